@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/travisjeffery/jocko/client"
+	"github.com/travisjeffery/jocko/jocko"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	sourceTopic   = "words"
+	sinkTopic     = "shouted_words"
+	groupID       = "shouter"
+	numPartitions = int32(4)
+	wordCount     = 100
+)
+
+func main() {
+	s, clean := setup()
+	defer clean()
+	addr := s.Addr().String()
+
+	producer := client.NewProducer(client.ProducerConfig{BrokerAddr: addr})
+	for i := 0; i < wordCount; i++ {
+		if err := producer.Send(&client.Record{Topic: sourceTopic, Value: []byte(fmt.Sprintf("hello #%d", i))}, nil); err != nil {
+			panic(err)
+		}
+	}
+	if err := producer.Close(); err != nil {
+		panic(err)
+	}
+
+	// each word's shouted exactly once, even if the pipeline's restarted
+	// midway: the shouted words and the source's offsets past them are
+	// committed in the same transactions
+	var partitions []client.TopicPartition
+	for i := int32(0); i < numPartitions; i++ {
+		partitions = append(partitions, client.TopicPartition{Topic: sourceTopic, Partition: i})
+	}
+	pipeline, err := client.NewPipeline(client.PipelineConfig{
+		GroupID:    groupID,
+		Partitions: partitions,
+		Transform: func(r *client.ConsumerRecord) ([]*client.Record, error) {
+			return []*client.Record{{Topic: sinkTopic, Key: r.Key, Value: bytes.ToUpper(r.Value)}}, nil
+		},
+		Consumer: client.ConsumerConfig{BrokerAddr: addr},
+		Producer: client.ProducerConfig{BrokerAddr: addr, TransactionalID: "shouter-1"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go pipeline.Run(ctx)
+
+	// the shouted words are read_committed, so only those of committed
+	// transactions are consumed
+	consumer := client.NewConsumer(client.ConsumerConfig{BrokerAddr: addr, IsolationLevel: protocol.ReadCommitted})
+	defer consumer.Close()
+	for i := int32(0); i < numPartitions; i++ {
+		consumer.Assign(sinkTopic, i, 0)
+	}
+	var shouted int
+	for shouted < wordCount {
+		records, err := consumer.Poll(time.Second)
+		if err != nil {
+			panic(err)
+		}
+		for _, r := range records {
+			fmt.Printf("partition [%d] offset [%d]: %s\n", r.Partition, r.Offset, r.Value)
+			shouted++
+		}
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "only %d of %d words shouted\n", shouted, wordCount)
+			os.Exit(1)
+		}
+	}
+	cancel()
+	if err := pipeline.Close(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("pipeline worked! %d words shouted exactly once\n", shouted)
+}
+
+func setup() (*jocko.Server, func()) {
+	c, cancel := jocko.NewTestServer(&testing.T{}, func(cfg *config.Config) {
+		cfg.Bootstrap = true
+		cfg.BootstrapExpect = 1
+		cfg.StartAsLeader = true
+	}, nil)
+	if err := c.Start(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start cluster: %v\n", err)
+		os.Exit(1)
+	}
+
+	conn, err := jocko.Dial("tcp", c.Addr().String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to broker: %v\n", err)
+		os.Exit(1)
+	}
+	var requests []*protocol.CreateTopicRequest
+	for _, topic := range []string{sourceTopic, sinkTopic} {
+		requests = append(requests, &protocol.CreateTopicRequest{
+			Topic:             topic,
+			NumPartitions:     numPartitions,
+			ReplicationFactor: 1,
+		})
+	}
+	resp, err := conn.CreateTopics(&protocol.CreateTopicRequests{Requests: requests})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed with request to broker: %v\n", err)
+		os.Exit(1)
+	}
+	for _, topicErrCode := range resp.TopicErrorCodes {
+		if topicErrCode.ErrorCode != protocol.ErrNone.Code() && topicErrCode.ErrorCode != protocol.ErrTopicAlreadyExists.Code() {
+			err := protocol.Errs[topicErrCode.ErrorCode]
+			fmt.Fprintf(os.Stderr, "error code: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	return c, func() {
+		cancel()
+		c.Shutdown()
+	}
+}
@@ -0,0 +1,475 @@
+// Package admin is a Go API for administering a cluster's topics, groups and
+// brokers, as an alternative to the Kafka protocol for infrastructure
+// automation. The service talks to the cluster over the Kafka protocol, so it
+// can run next to a broker or on its own. It isn't served over the network;
+// callers embed it and identify the principal of each call with WithPrincipal.
+// Topic configs, ACLs and partition reassignments aren't administered by it.
+package admin
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const requestTimeout = 10 * time.Second
+
+var (
+	// ErrPermissionDenied is returned when the caller isn't authorized for the call.
+	ErrPermissionDenied = errors.New("admin: permission denied")
+)
+
+// AllowAll authorizes every call. Only use it on trusted networks.
+var AllowAll = policy.AuthorizerFunc(func(string, policy.Operation, policy.ResourceType, string) bool { return true })
+
+type principalKey struct{}
+
+// WithPrincipal returns a context for calls made by the principal.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the principal the call is made by, or "" if it's anonymous.
+func Principal(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey{}).(string)
+	return p
+}
+
+// Client is the subset of a broker connection used by the service.
+type Client interface {
+	Metadata(*protocol.MetadataRequest) (*protocol.MetadataResponse, error)
+	CreateTopics(*protocol.CreateTopicRequests) (*protocol.CreateTopicsResponse, error)
+	DeleteTopics(*protocol.DeleteTopicsRequest) (*protocol.DeleteTopicsResponse, error)
+	ListGroups(*protocol.ListGroupsRequest) (*protocol.ListGroupsResponse, error)
+	DescribeGroups(*protocol.DescribeGroupsRequest) (*protocol.DescribeGroupsResponse, error)
+	DescribeTraffic(*protocol.DescribeTrafficRequest) (*protocol.DescribeTrafficResponse, error)
+	AlterPartitionReadOnly(*protocol.AlterPartitionReadOnlyRequest) (*protocol.AlterPartitionReadOnlyResponse, error)
+	AlterBrokerMaintenance(*protocol.AlterBrokerMaintenanceRequest) (*protocol.AlterBrokerMaintenanceResponse, error)
+	AlterFaultInjection(*protocol.AlterFaultInjectionRequest) (*protocol.AlterFaultInjectionResponse, error)
+	AlterOffsetsTopicPartitions(*protocol.AlterOffsetsTopicPartitionsRequest) (*protocol.AlterOffsetsTopicPartitionsResponse, error)
+	Close() error
+}
+
+// Config for the service.
+type Config struct {
+	// BrokerAddr is the address of a broker in the cluster.
+	BrokerAddr string
+	// Authorizer authorizes calls, the same as the brokers' requests. If nil
+	// every call is denied.
+	Authorizer policy.Authorizer
+	// Dial opens a connection to the broker at the address. Defaults to jocko.Dial.
+	Dial func(addr string) (Client, error)
+}
+
+// Service administers the cluster, authorizing each call against its caller.
+type Service struct {
+	config Config
+}
+
+// New returns the service for the config.
+func New(config Config) *Service {
+	if config.Dial == nil {
+		config.Dial = func(addr string) (Client, error) {
+			return jocko.Dial("tcp", addr)
+		}
+	}
+	return &Service{config: config}
+}
+
+func (s *Service) ListTopics(ctx context.Context, req *ListTopicsRequest) (*ListTopicsResponse, error) {
+	if err := s.authorize(ctx, policy.DescribeOperation, policy.ClusterResource, ""); err != nil {
+		return nil, err
+	}
+	var res *protocol.MetadataResponse
+	err := s.withConn(s.config.BrokerAddr, func(c Client) (err error) {
+		res, err = c.Metadata(&protocol.MetadataRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := &ListTopicsResponse{}
+	for _, t := range res.TopicMetadata {
+		if !s.authorized(ctx, policy.DescribeOperation, policy.TopicResource, t.Topic) {
+			continue
+		}
+		topic := &Topic{Name: t.Topic}
+		if !t.TopicID.IsZero() {
+			topic.Id = append([]byte(nil), t.TopicID[:]...)
+		}
+		for _, p := range t.PartitionMetadata {
+			topic.Partitions = append(topic.Partitions, &Partition{
+				Partition: p.PartitionID,
+				Leader:    p.Leader,
+				Replicas:  p.Replicas,
+				Isr:       p.ISR,
+			})
+		}
+		sort.Slice(topic.Partitions, func(i, j int) bool {
+			return topic.Partitions[i].Partition < topic.Partitions[j].Partition
+		})
+		out.Topics = append(out.Topics, topic)
+	}
+	sort.Slice(out.Topics, func(i, j int) bool { return out.Topics[i].Name < out.Topics[j].Name })
+	return out, nil
+}
+
+func (s *Service) CreateTopic(ctx context.Context, req *CreateTopicRequest) (*CreateTopicResponse, error) {
+	if err := s.authorize(ctx, policy.CreateOperation, policy.TopicResource, req.Name); err != nil {
+		return nil, err
+	}
+	configs := make(map[string]*string, len(req.Configs))
+	for k, v := range req.Configs {
+		v := v
+		configs[k] = &v
+	}
+	err := s.withController(func(c Client) error {
+		res, err := c.CreateTopics(&protocol.CreateTopicRequests{
+			Timeout: requestTimeout,
+			Requests: []*protocol.CreateTopicRequest{{
+				Topic:             req.Name,
+				NumPartitions:     req.Partitions,
+				ReplicationFactor: int16(req.ReplicationFactor),
+				Configs:           configs,
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		return topicError(res.TopicErrorCodes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &CreateTopicResponse{}, nil
+}
+
+func (s *Service) DeleteTopic(ctx context.Context, req *DeleteTopicRequest) (*DeleteTopicResponse, error) {
+	if err := s.authorize(ctx, policy.DeleteOperation, policy.TopicResource, req.Name); err != nil {
+		return nil, err
+	}
+	err := s.withController(func(c Client) error {
+		res, err := c.DeleteTopics(&protocol.DeleteTopicsRequest{
+			Timeout: requestTimeout,
+			Topics:  []string{req.Name},
+		})
+		if err != nil {
+			return err
+		}
+		return topicError(res.TopicErrorCodes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteTopicResponse{}, nil
+}
+
+func (s *Service) ListGroups(ctx context.Context, req *ListGroupsRequest) (*ListGroupsResponse, error) {
+	if err := s.authorize(ctx, policy.DescribeOperation, policy.ClusterResource, ""); err != nil {
+		return nil, err
+	}
+	var res *protocol.ListGroupsResponse
+	err := s.withConn(s.config.BrokerAddr, func(c Client) (err error) {
+		res, err = c.ListGroups(&protocol.ListGroupsRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.ErrorCode != protocol.ErrNone.Code() {
+		return nil, protocol.Errs[res.ErrorCode]
+	}
+	out := &ListGroupsResponse{}
+	for _, g := range res.Groups {
+		if s.authorized(ctx, policy.DescribeOperation, policy.GroupResource, g.GroupID) {
+			out.Groups = append(out.Groups, g.GroupID)
+		}
+	}
+	sort.Strings(out.Groups)
+	return out, nil
+}
+
+func (s *Service) DescribeGroup(ctx context.Context, req *DescribeGroupRequest) (*DescribeGroupResponse, error) {
+	if err := s.authorize(ctx, policy.DescribeOperation, policy.GroupResource, req.Group); err != nil {
+		return nil, err
+	}
+	var res *protocol.DescribeGroupsResponse
+	err := s.withConn(s.config.BrokerAddr, func(c Client) (err error) {
+		res, err = c.DescribeGroups(&protocol.DescribeGroupsRequest{GroupIDs: []string{req.Group}})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range res.Groups {
+		if g.GroupID != req.Group {
+			continue
+		}
+		if g.ErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[g.ErrorCode]
+		}
+		out := &DescribeGroupResponse{
+			Group:        g.GroupID,
+			State:        g.State,
+			ProtocolType: g.ProtocolType,
+			Protocol:     g.Protocol,
+		}
+		for id, m := range g.GroupMembers {
+			out.Members = append(out.Members, &Member{MemberId: id, ClientId: m.ClientID, ClientHost: m.ClientHost})
+		}
+		sort.Slice(out.Members, func(i, j int) bool { return out.Members[i].MemberId < out.Members[j].MemberId })
+		return out, nil
+	}
+	return nil, protocol.ErrInvalidGroupId
+}
+
+// DescribeTraffic returns the bytes produced to and consumed from each broker,
+// by topic and client ID. Topics the caller can't describe are left out.
+func (s *Service) DescribeTraffic(ctx context.Context, req *DescribeTrafficRequest) (*DescribeTrafficResponse, error) {
+	if err := s.authorize(ctx, policy.DescribeOperation, policy.ClusterResource, ""); err != nil {
+		return nil, err
+	}
+	var md *protocol.MetadataResponse
+	if err := s.withConn(s.config.BrokerAddr, func(c Client) (err error) {
+		md, err = c.Metadata(&protocol.MetadataRequest{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	out := &DescribeTrafficResponse{}
+	for _, b := range md.Brokers {
+		var res *protocol.DescribeTrafficResponse
+		if err := s.withConn(b.Addr(), func(c Client) (err error) {
+			res, err = c.DescribeTraffic(&protocol.DescribeTrafficRequest{})
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[res.ErrorCode]
+		}
+		bt := &BrokerTraffic{Broker: b.NodeID, WindowMs: int64(res.Window / time.Millisecond)}
+		for _, t := range res.Topics {
+			if s.authorized(ctx, policy.DescribeOperation, policy.TopicResource, t.Name) {
+				bt.Topics = append(bt.Topics, trafficStats(t))
+			}
+		}
+		for _, c := range res.Clients {
+			bt.Clients = append(bt.Clients, trafficStats(c))
+		}
+		out.Brokers = append(out.Brokers, bt)
+	}
+	sort.Slice(out.Brokers, func(i, j int) bool { return out.Brokers[i].Broker < out.Brokers[j].Broker })
+	return out, nil
+}
+
+// SetPartitionReadOnly puts the partition into or out of read-only mode, e.g.
+// while cutting over a reassignment.
+func (s *Service) SetPartitionReadOnly(ctx context.Context, req *SetPartitionReadOnlyRequest) (*SetPartitionReadOnlyResponse, error) {
+	if err := s.authorize(ctx, policy.AlterOperation, policy.TopicResource, req.Topic); err != nil {
+		return nil, err
+	}
+	err := s.withController(func(c Client) error {
+		res, err := c.AlterPartitionReadOnly(&protocol.AlterPartitionReadOnlyRequest{
+			Partitions: []*protocol.PartitionReadOnly{{
+				Topic:     req.Topic,
+				Partition: req.Partition,
+				ReadOnly:  req.ReadOnly,
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range res.Partitions {
+			if p.ErrorCode != protocol.ErrNone.Code() {
+				return protocol.Errs[p.ErrorCode]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SetPartitionReadOnlyResponse{}, nil
+}
+
+// SetBrokerMaintenance puts the broker into or out of maintenance mode, e.g.
+// for a kernel patching window. The broker stays in the cluster, but its
+// partitions' leadership is moved away and it isn't given new replicas.
+func (s *Service) SetBrokerMaintenance(ctx context.Context, req *SetBrokerMaintenanceRequest) (*SetBrokerMaintenanceResponse, error) {
+	if err := s.authorize(ctx, policy.AlterOperation, policy.ClusterResource, ""); err != nil {
+		return nil, err
+	}
+	out := &SetBrokerMaintenanceResponse{}
+	err := s.withController(func(c Client) error {
+		res, err := c.AlterBrokerMaintenance(&protocol.AlterBrokerMaintenanceRequest{
+			BrokerID:    req.Broker,
+			Maintenance: req.Maintenance,
+		})
+		if err != nil {
+			return err
+		}
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return protocol.Errs[res.ErrorCode]
+		}
+		out.MovedLeaders = res.Moved
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// InjectFault injects latency or errors into the broker's storage or network,
+// or removes them, for soak testing. The broker must be built with the
+// faultinject tag.
+func (s *Service) InjectFault(ctx context.Context, req *InjectFaultRequest) (*InjectFaultResponse, error) {
+	if err := s.authorize(ctx, policy.AlterOperation, policy.ClusterResource, ""); err != nil {
+		return nil, err
+	}
+	var md *protocol.MetadataResponse
+	if err := s.withConn(s.config.BrokerAddr, func(c Client) (err error) {
+		md, err = c.Metadata(&protocol.MetadataRequest{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	for _, b := range md.Brokers {
+		if b.NodeID != req.Broker {
+			continue
+		}
+		err := s.withConn(b.Addr(), func(c Client) error {
+			res, err := c.AlterFaultInjection(&protocol.AlterFaultInjectionRequest{
+				Faults: []*protocol.FaultInjection{{
+					Point: req.Point,
+					Delay: time.Duration(req.DelayMs) * time.Millisecond,
+					Error: req.Error,
+					Count: req.Count,
+				}},
+			})
+			if err != nil {
+				return err
+			}
+			for _, f := range res.Faults {
+				if f.ErrorCode != protocol.ErrNone.Code() {
+					return protocol.Errs[f.ErrorCode]
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &InjectFaultResponse{}, nil
+	}
+	return nil, protocol.ErrBrokerNotAvailable
+}
+
+// MigrateOffsetsTopic grows the offsets topic to the number of partitions,
+// handing off the groups hashed to other partitions to their new coordinators.
+// Run it with DryRun first to see which groups move. It's refused while groups
+// are rebalancing unless it's forced.
+func (s *Service) MigrateOffsetsTopic(ctx context.Context, req *MigrateOffsetsTopicRequest) (*MigrateOffsetsTopicResponse, error) {
+	if err := s.authorize(ctx, policy.AlterOperation, policy.ClusterResource, ""); err != nil {
+		return nil, err
+	}
+	out := &MigrateOffsetsTopicResponse{}
+	err := s.withController(func(c Client) error {
+		res, err := c.AlterOffsetsTopicPartitions(&protocol.AlterOffsetsTopicPartitionsRequest{
+			Partitions:   req.Partitions,
+			ValidateOnly: req.DryRun,
+			Force:        req.Force,
+		})
+		if err != nil {
+			return err
+		}
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return protocol.Errs[res.ErrorCode]
+		}
+		for _, m := range res.Moves {
+			out.Moves = append(out.Moves, &GroupMove{
+				Group:           m.GroupID,
+				FromPartition:   m.FromPartition,
+				ToPartition:     m.ToPartition,
+				FromCoordinator: m.FromCoordinator,
+				ToCoordinator:   m.ToCoordinator,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func trafficStats(s *protocol.TrafficStats) *TrafficStats {
+	return &TrafficStats{
+		Name:           s.Name,
+		BytesIn:        s.BytesIn,
+		BytesOut:       s.BytesOut,
+		WindowBytesIn:  s.WindowBytesIn,
+		WindowBytesOut: s.WindowBytesOut,
+	}
+}
+
+func (s *Service) authorize(ctx context.Context, op policy.Operation, typ policy.ResourceType, name string) error {
+	if !s.authorized(ctx, op, typ, name) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func (s *Service) authorized(ctx context.Context, op policy.Operation, typ policy.ResourceType, name string) bool {
+	if s.config.Authorizer == nil {
+		return false
+	}
+	return s.config.Authorizer.Authorize(Principal(ctx), op, typ, name)
+}
+
+// withController runs fn against each broker in the cluster until one of them
+// doesn't return ErrNotController, since only the controller manages topics.
+func (s *Service) withController(fn func(Client) error) error {
+	err := s.withConn(s.config.BrokerAddr, fn)
+	if err != protocol.ErrNotController {
+		return err
+	}
+	var res *protocol.MetadataResponse
+	if err := s.withConn(s.config.BrokerAddr, func(c Client) (err error) {
+		res, err = c.Metadata(&protocol.MetadataRequest{})
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, b := range res.Brokers {
+		err = s.withConn(b.Addr(), fn)
+		if err != protocol.ErrNotController {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Service) withConn(addr string, fn func(Client) error) error {
+	c, err := s.config.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return fn(c)
+}
+
+func topicError(codes []*protocol.TopicErrorCode) error {
+	for _, c := range codes {
+		if c.ErrorCode != protocol.ErrNone.Code() {
+			return protocol.Errs[c.ErrorCode]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package admin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fakeBroker is a broker at addr; it's the controller if controller is true.
+type fakeBroker struct {
+	addr        string
+	controller  bool
+	created     []string
+	readOnly    []string
+	maintenance []int32
+	faults      []string
+}
+
+func (b *fakeBroker) Metadata(req *protocol.MetadataRequest) (*protocol.MetadataResponse, error) {
+	return &protocol.MetadataResponse{
+		Brokers: []*protocol.Broker{
+			{NodeID: 1, Host: "localhost", Port: 9092},
+			{NodeID: 2, Host: "localhost", Port: 9093},
+		},
+		TopicMetadata: []*protocol.TopicMetadata{
+			{Topic: "public", PartitionMetadata: []*protocol.PartitionMetadata{{PartitionID: 1}, {PartitionID: 0}}},
+			{Topic: "secret"},
+		},
+	}, nil
+}
+
+func (b *fakeBroker) CreateTopics(req *protocol.CreateTopicRequests) (*protocol.CreateTopicsResponse, error) {
+	res := &protocol.CreateTopicsResponse{}
+	for _, r := range req.Requests {
+		code := protocol.ErrNone.Code()
+		if !b.controller {
+			code = protocol.ErrNotController.Code()
+		} else {
+			b.created = append(b.created, r.Topic)
+		}
+		res.TopicErrorCodes = append(res.TopicErrorCodes, &protocol.TopicErrorCode{Topic: r.Topic, ErrorCode: code})
+	}
+	return res, nil
+}
+
+func (b *fakeBroker) DeleteTopics(req *protocol.DeleteTopicsRequest) (*protocol.DeleteTopicsResponse, error) {
+	return &protocol.DeleteTopicsResponse{}, nil
+}
+
+func (b *fakeBroker) ListGroups(req *protocol.ListGroupsRequest) (*protocol.ListGroupsResponse, error) {
+	return &protocol.ListGroupsResponse{}, nil
+}
+
+func (b *fakeBroker) DescribeGroups(req *protocol.DescribeGroupsRequest) (*protocol.DescribeGroupsResponse, error) {
+	return &protocol.DescribeGroupsResponse{}, nil
+}
+
+func (b *fakeBroker) DescribeTraffic(req *protocol.DescribeTrafficRequest) (*protocol.DescribeTrafficResponse, error) {
+	return &protocol.DescribeTrafficResponse{
+		Window: time.Minute,
+		Topics: []*protocol.TrafficStats{
+			{Name: "public", BytesIn: 10, WindowBytesIn: 5},
+			{Name: "secret", BytesIn: 20},
+		},
+		Clients: []*protocol.TrafficStats{{Name: b.addr, BytesIn: 30}},
+	}, nil
+}
+
+func (b *fakeBroker) AlterPartitionReadOnly(req *protocol.AlterPartitionReadOnlyRequest) (*protocol.AlterPartitionReadOnlyResponse, error) {
+	res := &protocol.AlterPartitionReadOnlyResponse{}
+	for _, p := range req.Partitions {
+		code := protocol.ErrNone.Code()
+		if !b.controller {
+			code = protocol.ErrNotController.Code()
+		} else if p.ReadOnly {
+			b.readOnly = append(b.readOnly, p.Topic)
+		}
+		res.Partitions = append(res.Partitions, &protocol.AlterPartitionReadOnlyResult{Topic: p.Topic, Partition: p.Partition, ErrorCode: code})
+	}
+	return res, nil
+}
+
+func (b *fakeBroker) AlterBrokerMaintenance(req *protocol.AlterBrokerMaintenanceRequest) (*protocol.AlterBrokerMaintenanceResponse, error) {
+	if !b.controller {
+		return &protocol.AlterBrokerMaintenanceResponse{ErrorCode: protocol.ErrNotController.Code()}, nil
+	}
+	if req.Maintenance {
+		b.maintenance = append(b.maintenance, req.BrokerID)
+	}
+	return &protocol.AlterBrokerMaintenanceResponse{Moved: 2}, nil
+}
+
+func (b *fakeBroker) AlterFaultInjection(req *protocol.AlterFaultInjectionRequest) (*protocol.AlterFaultInjectionResponse, error) {
+	res := &protocol.AlterFaultInjectionResponse{}
+	for _, f := range req.Faults {
+		b.faults = append(b.faults, f.Point)
+		res.Faults = append(res.Faults, &protocol.AlterFaultInjectionResult{Point: f.Point})
+	}
+	return res, nil
+}
+
+func (b *fakeBroker) AlterOffsetsTopicPartitions(req *protocol.AlterOffsetsTopicPartitionsRequest) (*protocol.AlterOffsetsTopicPartitionsResponse, error) {
+	if !b.controller {
+		return &protocol.AlterOffsetsTopicPartitionsResponse{ErrorCode: protocol.ErrNotController.Code()}, nil
+	}
+	return &protocol.AlterOffsetsTopicPartitionsResponse{
+		Moves: []*protocol.GroupCoordinatorMove{{GroupID: "group", FromPartition: 1, ToPartition: 51, FromCoordinator: 1, ToCoordinator: 2}},
+	}, nil
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+func TestService(t *testing.T) {
+	req := require.New(t)
+	brokers := map[string]*fakeBroker{
+		"bootstrap:9092": {},
+		"localhost:9092": {},
+		"localhost:9093": {controller: true},
+	}
+	s := New(Config{
+		BrokerAddr: "bootstrap:9092",
+		Authorizer: policy.AuthorizerFunc(func(principal string, op policy.Operation, typ policy.ResourceType, name string) bool {
+			if principal != "admin" {
+				return false
+			}
+			return name != "secret"
+		}),
+		Dial: func(addr string) (Client, error) {
+			return brokers[addr], nil
+		},
+	})
+
+	_, err := s.ListTopics(context.Background(), &ListTopicsRequest{})
+	req.Equal(ErrPermissionDenied, err)
+
+	ctx := WithPrincipal(context.Background(), "admin")
+	res, err := s.ListTopics(ctx, &ListTopicsRequest{})
+	req.NoError(err)
+	req.Equal(1, len(res.Topics))
+	req.Equal("public", res.Topics[0].Name)
+	req.Equal(int32(0), res.Topics[0].Partitions[0].Partition)
+
+	_, err = s.CreateTopic(ctx, &CreateTopicRequest{Name: "secret", Partitions: 1, ReplicationFactor: 1})
+	req.Equal(ErrPermissionDenied, err)
+
+	// the bootstrap broker isn't the controller so the service finds it
+	_, err = s.CreateTopic(ctx, &CreateTopicRequest{Name: "new-topic", Partitions: 1, ReplicationFactor: 1})
+	req.NoError(err)
+	req.Equal([]string{"new-topic"}, brokers["localhost:9093"].created)
+
+	traffic, err := s.DescribeTraffic(ctx, &DescribeTrafficRequest{})
+	req.NoError(err)
+	req.Equal(2, len(traffic.Brokers))
+	req.Equal(int32(1), traffic.Brokers[0].Broker)
+	req.Equal(int64(60000), traffic.Brokers[0].WindowMs)
+	req.Equal([]*TrafficStats{{Name: "public", BytesIn: 10, WindowBytesIn: 5}}, traffic.Brokers[0].Topics)
+
+	_, err = s.SetPartitionReadOnly(ctx, &SetPartitionReadOnlyRequest{Topic: "secret", ReadOnly: true})
+	req.Equal(ErrPermissionDenied, err)
+
+	_, err = s.SetPartitionReadOnly(ctx, &SetPartitionReadOnlyRequest{Topic: "public", ReadOnly: true})
+	req.NoError(err)
+	req.Equal([]string{"public"}, brokers["localhost:9093"].readOnly)
+
+	maintenance, err := s.SetBrokerMaintenance(ctx, &SetBrokerMaintenanceRequest{Broker: 1, Maintenance: true})
+	req.NoError(err)
+	req.Equal(int32(2), maintenance.MovedLeaders)
+	req.Equal([]int32{1}, brokers["localhost:9093"].maintenance)
+
+	_, err = s.SetBrokerMaintenance(context.Background(), &SetBrokerMaintenanceRequest{Broker: 1, Maintenance: true})
+	req.Equal(ErrPermissionDenied, err)
+
+	// sent to the broker itself rather than the controller
+	_, err = s.InjectFault(ctx, &InjectFaultRequest{Broker: 2, Point: "network write", DelayMs: 100})
+	req.NoError(err)
+	req.Equal([]string{"network write"}, brokers["localhost:9093"].faults)
+
+	_, err = s.InjectFault(ctx, &InjectFaultRequest{Broker: 3, Point: "network write", DelayMs: 100})
+	req.Equal(protocol.ErrBrokerNotAvailable, err)
+
+	migration, err := s.MigrateOffsetsTopic(ctx, &MigrateOffsetsTopicRequest{Partitions: 100, DryRun: true})
+	req.NoError(err)
+	req.Equal([]*GroupMove{{Group: "group", FromPartition: 1, ToPartition: 51, FromCoordinator: 1, ToCoordinator: 2}}, migration.Moves)
+}
@@ -0,0 +1,133 @@
+package admin
+
+// The request and response messages of the Service's calls.
+
+type Partition struct {
+	Partition int32
+	Leader    int32
+	Replicas  []int32
+	Isr       []int32
+}
+
+type Topic struct {
+	Name       string
+	Id         []byte
+	Partitions []*Partition
+}
+
+type ListTopicsRequest struct{}
+
+type ListTopicsResponse struct {
+	Topics []*Topic
+}
+
+type CreateTopicRequest struct {
+	Name              string
+	Partitions        int32
+	ReplicationFactor int32
+	Configs           map[string]string
+}
+
+type CreateTopicResponse struct{}
+
+type DeleteTopicRequest struct {
+	Name string
+}
+
+type DeleteTopicResponse struct{}
+
+type ListGroupsRequest struct{}
+
+type ListGroupsResponse struct {
+	Groups []string
+}
+
+type DescribeGroupRequest struct {
+	Group string
+}
+
+type Member struct {
+	MemberId   string
+	ClientId   string
+	ClientHost string
+}
+
+type DescribeGroupResponse struct {
+	Group        string
+	State        string
+	ProtocolType string
+	Protocol     string
+	Members      []*Member
+}
+
+type DescribeTrafficRequest struct{}
+
+// TrafficStats are the bytes produced and consumed for a topic or client ID,
+// since the broker started and within its window.
+type TrafficStats struct {
+	Name           string
+	BytesIn        int64
+	BytesOut       int64
+	WindowBytesIn  int64
+	WindowBytesOut int64
+}
+
+type BrokerTraffic struct {
+	Broker   int32
+	WindowMs int64
+	Topics   []*TrafficStats
+	Clients  []*TrafficStats
+}
+
+type DescribeTrafficResponse struct {
+	Brokers []*BrokerTraffic
+}
+
+type SetPartitionReadOnlyRequest struct {
+	Topic     string
+	Partition int32
+	ReadOnly  bool
+}
+
+type SetPartitionReadOnlyResponse struct{}
+
+type SetBrokerMaintenanceRequest struct {
+	Broker      int32
+	Maintenance bool
+}
+
+type SetBrokerMaintenanceResponse struct {
+	MovedLeaders int32
+}
+
+// InjectFaultRequest injects latency or errors at a point in the broker's
+// storage ("segment write", "segment sync", "segment read", "index write",
+// "index sync") or network ("network read", "network write"). A fault without a
+// delay or error removes the point's fault.
+type InjectFaultRequest struct {
+	Broker  int32
+	Point   string
+	DelayMs int64
+	Error   bool
+	Count   int32
+}
+
+type InjectFaultResponse struct{}
+
+type MigrateOffsetsTopicRequest struct {
+	Partitions int32
+	DryRun     bool
+	Force      bool
+}
+
+type GroupMove struct {
+	Group           string
+	FromPartition   int32
+	ToPartition     int32
+	FromCoordinator int32
+	ToCoordinator   int32
+}
+
+type MigrateOffsetsTopicResponse struct {
+	Moves []*GroupMove
+}
@@ -0,0 +1,216 @@
+// Package archive exports the records in a partition's commit log to JSONL or
+// Parquet files, so historical topic data can be analyzed without running a
+// consumer.
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+// Format is the file format records are exported as.
+type Format string
+
+const (
+	// JSONL writes one JSON object per record, separated by newlines.
+	JSONL Format = "jsonl"
+	// Parquet writes the records as rows of offset, timestamp, key and
+	// value columns.
+	Parquet Format = "parquet"
+)
+
+// Encoding is how a record's key or value is written.
+type Encoding string
+
+const (
+	// BytesEncoding writes the raw bytes, base64 encoded in JSONL.
+	BytesEncoding Encoding = "bytes"
+	// StringEncoding writes the bytes as a string, a UTF8 column in Parquet.
+	StringEncoding Encoding = "string"
+)
+
+// Options for exporting records.
+type Options struct {
+	// Format defaults to JSONL.
+	Format Format
+	// KeyEncoding defaults to BytesEncoding.
+	KeyEncoding Encoding
+	// ValueEncoding defaults to BytesEncoding.
+	ValueEncoding Encoding
+}
+
+// record is an exported record. Timestamp is in milliseconds and nil for v0
+// messages, which don't have one. Key and Value are nil when they're null in
+// the message.
+type record struct {
+	Offset    int64
+	Timestamp *int64
+	Key       []byte
+	Value     []byte
+}
+
+// recordWriter writes records in a format.
+type recordWriter interface {
+	write(r *record) error
+	flush() error
+}
+
+// Archiver writes records read from commit log segments.
+type Archiver struct {
+	opts Options
+	w    recordWriter
+}
+
+// New returns an archiver that writes to w. Call Flush when done writing,
+// which finishes the file for formats with a footer, like Parquet.
+func New(w io.Writer, opts Options) (*Archiver, error) {
+	if opts.Format == "" {
+		opts.Format = JSONL
+	}
+	if opts.KeyEncoding == "" {
+		opts.KeyEncoding = BytesEncoding
+	}
+	if opts.ValueEncoding == "" {
+		opts.ValueEncoding = BytesEncoding
+	}
+	for _, e := range []Encoding{opts.KeyEncoding, opts.ValueEncoding} {
+		if e != BytesEncoding && e != StringEncoding {
+			return nil, fmt.Errorf("archive: unsupported encoding: %s", e)
+		}
+	}
+	a := &Archiver{opts: opts}
+	switch opts.Format {
+	case JSONL:
+		a.w = newJSONLWriter(w, opts)
+	case Parquet:
+		a.w = newParquetWriter(w, opts)
+	default:
+		return nil, fmt.Errorf("archive: unsupported format: %s", opts.Format)
+	}
+	return a, nil
+}
+
+// WriteDir writes every record in the segments of the log in the directory
+// and returns the number of records written. The log isn't opened, so its
+// files are left as they are, e.g. a torn write at the end of the log isn't
+// truncated, and it can be a copy of a running broker's log.
+func (a *Archiver) WriteDir(path string) (n int, err error) {
+	err = commitlog.ReadLog(path, func(ms commitlog.MessageSet) error {
+		nn, err := a.writeMessageSet(ms)
+		n += nn
+		return err
+	})
+	if err != nil {
+		return n, errors.Wrapf(err, "archive: reading log %s", path)
+	}
+	return n, nil
+}
+
+// WriteLog writes every record in the log's segments and returns the number of
+// records written.
+func (a *Archiver) WriteLog(l *commitlog.CommitLog) (n int, err error) {
+	for _, s := range l.Segments() {
+		nn, err := a.WriteSegment(s)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteSegment writes every record in the segment and returns the number of
+// records written.
+func (a *Archiver) WriteSegment(s *commitlog.Segment) (n int, err error) {
+	scanner := commitlog.NewSegmentScanner(s)
+	for {
+		ms, err := scanner.Scan()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "archive: scanning segment %d", s.BaseOffset)
+		}
+		nn, err := a.writeMessageSet(ms)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// writeMessageSet writes the message set's records and returns the number
+// written.
+func (a *Archiver) writeMessageSet(ms commitlog.MessageSet) (n int, err error) {
+	for _, msg := range ms.Messages() {
+		r := &record{
+			Offset: ms.Offset(),
+			Key:    msg.Key(),
+			Value:  msg.Value(),
+		}
+		if msg.MagicByte() > 0 {
+			ts := msg.Timestamp()
+			r.Timestamp = &ts
+		}
+		if err = a.w.write(r); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Flush writes any buffered records to the underlying writer. Parquet files
+// are finished by it, so nothing can be written after.
+func (a *Archiver) Flush() error {
+	return a.w.flush()
+}
+
+// jsonlWriter writes records as JSON objects.
+type jsonlWriter struct {
+	opts Options
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+// jsonRecord is a record as it's written in JSONL. Timestamp is left out for
+// v0 messages and Key and Value are null when they're null in the message.
+type jsonRecord struct {
+	Offset    int64       `json:"offset"`
+	Timestamp *int64      `json:"timestamp,omitempty"`
+	Key       interface{} `json:"key"`
+	Value     interface{} `json:"value"`
+}
+
+func newJSONLWriter(w io.Writer, opts Options) *jsonlWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonlWriter{opts: opts, w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (w *jsonlWriter) write(r *record) error {
+	return w.enc.Encode(jsonRecord{
+		Offset:    r.Offset,
+		Timestamp: r.Timestamp,
+		Key:       encode(r.Key, w.opts.KeyEncoding),
+		Value:     encode(r.Value, w.opts.ValueEncoding),
+	})
+}
+
+func (w *jsonlWriter) flush() error {
+	return w.w.Flush()
+}
+
+func encode(b []byte, e Encoding) interface{} {
+	if b == nil {
+		return nil
+	}
+	if e == StringEncoding {
+		return string(b)
+	}
+	return b
+}
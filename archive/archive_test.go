@@ -0,0 +1,243 @@
+package archive_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/archive"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestArchiverJSONL(t *testing.T) {
+	req := require.New(t)
+
+	path, err := ioutil.TempDir("", "archivetest")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 50,
+		MaxLogBytes:     -1,
+	})
+	req.NoError(err)
+
+	ts := time.Unix(1500000000, 0)
+	for i, value := range []string{"one", "two", "three"} {
+		b, err := protocol.Encode(&protocol.Message{
+			Key:       []byte("key"),
+			Value:     []byte(value),
+			MagicByte: 1,
+			Timestamp: ts,
+		})
+		req.NoError(err)
+		_, err = l.Append(commitlog.NewMessageSet(uint64(i), b))
+		req.NoError(err)
+	}
+	req.True(len(l.Segments()) > 1)
+
+	buf := new(bytes.Buffer)
+	a, err := archive.New(buf, archive.Options{
+		KeyEncoding:   archive.StringEncoding,
+		ValueEncoding: archive.BytesEncoding,
+	})
+	req.NoError(err)
+	n, err := a.WriteLog(l)
+	req.NoError(err)
+	req.Equal(3, n)
+	req.NoError(a.Flush())
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var r map[string]interface{}
+		req.NoError(json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	req.Equal(3, len(records))
+	req.Equal(float64(2), records[2]["offset"])
+	req.Equal(float64(1500000000000), records[2]["timestamp"])
+	req.Equal("key", records[2]["key"])
+	// bytes are base64 encoded
+	req.Equal("dGhyZWU=", records[2]["value"])
+}
+
+func TestArchiverUnsupportedFormat(t *testing.T) {
+	_, err := archive.New(new(bytes.Buffer), archive.Options{Format: "csv"})
+	require.Error(t, err)
+}
+
+func TestArchiverParquet(t *testing.T) {
+	req := require.New(t)
+
+	path, err := ioutil.TempDir("", "archivetest")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 50,
+		MaxLogBytes:     -1,
+	})
+	req.NoError(err)
+	ts := time.Unix(1500000000, 0)
+	for i, key := range []string{"one", "", "three"} {
+		msg := &protocol.Message{Value: []byte("value"), MagicByte: 1, Timestamp: ts}
+		if key != "" {
+			msg.Key = []byte(key)
+		}
+		b, err := protocol.Encode(msg)
+		req.NoError(err)
+		_, err = l.Append(commitlog.NewMessageSet(uint64(i), b))
+		req.NoError(err)
+	}
+	req.NoError(l.Close())
+
+	buf := new(bytes.Buffer)
+	a, err := archive.New(buf, archive.Options{Format: archive.Parquet, KeyEncoding: archive.StringEncoding})
+	req.NoError(err)
+	n, err := a.WriteDir(path)
+	req.NoError(err)
+	req.Equal(3, n)
+	req.NoError(a.Flush())
+
+	file := buf.Bytes()
+	req.Equal("PAR1", string(file[:4]))
+	req.Equal("PAR1", string(file[len(file)-4:]))
+	size := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	p := newThriftReader(file[len(file)-8-size : len(file)-8])
+
+	var names []string
+	var rows int64
+	pages := make(map[string]int64)
+	readStruct(t, p, func(id int16, typ thrift.TType) {
+		switch id {
+		case 2:
+			readList(t, p, func() {
+				readStruct(t, p, func(id int16, typ thrift.TType) {
+					if id == 4 {
+						name, err := p.ReadString()
+						req.NoError(err)
+						names = append(names, name)
+						return
+					}
+					req.NoError(p.Skip(typ))
+				})
+			})
+		case 3:
+			rows, err = p.ReadI64()
+			req.NoError(err)
+		case 4:
+			readList(t, p, func() {
+				readStruct(t, p, func(id int16, typ thrift.TType) {
+					if id != 1 {
+						req.NoError(p.Skip(typ))
+						return
+					}
+					readList(t, p, func() {
+						var offset int64
+						var name string
+						readStruct(t, p, func(id int16, typ thrift.TType) {
+							if id != 3 {
+								req.NoError(p.Skip(typ))
+								return
+							}
+							readStruct(t, p, func(id int16, typ thrift.TType) {
+								switch id {
+								case 3:
+									readList(t, p, func() {
+										name, err = p.ReadString()
+										req.NoError(err)
+									})
+								case 9:
+									offset, err = p.ReadI64()
+									req.NoError(err)
+								default:
+									req.NoError(p.Skip(typ))
+								}
+							})
+						})
+						pages[name] = offset
+					})
+				})
+			})
+		default:
+			req.NoError(p.Skip(typ))
+		}
+	})
+	req.Equal([]string{"schema", "offset", "timestamp", "key", "value"}, names)
+	req.Equal(int64(3), rows)
+
+	offsets := readPage(t, file[pages["offset"]:])
+	req.Len(offsets, 24)
+	for i := 0; i < 3; i++ {
+		req.Equal(uint64(i), binary.LittleEndian.Uint64(offsets[i*8:]))
+	}
+	// the key column's definition levels, 2 bytes bit packing 3 levels, then
+	// its two values
+	keys := readPage(t, file[pages["key"]:])
+	req.Equal(uint32(2), binary.LittleEndian.Uint32(keys))
+	req.Equal([]byte{3, 5}, keys[4:6])
+	req.Equal(uint32(3), binary.LittleEndian.Uint32(keys[6:]))
+	req.Equal("one", string(keys[10:13]))
+	req.Equal("three", string(keys[17:]))
+
+	// nothing's written once the file's finished
+	_, err = a.WriteDir(path)
+	req.Error(err)
+}
+
+func newThriftReader(b []byte) *thrift.TCompactProtocol {
+	buf := thrift.NewTMemoryBuffer()
+	buf.Write(b)
+	return thrift.NewTCompactProtocol(buf)
+}
+
+// readPage skips the page header at the start of b and returns the page.
+func readPage(t *testing.T, b []byte) []byte {
+	buf := thrift.NewTMemoryBuffer()
+	buf.Write(b)
+	p := thrift.NewTCompactProtocol(buf)
+	var size int32
+	readStruct(t, p, func(id int16, typ thrift.TType) {
+		if id == 3 {
+			var err error
+			size, err = p.ReadI32()
+			require.NoError(t, err)
+			return
+		}
+		require.NoError(t, p.Skip(typ))
+	})
+	return buf.Bytes()[:size]
+}
+
+func readStruct(t *testing.T, p *thrift.TCompactProtocol, fn func(id int16, typ thrift.TType)) {
+	_, err := p.ReadStructBegin()
+	require.NoError(t, err)
+	for {
+		_, typ, id, err := p.ReadFieldBegin()
+		require.NoError(t, err)
+		if typ == thrift.STOP {
+			break
+		}
+		fn(id, typ)
+	}
+	require.NoError(t, p.ReadStructEnd())
+}
+
+func readList(t *testing.T, p *thrift.TCompactProtocol, fn func()) {
+	_, n, err := p.ReadListBegin()
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		fn()
+	}
+}
@@ -0,0 +1,353 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/apache/thrift/lib/go/thrift"
+)
+
+// Parquet files are written uncompressed and plain encoded, one data page per
+// column chunk, in row groups of about rowGroupBytes. Their metadata is thrift
+// compact encoded like the format specifies.
+
+const (
+	parquetMagic  = "PAR1"
+	rowGroupBytes = 64 << 20
+)
+
+// The values of the format's thrift enums that are used.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetNoConversion    = -1
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+var errParquetFinished = errors.New("archive: parquet file already finished")
+
+// parquetColumn is a column and the values buffered for the row group being
+// written.
+type parquetColumn struct {
+	name      string
+	typ       int32
+	optional  bool
+	converted int32
+	// defined holds whether each of an optional column's rows has a value,
+	// and values has the ones that do plain encoded.
+	defined []bool
+	values  bytes.Buffer
+}
+
+func (c *parquetColumn) int64(v *int64) {
+	c.defined = append(c.defined, v != nil)
+	if v != nil {
+		binary.Write(&c.values, binary.LittleEndian, *v)
+	}
+}
+
+func (c *parquetColumn) byteArray(b []byte) {
+	c.defined = append(c.defined, b != nil)
+	if b != nil {
+		binary.Write(&c.values, binary.LittleEndian, uint32(len(b)))
+		c.values.Write(b)
+	}
+}
+
+// parquetChunk is where a column chunk's page was written.
+type parquetChunk struct {
+	offset, size, values int64
+}
+
+type parquetRowGroup struct {
+	rows, size int64
+	chunks     []parquetChunk
+}
+
+// parquetWriter writes records as a Parquet file, buffering a row group's
+// records until it's written.
+type parquetWriter struct {
+	w        *bufio.Writer
+	position int64
+	columns  []*parquetColumn
+	rows     int64
+	buffered int
+	groups   []parquetRowGroup
+	finished bool
+}
+
+func newParquetWriter(w io.Writer, opts Options) *parquetWriter {
+	converted := func(e Encoding) int32 {
+		if e == StringEncoding {
+			return parquetUTF8
+		}
+		return parquetNoConversion
+	}
+	return &parquetWriter{
+		w: bufio.NewWriter(w),
+		columns: []*parquetColumn{
+			{name: "offset", typ: parquetInt64, converted: parquetNoConversion},
+			{name: "timestamp", typ: parquetInt64, optional: true, converted: parquetTimestampMillis},
+			{name: "key", typ: parquetByteArray, optional: true, converted: converted(opts.KeyEncoding)},
+			{name: "value", typ: parquetByteArray, optional: true, converted: converted(opts.ValueEncoding)},
+		},
+	}
+}
+
+func (w *parquetWriter) write(r *record) error {
+	if w.finished {
+		return errParquetFinished
+	}
+	if w.position == 0 {
+		if err := w.writeBytes([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+	w.columns[0].int64(&r.Offset)
+	w.columns[1].int64(r.Timestamp)
+	w.columns[2].byteArray(r.Key)
+	w.columns[3].byteArray(r.Value)
+	w.rows++
+	w.buffered += 16 + len(r.Key) + len(r.Value)
+	if w.buffered >= rowGroupBytes {
+		return w.writeRowGroup()
+	}
+	return nil
+}
+
+// flush writes the buffered rows and the file's footer.
+func (w *parquetWriter) flush() error {
+	if w.finished {
+		return errParquetFinished
+	}
+	w.finished = true
+	if w.position == 0 {
+		if err := w.writeBytes([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+	if w.rows > 0 {
+		if err := w.writeRowGroup(); err != nil {
+			return err
+		}
+	}
+	footer, err := w.footer()
+	if err != nil {
+		return err
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(footer)))
+	for _, b := range [][]byte{footer, size, []byte(parquetMagic)} {
+		if err := w.writeBytes(b); err != nil {
+			return err
+		}
+	}
+	return w.w.Flush()
+}
+
+// writeRowGroup writes the buffered rows as a row group, each column's values
+// as a data page.
+func (w *parquetWriter) writeRowGroup() error {
+	g := parquetRowGroup{rows: w.rows}
+	for _, c := range w.columns {
+		page := new(bytes.Buffer)
+		if c.optional {
+			levels := definitionLevels(c.defined)
+			binary.Write(page, binary.LittleEndian, uint32(len(levels)))
+			page.Write(levels)
+		}
+		page.Write(c.values.Bytes())
+		header, err := pageHeader(w.rows, page.Len())
+		if err != nil {
+			return err
+		}
+		chunk := parquetChunk{offset: w.position, size: int64(len(header) + page.Len()), values: w.rows}
+		if err := w.writeBytes(header); err != nil {
+			return err
+		}
+		if err := w.writeBytes(page.Bytes()); err != nil {
+			return err
+		}
+		g.chunks = append(g.chunks, chunk)
+		g.size += chunk.size
+		c.defined = c.defined[:0]
+		c.values.Reset()
+	}
+	w.groups = append(w.groups, g)
+	w.rows, w.buffered = 0, 0
+	return nil
+}
+
+func (w *parquetWriter) writeBytes(b []byte) error {
+	n, err := w.w.Write(b)
+	w.position += int64(n)
+	return err
+}
+
+// definitionLevels encodes whether each of the rows has a value as bit packed
+// runs of the format's RLE/bit packing hybrid encoding, with a bit width of 1.
+func definitionLevels(defined []bool) []byte {
+	groups := (len(defined) + 7) / 8
+	b := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+groups)
+	b = b[:binary.PutUvarint(b, uint64(groups)<<1|1)]
+	packed := make([]byte, groups)
+	for i, d := range defined {
+		if d {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return append(b, packed...)
+}
+
+func pageHeader(rows int64, size int) ([]byte, error) {
+	t := newThriftWriter()
+	t.begin()
+	t.i32(1, parquetDataPage)
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.field(5, thrift.STRUCT)
+	t.begin()
+	t.i32(1, int32(rows))
+	t.i32(2, parquetPlain)
+	t.i32(3, parquetRLE)
+	t.i32(4, parquetRLE)
+	t.end()
+	t.end()
+	return t.bytes()
+}
+
+// footer returns the file's metadata: its schema and where its row groups'
+// column chunks are.
+func (w *parquetWriter) footer() ([]byte, error) {
+	t := newThriftWriter()
+	t.begin()
+	t.i32(1, 1)
+	t.list(2, thrift.STRUCT, len(w.columns)+1)
+	t.begin()
+	t.str(4, "schema")
+	t.i32(5, int32(len(w.columns)))
+	t.end()
+	for _, c := range w.columns {
+		t.begin()
+		t.i32(1, c.typ)
+		if c.optional {
+			t.i32(3, parquetOptional)
+		} else {
+			t.i32(3, parquetRequired)
+		}
+		t.str(4, c.name)
+		if c.converted != parquetNoConversion {
+			t.i32(6, c.converted)
+		}
+		t.end()
+	}
+	var rows int64
+	for _, g := range w.groups {
+		rows += g.rows
+	}
+	t.i64(3, rows)
+	t.list(4, thrift.STRUCT, len(w.groups))
+	for _, g := range w.groups {
+		t.begin()
+		t.list(1, thrift.STRUCT, len(g.chunks))
+		for i, chunk := range g.chunks {
+			c := w.columns[i]
+			t.begin()
+			t.i64(2, chunk.offset)
+			t.field(3, thrift.STRUCT)
+			t.begin()
+			t.i32(1, c.typ)
+			t.list(2, thrift.I32, 2)
+			t.do(t.p.WriteI32(parquetPlain))
+			t.do(t.p.WriteI32(parquetRLE))
+			t.list(3, thrift.STRING, 1)
+			t.do(t.p.WriteString(c.name))
+			t.i32(4, parquetUncompressed)
+			t.i64(5, chunk.values)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.end()
+	}
+	t.str(6, "jocko")
+	t.end()
+	return t.bytes()
+}
+
+// thriftWriter writes thrift compact encoded structs, keeping the first error.
+type thriftWriter struct {
+	buf *thrift.TMemoryBuffer
+	p   *thrift.TCompactProtocol
+	err error
+}
+
+func newThriftWriter() *thriftWriter {
+	buf := thrift.NewTMemoryBuffer()
+	return &thriftWriter{buf: buf, p: thrift.NewTCompactProtocol(buf)}
+}
+
+func (t *thriftWriter) do(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *thriftWriter) begin() {
+	t.do(t.p.WriteStructBegin(""))
+}
+
+func (t *thriftWriter) end() {
+	t.do(t.p.WriteFieldStop())
+	t.do(t.p.WriteStructEnd())
+}
+
+func (t *thriftWriter) field(id int16, typ thrift.TType) {
+	t.do(t.p.WriteFieldBegin("", typ, id))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thrift.I32)
+	t.do(t.p.WriteI32(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thrift.I64)
+	t.do(t.p.WriteI64(v))
+}
+
+func (t *thriftWriter) str(id int16, v string) {
+	t.field(id, thrift.STRING)
+	t.do(t.p.WriteString(v))
+}
+
+func (t *thriftWriter) list(id int16, elem thrift.TType, n int) {
+	t.field(id, thrift.LIST)
+	t.do(t.p.WriteListBegin(elem, n))
+}
+
+func (t *thriftWriter) bytes() ([]byte, error) {
+	t.do(t.p.Flush())
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.buf.Bytes(), nil
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"crypto/rand"
+	"sync"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// Chunked records' values are split over a run of records to the same
+// partition, marked with protocol.ChunkAttribute. Messages don't have headers
+// before message format v2, so each chunk's value starts with its header: the
+// chunked value's ID, the chunk's index, the number of chunks, and the chunked
+// value's size.
+const chunkHeaderLen = 16 + 4 + 4 + 4
+
+type chunkHeader struct {
+	id    [16]byte
+	index int32
+	count int32
+	size  int32
+}
+
+// chunkValue splits the value into chunks of up to size bytes, not counting
+// their headers.
+func chunkValue(value []byte, size int) [][]byte {
+	var h chunkHeader
+	rand.Read(h.id[:])
+	h.count = int32((len(value) + size - 1) / size)
+	h.size = int32(len(value))
+	chunks := make([][]byte, 0, h.count)
+	for h.index = 0; h.index < h.count; h.index++ {
+		data := value[int(h.index)*size:]
+		if len(data) > size {
+			data = data[:size]
+		}
+		chunk := make([]byte, chunkHeaderLen, chunkHeaderLen+len(data))
+		copy(chunk, h.id[:])
+		protocol.Encoding.PutUint32(chunk[16:], uint32(h.index))
+		protocol.Encoding.PutUint32(chunk[20:], uint32(h.count))
+		protocol.Encoding.PutUint32(chunk[24:], uint32(h.size))
+		chunks = append(chunks, append(chunk, data...))
+	}
+	return chunks
+}
+
+// parseChunk returns the chunk's header and data, and false if the chunk's
+// value is malformed.
+func parseChunk(value []byte) (chunkHeader, []byte, bool) {
+	var h chunkHeader
+	if len(value) < chunkHeaderLen {
+		return h, nil, false
+	}
+	copy(h.id[:], value[:16])
+	h.index = int32(protocol.Encoding.Uint32(value[16:]))
+	h.count = int32(protocol.Encoding.Uint32(value[20:]))
+	h.size = int32(protocol.Encoding.Uint32(value[24:]))
+	if h.count <= 0 || h.index < 0 || h.index >= h.count || h.size < 0 {
+		return h, nil, false
+	}
+	return h, value[chunkHeaderLen:], true
+}
+
+// chunkCallback calls the chunked record's callback once all its chunks are
+// acknowledged, with the last chunk's offset, or with the first error a chunk
+// failed with. Chunks that couldn't be added are failed by calling it with
+// their error once for each.
+func chunkCallback(chunks int, callback Callback) Callback {
+	if callback == nil {
+		return nil
+	}
+	var mu sync.Mutex
+	var firstErr error
+	return func(partition int32, offset int64, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if chunks--; chunks > 0 {
+			return
+		}
+		if firstErr != nil {
+			offset = -1
+		}
+		callback(partition, offset, firstErr)
+	}
+}
+
+// ChunkAssembler puts chunked records' values back together as they're
+// consumed, for consumers of topics produced to with ProducerConfig's
+// ChunkBytes set. A partition's chunks have to be added in the order they were
+// consumed in.
+type ChunkAssembler struct {
+	maxBytes int
+	pending  map[chunkKey]*assembly
+	// order is the pending values' keys, oldest first, to drop the oldest
+	// when they take up more than maxBytes.
+	order []chunkKey
+	bytes int
+}
+
+type chunkKey struct {
+	topic     string
+	partition int32
+	id        [16]byte
+}
+
+type assembly struct {
+	value []byte
+	next  int32
+	count int32
+}
+
+// NewChunkAssembler returns an assembler holding up to maxBytes of chunks
+// waiting for the rest of their values. The oldest partial values are dropped
+// past it, e.g. ones whose producer failed partway through sending them, and
+// values bigger than it are dropped. 0 for no limit.
+func NewChunkAssembler(maxBytes int) *ChunkAssembler {
+	return &ChunkAssembler{maxBytes: maxBytes, pending: make(map[chunkKey]*assembly)}
+}
+
+// Add adds a message consumed from the topic's partition. It returns its value
+// and true if the message isn't a chunk, the whole chunked value and true if
+// it's the value's last chunk, and false otherwise.
+func (a *ChunkAssembler) Add(topic string, partition int32, m commitlog.Message) ([]byte, bool) {
+	if m.Attributes()&protocol.ChunkAttribute == 0 {
+		return m.Value(), true
+	}
+	h, data, ok := parseChunk(m.Value())
+	if !ok || (a.maxBytes > 0 && int(h.size) > a.maxBytes) {
+		return nil, false
+	}
+	key := chunkKey{topic: topic, partition: partition, id: h.id}
+	as, ok := a.pending[key]
+	if !ok || h.index == 0 {
+		if ok {
+			a.remove(key)
+		}
+		if h.index != 0 {
+			// its earlier chunks were dropped or consumed before starting
+			return nil, false
+		}
+		as = &assembly{value: make([]byte, 0, h.size), count: h.count}
+		a.pending[key] = as
+		a.order = append(a.order, key)
+	}
+	if h.index != as.next || h.count != as.count || len(as.value)+len(data) > cap(as.value) {
+		// a chunk's missing, or the chunks are bigger than the value, so it
+		// can't be put back together
+		a.remove(key)
+		return nil, false
+	}
+	as.value = append(as.value, data...)
+	as.next++
+	a.bytes += len(data)
+	if as.next < as.count {
+		a.evict()
+		return nil, false
+	}
+	a.remove(key)
+	return as.value, true
+}
+
+// Pending returns the number of values waiting for more chunks.
+func (a *ChunkAssembler) Pending() int {
+	return len(a.pending)
+}
+
+func (a *ChunkAssembler) remove(key chunkKey) {
+	as, ok := a.pending[key]
+	if !ok {
+		return
+	}
+	a.bytes -= len(as.value)
+	delete(a.pending, key)
+	for i, k := range a.order {
+		if k == key {
+			a.order = append(a.order[:i], a.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// evict drops the oldest partial values while they take up too much space.
+func (a *ChunkAssembler) evict() {
+	for a.maxBytes > 0 && a.bytes > a.maxBytes && len(a.order) > 1 {
+		a.remove(a.order[0])
+	}
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// chunkMessages returns the value's chunks as the producer sends them.
+func chunkMessages(t *testing.T, value []byte, size int) []commitlog.Message {
+	var msgs []commitlog.Message
+	for _, chunk := range chunkValue(value, size) {
+		msgs = append(msgs, newMessage(t, protocol.ChunkAttribute, chunk))
+	}
+	return msgs
+}
+
+func newMessage(t *testing.T, attributes int8, value []byte) commitlog.Message {
+	b, err := protocol.Encode(&protocol.Message{MagicByte: 1, Attributes: attributes, Value: value})
+	require.NoError(t, err)
+	return commitlog.Message(b)
+}
+
+func TestChunkAssembler(t *testing.T) {
+	req := require.New(t)
+	a := NewChunkAssembler(0)
+
+	value := bytes.Repeat([]byte("abcdefghij"), 10)
+	chunks := chunkMessages(t, value, 30)
+	req.Equal(4, len(chunks))
+	other := chunkMessages(t, bytes.Repeat([]byte("z"), 50), 30)
+
+	// values that aren't chunked pass through, even ones that look like a
+	// chunk
+	v, ok := a.Add("test", 0, newMessage(t, 0, []byte("plain")))
+	req.True(ok)
+	req.Equal([]byte("plain"), v)
+	v, ok = a.Add("test", 0, newMessage(t, 0, chunks[0].Value()))
+	req.True(ok)
+	req.Equal(chunks[0].Value(), v)
+	req.Equal(0, a.Pending())
+
+	// another value's chunks can be interleaved
+	for i, chunk := range chunks {
+		if i == 1 {
+			_, ok = a.Add("test", 0, other[0])
+			req.False(ok)
+		}
+		v, ok = a.Add("test", 0, chunk)
+		req.Equal(i == len(chunks)-1, ok)
+	}
+	req.Equal(value, v)
+	req.Equal(1, a.Pending())
+	v, ok = a.Add("test", 0, other[1])
+	req.True(ok)
+	req.Equal(bytes.Repeat([]byte("z"), 50), v)
+	req.Equal(0, a.Pending())
+
+	// a value missing a chunk is dropped
+	_, ok = a.Add("test", 0, chunks[0])
+	req.False(ok)
+	_, ok = a.Add("test", 0, chunks[2])
+	req.False(ok)
+	_, ok = a.Add("test", 0, chunks[3])
+	req.False(ok)
+	req.Equal(0, a.Pending())
+
+	// the same chunks consumed from another partition are another value
+	_, ok = a.Add("test", 0, chunks[0])
+	req.False(ok)
+	_, ok = a.Add("test", 1, chunks[1])
+	req.False(ok)
+	req.Equal(1, a.Pending())
+}
+
+func TestChunkAssembler_DropsOldest(t *testing.T) {
+	req := require.New(t)
+	a := NewChunkAssembler(100)
+	first := chunkMessages(t, make([]byte, 90), 40)
+	second := chunkMessages(t, make([]byte, 90), 40)
+	a.Add("test", 0, first[0])
+	a.Add("test", 0, first[1])
+	a.Add("test", 0, second[0])
+	// past the limit, the first is dropped
+	req.Equal(1, a.Pending())
+	a.Add("test", 0, second[1])
+	v, ok := a.Add("test", 0, second[2])
+	req.True(ok)
+	req.Equal(90, len(v))
+
+	// a value bigger than the limit isn't held at all
+	_, ok = a.Add("test", 0, chunkMessages(t, make([]byte, 150), 60)[0])
+	req.False(ok)
+	req.Equal(0, a.Pending())
+}
+
+func TestProducer_ChunksLargeValues(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeConn{}
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		ChunkBytes: 100,
+		// each chunk's sent on its own
+		BatchSize: 1,
+		Linger:    time.Hour,
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	var calls int
+	req.NoError(p.Send(&Record{Topic: "test", Value: make([]byte, 1000)}, func(partition int32, offset int64, err error) {
+		req.NoError(err)
+		calls++
+	}))
+	req.NoError(p.Close())
+	req.Equal(1, calls)
+
+	// the chunks all went to one partition
+	partitions := make(map[int32]int)
+	for _, counts := range conn.produced {
+		for partition, n := range counts {
+			partitions[partition] += n
+		}
+	}
+	req.Equal(1, len(partitions))
+	for _, n := range partitions {
+		req.Equal(10, n)
+	}
+}
+
+func TestProducer_ChunksNotAdded(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeConn{}
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		ChunkBytes: 100,
+		// only a couple of chunks fit
+		BufferMemory: 300,
+		MaxBlock:     -1,
+		Linger:       time.Hour,
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	var calls int
+	var callbackErr error
+	err := p.Send(&Record{Topic: "test", Value: make([]byte, 1000)}, func(partition int32, offset int64, err error) {
+		calls++
+		callbackErr = err
+	})
+	req.Equal(ErrBufferFull, err)
+	// the chunks that were added are sent and the record still fails
+	req.NoError(p.Close())
+	req.Equal(1, calls)
+	req.Equal(ErrBufferFull, callbackErr)
+}
@@ -0,0 +1,383 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// ErrCommitterClosed is returned for commits after the committer's closed.
+var ErrCommitterClosed = errors.New("client: committer closed")
+
+// CommitConn is the subset of a broker connection used to commit offsets and
+// query partitions' offsets.
+type CommitConn interface {
+	Metadata(*protocol.MetadataRequest) (*protocol.MetadataResponse, error)
+	Offsets(*protocol.OffsetsRequest) (*protocol.OffsetsResponse, error)
+	FindCoordinator(*protocol.FindCoordinatorRequest) (*protocol.FindCoordinatorResponse, error)
+	OffsetCommit(*protocol.OffsetCommitRequest) (*protocol.OffsetCommitResponse, error)
+	Close() error
+}
+
+// TopicPartition is a partition of a topic.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// CommitterConfig for the committer.
+type CommitterConfig struct {
+	// BrokerAddr is the address of a broker used to find the group's coordinator.
+	BrokerAddr string
+	GroupID    string
+	// AutoCommitInterval is how often the marked offsets are committed in the
+	// background. They're only committed by Commit, CommitAsync, Revoke, and
+	// Close if it's zero.
+	AutoCommitInterval time.Duration
+	// Dial opens a connection to the broker at the address. Defaults to jocko.Dial.
+	Dial func(addr string) (CommitConn, error)
+}
+
+// CommitCallback is called once an async commit's done with the offsets it
+// committed, or with the error it failed with.
+type CommitCallback func(offsets map[TopicPartition]int64, err error)
+
+// Committer commits a group member's consumed offsets. Offsets are marked as
+// records are processed and committed in batches, every partition's in one
+// request to the group's coordinator, rather than a request per record or
+// partition. Commits, sync, async and automatic, are all sent by the commit
+// loop one at a time in the order they were made, so an older commit never
+// overwrites a newer one. A partition's offset is only sent again once a newer
+// one's marked.
+type Committer struct {
+	config CommitterConfig
+
+	mu           sync.Mutex
+	marked       map[TopicPartition]int64
+	committed    map[TopicPartition]int64
+	generationID int32
+	memberID     string
+	conns        map[string]CommitConn
+	coordinator  string
+	querier      *offsetQuerier
+
+	// closeMu guards closed and sends on commitCh, so a commit can't be sent
+	// once commitCh's closed.
+	closeMu  sync.Mutex
+	closed   bool
+	commitCh chan commitRequest
+	doneCh   chan struct{}
+}
+
+// commitRequest is a commit for the commit loop to send. Async commits have
+// their offsets. Sync commits commit the offsets that are uncommitted when
+// they're sent and get the result on done.
+type commitRequest struct {
+	offsets  map[TopicPartition]int64
+	callback CommitCallback
+	done     chan error
+}
+
+// NewCommitter returns a committer for the config and starts committing its
+// async and auto commits in the background.
+func NewCommitter(config CommitterConfig) *Committer {
+	if config.Dial == nil {
+		config.Dial = func(addr string) (CommitConn, error) {
+			return jocko.Dial("tcp", addr)
+		}
+	}
+	c := &Committer{
+		config:       config,
+		marked:       make(map[TopicPartition]int64),
+		committed:    make(map[TopicPartition]int64),
+		generationID: -1,
+		conns:        make(map[string]CommitConn),
+		commitCh:     make(chan commitRequest, 64),
+		doneCh:       make(chan struct{}),
+	}
+	c.querier = newOffsetQuerier(config.BrokerAddr, func(addr string) (offsetsConn, error) {
+		return c.conn(addr)
+	}, func(addr string, conn offsetsConn) {
+		c.drop(addr, conn.(CommitConn))
+	})
+	go c.commitLoop()
+	return c
+}
+
+// SetGeneration sets the group generation and member ID sent with commits,
+// after the member's joined the group.
+func (c *Committer) SetGeneration(generationID int32, memberID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generationID = generationID
+	c.memberID = memberID
+}
+
+// Mark marks the offset to commit for the partition, i.e. the offset of the
+// next record to consume from it.
+func (c *Committer) Mark(topic string, partition int32, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.marked[TopicPartition{topic, partition}] = offset
+}
+
+// Commit commits the marked offsets and waits for the coordinator to
+// acknowledge them, after the async commits made before it.
+func (c *Committer) Commit() error {
+	done := make(chan error, 1)
+	if err := c.send(commitRequest{done: done}); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// CommitAsync commits the marked offsets in the background and calls the
+// callback, if it isn't nil, once they're committed or the commit's failed.
+// The callback's called from the commit loop, so it mustn't call Commit.
+func (c *Committer) CommitAsync(callback CommitCallback) error {
+	c.mu.Lock()
+	offsets := c.uncommitted()
+	c.mu.Unlock()
+	return c.send(commitRequest{offsets: offsets, callback: callback})
+}
+
+// send sends the commit to the commit loop unless the committer's closed.
+func (c *Committer) send(r commitRequest) error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return ErrCommitterClosed
+	}
+	c.commitCh <- r
+	return nil
+}
+
+// Revoke commits the marked offsets synchronously and forgets the partitions'
+// offsets. It's called when the member's partitions are revoked before a
+// rebalance, so the member they're assigned to next starts after them.
+func (c *Committer) Revoke() error {
+	err := c.Commit()
+	c.mu.Lock()
+	c.marked = make(map[TopicPartition]int64)
+	c.committed = make(map[TopicPartition]int64)
+	c.mu.Unlock()
+	return err
+}
+
+// Close commits the async commits that are queued and then the marked offsets
+// synchronously, and closes the committer's connections.
+func (c *Committer) Close() error {
+	done := make(chan error, 1)
+	c.closeMu.Lock()
+	if c.closed {
+		c.closeMu.Unlock()
+		return nil
+	}
+	c.commitCh <- commitRequest{done: done}
+	c.closed = true
+	close(c.commitCh)
+	c.closeMu.Unlock()
+	<-c.doneCh
+	err := <-done
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+	return err
+}
+
+// commitLoop sends the commits, and commits the marked offsets every auto
+// commit interval, until the committer's closed and its commits are sent.
+func (c *Committer) commitLoop() {
+	defer close(c.doneCh)
+	var tick <-chan time.Time
+	if c.config.AutoCommitInterval > 0 {
+		ticker := time.NewTicker(c.config.AutoCommitInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case r, ok := <-c.commitCh:
+			if !ok {
+				return
+			}
+			c.process(r)
+		case <-tick:
+			c.mu.Lock()
+			offsets := c.uncommitted()
+			c.mu.Unlock()
+			if err := c.commit(offsets); err != nil {
+				log.Error.Printf("client: auto commit for group %s error: %s", c.config.GroupID, err)
+			}
+		}
+	}
+}
+
+// process sends the commit, committing the uncommitted offsets for sync
+// commits, and reports its result.
+func (c *Committer) process(r commitRequest) {
+	if r.done != nil {
+		c.mu.Lock()
+		r.offsets = c.uncommitted()
+		c.mu.Unlock()
+	}
+	err := c.commit(r.offsets)
+	if r.callback != nil {
+		r.callback(r.offsets, err)
+	}
+	if r.done != nil {
+		r.done <- err
+	}
+}
+
+// uncommitted returns the marked offsets that haven't been committed yet. The
+// committer's lock must be held.
+func (c *Committer) uncommitted() map[TopicPartition]int64 {
+	offsets := make(map[TopicPartition]int64)
+	for tp, offset := range c.marked {
+		if committed, ok := c.committed[tp]; !ok || committed != offset {
+			offsets[tp] = offset
+		}
+	}
+	return offsets
+}
+
+// commit sends the offsets to the group's coordinator in one request. It's
+// only called by the commit loop.
+func (c *Committer) commit(offsets map[TopicPartition]int64) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	req := &protocol.OffsetCommitRequest{
+		APIVersion:   2,
+		GroupID:      c.config.GroupID,
+		GenerationID: c.generationID,
+		MemberID:     c.memberID,
+		// the broker's retention
+		RetentionTime: -1,
+	}
+	c.mu.Unlock()
+	byTopic := make(map[string]int)
+	for tp, offset := range offsets {
+		i, ok := byTopic[tp.Topic]
+		if !ok {
+			i = len(req.Topics)
+			byTopic[tp.Topic] = i
+			req.Topics = append(req.Topics, protocol.OffsetCommitTopicRequest{Topic: tp.Topic})
+		}
+		req.Topics[i].Partitions = append(req.Topics[i].Partitions, protocol.OffsetCommitPartitionRequest{
+			Partition: tp.Partition,
+			Offset:    offset,
+		})
+	}
+
+	addr, conn, err := c.coordinatorConn()
+	if err != nil {
+		return err
+	}
+	res, err := conn.OffsetCommit(req)
+	if err != nil {
+		c.drop(addr, conn)
+		return err
+	}
+	var commitErr error
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tr := range res.Responses {
+		for _, pr := range tr.PartitionResponses {
+			tp := TopicPartition{tr.Topic, pr.Partition}
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				perr := protocol.Errs[pr.ErrorCode]
+				if perr == protocol.ErrNotCoordinator || perr == protocol.ErrCoordinatorNotAvailable {
+					// found again on the next commit
+					c.coordinator = ""
+				}
+				if commitErr == nil {
+					commitErr = perr
+				}
+				continue
+			}
+			c.committed[tp] = offsets[tp]
+		}
+	}
+	return commitErr
+}
+
+// coordinatorConn returns a connection to the group's coordinator, finding it
+// through the broker if it isn't known.
+func (c *Committer) coordinatorConn() (string, CommitConn, error) {
+	c.mu.Lock()
+	addr := c.coordinator
+	c.mu.Unlock()
+	if addr == "" {
+		conn, err := c.conn(c.config.BrokerAddr)
+		if err != nil {
+			return "", nil, err
+		}
+		res, err := conn.FindCoordinator(&protocol.FindCoordinatorRequest{
+			CoordinatorKey:  c.config.GroupID,
+			CoordinatorType: protocol.CoordinatorGroup,
+		})
+		if err != nil {
+			c.drop(c.config.BrokerAddr, conn)
+			return "", nil, err
+		}
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return "", nil, protocol.Errs[res.ErrorCode]
+		}
+		addr = net.JoinHostPort(res.Coordinator.Host, strconv.Itoa(int(res.Coordinator.Port)))
+		c.mu.Lock()
+		c.coordinator = addr
+		c.mu.Unlock()
+	}
+	conn, err := c.conn(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, conn, nil
+}
+
+// conn returns a cached connection to the broker at addr.
+func (c *Committer) conn(addr string) (CommitConn, error) {
+	c.mu.Lock()
+	conn, ok := c.conns[addr]
+	c.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+	conn, err := c.config.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.conns[addr]; ok {
+		conn.Close()
+		return cached, nil
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+func (c *Committer) drop(addr string, conn CommitConn) {
+	c.mu.Lock()
+	if c.conns[addr] == conn {
+		delete(c.conns, addr)
+	}
+	if c.coordinator == addr {
+		c.coordinator = ""
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fakeCommitConn is a broker coordinating every group. It records the offsets
+// committed in each request, and answers metadata and offsets requests like
+// fakeConn.
+type fakeCommitConn struct {
+	fakeConn
+	mu        sync.Mutex
+	committed []map[TopicPartition]int64
+}
+
+func (c *fakeCommitConn) FindCoordinator(req *protocol.FindCoordinatorRequest) (*protocol.FindCoordinatorResponse, error) {
+	return &protocol.FindCoordinatorResponse{
+		Coordinator: protocol.Coordinator{NodeID: 1, Host: "localhost", Port: 9092},
+	}, nil
+}
+
+func (c *fakeCommitConn) OffsetCommit(req *protocol.OffsetCommitRequest) (*protocol.OffsetCommitResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offsets := make(map[TopicPartition]int64)
+	res := &protocol.OffsetCommitResponse{}
+	for _, t := range req.Topics {
+		tres := protocol.OffsetCommitTopicResponse{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			offsets[TopicPartition{t.Topic, p.Partition}] = p.Offset
+			tres.PartitionResponses = append(tres.PartitionResponses, protocol.OffsetCommitPartitionResponse{Partition: p.Partition})
+		}
+		res.Responses = append(res.Responses, tres)
+	}
+	c.committed = append(c.committed, offsets)
+	return res, nil
+}
+
+func (c *fakeCommitConn) Close() error {
+	return nil
+}
+
+func TestCommitter_Batching(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeCommitConn{}
+	c := NewCommitter(CommitterConfig{
+		BrokerAddr: "localhost:9092",
+		GroupID:    "test-group",
+		Dial:       func(string) (CommitConn, error) { return conn, nil },
+	})
+
+	c.Mark("test", 0, 10)
+	c.Mark("test", 1, 20)
+	c.Mark("test", 0, 11)
+	c.Mark("other", 0, 5)
+	req.NoError(c.Commit())
+	// nothing new is marked so nothing's sent
+	req.NoError(c.Commit())
+
+	c.Mark("test", 1, 21)
+	done := make(chan error, 1)
+	req.NoError(c.CommitAsync(func(offsets map[TopicPartition]int64, err error) {
+		req.Equal(map[TopicPartition]int64{{"test", 1}: 21}, offsets)
+		done <- err
+	}))
+	req.NoError(<-done)
+
+	// the last marked offsets are committed on close
+	c.Mark("test", 2, 30)
+	req.NoError(c.Close())
+	req.Equal(ErrCommitterClosed, c.Commit())
+
+	req.Equal([]map[TopicPartition]int64{
+		{{"test", 0}: 11, {"test", 1}: 20, {"other", 0}: 5},
+		{{"test", 1}: 21},
+		{{"test", 2}: 30},
+	}, conn.committed)
+}
+
+func TestCommitter_CommitWhileClosing(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeCommitConn{}
+	c := NewCommitter(CommitterConfig{
+		BrokerAddr: "localhost:9092",
+		GroupID:    "test-group",
+		Dial:       func(string) (CommitConn, error) { return conn, nil },
+	})
+
+	// every commit's either sent before the committer closes or rejected,
+	// none are left waiting
+	var wg sync.WaitGroup
+	var callbacks sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for offset := int64(0); offset < 100; offset++ {
+				c.Mark("test", int32(i), offset)
+				callbacks.Add(1)
+				if err := c.CommitAsync(func(map[TopicPartition]int64, error) { callbacks.Done() }); err != nil {
+					callbacks.Done()
+					req.Equal(ErrCommitterClosed, err)
+				}
+				if err := c.Commit(); err != nil {
+					req.Equal(ErrCommitterClosed, err)
+				}
+			}
+		}(i)
+	}
+	req.NoError(c.Close())
+	wg.Wait()
+	callbacks.Wait()
+}
@@ -0,0 +1,738 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	defaultFetchMaxBytes          = 50 << 20
+	defaultMaxPartitionFetchBytes = 1 << 20
+	defaultMaxBufferedBytes       = 64 << 20
+	defaultFetchMaxWait           = 500 * time.Millisecond
+	defaultFetchBackoff           = 100 * time.Millisecond
+)
+
+// ErrConsumerClosed is returned for polls after the consumer's closed.
+var ErrConsumerClosed = errors.New("client: consumer closed")
+
+// ConsumerConn is the subset of a broker connection used to consume.
+type ConsumerConn interface {
+	Metadata(*protocol.MetadataRequest) (*protocol.MetadataResponse, error)
+	Fetch(*protocol.FetchRequest) (*protocol.FetchResponse, error)
+	Offsets(*protocol.OffsetsRequest) (*protocol.OffsetsResponse, error)
+	Close() error
+}
+
+// ConsumerRecord is a consumed record.
+type ConsumerRecord struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	// Timestamp is zero for records in the v0 message format.
+	Timestamp time.Time
+
+	transactional bool
+}
+
+// FetchError is sent on the consumer's Errors channel when fetching a
+// partition fails. The partition's fetched again after the backoff, except
+// for protocol.ErrOffsetOutOfRange which stops it until it's assigned again
+// with a valid offset.
+type FetchError struct {
+	Topic     string
+	Partition int32
+	Err       error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("client: fetch %s-%d: %s", e.Topic, e.Partition, e.Err)
+}
+
+// ConsumerConfig for the consumer.
+type ConsumerConfig struct {
+	// BrokerAddr is the address of a broker used to look up partition leaders.
+	BrokerAddr string
+	// FetchMaxBytes is the most bytes fetched from a broker in one request,
+	// over all the partitions fetched from it. Partitions that don't fit are
+	// fetched in the next request. Defaults to 50MiB.
+	FetchMaxBytes int
+	// MaxPartitionFetchBytes is the most bytes fetched for a partition in one
+	// request. A partition's fetched ahead of its polls while less than this
+	// much of it is queued. Defaults to 1MiB.
+	MaxPartitionFetchBytes int
+	// MaxBufferedBytes bounds the consumer's memory: how many bytes of records
+	// can be queued, or reserved for fetches in flight, over all the
+	// partitions before fetching waits for polls. A fetch's let in when
+	// nothing's buffered even if it's bigger. Defaults to 64MiB.
+	MaxBufferedBytes int
+	// FetchMaxWait is how long the brokers can wait for FetchMinBytes before
+	// answering a fetch. Defaults to 500ms.
+	FetchMaxWait  time.Duration
+	FetchMinBytes int
+	// FetchBackoff is how long a partition waits to be fetched again after a
+	// fetch fails or finds nothing new. Defaults to 100ms.
+	FetchBackoff time.Duration
+	// IsolationLevel is protocol.ReadCommitted to only consume the records of
+	// committed transactions. A partition's transactional records are held
+	// back until the marker ending their transaction's fetched, and the
+	// records produced after them along with them to keep the partition's
+	// order. Held records aren't counted against the buffer bounds. Defaults
+	// to protocol.ReadUncommitted.
+	IsolationLevel protocol.IsolationLevel
+	// AutoOffsetReset is where a subscription starts the partitions it picks
+	// up. Defaults to OffsetResetLatest.
+	AutoOffsetReset OffsetReset
+	// MetadataRefreshInterval is how often a subscription's topics are looked
+	// up so the partitions of topics that start or stop matching it are
+	// assigned or unassigned. Defaults to 30s.
+	MetadataRefreshInterval time.Duration
+	// Rebalance, if set, is called after a subscription's partitions change
+	// with those assigned and unassigned.
+	Rebalance func(assigned, revoked []TopicPartition)
+	// Dial opens a connection to the broker at the address. Defaults to jocko.Dial.
+	Dial func(addr string) (ConsumerConn, error)
+}
+
+// Consumer prefetches its assigned partitions' records into a queue per
+// partition and hands them out a fetched batch at a time, rotating through the
+// partitions so a busy one doesn't starve the others. Prefetching is bounded
+// per partition by MaxPartitionFetchBytes and over all the partitions by
+// MaxBufferedBytes, so consumers of many partitions of bursty topics don't
+// buffer more than they're configured to. Offsets are committed with a
+// Committer.
+type Consumer struct {
+	config ConsumerConfig
+
+	mu      sync.Mutex
+	queues  map[TopicPartition]*partitionQueue
+	ready   []*partitionQueue
+	leaders map[TopicPartition]string
+	conns   map[string]ConsumerConn
+	closed  bool
+	querier *offsetQuerier
+	// subscription is the topics the consumer's subscribed to, if it is, and
+	// subscribed the partitions it's been assigned.
+	subscription *subscription
+	subscribed   map[TopicPartition]struct{}
+	// bufferedRecords and bufferedBytes are the records queued, reservedBytes
+	// the bytes held for the fetches in flight.
+	bufferedRecords int
+	bufferedBytes   int
+	reservedBytes   int
+	// readyCh is closed, and replaced, when records are queued, and freedCh
+	// when buffer space is freed or partitions are assigned.
+	readyCh chan struct{}
+	freedCh chan struct{}
+	errCh   chan error
+
+	shutdownCh    chan struct{}
+	doneCh        chan struct{}
+	refreshDoneCh chan struct{}
+}
+
+// partitionQueue is a partition's prefetched records, a batch per fetch.
+type partitionQueue struct {
+	tp TopicPartition
+	// offset is the offset of the next record to fetch.
+	offset   int64
+	batches  []*fetchedBatch
+	bytes    int
+	fetching bool
+	// held is the records of a read_committed partition's ongoing
+	// transaction, and those after it, waiting for its marker.
+	held []*ConsumerRecord
+	// stopped is set by an offset out of range until the partition's
+	// assigned again.
+	stopped bool
+	// backoff is when the partition can be fetched again.
+	backoff time.Time
+	// queued is set while the partition's in the ready list.
+	queued bool
+}
+
+type fetchedBatch struct {
+	records []*ConsumerRecord
+	size    int
+}
+
+// NewConsumer returns a consumer for the config and starts prefetching its
+// partitions in the background as they're assigned.
+func NewConsumer(config ConsumerConfig) *Consumer {
+	if config.FetchMaxBytes == 0 {
+		config.FetchMaxBytes = defaultFetchMaxBytes
+	}
+	if config.MaxPartitionFetchBytes == 0 {
+		config.MaxPartitionFetchBytes = defaultMaxPartitionFetchBytes
+	}
+	if config.MaxBufferedBytes == 0 {
+		config.MaxBufferedBytes = defaultMaxBufferedBytes
+	}
+	if config.FetchMaxWait == 0 {
+		config.FetchMaxWait = defaultFetchMaxWait
+	}
+	if config.FetchMinBytes == 0 {
+		config.FetchMinBytes = 1
+	}
+	if config.FetchBackoff == 0 {
+		config.FetchBackoff = defaultFetchBackoff
+	}
+	if config.AutoOffsetReset == "" {
+		config.AutoOffsetReset = OffsetResetLatest
+	}
+	if config.MetadataRefreshInterval == 0 {
+		config.MetadataRefreshInterval = defaultMetadataRefresh
+	}
+	if config.Dial == nil {
+		config.Dial = func(addr string) (ConsumerConn, error) {
+			return jocko.Dial("tcp", addr)
+		}
+	}
+	c := &Consumer{
+		config:        config,
+		queues:        make(map[TopicPartition]*partitionQueue),
+		leaders:       make(map[TopicPartition]string),
+		conns:         make(map[string]ConsumerConn),
+		subscribed:    make(map[TopicPartition]struct{}),
+		readyCh:       make(chan struct{}),
+		freedCh:       make(chan struct{}),
+		errCh:         make(chan error, 16),
+		shutdownCh:    make(chan struct{}),
+		doneCh:        make(chan struct{}),
+		refreshDoneCh: make(chan struct{}),
+	}
+	c.querier = newOffsetQuerier(config.BrokerAddr, func(addr string) (offsetsConn, error) {
+		return c.conn(addr)
+	}, func(addr string, conn offsetsConn) {
+		c.drop(addr, conn.(ConsumerConn))
+	})
+	go c.fetchLoop()
+	go c.refreshSubscription()
+	return c
+}
+
+// Assign starts consuming the partition from the offset, dropping what's
+// queued for it if it's already assigned, e.g. to seek. Partitions assigned
+// by a subscription are left to it, but can be sought with Assign.
+func (c *Consumer) Assign(topic string, partition int32, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tp := TopicPartition{topic, partition}
+	c.unassign(tp)
+	c.queues[tp] = &partitionQueue{tp: tp, offset: offset}
+	c.freed()
+}
+
+// Unassign stops consuming the partition and frees what's queued for it.
+func (c *Consumer) Unassign(topic string, partition int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unassign(TopicPartition{topic, partition})
+	c.freed()
+}
+
+// unassign drops the partition's queue. A fetch in flight for it is dropped
+// when it's done. The consumer's lock must be held.
+func (c *Consumer) unassign(tp TopicPartition) {
+	q, ok := c.queues[tp]
+	if !ok {
+		return
+	}
+	delete(c.queues, tp)
+	for _, b := range q.batches {
+		c.bufferedRecords -= len(b.records)
+	}
+	c.bufferedBytes -= q.bytes
+	q.batches = nil
+	q.bytes = 0
+}
+
+// Poll returns the next partition's oldest fetched batch of records, waiting
+// up to the timeout for one. It returns nil if there wasn't one in time.
+func (c *Consumer) Poll(timeout time.Duration) ([]*ConsumerRecord, error) {
+	var timer <-chan time.Time
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrConsumerClosed
+		}
+		if records := c.next(); records != nil {
+			c.mu.Unlock()
+			return records, nil
+		}
+		readyCh := c.readyCh
+		c.mu.Unlock()
+		if timer == nil {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			timer = t.C
+		}
+		select {
+		case <-readyCh:
+		case <-timer:
+			return nil, nil
+		case <-c.shutdownCh:
+			return nil, ErrConsumerClosed
+		}
+	}
+}
+
+// next takes the oldest batch of the partition at the front of the ready
+// list, moving it to the back if it has more. The consumer's lock must be
+// held.
+func (c *Consumer) next() []*ConsumerRecord {
+	for len(c.ready) > 0 {
+		q := c.ready[0]
+		c.ready = c.ready[1:]
+		q.queued = false
+		if c.queues[q.tp] != q || len(q.batches) == 0 {
+			// unassigned or reassigned since
+			continue
+		}
+		b := q.batches[0]
+		q.batches = q.batches[1:]
+		q.bytes -= b.size
+		c.bufferedRecords -= len(b.records)
+		c.bufferedBytes -= b.size
+		if len(q.batches) > 0 {
+			c.enqueue(q)
+		}
+		c.freed()
+		return b.records
+	}
+	return nil
+}
+
+// enqueue adds the partition to the back of the ready list. The consumer's
+// lock must be held.
+func (c *Consumer) enqueue(q *partitionQueue) {
+	if q.queued {
+		return
+	}
+	q.queued = true
+	c.ready = append(c.ready, q)
+}
+
+// freed wakes the fetch loop. The consumer's lock must be held.
+func (c *Consumer) freed() {
+	close(c.freedCh)
+	c.freedCh = make(chan struct{})
+}
+
+// Buffered returns how many records, and how many bytes of them, are queued.
+func (c *Consumer) Buffered() (records, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bufferedRecords, c.bufferedBytes
+}
+
+// Errors returns a channel the consumer's FetchErrors are sent on. Errors are
+// dropped while the channel's full.
+func (c *Consumer) Errors() <-chan error {
+	return c.errCh
+}
+
+// Close stops prefetching, drops the queued records, and closes the
+// consumer's connections.
+func (c *Consumer) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	close(c.shutdownCh)
+	<-c.doneCh
+	<-c.refreshDoneCh
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for tp := range c.queues {
+		c.unassign(tp)
+	}
+	c.ready = nil
+	for addr, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+	return nil
+}
+
+// fetchRequest is the partitions fetched from a leader in one request and the
+// bytes reserved for them.
+type fetchRequest struct {
+	addr       string
+	partitions []*partitionQueue
+	reserved   int
+}
+
+// fetchLoop fetches the partitions with room in their queues, from each of
+// their leaders at once, while there's room in the buffer, until the
+// consumer's closed.
+func (c *Consumer) fetchLoop() {
+	defer close(c.doneCh)
+	for {
+		reqs, wait := c.fetchable(time.Now())
+		if len(reqs) == 0 {
+			c.mu.Lock()
+			freedCh := c.freedCh
+			c.mu.Unlock()
+			var backoff <-chan time.Time
+			var timer *time.Timer
+			if wait > 0 {
+				timer = time.NewTimer(wait)
+				backoff = timer.C
+			}
+			select {
+			case <-freedCh:
+			case <-backoff:
+			case <-c.shutdownCh:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, req := range reqs {
+			wg.Add(1)
+			go func(req *fetchRequest) {
+				defer wg.Done()
+				c.fetch(req)
+			}(req)
+		}
+		wg.Wait()
+		select {
+		case <-c.shutdownCh:
+			return
+		default:
+		}
+	}
+}
+
+// fetchable picks the partitions to fetch next, by leader, and reserves buffer
+// space for them. A partition's picked if it isn't being fetched or backing
+// off and less than MaxPartitionFetchBytes of it is queued. A request's
+// partitions are limited to FetchMaxBytes, and the requests' to the room left
+// in the buffer. If nothing's picked it returns how long until a partition's
+// backoff ends, or zero if none are backing off.
+func (c *Consumer) fetchable(now time.Time) ([]*fetchRequest, time.Duration) {
+	var unknown []string
+	c.mu.Lock()
+	for tp, q := range c.queues {
+		if _, ok := c.leaders[tp]; !ok && !q.stopped {
+			unknown = append(unknown, tp.Topic)
+		}
+	}
+	c.mu.Unlock()
+	if len(unknown) > 0 {
+		if err := c.refreshMetadata(unknown); err != nil {
+			log.Error.Printf("client: consumer metadata error: %s", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	byLeader := make(map[string]*fetchRequest)
+	var reqs []*fetchRequest
+	var wait time.Duration
+	for tp, q := range c.queues {
+		if q.fetching || q.stopped || q.bytes >= c.config.MaxPartitionFetchBytes {
+			continue
+		}
+		if d := q.backoff.Sub(now); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		addr, ok := c.leaders[tp]
+		if !ok {
+			if wait == 0 || c.config.FetchBackoff < wait {
+				wait = c.config.FetchBackoff
+			}
+			continue
+		}
+		size := c.config.MaxPartitionFetchBytes
+		req, ok := byLeader[addr]
+		if ok && req.reserved+size > c.config.FetchMaxBytes {
+			// fetched in the next request
+			continue
+		}
+		buffered := c.bufferedBytes + c.reservedBytes
+		if buffered > 0 && buffered+size > c.config.MaxBufferedBytes {
+			continue
+		}
+		if !ok {
+			req = &fetchRequest{addr: addr}
+			byLeader[addr] = req
+			reqs = append(reqs, req)
+		}
+		q.fetching = true
+		req.partitions = append(req.partitions, q)
+		req.reserved += size
+		c.reservedBytes += size
+	}
+	return reqs, wait
+}
+
+// fetch sends the request to its leader, queues the records fetched, and frees
+// the space reserved for them.
+func (c *Consumer) fetch(req *fetchRequest) {
+	fetchReq := &protocol.FetchRequest{
+		APIVersion:  3,
+		MaxWaitTime: c.config.FetchMaxWait,
+		MinBytes:    int32(c.config.FetchMinBytes),
+		MaxBytes:    int32(c.config.FetchMaxBytes),
+	}
+	byTopic := make(map[string]*protocol.FetchTopic)
+	c.mu.Lock()
+	for _, q := range req.partitions {
+		ft, ok := byTopic[q.tp.Topic]
+		if !ok {
+			ft = &protocol.FetchTopic{Topic: q.tp.Topic}
+			byTopic[q.tp.Topic] = ft
+			fetchReq.Topics = append(fetchReq.Topics, ft)
+		}
+		ft.Partitions = append(ft.Partitions, &protocol.FetchPartition{
+			Partition:   q.tp.Partition,
+			FetchOffset: q.offset,
+			MaxBytes:    int32(c.config.MaxPartitionFetchBytes),
+		})
+	}
+	c.mu.Unlock()
+
+	var res *protocol.FetchResponse
+	conn, err := c.conn(req.addr)
+	if err == nil {
+		if res, err = conn.Fetch(fetchReq); err != nil {
+			c.drop(req.addr, conn)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reservedBytes -= req.reserved
+	c.freed()
+	now := time.Now()
+	responses := make(map[TopicPartition]*protocol.FetchPartitionResponse)
+	if res != nil {
+		for _, tr := range res.Responses {
+			for _, pr := range tr.PartitionResponses {
+				responses[TopicPartition{tr.Topic, pr.Partition}] = pr
+			}
+		}
+	}
+	for _, q := range req.partitions {
+		q.fetching = false
+		if c.queues[q.tp] != q {
+			// unassigned or reassigned while it was fetched
+			continue
+		}
+		pr, ok := responses[q.tp]
+		switch {
+		case err != nil:
+			c.fetchFailed(q, err, now)
+		case !ok:
+			c.fetchFailed(q, errors.New("client: incomplete fetch response"), now)
+		case pr.ErrorCode != protocol.ErrNone.Code():
+			c.fetchFailed(q, protocol.Errs[pr.ErrorCode], now)
+		default:
+			var held *[]*ConsumerRecord
+			if c.config.IsolationLevel == protocol.ReadCommitted {
+				held = &q.held
+			}
+			b, next, err := decodeBatch(q.tp, q.offset, pr.RecordSet, held)
+			if err != nil {
+				c.fetchFailed(q, err, now)
+				continue
+			}
+			if next == q.offset {
+				// caught up
+				q.backoff = now.Add(c.config.FetchBackoff)
+				continue
+			}
+			// markers and held records move the offset along too
+			q.offset = next
+			if len(b.records) == 0 {
+				continue
+			}
+			q.batches = append(q.batches, b)
+			q.bytes += b.size
+			c.bufferedRecords += len(b.records)
+			c.bufferedBytes += b.size
+			c.enqueue(q)
+		}
+	}
+	if len(c.ready) > 0 {
+		close(c.readyCh)
+		c.readyCh = make(chan struct{})
+	}
+}
+
+// fetchFailed backs the partition off, or stops it if its offset's out of
+// range, and reports the error. The consumer's lock must be held.
+func (c *Consumer) fetchFailed(q *partitionQueue, err error, now time.Time) {
+	switch err {
+	case protocol.ErrOffsetOutOfRange:
+		q.stopped = true
+	case protocol.ErrNotLeaderForPartition, protocol.ErrUnknownTopicOrPartition, protocol.ErrLeaderNotAvailable:
+		// the leader may have moved
+		delete(c.leaders, q.tp)
+	}
+	q.backoff = now.Add(c.config.FetchBackoff)
+	log.Error.Printf("client: fetch %s-%d error: %s", q.tp.Topic, q.tp.Partition, err)
+	select {
+	case c.errCh <- &FetchError{Topic: q.tp.Topic, Partition: q.tp.Partition, Err: err}:
+	default:
+		// no one's keeping up with the errors
+	}
+}
+
+// decodeBatch decodes the records in a fetched record set from the offset on,
+// and returns the offset to fetch next. The batch's size is the record set's,
+// since its records' keys and values share it, plus that of the records
+// decompressed from it. If held isn't nil the partition's read_committed:
+// records are held in it from a transactional record on, and released or
+// dropped by the transaction's marker.
+func decodeBatch(tp TopicPartition, offset int64, recordSet []byte, held *[]*ConsumerRecord) (*fetchedBatch, int64, error) {
+	b := &fetchedBatch{size: len(recordSet)}
+	next := offset
+	for _, ms := range commitlog.MessageSets(recordSet) {
+		if ms.Offset() < offset {
+			continue
+		}
+		next = ms.Offset() + 1
+		var msgs []commitlog.Message
+		for _, m := range ms.Messages() {
+			if !m.Compressed() {
+				msgs = append(msgs, m)
+				continue
+			}
+			inner, err := m.Decompress()
+			if err != nil {
+				return nil, offset, fmt.Errorf("client: decompress %s-%d at %d: %v", tp.Topic, tp.Partition, ms.Offset(), err)
+			}
+			for _, ims := range inner {
+				b.size += len(ims)
+				msgs = append(msgs, ims.Messages()...)
+			}
+		}
+		for _, m := range msgs {
+			if m.Control() {
+				if held != nil && len(*held) > 0 {
+					b.records = append(b.records, endHeld(m, *held)...)
+					*held = nil
+				}
+				continue
+			}
+			r := &ConsumerRecord{
+				Topic:     tp.Topic,
+				Partition: tp.Partition,
+				Offset:    ms.Offset(),
+				Key:       m.Key(),
+				Value:     m.Value(),
+			}
+			if m.MagicByte() > 0 {
+				r.Timestamp = time.Unix(0, m.Timestamp()*int64(time.Millisecond))
+			}
+			r.transactional = m.Transactional()
+			if held != nil && (r.transactional || len(*held) > 0) {
+				*held = append(*held, r)
+				continue
+			}
+			b.records = append(b.records, r)
+		}
+	}
+	return b, next, nil
+}
+
+// endHeld returns the held records the marker releases: all of them if it
+// commits their transaction, and only those that weren't in it if it aborts.
+func endHeld(marker commitlog.Message, held []*ConsumerRecord) []*ConsumerRecord {
+	cr := new(protocol.ControlRecord)
+	if err := cr.Decode(protocol.NewDecoder(marker.Key())); err == nil && cr.Type == protocol.ControlRecordCommit {
+		return held
+	}
+	var released []*ConsumerRecord
+	for _, r := range held {
+		if !r.transactional {
+			released = append(released, r)
+		}
+	}
+	return released
+}
+
+// refreshMetadata looks up the topics' partitions' leaders.
+func (c *Consumer) refreshMetadata(topics []string) error {
+	conn, err := c.conn(c.config.BrokerAddr)
+	if err != nil {
+		return err
+	}
+	res, err := conn.Metadata(&protocol.MetadataRequest{Topics: topics})
+	if err != nil {
+		c.drop(c.config.BrokerAddr, conn)
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tm := range res.TopicMetadata {
+		if tm.TopicErrorCode != protocol.ErrNone.Code() {
+			continue
+		}
+		for _, pm := range tm.PartitionMetadata {
+			leader, err := res.Leader(tm.Topic, pm.PartitionID)
+			if err != nil {
+				continue
+			}
+			c.leaders[TopicPartition{tm.Topic, pm.PartitionID}] = leader.Addr()
+		}
+	}
+	return nil
+}
+
+// conn returns a cached connection to the broker at addr.
+func (c *Consumer) conn(addr string) (ConsumerConn, error) {
+	c.mu.Lock()
+	conn, ok := c.conns[addr]
+	c.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+	conn, err := c.config.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.conns[addr]; ok {
+		conn.Close()
+		return cached, nil
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+func (c *Consumer) drop(addr string, conn ConsumerConn) {
+	c.mu.Lock()
+	if c.conns[addr] == conn {
+		delete(c.conns, addr)
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
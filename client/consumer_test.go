@@ -0,0 +1,356 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fakeFetchConn is a broker leading all three of topic "test"'s partitions,
+// each with 100 records of 100 byte values. It keeps the most bytes a fetch
+// asked for over its partitions.
+type fakeFetchConn struct {
+	fakeConn
+	mu       sync.Mutex
+	maxFetch int
+}
+
+func (c *fakeFetchConn) Fetch(req *protocol.FetchRequest) (*protocol.FetchResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := &protocol.FetchResponse{}
+	var fetch int
+	for _, ft := range req.Topics {
+		tr := &protocol.FetchTopicResponse{Topic: ft.Topic}
+		for _, fp := range ft.Partitions {
+			fetch += int(fp.MaxBytes)
+			var recordSet []byte
+			for offset := fp.FetchOffset; offset < 100; offset++ {
+				msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: make([]byte, 100)})
+				if err != nil {
+					return nil, err
+				}
+				ms := commitlog.NewMessageSet(uint64(offset), msg)
+				if len(recordSet)+len(ms) > int(fp.MaxBytes) {
+					break
+				}
+				recordSet = append(recordSet, ms...)
+			}
+			tr.PartitionResponses = append(tr.PartitionResponses, &protocol.FetchPartitionResponse{
+				Partition:     fp.Partition,
+				HighWatermark: 100,
+				RecordSet:     recordSet,
+			})
+		}
+		res.Responses = append(res.Responses, tr)
+	}
+	if fetch > c.maxFetch {
+		c.maxFetch = fetch
+	}
+	return res, nil
+}
+
+func newTestConsumer(conn *fakeFetchConn, config ConsumerConfig) *Consumer {
+	config.BrokerAddr = "localhost:9092"
+	config.FetchBackoff = time.Millisecond
+	config.Dial = func(addr string) (ConsumerConn, error) {
+		return conn, nil
+	}
+	return NewConsumer(config)
+}
+
+func TestConsumer_Poll(t *testing.T) {
+	req := require.New(t)
+	c := newTestConsumer(&fakeFetchConn{}, ConsumerConfig{MaxPartitionFetchBytes: 1000})
+	defer c.Close()
+	for partition := int32(0); partition < 3; partition++ {
+		c.Assign("test", partition, 50)
+	}
+
+	next := map[int32]int64{0: 50, 1: 50, 2: 50}
+	var polled int
+	for polled < 150 {
+		records, err := c.Poll(time.Second)
+		req.NoError(err)
+		req.NotEmpty(records)
+		for _, r := range records {
+			req.Equal(next[r.Partition], r.Offset)
+			req.Equal(100, len(r.Value))
+			req.False(r.Timestamp.IsZero())
+			next[r.Partition]++
+			polled++
+		}
+	}
+	records, err := c.Poll(10 * time.Millisecond)
+	req.NoError(err)
+	req.Nil(records)
+
+	// seeking drops the queued records
+	c.Assign("test", 1, 98)
+	records, err = c.Poll(time.Second)
+	req.NoError(err)
+	req.Equal(int64(98), records[0].Offset)
+
+	req.NoError(c.Close())
+	_, err = c.Poll(time.Second)
+	req.Equal(ErrConsumerClosed, err)
+}
+
+func TestConsumer_BoundsPrefetching(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeFetchConn{}
+	c := newTestConsumer(conn, ConsumerConfig{
+		FetchMaxBytes:          2000,
+		MaxPartitionFetchBytes: 1000,
+		MaxBufferedBytes:       2500,
+	})
+	defer c.Close()
+	for partition := int32(0); partition < 3; partition++ {
+		c.Assign("test", partition, 0)
+	}
+
+	// without polls, prefetching stops at the buffer's bound
+	time.Sleep(50 * time.Millisecond)
+	records, bytes := c.Buffered()
+	req.True(records > 0)
+	req.True(bytes <= 2500, "buffered %d bytes", bytes)
+	conn.mu.Lock()
+	req.True(conn.maxFetch <= 2000, "fetched %d bytes", conn.maxFetch)
+	conn.mu.Unlock()
+
+	// polls make room to fetch more
+	var polled int
+	for polled < 300 {
+		records, err := c.Poll(time.Second)
+		req.NoError(err)
+		req.NotEmpty(records)
+		polled += len(records)
+		_, bytes := c.Buffered()
+		req.True(bytes <= 2500, "buffered %d bytes", bytes)
+	}
+	records, bytes = c.Buffered()
+	req.Equal(0, records)
+	req.Equal(0, bytes)
+}
+
+func TestDecodeBatch_ReadCommitted(t *testing.T) {
+	req := require.New(t)
+	var recordSet []byte
+	appendMessage := func(offset int64, msg *protocol.Message) {
+		msg.MagicByte = 1
+		b, err := protocol.Encode(msg)
+		req.NoError(err)
+		recordSet = append(recordSet, commitlog.NewMessageSet(uint64(offset), b)...)
+	}
+	appendRecord := func(offset int64, value string, transactional bool) {
+		var attributes int8
+		if transactional {
+			attributes = protocol.TransactionalAttribute
+		}
+		appendMessage(offset, &protocol.Message{Attributes: attributes, Value: []byte(value)})
+	}
+	appendMarker := func(offset int64, typ protocol.ControlRecordType) {
+		key, err := protocol.Encode(&protocol.ControlRecord{Type: typ})
+		req.NoError(err)
+		appendMessage(offset, &protocol.Message{Attributes: protocol.ControlAttribute, Key: key})
+	}
+	values := func(records []*ConsumerRecord) (values []string) {
+		for _, r := range records {
+			values = append(values, string(r.Value))
+		}
+		return values
+	}
+	appendRecord(0, "a", false)
+	appendRecord(1, "b", true)
+	appendRecord(2, "c", false)
+	appendMarker(3, protocol.ControlRecordCommit)
+	appendRecord(4, "d", true)
+	appendRecord(5, "e", false)
+	appendMarker(6, protocol.ControlRecordAbort)
+	appendRecord(7, "f", true)
+	tp := TopicPartition{"test", 0}
+
+	// read_uncommitted gets every record
+	b, next, err := decodeBatch(tp, 0, recordSet, nil)
+	req.NoError(err)
+	req.Equal([]string{"a", "b", "c", "d", "e", "f"}, values(b.records))
+	req.Equal(int64(8), next)
+
+	// read_committed gets the committed transaction's records, and those
+	// after it, once its marker's fetched, and skips the aborted one's
+	var held []*ConsumerRecord
+	b, next, err = decodeBatch(tp, 0, recordSet, &held)
+	req.NoError(err)
+	req.Equal([]string{"a", "b", "c", "e"}, values(b.records))
+	req.Equal([]string{"f"}, values(held))
+	req.Equal(int64(8), next)
+
+	// a fetch of only a marker moves the offset past it
+	recordSet = nil
+	appendMarker(8, protocol.ControlRecordCommit)
+	b, next, err = decodeBatch(tp, 8, recordSet, &held)
+	req.NoError(err)
+	req.Equal([]string{"f"}, values(b.records))
+	req.Empty(held)
+	req.Equal(int64(9), next)
+}
+
+func TestDecodeBatch_Compressed(t *testing.T) {
+	req := require.New(t)
+	var inner []byte
+	for _, value := range []string{"a", "b"} {
+		b, err := protocol.Encode(&protocol.Message{MagicByte: 1, Value: []byte(value)})
+		req.NoError(err)
+		inner = append(inner, commitlog.NewMessageSet(0, b)...)
+	}
+	compressed, err := commitlog.Compress(commitlog.CompressionGZIP, inner)
+	req.NoError(err)
+	b, err := protocol.Encode(&protocol.Message{MagicByte: 1, Attributes: commitlog.CompressionGZIP, Value: compressed})
+	req.NoError(err)
+	recordSet := commitlog.NewMessageSet(3, b)
+
+	// the compressed records are decoded, at the wrapper's offset
+	batch, next, err := decodeBatch(TopicPartition{"test", 0}, 0, recordSet, nil)
+	req.NoError(err)
+	req.Equal(int64(4), next)
+	req.Len(batch.records, 2)
+	for i, value := range []string{"a", "b"} {
+		req.Equal(value, string(batch.records[i].Value))
+		req.Equal(int64(3), batch.records[i].Offset)
+	}
+	req.Equal(len(recordSet)+len(inner), batch.size)
+
+	// a corrupt one fails the fetch
+	b, err = protocol.Encode(&protocol.Message{MagicByte: 1, Attributes: commitlog.CompressionGZIP, Value: []byte("corrupt")})
+	req.NoError(err)
+	_, next, err = decodeBatch(TopicPartition{"test", 0}, 0, commitlog.NewMessageSet(3, b), nil)
+	req.Error(err)
+	req.Equal(int64(0), next)
+}
+
+func TestConsumer_CloseIdle(t *testing.T) {
+	// the fetch loop stops even with nothing to fetch
+	c := newTestConsumer(&fakeFetchConn{}, ConsumerConfig{})
+	done := make(chan error)
+	go func() { done <- c.Close() }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't return")
+	}
+}
+
+// fakeTopicsConn is a broker leading the partition 0 of each of its topics.
+type fakeTopicsConn struct {
+	fakeFetchConn
+	topicsMu sync.Mutex
+	topics   []string
+}
+
+func (c *fakeTopicsConn) setTopics(topics ...string) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	c.topics = topics
+}
+
+func (c *fakeTopicsConn) Metadata(req *protocol.MetadataRequest) (*protocol.MetadataResponse, error) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	res := &protocol.MetadataResponse{Brokers: []*protocol.Broker{{NodeID: 1, Host: "localhost", Port: 9092}}}
+	for _, topic := range c.topics {
+		res.TopicMetadata = append(res.TopicMetadata, &protocol.TopicMetadata{
+			Topic:             topic,
+			PartitionMetadata: []*protocol.PartitionMetadata{{PartitionID: 0, Leader: 1}},
+		})
+	}
+	return res, nil
+}
+
+func TestConsumer_Subscribe(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeTopicsConn{}
+	conn.setTopics("test-a", "other")
+	rebalances := make(chan [2][]TopicPartition, 16)
+	c := NewConsumer(ConsumerConfig{
+		BrokerAddr:              "localhost:9092",
+		FetchBackoff:            time.Millisecond,
+		AutoOffsetReset:         OffsetResetEarliest,
+		MetadataRefreshInterval: 10 * time.Millisecond,
+		Rebalance: func(assigned, revoked []TopicPartition) {
+			rebalances <- [2][]TopicPartition{assigned, revoked}
+		},
+		Dial: func(addr string) (ConsumerConn, error) {
+			return conn, nil
+		},
+	})
+	defer c.Close()
+	rebalanced := func(assigned, revoked []TopicPartition) {
+		select {
+		case r := <-rebalances:
+			req.Equal(assigned, r[0])
+			req.Equal(revoked, r[1])
+		case <-time.After(5 * time.Second):
+			t.Fatal("no rebalance")
+		}
+	}
+	// last is the offset of the last record polled from each topic, which
+	// the next must follow
+	last := make(map[string]int64)
+	poll := func(topic string) *ConsumerRecord {
+		deadline := time.Now().Add(5 * time.Second)
+		var first *ConsumerRecord
+		for first == nil && time.Now().Before(deadline) {
+			records, err := c.Poll(time.Second)
+			req.NoError(err)
+			for _, r := range records {
+				req.NotEqual("other", r.Topic)
+				if offset, ok := last[r.Topic]; ok {
+					req.Equal(offset+1, r.Offset)
+				}
+				last[r.Topic] = r.Offset
+				if r.Topic == topic && first == nil {
+					first = r
+				}
+			}
+		}
+		if first == nil {
+			t.Fatalf("no records from %s", topic)
+		}
+		return first
+	}
+
+	req.Error(c.Subscribe(nil, "("))
+	req.NoError(c.Subscribe(nil, "test-.*"))
+	rebalanced([]TopicPartition{{"test-a", 0}}, nil)
+	// partitions start from the offset reset
+	req.Equal(int64(10), poll("test-a").Offset)
+
+	// topics that start matching are picked up, and those that stop dropped
+	conn.setTopics("test-a", "test-b", "other")
+	rebalanced([]TopicPartition{{"test-b", 0}}, nil)
+	poll("test-b")
+	conn.setTopics("test-b", "other")
+	rebalanced(nil, []TopicPartition{{"test-a", 0}})
+
+	// partitions a new subscription still matches keep their positions
+	req.NoError(c.Subscribe([]string{"test-b"}, ""))
+	for last["test-b"] < 99 {
+		poll("test-b")
+	}
+	records, err := c.Poll(50 * time.Millisecond)
+	req.NoError(err)
+	req.Empty(records)
+	select {
+	case r := <-rebalances:
+		t.Fatalf("unexpected rebalance: %v", r)
+	default:
+	}
+
+	c.Unsubscribe()
+	rebalanced(nil, []TopicPartition{{"test-b", 0}})
+}
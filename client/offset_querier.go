@@ -0,0 +1,293 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// ErrNoWatermarks is returned for the watermarks of a partition that haven't
+// been queried yet.
+var ErrNoWatermarks = errors.New("client: no watermarks for partition")
+
+// offsetsConn is the subset of a broker connection used to query partitions'
+// offsets.
+type offsetsConn interface {
+	Metadata(*protocol.MetadataRequest) (*protocol.MetadataResponse, error)
+	Offsets(*protocol.OffsetsRequest) (*protocol.OffsetsResponse, error)
+}
+
+// offsetQuerier queries partitions' offsets from their leaders: their low and
+// high watermarks, the offsets of their oldest record and of the next record
+// appended, keeping the last ones queried, and their offsets for timestamps.
+type offsetQuerier struct {
+	brokerAddr string
+	conn       func(addr string) (offsetsConn, error)
+	drop       func(addr string, conn offsetsConn)
+
+	mu      sync.Mutex
+	leaders map[TopicPartition]string
+	cached  map[TopicPartition][2]int64
+}
+
+func newOffsetQuerier(brokerAddr string, conn func(string) (offsetsConn, error), drop func(string, offsetsConn)) *offsetQuerier {
+	return &offsetQuerier{
+		brokerAddr: brokerAddr,
+		conn:       conn,
+		drop:       drop,
+		leaders:    make(map[TopicPartition]string),
+		cached:     make(map[TopicPartition][2]int64),
+	}
+}
+
+// get returns the partition's last queried watermarks.
+func (q *offsetQuerier) get(topic string, partition int32) (low, high int64, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	marks, ok := q.cached[TopicPartition{topic, partition}]
+	if !ok {
+		return -1, -1, ErrNoWatermarks
+	}
+	return marks[0], marks[1], nil
+}
+
+// query asks the partition's leader for its watermarks, failing with
+// protocol.ErrRequestTimedOut if they take longer than the timeout. A query
+// that times out still updates the watermarks get returns once it's done.
+func (q *offsetQuerier) query(topic string, partition int32, timeout time.Duration) (low, high int64, err error) {
+	var l, h int64
+	err = withTimeout(timeout, func() (err error) {
+		l, h, err = q.queryLeader(TopicPartition{topic, partition})
+		return err
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	return l, h, nil
+}
+
+// offsetsForTimestamp asks the topic's partitions' leaders for the offset of
+// each partition's first record at or after the timestamp, or its high
+// watermark if it doesn't have one, failing with protocol.ErrRequestTimedOut if
+// they take longer than the timeout.
+func (q *offsetQuerier) offsetsForTimestamp(topic string, timestamp time.Time, timeout time.Duration) (map[int32]int64, error) {
+	var offsets map[int32]int64
+	err := withTimeout(timeout, func() (err error) {
+		offsets, err = q.queryOffsetsForTimestamp(topic, timestamp.UnixNano()/int64(time.Millisecond))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+func (q *offsetQuerier) queryOffsetsForTimestamp(topic string, timestamp int64) (map[int32]int64, error) {
+	conn, err := q.conn(q.brokerAddr)
+	if err != nil {
+		return nil, err
+	}
+	md, err := conn.Metadata(&protocol.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		q.drop(q.brokerAddr, conn)
+		return nil, err
+	}
+	offsets := make(map[int32]int64)
+	for _, tm := range md.TopicMetadata {
+		if tm.Topic != topic {
+			continue
+		}
+		if tm.TopicErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[tm.TopicErrorCode]
+		}
+		for _, pm := range tm.PartitionMetadata {
+			leader, err := md.Leader(topic, pm.PartitionID)
+			if err != nil {
+				return nil, err
+			}
+			offset, err := q.offsetForTimestamp(leader.Addr(), TopicPartition{topic, pm.PartitionID}, timestamp)
+			if err != nil {
+				return nil, err
+			}
+			if offset < 0 {
+				// nothing's at or after the timestamp yet
+				if offset, err = q.offsetForTimestamp(leader.Addr(), TopicPartition{topic, pm.PartitionID}, -1); err != nil {
+					return nil, err
+				}
+			}
+			offsets[pm.PartitionID] = offset
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, protocol.ErrUnknownTopicOrPartition
+	}
+	return offsets, nil
+}
+
+// offsetForTimestamp asks the leader at addr for the offset of the partition's
+// first record at or after the timestamp, or -1 if there isn't one.
+func (q *offsetQuerier) offsetForTimestamp(addr string, tp TopicPartition, timestamp int64) (int64, error) {
+	conn, err := q.conn(addr)
+	if err != nil {
+		return -1, err
+	}
+	res, err := conn.Offsets(&protocol.OffsetsRequest{
+		APIVersion: 1,
+		ReplicaID:  -1,
+		Topics: []*protocol.OffsetsTopic{{
+			Topic:      tp.Topic,
+			Partitions: []*protocol.OffsetsPartition{{Partition: tp.Partition, Timestamp: timestamp}},
+		}},
+	})
+	if err != nil {
+		q.drop(addr, conn)
+		return -1, err
+	}
+	for _, r := range res.Responses {
+		for _, pr := range r.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return -1, protocol.Errs[pr.ErrorCode]
+			}
+			return pr.Offset, nil
+		}
+	}
+	return -1, errors.New("client: incomplete offsets response")
+}
+
+// withTimeout calls fn, returning protocol.ErrRequestTimedOut if it takes
+// longer than the timeout. fn's left to finish in the background if it does.
+func withTimeout(timeout time.Duration, fn func() error) error {
+	// not closed since fn may finish after the timeout
+	c := make(chan error, 1)
+	go func() {
+		c <- fn()
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-c:
+		return err
+	case <-t.C:
+		return protocol.ErrRequestTimedOut
+	}
+}
+
+func (q *offsetQuerier) queryLeader(tp TopicPartition) (low, high int64, err error) {
+	addr, err := q.leader(tp)
+	if err != nil {
+		return -1, -1, err
+	}
+	conn, err := q.conn(addr)
+	if err != nil {
+		return -1, -1, err
+	}
+	res, err := conn.Offsets(&protocol.OffsetsRequest{
+		APIVersion: 1,
+		ReplicaID:  -1,
+		Topics: []*protocol.OffsetsTopic{{
+			Topic: tp.Topic,
+			Partitions: []*protocol.OffsetsPartition{
+				{Partition: tp.Partition, Timestamp: -2},
+				{Partition: tp.Partition, Timestamp: -1},
+			},
+		}},
+	})
+	if err != nil {
+		q.drop(addr, conn)
+		return -1, -1, err
+	}
+	if len(res.Responses) != 1 || len(res.Responses[0].PartitionResponses) != 2 {
+		return -1, -1, errors.New("client: incomplete offsets response")
+	}
+	prs := res.Responses[0].PartitionResponses
+	for _, pr := range prs {
+		if pr.ErrorCode != protocol.ErrNone.Code() {
+			// the leader may have moved
+			q.mu.Lock()
+			delete(q.leaders, tp)
+			q.mu.Unlock()
+			return -1, -1, protocol.Errs[pr.ErrorCode]
+		}
+	}
+	low, high = prs[0].Offset, prs[1].Offset
+	q.mu.Lock()
+	q.cached[tp] = [2]int64{low, high}
+	q.mu.Unlock()
+	return low, high, nil
+}
+
+// leader returns the address of the partition's leader, looking it up through
+// the broker if it isn't known.
+func (q *offsetQuerier) leader(tp TopicPartition) (string, error) {
+	q.mu.Lock()
+	addr, ok := q.leaders[tp]
+	q.mu.Unlock()
+	if ok {
+		return addr, nil
+	}
+	conn, err := q.conn(q.brokerAddr)
+	if err != nil {
+		return "", err
+	}
+	res, err := conn.Metadata(&protocol.MetadataRequest{Topics: []string{tp.Topic}})
+	if err != nil {
+		q.drop(q.brokerAddr, conn)
+		return "", err
+	}
+	leader, err := res.Leader(tp.Topic, tp.Partition)
+	if err != nil {
+		return "", err
+	}
+	addr = leader.Addr()
+	q.mu.Lock()
+	q.leaders[tp] = addr
+	q.mu.Unlock()
+	return addr, nil
+}
+
+// QueryWatermarkOffsets returns the partition's low and high watermarks from
+// its leader, failing with protocol.ErrRequestTimedOut if they take longer
+// than the timeout.
+func (p *Producer) QueryWatermarkOffsets(topic string, partition int32, timeout time.Duration) (low, high int64, err error) {
+	return p.querier.query(topic, partition, timeout)
+}
+
+// GetWatermarkOffsets returns the partition's watermarks from its last query,
+// without asking the leader, or ErrNoWatermarks if it hasn't been queried.
+func (p *Producer) GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error) {
+	return p.querier.get(topic, partition)
+}
+
+// QueryWatermarkOffsets returns the partition's low and high watermarks from
+// its leader, failing with protocol.ErrRequestTimedOut if they take longer
+// than the timeout. The consumer's lag on the partition is the high watermark
+// less its committed offset.
+func (c *Committer) QueryWatermarkOffsets(topic string, partition int32, timeout time.Duration) (low, high int64, err error) {
+	return c.querier.query(topic, partition, timeout)
+}
+
+// GetWatermarkOffsets returns the partition's watermarks from its last query,
+// without asking the leader, or ErrNoWatermarks if it hasn't been queried.
+func (c *Committer) GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error) {
+	return c.querier.get(topic, partition)
+}
+
+// OffsetsForTimestamp returns the offset of each of the topic's partitions'
+// first record at or after the timestamp, or the partition's high watermark if
+// it doesn't have one, e.g. to start consuming the topic from a wall-clock
+// time. It fails with protocol.ErrRequestTimedOut if the leaders take longer
+// than the timeout.
+func (p *Producer) OffsetsForTimestamp(topic string, timestamp time.Time, timeout time.Duration) (map[int32]int64, error) {
+	return p.querier.offsetsForTimestamp(topic, timestamp, timeout)
+}
+
+// OffsetsForTimestamp returns the offset of each of the topic's partitions'
+// first record at or after the timestamp, or the partition's high watermark if
+// it doesn't have one, failing with protocol.ErrRequestTimedOut if the leaders
+// take longer than the timeout. Marking and committing them starts the group
+// consuming the topic from the timestamp.
+func (c *Committer) OffsetsForTimestamp(topic string, timestamp time.Time, timeout time.Duration) (map[int32]int64, error) {
+	return c.querier.offsetsForTimestamp(topic, timestamp, timeout)
+}
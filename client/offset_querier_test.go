@@ -0,0 +1,99 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// slowConn answers offsets requests after a delay.
+type slowConn struct {
+	fakeConn
+	delay time.Duration
+}
+
+func (c *slowConn) Offsets(req *protocol.OffsetsRequest) (*protocol.OffsetsResponse, error) {
+	time.Sleep(c.delay)
+	return c.fakeConn.Offsets(req)
+}
+
+func TestWatermarkOffsets(t *testing.T) {
+	req := require.New(t)
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		Dial: func(addr string) (Conn, error) {
+			return &fakeConn{}, nil
+		},
+	})
+	defer p.Close()
+
+	_, _, err := p.GetWatermarkOffsets("test", 1)
+	req.Equal(ErrNoWatermarks, err)
+	low, high, err := p.QueryWatermarkOffsets("test", 1, time.Second)
+	req.NoError(err)
+	req.Equal(int64(10), low)
+	req.Equal(int64(100), high)
+	low, high, err = p.GetWatermarkOffsets("test", 1)
+	req.NoError(err)
+	req.Equal(int64(10), low)
+	req.Equal(int64(100), high)
+
+	_, _, err = p.QueryWatermarkOffsets("other", 0, time.Second)
+	req.Equal(protocol.ErrUnknownTopicOrPartition, err)
+
+	c := NewCommitter(CommitterConfig{
+		BrokerAddr: "localhost:9092",
+		GroupID:    "test-group",
+		Dial: func(addr string) (CommitConn, error) {
+			return &fakeCommitConn{}, nil
+		},
+	})
+	defer c.Close()
+	low, high, err = c.QueryWatermarkOffsets("test", 2, time.Second)
+	req.NoError(err)
+	req.Equal(int64(10), low)
+	req.Equal(int64(100), high)
+}
+
+func TestWatermarkOffsets_Timeout(t *testing.T) {
+	req := require.New(t)
+	conn := &slowConn{delay: 100 * time.Millisecond}
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	defer p.Close()
+
+	_, _, err := p.QueryWatermarkOffsets("test", 0, 10*time.Millisecond)
+	req.Equal(protocol.ErrRequestTimedOut, err)
+
+	// the timed out query still finishes
+	time.Sleep(200 * time.Millisecond)
+	low, high, err := p.GetWatermarkOffsets("test", 0)
+	req.NoError(err)
+	req.Equal(int64(10), low)
+	req.Equal(int64(100), high)
+}
+
+func TestOffsetsForTimestamp(t *testing.T) {
+	req := require.New(t)
+	c := NewCommitter(CommitterConfig{
+		BrokerAddr: "localhost:9092",
+		GroupID:    "test-group",
+		Dial: func(addr string) (CommitConn, error) {
+			return &fakeCommitConn{}, nil
+		},
+	})
+	defer c.Close()
+
+	offsets, err := c.OffsetsForTimestamp("test", time.Now().Add(-time.Hour), time.Second)
+	req.NoError(err)
+	req.Equal(map[int32]int64{0: 50, 1: 50, 2: 50}, offsets)
+
+	_, err = c.OffsetsForTimestamp("other", time.Now(), time.Second)
+	req.Equal(protocol.ErrUnknownTopicOrPartition, err)
+}
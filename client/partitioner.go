@@ -0,0 +1,131 @@
+package client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Partitioner picks the partition of a topic a record's produced to.
+type Partitioner interface {
+	// Partition returns the partition, out of the topic's numPartitions, for
+	// a record with the key. Key is nil for records without one.
+	Partition(topic string, key []byte, numPartitions int32) int32
+	// OnNewBatch is called before a record without a key starts a new batch
+	// in the partition Partition returned for it, and the record's
+	// partitioned again after. Sticky partitioners move on to another
+	// partition here.
+	OnNewBatch(topic string, numPartitions, prev int32)
+}
+
+// HashPartitioner partitions records with keys by the murmur2 hash of their key,
+// the same as Kafka's Java client so both agree on where a key's records go,
+// and records without keys round-robin.
+type HashPartitioner struct {
+	mu   sync.Mutex
+	next map[string]int32
+}
+
+func NewHashPartitioner() *HashPartitioner {
+	return &HashPartitioner{next: make(map[string]int32)}
+}
+
+func (p *HashPartitioner) Partition(topic string, key []byte, numPartitions int32) int32 {
+	if key != nil {
+		return hashPartition(key, numPartitions)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	partition := p.next[topic] % numPartitions
+	p.next[topic] = partition + 1
+	return partition
+}
+
+func (p *HashPartitioner) OnNewBatch(string, int32, int32) {}
+
+// StickyPartitioner partitions records with keys like HashPartitioner, and
+// sticks records without keys to one partition until its batch is sent, then
+// moves on to another partition at random (KIP-480). Compared with
+// round-robin, the records fill fewer, larger batches, so there are fewer
+// produce requests and less latency waiting on lingering batches.
+type StickyPartitioner struct {
+	mu     sync.Mutex
+	sticky map[string]int32
+	rand   *rand.Rand
+}
+
+func NewStickyPartitioner() *StickyPartitioner {
+	return &StickyPartitioner{
+		sticky: make(map[string]int32),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *StickyPartitioner) Partition(topic string, key []byte, numPartitions int32) int32 {
+	if key != nil {
+		return hashPartition(key, numPartitions)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	partition, ok := p.sticky[topic]
+	if !ok || partition >= numPartitions {
+		partition = p.rand.Int31n(numPartitions)
+		p.sticky[topic] = partition
+	}
+	return partition
+}
+
+func (p *StickyPartitioner) OnNewBatch(topic string, numPartitions, prev int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// another record may have moved the topic on already
+	if partition, ok := p.sticky[topic]; ok && partition != prev {
+		return
+	}
+	partition := p.rand.Int31n(numPartitions)
+	if numPartitions > 1 {
+		for partition == prev {
+			partition = p.rand.Int31n(numPartitions)
+		}
+	}
+	p.sticky[topic] = partition
+}
+
+func hashPartition(key []byte, numPartitions int32) int32 {
+	return int32(murmur2(key)&0x7fffffff) % numPartitions
+}
+
+// murmur2 is the hash Kafka's Java client partitions keys with.
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
@@ -0,0 +1,298 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	defaultPipelineMaxRecords     = 500
+	defaultPipelineCommitInterval = 100 * time.Millisecond
+	defaultPipelineRetryBackoff   = time.Second
+)
+
+// PipelineConfig for a pipeline.
+type PipelineConfig struct {
+	// GroupID is the group the source partitions' offsets are committed as.
+	GroupID string
+	// Partitions are the source partitions. Each's consumed from the group's
+	// committed offset, or from its oldest record if the group hasn't
+	// committed one.
+	Partitions []TopicPartition
+	// Transform returns the records to produce for a consumed record, to any
+	// topics. If it fails, the record's transaction is aborted and Run
+	// returns a *TransformError.
+	Transform func(*ConsumerRecord) ([]*Record, error)
+	// MaxRecords is about how many consumed records a transaction takes
+	// before it's committed. Defaults to 500.
+	MaxRecords int
+	// CommitInterval is how long a transaction takes records for, from its
+	// first, before it's committed. Defaults to 100ms.
+	CommitInterval time.Duration
+	// RetryBackoff is how long the pipeline waits to start again after a
+	// transaction fails. Defaults to 1s.
+	RetryBackoff time.Duration
+	// Consumer configures the source's consumer. Its IsolationLevel is always
+	// read_committed.
+	Consumer ConsumerConfig
+	// Producer configures the sink's producer. Its TransactionalID is
+	// required, and must be the same each time the pipeline's run so a new
+	// run fences off the last.
+	Producer ProducerConfig
+}
+
+// TransformError is returned by Run when the config's Transform fails.
+type TransformError struct {
+	Record *ConsumerRecord
+	Err    error
+}
+
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("client: transform %s-%d at offset %d: %s", e.Record.Topic, e.Record.Partition, e.Record.Offset, e.Err)
+}
+
+// Pipeline consumes the source partitions, transforms their records, and
+// produces the results, exactly once: the records produced for a batch of
+// consumed records are committed in one transaction along with the source's
+// offsets past them. The source's read_committed, so pipelines can be chained.
+// If a transaction fails it's aborted and the source's rewound to the offsets
+// last committed, so none of its records are produced twice or lost.
+type Pipeline struct {
+	config   PipelineConfig
+	consumer *Consumer
+	producer *Producer
+}
+
+// NewPipeline returns a pipeline for the config.
+func NewPipeline(config PipelineConfig) (*Pipeline, error) {
+	if config.Producer.TransactionalID == "" {
+		return nil, ErrNotTransactional
+	}
+	if config.Transform == nil {
+		return nil, errors.New("client: pipeline needs a transform")
+	}
+	if config.MaxRecords == 0 {
+		config.MaxRecords = defaultPipelineMaxRecords
+	}
+	if config.CommitInterval == 0 {
+		config.CommitInterval = defaultPipelineCommitInterval
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultPipelineRetryBackoff
+	}
+	config.Consumer.IsolationLevel = protocol.ReadCommitted
+	return &Pipeline{
+		config:   config,
+		consumer: NewConsumer(config.Consumer),
+		producer: NewProducer(config.Producer),
+	}, nil
+}
+
+// Run runs transactions until the context's done, a record fails to
+// transform, or the pipeline's fenced off by another with its
+// TransactionalID. Other failed transactions are retried after the backoff.
+// The ongoing transaction's aborted when Run returns.
+func (p *Pipeline) Run(ctx context.Context) error {
+	if err := p.initTransactions(ctx); err != nil {
+		return err
+	}
+	if err := p.rewind(); err != nil {
+		return err
+	}
+	for {
+		err := p.transaction(ctx)
+		if err == nil {
+			continue
+		}
+		abortErr := p.producer.AbortTransaction()
+		if abortErr == ErrNoTransaction {
+			abortErr = nil
+		}
+		if abortErr != nil {
+			log.Error.Printf("client: pipeline abort transaction error: %s", abortErr)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := err.(*TransformError); ok || fenced(err) {
+			return err
+		}
+		if fenced(abortErr) {
+			return abortErr
+		}
+		log.Error.Printf("client: pipeline transaction error: %s", err)
+		for {
+			select {
+			case <-time.After(p.config.RetryBackoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if err = p.restart(abortErr != nil); err == nil {
+				break
+			}
+			if fenced(err) {
+				return err
+			}
+			log.Error.Printf("client: pipeline restart error: %s", err)
+		}
+	}
+}
+
+// initTransactions initializes the producer, fencing off the last run, and
+// waits while the brokers finish the last run's transaction.
+func (p *Pipeline) initTransactions(ctx context.Context) error {
+	for {
+		err := p.producer.InitTransactions()
+		if err != protocol.ErrConcurrentTransactions {
+			return err
+		}
+		select {
+		case <-time.After(p.config.RetryBackoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// restart rewinds the source after a failed transaction. If the transaction
+// couldn't be aborted, e.g. because its commit was acknowledged but its
+// markers weren't all written, the producer's initialized again, which
+// finishes the transaction however it ended.
+func (p *Pipeline) restart(reinit bool) error {
+	if reinit {
+		if err := p.producer.InitTransactions(); err != nil {
+			return err
+		}
+	}
+	return p.rewind()
+}
+
+// transaction consumes records, from the first polled until MaxRecords or
+// CommitInterval, and commits the records produced for them and the offsets
+// past them.
+func (p *Pipeline) transaction(ctx context.Context) error {
+	offsets := make(map[TopicPartition]int64)
+	var consumed int
+	var deadline time.Time
+	for consumed < p.config.MaxRecords {
+		wait := p.config.CommitInterval
+		if !deadline.IsZero() {
+			if wait = time.Until(deadline); wait <= 0 {
+				break
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		records, err := p.consumer.Poll(wait)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if deadline.IsZero() {
+			// transactions begin with their first record, so an idle
+			// pipeline doesn't commit empty ones
+			if err := p.producer.BeginTransaction(); err != nil {
+				return err
+			}
+			deadline = time.Now().Add(p.config.CommitInterval)
+		}
+		for _, r := range records {
+			out, err := p.config.Transform(r)
+			if err != nil {
+				return &TransformError{Record: r, Err: err}
+			}
+			for _, o := range out {
+				// records that fail fail the commit
+				if err := p.producer.Send(o, nil); err != nil {
+					return err
+				}
+			}
+			offsets[TopicPartition{r.Topic, r.Partition}] = r.Offset + 1
+			consumed++
+		}
+	}
+	if err := p.producer.SendOffsetsToTransaction(p.config.GroupID, offsets); err != nil {
+		return err
+	}
+	return p.producer.CommitTransaction()
+}
+
+// rewind assigns the source partitions from the group's committed offsets, or
+// their oldest if it hasn't committed any, dropping what's been consumed
+// since.
+func (p *Pipeline) rewind() error {
+	offsets, err := p.committed()
+	if err != nil {
+		return err
+	}
+	for _, tp := range p.config.Partitions {
+		offset, ok := offsets[tp]
+		if !ok {
+			if offset, _, err = p.producer.QueryWatermarkOffsets(tp.Topic, tp.Partition, p.producer.config.RequestTimeout); err != nil {
+				return err
+			}
+		}
+		p.consumer.Assign(tp.Topic, tp.Partition, offset)
+	}
+	return nil
+}
+
+// committed returns the group's committed offsets for the source partitions.
+func (p *Pipeline) committed() (map[TopicPartition]int64, error) {
+	req := &protocol.OffsetFetchRequest{GroupID: p.config.GroupID}
+	byTopic := make(map[string]int)
+	for _, tp := range p.config.Partitions {
+		i, ok := byTopic[tp.Topic]
+		if !ok {
+			i = len(req.Topics)
+			byTopic[tp.Topic] = i
+			req.Topics = append(req.Topics, protocol.OffsetFetchTopicRequest{Topic: tp.Topic})
+		}
+		req.Topics[i].Partitions = append(req.Topics[i].Partitions, tp.Partition)
+	}
+	addr := p.config.Producer.BrokerAddr
+	conn, err := p.producer.transactionConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.OffsetFetch(req)
+	if err != nil {
+		p.producer.drop(addr, conn)
+		return nil, err
+	}
+	offsets := make(map[TopicPartition]int64)
+	for _, tr := range res.Responses {
+		for _, pr := range tr.Partitions {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return nil, protocol.Errs[pr.ErrorCode]
+			}
+			if pr.Offset >= 0 {
+				offsets[TopicPartition{tr.Topic, pr.Partition}] = pr.Offset
+			}
+		}
+	}
+	return offsets, nil
+}
+
+// Close closes the pipeline's consumer and producer. Run must have returned.
+func (p *Pipeline) Close() error {
+	cerr := p.consumer.Close()
+	if err := p.producer.Close(); err != nil {
+		return err
+	}
+	return cerr
+}
+
+// fenced returns whether the error means another producer with the
+// pipeline's TransactionalID has taken over.
+func fenced(err error) bool {
+	return err == protocol.ErrInvalidProducerEpoch || err == protocol.ErrInvalidProducerIdMapping
+}
@@ -0,0 +1,714 @@
+// Package client is a Go client for producing to and consuming from a Jocko
+// cluster and committing consumers' offsets.
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	defaultBatchSize      = 16 << 10
+	defaultLinger         = 5 * time.Millisecond
+	defaultRequestTimeout = 10 * time.Second
+	defaultRetries        = 3
+	defaultRetryBackoff   = 100 * time.Millisecond
+	defaultBufferMemory   = 32 << 20
+	defaultMaxBlock       = 60 * time.Second
+	defaultTxnTimeout     = 60 * time.Second
+)
+
+var (
+	// ErrClosed is returned for records sent after the producer's closed.
+	ErrClosed = errors.New("client: producer closed")
+	// ErrBufferFull is returned for records sent while the producer's buffer
+	// is full and that no space was freed for in time, and is sent on the
+	// producer's Errors channel when a send finds the buffer full.
+	ErrBufferFull = errors.New("client: producer buffer full")
+)
+
+// Conn is the subset of a broker connection used by the client.
+type Conn interface {
+	Metadata(*protocol.MetadataRequest) (*protocol.MetadataResponse, error)
+	Produce(*protocol.ProduceRequest) (*protocol.ProduceResponse, error)
+	Offsets(*protocol.OffsetsRequest) (*protocol.OffsetsResponse, error)
+	Close() error
+}
+
+// Record is a record to produce.
+type Record struct {
+	Topic string
+	// Key picks the record's partition. Records without keys are spread over
+	// the topic's partitions by the producer's partitioner.
+	Key   []byte
+	Value []byte
+	// Timestamp defaults to when the record's sent.
+	Timestamp time.Time
+}
+
+// ProducerConfig for the producer.
+type ProducerConfig struct {
+	// BrokerAddr is the address of a broker used to look up partition leaders.
+	BrokerAddr string
+	// Acks is how many replicas must have the records before they're
+	// acknowledged, or -1 for the whole ISR. Defaults to 1.
+	Acks int16
+	// NoAcks sends records without waiting for the brokers to acknowledge
+	// them, the brokers don't answer at all, so records can be lost without
+	// their callbacks seeing an error and the offsets they're called with
+	// are -1. Acks is ignored. Transactional producers' records are always
+	// acknowledged.
+	NoAcks bool
+	// BatchSize is how many bytes of records are batched for a partition
+	// before the batch is sent. Defaults to 16KiB.
+	BatchSize int
+	// Linger is how long a batch waits for more records before it's sent
+	// anyway. Defaults to 5ms.
+	Linger time.Duration
+	// RequestTimeout is how long the brokers have to acknowledge a batch.
+	// Defaults to 10s.
+	RequestTimeout time.Duration
+	// Retries is how many times a batch that failed with a retriable error,
+	// like its partition's leader moving, is sent again before its records
+	// fail. The partition's later batches wait for it, so its records are
+	// still appended in the order they were sent. A batch whose
+	// acknowledgement was lost is appended again. Defaults to 3, if it's
+	// negative batches aren't retried.
+	Retries int
+	// RetryBackoff is how long a batch waits before it's retried. Defaults to
+	// 100ms.
+	RetryBackoff time.Duration
+	// BufferMemory is how many bytes of records can be buffered, batched or
+	// waiting to be acknowledged, before sends wait for space. Defaults to
+	// 32MiB.
+	BufferMemory int
+	// MaxBlock is how long a send waits for buffer space before failing with
+	// ErrBufferFull. Defaults to 60s, if it's negative sends fail right away.
+	MaxBlock time.Duration
+	// ChunkBytes, if set, splits records with values bigger than it into
+	// chunks of up to ChunkBytes produced in a run to the same partition, for
+	// the occasional value bigger than the brokers' max message size.
+	// Consumers put them back together with a ChunkAssembler.
+	ChunkBytes int
+	// Partitioner picks records' partitions. Defaults to a StickyPartitioner.
+	Partitioner Partitioner
+	// TransactionalID, if set, makes the producer transactional: its records
+	// are sent in transactions that are committed, or aborted, as a whole.
+	// InitTransactions must be called before the first transaction begins,
+	// and fences off any earlier producer with the same ID.
+	TransactionalID string
+	// TransactionTimeout is how long the producer's transactions can stay
+	// open, at most the brokers' TransactionMaxTimeout. Defaults to 60s.
+	TransactionTimeout time.Duration
+	// Dial opens a connection to the broker at the address. Defaults to
+	// jocko.Dial. Transactional producers' connections must be
+	// TransactionConns.
+	Dial func(addr string) (Conn, error)
+}
+
+// Callback is called once a record's batch is acknowledged, with the offset of
+// the message set the batch was appended as, or with the error it failed with.
+type Callback func(partition int32, offset int64, err error)
+
+// Producer batches records by partition and sends each batch to its
+// partition's leader once it's full or has lingered. A partition's batches are
+// sent one at a time, in the order they filled, so its records are appended in
+// the order they were sent even when a batch is retried.
+// Records take up the producer's buffer until they're acknowledged, so sends
+// are held back, and eventually fail, while the brokers can't keep up.
+type Producer struct {
+	config ProducerConfig
+
+	mu         sync.Mutex
+	batches    map[topicPartition]*batch
+	inFlight   map[*batch]struct{}
+	queues     map[topicPartition]*sendQueue
+	partitions map[string]int32
+	leaders    map[topicPartition]string
+	conns      map[string]Conn
+	querier    *offsetQuerier
+	closed     bool
+	// bufferedRecords and bufferedBytes are the records batched or in flight.
+	bufferedRecords int
+	bufferedBytes   int
+	// freedCh is closed, and replaced, when buffer space is freed.
+	freedCh chan struct{}
+	errCh   chan error
+	// txn is the transactional producer's session and ongoing transaction.
+	txn txnState
+
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// sendQueue is a partition's batches waiting to be sent, in order.
+type sendQueue struct {
+	batches []*batch
+	// sending is set while a send's draining the queue, the batches queued
+	// meanwhile are left to it.
+	sending bool
+}
+
+type batch struct {
+	msgs      []commitlog.Message
+	callbacks []Callback
+	size      int
+	created   time.Time
+	// done is closed once the batch is acknowledged or failed.
+	done chan struct{}
+}
+
+// NewProducer returns a producer for the config and starts sending its
+// lingering batches in the background.
+func NewProducer(config ProducerConfig) *Producer {
+	if config.Acks == 0 {
+		config.Acks = 1
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.Linger == 0 {
+		config.Linger = defaultLinger
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultRetries
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+	if config.BufferMemory == 0 {
+		config.BufferMemory = defaultBufferMemory
+	}
+	if config.MaxBlock == 0 {
+		config.MaxBlock = defaultMaxBlock
+	}
+	if config.TransactionTimeout == 0 {
+		config.TransactionTimeout = defaultTxnTimeout
+	}
+	if config.Partitioner == nil {
+		config.Partitioner = NewStickyPartitioner()
+	}
+	if config.Dial == nil {
+		config.Dial = func(addr string) (Conn, error) {
+			return jocko.Dial("tcp", addr)
+		}
+	}
+	p := &Producer{
+		config:     config,
+		batches:    make(map[topicPartition]*batch),
+		inFlight:   make(map[*batch]struct{}),
+		queues:     make(map[topicPartition]*sendQueue),
+		partitions: make(map[string]int32),
+		leaders:    make(map[topicPartition]string),
+		conns:      make(map[string]Conn),
+		freedCh:    make(chan struct{}),
+		errCh:      make(chan error, 16),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	p.querier = newOffsetQuerier(config.BrokerAddr, func(addr string) (offsetsConn, error) {
+		return p.conn(addr)
+	}, func(addr string, conn offsetsConn) {
+		p.drop(addr, conn.(Conn))
+	})
+	go p.lingerLoop()
+	return p
+}
+
+// Send adds the record to its partition's batch. Callback, if it isn't nil, is
+// called once the batch is acknowledged or fails. If the buffer's full, Send
+// waits up to the config's MaxBlock for space. A record chunked because of
+// ChunkBytes has its callback called once all its chunks are acknowledged. If
+// only some of its chunks could be added, Send returns the error and the
+// callback's called with it once the added chunks are done.
+// Transactional producers' records are sent in the ongoing transaction.
+func (p *Producer) Send(r *Record, callback Callback) error {
+	if err := p.checkTransaction(); err != nil {
+		return err
+	}
+	numPartitions, err := p.numPartitions(r.Topic)
+	if err != nil {
+		return err
+	}
+	timestamp := r.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if p.config.ChunkBytes > 0 && len(r.Value) > p.config.ChunkBytes {
+		chunks := chunkValue(r.Value, p.config.ChunkBytes)
+		callback = chunkCallback(len(chunks), callback)
+		// the chunks all go to the first's partition so they're consumed in
+		// order
+		partition := int32(-1)
+		for i, chunk := range chunks {
+			added, err := p.add(r.Topic, r.Key, timestamp, chunk, protocol.ChunkAttribute, partition, numPartitions, callback)
+			if err != nil {
+				if callback != nil && i > 0 {
+					for ; i < len(chunks); i++ {
+						callback(partition, -1, err)
+					}
+				}
+				return err
+			}
+			partition = added
+		}
+		return nil
+	}
+	_, err = p.add(r.Topic, r.Key, timestamp, r.Value, 0, -1, numPartitions, callback)
+	return err
+}
+
+// add adds a message with the attributes to the partition's batch, or to the
+// partition the partitioner picks if it's -1, and returns the partition.
+func (p *Producer) add(topic string, key []byte, timestamp time.Time, value []byte, attributes int8, partition, numPartitions int32, callback Callback) (int32, error) {
+	if p.config.TransactionalID != "" {
+		// read_committed consumers hold transactional messages until their
+		// transaction ends. Brokers only accept them in transactional
+		// produce requests, from the producer's live session.
+		attributes |= protocol.TransactionalAttribute
+	}
+	msg, err := protocol.Encode(&protocol.Message{
+		MagicByte:  1,
+		Attributes: attributes,
+		Timestamp:  timestamp,
+		Key:        key,
+		Value:      value,
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	p.mu.Lock()
+	if err := p.reserve(len(msg)); err != nil {
+		p.mu.Unlock()
+		return -1, err
+	}
+	if partition < 0 {
+		partition = p.config.Partitioner.Partition(topic, key, numPartitions)
+		if key == nil {
+			if _, ok := p.batches[topicPartition{topic, partition}]; !ok {
+				p.config.Partitioner.OnNewBatch(topic, numPartitions, partition)
+				partition = p.config.Partitioner.Partition(topic, key, numPartitions)
+			}
+		}
+	}
+	tp := topicPartition{topic, partition}
+	b, ok := p.batches[tp]
+	if !ok {
+		b = &batch{created: time.Now(), done: make(chan struct{})}
+		p.batches[tp] = b
+	}
+	b.msgs = append(b.msgs, msg)
+	b.callbacks = append(b.callbacks, callback)
+	b.size += len(msg)
+	drain := false
+	if b.size >= p.config.BatchSize {
+		drain = p.take(tp, b)
+	}
+	p.mu.Unlock()
+
+	if drain {
+		p.drain(tp)
+	}
+	return partition, nil
+}
+
+// reserve takes buffer space for a record of the size, waiting for space if
+// the buffer's full. A record's let in when the buffer's empty even if it's
+// bigger than the buffer. The producer's lock must be held, it's released
+// while waiting.
+func (p *Producer) reserve(size int) error {
+	var timeout <-chan time.Time
+	for {
+		if p.closed {
+			return ErrClosed
+		}
+		if p.bufferedBytes == 0 || p.bufferedBytes+size <= p.config.BufferMemory {
+			p.bufferedRecords++
+			p.bufferedBytes += size
+			return nil
+		}
+		if timeout == nil {
+			select {
+			case p.errCh <- ErrBufferFull:
+			default:
+				// no one's keeping up with the errors
+			}
+			if p.config.MaxBlock < 0 {
+				return ErrBufferFull
+			}
+			timer := time.NewTimer(p.config.MaxBlock)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		freedCh := p.freedCh
+		p.mu.Unlock()
+		select {
+		case <-freedCh:
+			p.mu.Lock()
+		case <-timeout:
+			p.mu.Lock()
+			return ErrBufferFull
+		case <-p.shutdownCh:
+			p.mu.Lock()
+			return ErrClosed
+		}
+	}
+}
+
+// take removes the partition's batch and queues it to be sent. It returns
+// whether the caller has to drain the partition's queue, it doesn't if another
+// send's already draining it. The producer's lock must be held.
+func (p *Producer) take(tp topicPartition, b *batch) bool {
+	delete(p.batches, tp)
+	p.inFlight[b] = struct{}{}
+	q, ok := p.queues[tp]
+	if !ok {
+		q = &sendQueue{}
+		p.queues[tp] = q
+	}
+	q.batches = append(q.batches, b)
+	if q.sending {
+		return false
+	}
+	q.sending = true
+	return true
+}
+
+// drain sends the partition's queued batches in order until there are none
+// left.
+func (p *Producer) drain(tp topicPartition) {
+	for {
+		p.mu.Lock()
+		q := p.queues[tp]
+		if len(q.batches) == 0 {
+			delete(p.queues, tp)
+			p.mu.Unlock()
+			return
+		}
+		b := q.batches[0]
+		q.batches = q.batches[1:]
+		p.mu.Unlock()
+		p.send(tp, b)
+	}
+}
+
+// Flush sends the batched records, without waiting for them to linger, and
+// waits until they and the records already being sent are acknowledged or
+// failed.
+func (p *Producer) Flush() {
+	// the batched records are taken first, they may be queued behind a
+	// batch another send's sending
+	p.sendLingering(time.Time{})
+	p.mu.Lock()
+	pending := make([]*batch, 0, len(p.inFlight))
+	for b := range p.inFlight {
+		pending = append(pending, b)
+	}
+	p.mu.Unlock()
+	for _, b := range pending {
+		<-b.done
+	}
+}
+
+// Buffered returns how many records, and how many bytes of them, are batched
+// or waiting to be acknowledged.
+func (p *Producer) Buffered() (records, bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bufferedRecords, p.bufferedBytes
+}
+
+// Errors returns a channel ErrBufferFull is sent on when sends find the buffer
+// full, so applications can shed or slow down their sends before they start
+// failing. Errors are dropped while the channel's full.
+func (p *Producer) Errors() <-chan error {
+	return p.errCh
+}
+
+// Close sends the batched records, waits until they're acknowledged or failed,
+// and closes the producer's connections.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	close(p.shutdownCh)
+	<-p.doneCh
+	p.Flush()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+	return nil
+}
+
+// lingerLoop sends the batches that have lingered long enough.
+func (p *Producer) lingerLoop() {
+	defer close(p.doneCh)
+	ticker := time.NewTicker(p.config.Linger)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.shutdownCh:
+			return
+		case now := <-ticker.C:
+			p.sendLingering(now.Add(-p.config.Linger))
+		}
+	}
+}
+
+// sendLingering sends the batches created before the given time, or all of them
+// if it's zero.
+func (p *Producer) sendLingering(before time.Time) {
+	p.mu.Lock()
+	var ready []topicPartition
+	for tp, b := range p.batches {
+		if before.IsZero() || b.created.Before(before) {
+			if p.take(tp, b) {
+				ready = append(ready, tp)
+			}
+		}
+	}
+	p.mu.Unlock()
+	for _, tp := range ready {
+		p.drain(tp)
+	}
+}
+
+// send produces the batch to its partition's leader, retrying it if it fails
+// with a retriable error, and calls its callbacks.
+func (p *Producer) send(tp topicPartition, b *batch) {
+	recordSet := commitlog.NewMessageSet(0, b.msgs...)
+	offset, err := p.produce(tp, recordSet)
+	for retries := 0; err != nil && retries < p.config.Retries && retriable(err); retries++ {
+		log.Info.Printf("client: produce to %s-%d error: %s, retrying", tp.topic, tp.partition, err)
+		time.Sleep(p.config.RetryBackoff)
+		offset, err = p.produce(tp, recordSet)
+	}
+	if err != nil {
+		log.Error.Printf("client: produce to %s-%d error: %s", tp.topic, tp.partition, err)
+		p.failTransaction(err)
+	}
+	for _, cb := range b.callbacks {
+		if cb != nil {
+			cb(tp.partition, offset, err)
+		}
+	}
+	p.mu.Lock()
+	delete(p.inFlight, b)
+	p.bufferedRecords -= len(b.msgs)
+	p.bufferedBytes -= b.size
+	close(p.freedCh)
+	p.freedCh = make(chan struct{})
+	p.mu.Unlock()
+	close(b.done)
+}
+
+func (p *Producer) produce(tp topicPartition, recordSet []byte) (int64, error) {
+	addr, err := p.leader(tp)
+	if err != nil {
+		return -1, err
+	}
+	var conn Conn
+	if p.config.TransactionalID != "" {
+		conn, err = p.transactionConn(addr)
+	} else {
+		conn, err = p.conn(addr)
+	}
+	if err != nil {
+		return -1, err
+	}
+	acks := p.config.Acks
+	if p.config.NoAcks && p.config.TransactionalID == "" {
+		acks = 0
+	}
+	req := &protocol.ProduceRequest{
+		Acks:    acks,
+		Timeout: p.config.RequestTimeout,
+		TopicData: []*protocol.TopicData{{
+			Topic: tp.topic,
+			Data:  []*protocol.Data{{Partition: tp.partition, RecordSet: recordSet}},
+		}},
+	}
+	var res *protocol.ProduceResponse
+	if p.config.TransactionalID != "" {
+		// the broker adds the partition to the producer's transaction, the
+		// session's sent alongside the produce since the message format
+		// doesn't have it
+		req.APIVersion = 3
+		req.TransactionalID = &p.config.TransactionalID
+		txn := &protocol.TransactionalProduceRequest{Produce: req}
+		p.mu.Lock()
+		txn.ProducerID, txn.ProducerEpoch = p.txn.producerID, p.txn.producerEpoch
+		p.mu.Unlock()
+		var txnRes *protocol.TransactionalProduceResponse
+		if txnRes, err = conn.(TransactionConn).TransactionalProduce(txn); err == nil {
+			res = txnRes.Produce
+		}
+	} else {
+		res, err = conn.Produce(req)
+	}
+	if err != nil {
+		p.drop(addr, conn)
+		return -1, err
+	}
+	if acks == 0 {
+		return -1, nil
+	}
+	for _, tr := range res.Responses {
+		for _, pr := range tr.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				// the leader may have moved
+				p.mu.Lock()
+				delete(p.leaders, tp)
+				p.mu.Unlock()
+				return -1, protocol.Errs[pr.ErrorCode]
+			}
+			return pr.BaseOffset, nil
+		}
+	}
+	return -1, errors.New("client: empty produce response")
+}
+
+// retriable returns whether a batch that failed with the error can be sent
+// again, because its partition's leader moved or wasn't reachable for the
+// moment.
+func retriable(err error) bool {
+	perr, ok := err.(protocol.Error)
+	if !ok {
+		// the connection failed
+		return err != ErrClosed
+	}
+	switch perr.Code() {
+	case protocol.ErrNotLeaderForPartition.Code(),
+		protocol.ErrLeaderNotAvailable.Code(),
+		protocol.ErrReplicaNotAvailable.Code(),
+		protocol.ErrRequestTimedOut.Code(),
+		protocol.ErrNetworkException.Code(),
+		protocol.ErrNotEnoughReplicas.Code(),
+		protocol.ErrNotEnoughReplicasAfterAppend.Code(),
+		protocol.ErrKafkaStorageError.Code():
+		return true
+	}
+	return false
+}
+
+// numPartitions returns how many partitions the topic has, looking it up the
+// first time.
+func (p *Producer) numPartitions(topic string) (int32, error) {
+	p.mu.Lock()
+	n, ok := p.partitions[topic]
+	p.mu.Unlock()
+	if ok {
+		return n, nil
+	}
+	if err := p.refreshMetadata(topic); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n, ok = p.partitions[topic]; !ok || n == 0 {
+		return 0, protocol.ErrUnknownTopicOrPartition
+	}
+	return n, nil
+}
+
+// leader returns the address of the partition's leader.
+func (p *Producer) leader(tp topicPartition) (string, error) {
+	p.mu.Lock()
+	addr, ok := p.leaders[tp]
+	p.mu.Unlock()
+	if ok {
+		return addr, nil
+	}
+	if err := p.refreshMetadata(tp.topic); err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if addr, ok = p.leaders[tp]; !ok {
+		return "", protocol.ErrLeaderNotAvailable
+	}
+	return addr, nil
+}
+
+// refreshMetadata looks up the topic's partitions and their leaders.
+func (p *Producer) refreshMetadata(topic string) error {
+	conn, err := p.conn(p.config.BrokerAddr)
+	if err != nil {
+		return err
+	}
+	res, err := conn.Metadata(&protocol.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		p.drop(p.config.BrokerAddr, conn)
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, tm := range res.TopicMetadata {
+		if tm.TopicErrorCode != protocol.ErrNone.Code() {
+			return protocol.Errs[tm.TopicErrorCode]
+		}
+		p.partitions[tm.Topic] = int32(len(tm.PartitionMetadata))
+		for _, pm := range tm.PartitionMetadata {
+			leader, err := res.Leader(tm.Topic, pm.PartitionID)
+			if err != nil {
+				continue
+			}
+			p.leaders[topicPartition{tm.Topic, pm.PartitionID}] = leader.Addr()
+		}
+	}
+	return nil
+}
+
+// conn returns a cached connection to the broker at addr.
+func (p *Producer) conn(addr string) (Conn, error) {
+	p.mu.Lock()
+	conn, ok := p.conns[addr]
+	p.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+	conn, err := p.config.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cached, ok := p.conns[addr]; ok {
+		conn.Close()
+		return cached, nil
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+func (p *Producer) drop(addr string, conn Conn) {
+	p.mu.Lock()
+	if p.conns[addr] == conn {
+		delete(p.conns, addr)
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
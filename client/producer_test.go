@@ -0,0 +1,281 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fakeConn is a broker leading all three of topic "test"'s partitions. It
+// counts the records produced in each request by partition, and keeps the
+// values produced to each partition and the acks they were produced with.
+// The first failures produce requests fail with not leader for partition.
+type fakeConn struct {
+	mu       sync.Mutex
+	produced []map[int32]int
+	values   map[int32][]string
+	acks     []int16
+	failures int
+}
+
+func (c *fakeConn) Metadata(req *protocol.MetadataRequest) (*protocol.MetadataResponse, error) {
+	return &protocol.MetadataResponse{
+		Brokers: []*protocol.Broker{{NodeID: 1, Host: "localhost", Port: 9092}},
+		TopicMetadata: []*protocol.TopicMetadata{{
+			Topic: "test",
+			PartitionMetadata: []*protocol.PartitionMetadata{
+				{PartitionID: 0, Leader: 1},
+				{PartitionID: 1, Leader: 1},
+				{PartitionID: 2, Leader: 1},
+			},
+		}},
+	}, nil
+}
+
+func (c *fakeConn) Produce(req *protocol.ProduceRequest) (*protocol.ProduceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acks = append(c.acks, req.Acks)
+	counts := make(map[int32]int)
+	res := &protocol.ProduceResponse{}
+	for _, td := range req.TopicData {
+		tres := &protocol.ProduceTopicResponse{Topic: td.Topic}
+		for _, d := range td.Data {
+			pres := &protocol.ProducePartitionResponse{Partition: d.Partition}
+			tres.PartitionResponses = append(tres.PartitionResponses, pres)
+			if c.failures > 0 {
+				c.failures--
+				pres.ErrorCode = protocol.ErrNotLeaderForPartition.Code()
+				continue
+			}
+			if c.values == nil {
+				c.values = make(map[int32][]string)
+			}
+			for _, ms := range commitlog.MessageSets(d.RecordSet) {
+				counts[d.Partition] += len(ms.Messages())
+				for _, m := range ms.Messages() {
+					c.values[d.Partition] = append(c.values[d.Partition], string(m.Value()))
+				}
+			}
+		}
+		res.Responses = append(res.Responses, tres)
+	}
+	c.produced = append(c.produced, counts)
+	return res, nil
+}
+
+// Offsets answers with watermarks 10 and 100 for every partition, and 50 for
+// the offset of any timestamp.
+func (c *fakeConn) Offsets(req *protocol.OffsetsRequest) (*protocol.OffsetsResponse, error) {
+	res := &protocol.OffsetsResponse{}
+	for _, t := range req.Topics {
+		tres := &protocol.OffsetResponse{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			offset := int64(100)
+			switch {
+			case p.Timestamp == -2:
+				offset = 10
+			case p.Timestamp >= 0:
+				offset = 50
+			}
+			tres.PartitionResponses = append(tres.PartitionResponses, &protocol.PartitionResponse{Partition: p.Partition, Offset: offset})
+		}
+		res.Responses = append(res.Responses, tres)
+	}
+	return res, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func TestProducer_StickyPartitioning(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeConn{}
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		// only sent when full
+		BatchSize: 10 * 40,
+		Linger:    time.Hour,
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	value := make([]byte, 40)
+	for i := 0; i < 30; i++ {
+		req.NoError(p.Send(&Record{Topic: "test", Value: value}, nil))
+	}
+	req.NoError(p.Close())
+
+	// each batch fills one partition and the next starts on another
+	var prev int32 = -1
+	total := 0
+	for _, counts := range conn.produced {
+		req.Equal(1, len(counts))
+		for partition, n := range counts {
+			req.NotEqual(prev, partition)
+			prev = partition
+			total += n
+		}
+	}
+	req.Equal(30, total)
+	req.True(len(conn.produced) < 10)
+}
+
+func TestProducer_KeyedRecords(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeConn{}
+	var mu sync.Mutex
+	partitions := make(map[int32]bool)
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	for i := 0; i < 10; i++ {
+		req.NoError(p.Send(&Record{Topic: "test", Key: []byte("key"), Value: []byte("value")}, func(partition int32, offset int64, err error) {
+			req.NoError(err)
+			mu.Lock()
+			partitions[partition] = true
+			mu.Unlock()
+		}))
+	}
+	req.NoError(p.Close())
+	req.Equal(map[int32]bool{hashPartition([]byte("key"), 3): true}, partitions)
+}
+
+func TestProducer_Backpressure(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeConn{}
+	value := make([]byte, 40)
+	newProducer := func(maxBlock time.Duration) *Producer {
+		return NewProducer(ProducerConfig{
+			BrokerAddr: "localhost:9092",
+			Linger:     time.Hour,
+			// room for two records
+			BufferMemory: 150,
+			MaxBlock:     maxBlock,
+			Dial: func(addr string) (Conn, error) {
+				return conn, nil
+			},
+		})
+	}
+
+	p := newProducer(-1)
+	req.NoError(p.Send(&Record{Topic: "test", Value: value}, nil))
+	req.NoError(p.Send(&Record{Topic: "test", Value: value}, nil))
+	records, bytes := p.Buffered()
+	req.Equal(2, records)
+	req.True(bytes > 80)
+	req.Equal(ErrBufferFull, p.Send(&Record{Topic: "test", Value: value}, nil))
+	req.Equal(ErrBufferFull, <-p.Errors())
+
+	// flushing sends the lingering batches and frees their space
+	p.Flush()
+	records, bytes = p.Buffered()
+	req.Equal(0, records)
+	req.Equal(0, bytes)
+	req.NoError(p.Send(&Record{Topic: "test", Value: value}, nil))
+	req.NoError(p.Close())
+
+	// sends wait for space up to the max block
+	p = newProducer(50 * time.Millisecond)
+	req.NoError(p.Send(&Record{Topic: "test", Value: value}, nil))
+	req.NoError(p.Send(&Record{Topic: "test", Value: value}, nil))
+	req.Equal(ErrBufferFull, p.Send(&Record{Topic: "test", Value: value}, nil))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Flush()
+	}()
+	req.NoError(p.Send(&Record{Topic: "test", Value: value}, nil))
+	req.NoError(p.Close())
+}
+
+func TestProducer_RetriesInOrder(t *testing.T) {
+	req := require.New(t)
+	// the first batch fails twice before it's appended
+	conn := &fakeConn{failures: 2}
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		// each record's its own batch
+		BatchSize:    1,
+		Linger:       time.Hour,
+		RetryBackoff: time.Millisecond,
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	var mu sync.Mutex
+	var errs []error
+	var want []string
+	for i := 0; i < 5; i++ {
+		value := fmt.Sprintf("value-%d", i)
+		want = append(want, value)
+		req.NoError(p.Send(&Record{Topic: "test", Key: []byte("key"), Value: []byte(value)}, func(partition int32, offset int64, err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}))
+	}
+	req.NoError(p.Close())
+	req.Equal([]error{nil, nil, nil, nil, nil}, errs)
+	req.Equal(want, conn.values[hashPartition([]byte("key"), 3)])
+
+	// batches that keep failing fail once they're out of retries
+	conn = &fakeConn{failures: 10}
+	p = NewProducer(ProducerConfig{
+		BrokerAddr:   "localhost:9092",
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	var sendErr error
+	req.NoError(p.Send(&Record{Topic: "test", Key: []byte("key"), Value: []byte("value")}, func(partition int32, offset int64, err error) {
+		sendErr = err
+	}))
+	req.NoError(p.Close())
+	req.Equal(protocol.ErrNotLeaderForPartition, sendErr)
+	req.Len(conn.acks, 3)
+}
+
+func TestProducer_NoAcks(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeConn{}
+	p := NewProducer(ProducerConfig{
+		BrokerAddr: "localhost:9092",
+		NoAcks:     true,
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+	var got int64
+	req.NoError(p.Send(&Record{Topic: "test", Value: []byte("value")}, func(partition int32, offset int64, err error) {
+		req.NoError(err)
+		got = offset
+	}))
+	req.NoError(p.Close())
+	req.Equal([]int16{0}, conn.acks)
+	req.Equal(int64(-1), got)
+}
+
+func TestMurmur2(t *testing.T) {
+	// from Kafka's Java client tests
+	for key, hash := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		require.Equal(t, hash, int32(murmur2([]byte(key))), key)
+	}
+}
@@ -0,0 +1,230 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const defaultMetadataRefresh = 30 * time.Second
+
+// OffsetReset is where a subscription starts consuming the partitions it picks
+// up.
+type OffsetReset string
+
+const (
+	// OffsetResetLatest starts from the end of the partition.
+	OffsetResetLatest OffsetReset = "latest"
+	// OffsetResetEarliest starts from the partition's oldest offset.
+	OffsetResetEarliest OffsetReset = "earliest"
+)
+
+// subscription is the topics the consumer's subscribed to.
+type subscription struct {
+	topics  map[string]struct{}
+	pattern *regexp.Regexp
+}
+
+func (s *subscription) matches(topic string) bool {
+	if _, ok := s.topics[topic]; ok {
+		return true
+	}
+	return s.pattern != nil && s.pattern.MatchString(topic)
+}
+
+// Subscribe consumes the partitions of the listed topics and of any topic
+// matching the pattern, if it isn't empty. The topics are looked up each
+// MetadataRefreshInterval, and the partitions of topics that start or stop
+// matching are assigned or unassigned. Partitions are started from the
+// AutoOffsetReset, and ConsumerConfig.Rebalance can Assign them other offsets,
+// e.g. their committed ones. It replaces the consumer's current subscription,
+// keeping the partitions the new one still matches where they are.
+func (c *Consumer) Subscribe(topics []string, pattern string) error {
+	sub := &subscription{topics: make(map[string]struct{}, len(topics))}
+	for _, t := range topics {
+		sub.topics[t] = struct{}{}
+	}
+	if pattern != "" {
+		// anchored like Kafka clients' pattern subscriptions
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("client: invalid topic pattern: %s", err)
+		}
+		sub.pattern = re
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrConsumerClosed
+	}
+	c.subscription = sub
+	c.mu.Unlock()
+	return c.rebalance()
+}
+
+// Unsubscribe unassigns the subscription's partitions.
+func (c *Consumer) Unsubscribe() {
+	c.mu.Lock()
+	c.subscription = nil
+	revoked := c.revoke(func(TopicPartition) bool { return true })
+	c.freed()
+	c.mu.Unlock()
+	c.rebalanced(nil, revoked)
+}
+
+// rebalance looks up the topics and assigns the subscription the partitions
+// of those that match, and unassigns the ones of those that no longer do.
+// Partitions it already has keep their positions. The lookups are made
+// without holding the consumer's lock so polls aren't held up, and if the
+// subscription changes meanwhile it's left to the rebalance of the new one.
+func (c *Consumer) rebalance() error {
+	c.mu.Lock()
+	sub := c.subscription
+	c.mu.Unlock()
+	if sub == nil {
+		return nil
+	}
+
+	conn, err := c.conn(c.config.BrokerAddr)
+	if err != nil {
+		return err
+	}
+	md, err := conn.Metadata(&protocol.MetadataRequest{})
+	if err != nil {
+		c.drop(c.config.BrokerAddr, conn)
+		return err
+	}
+	matched := make(map[TopicPartition]string)
+	for _, tm := range md.TopicMetadata {
+		if tm.TopicErrorCode != protocol.ErrNone.Code() || !sub.matches(tm.Topic) {
+			continue
+		}
+		for _, pm := range tm.PartitionMetadata {
+			var addr string
+			if leader, err := md.Leader(tm.Topic, pm.PartitionID); err == nil {
+				addr = leader.Addr()
+			}
+			matched[TopicPartition{tm.Topic, pm.PartitionID}] = addr
+		}
+	}
+
+	c.mu.Lock()
+	if c.subscription != sub {
+		c.mu.Unlock()
+		return nil
+	}
+	var added []TopicPartition
+	for tp := range matched {
+		if _, ok := c.subscribed[tp]; !ok {
+			added = append(added, tp)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(added, func(i, j int) bool { return added[i].less(added[j]) })
+
+	offsets := make(map[TopicPartition]int64, len(added))
+	for _, tp := range added {
+		offset, err := c.resetOffset(tp, matched[tp])
+		if err != nil {
+			// picked up by the next rebalance
+			log.Error.Printf("client: consumer %s-%d reset offset error: %s", tp.Topic, tp.Partition, err)
+			continue
+		}
+		offsets[tp] = offset
+	}
+
+	c.mu.Lock()
+	if c.subscription != sub {
+		c.mu.Unlock()
+		return nil
+	}
+	revoked := c.revoke(func(tp TopicPartition) bool {
+		_, ok := matched[tp]
+		return !ok
+	})
+	var assigned []TopicPartition
+	for _, tp := range added {
+		offset, ok := offsets[tp]
+		if _, subscribed := c.subscribed[tp]; !ok || subscribed {
+			continue
+		}
+		c.subscribed[tp] = struct{}{}
+		c.unassign(tp)
+		c.queues[tp] = &partitionQueue{tp: tp, offset: offset}
+		if addr := matched[tp]; addr != "" {
+			c.leaders[tp] = addr
+		}
+		assigned = append(assigned, tp)
+	}
+	c.freed()
+	c.mu.Unlock()
+	c.rebalanced(assigned, revoked)
+	return nil
+}
+
+// revoke unassigns the subscription's partitions that match and returns them.
+// The consumer's lock must be held.
+func (c *Consumer) revoke(match func(TopicPartition) bool) []TopicPartition {
+	var revoked []TopicPartition
+	for tp := range c.subscribed {
+		if !match(tp) {
+			continue
+		}
+		delete(c.subscribed, tp)
+		c.unassign(tp)
+		revoked = append(revoked, tp)
+	}
+	sort.Slice(revoked, func(i, j int) bool { return revoked[i].less(revoked[j]) })
+	return revoked
+}
+
+// rebalanced calls the Rebalance callback if the subscription's partitions
+// changed.
+func (c *Consumer) rebalanced(assigned, revoked []TopicPartition) {
+	if c.config.Rebalance == nil || (len(assigned) == 0 && len(revoked) == 0) {
+		return
+	}
+	c.config.Rebalance(assigned, revoked)
+}
+
+// resetOffset asks the partition's leader at addr, or the broker if it isn't
+// known, for the offset the AutoOffsetReset starts the partition at.
+func (c *Consumer) resetOffset(tp TopicPartition, addr string) (int64, error) {
+	timestamp := int64(-1)
+	if c.config.AutoOffsetReset == OffsetResetEarliest {
+		timestamp = -2
+	}
+	if addr == "" {
+		addr = c.config.BrokerAddr
+	}
+	return c.querier.offsetForTimestamp(addr, tp, timestamp)
+}
+
+// refreshSubscription rebalances the subscription each metadata refresh
+// interval until the consumer's closed.
+func (c *Consumer) refreshSubscription() {
+	defer close(c.refreshDoneCh)
+	t := time.NewTicker(c.config.MetadataRefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.shutdownCh:
+			return
+		case <-t.C:
+			if err := c.rebalance(); err != nil {
+				log.Error.Printf("client: consumer rebalance error: %s", err)
+			}
+		}
+	}
+}
+
+func (tp TopicPartition) less(o TopicPartition) bool {
+	if tp.Topic != o.Topic {
+		return tp.Topic < o.Topic
+	}
+	return tp.Partition < o.Partition
+}
@@ -0,0 +1,311 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+var (
+	// ErrNotTransactional is returned for transactions on a producer without
+	// a TransactionalID.
+	ErrNotTransactional = errors.New("client: producer isn't transactional")
+	// ErrTransactionsNotInitialized is returned for transactions begun before
+	// InitTransactions.
+	ErrTransactionsNotInitialized = errors.New("client: transactions not initialized")
+	// ErrNoTransaction is returned for a transactional producer's sends, and
+	// commits and aborts, while no transaction's begun.
+	ErrNoTransaction = errors.New("client: no transaction in progress")
+	// ErrTransactionInProgress is returned for transactions begun before the
+	// previous one's ended.
+	ErrTransactionInProgress = errors.New("client: transaction already in progress")
+)
+
+// TransactionConn is the subset of a broker connection used by transactional
+// producers.
+type TransactionConn interface {
+	Conn
+	FindCoordinator(*protocol.FindCoordinatorRequest) (*protocol.FindCoordinatorResponse, error)
+	InitProducerID(*protocol.InitProducerIDRequest) (*protocol.InitProducerIDResponse, error)
+	OffsetFetch(*protocol.OffsetFetchRequest) (*protocol.OffsetFetchResponse, error)
+	TxnOffsetCommit(*protocol.TxnOffsetCommitRequest) (*protocol.TxnOffsetCommitResponse, error)
+	EndTxn(*protocol.EndTxnRequest) (*protocol.EndTxnResponse, error)
+	TransactionalProduce(*protocol.TransactionalProduceRequest) (*protocol.TransactionalProduceResponse, error)
+}
+
+// txnState is a transactional producer's session and ongoing transaction. Its
+// fields are guarded by the producer's lock.
+type txnState struct {
+	// mu orders the transactions' calls to the coordinator.
+	mu            sync.Mutex
+	coordinator   string
+	producerID    int64
+	producerEpoch int16
+	initialized   bool
+	ongoing       bool
+	// err is the first error sending the ongoing transaction's records. The
+	// transaction can only be aborted once it's set.
+	err error
+}
+
+// InitTransactions registers the producer's TransactionalID with its
+// transaction coordinator. The transactions of an earlier producer with the
+// ID are finished, committed if they were committing and aborted otherwise,
+// and the earlier producer's fenced: its transactions fail from then on.
+func (p *Producer) InitTransactions() error {
+	if p.config.TransactionalID == "" {
+		return ErrNotTransactional
+	}
+	p.txn.mu.Lock()
+	defer p.txn.mu.Unlock()
+	addr, conn, err := p.txnConn()
+	if err != nil {
+		return err
+	}
+	res, err := conn.InitProducerID(&protocol.InitProducerIDRequest{
+		TransactionalID:    &p.config.TransactionalID,
+		TransactionTimeout: p.config.TransactionTimeout,
+	})
+	if err != nil {
+		p.dropCoordinator(addr, conn)
+		return err
+	}
+	if res.ErrorCode != protocol.ErrNone.Code() {
+		return p.coordinatorError(res.ErrorCode)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.txn.producerID = res.ProducerID
+	p.txn.producerEpoch = res.ProducerEpoch
+	p.txn.initialized = true
+	p.txn.ongoing = false
+	p.txn.err = nil
+	return nil
+}
+
+// BeginTransaction begins a transaction the producer's records are sent in
+// until it's committed or aborted.
+func (p *Producer) BeginTransaction() error {
+	if p.config.TransactionalID == "" {
+		return ErrNotTransactional
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case !p.txn.initialized:
+		return ErrTransactionsNotInitialized
+	case p.txn.ongoing:
+		return ErrTransactionInProgress
+	}
+	p.txn.ongoing = true
+	p.txn.err = nil
+	return nil
+}
+
+// SendOffsetsToTransaction adds the group's consumed offsets to the ongoing
+// transaction, so they're committed along with its records, or not at all if
+// it's aborted. The offsets are of the next records to consume, like the
+// Committer's.
+func (p *Producer) SendOffsetsToTransaction(groupID string, offsets map[TopicPartition]int64) error {
+	if err := p.checkTransaction(); err != nil {
+		return err
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	p.txn.mu.Lock()
+	defer p.txn.mu.Unlock()
+	p.mu.Lock()
+	req := &protocol.TxnOffsetCommitRequest{
+		TransactionalID: p.config.TransactionalID,
+		GroupID:         groupID,
+		ProducerID:      p.txn.producerID,
+		ProducerEpoch:   p.txn.producerEpoch,
+	}
+	p.mu.Unlock()
+	byTopic := make(map[string]int)
+	for tp, offset := range offsets {
+		i, ok := byTopic[tp.Topic]
+		if !ok {
+			i = len(req.Topics)
+			byTopic[tp.Topic] = i
+			req.Topics = append(req.Topics, protocol.TxnOffsetCommitTopicRequest{Topic: tp.Topic})
+		}
+		req.Topics[i].Partitions = append(req.Topics[i].Partitions, protocol.TxnOffsetCommitPartitionRequest{
+			Partition: tp.Partition,
+			Offset:    offset,
+		})
+	}
+	addr, conn, err := p.txnConn()
+	if err != nil {
+		return err
+	}
+	res, err := conn.TxnOffsetCommit(req)
+	if err != nil {
+		p.dropCoordinator(addr, conn)
+		return err
+	}
+	for _, tr := range res.Responses {
+		for _, pr := range tr.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return p.coordinatorError(pr.ErrorCode)
+			}
+		}
+	}
+	return nil
+}
+
+// CommitTransaction sends the transaction's batched records, waits for them
+// to be acknowledged, and commits the transaction. If any of its records
+// failed the transaction isn't committed and must be aborted. A commit that
+// fails otherwise can be retried.
+func (p *Producer) CommitTransaction() error {
+	return p.endTransaction(true)
+}
+
+// AbortTransaction waits for the transaction's records to be sent and aborts
+// it, so read_committed consumers skip its records and its offsets aren't
+// committed.
+func (p *Producer) AbortTransaction() error {
+	return p.endTransaction(false)
+}
+
+func (p *Producer) endTransaction(committed bool) error {
+	if err := p.checkTransaction(); err != nil {
+		return err
+	}
+	p.txn.mu.Lock()
+	defer p.txn.mu.Unlock()
+	// the markers are written after the transaction's records
+	p.Flush()
+	p.mu.Lock()
+	if committed && p.txn.err != nil {
+		err := p.txn.err
+		p.mu.Unlock()
+		return err
+	}
+	req := &protocol.EndTxnRequest{
+		TransactionalID: p.config.TransactionalID,
+		ProducerID:      p.txn.producerID,
+		ProducerEpoch:   p.txn.producerEpoch,
+		Committed:       committed,
+	}
+	p.mu.Unlock()
+	addr, conn, err := p.txnConn()
+	if err != nil {
+		return err
+	}
+	res, err := conn.EndTxn(req)
+	if err != nil {
+		p.dropCoordinator(addr, conn)
+		return err
+	}
+	if res.ErrorCode != protocol.ErrNone.Code() {
+		return p.coordinatorError(res.ErrorCode)
+	}
+	p.mu.Lock()
+	p.txn.ongoing = false
+	p.txn.err = nil
+	p.mu.Unlock()
+	return nil
+}
+
+// checkTransaction returns an error if the producer's transactional and no
+// transaction's begun.
+func (p *Producer) checkTransaction() error {
+	if p.config.TransactionalID == "" {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.txn.ongoing {
+		return ErrNoTransaction
+	}
+	return nil
+}
+
+// failTransaction keeps the first error sending the ongoing transaction's
+// records, if the producer's transactional.
+func (p *Producer) failTransaction(err error) {
+	if p.config.TransactionalID == "" {
+		return
+	}
+	p.mu.Lock()
+	if p.txn.ongoing && p.txn.err == nil {
+		p.txn.err = err
+	}
+	p.mu.Unlock()
+}
+
+// coordinatorError returns the coordinator's error, forgetting the
+// coordinator if it's moved.
+func (p *Producer) coordinatorError(code int16) error {
+	err := protocol.Errs[code]
+	if err == protocol.ErrNotCoordinator || err == protocol.ErrCoordinatorNotAvailable {
+		// found again on the next call
+		p.mu.Lock()
+		p.txn.coordinator = ""
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// txnConn returns a connection to the producer's transaction coordinator,
+// finding it through the broker if it isn't known.
+func (p *Producer) txnConn() (string, TransactionConn, error) {
+	p.mu.Lock()
+	addr := p.txn.coordinator
+	p.mu.Unlock()
+	if addr == "" {
+		conn, err := p.transactionConn(p.config.BrokerAddr)
+		if err != nil {
+			return "", nil, err
+		}
+		res, err := conn.FindCoordinator(&protocol.FindCoordinatorRequest{
+			CoordinatorKey:  p.config.TransactionalID,
+			CoordinatorType: protocol.CoordinatorTransaction,
+		})
+		if err != nil {
+			p.drop(p.config.BrokerAddr, conn)
+			return "", nil, err
+		}
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return "", nil, protocol.Errs[res.ErrorCode]
+		}
+		addr = net.JoinHostPort(res.Coordinator.Host, strconv.Itoa(int(res.Coordinator.Port)))
+		p.mu.Lock()
+		p.txn.coordinator = addr
+		p.mu.Unlock()
+	}
+	conn, err := p.transactionConn(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, conn, nil
+}
+
+// transactionConn returns a cached connection to the broker at addr that
+// supports transactions.
+func (p *Producer) transactionConn(addr string) (TransactionConn, error) {
+	conn, err := p.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := conn.(TransactionConn)
+	if !ok {
+		return nil, errors.New("client: connection doesn't support transactions")
+	}
+	return tc, nil
+}
+
+func (p *Producer) dropCoordinator(addr string, conn Conn) {
+	p.mu.Lock()
+	if p.txn.coordinator == addr {
+		p.txn.coordinator = ""
+	}
+	p.mu.Unlock()
+	p.drop(addr, conn)
+}
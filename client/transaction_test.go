@@ -0,0 +1,298 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fakeTxnConn is a fakeFetchConn that's also the transaction and group
+// coordinator. It commits a transaction's offsets when the transaction's
+// committed, and counts the records produced outside of transactions or
+// without the transactional bit.
+type fakeTxnConn struct {
+	fakeFetchConn
+	txnMu         sync.Mutex
+	epoch         int16
+	pending       map[string]map[TopicPartition]int64
+	committed     map[string]map[TopicPartition]int64
+	commits       int
+	aborts        int
+	nonTransacted int
+}
+
+func (c *fakeTxnConn) Produce(req *protocol.ProduceRequest) (*protocol.ProduceResponse, error) {
+	c.countNonTransacted(req, false)
+	return c.fakeFetchConn.Produce(req)
+}
+
+func (c *fakeTxnConn) TransactionalProduce(req *protocol.TransactionalProduceRequest) (*protocol.TransactionalProduceResponse, error) {
+	c.countNonTransacted(req.Produce, req.Produce.TransactionalID != nil)
+	res, err := c.fakeFetchConn.Produce(req.Produce)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.TransactionalProduceResponse{Produce: res}, nil
+}
+
+func (c *fakeTxnConn) countNonTransacted(req *protocol.ProduceRequest, transactional bool) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+	for _, td := range req.TopicData {
+		for _, d := range td.Data {
+			for _, ms := range commitlog.MessageSets(d.RecordSet) {
+				for _, m := range ms.Messages() {
+					if !transactional || !m.Transactional() {
+						c.nonTransacted++
+					}
+				}
+			}
+		}
+	}
+}
+
+func (c *fakeTxnConn) FindCoordinator(req *protocol.FindCoordinatorRequest) (*protocol.FindCoordinatorResponse, error) {
+	return &protocol.FindCoordinatorResponse{Coordinator: protocol.Coordinator{NodeID: 1, Host: "localhost", Port: 9092}}, nil
+}
+
+func (c *fakeTxnConn) InitProducerID(req *protocol.InitProducerIDRequest) (*protocol.InitProducerIDResponse, error) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+	c.epoch++
+	c.pending = nil
+	return &protocol.InitProducerIDResponse{ProducerID: 1, ProducerEpoch: c.epoch}, nil
+}
+
+func (c *fakeTxnConn) TxnOffsetCommit(req *protocol.TxnOffsetCommitRequest) (*protocol.TxnOffsetCommitResponse, error) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+	res := &protocol.TxnOffsetCommitResponse{}
+	for _, t := range req.Topics {
+		tres := protocol.OffsetCommitTopicResponse{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			pres := protocol.OffsetCommitPartitionResponse{Partition: p.Partition}
+			if req.ProducerEpoch != c.epoch {
+				pres.ErrorCode = protocol.ErrInvalidProducerEpoch.Code()
+			} else {
+				if c.pending == nil {
+					c.pending = make(map[string]map[TopicPartition]int64)
+				}
+				if c.pending[req.GroupID] == nil {
+					c.pending[req.GroupID] = make(map[TopicPartition]int64)
+				}
+				c.pending[req.GroupID][TopicPartition{t.Topic, p.Partition}] = p.Offset
+			}
+			tres.PartitionResponses = append(tres.PartitionResponses, pres)
+		}
+		res.Responses = append(res.Responses, tres)
+	}
+	return res, nil
+}
+
+func (c *fakeTxnConn) EndTxn(req *protocol.EndTxnRequest) (*protocol.EndTxnResponse, error) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+	if req.ProducerEpoch != c.epoch {
+		return &protocol.EndTxnResponse{ErrorCode: protocol.ErrInvalidProducerEpoch.Code()}, nil
+	}
+	if req.Committed {
+		if c.committed == nil {
+			c.committed = make(map[string]map[TopicPartition]int64)
+		}
+		for group, offsets := range c.pending {
+			if c.committed[group] == nil {
+				c.committed[group] = make(map[TopicPartition]int64)
+			}
+			for tp, offset := range offsets {
+				c.committed[group][tp] = offset
+			}
+		}
+		c.commits++
+	} else {
+		c.aborts++
+	}
+	c.pending = nil
+	return &protocol.EndTxnResponse{}, nil
+}
+
+func (c *fakeTxnConn) OffsetFetch(req *protocol.OffsetFetchRequest) (*protocol.OffsetFetchResponse, error) {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+	res := &protocol.OffsetFetchResponse{}
+	for _, t := range req.Topics {
+		tres := protocol.OffsetFetchTopicResponse{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			offset, ok := c.committed[req.GroupID][TopicPartition{t.Topic, p}]
+			if !ok {
+				offset = -1
+			}
+			tres.Partitions = append(tres.Partitions, protocol.OffsetFetchPartition{Partition: p, Offset: offset})
+		}
+		res.Responses = append(res.Responses, tres)
+	}
+	return res, nil
+}
+
+func (c *fakeTxnConn) groupOffsets(group string) map[TopicPartition]int64 {
+	c.txnMu.Lock()
+	defer c.txnMu.Unlock()
+	offsets := make(map[TopicPartition]int64)
+	for tp, offset := range c.committed[group] {
+		offsets[tp] = offset
+	}
+	return offsets
+}
+
+func newTxnProducer(conn *fakeTxnConn) *Producer {
+	return NewProducer(ProducerConfig{
+		BrokerAddr:      "localhost:9092",
+		TransactionalID: "txn",
+		Dial: func(addr string) (Conn, error) {
+			return conn, nil
+		},
+	})
+}
+
+func TestProducer_Transactions(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeTxnConn{}
+	p := newTxnProducer(conn)
+	defer p.Close()
+	record := &Record{Topic: "test", Value: []byte("value")}
+	req.Equal(ErrNoTransaction, p.Send(record, nil))
+	req.Equal(ErrTransactionsNotInitialized, p.BeginTransaction())
+
+	req.NoError(p.InitTransactions())
+	req.NoError(p.BeginTransaction())
+	req.Equal(ErrTransactionInProgress, p.BeginTransaction())
+	for i := 0; i < 3; i++ {
+		req.NoError(p.Send(record, nil))
+	}
+	offsets := map[TopicPartition]int64{{"test", 0}: 5}
+	req.NoError(p.SendOffsetsToTransaction("group", offsets))
+	req.Empty(conn.groupOffsets("group"))
+	req.NoError(p.CommitTransaction())
+	req.Equal(offsets, conn.groupOffsets("group"))
+	req.Equal(1, conn.commits)
+	req.Equal(0, conn.nonTransacted)
+	records, _ := p.Buffered()
+	req.Equal(0, records)
+	req.Equal(ErrNoTransaction, p.Send(record, nil))
+
+	// an aborted transaction's offsets aren't committed
+	req.NoError(p.BeginTransaction())
+	req.NoError(p.Send(record, nil))
+	req.NoError(p.SendOffsetsToTransaction("group", map[TopicPartition]int64{{"test", 0}: 10}))
+	req.NoError(p.AbortTransaction())
+	req.Equal(1, conn.aborts)
+	req.Equal(offsets, conn.groupOffsets("group"))
+
+	// a newer producer with the ID fences this one off
+	newer := newTxnProducer(conn)
+	defer newer.Close()
+	req.NoError(newer.InitTransactions())
+	req.NoError(p.BeginTransaction())
+	req.Equal(protocol.ErrInvalidProducerEpoch, p.SendOffsetsToTransaction("group", offsets))
+	req.Equal(protocol.ErrInvalidProducerEpoch, p.CommitTransaction())
+	req.Equal(1, conn.commits)
+
+	// transactions need a transactional ID
+	plain := NewProducer(ProducerConfig{BrokerAddr: "localhost:9092", Dial: newer.config.Dial})
+	defer plain.Close()
+	req.Equal(ErrNotTransactional, plain.InitTransactions())
+	req.Equal(ErrNotTransactional, plain.BeginTransaction())
+}
+
+func newTestPipeline(conn *fakeTxnConn, group string, transform func(*ConsumerRecord) ([]*Record, error)) (*Pipeline, error) {
+	return NewPipeline(PipelineConfig{
+		GroupID:        group,
+		Partitions:     []TopicPartition{{"test", 0}, {"test", 1}, {"test", 2}},
+		Transform:      transform,
+		MaxRecords:     50,
+		CommitInterval: 10 * time.Millisecond,
+		Consumer: ConsumerConfig{
+			BrokerAddr:   "localhost:9092",
+			FetchBackoff: time.Millisecond,
+			Dial: func(addr string) (ConsumerConn, error) {
+				return conn, nil
+			},
+		},
+		Producer: ProducerConfig{
+			BrokerAddr:      "localhost:9092",
+			TransactionalID: "pipeline",
+			Linger:          time.Millisecond,
+			Dial: func(addr string) (Conn, error) {
+				return conn, nil
+			},
+		},
+	})
+}
+
+func TestPipeline(t *testing.T) {
+	req := require.New(t)
+	conn := &fakeTxnConn{}
+	_, err := NewPipeline(PipelineConfig{Transform: func(*ConsumerRecord) ([]*Record, error) { return nil, nil }})
+	req.Equal(ErrNotTransactional, err)
+
+	p, err := newTestPipeline(conn, "group", func(r *ConsumerRecord) ([]*Record, error) {
+		return []*Record{{Topic: "test", Value: r.Value}}, nil
+	})
+	req.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	// the partitions are consumed from their low watermark, 10, to their
+	// high, 100
+	want := map[TopicPartition]int64{{"test", 0}: 100, {"test", 1}: 100, {"test", 2}: 100}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if offsets := conn.groupOffsets("group"); len(offsets) == 3 && offsets[TopicPartition{"test", 0}] == 100 &&
+			offsets[TopicPartition{"test", 1}] == 100 && offsets[TopicPartition{"test", 2}] == 100 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	req.Equal(want, conn.groupOffsets("group"))
+	cancel()
+	req.Equal(context.Canceled, <-done)
+	req.NoError(p.Close())
+	conn.fakeConn.mu.Lock()
+	var produced int
+	for _, counts := range conn.produced {
+		for _, n := range counts {
+			produced += n
+		}
+	}
+	conn.fakeConn.mu.Unlock()
+	req.Equal(270, produced)
+	req.Equal(0, conn.nonTransacted)
+
+	// a failed transform aborts its transaction and stops the pipeline
+	failed := errors.New("failed")
+	p, err = newTestPipeline(conn, "other", func(r *ConsumerRecord) ([]*Record, error) {
+		if r.Offset == 50 {
+			return nil, failed
+		}
+		return []*Record{{Topic: "test", Value: r.Value}}, nil
+	})
+	req.NoError(err)
+	err = p.Run(context.Background())
+	terr, ok := err.(*TransformError)
+	req.True(ok, "%v", err)
+	req.Equal(failed, terr.Err)
+	req.Equal(int64(50), terr.Record.Offset)
+	req.True(conn.aborts > 0)
+	for _, offset := range conn.groupOffsets("other") {
+		req.True(offset <= 50, "committed %d", offset)
+	}
+	req.NoError(p.Close())
+}
@@ -2,18 +2,29 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	gracefully "github.com/tj/go-gracefully"
+	"github.com/travisjeffery/jocko/archive"
+	"github.com/travisjeffery/jocko/client"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/gateway"
 	"github.com/travisjeffery/jocko/jocko"
 	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/jocko/reporter"
 	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/webhook"
 	"github.com/uber/jaeger-lib/metrics"
 
 	"github.com/hashicorp/memberlist"
@@ -30,11 +41,90 @@ var (
 
 	brokerCfg = config.DefaultConfig()
 
+	policyCfg = struct {
+		CreateTopic  string
+		AlterConfigs string
+		Authorizer   string
+	}{}
+
+	metricsReporters []string
+
+	interBrokerTLSCfg = config.InterBrokerTLSConfig{}
+
+	serfEncryptKey string
+
 	topicCfg = struct {
 		BrokerAddr        string
 		Topic             string
 		Partitions        int32
 		ReplicationFactor int
+		ConfigProfile     string
+	}{}
+
+	consumeCfg = struct {
+		BrokerAddr     string
+		Topic          string
+		FromBeginning  bool
+		FromTimestamp  string
+		AssembleChunks bool
+	}{}
+
+	archiveCfg = struct {
+		DataDir       string
+		Topic         string
+		Partition     int32
+		Output        string
+		Format        string
+		KeyEncoding   string
+		ValueEncoding string
+	}{}
+
+	verifyCfg = struct {
+		DataDir string
+	}{}
+
+	offsetsCfg = struct {
+		BrokerAddr string
+		Partitions int32
+		Execute    bool
+		Force      bool
+	}{}
+
+	gatewayCfg = gateway.Config{}
+
+	webhookCfg           = webhook.Config{}
+	webhookSubscriptions []string
+
+	translateCfg = struct {
+		BrokerAddr string
+		Topic      string
+		Offsets    []string
+	}{}
+
+	describeTopicCfg = struct {
+		BrokerAddr string
+		Topic      string
+	}{}
+
+	hotCfg = struct {
+		BrokerAddr string
+		MinSkew    float64
+	}{}
+
+	selfTestCfg = jocko.SelfTestConfig{}
+
+	doctorCfg = jocko.DoctorConfig{}
+
+	storageCleanCfg = jocko.CleanConfig{}
+
+	benchStorageCfg = struct {
+		commitlog.BenchConfig
+		SegmentBytes []int
+	}{}
+
+	verifyReplicasCfg = struct {
+		jocko.ReplicaVerifierConfig
+		Interval time.Duration
 	}{}
 )
 
@@ -49,6 +139,76 @@ func init() {
 	brokerCmd.Flags().StringSliceVar(&brokerCfg.StartJoinAddrsLAN, "join", nil, "Address of an broker serf to join at start time. Can be specified multiple times.")
 	brokerCmd.Flags().StringSliceVar(&brokerCfg.StartJoinAddrsWAN, "join-wan", nil, "Address of an broker serf to join -wan at start time. Can be specified multiple times.")
 	brokerCmd.Flags().Int32Var(&brokerCfg.ID, "id", 0, "Broker ID")
+	brokerCmd.Flags().StringVar(&brokerCfg.Rack, "rack", "", "Rack the broker is in, used to spread partitions' replicas across racks")
+	brokerCmd.Flags().IntVar(&brokerCfg.LeaderPriority, "leader-priority", 0, "Priority of the broker as the cluster's controller. Leadership's transferred to the live broker with the highest priority once elections settle")
+	brokerCmd.Flags().DurationVar(&brokerCfg.LeaderTransferDelay, "leader-transfer-delay", brokerCfg.LeaderTransferDelay, "Time an election settles for before leadership's transferred to a broker with a higher leader priority")
+	brokerCmd.Flags().BoolVar(&brokerCfg.Standalone, "standalone", false, "Run a single broker without Raft and Serf")
+	brokerCmd.Flags().Var((*readConsistencyValue)(&brokerCfg.MetadataReadConsistency), "metadata-read-consistency", "How up to date metadata and admin reads are: stale, unverified, or linearizable, which waits for the broker's metadata to have every change made before the request")
+	brokerCmd.Flags().DurationVar(&brokerCfg.MetadataReadTimeout, "metadata-read-timeout", brokerCfg.MetadataReadTimeout, "How long an unverified or linearizable read waits for the broker's metadata to catch up")
+	brokerCmd.Flags().Int32Var(&brokerCfg.ReplicaFetchMaxBytes, "replica-fetch-max-bytes", brokerCfg.ReplicaFetchMaxBytes, "Max bytes a follower fetches for a partition at a time")
+	brokerCmd.Flags().Int32Var(&brokerCfg.ReplicaFetchResponseMaxBytes, "replica-fetch-response-max-bytes", brokerCfg.ReplicaFetchResponseMaxBytes, "Max bytes of a follower's fetch response")
+	brokerCmd.Flags().Int32Var(&brokerCfg.ReplicaFetchMinBytes, "replica-fetch-min-bytes", brokerCfg.ReplicaFetchMinBytes, "Min bytes a follower's fetch waits for")
+	brokerCmd.Flags().DurationVar(&brokerCfg.ReplicaFetchWaitMax, "replica-fetch-wait-max", brokerCfg.ReplicaFetchWaitMax, "Max time a follower's fetch waits for the min bytes")
+	brokerCmd.Flags().DurationVar(&brokerCfg.ReplicaFetchBackoff, "replica-fetch-backoff", brokerCfg.ReplicaFetchBackoff, "Time a follower waits to fetch again after an error")
+	brokerCmd.Flags().DurationVar(&brokerCfg.ReplicaFetchMaxBackoff, "replica-fetch-max-backoff", brokerCfg.ReplicaFetchMaxBackoff, "Max time a follower waits to fetch again after errors in a row")
+	brokerCmd.Flags().DurationVar(&brokerCfg.TransactionMaxTimeout, "transaction-max-timeout", brokerCfg.TransactionMaxTimeout, "Longest transaction timeout a producer can ask for")
+	brokerCmd.Flags().DurationVar(&brokerCfg.GroupInitialRebalanceDelay, "group-initial-rebalance-delay", brokerCfg.GroupInitialRebalanceDelay, "Time to wait for more members to join a new group before its first rebalance")
+	brokerCmd.Flags().IntVar(&brokerCfg.ControllerMaxLeaderChanges, "controller-max-leader-changes", brokerCfg.ControllerMaxLeaderChanges, "Most partition leadership changes the controller applies at a time, 0 for no limit")
+	brokerCmd.Flags().DurationVar(&brokerCfg.ControllerLeaderChangeInterval, "controller-leader-change-interval", brokerCfg.ControllerLeaderChangeInterval, "Time the controller waits between batches of partition leadership changes")
+	brokerCmd.Flags().IntVar(&brokerCfg.MaxOpenSegmentFiles, "max-open-segment-files", brokerCfg.MaxOpenSegmentFiles, "Most partition log segment files to keep open, 0 for no limit")
+	brokerCmd.Flags().Int64Var(&brokerCfg.CompactionOffsetMapBytes, "compaction-offset-map-bytes", brokerCfg.CompactionOffsetMapBytes, "Most memory compacting a partition's log takes, more keys are compacted in more passes, 0 for no limit")
+	brokerCmd.Flags().DurationVar(&brokerCfg.GroupLagExportInterval, "group-lag-export-interval", brokerCfg.GroupLagExportInterval, "How often to write consumer group lag to the __consumer_lag topic, 0 to not export it")
+	brokerCmd.Flags().DurationVar(&brokerCfg.OffsetsRetention, "offsets-retention", brokerCfg.OffsetsRetention, "How long to keep the committed offsets of consumer groups without members")
+	brokerCmd.Flags().DurationVar(&brokerCfg.OffsetsSnapshotInterval, "offsets-snapshot-interval", brokerCfg.OffsetsSnapshotInterval, "How often to snapshot the offsets committed to the offsets topic so coordinators load faster, 0 to not snapshot them")
+	brokerCmd.Flags().BoolVar(&brokerCfg.PublishClusterEvents, "publish-cluster-events", false, "Publish broker, leadership, ISR, and topic events to the __cluster_events topic")
+	brokerCmd.Flags().Int64Var(&brokerCfg.FetchDecompressionCacheBytes, "fetch-decompression-cache-bytes", brokerCfg.FetchDecompressionCacheBytes, "Most bytes of decompressed batches to cache for filtered fetches, 0 to not cache them")
+	brokerCmd.Flags().BoolVar(&brokerCfg.VerifySegmentManifests, "verify-segment-manifests", brokerCfg.VerifySegmentManifests, "Check partitions' segments against their checksum manifests on startup")
+	brokerCmd.Flags().DurationVar(&brokerCfg.GroupMinSessionTimeout, "group-min-session-timeout", brokerCfg.GroupMinSessionTimeout, "Shortest session timeout a consumer can join a group with")
+	brokerCmd.Flags().DurationVar(&brokerCfg.GroupMaxSessionTimeout, "group-max-session-timeout", brokerCfg.GroupMaxSessionTimeout, "Longest session timeout a consumer can join a group with")
+	brokerCmd.Flags().DurationVar(&brokerCfg.GroupMaxRebalanceTimeout, "group-max-rebalance-timeout", brokerCfg.GroupMaxRebalanceTimeout, "Longest rebalance timeout a consumer can join a group with")
+	brokerCmd.Flags().StringVar(&brokerCfg.DelegationTokenSecret, "delegation-token-secret", "", "Secret shared by the brokers that delegation tokens are derived from. Enables delegation tokens and SCRAM authentication with them")
+	brokerCmd.Flags().DurationVar(&brokerCfg.DelegationTokenMaxLifetime, "delegation-token-max-lifetime", brokerCfg.DelegationTokenMaxLifetime, "Longest a delegation token can be renewed for")
+	brokerCmd.Flags().DurationVar(&brokerCfg.DelegationTokenExpiryTime, "delegation-token-expiry-time", brokerCfg.DelegationTokenExpiryTime, "How long a delegation token's valid for after it's created or renewed")
+	brokerCmd.Flags().StringVar(&interBrokerTLSCfg.CertFile, "inter-broker-cert", "", "Certificate the broker identifies itself to other brokers with. Enables mutual TLS between brokers")
+	brokerCmd.Flags().StringVar(&interBrokerTLSCfg.KeyFile, "inter-broker-key", "", "Key of the inter-broker certificate")
+	brokerCmd.Flags().StringVar(&interBrokerTLSCfg.CAFile, "inter-broker-ca", "", "CAs that sign brokers' certificates")
+	brokerCmd.Flags().StringSliceVar(&interBrokerTLSCfg.AllowedIdentities, "inter-broker-allowed-identity", nil, "Name of a broker certificate allowed to connect. Can be specified multiple times, any broker certificate's allowed if none are")
+	brokerCmd.Flags().StringVar(&interBrokerTLSCfg.Listener, "inter-broker-listener", "", "Name of the listener brokers send each other requests on with inter-broker TLS. Required with inter-broker TLS")
+	brokerCmd.Flags().StringVar(&serfEncryptKey, "serf-encrypt", "", "Base64 encoded 16, 24, or 32 byte key Serf encrypts its gossip with. Required with inter-broker TLS")
+	brokerCmd.Flags().Var((*listenersValue)(&brokerCfg.Listeners), "listener", "Extra listener as name=addr;cert=cert.pem:key.pem;client-ca=ca.pem, with a cert per SNI host name and TLS if it has any. Can be specified multiple times.")
+	brokerCmd.Flags().StringVar(&policyCfg.CreateTopic, "create-topic-policy", "", "Name of the registered policy to validate create topic requests with")
+	brokerCmd.Flags().StringVar(&policyCfg.AlterConfigs, "alter-configs-policy", "", "Name of the registered policy to validate alter configs requests with")
+	brokerCmd.Flags().Var((*namespacesValue)(&brokerCfg.Namespaces), "namespace", "Tenant namespace whose topics and groups, prefixed with its name and a dot, only its principals can use, as name:principals=User:alice,User:bob;produce-byte-rate=1048576;config=value with default topic configs. Can be specified multiple times.")
+	brokerCmd.Flags().Var((*configProfilesValue)(&brokerCfg.TopicConfigProfiles), "topic-config-profile", "Named bundle of topic configs topics can be created with as name:config=value;config=value. Can be specified multiple times.")
+	brokerCmd.Flags().IntVar(&brokerCfg.AppendWorkers, "append-workers", brokerCfg.AppendWorkers, "Number of workers per data dir appending produced records to partitions' logs, taking turns between partitions. 0 to append on the produce request's goroutine")
+	brokerCmd.Flags().IntVar(&brokerCfg.AppendQuantumBytes, "append-quantum-bytes", brokerCfg.AppendQuantumBytes, "Bytes of a partition's records an append worker appends at a turn")
+	brokerCmd.Flags().Float64Var(&brokerCfg.ProduceSampleRate, "produce-sample-rate", 0, "Fraction of produced record sets decoded to report topics' record counts, sizes, and key cardinality. 0 to not sample them")
+	brokerCmd.Flags().Float64Var(&brokerCfg.FetchVerifyRate, "fetch-verify-rate", 0, "Fraction of fetched record sets whose CRCs are checked as they're read, to catch disk corruption. 1 to check all of them, 0 to not check them")
+	brokerCmd.Flags().Var((*disabledAPIsValue)(&brokerCfg.DisabledAPIs), "disabled-api", "API, by name like DeleteTopics or by key, the broker rejects as unsupported and leaves out of ApiVersions. Can be specified multiple times.")
+	brokerCmd.Flags().IntVar(&brokerCfg.MaxInFlightRequestsPerConnection, "max-in-flight-requests-per-connection", brokerCfg.MaxInFlightRequestsPerConnection, "Most requests a connection can have waiting for responses before the broker stops reading its requests, 0 for no limit")
+	brokerCmd.Flags().Int64Var(&brokerCfg.CacheWarmBytes, "cache-warm-bytes", 0, "Bytes of the tails of the partitions hottest when the broker last ran to read into the page cache on start. 0 to not warm the page cache")
+	brokerCmd.Flags().IntVar(&brokerCfg.CacheWarmPartitions, "cache-warm-partitions", brokerCfg.CacheWarmPartitions, "Most partitions, hottest first, to warm the page cache with on start")
+	brokerCmd.Flags().DurationVar(&brokerCfg.ShutdownTimeout, "shutdown-timeout", brokerCfg.ShutdownTimeout, "Time shutdown waits for each of the broker's subsystems, e.g. its replica fetchers, to stop before logging what's still running and moving on. 0 to wait as long as it takes")
+	brokerCmd.Flags().Int32Var(&brokerCfg.SocketRequestMaxBytes, "socket-request-max-bytes", brokerCfg.SocketRequestMaxBytes, "Biggest request the broker reads, connections sending bigger ones are closed. 0 for no limit")
+	brokerCmd.Flags().DurationVar(&brokerCfg.RequestTimeout, "request-timeout", brokerCfg.RequestTimeout, "Time a request can take to handle before it's responded to with a request timed out error, 0 for no timeout")
+	brokerCmd.Flags().StringSliceVar(&metricsReporters, "metrics-reporter", nil, "Registered metrics reporter to report to as name=addr, e.g. prometheus=0.0.0.0:9095 or statsd=127.0.0.1:8125. Can be specified multiple times.")
+	brokerCmd.Flags().StringVar(&policyCfg.Authorizer, "authorizer", "", "Name of the registered authorizer to limit the topics, groups, and configs clients can describe with")
+
+	selfTestCmd := &cobra.Command{Use: "self-test", Short: "Check this machine's data dirs, open file limit, and connectivity and clock skew to the cluster's brokers before joining", Run: selfTest, Args: cobra.NoArgs}
+	selfTestCmd.Flags().StringSliceVar(&selfTestCfg.DataDirs, "data-dir", []string{"/tmp/jocko"}, "Directory the broker stores log files under. Can be specified multiple times.")
+	selfTestCmd.Flags().Int64Var(&selfTestCfg.WriteBytes, "write-bytes", 256<<20, "Bytes to write to each data dir")
+	selfTestCmd.Flags().IntVar(&selfTestCfg.Syncs, "syncs", 100, "Number of synced appends to measure fsync latency with")
+	selfTestCmd.Flags().DurationVar(&selfTestCfg.MaxSyncLatency, "max-sync-latency", 100*time.Millisecond, "Slowest fsync that passes, 0 for no limit")
+	selfTestCmd.Flags().Uint64Var(&selfTestCfg.MinOpenFiles, "min-open-files", 65536, "Lowest open file limit that passes")
+	selfTestCmd.Flags().StringVar(&selfTestCfg.BrokerAddr, "broker-addr", "", "Address of a broker in the cluster to join, to check connectivity and clock skew to its brokers")
+	selfTestCmd.Flags().DurationVar(&selfTestCfg.MaxClockSkew, "max-clock-skew", time.Second, "Most a broker's clock can be off from this machine's, 0 for no limit")
+
+	doctorCmd := &cobra.Command{Use: "doctor", Short: "Inspect a running cluster and a data dir for common misconfigurations and suggest fixes", Run: doctor, Args: cobra.NoArgs}
+	doctorCmd.Flags().StringVar(&doctorCfg.BrokerAddr, "broker-addr", "", "Address of a broker in the cluster to inspect")
+	doctorCmd.Flags().StringVar(&doctorCfg.DataDir, "data-dir", "", "Directory a broker stores log files under to inspect, best while it's stopped")
+	doctorCmd.Flags().DurationVar(&doctorCfg.MaxClockSkew, "max-clock-skew", time.Second, "Most a broker's clock can be off from this machine's, 0 for no limit")
+	doctorCmd.Flags().Uint64Var(&doctorCfg.MinOpenFiles, "min-open-files", 4096, "Open file limit to have for connections on top of the data dir's segment files")
+	doctorCmd.Flags().Float64Var(&doctorCfg.QuotaSaturation, "quota-saturation", 0.9, "Share of a topic's produce.byte.rate its producers can use before it's reported, 0 to not check quotas")
 
 	topicCmd := &cobra.Command{Use: "topic", Short: "Manage topics"}
 	createTopicCmd := &cobra.Command{Use: "create", Short: "Create a topic", Run: createTopic, Args: cobra.NoArgs}
@@ -57,10 +217,110 @@ func init() {
 	createTopicCmd.MarkFlagRequired("topic")
 	createTopicCmd.Flags().Int32Var(&topicCfg.Partitions, "partitions", 1, "Number of partitions")
 	createTopicCmd.Flags().IntVar(&topicCfg.ReplicationFactor, "replication-factor", 1, "Replication factor")
+	createTopicCmd.Flags().StringVar(&topicCfg.ConfigProfile, "config-profile", "", "Name of the broker's topic config profile to create the topic with")
+
+	describeTopicCmd := &cobra.Command{Use: "describe", Short: "Describe a topic's partitions' sizes, message counts, last writes, and leaders", Run: describeTopic, Args: cobra.NoArgs}
+	describeTopicCmd.Flags().StringVar(&describeTopicCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker in the cluster")
+	describeTopicCmd.Flags().StringVar(&describeTopicCfg.Topic, "topic", "", "Name of topic to describe (required)")
+	describeTopicCmd.MarkFlagRequired("topic")
+
+	consumeCmd := &cobra.Command{Use: "consume", Short: "Print a topic's records as partition, offset, key, and value", Run: consumeTopic, Args: cobra.NoArgs}
+	consumeCmd.Flags().StringVar(&consumeCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker in the cluster")
+	consumeCmd.Flags().StringVar(&consumeCfg.Topic, "topic", "", "Name of topic to consume (required)")
+	consumeCmd.MarkFlagRequired("topic")
+	consumeCmd.Flags().BoolVar(&consumeCfg.FromBeginning, "from-beginning", false, "Start at partitions' oldest records rather than their end")
+	consumeCmd.Flags().StringVar(&consumeCfg.FromTimestamp, "from-timestamp", "", "Start at partitions' first records at or after the time, as RFC 3339 or milliseconds since the epoch")
+	consumeCmd.Flags().BoolVar(&consumeCfg.AssembleChunks, "assemble-chunks", false, "Put records chunked by producers with a chunk size back together, printing them at their last chunk's offset")
+
+	hotCmd := &cobra.Command{Use: "hot", Short: "List partitions with more than their share of their topic's traffic", Run: hotPartitions, Args: cobra.NoArgs}
+	hotCmd.Flags().StringVar(&hotCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker in the cluster")
+	hotCmd.Flags().Float64Var(&hotCfg.MinSkew, "min-skew", 2, "Least multiple of an even share of its topic's traffic a partition needs to be listed")
+
+	archiveCmd := &cobra.Command{Use: "archive", Short: "Export a partition's log to a file, leaving the log as it is", Run: archivePartition, Args: cobra.NoArgs}
+	archiveCmd.Flags().StringVar(&archiveCfg.DataDir, "data-dir", "/tmp/jocko", "Directory the broker stores log files under")
+	archiveCmd.Flags().StringVar(&archiveCfg.Topic, "topic", "", "Name of topic to export (required)")
+	archiveCmd.MarkFlagRequired("topic")
+	archiveCmd.Flags().Int32Var(&archiveCfg.Partition, "partition", 0, "Partition to export")
+	archiveCmd.Flags().StringVar(&archiveCfg.Output, "output", "", "File to write to, defaults to stdout")
+	archiveCmd.Flags().StringVar(&archiveCfg.Format, "format", string(archive.JSONL), "Format to write records as: jsonl or parquet")
+	archiveCmd.Flags().StringVar(&archiveCfg.KeyEncoding, "key-encoding", string(archive.BytesEncoding), "How to write keys: bytes (base64) or string")
+	archiveCmd.Flags().StringVar(&archiveCfg.ValueEncoding, "value-encoding", string(archive.BytesEncoding), "How to write values: bytes (base64) or string")
+
+	verifyCmd := &cobra.Command{Use: "verify", Short: "Check partitions' segments against their checksum manifests, e.g. after restoring a backup", Run: verifyManifests, Args: cobra.NoArgs}
+	verifyCmd.Flags().StringVar(&verifyCfg.DataDir, "data-dir", "/tmp/jocko", "Directory the broker stores log files under")
+
+	storageCmd := &cobra.Command{Use: "storage", Short: "Manage a stopped broker's storage"}
+	cleanStorageCmd := &cobra.Command{Use: "clean", Short: "Run retention and compaction over partitions' logs to reclaim disk space (the broker must not be running)", Run: cleanStorage, Args: cobra.NoArgs}
+	cleanStorageCmd.Flags().StringSliceVar(&storageCleanCfg.DataDirs, "data-dir", []string{"/tmp/jocko"}, "Directory the broker stores log files under. Can be specified multiple times.")
+	cleanStorageCmd.Flags().StringSliceVar(&storageCleanCfg.Topics, "topic", nil, "Topic to clean, with its config from the broker's raft state. Can be specified multiple times.")
+	cleanStorageCmd.MarkFlagRequired("topic")
+	cleanStorageCmd.Flags().Int64Var(&storageCleanCfg.OffsetMapBytes, "offset-map-bytes", 64*1024*1024, "Most memory compacting a partition's log takes, more keys are compacted in more passes, 0 for no limit")
+
+	benchCmd := &cobra.Command{Use: "bench", Short: "Benchmark this machine"}
+	benchStorageCmd := &cobra.Command{Use: "storage", Short: "Benchmark appends, offset lookups, and fetch scans of logs with different segment sizes", Run: benchStorage, Args: cobra.NoArgs}
+	benchStorageCmd.Flags().StringVar(&benchStorageCfg.Dir, "dir", "", "Directory to write the benchmark's logs under, defaults to the temp dir. Use the data dir's disk to benchmark it")
+	benchStorageCmd.Flags().IntSliceVar(&benchStorageCfg.SegmentBytes, "segment-bytes", []int{1 << 20, 16 << 20, 128 << 20}, "Segment sizes to benchmark, with a log each")
+	benchStorageCmd.Flags().IntVar(&benchStorageCfg.MessageSets, "message-sets", 256*1024, "Number of message sets to append to each log")
+	benchStorageCmd.Flags().IntVar(&benchStorageCfg.MessageBytes, "message-bytes", 1024, "Size of each message set's message's value")
+	benchStorageCmd.Flags().IntVar(&benchStorageCfg.Lookups, "lookups", 100000, "Number of random offsets to look up in each log")
+	benchStorageCmd.Flags().Int32Var(&benchStorageCfg.ReadBytes, "read-bytes", 1024*1024, "Most bytes to read at a time scanning each log, like a fetch's max bytes")
+
+	verifyReplicasCmd := &cobra.Command{Use: "verify-replicas", Short: "Continuously compare partitions' replicas and report where they diverge", Run: verifyReplicas, Args: cobra.NoArgs}
+	verifyReplicasCmd.Flags().StringVar(&verifyReplicasCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker in the cluster")
+	verifyReplicasCmd.Flags().StringSliceVar(&verifyReplicasCfg.Topics, "topic", nil, "Topic to verify, defaults to all of them. Can be specified multiple times.")
+	verifyReplicasCmd.Flags().Int32Var(&verifyReplicasCfg.FetchMaxBytes, "fetch-max-bytes", 1024*1024, "Most bytes to fetch from each replica of a partition at a time")
+	verifyReplicasCmd.Flags().BoolVar(&verifyReplicasCfg.FromEarliest, "from-earliest", false, "Start at partitions' earliest offsets rather than their latest")
+	verifyReplicasCmd.Flags().DurationVar(&verifyReplicasCfg.Interval, "interval", time.Second, "Time to wait between fetches from the replicas")
+
+	offsetsCmd := &cobra.Command{Use: "offsets", Short: "Manage the consumer offsets topic"}
+	migrateOffsetsCmd := &cobra.Command{Use: "migrate", Short: "Grow the offsets topic's partitions, moving groups to their new coordinators", Run: migrateOffsetsTopic, Args: cobra.NoArgs}
+	migrateOffsetsCmd.Flags().StringVar(&offsetsCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker in the cluster")
+	migrateOffsetsCmd.Flags().Int32Var(&offsetsCfg.Partitions, "partitions", 0, "Number of partitions to grow the offsets topic to (required)")
+	migrateOffsetsCmd.MarkFlagRequired("partitions")
+	migrateOffsetsCmd.Flags().BoolVar(&offsetsCfg.Execute, "execute", false, "Migrate the topic rather than only list the groups that would move")
+	migrateOffsetsCmd.Flags().BoolVar(&offsetsCfg.Force, "force", false, "Migrate even if groups are rebalancing")
+
+	gatewayCmd := &cobra.Command{Use: "gateway", Short: "Run an HTTP gateway to produce and consume over HTTP", Run: runGateway, Args: cobra.NoArgs}
+	gatewayCmd.Flags().StringVar(&gatewayCfg.Addr, "addr", "0.0.0.0:8080", "Address for the HTTP gateway to bind on")
+	gatewayCmd.Flags().StringVar(&gatewayCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker to look up partition leaders with")
+	gatewayCmd.Flags().DurationVar(&gatewayCfg.InstanceTimeout, "instance-timeout", 5*time.Minute, "How long a consumer instance can be idle before it's removed")
+	gatewayCmd.Flags().Int64Var(&gatewayCfg.MaxRequestBytes, "max-request-bytes", 1<<20, "Max size of a request's body")
+
+	webhookCmd := &cobra.Command{Use: "webhook", Short: "Push records from topics to HTTP webhooks", Run: runWebhook, Args: cobra.NoArgs}
+	webhookCmd.Flags().StringVar(&webhookCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker to look up partition leaders with")
+	webhookCmd.Flags().StringVar(&webhookCfg.OffsetsDir, "offsets-dir", "/tmp/jocko-webhook", "Directory the subscriptions' offsets are committed in")
+	webhookCmd.Flags().DurationVar(&webhookCfg.PollInterval, "poll-interval", time.Second, "How long to wait before fetching again when a partition has no new records")
+	webhookCmd.Flags().StringArrayVar(&webhookSubscriptions, "subscription", nil, "Subscription as whitespace separated key=value pairs of name, topic, url, partitions (separated by commas), max-retries, retry-backoff, and dead-letter-topic, e.g. 'name=orders topic=orders url=http://localhost/orders'. Can be specified multiple times.")
+	webhookCmd.MarkFlagRequired("subscription")
+
+	mirrorCmd := &cobra.Command{Use: "mirror", Short: "Manage mirrored topics"}
+	translateCmd := &cobra.Command{Use: "translate", Short: "Translate consumer offsets in a source topic to its mirror's offsets to fail over to", Run: translateOffsets, Args: cobra.NoArgs}
+	translateCmd.Flags().StringVar(&translateCfg.BrokerAddr, "broker-addr", "0.0.0.0:9092", "Address of a broker in the mirror's cluster")
+	translateCmd.Flags().StringVar(&translateCfg.Topic, "topic", "", "Name of the mirror topic (required)")
+	translateCmd.MarkFlagRequired("topic")
+	translateCmd.Flags().StringSliceVar(&translateCfg.Offsets, "offset", nil, "Offset in the source to translate as partition=offset. Can be specified multiple times.")
 
 	cli.AddCommand(brokerCmd)
 	cli.AddCommand(topicCmd)
+	cli.AddCommand(archiveCmd)
+	cli.AddCommand(verifyCmd)
+	cli.AddCommand(verifyReplicasCmd)
+	cli.AddCommand(storageCmd)
+	cli.AddCommand(benchCmd)
+	cli.AddCommand(gatewayCmd)
+	cli.AddCommand(webhookCmd)
+	cli.AddCommand(mirrorCmd)
+	cli.AddCommand(offsetsCmd)
+	cli.AddCommand(doctorCmd)
+	brokerCmd.AddCommand(selfTestCmd)
+	storageCmd.AddCommand(cleanStorageCmd)
+	benchCmd.AddCommand(benchStorageCmd)
 	topicCmd.AddCommand(createTopicCmd)
+	topicCmd.AddCommand(describeTopicCmd)
+	topicCmd.AddCommand(consumeCmd)
+	topicCmd.AddCommand(hotCmd)
+	mirrorCmd.AddCommand(translateCmd)
+	offsetsCmd.AddCommand(migrateOffsetsCmd)
 }
 
 func run(cmd *cobra.Command, args []string) {
@@ -90,6 +350,55 @@ func run(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
+	if policyCfg.CreateTopic != "" {
+		if brokerCfg.CreateTopicPolicy, err = policy.CreateTopic(policyCfg.CreateTopic); err != nil {
+			fmt.Fprintf(os.Stderr, "error starting broker: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if policyCfg.AlterConfigs != "" {
+		if brokerCfg.AlterConfigsPolicy, err = policy.AlterConfigs(policyCfg.AlterConfigs); err != nil {
+			fmt.Fprintf(os.Stderr, "error starting broker: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if policyCfg.Authorizer != "" {
+		if brokerCfg.Authorizer, err = policy.AuthorizerByName(policyCfg.Authorizer); err != nil {
+			fmt.Fprintf(os.Stderr, "error starting broker: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(metricsReporters) > 0 {
+		var reporters reporter.Multi
+		for _, nameAddr := range metricsReporters {
+			kv := strings.SplitN(nameAddr, "=", 2)
+			if len(kv) != 2 {
+				fmt.Fprintf(os.Stderr, "error starting broker: metrics reporter %q isn't name=addr\n", nameAddr)
+				os.Exit(1)
+			}
+			r, err := reporter.New(kv[0], kv[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error starting broker: %v\n", err)
+				os.Exit(1)
+			}
+			reporters = append(reporters, r)
+		}
+		brokerCfg.MetricsReporter = reporters
+	}
+
+	if interBrokerTLSCfg.CertFile != "" {
+		brokerCfg.InterBrokerTLS = &interBrokerTLSCfg
+	}
+	if serfEncryptKey != "" {
+		key, err := base64.StdEncoding.DecodeString(serfEncryptKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error starting broker: serf encrypt key isn't base64: %v\n", err)
+			os.Exit(1)
+		}
+		brokerCfg.SerfLANConfig.MemberlistConfig.SecretKey = key
+	}
+
 	broker, err := jocko.NewBroker(brokerCfg, tracer)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error starting broker: %v\n", err)
@@ -120,13 +429,17 @@ func createTopic(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	var configs map[string]*string
+	if topicCfg.ConfigProfile != "" {
+		configs = map[string]*string{"config.profile": &topicCfg.ConfigProfile}
+	}
 	resp, err := conn.CreateTopics(&protocol.CreateTopicRequests{
 		Requests: []*protocol.CreateTopicRequest{{
 			Topic:             topicCfg.Topic,
 			NumPartitions:     topicCfg.Partitions,
 			ReplicationFactor: int16(topicCfg.ReplicationFactor),
 			ReplicaAssignment: nil,
-			Configs:           nil,
+			Configs:           configs,
 		}},
 	})
 	if err != nil {
@@ -143,6 +456,466 @@ func createTopic(cmd *cobra.Command, args []string) {
 	fmt.Printf("created topic: %v\n", topicCfg.Topic)
 }
 
+func describeTopic(cmd *cobra.Command, args []string) {
+	d, err := jocko.DescribeTopic(jocko.NewDialer("jocko-cli"), describeTopicCfg.BrokerAddr, describeTopicCfg.Topic)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error describing topic: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d partitions, %d bytes, ~%d messages, leader skew %.1fx\n", d.Topic, len(d.Partitions), d.Size, d.Messages, d.LeaderSkew)
+	for _, p := range d.Partitions {
+		lastWrite := "-"
+		if !p.LastWrite.IsZero() {
+			lastWrite = p.LastWrite.Format(time.RFC3339)
+		}
+		stale := ""
+		if p.Stale {
+			stale = " (leader's log stats unavailable)"
+		}
+		fmt.Printf("%s-%d: leader %d, replicas %v, isr %v, %d bytes (%.1fx avg), ~%d messages, last write %s%s\n", d.Topic, p.Partition, p.Leader, p.Replicas, p.ISR, p.Size, p.SizeSkew, p.Messages, lastWrite, stale)
+	}
+	ids := make([]int, 0, len(d.Leaders))
+	for id := range d.Leaders {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Printf("broker %d: leads %d partitions\n", id, d.Leaders[int32(id)])
+	}
+}
+
+func consumeTopic(cmd *cobra.Command, args []string) {
+	// the offsets request's special timestamps for the end and the start
+	timestamp := int64(-1)
+	if consumeCfg.FromBeginning {
+		timestamp = -2
+	}
+	if consumeCfg.FromTimestamp != "" {
+		var err error
+		if timestamp, err = parseTimestamp(consumeCfg.FromTimestamp); err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing timestamp: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	conn, err := jocko.Dial("tcp", consumeCfg.BrokerAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to broker: %v\n", err)
+		os.Exit(1)
+	}
+	md, err := conn.Metadata(&protocol.MetadataRequest{Topics: []string{consumeCfg.Topic}})
+	conn.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error with request to broker: %v\n", err)
+		os.Exit(1)
+	}
+
+	type position struct {
+		conn   *jocko.Conn
+		offset int64
+	}
+	conns := make(map[string]*jocko.Conn)
+	positions := make(map[int32]*position)
+	for _, tm := range md.TopicMetadata {
+		for _, pm := range tm.PartitionMetadata {
+			leader, err := md.Leader(consumeCfg.Topic, pm.PartitionID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error finding partition %d's leader: %v\n", pm.PartitionID, err)
+				os.Exit(1)
+			}
+			conn, ok := conns[leader.Addr()]
+			if !ok {
+				if conn, err = jocko.Dial("tcp", leader.Addr()); err != nil {
+					fmt.Fprintf(os.Stderr, "error connecting to broker: %v\n", err)
+					os.Exit(1)
+				}
+				conns[leader.Addr()] = conn
+			}
+			offset, err := offsetForTimestamp(conn, consumeCfg.Topic, pm.PartitionID, timestamp)
+			if err == nil && offset < 0 {
+				// nothing's at or after the timestamp yet
+				offset, err = offsetForTimestamp(conn, consumeCfg.Topic, pm.PartitionID, -1)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error finding partition %d's start offset: %v\n", pm.PartitionID, err)
+				os.Exit(1)
+			}
+			positions[pm.PartitionID] = &position{conn: conn, offset: offset}
+		}
+	}
+	if len(positions) == 0 {
+		fmt.Fprintf(os.Stderr, "error code: %v\n", protocol.ErrUnknownTopicOrPartition)
+		os.Exit(1)
+	}
+
+	var chunks *client.ChunkAssembler
+	if consumeCfg.AssembleChunks {
+		chunks = client.NewChunkAssembler(64 * 1024 * 1024)
+	}
+	for {
+		for partition, p := range positions {
+			res, err := p.conn.Fetch(&protocol.FetchRequest{
+				APIVersion:  3,
+				MaxWaitTime: 100 * time.Millisecond,
+				MinBytes:    1,
+				MaxBytes:    1024 * 1024,
+				Topics: []*protocol.FetchTopic{{
+					Topic:      consumeCfg.Topic,
+					Partitions: []*protocol.FetchPartition{{Partition: partition, FetchOffset: p.offset, MaxBytes: 1024 * 1024}},
+				}},
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error fetching partition %d: %v\n", partition, err)
+				os.Exit(1)
+			}
+			for _, tr := range res.Responses {
+				for _, pr := range tr.PartitionResponses {
+					if pr.ErrorCode != protocol.ErrNone.Code() {
+						fmt.Fprintf(os.Stderr, "error fetching partition %d: %v\n", partition, protocol.Errs[pr.ErrorCode])
+						os.Exit(1)
+					}
+					for _, ms := range commitlog.MessageSets(pr.RecordSet) {
+						for _, m := range ms.Messages() {
+							msgs := []commitlog.Message{m}
+							if m.Compressed() {
+								sets, err := m.Decompress()
+								if err != nil {
+									fmt.Fprintf(os.Stderr, "error decompressing partition %d offset %d: %v\n", partition, ms.Offset(), err)
+									continue
+								}
+								msgs = nil
+								for _, s := range sets {
+									msgs = append(msgs, s.Messages()...)
+								}
+							}
+							for _, m := range msgs {
+								value := m.Value()
+								if chunks != nil {
+									var ok bool
+									if value, ok = chunks.Add(consumeCfg.Topic, partition, m); !ok {
+										continue
+									}
+								}
+								fmt.Printf("%d\t%d\t%s\t%s\n", partition, ms.Offset(), m.Key(), value)
+							}
+						}
+						p.offset = ms.Offset() + 1
+					}
+				}
+			}
+		}
+	}
+}
+
+// offsetForTimestamp asks the partition's leader for the offset of its first
+// record at or after the timestamp, or -1 if there isn't one.
+func offsetForTimestamp(conn *jocko.Conn, topic string, partition int32, timestamp int64) (int64, error) {
+	res, err := conn.Offsets(&protocol.OffsetsRequest{
+		APIVersion: 1,
+		ReplicaID:  -1,
+		Topics: []*protocol.OffsetsTopic{{
+			Topic:      topic,
+			Partitions: []*protocol.OffsetsPartition{{Partition: partition, Timestamp: timestamp}},
+		}},
+	})
+	if err != nil {
+		return -1, err
+	}
+	for _, r := range res.Responses {
+		for _, pr := range r.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return -1, protocol.Errs[pr.ErrorCode]
+			}
+			return pr.Offset, nil
+		}
+	}
+	return -1, protocol.ErrUnknownTopicOrPartition
+}
+
+// parseTimestamp parses the time, given as RFC 3339 or milliseconds since the
+// epoch, into milliseconds since the epoch.
+func parseTimestamp(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if ms < 0 {
+			return 0, fmt.Errorf("negative timestamp: %d", ms)
+		}
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+func runGateway(cmd *cobra.Command, args []string) {
+	g := gateway.New(gatewayCfg)
+	if err := g.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "error starting gateway: %v\n", err)
+		os.Exit(1)
+	}
+
+	gracefully.Timeout = 10 * time.Second
+	gracefully.Shutdown()
+
+	if err := g.Shutdown(); err != nil {
+		fmt.Fprintf(os.Stderr, "error shutting down gateway: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runWebhook(cmd *cobra.Command, args []string) {
+	for _, s := range webhookSubscriptions {
+		sub, err := webhook.ParseSubscription(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing subscription: %v\n", err)
+			os.Exit(1)
+		}
+		webhookCfg.Subscriptions = append(webhookCfg.Subscriptions, sub)
+	}
+	p, err := webhook.New(webhookCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating webhook pusher: %v\n", err)
+		os.Exit(1)
+	}
+	if err := p.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "error starting webhook pusher: %v\n", err)
+		os.Exit(1)
+	}
+
+	gracefully.Timeout = 10 * time.Second
+	gracefully.Shutdown()
+
+	if err := p.Shutdown(); err != nil {
+		fmt.Fprintf(os.Stderr, "error shutting down webhook pusher: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func translateOffsets(cmd *cobra.Command, args []string) {
+	checkpoints, err := jocko.MirrorCheckpoints(jocko.NewDialer("jocko-cli"), translateCfg.BrokerAddr, translateCfg.Topic)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading checkpoints: %v\n", err)
+		os.Exit(1)
+	}
+	for _, o := range translateCfg.Offsets {
+		var partition int32
+		var offset int64
+		if _, err := fmt.Sscanf(o, "%d=%d", &partition, &offset); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid offset %q: want partition=offset\n", o)
+			os.Exit(1)
+		}
+		cp, ok := checkpoints[partition]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no checkpoint for partition %d\n", partition)
+			os.Exit(1)
+		}
+		fmt.Printf("%s-%d: %d -> %d\n", translateCfg.Topic, partition, offset, jocko.TranslateMirrorOffset(cp, offset))
+	}
+}
+
+func hotPartitions(cmd *cobra.Command, args []string) {
+	hot, err := jocko.HotPartitions(jocko.NewDialer("jocko-cli"), hotCfg.BrokerAddr, hotCfg.MinSkew)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error describing traffic: %v\n", err)
+		os.Exit(1)
+	}
+	for _, p := range hot {
+		fmt.Printf("%s-%d: leader %d, %.1fx share, %.0f B/s in, %.0f B/s out\n", p.Topic, p.Partition, p.Leader, p.Skew, p.BytesInRate, p.BytesOutRate)
+	}
+}
+
+func cleanStorage(cmd *cobra.Command, args []string) {
+	reclaimed, err := jocko.CleanLogs(storageCleanCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error cleaning logs: %v\n", err)
+		os.Exit(1)
+	}
+	var total int64
+	for partition, n := range reclaimed {
+		if n > 0 {
+			fmt.Printf("%s: reclaimed %d bytes\n", partition, n)
+		}
+		total += n
+	}
+	fmt.Fprintf(os.Stderr, "cleaned %d partitions, reclaimed %d bytes\n", len(reclaimed), total)
+}
+
+func benchStorage(cmd *cobra.Command, args []string) {
+	cfg := benchStorageCfg.BenchConfig
+	for _, n := range benchStorageCfg.SegmentBytes {
+		cfg.SegmentBytes = append(cfg.SegmentBytes, int64(n))
+	}
+	results, err := commitlog.Bench(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error benchmarking storage: %v\n", err)
+		os.Exit(1)
+	}
+	for _, res := range results {
+		fmt.Printf("segment bytes %d: %d segments, append %.1f MB/s, lookup %s, scan %.1f MB/s\n", res.SegmentBytes, res.Segments, res.AppendThroughput()/1e6, res.LookupTime, res.ScanThroughput()/1e6)
+	}
+}
+
+func verifyReplicas(cmd *cobra.Command, args []string) {
+	v := jocko.NewReplicaVerifier(jocko.NewDialer("jocko-cli"), verifyReplicasCfg.ReplicaVerifierConfig)
+	defer v.Close()
+	var matched int
+	report := time.Now()
+	for {
+		n, divergences, err := v.Verify()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error verifying replicas: %v\n", err)
+		}
+		matched += n
+		for _, d := range divergences {
+			fmt.Printf("%s-%d: replicas diverge at offset %d:", d.Topic, d.Partition, d.Offset)
+			for id, checksum := range d.Checksums {
+				fmt.Printf(" broker %d crc %08x", id, checksum)
+			}
+			fmt.Println()
+		}
+		if time.Since(report) >= time.Minute {
+			fmt.Fprintf(os.Stderr, "%d message sets verified\n", matched)
+			report = time.Now()
+		}
+		time.Sleep(verifyReplicasCfg.Interval)
+	}
+}
+
+func migrateOffsetsTopic(cmd *cobra.Command, args []string) {
+	conn, err := jocko.Dial("tcp", offsetsCfg.BrokerAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error connecting to broker: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	resp, err := conn.AlterOffsetsTopicPartitions(&protocol.AlterOffsetsTopicPartitionsRequest{
+		Partitions:   offsetsCfg.Partitions,
+		ValidateOnly: !offsetsCfg.Execute,
+		Force:        offsetsCfg.Force,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error with request to broker: %v\n", err)
+		os.Exit(1)
+	}
+	if resp.ErrorCode != protocol.ErrNone.Code() {
+		fmt.Fprintf(os.Stderr, "error code: %v\n", protocol.Errs[resp.ErrorCode])
+		os.Exit(1)
+	}
+	for _, m := range resp.Moves {
+		fmt.Printf("%s: partition %d -> %d, coordinator %d -> %d\n", m.GroupID, m.FromPartition, m.ToPartition, m.FromCoordinator, m.ToCoordinator)
+	}
+	if !offsetsCfg.Execute {
+		fmt.Fprintf(os.Stderr, "%d groups would move, run with --execute to migrate\n", len(resp.Moves))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "migrated offsets topic to %d partitions, moved %d groups\n", offsetsCfg.Partitions, len(resp.Moves))
+}
+
+func selfTest(cmd *cobra.Command, args []string) {
+	results := jocko.SelfTest(jocko.NewDialer("jocko-cli"), selfTestCfg)
+	for _, r := range results {
+		fmt.Println(r)
+	}
+	if !jocko.SelfTestPassed(results) {
+		fmt.Fprintln(os.Stderr, "self-test failed")
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "self-test passed")
+}
+
+func doctor(cmd *cobra.Command, args []string) {
+	if doctorCfg.BrokerAddr == "" && doctorCfg.DataDir == "" {
+		fmt.Fprintln(os.Stderr, "error: --broker-addr or --data-dir is required")
+		os.Exit(1)
+	}
+	diagnoses, err := jocko.Doctor(jocko.NewDialer("jocko-cli"), doctorCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error inspecting cluster: %v\n", err)
+		os.Exit(1)
+	}
+	if len(diagnoses) == 0 {
+		fmt.Fprintln(os.Stderr, "no problems found")
+		return
+	}
+	for _, d := range diagnoses {
+		fmt.Println(d)
+	}
+	fmt.Fprintf(os.Stderr, "found %d problems\n", len(diagnoses))
+	os.Exit(1)
+}
+
+func verifyManifests(cmd *cobra.Command, args []string) {
+	mismatches, err := jocko.VerifyManifests(verifyCfg.DataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error verifying manifests: %v\n", err)
+		os.Exit(1)
+	}
+	if len(mismatches) == 0 {
+		fmt.Fprintln(os.Stderr, "all segments match their manifests")
+		return
+	}
+	for partition, m := range mismatches {
+		for _, s := range m {
+			fmt.Printf("%s: %s\n", partition, s)
+		}
+	}
+	os.Exit(1)
+}
+
+func archivePartition(cmd *cobra.Command, args []string) {
+	path := filepath.Join(archiveCfg.DataDir, "data", fmt.Sprintf("%s-%d", archiveCfg.Topic, archiveCfg.Partition))
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(os.Stderr, "error finding partition: %v\n", err)
+		os.Exit(1)
+	}
+
+	// the export's written to a temp file and renamed once it's done, so a
+	// failed one doesn't replace an existing file
+	out := os.Stdout
+	var tmp string
+	if archiveCfg.Output != "" {
+		var err error
+		tmp = archiveCfg.Output + ".tmp"
+		if out, err = os.Create(tmp); err != nil {
+			fmt.Fprintf(os.Stderr, "error creating output file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	a, err := archive.New(out, archive.Options{
+		Format:        archive.Format(archiveCfg.Format),
+		KeyEncoding:   archive.Encoding(archiveCfg.KeyEncoding),
+		ValueEncoding: archive.Encoding(archiveCfg.ValueEncoding),
+	})
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	n, err := a.WriteDir(path)
+	if err == nil {
+		err = a.Flush()
+	}
+	if tmp != "" {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, archiveCfg.Output)
+		}
+	}
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		fmt.Fprintf(os.Stderr, "error exporting partition: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d records\n", n)
+}
+
 func main() {
 	cli.Execute()
 }
@@ -175,3 +948,180 @@ func (v *memberlistConfigValue) Type() string {
 func (v *memberlistConfigValue) String() string {
 	return fmt.Sprintf("%s:%d", v.BindAddr, v.BindPort)
 }
+
+// listenersValue parses listeners like
+// name=addr;cert=cert.pem:key.pem;cert=other.pem:other-key.pem;client-ca=ca.pem.
+type listenersValue []config.ListenerConfig
+
+func (v *listenersValue) Set(s string) error {
+	parts := strings.Split(s, ";")
+	nameAddr := strings.SplitN(parts[0], "=", 2)
+	if len(nameAddr) != 2 || nameAddr[0] == "" || nameAddr[1] == "" {
+		return fmt.Errorf("listener %q isn't name=addr", parts[0])
+	}
+	lc := config.ListenerConfig{Name: nameAddr[0], Addr: nameAddr[1]}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("listener option %q isn't key=value", part)
+		}
+		switch kv[0] {
+		case "cert":
+			files := strings.SplitN(kv[1], ":", 2)
+			if len(files) != 2 {
+				return fmt.Errorf("listener cert %q isn't cert:key", kv[1])
+			}
+			lc.Certificates = append(lc.Certificates, config.CertificateConfig{CertFile: files[0], KeyFile: files[1]})
+		case "client-ca":
+			lc.ClientCAFile = kv[1]
+		default:
+			return fmt.Errorf("unknown listener option %q", kv[0])
+		}
+	}
+	*v = append(*v, lc)
+	return nil
+}
+
+func (v *listenersValue) Type() string {
+	return "listener"
+}
+
+func (v *listenersValue) String() string {
+	var names []string
+	for _, lc := range *v {
+		names = append(names, lc.Name+"="+lc.Addr)
+	}
+	return strings.Join(names, ",")
+}
+
+// configProfilesValue parses topic config profiles like
+// compacted-changelog:cleanup.policy=compact;min.insync.replicas=2.
+type configProfilesValue map[string]map[string]string
+
+func (v *configProfilesValue) Set(s string) error {
+	nameConfigs := strings.SplitN(s, ":", 2)
+	if len(nameConfigs) != 2 || nameConfigs[0] == "" {
+		return fmt.Errorf("config profile %q isn't name:config=value", s)
+	}
+	configs := make(map[string]string)
+	for _, part := range strings.Split(nameConfigs[1], ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("config profile config %q isn't config=value", part)
+		}
+		configs[kv[0]] = kv[1]
+	}
+	if *v == nil {
+		*v = make(configProfilesValue)
+	}
+	(*v)[nameConfigs[0]] = configs
+	return nil
+}
+
+func (v *configProfilesValue) Type() string {
+	return "profile"
+}
+
+func (v *configProfilesValue) String() string {
+	var names []string
+	for name := range *v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// namespacesValue parses namespaces like
+// payments:principals=User:alice,User:bob;produce-byte-rate=1048576;retention.ms=86400000.
+type namespacesValue []config.NamespaceConfig
+
+func (v *namespacesValue) Set(s string) error {
+	nameOptions := strings.SplitN(s, ":", 2)
+	if len(nameOptions) != 2 || nameOptions[0] == "" {
+		return fmt.Errorf("namespace %q isn't name:option=value", s)
+	}
+	ns := config.NamespaceConfig{Name: nameOptions[0], TopicConfigs: make(map[string]string)}
+	for _, part := range strings.Split(nameOptions[1], ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("namespace option %q isn't option=value", part)
+		}
+		switch kv[0] {
+		case "principals":
+			ns.Principals = strings.Split(kv[1], ",")
+		case "produce-byte-rate":
+			rate, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("namespace produce byte rate %q isn't a number", kv[1])
+			}
+			ns.ProduceByteRate = rate
+		default:
+			ns.TopicConfigs[kv[0]] = kv[1]
+		}
+	}
+	*v = append(*v, ns)
+	return nil
+}
+
+func (v *namespacesValue) Type() string {
+	return "namespace"
+}
+
+func (v *namespacesValue) String() string {
+	var names []string
+	for _, ns := range *v {
+		names = append(names, ns.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// disabledAPIsValue parses APIs by name, e.g. DeleteTopics, or by key.
+type disabledAPIsValue []int16
+
+func (v *disabledAPIsValue) Set(s string) error {
+	key, ok := protocol.APIKeyByName(s)
+	if !ok {
+		k, err := strconv.ParseInt(s, 10, 16)
+		if err != nil {
+			return fmt.Errorf("unknown API %q", s)
+		}
+		key = int16(k)
+	}
+	if err := jocko.ValidateDisabledAPIs([]int16{key}); err != nil {
+		return err
+	}
+	*v = append(*v, key)
+	return nil
+}
+
+func (v *disabledAPIsValue) Type() string {
+	return "api"
+}
+
+func (v *disabledAPIsValue) String() string {
+	var names []string
+	for _, key := range *v {
+		names = append(names, protocol.APIKeyName(key))
+	}
+	return strings.Join(names, ",")
+}
+
+// readConsistencyValue parses the consistency of metadata reads.
+type readConsistencyValue config.ReadConsistency
+
+func (v *readConsistencyValue) Set(s string) error {
+	switch c := config.ReadConsistency(s); c {
+	case config.StaleReads, config.UnverifiedReads, config.LinearizableReads:
+		*v = readConsistencyValue(c)
+		return nil
+	}
+	return fmt.Errorf("unknown read consistency %q, must be stale, unverified, or linearizable", s)
+}
+
+func (v *readConsistencyValue) Type() string {
+	return "consistency"
+}
+
+func (v *readConsistencyValue) String() string {
+	return string(*v)
+}
@@ -0,0 +1,177 @@
+package commitlog
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BenchConfig configures a storage benchmark.
+type BenchConfig struct {
+	// Dir is where the benchmark's logs are written. They're removed once
+	// it's done.
+	Dir string
+	// SegmentBytes are the segment sizes to benchmark, with a log each.
+	SegmentBytes []int64
+	// MessageSets is the number of message sets appended to each log, each
+	// holding a message with a MessageBytes byte value.
+	MessageSets  int
+	MessageBytes int
+	// Lookups is the number of random offsets looked up in each log.
+	Lookups int
+	// ReadBytes is the most bytes read at a time scanning each log.
+	ReadBytes int32
+}
+
+// BenchResult is a storage benchmark's results for one segment size.
+type BenchResult struct {
+	SegmentBytes int64
+	Segments     int
+	// AppendBytes were appended in AppendTime.
+	AppendBytes int64
+	AppendTime  time.Duration
+	// LookupTime is the mean time to find an offset's segment and position.
+	LookupTime time.Duration
+	// ScanBytes were read from the start of the log in ScanTime.
+	ScanBytes int64
+	ScanTime  time.Duration
+}
+
+// AppendThroughput returns the bytes appended a second.
+func (r *BenchResult) AppendThroughput() float64 {
+	return float64(r.AppendBytes) / r.AppendTime.Seconds()
+}
+
+// ScanThroughput returns the bytes scanned a second.
+func (r *BenchResult) ScanThroughput() float64 {
+	return float64(r.ScanBytes) / r.ScanTime.Seconds()
+}
+
+// Bench benchmarks appending to, looking up offsets in, and scanning a log
+// with each of the segment sizes, to compare storage changes against a
+// baseline on the same machine and disk.
+func Bench(cfg BenchConfig) ([]*BenchResult, error) {
+	if cfg.MessageSets <= 0 {
+		return nil, fmt.Errorf("message sets must be positive")
+	}
+	dir, err := ioutil.TempDir(cfg.Dir, "jocko-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	var results []*BenchResult
+	for _, size := range cfg.SegmentBytes {
+		res, err := benchSegmentBytes(filepath.Join(dir, fmt.Sprintf("segment-%d", size)), size, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("segment bytes %d: %v", size, err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func benchSegmentBytes(path string, size int64, cfg BenchConfig) (*BenchResult, error) {
+	l, err := New(Options{Path: path, MaxSegmentBytes: size, MaxLogBytes: -1})
+	if err != nil {
+		return nil, err
+	}
+	defer l.Delete()
+	res := &BenchResult{SegmentBytes: size}
+
+	ms := benchMessageSet(cfg.MessageBytes)
+	start := time.Now()
+	if err := benchAppend(l, ms, cfg.MessageSets); err != nil {
+		return nil, err
+	}
+	if err := l.Sync(); err != nil {
+		return nil, err
+	}
+	res.AppendTime = time.Since(start)
+	res.AppendBytes = int64(len(ms)) * int64(cfg.MessageSets)
+	res.Segments = len(l.Segments())
+
+	if cfg.Lookups > 0 {
+		offsets := benchOffsets(l, cfg.Lookups)
+		start = time.Now()
+		if err := benchLookups(l, offsets); err != nil {
+			return nil, err
+		}
+		res.LookupTime = time.Since(start) / time.Duration(len(offsets))
+	}
+
+	start = time.Now()
+	res.ScanBytes, err = benchScan(l, cfg.ReadBytes)
+	if err != nil {
+		return nil, err
+	}
+	res.ScanTime = time.Since(start)
+	return res, nil
+}
+
+// benchMessageSet returns a message set holding a message with a value of
+// size bytes.
+func benchMessageSet(size int) MessageSet {
+	value := make([]byte, size)
+	rand.Read(value)
+	return NewMessageSet(0, newMessageV0(0, nil, value))
+}
+
+// benchAppend appends the message set to the log n times.
+func benchAppend(l *CommitLog, ms MessageSet, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := l.Append(ms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchOffsets returns n random offsets in the log.
+func benchOffsets(l *CommitLog, n int) []int64 {
+	oldest, newest := l.OldestOffset(), l.NewestOffset()
+	offsets := make([]int64, n)
+	for i := range offsets {
+		offsets[i] = oldest + rand.Int63n(newest-oldest)
+	}
+	return offsets
+}
+
+// benchLookups looks up the offsets' segments and positions in the log, as
+// fetches do.
+func benchLookups(l *CommitLog, offsets []int64) error {
+	for _, offset := range offsets {
+		if _, err := l.NewReader(offset, 0); err != nil {
+			return fmt.Errorf("look up offset %d: %v", offset, err)
+		}
+	}
+	return nil
+}
+
+// benchScan reads the whole log, readBytes at a time, and returns the bytes
+// read.
+func benchScan(l *CommitLog, readBytes int32) (int64, error) {
+	if readBytes <= 0 {
+		readBytes = 1024 * 1024
+	}
+	r, err := l.NewReader(l.OldestOffset(), readBytes)
+	if err != nil {
+		return 0, err
+	}
+	p := make([]byte, readBytes)
+	var read int64
+	for {
+		n, err := r.Read(p)
+		read += int64(n)
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
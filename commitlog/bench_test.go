@@ -0,0 +1,96 @@
+package commitlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// benchSegmentSizes are the segment sizes the storage benchmarks run with, to
+// see how lookups and scans change with the number of segments.
+var benchSegmentSizes = []int64{1 << 20, 16 << 20, 128 << 20}
+
+const (
+	benchMessageBytes = 1024
+	// benchMessageSets fill the logs the lookups and scans run over, 64MiB.
+	benchMessageSets = 64 * 1024
+)
+
+func TestBench(t *testing.T) {
+	req := require.New(t)
+	dir, err := ioutil.TempDir("", "benchtest")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	results, err := Bench(BenchConfig{
+		Dir:          dir,
+		SegmentBytes: []int64{4096, 1 << 20},
+		MessageSets:  100,
+		MessageBytes: 100,
+		Lookups:      10,
+		ReadBytes:    1000,
+	})
+	req.NoError(err)
+	req.Equal(2, len(results))
+	setBytes := int64(len(benchMessageSet(100)))
+	for _, res := range results {
+		req.Equal(100*setBytes, res.AppendBytes)
+		req.Equal(100*setBytes, res.ScanBytes)
+		req.True(res.AppendThroughput() > 0)
+	}
+	req.True(results[0].Segments > 1)
+	req.Equal(1, results[1].Segments)
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, size := range benchSegmentSizes {
+		b.Run(fmt.Sprintf("segment=%dMiB", size>>20), func(b *testing.B) {
+			l := newBenchLog(b, size)
+			defer l.Delete()
+			ms := benchMessageSet(benchMessageBytes)
+			b.SetBytes(int64(len(ms)))
+			b.ResetTimer()
+			require.NoError(b, benchAppend(l, ms, b.N))
+		})
+	}
+}
+
+func BenchmarkIndexLookup(b *testing.B) {
+	for _, size := range benchSegmentSizes {
+		b.Run(fmt.Sprintf("segment=%dMiB", size>>20), func(b *testing.B) {
+			l := newBenchLog(b, size)
+			defer l.Delete()
+			require.NoError(b, benchAppend(l, benchMessageSet(benchMessageBytes), benchMessageSets))
+			offsets := benchOffsets(l, b.N)
+			b.ResetTimer()
+			require.NoError(b, benchLookups(l, offsets))
+		})
+	}
+}
+
+func BenchmarkFetchScan(b *testing.B) {
+	for _, size := range benchSegmentSizes {
+		b.Run(fmt.Sprintf("segment=%dMiB", size>>20), func(b *testing.B) {
+			l := newBenchLog(b, size)
+			defer l.Delete()
+			ms := benchMessageSet(benchMessageBytes)
+			require.NoError(b, benchAppend(l, ms, benchMessageSets))
+			b.SetBytes(int64(len(ms)) * benchMessageSets)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := benchScan(l, 1024*1024)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func newBenchLog(b *testing.B, size int64) *CommitLog {
+	dir, err := ioutil.TempDir("", "commitlogbench")
+	require.NoError(b, err)
+	l, err := New(Options{Path: dir, MaxSegmentBytes: size, MaxLogBytes: -1})
+	require.NoError(b, err)
+	return l
+}
@@ -0,0 +1,152 @@
+package commitlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckLog checks the segments of the log in the directory for
+// inconsistencies between them and their indexes without opening the log,
+// which would rebuild the indexes and truncate torn writes: message sets that
+// are torn or fail their CRCs, offsets that go backwards, segments that
+// overlap, and index entries that don't point at their message sets.
+// It returns the segments with problems, so it works on a stopped broker's
+// data dir and on backups.
+func CheckLog(path string) ([]SegmentMismatch, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read dir failed")
+	}
+	var mismatches []SegmentMismatch
+	var baseOffsets []int64
+	logs := make(map[int64]bool)
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, LogFileSuffix):
+			baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, LogFileSuffix), 10, 64)
+			if err != nil {
+				continue
+			}
+			baseOffsets = append(baseOffsets, baseOffset)
+			logs[baseOffset] = true
+		case strings.HasSuffix(name, cleanedSuffix):
+			baseOffset, _ := strconv.ParseInt(strings.SplitN(name, ".", 2)[0], 10, 64)
+			mismatches = append(mismatches, SegmentMismatch{BaseOffset: baseOffset, Reason: "leftover file from an interrupted clean: " + name})
+		}
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, IndexFileSuffix) {
+			continue
+		}
+		baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, IndexFileSuffix), 10, 64)
+		if err == nil && !logs[baseOffset] {
+			mismatches = append(mismatches, SegmentMismatch{BaseOffset: baseOffset, Reason: "index without a log file"})
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+
+	nextOffset := int64(-1)
+	for _, baseOffset := range baseOffsets {
+		if baseOffset < nextOffset {
+			mismatches = append(mismatches, SegmentMismatch{
+				BaseOffset: baseOffset,
+				Reason:     fmt.Sprintf("overlaps the previous segment, which ends at offset %d", nextOffset),
+			})
+		}
+		entries, reasons, err := checkSegmentLog(path, baseOffset)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			nextOffset = entries[len(entries)-1].Offset + 1
+		} else if baseOffset > nextOffset {
+			nextOffset = baseOffset
+		}
+		if reasons, err = checkSegmentIndex(path, baseOffset, entries, reasons); err != nil {
+			return nil, err
+		}
+		for _, r := range reasons {
+			mismatches = append(mismatches, SegmentMismatch{BaseOffset: baseOffset, Reason: r})
+		}
+	}
+	return mismatches, nil
+}
+
+// checkSegmentLog reads the segment's message sets and returns their offsets
+// and positions and the problems found. It stops at the first message set
+// that's torn or corrupt, since the rest of the segment can't be trusted to
+// be framed.
+func checkSegmentLog(path string, baseOffset int64) ([]Entry, []string, error) {
+	p, err := ioutil.ReadFile(filepath.Join(path, fmt.Sprintf(fileFormat, baseOffset, logSuffix)))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read segment failed")
+	}
+	var entries []Entry
+	nextOffset := baseOffset
+	var reasons []string
+	for position := int64(0); position < int64(len(p)); {
+		rest := p[position:]
+		if len(rest) < msgSetHeaderLen || int64(MessageSet(rest).Size()) > int64(len(rest)) {
+			reasons = append(reasons, fmt.Sprintf("torn message set at position %d, the last %d bytes", position, len(rest)))
+			break
+		}
+		ms := MessageSet(rest[:MessageSet(rest).Size()])
+		if !ms.Verify() {
+			reasons = append(reasons, fmt.Sprintf("corrupt message set at position %d, offset %d", position, ms.Offset()))
+			break
+		}
+		if ms.Offset() < nextOffset {
+			reasons = append(reasons, fmt.Sprintf("offset %d at position %d isn't after offset %d", ms.Offset(), position, nextOffset-1))
+		}
+		entries = append(entries, Entry{Offset: ms.Offset(), Position: position})
+		nextOffset = ms.Offset() + 1
+		position += int64(len(ms))
+	}
+	return entries, reasons, nil
+}
+
+// checkSegmentIndex checks the segment's index has an entry for each of its
+// message sets, in order, with the offset stored in the log and pointing at
+// its position. Offsets can have gaps, e.g. after the log's cleaned, so the
+// entries are checked against the log's rather than counted from the base
+// offset. Indexes are rebuilt when their logs are opened, so a missing one
+// isn't a problem.
+func checkSegmentIndex(path string, baseOffset int64, entries []Entry, reasons []string) ([]string, error) {
+	p, err := ioutil.ReadFile(filepath.Join(path, fmt.Sprintf(fileFormat, baseOffset, indexSuffix)))
+	if os.IsNotExist(err) {
+		return reasons, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read index failed")
+	}
+	if len(p)%entryWidth != 0 {
+		return append(reasons, fmt.Sprintf("index is %d bytes, not a multiple of its %d byte entries", len(p), entryWidth)), nil
+	}
+	var n int
+	for ; n*entryWidth < len(p); n++ {
+		entry := p[n*entryWidth : (n+1)*entryWidth]
+		offset := baseOffset + int64(int32(Encoding.Uint32(entry[offsetOffset:offsetOffset+offsetWidth])))
+		position := int64(int32(Encoding.Uint32(entry[positionOffset : positionOffset+positionWidth])))
+		// the index is preallocated while it's open, its entries end at the
+		// first empty one
+		if (n > 0 || len(entries) == 0) && offset == baseOffset && position == 0 {
+			break
+		}
+		if n >= len(entries) || offset != entries[n].Offset || position != entries[n].Position {
+			return append(reasons, fmt.Sprintf("index entry %d for offset %d at position %d doesn't match the log", n, offset, position)), nil
+		}
+	}
+	if n != len(entries) {
+		reasons = append(reasons, fmt.Sprintf("index has %d entries for the log's %d message sets", n, len(entries)))
+	}
+	return reasons, nil
+}
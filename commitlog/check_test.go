@@ -0,0 +1,97 @@
+package commitlog_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestCheckLog(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "check")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	ms := newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")})
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: int64(ms.Size()),
+		MaxLogBytes:     -1,
+	})
+	req.NoError(err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(ms)
+		req.NoError(err)
+	}
+	req.NoError(l.Close())
+
+	mismatches, err := commitlog.CheckLog(path)
+	req.NoError(err)
+	req.Empty(mismatches)
+
+	segment := func(baseOffset, suffix string) string {
+		return filepath.Join(path, "0000000000000000000"+baseOffset+suffix)
+	}
+	b, err := ioutil.ReadFile(segment("0", ".log"))
+	req.NoError(err)
+	b[len(b)-1] ^= 0xff
+	req.NoError(ioutil.WriteFile(segment("0", ".log"), b, 0644))
+	f, err := os.OpenFile(segment("1", ".log"), os.O_APPEND|os.O_WRONLY, 0644)
+	req.NoError(err)
+	_, err = f.Write([]byte("torn"))
+	req.NoError(err)
+	req.NoError(f.Close())
+	req.NoError(ioutil.WriteFile(segment("2", ".index"), []byte("bad"), 0644))
+	req.NoError(ioutil.WriteFile(segment("9", ".index"), nil, 0644))
+
+	mismatches, err = commitlog.CheckLog(path)
+	req.NoError(err)
+	reasons := make(map[int64][]string)
+	for _, m := range mismatches {
+		reasons[m.BaseOffset] = append(reasons[m.BaseOffset], m.Reason)
+	}
+	req.Equal(4, len(reasons), "%v", mismatches)
+	req.Contains(reasons[0][0], "corrupt message set at position 0")
+	req.Contains(reasons[1][0], "torn message set")
+	req.Contains(reasons[2][0], "not a multiple")
+	req.Equal([]string{"index without a log file"}, reasons[9])
+}
+
+func TestCheckLog_OffsetGaps(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "check")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	// a cleaned segment, its offsets have gaps
+	msg := &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")}
+	first, second := newMessageSet(0, msg), newMessageSet(5, msg)
+	req.NoError(ioutil.WriteFile(filepath.Join(path, "00000000000000000000.log"), append(append([]byte{}, first...), second...), 0644))
+	index := func(offsets ...uint32) []byte {
+		b := make([]byte, 8*len(offsets))
+		position := uint32(0)
+		for i, offset := range offsets {
+			commitlog.Encoding.PutUint32(b[i*8:], offset)
+			commitlog.Encoding.PutUint32(b[i*8+4:], position)
+			position += uint32(len(first))
+		}
+		return b
+	}
+	req.NoError(ioutil.WriteFile(filepath.Join(path, "00000000000000000000.index"), index(0, 5), 0644))
+
+	mismatches, err := commitlog.CheckLog(path)
+	req.NoError(err)
+	req.Empty(mismatches)
+
+	req.NoError(ioutil.WriteFile(filepath.Join(path, "00000000000000000000.index"), index(0, 1), 0644))
+	mismatches, err = commitlog.CheckLog(path)
+	req.NoError(err)
+	req.Equal(1, len(mismatches), "%v", mismatches)
+	req.Contains(mismatches[0].Reason, "index entry 1 for offset 1")
+}
@@ -3,26 +3,34 @@ package commitlog
 import (
 	"encoding/binary"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 var (
 	ErrSegmentNotFound = errors.New("segment not found")
-	Encoding           = binary.BigEndian
+	// ErrLogFailed is returned by appends to a log after a write to it or a
+	// sync of it failed, since the log may have lost writes it acknowledged
+	// or be left with a partial write.
+	ErrLogFailed = errors.New("log failed")
+	Encoding     = binary.BigEndian
 )
 
 type CleanupPolicy string
 
 const (
-	DeleteCleanupPolicy  = "delete"
-	CompactCleanupPolicy = "compact"
+	DeleteCleanupPolicy        = "delete"
+	CompactCleanupPolicy       = "compact"
+	CompactDeleteCleanupPolicy = "compact,delete"
 
 	LogFileSuffix   = ".log"
 	IndexFileSuffix = ".index"
@@ -35,6 +43,21 @@ type CommitLog struct {
 	mu             sync.RWMutex
 	segments       []*Segment
 	vActiveSegment atomic.Value
+	// unflushed is the number of message sets appended since the log was
+	// last synced.
+	unflushed int64
+	failure   atomic.Value
+	// manifest has the size and checksum of each rolled segment listed in
+	// the log's manifest.
+	manifest map[*Segment]manifestEntry
+	// rollJitter is taken off MaxSegmentAge for the active segment.
+	rollJitter time.Duration
+}
+
+// logFailure holds the error that failed the log, it's wrapped since
+// atomic.Value needs the same concrete type each time.
+type logFailure struct {
+	err error
 }
 
 type Options struct {
@@ -42,8 +65,50 @@ type Options struct {
 	// MaxSegmentBytes is the max number of bytes a segment can contain, once the limit is hit a
 	// new segment will be split off.
 	MaxSegmentBytes int64
-	MaxLogBytes     int64
-	CleanupPolicy   CleanupPolicy
+	// MaxSegmentAge is how long the active segment's written to before a new
+	// segment's split off, even if it isn't full. Segments are only rolled
+	// by size if it's zero or negative.
+	MaxSegmentAge time.Duration
+	// SegmentJitter is the most that's randomly taken off MaxSegmentAge for
+	// each segment, so logs created at the same time don't all roll, and
+	// sync, at the same time.
+	SegmentJitter time.Duration
+	MaxLogBytes   int64
+	// MaxLogAge is how long segments are kept with the delete cleanup
+	// policies. Segments don't expire if it's zero or negative.
+	MaxLogAge     time.Duration
+	CleanupPolicy CleanupPolicy
+	// DeleteRetention is how long a compacted log keeps tombstones. Zero removes
+	// them the next time the log's cleaned and a negative value keeps them.
+	DeleteRetention time.Duration
+	// MinCleanableDirtyRatio and MaxCompactionLag control how often a
+	// compacted log's cleaned, see CompactCleaner.
+	MinCleanableDirtyRatio float64
+	MaxCompactionLag       time.Duration
+	// OffsetMapBytes bounds the memory compacting the log takes, see
+	// CompactCleaner.
+	OffsetMapBytes int64
+	// FlushMessages is the number of message sets appended after which the
+	// log's synced to disk. If it's zero or negative the log's only synced
+	// when a segment's rolled and when it's closed.
+	FlushMessages int64
+	// Recover verifies the log's messages when it's opened and truncates it at
+	// the first corrupt message set, e.g. after an unclean shutdown.
+	Recover bool
+	// FDCache limits how many of the log's segment files are open at a time,
+	// along with those of the other logs it's shared with. Every segment's
+	// files stay open if it's nil.
+	FDCache *FDCache
+	// Manifest keeps a manifest of the log's rolled segments' sizes and
+	// checksums in its directory, updated as segments are rolled and cleaned,
+	// so bit rot or a partial restore can be found with VerifyManifest.
+	Manifest bool
+	// CompactionPaused, if it's set and returns true when a segment's rolled,
+	// skips compacting the log that time, e.g. while its broker's in
+	// maintenance. Segments past retention are still deleted.
+	CompactionPaused func() bool
+	// Failpoints are faults to inject into storage operations. Only used by tests.
+	Failpoints *Failpoints
 }
 
 func New(opts Options) (*CommitLog, error) {
@@ -59,11 +124,23 @@ func New(opts Options) (*CommitLog, error) {
 		opts.CleanupPolicy = DeleteCleanupPolicy
 	}
 
+	dc := NewDeleteCleaner(opts.MaxLogBytes)
+	dc.Retention.Age = opts.MaxLogAge
+	cc := NewCompactCleaner()
+	cc.DeleteRetention = opts.DeleteRetention
+	cc.MinCleanableDirtyRatio = opts.MinCleanableDirtyRatio
+	cc.MaxCompactionLag = opts.MaxCompactionLag
+	cc.OffsetMapBytes = opts.OffsetMapBytes
+	cc.CheckpointPath = filepath.Join(opts.Path, CleanerCheckpointFile)
+
 	var cleaner Cleaner
-	if opts.CleanupPolicy == DeleteCleanupPolicy {
-		cleaner = NewDeleteCleaner(opts.MaxLogBytes)
-	} else {
-		cleaner = NewCompactCleaner()
+	switch opts.CleanupPolicy {
+	case DeleteCleanupPolicy:
+		cleaner = dc
+	case CompactDeleteCleanupPolicy, "delete,compact":
+		cleaner = &CompactDeleteCleaner{Compact: cc, Delete: dc}
+	default:
+		cleaner = cc
 	}
 
 	path, _ := filepath.Abs(opts.Path)
@@ -76,6 +153,7 @@ func New(opts Options) (*CommitLog, error) {
 	if err := l.init(); err != nil {
 		return nil, err
 	}
+	l.rollJitter = l.newRollJitter()
 
 	if err := l.open(); err != nil {
 		return nil, err
@@ -92,17 +170,37 @@ func (l *CommitLog) init() error {
 	return nil
 }
 
+// indexFileSuffix returns the suffix of the file if it's one of a segment's
+// indexes, or "" if it isn't.
+func indexFileSuffix(name string) string {
+	for _, suffix := range []string{IndexFileSuffix, timeIndexSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
 func (l *CommitLog) open() error {
 	files, err := ioutil.ReadDir(l.Path)
 	if err != nil {
 		return errors.Wrap(err, "read dir failed")
 	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	// finish deleting the files that were still open when they were deleted
+	if err := removeDeletedFiles(l.Path, names); err != nil {
+		return errors.Wrap(err, "remove deleted files failed")
+	}
+	var baseOffsets []int64
 	for _, file := range files {
 		// if this file is an index file, make sure it has a corresponding .log file
-		if strings.HasSuffix(file.Name(), IndexFileSuffix) {
-			_, err := os.Stat(filepath.Join(l.Path, strings.Replace(file.Name(), IndexFileSuffix, LogFileSuffix, 1)))
+		if suffix := indexFileSuffix(file.Name()); suffix != "" {
+			_, err := os.Stat(filepath.Join(l.Path, strings.Replace(file.Name(), suffix, LogFileSuffix, 1)))
 			if os.IsNotExist(err) {
-				if err := os.Remove(file.Name()); err != nil {
+				if err := removeFile(filepath.Join(l.Path, file.Name())); err != nil {
 					return err
 				}
 			} else if err != nil {
@@ -114,25 +212,70 @@ func (l *CommitLog) open() error {
 			if err != nil {
 				return err
 			}
-			segment, err := NewSegment(l.Path, int64(baseOffset), l.MaxSegmentBytes)
-			if err != nil {
-				return err
-			}
-			l.segments = append(l.segments, segment)
+			baseOffsets = append(baseOffsets, int64(baseOffset))
 		}
 	}
+	for i, baseOffset := range baseOffsets {
+		// with an FD cache the rolled segments' files are opened when
+		// they're first read, unless they're all to be verified now
+		var segment *Segment
+		if l.FDCache != nil && !l.Recover && i < len(baseOffsets)-1 {
+			segment, err = openSegment(l.Path, baseOffset, l.MaxSegmentBytes, l.Failpoints, l.FDCache)
+		} else {
+			segment, err = NewSegment(l.Path, baseOffset, l.MaxSegmentBytes, l.Failpoints, l.FDCache)
+		}
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, segment)
+	}
 	if len(l.segments) == 0 {
-		segment, err := NewSegment(l.Path, 0, l.MaxSegmentBytes)
+		segment, err := NewSegment(l.Path, 0, l.MaxSegmentBytes, l.Failpoints, l.FDCache)
 		if err != nil {
 			return err
 		}
 		l.segments = append(l.segments, segment)
 	}
+	if l.Recover {
+		if err := l.recover(); err != nil {
+			return err
+		}
+	}
+	if l.Manifest {
+		if err := l.loadManifest(); err != nil {
+			return err
+		}
+	}
 	l.vActiveSegment.Store(l.segments[len(l.segments)-1])
 	return nil
 }
 
+// recover truncates the log at its first corrupt message set, deleting the
+// segments after it.
+func (l *CommitLog) recover() error {
+	for i, segment := range l.segments {
+		truncated, err := segment.Recover()
+		if err != nil {
+			return err
+		}
+		if !truncated {
+			continue
+		}
+		for _, s := range l.segments[i+1:] {
+			if err := s.Delete(); err != nil {
+				return err
+			}
+		}
+		l.segments = l.segments[:i+1]
+		return nil
+	}
+	return nil
+}
+
 func (l *CommitLog) Append(b []byte) (offset int64, err error) {
+	if err := l.Failed(); err != nil {
+		return offset, errors.Wrap(ErrLogFailed, err.Error())
+	}
 	ms := MessageSet(b)
 	if l.checkSplit() {
 		if err := l.split(); err != nil {
@@ -143,18 +286,47 @@ func (l *CommitLog) Append(b []byte) (offset int64, err error) {
 	offset = l.activeSegment().NextOffset
 	ms.PutOffset(offset)
 	if _, err := l.activeSegment().Write(ms); err != nil {
-		return offset, err
+		return offset, l.fail(err)
 	}
 	e := Entry{
 		Offset:   offset,
 		Position: position,
 	}
 	if err := l.activeSegment().Index.WriteEntry(e); err != nil {
-		return offset, err
+		return offset, l.fail(err)
+	}
+	if l.FlushMessages > 0 && atomic.AddInt64(&l.unflushed, 1) >= l.FlushMessages {
+		if err := l.Sync(); err != nil {
+			return offset, err
+		}
 	}
 	return offset, nil
 }
 
+// Sync flushes the active segment to disk. If it fails the log's failed.
+func (l *CommitLog) Sync() error {
+	atomic.StoreInt64(&l.unflushed, 0)
+	if err := l.activeSegment().Sync(); err != nil {
+		return l.fail(err)
+	}
+	return nil
+}
+
+// fail marks the log failed by the error, so it stops taking appends rather
+// than acknowledging writes that may not be durable, and returns the error.
+func (l *CommitLog) fail(err error) error {
+	l.failure.Store(logFailure{err})
+	return err
+}
+
+// Failed returns the error that failed the log, or nil if it hasn't failed.
+func (l *CommitLog) Failed() error {
+	if f, ok := l.failure.Load().(logFailure); ok {
+		return f.err
+	}
+	return nil
+}
+
 func (l *CommitLog) Read(p []byte) (n int, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -162,7 +334,21 @@ func (l *CommitLog) Read(p []byte) (n int, err error) {
 }
 
 func (l *CommitLog) NewestOffset() int64 {
-	return l.activeSegment().NextOffset
+	return l.activeSegment().nextOffset()
+}
+
+// SegmentID returns the ID of the segment with the offset, or 0 if no segment
+// has it. The ID changes when the segment's replaced, e.g. when it's cleaned,
+// so a message set read at the offset from a segment with the same ID is the
+// same message set.
+func (l *CommitLog) SegmentID(offset int64) uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].BaseOffset > offset })
+	if i == 0 {
+		return 0
+	}
+	return l.segments[i-1].id
 }
 
 func (l *CommitLog) OldestOffset() int64 {
@@ -171,6 +357,36 @@ func (l *CommitLog) OldestOffset() int64 {
 	return l.segments[0].BaseOffset
 }
 
+// OffsetForTime returns the offset and timestamp of the first message set whose
+// timestamp is greater than or equal to the given timestamp in milliseconds, or
+// -1 for both if there isn't one. Since timestamps may be out of order the
+// segments are searched by the max timestamp of them and every segment before
+// them, and then the segment's time index. That's the earliest set at or after
+// the timestamp even if later sets have earlier timestamps: every set before it
+// is earlier than the timestamp, so it's later than all of them and indexed.
+func (l *CommitLog) OffsetForTime(ts int64) (offset, timestamp int64) {
+	l.mu.RLock()
+	segments := l.segments
+	l.mu.RUnlock()
+	maxes := make([]int64, len(segments))
+	max := int64(-1)
+	for i, segment := range segments {
+		if t := segment.MaxTimestamp(); t > max {
+			max = t
+		}
+		maxes[i] = max
+	}
+	i := sort.Search(len(maxes), func(i int) bool { return maxes[i] >= ts })
+	if i == len(maxes) {
+		return -1, -1
+	}
+	e, ok := segments[i].findTime(ts)
+	if !ok {
+		return -1, -1
+	}
+	return e.Offset, e.Timestamp
+}
+
 func (l *CommitLog) activeSegment() *Segment {
 	return l.vActiveSegment.Load().(*Segment)
 }
@@ -207,9 +423,66 @@ func (l *CommitLog) Truncate(offset int64) error {
 		}
 	}
 	l.segments = segments
+	return l.writeManifest()
+}
+
+// Reset deletes the log's segments and starts it over at the offset, e.g. so
+// a mirror of a log whose older segments have been deleted has the same
+// offsets as it.
+func (l *CommitLog) Reset(offset int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, segment := range l.segments {
+		if err := segment.Delete(); err != nil {
+			return err
+		}
+	}
+	segment, err := NewSegment(l.Path, offset, l.MaxSegmentBytes, l.Failpoints, l.FDCache)
+	if err != nil {
+		return err
+	}
+	l.segments = []*Segment{segment}
+	l.vActiveSegment.Store(segment)
+	return l.writeManifest()
+}
+
+// Skip moves the log's next offset forward to the offset, leaving a gap in its
+// offsets like compaction does, e.g. so a mirror of a compacted log has the same
+// offsets as it. It does nothing if the offset's not past the newest.
+func (l *CommitLog) Skip(offset int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.Failed(); err != nil {
+		return errors.Wrap(ErrLogFailed, err.Error())
+	}
+	segment := l.activeSegment()
+	segment.Lock()
+	if offset > segment.NextOffset {
+		segment.NextOffset = offset
+	}
+	segment.Unlock()
 	return nil
 }
 
+// Clean rolls the log's active segment and runs its cleaner now rather than
+// when the segment fills up, e.g. to reclaim disk space while the broker's
+// stopped.
+func (l *CommitLog) Clean() error {
+	if l.activeSegment().Position > 0 {
+		return l.split()
+	}
+	// the empty active segment's as good as a rolled one
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments, err := l.activeCleaner().Clean(l.segments)
+	if err != nil {
+		return err
+	}
+	l.segments = segments
+	l.vActiveSegment.Store(segments[len(segments)-1])
+	return l.writeManifest()
+}
+
 func (l *CommitLog) Segments() []*Segment {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -217,23 +490,65 @@ func (l *CommitLog) Segments() []*Segment {
 }
 
 func (l *CommitLog) checkSplit() bool {
-	return l.activeSegment().IsFull()
+	segment := l.activeSegment()
+	if segment.IsFull() {
+		return true
+	}
+	return l.MaxSegmentAge > 0 && segment.IsExpired(l.MaxSegmentAge-l.rollJitter)
+}
+
+// newRollJitter picks the jitter for a new active segment, up to SegmentJitter
+// and less than MaxSegmentAge.
+func (l *CommitLog) newRollJitter() time.Duration {
+	max := l.SegmentJitter
+	if max > l.MaxSegmentAge {
+		max = l.MaxSegmentAge
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// activeCleaner returns the log's cleaner, less compaction if it's paused.
+func (l *CommitLog) activeCleaner() Cleaner {
+	if l.CompactionPaused == nil || !l.CompactionPaused() {
+		return l.cleaner
+	}
+	switch c := l.cleaner.(type) {
+	case *CompactCleaner:
+		return noopCleaner{}
+	case *CompactDeleteCleaner:
+		return c.Delete
+	}
+	return l.cleaner
+}
+
+type noopCleaner struct{}
+
+func (noopCleaner) Clean(segments []*Segment) ([]*Segment, error) {
+	return segments, nil
 }
 
 func (l *CommitLog) split() error {
-	segment, err := NewSegment(l.Path, l.NewestOffset(), l.MaxSegmentBytes)
+	if err := l.Sync(); err != nil {
+		return err
+	}
+	segment, err := NewSegment(l.Path, l.NewestOffset(), l.MaxSegmentBytes, l.Failpoints, l.FDCache)
 	if err != nil {
 		return err
 	}
 	l.mu.Lock()
 	segments := append(l.segments, segment)
-	segments, err = l.cleaner.Clean(segments)
+	segments, err = l.activeCleaner().Clean(segments)
 	if err != nil {
 		l.mu.Unlock()
 		return err
 	}
 	l.segments = segments
+	err = l.writeManifest()
+	l.rollJitter = l.newRollJitter()
 	l.mu.Unlock()
 	l.vActiveSegment.Store(segment)
-	return nil
+	return err
 }
@@ -2,12 +2,17 @@ package commitlog_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
 )
 
 var (
@@ -159,3 +164,287 @@ func cleanup(t require.TestingT, l *commitlog.CommitLog) {
 	os.RemoveAll(l.Path)
 	os.MkdirAll(l.Path, 0755)
 }
+
+func TestRecover(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	defer cleanup(t, l)
+
+	var sets []commitlog.MessageSet
+	for _, v := range []string{"one", "two", "three"} {
+		sets = append(sets, newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte(v)}))
+		_, err := l.Append(sets[len(sets)-1])
+		req.NoError(err)
+	}
+	req.NoError(l.Close())
+
+	// flip a byte in the second message set's value
+	f, err := os.OpenFile(filepath.Join(l.Path, fmt.Sprintf("%020d.log", 0)), os.O_RDWR, 0644)
+	req.NoError(err)
+	_, err = f.WriteAt([]byte{'X'}, int64(len(sets[0])+len(sets[1])-1))
+	req.NoError(err)
+	req.NoError(f.Close())
+
+	l, err = commitlog.New(commitlog.Options{Path: l.Path, MaxSegmentBytes: 1024, MaxLogBytes: -1, Recover: true})
+	req.NoError(err)
+	defer l.Close()
+	req.Equal(int64(1), l.NewestOffset())
+	req.True(sets[0].Verify())
+}
+
+func TestSkip(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	defer cleanup(t, l)
+
+	one := newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("one")})
+	two := newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("two")})
+	_, err := l.Append(one)
+	req.NoError(err)
+	req.NoError(l.Skip(5))
+	// skipping back does nothing
+	req.NoError(l.Skip(3))
+	offset, err := l.Append(two)
+	req.NoError(err)
+	req.Equal(int64(5), offset)
+
+	read := func(l *commitlog.CommitLog) {
+		req.Equal(int64(6), l.NewestOffset())
+		// reads in the gap start at the next message set after it
+		r, err := l.NewReader(2, 0)
+		req.NoError(err)
+		p := make([]byte, len(two))
+		_, err = r.Read(p)
+		req.NoError(err)
+		req.Equal(int64(5), commitlog.MessageSet(p).Offset())
+	}
+	read(l)
+
+	// the gap's kept when the log's opened again
+	req.NoError(l.Close())
+	l, err = commitlog.New(commitlog.Options{Path: l.Path, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	req.NoError(err)
+	defer l.Close()
+	read(l)
+}
+
+func TestNewestOffsetWhileAppending(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{MaxSegmentBytes: 1 << 20, MaxLogBytes: -1})
+	defer cleanup(t, l)
+
+	// the newest offset's read while it's written, e.g. by a fetch while
+	// the partition's produced to, so run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_, err := l.Append(newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")}))
+			req.NoError(err)
+		}
+	}()
+	var last int64
+	for offset := int64(0); offset < 100; offset = l.NewestOffset() {
+		req.True(offset >= last)
+		last = offset
+		if offset > 0 {
+			_, err := l.NewReader(offset-1, 0)
+			req.NoError(err)
+		}
+	}
+	<-done
+}
+
+func TestReadLog(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{MaxSegmentBytes: 100, MaxLogBytes: -1})
+	defer cleanup(t, l)
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")}))
+		req.NoError(err)
+	}
+	req.True(len(l.Segments()) > 1)
+	req.NoError(l.Close())
+
+	// a torn write at the end is read past and left as it is
+	active := l.Segments()[len(l.Segments())-1]
+	name := filepath.Join(l.Path, fmt.Sprintf("%020d%s", active.BaseOffset, commitlog.LogFileSuffix))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	req.NoError(err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 1})
+	req.NoError(err)
+	req.NoError(f.Close())
+	fi, err := os.Stat(name)
+	req.NoError(err)
+
+	var offsets []int64
+	req.NoError(commitlog.ReadLog(l.Path, func(ms commitlog.MessageSet) error {
+		req.Len(ms.Messages(), 1)
+		offsets = append(offsets, ms.Offset())
+		return nil
+	}))
+	req.Equal([]int64{0, 1, 2, 3, 4}, offsets)
+	after, err := os.Stat(name)
+	req.NoError(err)
+	req.Equal(fi.Size(), after.Size())
+}
+
+func TestReadLogCorruptSize(t *testing.T) {
+	req := require.New(t)
+	for _, size := range []uint32{0xFFFFFFF4, 0xFFFFFFF8, 0x80000000} {
+		l := setupWithOptions(t, commitlog.Options{MaxSegmentBytes: 1024, MaxLogBytes: -1})
+		_, err := l.Append(newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")}))
+		req.NoError(err)
+		req.NoError(l.Close())
+
+		// a header whose size is corrupt is read as a torn tail
+		name := filepath.Join(l.Path, fmt.Sprintf("%020d%s", int64(0), commitlog.LogFileSuffix))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+		req.NoError(err)
+		header := make([]byte, 12)
+		binary.BigEndian.PutUint32(header[8:], size)
+		_, err = f.Write(header)
+		req.NoError(err)
+		req.NoError(f.Close())
+
+		var n int
+		req.NoError(commitlog.ReadLog(l.Path, func(ms commitlog.MessageSet) error {
+			n++
+			return nil
+		}))
+		req.Equal(1, n)
+		cleanup(t, l)
+	}
+}
+
+func TestOffsetForTime(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{MaxSegmentBytes: 100, MaxLogBytes: -1})
+	defer cleanup(t, l)
+
+	// the timestamps are out of order within and across segments
+	for _, ts := range []int64{100, 300, 200, 500, 400, 700} {
+		_, err := l.Append(newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Unix(0, ts*int64(time.Millisecond)), Value: []byte("value")}))
+		req.NoError(err)
+	}
+	req.True(len(l.Segments()) > 1)
+
+	search := func(l *commitlog.CommitLog) {
+		for _, c := range []struct{ ts, offset, timestamp int64 }{
+			{0, 0, 100},
+			{150, 1, 300},
+			{300, 1, 300},
+			{350, 3, 500},
+			{450, 3, 500},
+			{600, 5, 700},
+			{800, -1, -1},
+		} {
+			offset, timestamp := l.OffsetForTime(c.ts)
+			req.Equal(c.offset, offset, "offset for %d", c.ts)
+			req.Equal(c.timestamp, timestamp, "timestamp for %d", c.ts)
+		}
+	}
+	search(l)
+
+	// the time index is kept with each segment and read when the log's
+	// opened
+	req.NoError(l.Close())
+	timeIndexes, err := filepath.Glob(filepath.Join(l.Path, "*.timeindex"))
+	req.NoError(err)
+	req.Len(timeIndexes, len(l.Segments()))
+	l, err = commitlog.New(commitlog.Options{Path: l.Path, MaxSegmentBytes: 100, MaxLogBytes: -1})
+	req.NoError(err)
+	search(l)
+
+	// and rebuilt from the log if it's missing
+	req.NoError(l.Close())
+	for _, path := range timeIndexes {
+		req.NoError(os.Remove(path))
+	}
+	l, err = commitlog.New(commitlog.Options{Path: l.Path, MaxSegmentBytes: 100, MaxLogBytes: -1})
+	req.NoError(err)
+	defer l.Close()
+	search(l)
+}
+
+func TestOffsetForTimeGaps(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	defer cleanup(t, l)
+
+	_, err := l.Append(newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Unix(0, 100*int64(time.Millisecond)), Value: []byte("value")}))
+	req.NoError(err)
+	req.NoError(l.Skip(5))
+	_, err = l.Append(newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Unix(0, 200*int64(time.Millisecond)), Value: []byte("value")}))
+	req.NoError(err)
+
+	// the message set after a gap is found by its own offset, whether it was
+	// indexed as it was appended or from the log
+	for _, remove := range []bool{false, true} {
+		offset, timestamp := l.OffsetForTime(150)
+		req.Equal(int64(5), offset)
+		req.Equal(int64(200), timestamp)
+		req.NoError(l.Close())
+		if remove {
+			paths, err := filepath.Glob(filepath.Join(l.Path, "*.timeindex"))
+			req.NoError(err)
+			for _, path := range paths {
+				req.NoError(os.Remove(path))
+			}
+		}
+		l, err = commitlog.New(commitlog.Options{Path: l.Path, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+		req.NoError(err)
+	}
+	offset, _ := l.OffsetForTime(150)
+	req.Equal(int64(5), offset)
+	req.NoError(l.Close())
+}
+
+func TestRollByAge(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+		MaxSegmentAge:   50 * time.Millisecond,
+		SegmentJitter:   time.Hour,
+	})
+	defer cleanup(t, l)
+
+	ms := newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("one")})
+	_, err := l.Append(ms)
+	req.NoError(err)
+	req.Len(l.Segments(), 1)
+
+	// the jitter's capped at the segment's age, so it's rolled by then
+	time.Sleep(50 * time.Millisecond)
+	_, err = l.Append(ms)
+	req.NoError(err)
+	req.Len(l.Segments(), 2)
+}
+
+func TestSegmentID(t *testing.T) {
+	req := require.New(t)
+	l := setupWithOptions(t, commitlog.Options{
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+		MaxSegmentAge:   50 * time.Millisecond,
+	})
+	defer cleanup(t, l)
+
+	ms := newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("one")})
+	_, err := l.Append(ms)
+	req.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = l.Append(ms)
+	req.NoError(err)
+	req.Len(l.Segments(), 2)
+
+	// each segment has its own ID, which changes when it's replaced
+	first, second := l.SegmentID(0), l.SegmentID(1)
+	req.NotZero(first)
+	req.NotZero(second)
+	req.NotEqual(first, second)
+	req.NoError(l.Reset(0))
+	req.NotEqual(first, l.SegmentID(0))
+	req.Zero(l.SegmentID(-1))
+}
@@ -1,17 +1,65 @@
 package commitlog
 
 import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
 )
 
+// offsetMapEntryBytes is about how much memory an entry of the offset map
+// takes, its key hash and offset along with the map's overhead.
+const offsetMapEntryBytes = 48
+
+// CleanerCheckpointFile is the name of the file in a compacted log's directory
+// with the offset the log's been cleaned up to.
+const CleanerCheckpointFile = "cleaner-offset-checkpoint"
+
 type CompactCleaner struct {
-	// map from key hash to offset
-	m map[uint64]int64
+	// DeleteRetention is how long tombstones, i.e. messages with a nil value,
+	// are kept after their segment was last written so consumers see the
+	// delete before the key's gone for good. It's measured from the
+	// segment's modification time rather than the messages' timestamps,
+	// which producers set, and cleaning keeps the time of the segment it
+	// rewrites. Transaction markers are kept while their transactions'
+	// records are, and as long again after so read_committed consumers
+	// reading the transaction when the log's cleaned still see how it
+	// ended. Both are kept forever if it's negative. Aborted transactions'
+	// records are always removed.
+	DeleteRetention time.Duration
+	// MinCleanableDirtyRatio is the share of the log's bytes that have to be
+	// dirty, i.e. written since the log was last cleaned, for it to be cleaned.
+	MinCleanableDirtyRatio float64
+	// MaxCompactionLag is how long a message can stay dirty before the log's
+	// cleaned regardless of its dirty ratio. A message's dirty since its
+	// segment was last written, rather than since its timestamp, which
+	// producers set, so the lag can run over by up to a segment's age. It's
+	// ignored if it's negative.
+	MaxCompactionLag time.Duration
+	// OffsetMapBytes bounds the memory of the map of keys to their latest
+	// offsets the log's cleaned with. A log with more keys than fit is
+	// cleaned in passes, each mapping as much of the rest of the log as fits
+	// and cleaning the log up to there. It's unbounded if it's zero or
+	// negative.
+	OffsetMapBytes int64
+	// CheckpointPath, if it's set, is the file the clean offset's kept in so
+	// the log's clean part isn't taken for dirty after a restart.
+	CheckpointPath string
+	// offset the log's been cleaned up to
+	cleanOffset int64
+	// loaded is whether the clean offset's been read from the checkpoint
+	loaded bool
 }
 
 func NewCompactCleaner() *CompactCleaner {
 	return &CompactCleaner{
-		m: make(map[uint64]int64),
+		DeleteRetention:  -1,
+		MaxCompactionLag: -1,
 	}
 }
 
@@ -20,27 +68,181 @@ func (c *CompactCleaner) Clean(segments []*Segment) (cleaned []*Segment, err err
 		return segments, nil
 	}
 
-	var ss *SegmentScanner
-	var ms MessageSet
-	var offset int64
+	if !c.loaded {
+		c.loaded = true
+		c.cleanOffset = readCleanerCheckpoint(c.CheckpointPath)
+	}
+	// the log's been truncated or replaced since it was cleaned
+	if c.cleanOffset > segments[len(segments)-1].NextOffset {
+		c.cleanOffset = 0
+	}
+	now := time.Now()
+	if !c.cleanable(segments, now) {
+		return segments, nil
+	}
+	txns := readTransactions(segments)
 
-	// build the map of keys to their latest offsets
-	for _, segment := range segments {
-		ss = NewSegmentScanner(segment)
+	// each pass cleans the log with the keys of the next stretch of it
+	for start := int64(0); start >= 0; {
+		m, end, err := c.offsetMap(segments, start, txns)
+		if err != nil {
+			return nil, err
+		}
+		if segments, err = c.cleanSegments(segments, m, end, now, txns); err != nil {
+			return nil, err
+		}
+		start = end
+	}
 
-		for ms, err = ss.Scan(); err == nil; ms, err = ss.Scan() {
-			offset = ms.Offset()
+	c.cleanOffset = segments[len(segments)-1].NextOffset
+	if err := writeCleanerCheckpoint(c.CheckpointPath, c.cleanOffset); err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
+
+// readCleanerCheckpoint returns the clean offset in the checkpoint at the
+// path, or 0, i.e. the whole log's dirty, if there isn't a checkpoint or it's
+// corrupt.
+func readCleanerCheckpoint(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// writeCleanerCheckpoint writes the clean offset to the checkpoint at the path,
+// if it's set.
+func writeCleanerCheckpoint(path string, offset int64) error {
+	if path == "" {
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "write cleaner checkpoint failed")
+	}
+	return renameFile(tmp, path)
+}
+
+// transactions are the log's transaction markers in offset order. A
+// partition's only in one transaction at a time, so a transactional message's
+// in the transaction ended by the partition's next marker.
+type transactions []transactionMarker
+
+type transactionMarker struct {
+	offset int64
+	abort  bool
+}
+
+// readTransactions returns the segments' transaction markers.
+func readTransactions(segments []*Segment) transactions {
+	var txns transactions
+	for _, segment := range segments {
+		ss := NewSegmentScanner(segment)
+		for ms, err := ss.Scan(); err == nil; ms, err = ss.Scan() {
 			for _, msg := range ms.Messages() {
-				c.m[Hash(msg.Key())] = offset
+				if msg.Control() {
+					txns = append(txns, transactionMarker{offset: ms.Offset(), abort: msg.Aborts()})
+				}
 			}
 		}
 	}
+	return txns
+}
+
+// marker returns the marker ending the transaction of the transactional
+// message at the offset, or nil if the transaction's ongoing.
+func (t transactions) marker(offset int64) *transactionMarker {
+	i := sort.Search(len(t), func(i int) bool { return t[i].offset > offset })
+	if i == len(t) {
+		return nil
+	}
+	return &t[i]
+}
+
+// offsetMap maps the keys of the messages from the start offset on to their
+// latest offsets, up to as many keys as fit in the offset map's memory. It
+// returns the offset of the first message set that didn't fit, or -1 if the
+// rest of the log did. A message set's mapped whole, even if it alone doesn't
+// fit, so each pass gets further. Records of transactions that were aborted,
+// or haven't ended, aren't mapped since they mustn't replace their keys'
+// committed records.
+func (c *CompactCleaner) offsetMap(segments []*Segment, start int64, txns transactions) (map[uint64]int64, int64, error) {
+	var maxKeys int
+	if c.OffsetMapBytes > 0 {
+		maxKeys = int(c.OffsetMapBytes / offsetMapEntryBytes)
+	}
+	m := make(map[uint64]int64)
+	for i, segment := range segments {
+		if i+1 < len(segments) && segments[i+1].BaseOffset <= start {
+			// mapped in an earlier pass
+			continue
+		}
+		ss := NewSegmentScanner(segment)
+		for ms, err := ss.Scan(); err == nil; ms, err = ss.Scan() {
+			offset := ms.Offset()
+			if offset < start {
+				continue
+			}
+			msgs := ms.Messages()
+			if maxKeys > 0 && len(m) > 0 && len(m)+len(msgs) > maxKeys {
+				return m, offset, nil
+			}
+			for _, msg := range msgs {
+				// markers are kept with their transactions rather than by key
+				if msg.Control() {
+					continue
+				}
+				if msg.Transactional() {
+					if marker := txns.marker(offset); marker == nil || marker.abort {
+						continue
+					}
+				}
+				m[Hash(msg.Key())] = offset
+			}
+		}
+	}
+	return m, -1, nil
+}
+
+// cleanSegments rewrites the segments before the end offset, or all of them
+// if it's -1, without the messages whose keys have later offsets in the map,
+// without aborted transactions' records, and without the tombstones before
+// the end that are past the delete retention, or the markers whose
+// transactions have no records left. The tombstones and markers after the end
+// are kept until the pass that maps them, so their keys' older messages are
+// dropped before they are.
+func (c *CompactCleaner) cleanSegments(segments []*Segment, m map[uint64]int64, end int64, now time.Time, txns transactions) (cleaned []*Segment, err error) {
+	var ss *SegmentScanner
+	var ms MessageSet
+	var offset int64
+	// the offsets of the markers whose transactions have records left
+	covering := make(map[int64]bool)
 
 	// TODO: handle joining segments when they're smaller than max segment size
-	for _, ds := range segments {
+	for i, ds := range segments {
+		if end >= 0 && ds.BaseOffset >= end {
+			cleaned = append(cleaned, segments[i:]...)
+			break
+		}
 		ss = NewSegmentScanner(ds)
 
-		cs, err := NewSegment(ds.path, ds.BaseOffset, ds.maxBytes, cleanedSuffix)
+		// tombstones and markers age with their segment
+		var modified time.Time
+		if fi, err := os.Stat(ds.logPath()); err == nil {
+			modified = fi.ModTime()
+		}
+
+		cs, err := NewSegment(ds.path, ds.BaseOffset, ds.maxBytes, cleanedSuffix, ds.failpoints, ds.fds)
 		if err != nil {
 			return nil, err
 		}
@@ -49,9 +251,28 @@ func (c *CompactCleaner) Clean(segments []*Segment) (cleaned []*Segment, err err
 			var retain bool
 			offset = ms.Offset()
 			for _, msg := range ms.Messages() {
-				if c.m[Hash(msg.Key())] <= offset {
+				var marker *transactionMarker
+				if msg.Transactional() {
+					if marker = txns.marker(offset); marker != nil && marker.abort {
+						continue
+					}
+				}
+				if !msg.Control() && m[Hash(msg.Key())] > offset {
+					continue
+				}
+				if msg.Control() && covering[offset] {
 					retain = true
+					continue
 				}
+				if (msg.Control() || msg.Value() == nil) && c.DeleteRetention >= 0 && (end < 0 || offset < end) && !modified.IsZero() {
+					if now.Sub(modified) >= c.DeleteRetention {
+						continue
+					}
+				}
+				if marker != nil {
+					covering[marker.offset] = true
+				}
+				retain = true
 			}
 
 			if retain {
@@ -64,6 +285,12 @@ func (c *CompactCleaner) Clean(segments []*Segment) (cleaned []*Segment, err err
 		if err = cs.Replace(ds); err != nil {
 			return nil, err
 		}
+		// rewriting the segment doesn't make its tombstones younger
+		if !modified.IsZero() {
+			if err = os.Chtimes(cs.logPath(), modified, modified); err != nil {
+				return nil, err
+			}
+		}
 
 		cleaned = append(cleaned, cs)
 	}
@@ -71,6 +298,37 @@ func (c *CompactCleaner) Clean(segments []*Segment) (cleaned []*Segment, err err
 	return cleaned, nil
 }
 
+// cleanable returns whether the log's dirty ratio is at least the min
+// cleanable ratio or its oldest dirty message has waited the max compaction
+// lag. Segments are dirty if they have messages after the clean offset.
+func (c *CompactCleaner) cleanable(segments []*Segment, now time.Time) bool {
+	var total, dirty int64
+	var firstDirty *Segment
+	for _, s := range segments {
+		total += s.Position
+		if s.NextOffset > c.cleanOffset && s.Position > 0 {
+			dirty += s.Position
+			if firstDirty == nil {
+				firstDirty = s
+			}
+		}
+	}
+	if dirty == 0 {
+		return false
+	}
+	if float64(dirty)/float64(total) >= c.MinCleanableDirtyRatio {
+		return true
+	}
+	if c.MaxCompactionLag < 0 {
+		return false
+	}
+	fi, err := os.Stat(firstDirty.logPath())
+	if err != nil {
+		return false
+	}
+	return now.Sub(fi.ModTime()) >= c.MaxCompactionLag
+}
+
 func Hash(b []byte) uint64 {
 	h := xxhash.New()
 	if _, err := h.Write(b); err != nil {
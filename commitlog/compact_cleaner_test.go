@@ -1,8 +1,10 @@
 package commitlog_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -89,6 +91,11 @@ func TestCompactCleaner(t *testing.T) {
 	req.Equal(1, count)
 
 	scanner = commitlog.NewSegmentScanner(cleaned[1])
+	// again another's only record's kept, see TestSegmentBuildIndex
+	expected := []struct{ key, value string }{
+		{"travisjeffery", "two tj"},
+		{"again another", "again another"},
+	}
 	count = 0
 	for {
 		ms, err = scanner.Scan()
@@ -96,12 +103,246 @@ func TestCompactCleaner(t *testing.T) {
 			break
 		}
 		req.Equal(1, len(ms.Messages()))
-		req.Equal([]byte("travisjeffery"), ms.Messages()[0].Key())
-		req.Equal([]byte("two tj"), ms.Messages()[0].Value())
+		req.Equal([]byte(expected[count].key), ms.Messages()[0].Key())
+		req.Equal([]byte(expected[count].value), ms.Messages()[0].Value())
 		count++
 	}
-	req.Equal(1, count)
+	req.Equal(2, count)
+
+}
+
+func TestCompactCleanerTombstones(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "commitlog-compact-cleaner")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	// the tombstones' timestamps don't matter, only when their segments
+	// were written
+	old := time.Now().Add(-2 * time.Hour)
+	segments := newAgedSegments(t, path,
+		agedSegment{old, []*protocol.Message{
+			{Key: []byte("expired"), Value: []byte("v"), MagicByte: 1, Timestamp: time.Now()},
+			{Key: []byte("expired"), MagicByte: 1, Timestamp: time.Now()},
+			{Key: []byte("recent"), Value: []byte("v"), MagicByte: 1, Timestamp: old},
+		}},
+		agedSegment{time.Now(), []*protocol.Message{
+			{Key: []byte("recent"), MagicByte: 1, Timestamp: old},
+		}},
+	)
+
+	cc := commitlog.NewCompactCleaner()
+	cc.DeleteRetention = time.Hour
+	cleaned, err := cc.Clean(segments)
+	req.NoError(err)
+
+	// only the tombstone in the segment younger than the delete retention
+	// is left
+	req.Equal([]int64{3}, segmentOffsets(cleaned))
+
+	// cleaning keeps the time of the segment it rewrote
+	fi, err := os.Stat(filepath.Join(path, fmt.Sprintf("%020d%s", 0, commitlog.LogFileSuffix)))
+	req.NoError(err)
+	req.True(fi.ModTime().Sub(old) < time.Second)
+}
+
+func TestCompactCleanerControlMessages(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "commitlog-compact-cleaner")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	// control messages share a key, the marker's version and type
+	marker := []byte{0, 0, 0, 1}
+	old := time.Now().Add(-2 * time.Hour)
+	segments := newAgedSegments(t, path,
+		agedSegment{old, []*protocol.Message{
+			{Key: []byte("a"), Value: []byte("v"), MagicByte: 1, Timestamp: old},
+			{Key: marker, Value: []byte{}, Attributes: 0x20, MagicByte: 1, Timestamp: old},
+		}},
+		agedSegment{time.Now(), []*protocol.Message{
+			{Key: []byte("b"), Value: []byte("v"), MagicByte: 1, Timestamp: time.Now()},
+			{Key: marker, Value: []byte{}, Attributes: 0x20, MagicByte: 1, Timestamp: time.Now()},
+		}},
+	)
+
+	cc := commitlog.NewCompactCleaner()
+	cc.DeleteRetention = time.Hour
+	cleaned, err := cc.Clean(segments)
+	req.NoError(err)
+
+	// the expired marker's removed and the recent one isn't compacted away
+	req.Equal([]int64{0, 2, 3}, segmentOffsets(cleaned))
+}
+
+func TestCompactCleanerTransactions(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "commitlog-compact-cleaner")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	abort, commit := []byte{0, 0, 0, 0}, []byte{0, 0, 0, 1}
+	old := time.Now().Add(-2 * time.Hour)
+	segments := newAgedSegments(t, path,
+		agedSegment{old, []*protocol.Message{
+			// an aborted transaction
+			{Key: []byte("a"), Value: []byte("v"), Attributes: 0x10, MagicByte: 1, Timestamp: old},
+			{Key: abort, Value: []byte{}, Attributes: 0x20, MagicByte: 1, Timestamp: old},
+			// a committed transaction whose record's later replaced
+			{Key: []byte("b"), Value: []byte("v"), Attributes: 0x10, MagicByte: 1, Timestamp: old},
+			{Key: commit, Value: []byte{}, Attributes: 0x20, MagicByte: 1, Timestamp: old},
+			// a committed transaction whose record remains
+			{Key: []byte("c"), Value: []byte("v"), Attributes: 0x10, MagicByte: 1, Timestamp: old},
+			{Key: commit, Value: []byte{}, Attributes: 0x20, MagicByte: 1, Timestamp: old},
+			{Key: []byte("b"), Value: []byte("v"), MagicByte: 1, Timestamp: old},
+		}},
+		agedSegment{time.Now(), []*protocol.Message{
+			// an ongoing transaction that mustn't replace its key's record
+			{Key: []byte("c"), Value: []byte("v"), Attributes: 0x10, MagicByte: 1, Timestamp: time.Now()},
+		}},
+	)
+
+	cc := commitlog.NewCompactCleaner()
+	cc.DeleteRetention = time.Hour
+	cleaned, err := cc.Clean(segments)
+	req.NoError(err)
 
+	// the aborted records and the expired markers with no records left are
+	// removed, and the marker of the remaining record is kept
+	req.Equal([]int64{4, 5, 6, 7}, segmentOffsets(cleaned))
+}
+
+func TestCompactCleanerDirtyRatio(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "commitlog-compact-cleaner")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	old := time.Now().Add(-2 * time.Hour)
+	newSegment := func(baseOffset int64, keys ...string) *commitlog.Segment {
+		s, err := commitlog.NewSegment(path, baseOffset, 1000)
+		req.NoError(err)
+		for i, k := range keys {
+			_, err = s.Write(newMessageSet(uint64(baseOffset)+uint64(i), &protocol.Message{Key: []byte(k), Value: []byte("v"), MagicByte: 1, Timestamp: time.Now()}))
+			req.NoError(err)
+		}
+		req.NoError(s.BuildIndex())
+		req.NoError(os.Chtimes(filepath.Join(path, fmt.Sprintf("%020d%s", baseOffset, commitlog.LogFileSuffix)), old, old))
+		return s
+	}
+
+	cc := commitlog.NewCompactCleaner()
+	cc.MinCleanableDirtyRatio = 0.5
+	cc.CheckpointPath = filepath.Join(path, commitlog.CleanerCheckpointFile)
+	segments, err := cc.Clean([]*commitlog.Segment{newSegment(0, "a", "b", "c", "d")})
+	req.NoError(err)
+
+	// a log that's mostly clean is skipped, by a cleaner that's read how far
+	// it's clean from the checkpoint too
+	segments = append(segments, newSegment(4, "a"))
+	cleaned, err := cc.Clean(segments)
+	req.NoError(err)
+	req.True(cleaned[1] == segments[1])
+	restarted := commitlog.NewCompactCleaner()
+	restarted.MinCleanableDirtyRatio = 0.5
+	restarted.CheckpointPath = cc.CheckpointPath
+	cleaned, err = restarted.Clean(segments)
+	req.NoError(err)
+	req.True(cleaned[1] == segments[1])
+
+	// unless its dirty segment was written longer ago than the max
+	// compaction lag, however recent its messages' timestamps
+	cc.MaxCompactionLag = time.Hour
+	cleaned, err = cc.Clean(segments)
+	req.NoError(err)
+	req.False(cleaned[1] == segments[1])
+}
+
+func TestCompactCleanerOffsetMapBytes(t *testing.T) {
+	req := require.New(t)
+	old := time.Now().Add(-2 * time.Hour)
+	clean := func(offsetMapBytes int64) []int64 {
+		path, err := ioutil.TempDir("", "commitlog-compact-cleaner")
+		req.NoError(err)
+		defer os.RemoveAll(path)
+		var offset uint64
+		newSegment := func(keys ...string) *commitlog.Segment {
+			s, err := commitlog.NewSegment(path, int64(offset), 1000)
+			req.NoError(err)
+			for _, k := range keys {
+				msg := &protocol.Message{Key: []byte(k), Value: []byte("v"), MagicByte: 1, Timestamp: old}
+				if offset == 5 {
+					// b's tombstone, past the delete retention
+					msg.Value = nil
+				}
+				_, err = s.Write(newMessageSet(offset, msg))
+				req.NoError(err)
+				offset++
+			}
+			req.NoError(s.BuildIndex())
+			req.NoError(os.Chtimes(filepath.Join(path, fmt.Sprintf("%020d%s", s.BaseOffset, commitlog.LogFileSuffix)), old, old))
+			return s
+		}
+		segments := []*commitlog.Segment{newSegment("a", "b", "c"), newSegment("d", "a", "b", "c")}
+
+		cc := commitlog.NewCompactCleaner()
+		cc.DeleteRetention = time.Hour
+		cc.OffsetMapBytes = offsetMapBytes
+		cleaned, err := cc.Clean(segments)
+		req.NoError(err)
+		var offsets []int64
+		for _, s := range cleaned {
+			scanner := commitlog.NewSegmentScanner(s)
+			for ms, err := scanner.Scan(); err == nil; ms, err = scanner.Scan() {
+				offsets = append(offsets, ms.Offset())
+			}
+		}
+		return offsets
+	}
+
+	// a map with room for two keys cleans the log in passes to the same
+	// result, without the keys' older values or the tombstone's
+	req.Equal([]int64{3, 4, 6}, clean(0))
+	req.Equal([]int64{3, 4, 6}, clean(96))
+}
+
+// agedSegment is a segment's messages and when it was last written.
+type agedSegment struct {
+	modified time.Time
+	msgs     []*protocol.Message
+}
+
+// newAgedSegments writes the segments' messages to segments in the path, with
+// consecutive offsets, and sets their modification times.
+func newAgedSegments(t *testing.T, path string, segments ...agedSegment) []*commitlog.Segment {
+	var offset uint64
+	var out []*commitlog.Segment
+	for _, as := range segments {
+		s, err := commitlog.NewSegment(path, int64(offset), 1000)
+		require.NoError(t, err)
+		for _, msg := range as.msgs {
+			_, err = s.Write(newMessageSet(offset, msg))
+			require.NoError(t, err)
+			offset++
+		}
+		require.NoError(t, s.BuildIndex())
+		name := filepath.Join(path, fmt.Sprintf("%020d%s", s.BaseOffset, commitlog.LogFileSuffix))
+		require.NoError(t, os.Chtimes(name, as.modified, as.modified))
+		out = append(out, s)
+	}
+	return out
+}
+
+// segmentOffsets returns the offsets of the segments' message sets.
+func segmentOffsets(segments []*commitlog.Segment) []int64 {
+	var offsets []int64
+	for _, s := range segments {
+		scanner := commitlog.NewSegmentScanner(s)
+		for ms, err := scanner.Scan(); err == nil; ms, err = scanner.Scan() {
+			offsets = append(offsets, ms.Offset())
+		}
+	}
+	return offsets
 }
 
 func newMessageSet(offset uint64, pmsgs ...*protocol.Message) commitlog.MessageSet {
@@ -0,0 +1,108 @@
+package commitlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	snappy "github.com/eapache/go-xerial-snappy"
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+)
+
+// Compression codecs set in a message's attributes.
+const (
+	CompressionNone   = 0
+	CompressionGZIP   = 1
+	CompressionSnappy = 2
+	CompressionLZ4    = 3
+)
+
+// ErrDecompressedTooLarge is returned when a message decompresses to more than
+// the max bytes.
+var ErrDecompressedTooLarge = errors.New("decompressed message too large")
+
+// Codec returns the compression codec of the message's value.
+func (m Message) Codec() int8 {
+	return m.Attributes() & compressionCodecMask
+}
+
+// Decompress returns the message sets compressed in the message's value, or
+// nil if it isn't compressed.
+func (m Message) Decompress() ([]MessageSet, error) {
+	return m.DecompressLimit(-1)
+}
+
+// DecompressLimit is like Decompress but returns ErrDecompressedTooLarge
+// rather than decompress more than maxBytes, if it's positive, so a small
+// message can't decompress to take all the memory.
+func (m Message) DecompressLimit(maxBytes int64) ([]MessageSet, error) {
+	var b []byte
+	var err error
+	readAll := func(r io.Reader) ([]byte, error) {
+		if maxBytes > 0 {
+			r = io.LimitReader(r, maxBytes+1)
+		}
+		return ioutil.ReadAll(r)
+	}
+	switch m.Codec() {
+	case CompressionNone:
+		return nil, nil
+	case CompressionGZIP:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(m.Value())); err == nil {
+			b, err = readAll(r)
+		}
+	case CompressionSnappy:
+		b, err = snappy.Decode(m.Value())
+	case CompressionLZ4:
+		b, err = readAll(lz4.NewReader(bytes.NewReader(m.Value())))
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", m.Codec())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && int64(len(b)) > maxBytes {
+		return nil, ErrDecompressedTooLarge
+	}
+	sets := MessageSets(b)
+	for _, ms := range sets {
+		if !ms.Verify() {
+			return nil, fmt.Errorf("corrupt compressed message set")
+		}
+	}
+	return sets, nil
+}
+
+// Compress returns b, e.g. message sets, compressed with the codec.
+func Compress(codec int8, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch codec {
+	case CompressionNone:
+		return b, nil
+	case CompressionGZIP:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case CompressionSnappy:
+		return snappy.Encode(b), nil
+	case CompressionLZ4:
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression codec %d", codec)
+	}
+	return buf.Bytes(), nil
+}
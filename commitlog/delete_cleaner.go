@@ -1,5 +1,10 @@
 package commitlog
 
+import (
+	"os"
+	"time"
+)
+
 type Cleaner interface {
 	Clean([]*Segment) ([]*Segment, error)
 }
@@ -10,6 +15,10 @@ type Cleaner interface {
 type DeleteCleaner struct {
 	Retention struct {
 		Bytes int64
+		// Age is how long a segment's kept after its newest message was
+		// written. Segments are kept regardless of their age if it's zero or
+		// negative.
+		Age time.Duration
 	}
 }
 
@@ -20,6 +29,56 @@ func NewDeleteCleaner(bytes int64) *DeleteCleaner {
 }
 
 func (c *DeleteCleaner) Clean(segments []*Segment) ([]*Segment, error) {
+	segments, err := c.cleanAge(segments)
+	if err != nil {
+		return nil, err
+	}
+	return c.cleanBytes(segments)
+}
+
+// cleanAge deletes the segments older than the retention age, except for the
+// most recent segment.
+func (c *DeleteCleaner) cleanAge(segments []*Segment) ([]*Segment, error) {
+	if len(segments) == 0 || c.Retention.Age <= 0 {
+		return segments, nil
+	}
+	deadline := time.Now().Add(-c.Retention.Age)
+	var i int
+	for i = 0; i < len(segments)-1; i++ {
+		written, err := lastWritten(segments[i])
+		if err != nil {
+			return nil, err
+		}
+		if written.After(deadline) {
+			break
+		}
+		if err := segments[i].Delete(); err != nil {
+			return nil, err
+		}
+	}
+	return segments[i:], nil
+}
+
+// lastWritten returns when the segment's newest message was written. It uses
+// the messages' timestamps, from the segment's time index, since compaction
+// rewrites segments, and falls back to the file's mod time for v0 messages which
+// don't have one. Empty segments, e.g. ones that were compacted away, are as
+// old as can be.
+func lastWritten(s *Segment) (time.Time, error) {
+	if s.Position == 0 {
+		return time.Time{}, nil
+	}
+	if ts := s.MaxTimestamp(); ts >= 0 {
+		return time.Unix(0, ts*int64(time.Millisecond)), nil
+	}
+	fi, err := os.Stat(s.logPath())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (c *DeleteCleaner) cleanBytes(segments []*Segment) ([]*Segment, error) {
 	if len(segments) == 0 || c.Retention.Bytes == -1 {
 		return segments, nil
 	}
@@ -48,3 +107,20 @@ func (c *DeleteCleaner) Clean(segments []*Segment) ([]*Segment, error) {
 	}
 	return cleanedSegments, nil
 }
+
+// The compact delete cleaner implements the compact,delete cleanup policy
+// which compacts the log and then deletes its old segments, so records are
+// removed once they're past retention even if they're the latest for their key.
+
+type CompactDeleteCleaner struct {
+	Compact *CompactCleaner
+	Delete  *DeleteCleaner
+}
+
+func (c *CompactDeleteCleaner) Clean(segments []*Segment) ([]*Segment, error) {
+	segments, err := c.Compact.Clean(segments)
+	if err != nil {
+		return nil, err
+	}
+	return c.Delete.Clean(segments)
+}
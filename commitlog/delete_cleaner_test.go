@@ -96,3 +96,34 @@ func TestDeleteCleaner(t *testing.T) {
 	req.Equal(2, count)
 
 }
+
+func TestCompactDeleteCleaner(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "commitlog-compact-delete-cleaner")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	// the segment holding b's only record is past retention
+	old := time.Now().Add(-2 * time.Hour)
+	var segments []*commitlog.Segment
+	for i, msg := range []*protocol.Message{
+		{Key: []byte("a"), Value: []byte("v"), MagicByte: 1, Timestamp: old},
+		{Key: []byte("b"), Value: []byte("v"), MagicByte: 1, Timestamp: old},
+		{Key: []byte("a"), Value: []byte("v"), MagicByte: 1, Timestamp: time.Now()},
+	} {
+		s, err := commitlog.NewSegment(path, int64(i), 1000)
+		req.NoError(err)
+		_, err = s.Write(newMessageSet(uint64(i), msg))
+		req.NoError(err)
+		req.NoError(s.BuildIndex())
+		segments = append(segments, s)
+	}
+
+	cc := commitlog.NewCompactCleaner()
+	dc := commitlog.NewDeleteCleaner(-1)
+	dc.Retention.Age = time.Hour
+	cleaned, err := (&commitlog.CompactDeleteCleaner{Compact: cc, Delete: dc}).Clean(segments)
+	req.NoError(err)
+	req.Equal(1, len(cleaned))
+	req.Equal(int64(2), cleaned[0].BaseOffset)
+}
@@ -0,0 +1,78 @@
+package commitlog
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// timestampTypeMask is the bit of a v1 message's attributes set when its
+// timestamp is the log append time rather than the create time.
+const timestampTypeMask = 0x08
+
+// DownConvert returns the message set with its messages converted to the
+// message format version magic, for clients too old to decode newer ones, and
+// whether any needed converting. Converting v1 messages to v0 drops their
+// timestamps. Compressed messages have the messages compressed in them
+// converted and are recompressed with the same codec. Their inner message
+// sets take the set's offset, since the log gives each set one offset and old
+// clients read the inner offsets as the records' offsets.
+func (ms MessageSet) DownConvert(magic int8) (MessageSet, bool, error) {
+	if magic > 0 {
+		// v1 is the newest format the log stores
+		return ms, false, nil
+	}
+	if !ms.Verify() {
+		return nil, false, errors.New("corrupt message set")
+	}
+	msgs := ms.Messages()
+	converted := false
+	for i, m := range msgs {
+		if m.MagicByte() <= magic {
+			continue
+		}
+		converted = true
+		value := m.Value()
+		if m.Compressed() {
+			sets, err := m.Decompress()
+			if err != nil {
+				return nil, false, err
+			}
+			var b []byte
+			for _, inner := range sets {
+				c, _, err := inner.DownConvert(magic)
+				if err != nil {
+					return nil, false, err
+				}
+				c.PutOffset(ms.Offset())
+				b = append(b, c...)
+			}
+			if value, err = Compress(m.Codec(), b); err != nil {
+				return nil, false, err
+			}
+		}
+		msgs[i] = newMessageV0(m.Attributes()&^timestampTypeMask, m.Key(), value)
+	}
+	if !converted {
+		return ms, false, nil
+	}
+	return NewMessageSet(uint64(ms.Offset()), msgs...), true, nil
+}
+
+// newMessageV0 encodes a v0 message, i.e. one without a timestamp. Nil keys
+// and values are encoded as null.
+func newMessageV0(attributes int8, key, value []byte) Message {
+	m := make([]byte, 6, 6+4+len(key)+4+len(value))
+	m[5] = byte(attributes)
+	for _, b := range [][]byte{key, value} {
+		var size [4]byte
+		if b == nil {
+			Encoding.PutUint32(size[:], 0xffffffff)
+		} else {
+			Encoding.PutUint32(size[:], uint32(len(b)))
+		}
+		m = append(m, size[:]...)
+		m = append(m, b...)
+	}
+	Encoding.PutUint32(m, crc32.ChecksumIEEE(m[4:]))
+	return Message(m)
+}
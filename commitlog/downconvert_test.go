@@ -0,0 +1,67 @@
+package commitlog_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestDownConvert(t *testing.T) {
+	req := require.New(t)
+	ms := newMessageSet(7, &protocol.Message{
+		MagicByte: 1,
+		Timestamp: time.Unix(1, 0),
+		Key:       []byte("key"),
+		Value:     []byte("value"),
+	})
+
+	converted, ok, err := ms.DownConvert(0)
+	req.NoError(err)
+	req.True(ok)
+	req.True(converted.Verify())
+	req.Equal(int64(7), converted.Offset())
+	msgs := converted.Messages()
+	req.Equal(1, len(msgs))
+	req.Equal(int8(0), msgs[0].MagicByte())
+	req.Equal([]byte("key"), msgs[0].Key())
+	req.Equal([]byte("value"), msgs[0].Value())
+
+	// v0 sets and newer formats are left as they are
+	same, ok, err := converted.DownConvert(0)
+	req.NoError(err)
+	req.False(ok)
+	req.Equal(converted, same)
+	same, ok, err = ms.DownConvert(1)
+	req.NoError(err)
+	req.False(ok)
+	req.Equal(ms, same)
+}
+
+func TestDownConvert_Compressed(t *testing.T) {
+	req := require.New(t)
+	inner := newMessageSet(0, &protocol.Message{MagicByte: 1, Timestamp: time.Unix(1, 0), Value: []byte("value")})
+	value, err := commitlog.Compress(commitlog.CompressionGZIP, inner)
+	req.NoError(err)
+	ms := newMessageSet(3, &protocol.Message{
+		MagicByte:  1,
+		Attributes: commitlog.CompressionGZIP,
+		Timestamp:  time.Unix(1, 0),
+		Value:      value,
+	})
+
+	converted, ok, err := ms.DownConvert(0)
+	req.NoError(err)
+	req.True(ok)
+	wrapper := converted.Messages()[0]
+	req.Equal(int8(0), wrapper.MagicByte())
+	req.Equal(int8(commitlog.CompressionGZIP), wrapper.Codec())
+	sets, err := wrapper.Decompress()
+	req.NoError(err)
+	req.Equal(1, len(sets))
+	req.Equal(int64(3), sets[0].Offset())
+	req.Equal(int8(0), sets[0].Messages()[0].MagicByte())
+	req.Equal([]byte("value"), sets[0].Messages()[0].Value())
+}
@@ -0,0 +1,183 @@
+package commitlog
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrCrashed is returned by operations after a torn write fault simulated a crash.
+	ErrCrashed = errors.New("simulated crash")
+)
+
+// Failpoint identifies a storage operation faults can be injected into.
+type Failpoint string
+
+const (
+	// SegmentWriteFailpoint is hit when writing to a segment's log file.
+	SegmentWriteFailpoint Failpoint = "segment write"
+	// IndexWriteFailpoint is hit when writing an index entry.
+	IndexWriteFailpoint Failpoint = "index write"
+	// IndexSyncFailpoint is hit when syncing an index to disk.
+	IndexSyncFailpoint Failpoint = "index sync"
+	// SegmentSyncFailpoint is hit when syncing a segment's log file to disk.
+	SegmentSyncFailpoint Failpoint = "segment sync"
+	// SegmentReadFailpoint is hit when reading from a segment's log file. A
+	// simulated crash doesn't fail reads.
+	SegmentReadFailpoint Failpoint = "segment read"
+)
+
+// Fault describes how an operation misbehaves when its failpoint is hit.
+type Fault struct {
+	// Delay is how long to wait before running the operation.
+	Delay time.Duration
+	// Err is returned instead of running the operation.
+	Err error
+	// ShortWrite, if positive, limits the write to this many bytes and
+	// returns io.ErrShortWrite.
+	ShortWrite int
+	// TornWrite, if positive, writes this many bytes then simulates a crash:
+	// the write and every write after it returns ErrCrashed.
+	TornWrite int
+	// Count is the number of times the fault fires before it's disabled. Zero
+	// means it fires until disabled.
+	Count int
+}
+
+// Failpoints is a set of faults injected into the commit log's storage. It's
+// used by tests to verify recovery without needing real disk errors or power
+// loss. A nil *Failpoints injects nothing.
+type Failpoints struct {
+	mu      sync.Mutex
+	faults  map[Failpoint]*Fault
+	crashed bool
+}
+
+// NewFailpoints returns an empty set of failpoints.
+func NewFailpoints() *Failpoints {
+	return &Failpoints{faults: make(map[Failpoint]*Fault)}
+}
+
+// Enable sets the fault to inject when the failpoint is hit.
+func (f *Failpoints) Enable(fp Failpoint, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[fp] = &fault
+}
+
+// Disable removes the fault for the failpoint.
+func (f *Failpoints) Disable(fp Failpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.faults, fp)
+}
+
+// Reset removes all faults and clears a simulated crash.
+func (f *Failpoints) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[Failpoint]*Fault)
+	f.crashed = false
+}
+
+// Crashed returns true if a torn write has simulated a crash.
+func (f *Failpoints) Crashed() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// fault returns the fault to inject for the failpoint, if any.
+func (f *Failpoints) fault(fp Failpoint) (Fault, bool) {
+	if f == nil {
+		return Fault{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fault, ok := f.faults[fp]
+	if !ok {
+		return Fault{}, false
+	}
+	if fault.Count > 0 {
+		fault.Count--
+		if fault.Count == 0 {
+			delete(f.faults, fp)
+		}
+	}
+	return *fault, true
+}
+
+// write runs the write through the failpoint.
+func (f *Failpoints) write(fp Failpoint, p []byte, write func([]byte) (int, error)) (int, error) {
+	if f.Crashed() {
+		return 0, ErrCrashed
+	}
+	fault, ok := f.fault(fp)
+	if !ok {
+		return write(p)
+	}
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	if fault.Err != nil {
+		return 0, fault.Err
+	}
+	if fault.TornWrite > 0 && fault.TornWrite < len(p) {
+		n, err := write(p[:fault.TornWrite])
+		if err != nil {
+			return n, err
+		}
+		f.mu.Lock()
+		f.crashed = true
+		f.mu.Unlock()
+		return n, ErrCrashed
+	}
+	if fault.ShortWrite > 0 && fault.ShortWrite < len(p) {
+		n, err := write(p[:fault.ShortWrite])
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+	}
+	return write(p)
+}
+
+// do runs the operation through the failpoint.
+func (f *Failpoints) do(fp Failpoint, fn func() error) error {
+	if f.Crashed() {
+		return ErrCrashed
+	}
+	fault, ok := f.fault(fp)
+	if !ok {
+		return fn()
+	}
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	if fault.Err != nil {
+		return fault.Err
+	}
+	return fn()
+}
+
+// read runs the read through the failpoint. Only the fault's delay and error
+// apply to reads.
+func (f *Failpoints) read(fp Failpoint, fn func() error) error {
+	fault, ok := f.fault(fp)
+	if !ok {
+		return fn()
+	}
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	if fault.Err != nil {
+		return fault.Err
+	}
+	return fn()
+}
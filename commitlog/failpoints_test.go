@@ -0,0 +1,116 @@
+package commitlog_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+func TestFailpointsTornWriteRecovery(t *testing.T) {
+	fp := commitlog.NewFailpoints()
+	opts := commitlog.Options{
+		MaxSegmentBytes: 1000,
+		MaxLogBytes:     -1,
+		Failpoints:      fp,
+	}
+	l := setupWithOptions(t, opts)
+	defer cleanup(t, l)
+
+	for _, msgSet := range msgSets {
+		_, err := l.Append(msgSet)
+		require.NoError(t, err)
+	}
+
+	// crash half way through writing the next message set
+	fp.Enable(commitlog.SegmentWriteFailpoint, commitlog.Fault{TornWrite: 5})
+	_, err := l.Append(commitlog.NewMessageSet(0, msgs...))
+	require.Equal(t, commitlog.ErrCrashed, errors.Cause(err))
+	require.True(t, fp.Crashed())
+
+	_, err = l.Append(commitlog.NewMessageSet(0, msgs...))
+	require.Error(t, err)
+
+	// "restart" the broker and check the torn write was dropped
+	fp.Reset()
+	require.NoError(t, l.Close())
+	opts.Path = l.Path
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(msgSets)), l.NewestOffset())
+
+	exp := commitlog.NewMessageSet(0, msgs...)
+	offset, err := l.Append(exp)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(msgSets)), offset)
+
+	r, err := l.NewReader(0, exp.Size())
+	require.NoError(t, err)
+	for i := int64(0); i <= offset; i++ {
+		p := make([]byte, exp.Size())
+		_, err = io.ReadFull(r, p)
+		require.NoError(t, err)
+		act := commitlog.MessageSet(p)
+		require.Equal(t, i, act.Offset())
+		require.Equal(t, exp.Payload(), act.Payload())
+	}
+}
+
+func TestFailpointsShortWrite(t *testing.T) {
+	fp := commitlog.NewFailpoints()
+	l := setupWithOptions(t, commitlog.Options{
+		MaxSegmentBytes: 1000,
+		MaxLogBytes:     -1,
+		Failpoints:      fp,
+	})
+	defer cleanup(t, l)
+
+	fp.Enable(commitlog.SegmentWriteFailpoint, commitlog.Fault{ShortWrite: 1, Count: 1})
+	_, err := l.Append(msgSets[0])
+	require.Equal(t, io.ErrShortWrite, errors.Cause(err))
+	require.False(t, fp.Crashed())
+}
+
+func TestFailpointsSyncError(t *testing.T) {
+	fp := commitlog.NewFailpoints()
+	l := setupWithOptions(t, commitlog.Options{
+		MaxSegmentBytes: 1000,
+		MaxLogBytes:     -1,
+		Failpoints:      fp,
+	})
+	defer cleanup(t, l)
+
+	_, err := l.Append(msgSets[0])
+	require.NoError(t, err)
+
+	syncErr := errors.New("fsync failed")
+	fp.Enable(commitlog.IndexSyncFailpoint, commitlog.Fault{Err: syncErr, Count: 1})
+	require.Equal(t, syncErr, l.Close())
+}
+
+func TestFailpointsSyncFailsLog(t *testing.T) {
+	fp := commitlog.NewFailpoints()
+	l := setupWithOptions(t, commitlog.Options{
+		MaxSegmentBytes: 1000,
+		MaxLogBytes:     -1,
+		FlushMessages:   1,
+		Failpoints:      fp,
+	})
+	defer cleanup(t, l)
+
+	_, err := l.Append(msgSets[0])
+	require.NoError(t, err)
+	require.NoError(t, l.Failed())
+
+	fp.Enable(commitlog.SegmentSyncFailpoint, commitlog.Fault{Err: errors.New("input/output error")})
+	_, err = l.Append(msgSets[1])
+	require.Error(t, err)
+	require.Error(t, l.Failed())
+
+	// the log stays failed even once syncs work again
+	fp.Reset()
+	_, err = l.Append(msgSets[1])
+	require.Equal(t, commitlog.ErrLogFailed, errors.Cause(err))
+}
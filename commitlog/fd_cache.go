@@ -0,0 +1,84 @@
+package commitlog
+
+import (
+	"container/list"
+	"sync"
+)
+
+// FDCache limits how many segment log files are open at a time. Segments open
+// their log files when they're read or written and the cache closes the least
+// recently used ones past its limit, so a broker with many partitions and long
+// retention doesn't run out of file descriptors. It's shared by the logs it's
+// given to.
+type FDCache struct {
+	mu    sync.Mutex
+	limit int
+	lru   *list.List
+	open  map[*Segment]*list.Element
+}
+
+// NewFDCache returns a cache that keeps at most limit segment log files open.
+func NewFDCache(limit int) *FDCache {
+	return &FDCache{
+		limit: limit,
+		lru:   list.New(),
+		open:  make(map[*Segment]*list.Element),
+	}
+}
+
+// Len returns the number of segment log files open.
+func (c *FDCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// touch marks the segment's file as the most recently used and returns the
+// segments whose files should be closed to stay under the limit. The caller
+// closes them once it's released the segment's lock, so segments never wait on
+// each other's locks while holding their own.
+func (c *FDCache) touch(s *Segment) []*Segment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.open[s]; ok {
+		c.lru.MoveToFront(e)
+	} else {
+		c.open[s] = c.lru.PushFront(s)
+	}
+	var evicted []*Segment
+	for c.lru.Len() > c.limit {
+		e := c.lru.Back()
+		victim := e.Value.(*Segment)
+		if victim == s {
+			break
+		}
+		c.lru.Remove(e)
+		delete(c.open, victim)
+		evicted = append(evicted, victim)
+	}
+	return evicted
+}
+
+func (c *FDCache) isOpen(s *Segment) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.open[s]
+	return ok
+}
+
+// remove forgets the segment after its file's closed.
+func (c *FDCache) remove(s *Segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.open[s]; ok {
+		c.lru.Remove(e)
+		delete(c.open, s)
+	}
+}
+
+// release closes the log files of segments evicted from the cache.
+func release(segments []*Segment) {
+	for _, s := range segments {
+		s.releaseFile()
+	}
+}
@@ -0,0 +1,60 @@
+package commitlog_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+func TestFDCache(t *testing.T) {
+	req := require.New(t)
+	fds := commitlog.NewFDCache(2)
+	l := setupWithOptions(t, commitlog.Options{
+		MaxSegmentBytes: 6,
+		MaxLogBytes:     -1,
+		FDCache:         fds,
+	})
+	defer cleanup(t, l)
+
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(commitlog.NewMessageSet(uint64(i), msgs...))
+		req.NoError(err)
+		req.True(fds.Len() <= 2)
+	}
+	req.True(len(l.Segments()) > 2)
+
+	// segments whose files were closed are opened again to be read
+	maxBytes := msgSets[0].Size()
+	r, err := l.NewReader(0, maxBytes)
+	req.NoError(err)
+	for i := 0; i < 5; i++ {
+		p := make([]byte, maxBytes)
+		_, err = r.Read(p)
+		req.NoError(err)
+		req.Equal(int64(i), commitlog.MessageSet(p).Offset())
+		req.True(fds.Len() <= 2)
+	}
+	req.NoError(l.Close())
+	req.Equal(0, fds.Len())
+
+	// reopening the log only opens the active segment
+	fds = commitlog.NewFDCache(100)
+	l, err = commitlog.New(commitlog.Options{
+		Path:            l.Path,
+		MaxSegmentBytes: 6,
+		MaxLogBytes:     -1,
+		FDCache:         fds,
+	})
+	req.NoError(err)
+	req.Equal(1, fds.Len())
+	req.Equal(int64(5), l.NewestOffset())
+	r, err = l.NewReader(2, maxBytes)
+	req.NoError(err)
+	p := make([]byte, maxBytes)
+	_, err = r.Read(p)
+	req.NoError(err)
+	req.Equal(int64(2), commitlog.MessageSet(p).Offset())
+	req.Equal(2, fds.Len())
+	req.NoError(l.Close())
+}
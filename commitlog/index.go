@@ -8,8 +8,6 @@ import (
 	"sync"
 
 	"github.com/pkg/errors"
-
-	"github.com/tysontate/gommap"
 )
 
 var (
@@ -28,7 +26,7 @@ const (
 
 type Index struct {
 	options
-	mmap     gommap.MMap
+	mmap     fileMap
 	file     *os.File
 	mu       sync.RWMutex
 	position int64
@@ -61,6 +59,10 @@ type options struct {
 	path       string
 	bytes      int64
 	baseOffset int64
+	failpoints *Failpoints
+	// closeFile closes the index's file once it's mapped, so it doesn't hold
+	// a file descriptor.
+	closeFile bool
 }
 
 func NewIndex(opts options) (idx *Index, err error) {
@@ -87,10 +89,16 @@ func NewIndex(opts options) (idx *Index, err error) {
 		return nil, err
 	}
 
-	idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	idx.mmap, err = mapFile(idx.file)
 	if err != nil {
 		return nil, errors.Wrap(err, "mmap file failed")
 	}
+	if opts.closeFile {
+		if err := idx.file.Close(); err != nil {
+			return nil, errors.Wrap(err, "close file failed")
+		}
+		idx.file = nil
+	}
 	return idx, nil
 }
 
@@ -100,7 +108,12 @@ func (idx *Index) WriteEntry(entry Entry) (err error) {
 	if err = binary.Write(b, Encoding, relEntry); err != nil {
 		return errors.Wrap(err, "binary write failed")
 	}
-	idx.WriteAt(b.Bytes(), idx.position)
+	_, err = idx.failpoints.write(IndexWriteFailpoint, b.Bytes(), func(p []byte) (int, error) {
+		return idx.WriteAt(p, idx.position), nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "index write failed")
+	}
 	idx.mu.Lock()
 	idx.position += entryWidth
 	idx.mu.Unlock()
@@ -139,7 +152,7 @@ func (idx *Index) ReadAt(p []byte, offset int64) (n int, err error) {
 	if idx.position < offset+entryWidth {
 		return 0, io.EOF
 	}
-	n = copy(p, idx.mmap[offset:offset+entryWidth])
+	n = copy(p, idx.mmap.Bytes()[offset:offset+entryWidth])
 	return n, nil
 }
 
@@ -150,25 +163,32 @@ func (idx *Index) Write(p []byte) (n int, err error) {
 func (idx *Index) WriteAt(p []byte, offset int64) (n int) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
-	return copy(idx.mmap[offset:offset+entryWidth], p)
+	return copy(idx.mmap.Bytes()[offset:offset+entryWidth], p)
 }
 
 func (idx *Index) Sync() error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
-	if err := idx.file.Sync(); err != nil {
-		return errors.Wrap(err, "file sync failed")
-	}
-	if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
-		return errors.Wrap(err, "mmap sync failed")
-	}
-	return nil
+	return idx.failpoints.do(IndexSyncFailpoint, func() error {
+		if idx.file != nil {
+			if err := idx.file.Sync(); err != nil {
+				return errors.Wrap(err, "file sync failed")
+			}
+		}
+		if err := idx.mmap.Sync(); err != nil {
+			return errors.Wrap(err, "mmap sync failed")
+		}
+		return nil
+	})
 }
 
 func (idx *Index) Close() (err error) {
 	if err = idx.Sync(); err != nil {
 		return
 	}
+	if idx.file == nil {
+		return os.Truncate(idx.path, idx.position)
+	}
 	if err = idx.file.Truncate(idx.position); err != nil {
 		return
 	}
@@ -176,7 +196,7 @@ func (idx *Index) Close() (err error) {
 }
 
 func (idx *Index) Name() string {
-	return idx.file.Name()
+	return idx.path
 }
 
 func (idx *Index) TruncateEntries(number int) error {
@@ -0,0 +1,201 @@
+package commitlog
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestFile is the name of the file in a log's directory listing the sizes
+// and checksums of its rolled segments.
+const ManifestFile = "manifest"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// manifestEntry is a rolled segment's log file's size and CRC-32C.
+type manifestEntry struct {
+	baseOffset int64
+	size       int64
+	checksum   uint32
+}
+
+// SegmentMismatch is a rolled segment whose log file doesn't match the log's
+// manifest, e.g. because of bit rot or a partial restore.
+type SegmentMismatch struct {
+	BaseOffset int64
+	Reason     string
+}
+
+func (m SegmentMismatch) String() string {
+	return fmt.Sprintf("segment %d: %s", m.BaseOffset, m.Reason)
+}
+
+// loadManifest reads the manifest's entries for the log's segments so their
+// checksums aren't taken again, and overwritten, from files that may have
+// changed since.
+func (l *CommitLog) loadManifest() error {
+	entries, err := readManifest(l.Path)
+	if err != nil {
+		return err
+	}
+	byOffset := make(map[int64]manifestEntry, len(entries))
+	for _, e := range entries {
+		byOffset[e.baseOffset] = e
+	}
+	l.manifest = make(map[*Segment]manifestEntry)
+	for _, s := range l.segments {
+		if e, ok := byOffset[s.BaseOffset]; ok {
+			l.manifest[s] = e
+		}
+	}
+	return nil
+}
+
+// writeManifest lists the log's rolled segments in its manifest, taking the
+// checksums of those that are new or were rewritten by the cleaner. The log's
+// lock must be held.
+func (l *CommitLog) writeManifest() error {
+	if !l.Manifest || len(l.segments) == 0 {
+		return nil
+	}
+	manifest := make(map[*Segment]manifestEntry, len(l.segments))
+	entries := make([]manifestEntry, 0, len(l.segments)-1)
+	// the active segment's still being written to
+	for _, s := range l.segments[:len(l.segments)-1] {
+		e, ok := l.manifest[s]
+		if !ok {
+			var err error
+			if e, err = checksumSegment(s.logPath(), s.BaseOffset); err != nil {
+				return err
+			}
+		}
+		manifest[s] = e
+		entries = append(entries, e)
+	}
+	l.manifest = manifest
+
+	tmp := filepath.Join(l.Path, ManifestFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "create manifest failed")
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		fmt.Fprintf(w, fileFormat+" %d %08x\n", e.baseOffset, logSuffix, e.size, e.checksum)
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "write manifest failed")
+	}
+	return renameFile(tmp, filepath.Join(l.Path, ManifestFile))
+}
+
+// VerifyManifest checks the rolled segments of the log in the directory against
+// its manifest and returns those that are missing or whose size or checksum
+// differs. It returns none if the log has no manifest. The log doesn't need to
+// be open, so it works on backups too.
+func VerifyManifest(path string) ([]SegmentMismatch, error) {
+	entries, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []SegmentMismatch
+	for _, e := range entries {
+		name := filepath.Join(path, fmt.Sprintf(fileFormat, e.baseOffset, logSuffix))
+		actual, err := checksumSegment(name, e.baseOffset)
+		if os.IsNotExist(errors.Cause(err)) {
+			mismatches = append(mismatches, SegmentMismatch{BaseOffset: e.baseOffset, Reason: "missing"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case actual.size != e.size:
+			mismatches = append(mismatches, SegmentMismatch{
+				BaseOffset: e.baseOffset,
+				Reason:     fmt.Sprintf("size is %d bytes, manifest has %d", actual.size, e.size),
+			})
+		case actual.checksum != e.checksum:
+			mismatches = append(mismatches, SegmentMismatch{
+				BaseOffset: e.baseOffset,
+				Reason:     fmt.Sprintf("checksum is %08x, manifest has %08x", actual.checksum, e.checksum),
+			})
+		}
+	}
+	return mismatches, nil
+}
+
+// readManifest returns the entries of the manifest in the directory, or none if
+// there isn't one.
+func readManifest(path string) ([]manifestEntry, error) {
+	f, err := os.Open(filepath.Join(path, ManifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open manifest failed")
+	}
+	defer f.Close()
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e, err := parseManifestLine(scanner.Text())
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse manifest line %q failed", scanner.Text())
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read manifest failed")
+	}
+	return entries, nil
+}
+
+// parseManifestLine parses a line of the manifest: the segment's log file name,
+// its size, and its checksum in hex.
+func parseManifestLine(line string) (e manifestEntry, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasSuffix(fields[0], logSuffix) {
+		return e, errors.New("malformed line")
+	}
+	if e.baseOffset, err = strconv.ParseInt(strings.TrimSuffix(fields[0], logSuffix), 10, 64); err != nil {
+		return e, err
+	}
+	if e.size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return e, err
+	}
+	checksum, err := strconv.ParseUint(fields[2], 16, 32)
+	if err != nil {
+		return e, err
+	}
+	e.checksum = uint32(checksum)
+	return e, nil
+}
+
+func checksumSegment(name string, baseOffset int64) (manifestEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return manifestEntry{}, errors.Wrap(err, "open segment failed")
+	}
+	defer f.Close()
+	h := crc32.New(castagnoli)
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return manifestEntry{}, errors.Wrap(err, "read segment failed")
+	}
+	return manifestEntry{baseOffset: baseOffset, size: n, checksum: h.Sum32()}, nil
+}
@@ -0,0 +1,58 @@
+package commitlog_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+func TestManifest(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "manifest")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: int64(msgSets[0].Size()),
+		MaxLogBytes:     -1,
+		Manifest:        true,
+	})
+	req.NoError(err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(commitlog.NewMessageSet(0, msgs...))
+		req.NoError(err)
+	}
+	req.NoError(l.Close())
+
+	mismatches, err := commitlog.VerifyManifest(path)
+	req.NoError(err)
+	req.Empty(mismatches)
+
+	first := filepath.Join(path, "00000000000000000000.log")
+	b, err := ioutil.ReadFile(first)
+	req.NoError(err)
+	b[len(b)-1] ^= 0xff
+	req.NoError(ioutil.WriteFile(first, b, 0644))
+	req.NoError(os.Remove(filepath.Join(path, "00000000000000000001.log")))
+
+	mismatches, err = commitlog.VerifyManifest(path)
+	req.NoError(err)
+	req.Equal(2, len(mismatches))
+	req.Equal(int64(0), mismatches[0].BaseOffset)
+	req.Contains(mismatches[0].Reason, "checksum")
+	req.Equal(int64(1), mismatches[1].BaseOffset)
+	req.Equal("missing", mismatches[1].Reason)
+}
+
+func TestVerifyManifest_NoManifest(t *testing.T) {
+	l := setup(t)
+	defer cleanup(t, l)
+	mismatches, err := commitlog.VerifyManifest(l.Path)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
@@ -1,5 +1,18 @@
 package commitlog
 
+// compressionCodecMask is the bits of a message's attributes holding its
+// compression codec.
+const compressionCodecMask = 0x07
+
+// controlAttributeMask is the bit of a message's attributes set on control
+// messages, i.e. the markers committing or aborting a transaction, like the
+// control bit of a batch's attributes in newer message formats.
+const controlAttributeMask = 0x20
+
+// transactionalAttributeMask is the bit of a message's attributes set on
+// messages produced in a transaction.
+const transactionalAttributeMask = 0x10
+
 type Message []byte
 
 func NewMessage(p []byte) Message {
@@ -25,6 +38,31 @@ func (m Message) Timestamp() int64 {
 	return int64(Encoding.Uint64(m[6:]))
 }
 
+// Compressed returns whether the message's value is a compressed message set.
+func (m Message) Compressed() bool {
+	return m.Attributes()&compressionCodecMask != 0
+}
+
+// Control returns whether the message is a transaction marker rather than a
+// record.
+func (m Message) Control() bool {
+	return m.Attributes()&controlAttributeMask != 0
+}
+
+// Aborts returns whether the message is a marker aborting its transaction.
+// A marker's key is its control record, its version and then its type, which
+// is 0 for an abort.
+func (m Message) Aborts() bool {
+	key := m.Key()
+	return m.Control() && len(key) >= 4 && Encoding.Uint16(key[2:4]) == 0
+}
+
+// Transactional returns whether the message was produced in a transaction, so
+// it's only read by read_committed consumers once its transaction's committed.
+func (m Message) Transactional() bool {
+	return m.Attributes()&transactionalAttributeMask != 0
+}
+
 func (m Message) Key() []byte {
 	start, end, size := m.keyOffsets()
 	if size == -1 {
@@ -66,7 +104,11 @@ func (m Message) keyOffsets() (start, end, size int32) {
 		start = 14
 	}
 	size = int32(Encoding.Uint32(m[start:]))
-	end = start + 4 + size
+	end = start + 4
+	if size > 0 {
+		// null is a size of -1 and takes no bytes
+		end += size
+	}
 	return
 }
 
@@ -74,6 +116,10 @@ func (m Message) valueOffsets() (start, end, size int32) {
 	_, keyEnd, _ := m.keyOffsets()
 	start = keyEnd
 	size = int32(Encoding.Uint32(m[start:]))
-	end = start + 4 + size
+	end = start + 4
+	if size > 0 {
+		// null is a size of -1 and takes no bytes
+		end += size
+	}
 	return
 }
@@ -1,11 +1,23 @@
 package commitlog
 
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
 const (
 	offsetPos       = 0
 	sizePos         = 8
 	msgSetHeaderLen = 12
 )
 
+// ErrMessageSetCorrupt is returned reading a message set whose size is less
+// than its header.
+var ErrMessageSetCorrupt = errors.New("corrupt message set size")
+
 type MessageSet []byte
 
 func NewMessageSet(offset uint64, msgs ...Message) MessageSet {
@@ -20,6 +32,48 @@ func NewMessageSet(offset uint64, msgs ...Message) MessageSet {
 	return ms
 }
 
+// MessageSets splits b, e.g. a fetched record set, into its message sets. A
+// partial message set at the end, like one cut off by a fetch's max bytes, is
+// dropped, as is the rest of b from a set whose size is corrupt.
+func MessageSets(b []byte) (sets []MessageSet) {
+	for len(b) >= msgSetHeaderLen {
+		ms := MessageSet(b)
+		// the size wraps around to less than the header for sizes that
+		// don't fit in an int32
+		size := int(ms.Size())
+		if size < msgSetHeaderLen || size > len(b) {
+			break
+		}
+		sets = append(sets, ms[:size])
+		b = b[size:]
+	}
+	return sets
+}
+
+// ReadMessageSet reads the next message set from r. The set isn't allocated up
+// front from its size, which may be torn or corrupt, but grown as it's read. It
+// returns io.EOF if r's at its end, io.ErrUnexpectedEOF if r ends partway
+// through the set, and ErrMessageSetCorrupt if its size is less than its
+// header.
+func ReadMessageSet(r io.Reader) (MessageSet, error) {
+	header := make([]byte, msgSetHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := int64(MessageSet(header).Size())
+	if size < msgSetHeaderLen {
+		return nil, ErrMessageSetCorrupt
+	}
+	buf := bytes.NewBuffer(header)
+	if n, err := io.CopyN(buf, r, size-msgSetHeaderLen); err != nil {
+		if err == io.EOF && n < size-msgSetHeaderLen {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (ms MessageSet) Offset() int64 {
 	return int64(Encoding.Uint64(ms[offsetPos : offsetPos+8]))
 }
@@ -36,17 +90,93 @@ func (ms MessageSet) Payload() []byte {
 	return ms[msgSetHeaderLen:]
 }
 
+// Verify returns whether the message set's messages are whole and match their
+// CRCs. It's safe to call on a set that may be corrupt.
+func (ms MessageSet) Verify() bool {
+	return ms.walk(func(m Message) bool {
+		return crc32.ChecksumIEEE(m[4:]) == uint32(m.Crc())
+	})
+}
+
+// MaxTimestamp returns the greatest timestamp of the set's messages. It returns
+// false if the messages are v0, which don't have timestamps, or the set's
+// corrupt.
+func (ms MessageSet) MaxTimestamp() (int64, bool) {
+	max, ok := int64(-1), false
+	valid := ms.walk(func(m Message) bool {
+		if m.MagicByte() > 0 {
+			ok = true
+			if ts := m.Timestamp(); ts > max {
+				max = ts
+			}
+		}
+		return true
+	})
+	return max, ok && valid
+}
+
+// walk calls fn with each of the set's messages until it returns false. Unlike
+// Messages it doesn't trust the sizes in the set, so it's safe to call on a set
+// that may be corrupt. It returns false if the set's corrupt or fn returned
+// false.
+func (ms MessageSet) walk(fn func(Message) bool) bool {
+	if len(ms) < msgSetHeaderLen || int64(len(ms)) != int64(ms.Size()) {
+		return false
+	}
+	return walkMessages(ms.Payload(), fn)
+}
+
+// walkMessages calls fn with each of the whole messages in b until it returns
+// false. It returns false if b ends in a partial message or fn returned false.
+func walkMessages(b []byte, fn func(Message) bool) bool {
+	for len(b) > 0 {
+		// crc, magic byte, attributes
+		n := 6
+		if len(b) < n {
+			return false
+		}
+		if Message(b).MagicByte() > 0 {
+			n += 8
+		}
+		// key and value
+		for i := 0; i < 2; i++ {
+			if len(b) < n+4 {
+				return false
+			}
+			size := int32(Encoding.Uint32(b[n:]))
+			n += 4
+			if size == -1 {
+				continue
+			}
+			if size < 0 || len(b)-n < int(size) {
+				return false
+			}
+			n += int(size)
+		}
+		if !fn(Message(b[:n])) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// Messages returns the set's messages. A set that's cut short, e.g. by a
+// fetch's max bytes, returns the messages before the one that's cut off.
 func (ms MessageSet) Messages() (msgs []Message) {
-	var offset int32
-	var msg Message
-	b := ms.Payload()
-	payloadSize := int32(len(b))
-	for offset < payloadSize {
-		msg = NewMessage(b)
-		offset = msg.Size()
-		msgs = append(msgs, NewMessage(b[:offset]))
-		b = b[offset:]
-		offset += offset
+	if len(ms) < msgSetHeaderLen {
+		return nil
+	}
+	size := int64(ms.Size())
+	if size < msgSetHeaderLen {
+		return nil
+	}
+	if size < int64(len(ms)) {
+		ms = ms[:size]
 	}
+	walkMessages(ms.Payload(), func(m Message) bool {
+		msgs = append(msgs, m)
+		return true
+	})
 	return msgs
 }
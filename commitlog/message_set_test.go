@@ -1,6 +1,9 @@
 package commitlog_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -33,3 +36,51 @@ func TestMessages(t *testing.T) {
 	req.Equal(commitlog.Message(emptyMessage), msgs[0])
 	req.Equal(commitlog.Message(emptyV1Message), msgs[1])
 }
+
+func TestMessagesPartial(t *testing.T) {
+	req := require.New(t)
+	ms := commitlog.NewMessageSet(1, emptyMessage, emptyV1Message)
+	// cut off in the second message, and in the first's header
+	msgs := ms[:len(ms)-3].Messages()
+	req.Equal([]commitlog.Message{commitlog.Message(emptyMessage)}, msgs)
+	req.Empty(ms[:15].Messages())
+	req.Empty(ms[:5].Messages())
+}
+
+func TestMessageSetsCorruptSize(t *testing.T) {
+	req := require.New(t)
+	ms := commitlog.NewMessageSet(1, emptyMessage)
+	for _, size := range []uint32{0xFFFFFFF4, 0x80000000} {
+		corrupt := append(commitlog.MessageSet(nil), ms...)
+		binary.BigEndian.PutUint32(corrupt[8:12], size)
+		// the sets before the corrupt one are kept
+		sets := commitlog.MessageSets(append(append([]byte(nil), ms...), corrupt...))
+		req.Equal([]commitlog.MessageSet{ms}, sets, "size %#x", size)
+		req.Empty(corrupt.Messages(), "size %#x", size)
+	}
+}
+
+func TestReadMessageSet(t *testing.T) {
+	req := require.New(t)
+	ms := commitlog.NewMessageSet(1, emptyMessage)
+	r := bytes.NewReader(append(append([]byte(nil), ms...), ms[:len(ms)-1]...))
+	read, err := commitlog.ReadMessageSet(r)
+	req.NoError(err)
+	req.Equal(ms, read)
+	_, err = commitlog.ReadMessageSet(r)
+	req.Equal(io.ErrUnexpectedEOF, err)
+	_, err = commitlog.ReadMessageSet(r)
+	req.Equal(io.EOF, err)
+
+	// a corrupt size isn't allocated
+	for _, size := range []uint32{0xFFFFFFF4, 0x80000000, 0x7FFFFFF0} {
+		corrupt := append(commitlog.MessageSet(nil), ms...)
+		binary.BigEndian.PutUint32(corrupt[8:12], size)
+		_, err := commitlog.ReadMessageSet(bytes.NewReader(corrupt))
+		if size == 0x7FFFFFF0 {
+			req.Equal(io.ErrUnexpectedEOF, err)
+		} else {
+			req.Equal(commitlog.ErrMessageSetCorrupt, err)
+		}
+	}
+}
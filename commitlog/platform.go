@@ -0,0 +1,94 @@
+package commitlog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The commit log's file handling goes through the functions here since
+// platforms differ in what they let the broker do with files that are open.
+// Unix systems delete and rename over open and mapped files, sync directories
+// so renames and new files survive a crash, and map indexes into memory.
+// Windows does none of those: files that are still open are renamed to be
+// deleted when the log's next opened, renames are retried while other
+// processes (e.g. virus scanners and indexers) briefly hold files open,
+// directory syncs are skipped since NTFS journals its metadata, and indexes
+// are read into memory and written back when they're synced. Fetches are
+// served from memory with vectored writes rather than sendfile, so they need
+// nothing here.
+
+const (
+	// deletedFileSuffix is the suffix of files renamed to be deleted later.
+	deletedFileSuffix = ".deleted"
+
+	renameAttempts = 5
+	renameBackoff  = 10 * time.Millisecond
+)
+
+// removeFile deletes the file, or if the platform can't delete it while it's
+// open, renames it to be deleted when the log's next opened.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if err == nil || os.IsNotExist(err) || !fileInUse(err) {
+		return err
+	}
+	if rerr := renameFile(path, path+deletedFileSuffix); rerr != nil {
+		return err
+	}
+	return nil
+}
+
+// renameFile renames the file, replacing the file at the new path if there is
+// one, and syncs the directory so the rename survives a crash.
+func renameFile(from, to string) (err error) {
+	for i := 0; i < renameAttempts; i++ {
+		if err = os.Rename(from, to); err == nil || !fileInUse(err) {
+			break
+		}
+		time.Sleep(renameBackoff << uint(i))
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(to))
+}
+
+// removeDeletedFiles deletes the files in the dir that were renamed to be
+// deleted later.
+func removeDeletedFiles(dir string, names []string) error {
+	for _, name := range names {
+		if !strings.HasSuffix(name, deletedFileSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// errno returns the system error underlying the file operation's error, or 0.
+func errno(err error) syscall.Errno {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if en, ok := err.(syscall.Errno); ok {
+		return en
+	}
+	return 0
+}
+
+// fileMap is a file's contents mapped into memory, with changes to them
+// written to the file when it's synced.
+type fileMap interface {
+	Bytes() []byte
+	Sync() error
+}
@@ -0,0 +1,36 @@
+package commitlog_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+func TestOpenRemovesDeletedAndOrphanedFiles(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "platform")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	deleted := filepath.Join(path, "00000000000000000005.log.deleted")
+	orphan := filepath.Join(path, "00000000000000000009.index")
+	req.NoError(ioutil.WriteFile(deleted, []byte("stale"), 0644))
+	req.NoError(ioutil.WriteFile(orphan, make([]byte, 8), 0644))
+
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+	})
+	req.NoError(err)
+	defer l.Close()
+
+	_, err = os.Stat(deleted)
+	req.True(os.IsNotExist(err))
+	_, err = os.Stat(orphan)
+	req.True(os.IsNotExist(err))
+}
@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package commitlog
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/tysontate/gommap"
+)
+
+func fileInUse(err error) bool {
+	return false
+}
+
+// syncDir fsyncs the dir so the files created, renamed, and deleted in it
+// survive a crash. Filesystems that can't sync directories are left as is.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if en := errno(err); en == syscall.EINVAL || en == syscall.ENOTSUP {
+		return nil
+	}
+	return err
+}
+
+// mappedFile is a file mapped with mmap.
+type mappedFile struct {
+	mmap gommap.MMap
+}
+
+func mapFile(f *os.File) (fileMap, error) {
+	mmap, err := gommap.Map(f.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{mmap: mmap}, nil
+}
+
+func (m *mappedFile) Bytes() []byte {
+	return m.mmap
+}
+
+func (m *mappedFile) Sync() error {
+	return m.mmap.Sync(gommap.MS_SYNC)
+}
@@ -0,0 +1,69 @@
+//go:build windows
+// +build windows
+
+package commitlog
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	errorAccessDenied     syscall.Errno = 5
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// fileInUse returns whether the error's from a file being open somewhere,
+// which stops it being deleted or renamed over on Windows.
+func fileInUse(err error) bool {
+	switch errno(err) {
+	case errorAccessDenied, errorSharingViolation, errorLockViolation:
+		return true
+	}
+	return false
+}
+
+// syncDir does nothing, directories can't be opened to sync them on Windows
+// and NTFS journals the changes to them.
+func syncDir(dir string) error {
+	return nil
+}
+
+// memoryFile is a file read into memory, since mapping it would stop it being
+// renamed or deleted while it's mapped. It's written back when it's synced.
+type memoryFile struct {
+	path string
+	b    []byte
+}
+
+func mapFile(f *os.File) (fileMap, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, fi.Size())
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &memoryFile{path: f.Name(), b: b}, nil
+}
+
+func (m *memoryFile) Bytes() []byte {
+	return m.b
+}
+
+func (m *memoryFile) Sync() error {
+	f, err := os.OpenFile(m.path, os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(m.b, 0); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
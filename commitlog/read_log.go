@@ -0,0 +1,86 @@
+package commitlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ReadLog calls fn with each of the message sets in the segments of the log in
+// the directory, in order, until it returns an error. Like CheckLog it doesn't
+// open the log, which would rebuild its indexes and truncate a torn write, so
+// it leaves the files as they are and works on a copy of a running broker's
+// log. A segment's read up to a message set that's torn, e.g. because it's
+// still being written.
+func ReadLog(path string, fn func(MessageSet) error) error {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return errors.Wrap(err, "read dir failed")
+	}
+	var baseOffsets []int64
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), LogFileSuffix) {
+			continue
+		}
+		baseOffset, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), LogFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, baseOffset)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+	for _, baseOffset := range baseOffsets {
+		if err := readSegmentLog(filepath.Join(path, fmt.Sprintf(fileFormat, baseOffset, logSuffix)), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegmentLog calls fn with each of the whole message sets in the segment's
+// log file.
+func readSegmentLog(name string, fn func(MessageSet) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "open segment failed")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat segment failed")
+	}
+	r := bufio.NewReader(f)
+	header := make([]byte, msgSetHeaderLen)
+	for position := int64(0); ; {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "read segment failed")
+		}
+		// a torn size isn't trusted to allocate the set, one that's smaller
+		// than the header or past the end of the file is read as the tail
+		size := int64(MessageSet(header).Size())
+		if size < msgSetHeaderLen || position+size > fi.Size() {
+			return nil
+		}
+		position += size
+		ms := make(MessageSet, size)
+		copy(ms, header)
+		if _, err := io.ReadFull(r, ms[msgSetHeaderLen:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "read segment failed")
+		}
+		if err := fn(ms); err != nil {
+			return err
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -20,43 +22,168 @@ const (
 )
 
 type Segment struct {
-	writer     io.Writer
-	reader     io.Reader
-	log        *os.File
+	// log is the segment's log file. With an FD cache it's opened when it's
+	// used and nil once the cache has it closed.
+	log    *os.File
+	fds    *FDCache
+	closed bool
+	// Index is nil until it's first read if the segment was opened lazily,
+	// indexMu guards setting it up.
 	Index      *Index
+	indexMu    sync.Mutex
 	BaseOffset int64
 	NextOffset int64
 	Position   int64
 	maxBytes   int64
 	path       string
 	suffix     string
+	failpoints *Failpoints
+	// created is when the segment was created or, for an existing segment,
+	// opened. Time-based rolling's measured from it.
+	created time.Time
+	// timeIndex maps timestamps to the first message set at or after them. It
+	// only has an entry for a message set whose timestamp is greater than every
+	// earlier one in the segment, so it's sorted even if timestamps are out of
+	// order.
+	timeIndex []timeEntry
+	// id identifies the segment among every segment opened by the process.
+	// A segment's written only by appending, and replaced rather than
+	// rewritten, so an offset in the segment always has the same message set.
+	id uint64
 
 	sync.Mutex
 }
 
+// segmentIDs is the last ID given to a segment.
+var segmentIDs uint64
+
+type timeEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
 func NewSegment(path string, baseOffset, maxBytes int64, args ...interface{}) (*Segment, error) {
-	var suffix string
-	if len(args) != 0 {
-		suffix = args[0].(string)
-	}
 	s := &Segment{
 		maxBytes:   maxBytes,
 		BaseOffset: baseOffset,
 		NextOffset: baseOffset,
 		path:       path,
-		suffix:     suffix,
+		created:    time.Now(),
+		id:         atomic.AddUint64(&segmentIDs, 1),
+	}
+	for _, arg := range args {
+		switch a := arg.(type) {
+		case string:
+			s.suffix = a
+		case *Failpoints:
+			s.failpoints = a
+		case *FDCache:
+			s.fds = a
+		}
 	}
 	log, err := os.OpenFile(s.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, errors.Wrap(err, "open file failed")
 	}
 	s.log = log
-	s.writer = log
-	s.reader = log
 	err = s.SetupIndex()
 	return s, err
 }
 
+// openSegment returns an existing rolled segment without opening its files, so
+// opening a log with many segments doesn't open all of them. Its size is its log
+// file's, its next offset and time index are read from its time index file,
+// and its index is set up when it's first read. If the time index file's
+// missing or corrupt the segment's opened now like NewSegment.
+func openSegment(path string, baseOffset, maxBytes int64, failpoints *Failpoints, fds *FDCache) (*Segment, error) {
+	s := &Segment{
+		maxBytes:   maxBytes,
+		BaseOffset: baseOffset,
+		NextOffset: baseOffset,
+		path:       path,
+		failpoints: failpoints,
+		fds:        fds,
+		created:    time.Now(),
+		id:         atomic.AddUint64(&segmentIDs, 1),
+	}
+	fi, err := os.Stat(s.logPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "stat file failed")
+	}
+	indexed := s.loadTimeIndex()
+	if indexed == baseOffset && fi.Size() > 0 {
+		return NewSegment(path, baseOffset, maxBytes, failpoints, fds)
+	}
+	s.NextOffset = indexed
+	s.Position = fi.Size()
+	return s, nil
+}
+
+// index returns the segment's index, setting it up if the segment was opened
+// lazily.
+func (s *Segment) index() (*Index, error) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.Index != nil {
+		return s.Index, nil
+	}
+	s.Lock()
+	closed := s.closed
+	s.Unlock()
+	if closed {
+		return nil, os.ErrClosed
+	}
+	if err := s.SetupIndex(); err != nil {
+		return nil, err
+	}
+	return s.Index, nil
+}
+
+// withFile calls fn with the segment's log file, opening it if the FD cache
+// closed it, while holding the segment's lock.
+func (s *Segment) withFile(fn func(f *os.File) error) error {
+	s.Lock()
+	evicted, err := s.openFile()
+	if err == nil {
+		err = fn(s.log)
+	}
+	s.Unlock()
+	release(evicted)
+	return err
+}
+
+// openFile opens the log file if it isn't open and marks it used in the FD
+// cache, returning the segments whose files the cache evicted. The segment's
+// lock must be held.
+func (s *Segment) openFile() ([]*Segment, error) {
+	if s.closed {
+		return nil, os.ErrClosed
+	}
+	if s.log == nil {
+		log, err := os.OpenFile(s.logPath(), os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, errors.Wrap(err, "open file failed")
+		}
+		s.log = log
+	}
+	if s.fds == nil {
+		return nil, nil
+	}
+	return s.fds.touch(s), nil
+}
+
+// releaseFile closes the log file after the FD cache evicted it, unless it's
+// been used again since.
+func (s *Segment) releaseFile() {
+	s.Lock()
+	defer s.Unlock()
+	if s.log == nil || s.fds.isOpen(s) {
+		return
+	}
+	s.log.Close()
+	s.log = nil
+}
+
 // SetupIndex creates and initializes an Index.
 // Initialization is:
 // - Sanity check of the loaded Index
@@ -66,6 +193,10 @@ func (s *Segment) SetupIndex() (err error) {
 	s.Index, err = NewIndex(options{
 		path:       s.indexPath(),
 		baseOffset: s.BaseOffset,
+		failpoints: s.failpoints,
+		// the index is read and written through its mapping so its file's
+		// only needed when it's closed
+		closeFile: s.fds != nil,
 	})
 	if err != nil {
 		return err
@@ -80,8 +211,28 @@ func (s *Segment) BuildIndex() (err error) {
 	if err := s.Index.TruncateEntries(0); err != nil {
 		return err
 	}
+	s.Lock()
+	indexed := s.loadTimeIndex()
+	s.Unlock()
+	err = s.withFile(func(log *os.File) error {
+		return s.buildIndex(log, indexed)
+	})
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	// drop what the log no longer has, e.g. after it's been recovered
+	for n := len(s.timeIndex); n > 0 && s.timeIndex[n-1].Offset >= s.NextOffset; n-- {
+		s.timeIndex = s.timeIndex[:n-1]
+	}
+	return s.saveTimeIndex()
+}
 
-	_, err = s.log.Seek(0, 0)
+// buildIndex indexes the log's message sets. Only the message sets from the
+// indexed offset on are added to the time index, it has the ones before.
+func (s *Segment) buildIndex(log *os.File, indexed int64) (err error) {
+	_, err = log.Seek(0, 0)
 	if err != nil {
 		return err
 	}
@@ -94,27 +245,34 @@ func (s *Segment) BuildIndex() (err error) {
 loop:
 	for {
 		// get offset and size
-		_, err = io.CopyN(b, s.log, 8)
+		_, err = io.CopyN(b, log, 8)
 		if err != nil {
 			break loop
 		}
 
-		_, err = io.CopyN(b, s.log, 4)
+		_, err = io.CopyN(b, log, 4)
 		if err != nil {
 			break loop
 		}
+		offset := int64(Encoding.Uint64(b.Bytes()[0:8]))
 		size := int64(Encoding.Uint32(b.Bytes()[8:12]))
 
-		_, err = io.CopyN(b, s.log, size)
+		_, err = io.CopyN(b, log, size)
 		if err != nil {
 			break loop
 		}
 
+		if offset >= indexed {
+			s.indexTime(offset, MessageSet(b.Bytes()))
+		}
+
 		// Reset the buffer to not get an overflow
 		b.Truncate(0)
 
+		// compacted segments have gaps in their offsets, so index the
+		// message set's own offset rather than counting them
 		entry := Entry{
-			Offset:   nextOffset,
+			Offset:   offset,
 			Position: position,
 		}
 		err = s.Index.WriteEntry(entry)
@@ -123,14 +281,14 @@ loop:
 		}
 
 		position += size + msgSetHeaderLen
-		nextOffset++
-
-		_, err = s.log.Seek(size, 1)
-		if err != nil {
-			break loop
-		}
+		nextOffset = offset + 1
 	}
 	if err == io.EOF {
+		// drop any partially written message left over from a crash so new
+		// writes start at the end of the last complete message.
+		if err = log.Truncate(position); err != nil {
+			return errors.Wrap(err, "truncate file failed")
+		}
 		s.NextOffset = nextOffset
 		s.Position = position
 		return nil
@@ -138,42 +296,187 @@ loop:
 	return err
 }
 
+// Recover verifies the segment's message sets and truncates it at the first
+// one that's corrupt. It returns whether the segment was truncated.
+func (s *Segment) Recover() (bool, error) {
+	idx, err := s.index()
+	if err != nil {
+		return false, err
+	}
+	is := NewIndexScanner(idx)
+	for {
+		entry, err := is.Scan()
+		if err != nil {
+			return false, nil
+		}
+		if s.verifyAt(entry.Position) {
+			continue
+		}
+		err = s.withFile(func(f *os.File) error {
+			return f.Truncate(entry.Position)
+		})
+		if err != nil {
+			return false, errors.Wrap(err, "truncate file failed")
+		}
+		return true, s.BuildIndex()
+	}
+}
+
+// verifyAt returns whether the message set at the position is whole and valid.
+func (s *Segment) verifyAt(position int64) bool {
+	header := make(MessageSet, msgSetHeaderLen)
+	if _, err := s.ReadAt(header, position); err != nil {
+		return false
+	}
+	size := int64(header.Size())
+	if size < msgSetHeaderLen || position+size > s.Position {
+		return false
+	}
+	ms := make(MessageSet, size)
+	if _, err := s.ReadAt(ms, position); err != nil {
+		return false
+	}
+	return ms.Verify()
+}
+
 func (s *Segment) IsFull() bool {
 	s.Lock()
 	defer s.Unlock()
 	return s.Position >= s.maxBytes
 }
 
+// IsExpired returns whether the segment has messages and is at least the given
+// age, so should be rolled.
+func (s *Segment) IsExpired(age time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.Position > 0 && time.Since(s.created) >= age
+}
+
 // Write writes a byte slice to the log at the current position.
 // It increments the offset as well as sets the position to the new tail.
 func (s *Segment) Write(p []byte) (n int, err error) {
+	err = s.withFile(func(f *os.File) error {
+		n, err = s.failpoints.write(SegmentWriteFailpoint, p, f.Write)
+		if err != nil {
+			return errors.Wrap(err, "log write failed")
+		}
+		offset := MessageSet(p).Offset()
+		s.indexTime(offset, MessageSet(p))
+		s.NextOffset = offset + 1
+		s.Position += int64(n)
+		return nil
+	})
+	return n, err
+}
+
+// nextOffset returns the offset the segment's next message set is written at.
+// Unlike reading NextOffset it's safe while the segment's being written.
+func (s *Segment) nextOffset() int64 {
 	s.Lock()
 	defer s.Unlock()
-	n, err = s.writer.Write(p)
-	if err != nil {
-		return n, errors.Wrap(err, "log write failed")
+	return s.NextOffset
+}
+
+// indexTime adds the message set at the offset to the time index if its
+// timestamp's greater than the segment's max timestamp. Sets with timestamps
+// earlier than one before them aren't indexed, so the index stays sorted
+// however out of order producers' timestamps are.
+func (s *Segment) indexTime(offset int64, ms MessageSet) {
+	ts, ok := ms.MaxTimestamp()
+	if !ok || ts < 0 {
+		return
+	}
+	if n := len(s.timeIndex); n > 0 && ts <= s.timeIndex[n-1].Timestamp {
+		return
 	}
-	s.NextOffset++
-	s.Position += int64(n)
-	return n, nil
+	s.timeIndex = append(s.timeIndex, timeEntry{Timestamp: ts, Offset: offset})
 }
 
-func (s *Segment) Read(p []byte) (n int, err error) {
+// MaxTimestamp returns the greatest timestamp of the segment's messages, or -1
+// if the segment's empty or its messages don't have timestamps.
+func (s *Segment) MaxTimestamp() int64 {
 	s.Lock()
 	defer s.Unlock()
-	return s.reader.Read(p)
+	if n := len(s.timeIndex); n > 0 {
+		return s.timeIndex[n-1].Timestamp
+	}
+	return -1
 }
 
-func (s *Segment) ReadAt(p []byte, off int64) (n int, err error) {
+// findTime returns the first message set in the segment whose timestamp is
+// greater than or equal to the given timestamp.
+func (s *Segment) findTime(ts int64) (timeEntry, bool) {
 	s.Lock()
 	defer s.Unlock()
-	return s.log.ReadAt(p, off)
+	i := sort.Search(len(s.timeIndex), func(i int) bool {
+		return s.timeIndex[i].Timestamp >= ts
+	})
+	if i == len(s.timeIndex) {
+		return timeEntry{}, false
+	}
+	return s.timeIndex[i], true
+}
+
+// Sync flushes the segment's log file and index to disk.
+func (s *Segment) Sync() error {
+	err := s.withFile(func(f *os.File) error {
+		return s.failpoints.do(SegmentSyncFailpoint, f.Sync)
+	})
+	if err != nil {
+		return errors.Wrap(err, "log sync failed")
+	}
+	idx, err := s.index()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	err = s.saveTimeIndex()
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	return idx.Sync()
+}
+
+func (s *Segment) Read(p []byte) (n int, err error) {
+	err = s.withFile(func(f *os.File) error {
+		n, err = f.Read(p)
+		return err
+	})
+	return n, err
+}
+
+func (s *Segment) ReadAt(p []byte, off int64) (n int, err error) {
+	err = s.withFile(func(f *os.File) error {
+		return s.failpoints.read(SegmentReadFailpoint, func() error {
+			n, err = f.ReadAt(p, off)
+			return err
+		})
+	})
+	return n, err
 }
 
 func (s *Segment) Close() error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
 	s.Lock()
 	defer s.Unlock()
-	if err := s.log.Close(); err != nil {
+	s.closed = true
+	if s.fds != nil {
+		s.fds.remove(s)
+	}
+	if s.log != nil {
+		if err := s.log.Close(); err != nil {
+			return err
+		}
+		s.log = nil
+	}
+	if s.Index == nil {
+		// opened lazily and never read, so there's nothing to save
+		return nil
+	}
+	if err := s.saveTimeIndex(); err != nil {
 		return err
 	}
 	return s.Index.Close()
@@ -181,7 +484,7 @@ func (s *Segment) Close() error {
 
 // Cleaner creates a cleaner segment for this segment.
 func (s *Segment) Cleaner() (*Segment, error) {
-	return NewSegment(s.path, s.BaseOffset, s.maxBytes, cleanedSuffix)
+	return NewSegment(s.path, s.BaseOffset, s.maxBytes, cleanedSuffix, s.failpoints, s.fds)
 }
 
 // Replace replaces the given segment with the callee.
@@ -192,37 +495,48 @@ func (s *Segment) Replace(old *Segment) (err error) {
 	if err = s.Close(); err != nil {
 		return err
 	}
-	if err = os.Rename(s.logPath(), old.logPath()); err != nil {
+	if err = renameFile(s.logPath(), old.logPath()); err != nil {
 		return err
 	}
-	if err = os.Rename(s.indexPath(), old.indexPath()); err != nil {
+	if err = renameFile(s.indexPath(), old.indexPath()); err != nil {
 		return err
 	}
-	s.suffix = ""
-	log, err := os.OpenFile(s.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return errors.Wrap(err, "open file failed")
+	if err = renameFile(s.timeIndexPath(), old.timeIndexPath()); err != nil {
+		return err
 	}
-	s.log = log
-	s.writer = log
-	s.reader = log
+	s.suffix = ""
+	s.Lock()
+	s.closed = false
+	s.Unlock()
 	return s.SetupIndex()
 }
 
 // findEntry returns the nearest entry whose offset is greater than or equal to the given offset.
 func (s *Segment) findEntry(offset int64) (e *Entry, err error) {
+	idx, err := s.index()
+	if err != nil {
+		return nil, err
+	}
 	s.Lock()
 	defer s.Unlock()
 	e = &Entry{}
-	n := int(s.Index.bytes / entryWidth)
-	idx := sort.Search(n, func(i int) bool {
-		_ = s.Index.ReadEntryAtFileOffset(e, int64(i*entryWidth))
-		return e.Offset >= offset || e.Offset == 0
+	// only the written entries are searched, the rest of the index is zeroed
+	// and their offsets would be the base offset
+	idx.mu.Lock()
+	n := int(idx.position / entryWidth)
+	idx.mu.Unlock()
+	i := sort.Search(n, func(i int) bool {
+		_ = idx.ReadEntryAtFileOffset(e, int64(i*entryWidth))
+		return e.Offset >= offset
 	})
-	if idx == n {
-		return nil, errors.New("entry not found")
+	if i == n {
+		if offset > s.NextOffset {
+			return nil, errors.New("entry not found")
+		}
+		// the offset's the next to be written, there's nothing to read yet
+		return &Entry{Offset: s.NextOffset, Position: s.Position}, nil
 	}
-	_ = s.Index.ReadEntryAtFileOffset(e, int64(idx*entryWidth))
+	_ = idx.ReadEntryAtFileOffset(e, int64(i*entryWidth))
 	return e, nil
 }
 
@@ -233,13 +547,13 @@ func (s *Segment) Delete() error {
 	}
 	s.Lock()
 	defer s.Unlock()
-	if err := os.Remove(s.log.Name()); err != nil {
+	if err := removeFile(s.logPath()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.Index.Name()); err != nil {
+	if err := removeFile(s.indexPath()); err != nil {
 		return err
 	}
-	return nil
+	return removeFile(s.timeIndexPath())
 }
 
 type SegmentScanner struct {
@@ -248,12 +562,19 @@ type SegmentScanner struct {
 }
 
 func NewSegmentScanner(segment *Segment) *SegmentScanner {
-	return &SegmentScanner{s: segment, is: NewIndexScanner(segment.Index)}
+	return &SegmentScanner{s: segment}
 }
 
 // Scan should be called repeatedly to iterate over the messages in the segment, it will return
 // io.EOF when there are no more messages.
 func (s *SegmentScanner) Scan() (ms MessageSet, err error) {
+	if s.is == nil {
+		idx, err := s.s.index()
+		if err != nil {
+			return nil, err
+		}
+		s.is = NewIndexScanner(idx)
+	}
 	entry, err := s.is.Scan()
 	if err != nil {
 		return nil, err
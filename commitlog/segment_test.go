@@ -1,6 +1,8 @@
 package commitlog_test
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -29,3 +31,50 @@ func TestSegmentScanner(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, msgSets[0], ms)
 }
+
+func TestSegmentBuildIndexWithGaps(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "segment")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	// a compacted segment that only kept offset 1
+	s, err := commitlog.NewSegment(path, 0, 1000)
+	req.NoError(err)
+	_, err = s.Write(commitlog.NewMessageSet(1, []byte("kept")))
+	req.NoError(err)
+	req.NoError(s.Close())
+
+	s, err = commitlog.NewSegment(path, 0, 1000)
+	req.NoError(err)
+	defer s.Close()
+	req.Equal(int64(2), s.NextOffset)
+}
+
+func TestSegmentBuildIndex(t *testing.T) {
+	req := require.New(t)
+	path, err := ioutil.TempDir("", "segment")
+	req.NoError(err)
+	defer os.RemoveAll(path)
+
+	s, err := commitlog.NewSegment(path, 0, 1000)
+	req.NoError(err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Write(commitlog.NewMessageSet(uint64(i), []byte("v")))
+		req.NoError(err)
+	}
+	req.NoError(s.Close())
+
+	// every message set's indexed when the segment's reopened, not every
+	// other one, which is what lost records when compaction replaced segments
+	s, err = commitlog.NewSegment(path, 0, 1000)
+	req.NoError(err)
+	defer s.Close()
+	req.Equal(int64(3), s.NextOffset)
+	scanner := commitlog.NewSegmentScanner(s)
+	for i := int64(0); i < 3; i++ {
+		ms, err := scanner.Scan()
+		req.NoError(err)
+		req.Equal(i, ms.Offset())
+	}
+}
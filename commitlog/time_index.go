@@ -0,0 +1,77 @@
+package commitlog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// timeIndexSuffix is the suffix of a segment's time index file.
+const timeIndexSuffix = ".timeindex"
+
+// The time index file is the offset the segment's indexed up to followed by
+// its entries, each a timestamp and an offset. It's written when the segment's
+// synced or closed, so the message sets appended since it was last written are
+// indexed from the log when the segment's opened again.
+const timeEntryWidth = 16
+
+func (s *Segment) timeIndexPath() string {
+	return filepath.Join(s.path, fmt.Sprintf(fileFormat, s.BaseOffset, timeIndexSuffix+s.suffix))
+}
+
+// loadTimeIndex reads the segment's time index file and returns the offset
+// it's indexed up to. If there's no file or it's corrupt the segment's
+// indexed from its base offset.
+func (s *Segment) loadTimeIndex() int64 {
+	s.timeIndex = nil
+	p, err := ioutil.ReadFile(s.timeIndexPath())
+	if err != nil || len(p) < 8 || (len(p)-8)%timeEntryWidth != 0 {
+		return s.BaseOffset
+	}
+	indexed := int64(Encoding.Uint64(p))
+	var entries []timeEntry
+	for b := p[8:]; len(b) > 0; b = b[timeEntryWidth:] {
+		e := timeEntry{
+			Timestamp: int64(Encoding.Uint64(b)),
+			Offset:    int64(Encoding.Uint64(b[8:])),
+		}
+		if e.Offset < s.BaseOffset || e.Offset >= indexed {
+			return s.BaseOffset
+		}
+		if n := len(entries); n > 0 && (e.Timestamp <= entries[n-1].Timestamp || e.Offset <= entries[n-1].Offset) {
+			return s.BaseOffset
+		}
+		entries = append(entries, e)
+	}
+	s.timeIndex = entries
+	return indexed
+}
+
+// saveTimeIndex writes the segment's time index file. The segment's lock must
+// be held.
+func (s *Segment) saveTimeIndex() error {
+	b := new(bytes.Buffer)
+	p := make([]byte, timeEntryWidth)
+	Encoding.PutUint64(p, uint64(s.NextOffset))
+	b.Write(p[:8])
+	for _, e := range s.timeIndex {
+		Encoding.PutUint64(p, uint64(e.Timestamp))
+		Encoding.PutUint64(p[8:], uint64(e.Offset))
+		b.Write(p)
+	}
+	// it's written to a temp file and renamed so a crash doesn't leave half
+	// of it
+	tmp := s.timeIndexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0666); err != nil {
+		return errors.Wrap(err, "write time index failed")
+	}
+	if err := renameFile(tmp, s.timeIndexPath()); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "rename time index failed")
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// OffsetReset is where a consumer instance starts reading a partition.
+type OffsetReset string
+
+const (
+	// Earliest starts from the partition's oldest offset.
+	Earliest OffsetReset = "earliest"
+	// Latest starts from the end of the partition.
+	Latest OffsetReset = "latest"
+)
+
+// CreateConsumerRequest is the body of a create consumer instance request.
+type CreateConsumerRequest struct {
+	// AutoOffsetReset defaults to Latest.
+	AutoOffsetReset OffsetReset `json:"auto_offset_reset"`
+	// StartTimestamp, if set, starts the instance at each partition's first
+	// record at or after the timestamp, in milliseconds since the epoch,
+	// rather than by AutoOffsetReset.
+	StartTimestamp *int64 `json:"start_timestamp,omitempty"`
+}
+
+// CreateConsumerResponse is the body of a create consumer instance response.
+type CreateConsumerResponse struct {
+	InstanceID string `json:"instance_id"`
+	BaseURI    string `json:"base_uri"`
+}
+
+// TopicPartition identifies a partition.
+type TopicPartition struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+}
+
+// AssignRequest is the body of an assign partitions request. It replaces the
+// consumer instance's current assignment.
+type AssignRequest struct {
+	Partitions []TopicPartition `json:"partitions"`
+}
+
+// Record is a consumed record.
+type Record struct {
+	Topic     string  `json:"topic"`
+	Partition int32   `json:"partition"`
+	Offset    int64   `json:"offset"`
+	Timestamp *int64  `json:"timestamp,omitempty"`
+	Key       *string `json:"key"`
+	Value     *string `json:"value"`
+}
+
+// ConsumeResponse is the body of a consume records response.
+type ConsumeResponse struct {
+	Records []Record `json:"records"`
+}
+
+// consumer is a consumer instance. It reads from the partitions assigned to it
+// and tracks how far it's read in each of them.
+type consumer struct {
+	mu          sync.Mutex
+	id          string
+	group       string
+	offsetReset OffsetReset
+	// startTimestamp is the timestamp to start at, or -1 to start by the
+	// offset reset.
+	startTimestamp int64
+	positions      map[TopicPartition]int64
+	lastUsed       time.Time
+}
+
+func (g *Gateway) handleCreateConsumer(w http.ResponseWriter, r *http.Request, group string) {
+	var req CreateConsumerRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	switch req.AutoOffsetReset {
+	case "":
+		req.AutoOffsetReset = Latest
+	case Earliest, Latest:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid auto_offset_reset: %s", req.AutoOffsetReset))
+		return
+	}
+	startTimestamp := int64(-1)
+	if req.StartTimestamp != nil {
+		if *req.StartTimestamp < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid start_timestamp: %d", *req.StartTimestamp))
+			return
+		}
+		startTimestamp = *req.StartTimestamp
+	}
+
+	g.mu.Lock()
+	g.nextID++
+	c := &consumer{
+		id:             fmt.Sprintf("%s-%d", group, g.nextID),
+		group:          group,
+		offsetReset:    req.AutoOffsetReset,
+		startTimestamp: startTimestamp,
+		positions:      make(map[TopicPartition]int64),
+		lastUsed:       time.Now(),
+	}
+	g.consumers[c.id] = c
+	g.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, CreateConsumerResponse{
+		InstanceID: c.id,
+		BaseURI:    fmt.Sprintf("/consumers/%s/instances/%s", group, c.id),
+	})
+}
+
+func (g *Gateway) handleAssign(w http.ResponseWriter, r *http.Request, c *consumer) {
+	var req AssignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	positions := make(map[TopicPartition]int64, len(req.Partitions))
+	for _, tp := range req.Partitions {
+		if offset, ok := c.positions[tp]; ok {
+			positions[tp] = offset
+			continue
+		}
+		offset, err := g.startOffset(tp, c.offsetReset, c.startTimestamp)
+		if err != nil {
+			writeError(w, statusCode(err), err)
+			return
+		}
+		positions[tp] = offset
+	}
+	c.positions = positions
+	c.lastUsed = time.Now()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) handleConsume(w http.ResponseWriter, r *http.Request, c *consumer) {
+	maxBytes := int32(defaultMaxBytes)
+	if v := r.URL.Query().Get("max_bytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid max_bytes: %s", v))
+			return
+		}
+		maxBytes = int32(n)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := ConsumeResponse{Records: []Record{}}
+	for tp, offset := range c.positions {
+		var fres *protocol.FetchResponse
+		err := g.withLeader(tp.Topic, tp.Partition, func(conn Client) (err error) {
+			fres, err = conn.Fetch(&protocol.FetchRequest{
+				MaxWaitTime: fetchMaxWait,
+				MinBytes:    1,
+				MaxBytes:    maxBytes,
+				Topics: []*protocol.FetchTopic{{
+					Topic: tp.Topic,
+					Partitions: []*protocol.FetchPartition{{
+						Partition:   tp.Partition,
+						FetchOffset: offset,
+						MaxBytes:    maxBytes,
+					}},
+				}},
+			})
+			return err
+		})
+		if err != nil {
+			writeError(w, statusCode(err), err)
+			return
+		}
+		for _, tr := range fres.Responses {
+			for _, pr := range tr.PartitionResponses {
+				if pr.ErrorCode != protocol.ErrNone.Code() {
+					writeError(w, http.StatusInternalServerError, protocol.Errs[pr.ErrorCode])
+					return
+				}
+				records, err := decodeRecords(tp, offset, pr.RecordSet)
+				if err != nil {
+					writeError(w, statusCode(err), err)
+					return
+				}
+				if len(records) > 0 {
+					c.positions[tp] = records[len(records)-1].Offset + 1
+				}
+				res.Records = append(res.Records, records...)
+			}
+		}
+	}
+	c.lastUsed = time.Now()
+	writeJSON(w, http.StatusOK, res)
+}
+
+// startOffset returns the offset to start reading the partition from: its first
+// record at or after the start timestamp, if it isn't -1, or the end of the
+// partition if there isn't one, otherwise the offset reset's.
+func (g *Gateway) startOffset(tp TopicPartition, reset OffsetReset, startTimestamp int64) (int64, error) {
+	if startTimestamp >= 0 {
+		offset, err := g.offsetForTimestamp(tp, startTimestamp)
+		if err != nil || offset >= 0 {
+			return offset, err
+		}
+		reset = Latest
+	}
+	timestamp := int64(-1)
+	if reset == Earliest {
+		timestamp = -2
+	}
+	return g.offsetForTimestamp(tp, timestamp)
+}
+
+// offsetForTimestamp asks the partition's leader for the offset of its first
+// record at or after the timestamp, or -1 if there isn't one. The timestamp
+// can also be -1 for the end of the partition or -2 for its oldest offset.
+func (g *Gateway) offsetForTimestamp(tp TopicPartition, timestamp int64) (int64, error) {
+	var res *protocol.OffsetsResponse
+	err := g.withLeader(tp.Topic, tp.Partition, func(c Client) (err error) {
+		res, err = c.Offsets(&protocol.OffsetsRequest{
+			Topics: []*protocol.OffsetsTopic{{
+				Topic:      tp.Topic,
+				Partitions: []*protocol.OffsetsPartition{{Partition: tp.Partition, Timestamp: timestamp, MaxNumOffsets: 1}},
+			}},
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range res.Responses {
+		for _, p := range r.PartitionResponses {
+			if p.ErrorCode != protocol.ErrNone.Code() {
+				return 0, protocol.Errs[p.ErrorCode]
+			}
+			if len(p.Offsets) > 0 {
+				return p.Offsets[0], nil
+			}
+		}
+	}
+	return 0, protocol.ErrUnknownTopicOrPartition
+}
+
+func (g *Gateway) consumer(group, id string) *consumer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.consumers[id]
+	if !ok || c.group != group {
+		return nil
+	}
+	return c
+}
+
+func (g *Gateway) removeConsumer(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.consumers, id)
+}
+
+// reapConsumers removes consumer instances that haven't been used within the
+// instance timeout.
+func (g *Gateway) reapConsumers() {
+	ticker := time.NewTicker(g.config.InstanceTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.shutdownCh:
+			return
+		case now := <-ticker.C:
+			// consumers hold their lock while talking to brokers, which takes
+			// the gateway's lock, so don't hold both here.
+			g.mu.Lock()
+			consumers := make([]*consumer, 0, len(g.consumers))
+			for _, c := range g.consumers {
+				consumers = append(consumers, c)
+			}
+			g.mu.Unlock()
+			for _, c := range consumers {
+				c.mu.Lock()
+				idle := now.Sub(c.lastUsed) > g.config.InstanceTimeout
+				c.mu.Unlock()
+				if idle {
+					g.removeConsumer(c.id)
+				}
+			}
+		}
+	}
+}
+
+// encodeRecords encodes the records into a message set to produce.
+func encodeRecords(records []ProduceRecord, now time.Time) ([]byte, error) {
+	msgs := make([]commitlog.Message, 0, len(records))
+	for _, r := range records {
+		m := &protocol.Message{MagicByte: 1, Timestamp: now}
+		if r.Key != nil {
+			m.Key = []byte(*r.Key)
+		}
+		if r.Value != nil {
+			m.Value = []byte(*r.Value)
+		}
+		b, err := protocol.Encode(m)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, b)
+	}
+	return commitlog.NewMessageSet(0, msgs...), nil
+}
+
+// decodeRecords decodes the message sets in a record set fetched from the
+// offset. It errors if a message set's corrupt, or if the record set's only
+// part of one, e.g. because the set's bigger than the fetch's max bytes, as
+// the instance would never move past it otherwise.
+func decodeRecords(tp TopicPartition, offset int64, recordSet []byte) ([]Record, error) {
+	sets := commitlog.MessageSets(recordSet)
+	if len(sets) == 0 && len(recordSet) > 0 {
+		return nil, protocol.ErrMessageTooLarge.WithErr(fmt.Errorf("record set fetched from offset %d is part of a message set, fetch with a greater max_bytes than %d", offset, len(recordSet)))
+	}
+	var records []Record
+	for _, ms := range sets {
+		if !ms.Verify() {
+			return nil, protocol.ErrCorruptMessage
+		}
+		for _, m := range ms.Messages() {
+			r := Record{
+				Topic:     tp.Topic,
+				Partition: tp.Partition,
+				Offset:    ms.Offset(),
+				Key:       nullableString(m.Key()),
+				Value:     nullableString(m.Value()),
+			}
+			if m.MagicByte() > 0 {
+				ts := m.Timestamp()
+				r.Timestamp = &ts
+			}
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func nullableString(b []byte) *string {
+	if b == nil {
+		return nil
+	}
+	s := string(b)
+	return &s
+}
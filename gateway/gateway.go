@@ -0,0 +1,322 @@
+// Package gateway is an HTTP gateway for producing to and fetching from a
+// Jocko cluster, for languages and tools without a Kafka client.
+//
+// Records are produced with:
+//
+//	POST /topics/{topic}/partitions/{partition}/records
+//
+// and consumed through consumer instances, which track their position in each
+// assigned partition:
+//
+//	POST   /consumers/{group}/instances
+//	POST   /consumers/{group}/instances/{instance}/assignments
+//	GET    /consumers/{group}/instances/{instance}/records
+//	DELETE /consumers/{group}/instances/{instance}
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	defaultInstanceTimeout = 5 * time.Minute
+	defaultMaxBytes        = 1 << 20
+	defaultMaxRequestBytes = 1 << 20
+	requestTimeout         = 10 * time.Second
+	fetchMaxWait           = 500 * time.Millisecond
+)
+
+// Client is the subset of a broker connection used by the gateway.
+type Client interface {
+	Metadata(*protocol.MetadataRequest) (*protocol.MetadataResponse, error)
+	Produce(*protocol.ProduceRequest) (*protocol.ProduceResponse, error)
+	Fetch(*protocol.FetchRequest) (*protocol.FetchResponse, error)
+	Offsets(*protocol.OffsetsRequest) (*protocol.OffsetsResponse, error)
+	Close() error
+}
+
+// Config for the gateway.
+type Config struct {
+	// Addr is the address the HTTP server binds on.
+	Addr string
+	// BrokerAddr is the address of a broker used to look up partition leaders.
+	BrokerAddr string
+	// InstanceTimeout is how long a consumer instance can go unused before it's
+	// removed. Defaults to 5 minutes.
+	InstanceTimeout time.Duration
+	// MaxRequestBytes is the max size of a request's body. Defaults to 1MB.
+	MaxRequestBytes int64
+	// Dial opens a connection to the broker at the address. Defaults to jocko.Dial.
+	Dial func(addr string) (Client, error)
+}
+
+// Gateway serves the HTTP API and forwards requests to the brokers leading the
+// partitions.
+type Gateway struct {
+	config Config
+	server *http.Server
+
+	mu        sync.Mutex
+	conns     map[string]Client
+	consumers map[string]*consumer
+	nextID    uint64
+
+	shutdownCh chan struct{}
+}
+
+// New returns a gateway for the config.
+func New(config Config) *Gateway {
+	if config.InstanceTimeout == 0 {
+		config.InstanceTimeout = defaultInstanceTimeout
+	}
+	if config.MaxRequestBytes == 0 {
+		config.MaxRequestBytes = defaultMaxRequestBytes
+	}
+	if config.Dial == nil {
+		config.Dial = func(addr string) (Client, error) {
+			return jocko.Dial("tcp", addr)
+		}
+	}
+	return &Gateway{
+		config:     config,
+		conns:      make(map[string]Client),
+		consumers:  make(map[string]*consumer),
+		shutdownCh: make(chan struct{}),
+	}
+}
+
+// Start listens on the configured address and serves requests in the background.
+func (g *Gateway) Start() error {
+	ln, err := net.Listen("tcp", g.config.Addr)
+	if err != nil {
+		return err
+	}
+	g.server = &http.Server{Handler: g}
+	go func() {
+		if err := g.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Error.Printf("gateway: serve error: %s", err)
+		}
+	}()
+	go g.reapConsumers()
+	return nil
+}
+
+// Shutdown stops the server and closes the broker connections.
+func (g *Gateway) Shutdown() error {
+	close(g.shutdownCh)
+	var err error
+	if g.server != nil {
+		err = g.server.Shutdown(context.Background())
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr, conn := range g.conns {
+		conn.Close()
+		delete(g.conns, addr)
+	}
+	return err
+}
+
+// ServeHTTP routes the request to its handler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// handlers decoding a body bigger than the max fail with a bad request
+	r.Body = http.MaxBytesReader(w, r.Body, g.config.MaxRequestBytes)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 5 && parts[0] == "topics" && parts[2] == "partitions" && parts[4] == "records":
+		partition, err := strconv.ParseInt(parts[3], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, protocol.ErrUnknownTopicOrPartition.WithErr(err))
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		g.handleProduce(w, r, parts[1], int32(partition))
+	case len(parts) == 3 && parts[0] == "consumers" && parts[2] == "instances":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		g.handleCreateConsumer(w, r, parts[1])
+	case len(parts) >= 4 && parts[0] == "consumers" && parts[2] == "instances":
+		c := g.consumer(parts[1], parts[3])
+		if c == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("consumer instance not found: %s", parts[3]))
+			return
+		}
+		switch {
+		case len(parts) == 4 && r.Method == http.MethodDelete:
+			g.removeConsumer(c.id)
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 5 && parts[4] == "assignments" && r.Method == http.MethodPost:
+			g.handleAssign(w, r, c)
+		case len(parts) == 5 && parts[4] == "records" && r.Method == http.MethodGet:
+			g.handleConsume(w, r, c)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ProduceRecord is a record sent to the gateway to produce.
+type ProduceRecord struct {
+	Key   *string `json:"key"`
+	Value *string `json:"value"`
+}
+
+// ProduceRequest is the body of a produce request.
+type ProduceRequest struct {
+	Records []ProduceRecord `json:"records"`
+}
+
+// ProduceResponse is the body of a produce response. The records are appended
+// as one message set so they share its offset.
+type ProduceResponse struct {
+	Partition int32 `json:"partition"`
+	Offset    int64 `json:"offset"`
+}
+
+func (g *Gateway) handleProduce(w http.ResponseWriter, r *http.Request, topic string, partition int32) {
+	var req ProduceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Records) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no records"))
+		return
+	}
+	recordSet, err := encodeRecords(req.Records, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var res *protocol.ProduceResponse
+	err = g.withLeader(topic, partition, func(c Client) (err error) {
+		res, err = c.Produce(&protocol.ProduceRequest{
+			Acks:    1,
+			Timeout: requestTimeout,
+			TopicData: []*protocol.TopicData{{
+				Topic: topic,
+				Data:  []*protocol.Data{{Partition: partition, RecordSet: recordSet}},
+			}},
+		})
+		return err
+	})
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	for _, tr := range res.Responses {
+		for _, pr := range tr.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				writeError(w, http.StatusInternalServerError, protocol.Errs[pr.ErrorCode])
+				return
+			}
+			writeJSON(w, http.StatusOK, ProduceResponse{Partition: pr.Partition, Offset: pr.BaseOffset})
+			return
+		}
+	}
+	writeError(w, http.StatusInternalServerError, fmt.Errorf("empty produce response"))
+}
+
+// withLeader runs fn with a connection to the partition's leader.
+func (g *Gateway) withLeader(topic string, partition int32, fn func(Client) error) error {
+	var addr string
+	err := g.withConn(g.config.BrokerAddr, func(c Client) error {
+		res, err := c.Metadata(&protocol.MetadataRequest{Topics: []string{topic}})
+		if err != nil {
+			return err
+		}
+		leader, err := res.Leader(topic, partition)
+		if err != nil {
+			return err
+		}
+		addr = leader.Addr()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return g.withConn(addr, fn)
+}
+
+// withConn runs fn with a cached connection to the broker at addr. The
+// connection is dropped if fn fails with something other than a protocol error.
+func (g *Gateway) withConn(addr string, fn func(Client) error) error {
+	g.mu.Lock()
+	conn, ok := g.conns[addr]
+	g.mu.Unlock()
+	if !ok {
+		var err error
+		if conn, err = g.config.Dial(addr); err != nil {
+			return err
+		}
+		g.mu.Lock()
+		g.conns[addr] = conn
+		g.mu.Unlock()
+	}
+	err := fn(conn)
+	if _, ok := err.(protocol.Error); err != nil && !ok {
+		g.mu.Lock()
+		if g.conns[addr] == conn {
+			delete(g.conns, addr)
+		}
+		g.mu.Unlock()
+		conn.Close()
+	}
+	return err
+}
+
+type errorResponse struct {
+	ErrorCode int16  `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	res := errorResponse{ErrorCode: protocol.ErrUnknown.Code(), Message: err.Error()}
+	if perr, ok := err.(protocol.Error); ok {
+		res.ErrorCode = perr.Code()
+	}
+	writeJSON(w, status, res)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error.Printf("gateway: write response error: %s", err)
+	}
+}
+
+// statusCode returns the HTTP status for an error talking to the brokers.
+func statusCode(err error) int {
+	perr, ok := err.(protocol.Error)
+	if !ok {
+		return http.StatusBadGateway
+	}
+	switch perr.Code() {
+	case protocol.ErrUnknownTopicOrPartition.Code():
+		return http.StatusNotFound
+	case protocol.ErrLeaderNotAvailable.Code(), protocol.ErrNotLeaderForPartition.Code():
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
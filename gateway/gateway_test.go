@@ -0,0 +1,245 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fakeBroker leads every partition of a single topic and keeps its log in memory.
+type fakeBroker struct {
+	mu    sync.Mutex
+	topic string
+	log   [][]byte
+}
+
+func (b *fakeBroker) Metadata(req *protocol.MetadataRequest) (*protocol.MetadataResponse, error) {
+	res := &protocol.MetadataResponse{
+		Brokers: []*protocol.Broker{{NodeID: 1, Host: "localhost", Port: 9092}},
+	}
+	topics := req.Topics
+	if len(topics) == 0 {
+		topics = []string{b.topic}
+	}
+	for _, t := range topics {
+		tm := &protocol.TopicMetadata{Topic: t}
+		if t == b.topic {
+			tm.PartitionMetadata = []*protocol.PartitionMetadata{{PartitionID: 0, Leader: 1}}
+		} else {
+			tm.TopicErrorCode = protocol.ErrUnknownTopicOrPartition.Code()
+		}
+		res.TopicMetadata = append(res.TopicMetadata, tm)
+	}
+	return res, nil
+}
+
+func (b *fakeBroker) Produce(req *protocol.ProduceRequest) (*protocol.ProduceResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ms := commitlog.MessageSet(req.TopicData[0].Data[0].RecordSet)
+	offset := int64(len(b.log))
+	ms.PutOffset(offset)
+	b.log = append(b.log, ms)
+	return &protocol.ProduceResponse{Responses: []*protocol.ProduceTopicResponse{{
+		Topic:              b.topic,
+		PartitionResponses: []*protocol.ProducePartitionResponse{{BaseOffset: offset}},
+	}}}, nil
+}
+
+func (b *fakeBroker) Fetch(req *protocol.FetchRequest) (*protocol.FetchResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var recordSet []byte
+	for _, ms := range b.log[req.Topics[0].Partitions[0].FetchOffset:] {
+		recordSet = append(recordSet, ms...)
+	}
+	if maxBytes := int(req.Topics[0].Partitions[0].MaxBytes); len(recordSet) > maxBytes {
+		recordSet = recordSet[:maxBytes]
+	}
+	return &protocol.FetchResponse{Responses: []*protocol.FetchTopicResponse{{
+		Topic:              b.topic,
+		PartitionResponses: []*protocol.FetchPartitionResponse{{RecordSet: recordSet}},
+	}}}, nil
+}
+
+func (b *fakeBroker) Offsets(req *protocol.OffsetsRequest) (*protocol.OffsetsResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	offset := int64(len(b.log))
+	switch ts := req.Topics[0].Partitions[0].Timestamp; {
+	case ts == -2:
+		offset = 0
+	case ts >= 0:
+		offset = -1
+		for i, ms := range b.log {
+			if max, ok := commitlog.MessageSet(ms).MaxTimestamp(); ok && max >= ts {
+				offset = int64(i)
+				break
+			}
+		}
+	}
+	return &protocol.OffsetsResponse{Responses: []*protocol.OffsetResponse{{
+		Topic:              b.topic,
+		PartitionResponses: []*protocol.PartitionResponse{{Offsets: []int64{offset}}},
+	}}}, nil
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+func TestGatewayProduceConsume(t *testing.T) {
+	req := require.New(t)
+	broker := &fakeBroker{topic: "test-topic"}
+	g := New(Config{Dial: func(addr string) (Client, error) { return broker, nil }})
+
+	do := func(method, path string, body interface{}, v interface{}) int {
+		var b bytes.Buffer
+		if body != nil {
+			req.NoError(json.NewEncoder(&b).Encode(body))
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, path, &b))
+		if v != nil {
+			req.NoError(json.NewDecoder(w.Body).Decode(v))
+		}
+		return w.Code
+	}
+
+	key, one, two := "key", "one", "two"
+	var pres ProduceResponse
+	req.Equal(http.StatusOK, do("POST", "/topics/test-topic/partitions/0/records", ProduceRequest{
+		Records: []ProduceRecord{{Key: &key, Value: &one}, {Value: &two}},
+	}, &pres))
+	req.Equal(int64(0), pres.Offset)
+
+	var cres CreateConsumerResponse
+	req.Equal(http.StatusOK, do("POST", "/consumers/group/instances", CreateConsumerRequest{AutoOffsetReset: Earliest}, &cres))
+	req.Equal(http.StatusNoContent, do("POST", cres.BaseURI+"/assignments", AssignRequest{
+		Partitions: []TopicPartition{{Topic: "test-topic", Partition: 0}},
+	}, nil))
+
+	var records ConsumeResponse
+	req.Equal(http.StatusOK, do("GET", cres.BaseURI+"/records", nil, &records))
+	req.Equal(2, len(records.Records))
+	req.Equal(&key, records.Records[0].Key)
+	req.Equal(&one, records.Records[0].Value)
+	req.Nil(records.Records[1].Key)
+	req.Equal(&two, records.Records[1].Value)
+	req.NotNil(records.Records[1].Timestamp)
+
+	// the instance's position moved past the records it consumed
+	records = ConsumeResponse{}
+	req.Equal(http.StatusOK, do("GET", cres.BaseURI+"/records", nil, &records))
+	req.Equal(0, len(records.Records))
+
+	req.Equal(http.StatusNoContent, do("DELETE", cres.BaseURI, nil, nil))
+	req.Equal(http.StatusNotFound, do("GET", cres.BaseURI+"/records", nil, nil))
+}
+
+func TestGatewayConsumeFromTimestamp(t *testing.T) {
+	req := require.New(t)
+	broker := &fakeBroker{topic: "test-topic"}
+	g := New(Config{Dial: func(addr string) (Client, error) { return broker, nil }})
+
+	do := func(method, path string, body interface{}, v interface{}) int {
+		var b bytes.Buffer
+		if body != nil {
+			req.NoError(json.NewEncoder(&b).Encode(body))
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, path, &b))
+		if v != nil {
+			req.NoError(json.NewDecoder(w.Body).Decode(v))
+		}
+		return w.Code
+	}
+	consume := func(startTimestamp int64) []Record {
+		var cres CreateConsumerResponse
+		req.Equal(http.StatusOK, do("POST", "/consumers/group/instances", CreateConsumerRequest{StartTimestamp: &startTimestamp}, &cres))
+		req.Equal(http.StatusNoContent, do("POST", cres.BaseURI+"/assignments", AssignRequest{
+			Partitions: []TopicPartition{{Topic: "test-topic", Partition: 0}},
+		}, nil))
+		var records ConsumeResponse
+		req.Equal(http.StatusOK, do("GET", cres.BaseURI+"/records", nil, &records))
+		return records.Records
+	}
+
+	value := "value"
+	req.Equal(http.StatusOK, do("POST", "/topics/test-topic/partitions/0/records", ProduceRequest{
+		Records: []ProduceRecord{{Value: &value}},
+	}, nil))
+
+	req.Len(consume(0), 1)
+	// nothing's at or after a future timestamp so it starts at the end
+	req.Len(consume(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond)), 0)
+
+	startTimestamp := int64(-5)
+	req.Equal(http.StatusBadRequest, do("POST", "/consumers/group/instances", CreateConsumerRequest{StartTimestamp: &startTimestamp}, nil))
+}
+
+func TestGatewayProduceUnknownTopic(t *testing.T) {
+	broker := &fakeBroker{topic: "test-topic"}
+	g := New(Config{Dial: func(addr string) (Client, error) { return broker, nil }})
+
+	value := "value"
+	b, err := json.Marshal(ProduceRequest{Records: []ProduceRecord{{Value: &value}}})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("POST", "/topics/unknown/partitions/0/records", bytes.NewReader(b)))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	var res errorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	require.Equal(t, protocol.ErrUnknownTopicOrPartition.Code(), res.ErrorCode)
+}
+
+func TestGatewayLimits(t *testing.T) {
+	req := require.New(t)
+	broker := &fakeBroker{topic: "test-topic"}
+	g := New(Config{MaxRequestBytes: 64, Dial: func(addr string) (Client, error) { return broker, nil }})
+
+	do := func(method, path string, body []byte, v interface{}) int {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+		if v != nil {
+			req.NoError(json.NewDecoder(w.Body).Decode(v))
+		}
+		return w.Code
+	}
+
+	// bodies bigger than the max aren't read
+	value := string(make([]byte, 64))
+	b, err := json.Marshal(ProduceRequest{Records: []ProduceRecord{{Value: &value}}})
+	req.NoError(err)
+	req.Equal(http.StatusBadRequest, do("POST", "/topics/test-topic/partitions/0/records", b, nil))
+	req.Empty(broker.log)
+
+	value = "value"
+	b, err = json.Marshal(ProduceRequest{Records: []ProduceRecord{{Value: &value}}})
+	req.NoError(err)
+	req.Equal(http.StatusOK, do("POST", "/topics/test-topic/partitions/0/records", b, nil))
+	var cres CreateConsumerResponse
+	req.Equal(http.StatusOK, do("POST", "/consumers/group/instances", []byte(`{"auto_offset_reset": "earliest"}`), &cres))
+	req.Equal(http.StatusNoContent, do("POST", cres.BaseURI+"/assignments", []byte(`{"partitions": [{"topic": "test-topic", "partition": 0}]}`), nil))
+
+	// a message set bigger than the max bytes errors rather than being
+	// skipped forever
+	var eres errorResponse
+	do("GET", cres.BaseURI+"/records?max_bytes=16", nil, &eres)
+	req.Equal(protocol.ErrMessageTooLarge.Code(), eres.ErrorCode)
+
+	// as does a corrupt one
+	broker.log[0][len(broker.log[0])-1] ^= 0xff
+	eres = errorResponse{}
+	do("GET", cres.BaseURI+"/records", nil, &eres)
+	req.Equal(protocol.ErrCorruptMessage.Code(), eres.ErrorCode)
+}
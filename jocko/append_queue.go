@@ -0,0 +1,151 @@
+package jocko
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errAppendQueueClosed = errors.New("append queue closed")
+
+// appendQueue schedules the produce appends to the data dir's partitions on a
+// pool of workers. Each partition's appends queue up in order and the workers
+// take turns between the partitions with appends queued, each turn appending
+// up to a quantum of bytes (deficit round robin), so a firehose partition
+// can't take over the workers and starve the other partitions' appends.
+type appendQueue struct {
+	quantum int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[appendPartition]*partitionAppends
+	// ready are the partitions with appends queued that no worker's on, in
+	// the order they get their turns.
+	ready  []*partitionAppends
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type appendPartition struct {
+	topic     string
+	partition int32
+}
+
+type partitionAppends struct {
+	key     appendPartition
+	appends []*pendingAppend
+	// deficit is how many bytes the partition can append in its turn.
+	deficit int
+	// busy is whether the partition's ready or a worker's on it.
+	busy bool
+}
+
+type pendingAppend struct {
+	ctx    context.Context
+	size   int
+	append func() (int64, error)
+	offset int64
+	err    error
+	done   chan struct{}
+}
+
+// newAppendQueue starts the workers, which append up to quantum bytes of a
+// partition's records at a turn.
+func newAppendQueue(workers, quantum int) *appendQueue {
+	q := &appendQueue{
+		quantum: quantum,
+		queues:  make(map[appendPartition]*partitionAppends),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// append queues the partition's append of size bytes, run by fn, and returns
+// its offset once it's run. It's skipped if ctx is done before its turn, e.g.
+// because its produce request timed out and the producer will retry it.
+func (q *appendQueue) append(ctx context.Context, topic string, partition int32, size int, fn func() (int64, error)) (int64, error) {
+	a := &pendingAppend{ctx: ctx, size: size, append: fn, done: make(chan struct{})}
+	key := appendPartition{topic: topic, partition: partition}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return 0, errAppendQueueClosed
+	}
+	p, ok := q.queues[key]
+	if !ok {
+		p = &partitionAppends{key: key}
+		q.queues[key] = p
+	}
+	p.appends = append(p.appends, a)
+	if !p.busy {
+		p.busy = true
+		q.ready = append(q.ready, p)
+		q.cond.Signal()
+	}
+	q.mu.Unlock()
+	<-a.done
+	return a.offset, a.err
+}
+
+func (q *appendQueue) work() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		for len(q.ready) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.ready) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		p := q.ready[0]
+		q.ready = q.ready[1:]
+		p.deficit += q.quantum
+		// a partition's turn appends at least one batch so one bigger than
+		// the quantum isn't stuck
+		n := 0
+		for n < len(p.appends) && (n == 0 || p.appends[n].size <= p.deficit) {
+			p.deficit -= p.appends[n].size
+			n++
+		}
+		if p.deficit < 0 {
+			p.deficit = 0
+		}
+		turn := p.appends[:n]
+		p.appends = p.appends[n:]
+		q.mu.Unlock()
+
+		// the partition isn't ready while its turn runs so its appends stay
+		// in order
+		for _, a := range turn {
+			if a.err = a.ctx.Err(); a.err == nil {
+				a.offset, a.err = a.append()
+			}
+			close(a.done)
+		}
+
+		q.mu.Lock()
+		if len(p.appends) > 0 {
+			q.ready = append(q.ready, p)
+			q.cond.Signal()
+		} else {
+			p.busy = false
+			p.deficit = 0
+			delete(q.queues, p.key)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// close stops the workers once they've run the appends already queued.
+func (q *appendQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.wg.Wait()
+}
@@ -0,0 +1,105 @@
+package jocko
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+)
+
+func TestAppendQueueFairness(t *testing.T) {
+	q := newAppendQueue(1, 10)
+	var mu sync.Mutex
+	var order []string
+	appendFn := func(name string, block chan struct{}) func() (int64, error) {
+		return func() (int64, error) {
+			if block != nil {
+				<-block
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return int64(len(name)), nil
+		}
+	}
+	queued := func(n int) func() bool {
+		return func() bool {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			c := 0
+			for _, p := range q.queues {
+				c += len(p.appends)
+			}
+			return len(q.queues) > 0 && c == n
+		}
+	}
+
+	var wg sync.WaitGroup
+	enqueue := func(topic, name string, block chan struct{}, n int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			offset, err := q.append(context.Background(), topic, 0, 10, appendFn(name, block))
+			require.NoError(t, err)
+			require.Equal(t, int64(len(name)), offset)
+		}()
+		for deadline := time.Now().Add(time.Second); !queued(n)(); time.Sleep(time.Millisecond) {
+			require.True(t, time.Now().Before(deadline), "append %s not queued", name)
+		}
+	}
+	// the worker's stuck on a's first append while a queues up more than a
+	// turn's worth and b queues one
+	block := make(chan struct{})
+	enqueue("a", "a0", block, 0)
+	enqueue("a", "a1", nil, 1)
+	enqueue("a", "a2", nil, 2)
+	enqueue("a", "a3", nil, 3)
+	enqueue("b", "b0", nil, 4)
+	close(block)
+	wg.Wait()
+	q.close()
+
+	require.Equal(t, []string{"a0", "b0", "a1", "a2", "a3"}, order)
+	_, err := q.append(context.Background(), "a", 0, 10, appendFn("a4", nil))
+	require.Equal(t, errAppendQueueClosed, err)
+}
+
+func TestAppendQueueCanceled(t *testing.T) {
+	q := newAppendQueue(1, 10)
+	defer q.close()
+	// an append whose request's done before its turn isn't run
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := q.append(ctx, "a", 0, 10, func() (int64, error) {
+		t.Fatal("canceled append run")
+		return 0, nil
+	})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestBroker_StartAppendQueues(t *testing.T) {
+	b := &Broker{
+		config: &config.Config{DataDir: "/tmp/jocko", AppendWorkers: 2, AppendQuantumBytes: 10},
+		runner: newRunner(),
+	}
+	b.runner.add("append workers")
+	b.startAppendQueues()
+	q := b.appends[b.partitionDataDir("test-topic", 0)]
+	require.NotNil(t, q)
+	offset, err := q.append(context.Background(), "test-topic", 0, 10, func() (int64, error) { return 1, nil })
+	require.NoError(t, err)
+	require.Equal(t, int64(1), offset)
+
+	// the workers stop with the broker
+	require.Empty(t, b.runner.stop(time.Second))
+	_, err = q.append(context.Background(), "test-topic", 0, 10, func() (int64, error) { return 2, nil })
+	require.Equal(t, errAppendQueueClosed, err)
+
+	// they aren't started once the broker's stopped
+	b.appends = nil
+	b.startAppendQueues()
+	require.Nil(t, b.appends)
+}
@@ -0,0 +1,104 @@
+package jocko
+
+import (
+	"sort"
+
+	"github.com/travisjeffery/jocko/jocko/metadata"
+)
+
+// assignReplicas assigns the replicas of each partition to brokers so both the
+// replicas and the leaders, the first replica of each partition, are spread
+// evenly across the brokers. Partitions' leaders go round-robin from the start
+// index and their followers are shifted from the leader by an amount that
+// changes each time the leaders wrap around, so the same brokers don't always
+// follow each other.
+//
+// If every broker has a rack the brokers are ordered alternating between racks
+// and a partition's replicas go to as many different racks as they can, so a
+// partition stays available if a rack goes down.
+func assignReplicas(brokers []*metadata.Broker, partitions int32, replicationFactor int16, start, shift int) [][]int32 {
+	n := len(brokers)
+	if n == 0 || replicationFactor <= 0 || int(replicationFactor) > n {
+		return nil
+	}
+	brokers, rackAware := rackAlternated(brokers)
+	racks := make(map[string]struct{})
+	for _, b := range brokers {
+		racks[b.Rack] = struct{}{}
+	}
+
+	assignments := make([][]int32, 0, partitions)
+	for p := 0; p < int(partitions); p++ {
+		if p > 0 && p%n == 0 {
+			shift++
+		}
+		first := (p + start) % n
+		leader := brokers[first]
+		replicas := []int32{leader.ID.Int32()}
+		if !rackAware {
+			for j := 0; j < int(replicationFactor)-1; j++ {
+				replicas = append(replicas, brokers[replicaIndex(first, shift, j, n)].ID.Int32())
+			}
+			assignments = append(assignments, replicas)
+			continue
+		}
+		usedRacks := map[string]struct{}{leader.Rack: {}}
+		usedBrokers := map[int32]struct{}{leader.ID.Int32(): {}}
+		for k := 0; len(replicas) < int(replicationFactor); k++ {
+			b := brokers[replicaIndex(first, shift*len(racks), k, n)]
+			if _, ok := usedBrokers[b.ID.Int32()]; ok {
+				continue
+			}
+			// only put two replicas in a rack once every rack has one
+			if _, ok := usedRacks[b.Rack]; ok && len(usedRacks) < len(racks) {
+				continue
+			}
+			replicas = append(replicas, b.ID.Int32())
+			usedRacks[b.Rack] = struct{}{}
+			usedBrokers[b.ID.Int32()] = struct{}{}
+		}
+		assignments = append(assignments, replicas)
+	}
+	return assignments
+}
+
+// replicaIndex returns the index of the follower j of the partition whose
+// leader is at the first index. The shift is never a multiple of n so the
+// follower's never the leader.
+func replicaIndex(first, shift, j, n int) int {
+	if n == 1 {
+		return first
+	}
+	return (first + 1 + (shift+j)%(n-1)) % n
+}
+
+// rackAlternated returns the brokers sorted by ID, or if they all have racks,
+// ordered so each rack's brokers alternate, e.g. a1, b1, c1, a2, b2, c2, and
+// true.
+func rackAlternated(brokers []*metadata.Broker) ([]*metadata.Broker, bool) {
+	sorted := make([]*metadata.Broker, len(brokers))
+	copy(sorted, brokers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	byRack := make(map[string][]*metadata.Broker)
+	var racks []string
+	for _, b := range sorted {
+		if b.Rack == "" {
+			return sorted, false
+		}
+		if _, ok := byRack[b.Rack]; !ok {
+			racks = append(racks, b.Rack)
+		}
+		byRack[b.Rack] = append(byRack[b.Rack], b)
+	}
+	sort.Strings(racks)
+	alternated := make([]*metadata.Broker, 0, len(sorted))
+	for i := 0; len(alternated) < len(sorted); i++ {
+		for _, rack := range racks {
+			if i < len(byRack[rack]) {
+				alternated = append(alternated, byRack[rack][i])
+			}
+		}
+	}
+	return alternated, true
+}
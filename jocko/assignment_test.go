@@ -0,0 +1,51 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+)
+
+func TestAssignReplicas(t *testing.T) {
+	var brokers []*metadata.Broker
+	for i := 1; i <= 4; i++ {
+		brokers = append(brokers, &metadata.Broker{ID: metadata.NodeID(i)})
+	}
+	assignments := assignReplicas(brokers, 8, 3, 1, 0)
+	require.Equal(t, 8, len(assignments))
+	leaders := make(map[int32]int)
+	replicas := make(map[int32]int)
+	for _, a := range assignments {
+		require.Equal(t, 3, len(a))
+		seen := make(map[int32]bool)
+		for _, id := range a {
+			require.False(t, seen[id], "%v", a)
+			seen[id] = true
+			replicas[id]++
+		}
+		leaders[a[0]]++
+	}
+	for _, b := range brokers {
+		require.Equal(t, 2, leaders[b.ID.Int32()])
+		require.Equal(t, 6, replicas[b.ID.Int32()])
+	}
+	require.Equal(t, []int32{2, 3, 4}, assignments[0])
+	// followers shift once the leaders wrap around
+	require.Equal(t, []int32{2, 4, 1}, assignments[4])
+}
+
+func TestAssignReplicasRackAware(t *testing.T) {
+	var brokers []*metadata.Broker
+	racks := map[int32]string{1: "a", 2: "a", 3: "b", 4: "b", 5: "c", 6: "c"}
+	for i := int32(1); i <= 6; i++ {
+		brokers = append(brokers, &metadata.Broker{ID: metadata.NodeID(i), Rack: racks[i]})
+	}
+	for _, a := range assignReplicas(brokers, 12, 3, 0, 0) {
+		seen := make(map[string]bool)
+		for _, id := range a {
+			require.False(t, seen[racks[id]], "%v", a)
+			seen[racks[id]] = true
+		}
+	}
+}
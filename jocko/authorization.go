@@ -0,0 +1,115 @@
+package jocko
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// authorized returns whether the client that sent the request can run the
+// operation on the resource. Topics and groups in a namespace are only
+// authorized for its principals, and the cluster's never authorized for a
+// namespace's principals, otherwise everything's authorized without an
+// authorizer.
+func (b *Broker) authorized(ctx *Context, op policy.Operation, typ policy.ResourceType, name string) bool {
+	var client *ClientInfo
+	if ctx != nil {
+		client = ctx.Client()
+	}
+	if !b.namespaces.allowed(client.Principal(), name) {
+		return false
+	}
+	if typ == policy.ClusterResource && b.namespaces.member(client.Principal()) {
+		return false
+	}
+	if b.config.Authorizer == nil {
+		return true
+	}
+	return b.config.Authorizer.Authorize(client.Principal(), op, typ, name)
+}
+
+// brokerAuthorized returns whether the client that sent the request can send
+// brokers' requests, e.g. fetch as a replica: it connected to the inter-broker
+// listener, whose clients have proved they're brokers, or it's authorized for
+// the cluster's actions.
+func (b *Broker) brokerAuthorized(ctx *Context) bool {
+	if c := b.config.InterBrokerTLS; c != nil && ctx != nil && ctx.Client() != nil && ctx.Client().Listener == c.Listener {
+		return true
+	}
+	return b.authorized(ctx, policy.ClusterActionOperation, policy.ClusterResource, "")
+}
+
+func (b *Broker) handleDescribeConfigs(ctx *Context, req *protocol.DescribeConfigsRequest) *protocol.DescribeConfigsResponse {
+	sp := span(ctx, b.tracer, "describe configs")
+	defer sp.Finish()
+	res := new(protocol.DescribeConfigsResponse)
+	res.APIVersion = req.Version()
+	for _, resource := range req.Resources {
+		rres := protocol.DescribeConfigsResourceResponse{
+			Type: resource.Type,
+			Name: resource.Name,
+		}
+		err := protocol.ErrNone
+		switch {
+		case resource.Type != protocol.TopicResourceType:
+			err = protocol.ErrInvalidRequest.WithErr(fmt.Errorf("only topic configs can be described"))
+		case !b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, resource.Name):
+			err = protocol.ErrTopicAuthorizationFailed
+		default:
+			rres.ConfigEntries, err = b.describeTopicConfigs(resource.Name, resource.ConfigNames)
+		}
+		rres.ErrorCode = err.Code()
+		if err != protocol.ErrNone {
+			msg := err.Error()
+			rres.ErrorMessage = &msg
+		}
+		res.Resources = append(res.Resources, rres)
+	}
+	return res
+}
+
+// topicIDConfig is the read-only config clients can describe for a topic's
+// ID, e.g. when they use Metadata versions without topic IDs.
+const topicIDConfig = "topic.id"
+
+// describeTopicConfigs returns the topic's configs with the names, or all of
+// them if there aren't any. The topic's ID is only returned when it's named.
+func (b *Broker) describeTopicConfigs(topic string, names []string) ([]protocol.DescribeConfigsEntry, protocol.Error) {
+	_, t, err := b.fsm.State().GetTopic(topic)
+	if err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if t == nil {
+		return nil, protocol.ErrUnknownTopicOrPartition
+	}
+	if len(names) == 0 {
+		for name := range t.Config {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	entries := make([]protocol.DescribeConfigsEntry, 0, len(names))
+	for _, name := range names {
+		if name == topicIDConfig {
+			id := t.ID
+			entries = append(entries, protocol.DescribeConfigsEntry{Name: name, Value: &id, ReadOnly: true})
+			continue
+		}
+		e, ok := t.Config[name]
+		if !ok {
+			continue
+		}
+		entry := protocol.DescribeConfigsEntry{
+			Name:      name,
+			IsDefault: e.Value == nil,
+		}
+		if v := t.Config.GetValue(name); v != nil {
+			s := fmt.Sprint(v)
+			entry.Value = &s
+		}
+		entries = append(entries, entry)
+	}
+	return entries, protocol.ErrNone
+}
@@ -0,0 +1,103 @@
+package jocko
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestAuthorizedDescribe(t *testing.T) {
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	require.NoError(t, err)
+	apply := func(typ structs.MessageType, req interface{}) {
+		buf, err := structs.Encode(typ, req)
+		require.NoError(t, err)
+		f.Apply(&raft.Log{Data: buf})
+	}
+	for _, topic := range []string{"public", "secret"} {
+		apply(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+			Topic: structs.Topic{Topic: topic, Partitions: map[int32][]int32{}, Config: structs.NewTopicConfig()},
+		})
+		apply(structs.RegisterGroupRequestType, structs.RegisterGroupRequest{Group: structs.Group{Group: topic + "-group"}})
+	}
+	// alice can only describe what's public
+	authorizer := policy.AuthorizerFunc(func(principal string, op policy.Operation, typ policy.ResourceType, name string) bool {
+		return principal == "alice" && (name == "public" || name == "public-group")
+	})
+	b := &Broker{config: &config.Config{Addr: "localhost:9092", Authorizer: authorizer}, fsm: f, store: &fsmStore{fsm: f}, tracer: stdopentracing.NoopTracer{}}
+	client := &ClientInfo{}
+	client.SetPrincipal("alice")
+	ctx := &Context{parent: context.Background(), client: client}
+
+	metadata := b.handleMetadata(ctx, &protocol.MetadataRequest{})
+	require.Len(t, metadata.TopicMetadata, 1)
+	require.Equal(t, "public", metadata.TopicMetadata[0].Topic)
+
+	metadata = b.handleMetadata(ctx, &protocol.MetadataRequest{Topics: []string{"secret", "missing"}})
+	require.Equal(t, protocol.ErrTopicAuthorizationFailed.Code(), metadata.TopicMetadata[0].TopicErrorCode)
+	// unknown topics look the same as ones the client can't describe
+	require.Equal(t, protocol.ErrTopicAuthorizationFailed.Code(), metadata.TopicMetadata[1].TopicErrorCode)
+
+	groups := b.handleListGroups(ctx, &protocol.ListGroupsRequest{})
+	require.Len(t, groups.Groups, 1)
+	require.Equal(t, "public-group", groups.Groups[0].GroupID)
+
+	configs := b.handleDescribeConfigs(ctx, &protocol.DescribeConfigsRequest{Resources: []protocol.DescribeConfigsResource{
+		{Type: protocol.TopicResourceType, Name: "public", ConfigNames: []string{"retention.ms"}},
+		{Type: protocol.TopicResourceType, Name: "secret"},
+	}})
+	require.Equal(t, protocol.ErrNone.Code(), configs.Resources[0].ErrorCode)
+	require.Len(t, configs.Resources[0].ConfigEntries, 1)
+	require.Equal(t, "604800000", *configs.Resources[0].ConfigEntries[0].Value)
+	require.Equal(t, protocol.ErrTopicAuthorizationFailed.Code(), configs.Resources[1].ErrorCode)
+
+	dir, err := ioutil.TempDir("", "authorization")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	b.replicaLookup = NewReplicaLookup()
+	for _, topic := range []string{"public", "secret"} {
+		l, err := commitlog.New(commitlog.Options{Path: filepath.Join(dir, topic), MaxSegmentBytes: 1024, MaxLogBytes: -1})
+		require.NoError(t, err)
+		defer l.Close()
+		b.replicaLookup.AddReplica(&Replica{Partition: structs.Partition{Topic: topic}, Log: l})
+	}
+	stats := b.handleDescribeLogStats(ctx, &protocol.DescribeLogStatsRequest{})
+	require.Len(t, stats.Partitions, 1)
+	require.Equal(t, "public", stats.Partitions[0].Topic)
+
+	// debugging fetches need the cluster
+	b.verifier = newFetchVerifier(0)
+	b.traffic = newTrafficStats()
+	fetch := b.handleFetch(ctx, &protocol.FetchRequest{
+		ReplicaID:   debuggingReplicaID,
+		MaxWaitTime: time.Second,
+		Topics:      []*protocol.FetchTopic{{Topic: "public", Partitions: []*protocol.FetchPartition{{Partition: 0, MaxBytes: 1024}}}},
+	})
+	require.Equal(t, protocol.ErrClusterAuthorizationFailed.Code(), fetch.Responses[0].PartitionResponses[0].ErrorCode)
+	fetch = b.handleFetch(ctx, &protocol.FetchRequest{
+		ReplicaID:   -1,
+		MaxWaitTime: time.Second,
+		Topics:      []*protocol.FetchTopic{{Topic: "public", Partitions: []*protocol.FetchPartition{{Partition: 0, MaxBytes: 1024}}}},
+	})
+	require.Equal(t, protocol.ErrNone.Code(), fetch.Responses[0].PartitionResponses[0].ErrorCode)
+
+	// only brokers write markers
+	markers := b.handleWriteTxnMarkers(ctx, &protocol.WriteTxnMarkersRequest{Markers: []*protocol.WritableTxnMarker{{
+		Committed: true,
+		Topics:    []*protocol.WritableTxnMarkerTopic{{Topic: "public", Partitions: []int32{0}}},
+	}}})
+	require.Equal(t, protocol.ErrClusterAuthorizationFailed.Code(), markers.Markers[0].Topics[0].Partitions[0].ErrorCode)
+}
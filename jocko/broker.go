@@ -2,13 +2,16 @@ package jocko
 
 import (
 	"bytes"
-	"container/ring"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,7 +19,6 @@ import (
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/hashicorp/raft"
-	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"github.com/hashicorp/serf/serf"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -25,8 +27,8 @@ import (
 	"github.com/travisjeffery/jocko/jocko/config"
 	"github.com/travisjeffery/jocko/jocko/fsm"
 	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/jocko/policy"
 	"github.com/travisjeffery/jocko/jocko/structs"
-	"github.com/travisjeffery/jocko/jocko/util"
 	"github.com/travisjeffery/jocko/log"
 	"github.com/travisjeffery/jocko/protocol"
 )
@@ -45,6 +47,11 @@ const (
 	raftState         = "raft/"
 	raftLogCacheSize  = 512
 	snapshotsRetained = 2
+	// partitionMetadataFile holds the topic ID in each partition's directory.
+	partitionMetadataFile = "partition.metadata"
+	// quarantineDir holds partition data whose topic IDs didn't match their
+	// topics', outside the data dir so it isn't served or cleaned.
+	quarantineDir = "quarantine"
 )
 
 func init() {
@@ -65,16 +72,46 @@ type Broker struct {
 	// ready to serve consistent reads, after it has applied its initial
 	// barrier. This is updated atomically.
 	readyForConsistentReads int32
+	// logDirFailed is set when a write to or sync of a partition's log
+	// failed, after which the data dir's offline. This is updated atomically.
+	logDirFailed int32
 	// brokerLookup tracks servers in the local datacenter.
-	brokerLookup  *brokerLookup
+	brokerLookup *brokerLookup
+	// peers sends requests to the other brokers.
+	peers         *brokerClient
 	replicaLookup *replicaLookup
-	// The raft instance is used among Jocko brokers within the DC to protect operations that require strong consistency.
-	raft          *raft.Raft
-	raftStore     *raftboltdb.BoltStore
-	raftTransport *raft.NetworkTransport
-	raftInmem     *raft.InmemStore
-	// raftNotifyCh ensures we get reliable leader transition notifications from the raft layer.
-	raftNotifyCh <-chan bool
+	shareGroups   *shareGroups
+	throttles     *produceThrottles
+	delayedJoins  *delayedJoins
+	traffic       *trafficStats
+	sampler       *recordSampler
+	verifier      *fetchVerifier
+	// leaderChanges queues the controller's partition leadership changes.
+	leaderChanges leaderChanges
+	// decompressed caches the message sets decompressed by filtered fetches.
+	decompressed *decompressionCache
+	// offsets reads back the offsets committed to the offsets topic's
+	// partitions this broker leads.
+	offsets *offsetStore
+	hooks   hooks
+	fds     *commitlog.FDCache
+	// appends schedule produce appends fairly between the partitions of each
+	// data dir, keyed by the dir, nil if they're appended on the request's
+	// goroutine.
+	appends map[string]*appendQueue
+	// interBrokerTLS secures the connections to and from other brokers if
+	// it's set.
+	interBrokerTLS *tls.Config
+	// faults is nil unless the broker's built with the faultinject tag.
+	faults *faultInjector
+	// dirLock is the data dir's lock file, held while the broker runs.
+	dirLock *os.File
+	// store replicates and applies metadata changes, with raft unless the
+	// broker runs standalone or was given another store.
+	store MetadataStore
+	// cluster is the store when the broker's part of a cluster, through
+	// which it manages the cluster's membership. It's nil when standalone.
+	cluster ClusterMetadataStore
 	// reconcileCh is used to pass events from the serf handler to the raft leader to update its state.
 	reconcileCh      chan serf.Member
 	serf             *serf.Serf
@@ -84,6 +121,23 @@ type Broker struct {
 
 	tracer opentracing.Tracer
 
+	// recovered is set once the logs are known to be intact, i.e. the broker
+	// shut down cleanly last time or its logs have been recovered.
+	recovered bool
+
+	// namespaces are the tenants' namespaces, only their principals can see
+	// and use their topics and groups.
+	namespaces namespaces
+	// runner runs the broker's background goroutines and stops them on
+	// shutdown.
+	runner *runner
+	// eventsCh queues the cluster events to publish.
+	eventsCh chan ClusterEvent
+
+	// ctx is canceled when the broker shuts down, for the requests it sends
+	// that aren't for a request it's handling.
+	ctx          context.Context
+	cancel       context.CancelFunc
 	shutdownCh   chan struct{}
 	shutdown     bool
 	shutdownLock sync.Mutex
@@ -91,33 +145,177 @@ type Broker struct {
 
 // New is used to instantiate a new broker.
 func NewBroker(config *config.Config, tracer opentracing.Tracer) (*Broker, error) {
+	return newBroker(config, tracer, nil)
+}
+
+func newBroker(config *config.Config, tracer opentracing.Tracer, newStore MetadataStoreFactory) (*Broker, error) {
 	b := &Broker{
 		config:           config,
 		shutdownCh:       make(chan struct{}),
 		eventChLAN:       make(chan serf.Event, 256),
 		brokerLookup:     NewBrokerLookup(),
 		replicaLookup:    NewReplicaLookup(),
+		shareGroups:      newShareGroups(config.ShareRecordLockDuration, config.ShareMaxDeliveryCount),
+		throttles:        newProduceThrottles(),
+		delayedJoins:     newDelayedJoins(),
+		traffic:          newTrafficStats(),
+		sampler:          newRecordSampler(config.ProduceSampleRate),
+		verifier:         newFetchVerifier(config.FetchVerifyRate),
+		faults:           newFaultInjector(),
+		runner:           newRunner(),
+		eventsCh:         make(chan ClusterEvent, clusterEventsBuffer),
 		reconcileCh:      make(chan serf.Member, 32),
 		tracer:           tracer,
 		logStateInterval: time.Millisecond * 250,
 	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	// the append workers append and clean the partitions' logs and are
+	// stopped last so whatever's still appending, e.g. the group lag export,
+	// can finish. The serf event handler hands members to the leader loop to
+	// reconcile so it stops first.
+	b.runner.add("append workers")
+	b.runner.add("replica fetchers")
+	b.runner.add("delay queues")
+	// staged records are drained on the append workers
+	b.runner.add("burst buffers", "append workers")
+	b.runner.add("join purgatory")
+	b.runner.add("cluster events", "append workers")
+	// the controller's events are published before shutdown stops
+	// publishing them
+	b.runner.add("leadership", "cluster events")
+	b.runner.add("serf events", "leadership")
+	b.runner.add("group lag export", "append workers", "delay queues")
+	b.runner.add("offsets expiry", "append workers", "delay queues")
+	b.runner.add("offsets snapshots")
+	b.runner.add("state logger")
+	b.runner.add("heat map")
+	b.runner.add("cache warming")
+	b.runner.add("record sampler")
+	b.runner.run("join purgatory", "delayed joins", b.runDelayedJoins)
+
+	// from here on the broker's shut down on errors, which stops what's been
+	// started and releases the data dir's lock once it's taken
+	b.peers = newBrokerClient(config.ID, b.brokerLookup)
+	if config.InterBrokerTLS != nil {
+		if err := validateInterBrokerTLS(config); err != nil {
+			b.Shutdown()
+			return nil, err
+		}
+		tlsConfig, err := interBrokerTLSConfig(config.InterBrokerTLS)
+		if err != nil {
+			b.Shutdown()
+			return nil, err
+		}
+		b.interBrokerTLS = tlsConfig
+		b.peers.dialer.TLS = tlsConfig
+	}
+	b.decompressed = newDecompressionCache(config.FetchDecompressionCacheBytes)
+	b.offsets = newOffsetStore(func(partition int32) string {
+		return b.partitionDir(OffsetsTopicName, partition)
+	})
+
+	if config.MaxOpenSegmentFiles > 0 {
+		b.fds = commitlog.NewFDCache(config.MaxOpenSegmentFiles)
+	}
+
+	if err := validateConfigProfiles(config.TopicConfigProfiles); err != nil {
+		b.Shutdown()
+		return nil, err
+	}
 
-	if err := b.setupRaft(); err != nil {
+	if err := ValidateDisabledAPIs(config.DisabledAPIs); err != nil {
 		b.Shutdown()
-		return nil, fmt.Errorf("start raft: %v", err)
+		return nil, err
 	}
 
 	var err error
+	if b.namespaces, err = newNamespaces(config.Namespaces); err != nil {
+		b.Shutdown()
+		return nil, err
+	}
+
+	if err := b.lockDataDir(); err != nil {
+		b.Shutdown()
+		return nil, err
+	}
+
+	if err := b.recoverLogs(); err != nil {
+		b.Shutdown()
+		return nil, fmt.Errorf("recover logs: %v", err)
+	}
+
+	if err := b.verifyManifests(); err != nil {
+		b.Shutdown()
+		return nil, fmt.Errorf("verify manifests: %v", err)
+	}
+
+	if config.AppendWorkers > 0 {
+		b.startAppendQueues()
+	}
+
+	if config.ProduceSampleRate > 0 {
+		b.runner.run("record sampler", "sample records", b.sampler.run)
+	}
+
+	if !config.DevMode && config.CacheWarmBytes > 0 && config.CacheWarmPartitions > 0 {
+		b.runner.run("heat map", "write heat maps", b.writeHeatMaps)
+		b.runner.run("cache warming", "warm page cache", b.warmPageCache)
+	}
+
+	if config.Standalone {
+		if err := b.setupStandalone(newStore); err != nil {
+			b.Shutdown()
+			return nil, fmt.Errorf("start standalone: %v", err)
+		}
+		b.runner.run("state logger", "log state", b.logState)
+		if config.GroupLagExportInterval > 0 {
+			b.runner.run("group lag export", "export group lag", b.exportGroupLag)
+		}
+		if config.OffsetsRetentionCheckInterval > 0 {
+			b.runner.run("offsets expiry", "expire offsets", b.expireOffsets)
+		}
+		if config.OffsetsSnapshotInterval > 0 {
+			b.runner.run("offsets snapshots", "snapshot offsets", b.snapshotOffsets)
+		}
+		if config.PublishClusterEvents {
+			b.runner.run("cluster events", "publish cluster events", b.publishClusterEvents)
+		}
+		return b, nil
+	}
+
+	if err := b.setupCluster(newStore); err != nil {
+		b.Shutdown()
+		return nil, fmt.Errorf("start metadata store: %v", err)
+	}
+
 	b.serf, err = b.setupSerf(config.SerfLANConfig, b.eventChLAN, serfLANSnapshot)
 	if err != nil {
+		b.Shutdown()
 		return nil, err
 	}
 
-	go b.lanEventHandler()
+	b.runner.run("serf events", "lan event handler", b.lanEventHandler)
+
+	b.runner.run("leadership", "monitor leadership", b.monitorLeadership)
+
+	b.runner.run("state logger", "log state", b.logState)
+
+	if config.GroupLagExportInterval > 0 {
+		b.runner.run("group lag export", "export group lag", b.exportGroupLag)
+	}
+
+	if config.OffsetsRetentionCheckInterval > 0 {
+		b.runner.run("offsets expiry", "expire offsets", b.expireOffsets)
+	}
 
-	go b.monitorLeadership()
+	if config.OffsetsSnapshotInterval > 0 {
+		b.runner.run("offsets snapshots", "snapshot offsets", b.snapshotOffsets)
+	}
 
-	go b.logState()
+	if config.PublishClusterEvents {
+		b.runner.run("cluster events", "publish cluster events", b.publishClusterEvents)
+	}
 
 	return b, nil
 }
@@ -126,6 +324,7 @@ func NewBroker(config *config.Config, tracer opentracing.Tracer) (*Broker, error
 
 // Run starts a loop to handle requests send back responses.
 func (b *Broker) Run(ctx context.Context, requests <-chan *Context, responses chan<- *Context) {
+	b.hooks.runStarted()
 	for {
 		select {
 		case reqCtx := <-requests:
@@ -140,11 +339,26 @@ func (b *Broker) Run(ctx context.Context, requests <-chan *Context, responses ch
 				queueSpan.Finish()
 			}
 
+			if b.delayRead(reqCtx, responses) {
+				continue
+			}
+
 			var res protocol.ResponseBody
 
 			switch req := reqCtx.req.(type) {
 			case *protocol.ProduceRequest:
-				res = b.handleProduce(reqCtx, req)
+				produceRes, wait := b.handleProduce(reqCtx, req, nil)
+				if b.holdProduce(reqCtx, produceRes, produceRes, wait, req.Timeout, responses) {
+					continue
+				}
+				res = produceRes
+			case *protocol.TransactionalProduceRequest:
+				produceRes, wait := b.handleProduce(reqCtx, req.Produce, req)
+				txnRes := &protocol.TransactionalProduceResponse{APIVersion: req.Version(), Produce: produceRes}
+				if b.holdProduce(reqCtx, txnRes, produceRes, wait, req.Produce.Timeout, responses) {
+					continue
+				}
+				res = txnRes
 			case *protocol.FetchRequest:
 				res = b.handleFetch(reqCtx, req)
 			case *protocol.OffsetsRequest:
@@ -166,6 +380,9 @@ func (b *Broker) Run(ctx context.Context, requests <-chan *Context, responses ch
 			case *protocol.FindCoordinatorRequest:
 				res = b.handleFindCoordinator(reqCtx, req)
 			case *protocol.JoinGroupRequest:
+				if b.delayJoin(reqCtx, req, responses) {
+					continue
+				}
 				res = b.handleJoinGroup(reqCtx, req)
 			case *protocol.HeartbeatRequest:
 				res = b.handleHeartbeat(reqCtx, req)
@@ -185,21 +402,55 @@ func (b *Broker) Run(ctx context.Context, requests <-chan *Context, responses ch
 				res = b.handleCreateTopic(reqCtx, req)
 			case *protocol.DeleteTopicsRequest:
 				res = b.handleDeleteTopics(reqCtx, req)
+			case *protocol.NackRequest:
+				res = b.handleNack(reqCtx, req)
+			case *protocol.FilteredFetchRequest:
+				res = b.handleFilteredFetch(reqCtx, req)
+			case *protocol.ShareFetchRequest:
+				res = b.handleShareFetch(reqCtx, req)
+			case *protocol.ShareAcknowledgeRequest:
+				res = b.handleShareAcknowledge(reqCtx, req)
+			case *protocol.AlterConfigsRequest:
+				res = b.handleAlterConfigs(reqCtx, req)
+			case *protocol.DescribeConfigsRequest:
+				res = b.handleDescribeConfigs(reqCtx, req)
+			case *protocol.SaslAuthenticateRequest:
+				res = b.handleSaslAuthenticate(reqCtx, req)
+			case *protocol.CreateDelegationTokenRequest:
+				res = b.handleCreateDelegationToken(reqCtx, req)
+			case *protocol.RenewDelegationTokenRequest:
+				res = b.handleRenewDelegationToken(reqCtx, req)
+			case *protocol.ExpireDelegationTokenRequest:
+				res = b.handleExpireDelegationToken(reqCtx, req)
+			case *protocol.DescribeDelegationTokenRequest:
+				res = b.handleDescribeDelegationToken(reqCtx, req)
+			case *protocol.InitProducerIDRequest:
+				res = b.handleInitProducerID(reqCtx, req)
+			case *protocol.EndTxnRequest:
+				res = b.handleEndTxn(reqCtx, req)
+			case *protocol.TxnOffsetCommitRequest:
+				res = b.handleTxnOffsetCommit(reqCtx, req)
+			case *protocol.WriteTxnMarkersRequest:
+				res = b.handleWriteTxnMarkers(reqCtx, req)
+			case *protocol.DescribeTrafficRequest:
+				res = b.handleDescribeTraffic(reqCtx, req)
+			case *protocol.AlterPartitionReadOnlyRequest:
+				res = b.handleAlterPartitionReadOnly(reqCtx, req)
+			case *protocol.AlterBrokerMaintenanceRequest:
+				res = b.handleAlterBrokerMaintenance(reqCtx, req)
+			case *protocol.AlterFaultInjectionRequest:
+				res = b.handleAlterFaultInjection(reqCtx, req)
+			case *protocol.AlterOffsetsTopicPartitionsRequest:
+				res = b.handleAlterOffsetsTopicPartitions(reqCtx, req)
+			case *protocol.DescribeClockRequest:
+				res = b.handleDescribeClock(reqCtx, req)
+			case *protocol.DescribeLogStatsRequest:
+				res = b.handleDescribeLogStats(reqCtx, req)
+			case *protocol.ReadIndexRequest:
+				res = b.handleReadIndex(reqCtx, req)
 			}
 
-			parentSpan := opentracing.SpanFromContext(reqCtx)
-			queueSpan = b.tracer.StartSpan("broker: queue response", opentracing.ChildOf(parentSpan.Context()))
-			responseCtx := context.WithValue(reqCtx, responseQueueSpanKey, queueSpan)
-
-			responses <- &Context{
-				parent: responseCtx,
-				conn:   reqCtx.conn,
-				header: reqCtx.header,
-				res: &protocol.Response{
-					CorrelationID: reqCtx.header.CorrelationID,
-					Body:          res,
-				},
-			}
+			b.respond(reqCtx, res, responses)
 		case <-ctx.Done():
 			goto DONE
 		}
@@ -209,9 +460,31 @@ DONE:
 	return
 }
 
+// respond sends the response to the request.
+func (b *Broker) respond(reqCtx *Context, res protocol.ResponseBody, responses chan<- *Context) {
+	parentSpan := opentracing.SpanFromContext(reqCtx)
+	queueSpan := b.tracer.StartSpan("broker: queue response", opentracing.ChildOf(parentSpan.Context()))
+	responseCtx := context.WithValue(reqCtx, responseQueueSpanKey, queueSpan)
+
+	responses <- &Context{
+		parent: responseCtx,
+		conn:   reqCtx.conn,
+		client: reqCtx.client,
+		header: reqCtx.header,
+		req:    reqCtx.req,
+		res: &protocol.Response{
+			CorrelationID: reqCtx.header.CorrelationID,
+			Body:          res,
+		},
+	}
+}
+
 // Join is used to have the broker join the gossip ring.
 // The given address should be another broker listening on the Serf address.
 func (b *Broker) JoinLAN(addrs ...string) protocol.Error {
+	if b.serf == nil {
+		return protocol.ErrUnknown.WithErr(errors.New("standalone broker can't join a cluster"))
+	}
 	if _, err := b.serf.Join(addrs, true); err != nil {
 		return protocol.ErrUnknown.WithErr(err)
 	}
@@ -238,7 +511,10 @@ var apiVersions = &protocol.APIVersionsResponse{APIVersions: protocol.APIVersion
 func (b *Broker) handleAPIVersions(ctx *Context, req *protocol.APIVersionsRequest) *protocol.APIVersionsResponse {
 	sp := span(ctx, b.tracer, "api versions")
 	defer sp.Finish()
-	return apiVersions
+	res := *apiVersions
+	res.APIVersion = req.Version()
+	res.APIVersions = enabledAPIVersions(b.config.DisabledAPIs)
+	return &res
 }
 
 func (b *Broker) handleCreateTopic(ctx *Context, reqs *protocol.CreateTopicRequests) *protocol.CreateTopicsResponse {
@@ -257,14 +533,27 @@ func (b *Broker) handleCreateTopic(ctx *Context, reqs *protocol.CreateTopicReque
 			}
 			continue
 		}
-		if req.ReplicationFactor > int16(len(b.LANMembers())) {
+		err := protocol.ErrNone
+		if !b.authorized(ctx, policy.CreateOperation, policy.TopicResource, req.Topic) {
+			err = protocol.ErrTopicAuthorizationFailed
+		}
+		if err == protocol.ErrNone {
+			err = b.applyConfigProfile(req)
+		}
+		if err == protocol.ErrNone {
+			b.applyNamespaceConfigs(req)
+			err = b.validateCreateTopic(req)
+		}
+		if err != protocol.ErrNone {
+			msg := err.Error()
 			res.TopicErrorCodes[i] = &protocol.TopicErrorCode{
-				Topic:     req.Topic,
-				ErrorCode: protocol.ErrInvalidReplicationFactor.Code(),
+				Topic:        req.Topic,
+				ErrorCode:    err.Code(),
+				ErrorMessage: &msg,
 			}
 			continue
 		}
-		err := b.withTimeout(reqs.Timeout, func() protocol.Error {
+		err = b.withTimeout(ctx, reqs.Timeout, func(ctx *Context) protocol.Error {
 			return b.createTopic(ctx, req)
 		})
 		res.TopicErrorCodes[i] = &protocol.TopicErrorCode{
@@ -276,6 +565,123 @@ func (b *Broker) handleCreateTopic(ctx *Context, reqs *protocol.CreateTopicReque
 	return res
 }
 
+// validateCreateTopic checks the request against the create topic policy.
+func (b *Broker) validateCreateTopic(req *protocol.CreateTopicRequest) protocol.Error {
+	if err := b.validateTopicLayout(req); err != protocol.ErrNone {
+		log.Info.Printf("broker/%d: create topic %s rejected: %s", b.config.ID, req.Topic, err)
+		return err
+	}
+	if b.config.CreateTopicPolicy == nil {
+		return protocol.ErrNone
+	}
+	err := b.config.CreateTopicPolicy.ValidateCreateTopic(&policy.CreateTopicRequest{
+		Topic:             req.Topic,
+		NumPartitions:     req.NumPartitions,
+		ReplicationFactor: req.ReplicationFactor,
+		Configs:           configValues(req.Configs),
+	})
+	if err != nil {
+		log.Info.Printf("broker/%d: create topic %s rejected by policy: %s", b.config.ID, req.Topic, err)
+		return protocol.ErrPolicyViolation.WithErr(err)
+	}
+	return protocol.ErrNone
+}
+
+func configValues(configs map[string]*string) map[string]string {
+	values := make(map[string]string, len(configs))
+	for name, value := range configs {
+		if value != nil {
+			values[name] = *value
+		}
+	}
+	return values
+}
+
+func (b *Broker) handleAlterConfigs(ctx *Context, req *protocol.AlterConfigsRequest) *protocol.AlterConfigsResponse {
+	sp := span(ctx, b.tracer, "alter configs")
+	defer sp.Finish()
+	res := new(protocol.AlterConfigsResponse)
+	res.APIVersion = req.Version()
+	isController := b.isController()
+	for _, resource := range req.Resources {
+		err := protocol.ErrNone
+		switch {
+		case resource.Type != protocol.TopicResourceType:
+			err = protocol.ErrInvalidRequest.WithErr(fmt.Errorf("only topic configs can be altered"))
+		case !b.authorized(ctx, policy.AlterOperation, policy.TopicResource, resource.Name):
+			err = protocol.ErrTopicAuthorizationFailed
+		case !isController:
+			err = protocol.ErrNotController
+		default:
+			err = b.alterTopicConfigs(resource, req.ValidateOnly)
+		}
+		rres := protocol.AlterConfigResourceResponse{
+			ErrorCode: err.Code(),
+			Type:      resource.Type,
+			Name:      resource.Name,
+		}
+		if err != protocol.ErrNone {
+			msg := err.Error()
+			rres.ErrorMessage = &msg
+		}
+		res.Resources = append(res.Resources, rres)
+	}
+	return res
+}
+
+// alterTopicConfigs validates the configs against the alter configs policy and
+// sets them as the topic's config. Like Kafka's AlterConfigs it replaces the
+// topic's config, so configs the request doesn't set go back to their defaults.
+func (b *Broker) alterTopicConfigs(resource protocol.AlterConfigsResource, validateOnly bool) protocol.Error {
+	_, topic, err := b.fsm.State().GetTopic(resource.Name)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	configs := make(map[string]*string, len(resource.Entries))
+	for _, e := range resource.Entries {
+		configs[e.Name] = e.Value
+	}
+	if b.config.AlterConfigsPolicy != nil {
+		err := b.config.AlterConfigsPolicy.ValidateAlterConfigs(&policy.AlterConfigsRequest{
+			Topic:   topic.Topic,
+			Configs: configValues(configs),
+		})
+		if err != nil {
+			log.Info.Printf("broker/%d: alter configs of %s rejected by policy: %s", b.config.ID, topic.Topic, err)
+			return protocol.ErrPolicyViolation.WithErr(err)
+		}
+	}
+	config := structs.NewTopicConfig()
+	for name, value := range configValues(configs) {
+		if err := config.SetString(name, value); err != nil {
+			return protocol.ErrInvalidConfig.WithErr(err)
+		}
+	}
+	if _, err := recordValidators(config); err != nil {
+		return protocol.ErrInvalidConfig.WithErr(err)
+	}
+	if validateOnly {
+		return protocol.ErrNone
+	}
+	resp, err := b.raftApply(structs.SetTopicConfigRequestType, structs.SetTopicConfigRequest{
+		Topic:  topic.Topic,
+		Config: config,
+	})
+	if err == nil {
+		err, _ = resp.(error)
+	}
+	if err == fsm.ErrUnknownTopic {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	return protocol.ErrNone
+}
+
 func (b *Broker) handleDeleteTopics(ctx *Context, reqs *protocol.DeleteTopicsRequest) *protocol.DeleteTopicsResponse {
 	sp := span(ctx, b.tracer, "delete topics")
 	defer sp.Finish()
@@ -291,7 +697,14 @@ func (b *Broker) handleDeleteTopics(ctx *Context, reqs *protocol.DeleteTopicsReq
 			}
 			continue
 		}
-		err := b.withTimeout(reqs.Timeout, func() protocol.Error {
+		if !b.authorized(ctx, policy.DeleteOperation, policy.TopicResource, topic) {
+			res.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:     topic,
+				ErrorCode: protocol.ErrTopicAuthorizationFailed.Code(),
+			}
+			continue
+		}
+		err := b.withTimeout(ctx, reqs.Timeout, func(ctx *Context) protocol.Error {
 			// TODO: this will delete from fsm -- need to delete associated partitions, etc.
 			_, err := b.raftApply(structs.DeregisterTopicRequestType, structs.DeregisterTopicRequest{
 				structs.Topic{
@@ -301,6 +714,7 @@ func (b *Broker) handleDeleteTopics(ctx *Context, reqs *protocol.DeleteTopicsReq
 			if err != nil {
 				return protocol.ErrUnknown.WithErr(err)
 			}
+			b.publishEvent(ClusterEvent{Type: TopicDeleted, Topic: topic})
 			return protocol.ErrNone
 		})
 		res.TopicErrorCodes[i] = &protocol.TopicErrorCode{
@@ -326,7 +740,6 @@ func (b *Broker) handleLeaderAndISR(ctx *Context, req *protocol.LeaderAndISRRequ
 		}
 	}
 	for i, p := range req.PartitionStates {
-		// TODO: need to replace the replica regardless
 		replica := &Replica{
 			BrokerID: b.config.ID,
 			Partition: structs.Partition{
@@ -341,6 +754,17 @@ func (b *Broker) handleLeaderAndISR(ctx *Context, req *protocol.LeaderAndISRRequ
 			},
 			IsLocal: true,
 		}
+		if old, err := b.replicaLookup.Replica(p.Topic, p.Partition); err == nil {
+			// the new replica takes over the old one's log, and starts what
+			// else it runs over for its role. The old one's told its new
+			// leader first so, if it isn't this broker, records staged in
+			// its burst buffer are failed rather than appended.
+			old.Lock()
+			old.Partition.Leader = p.Leader
+			old.Unlock()
+			b.stopReplica(old, false)
+			replica.Log = old.Log
+		}
 		b.replicaLookup.AddReplica(replica)
 
 		if p.Leader == b.config.ID && (replica.Partition.Leader == b.config.ID) {
@@ -355,6 +779,7 @@ func (b *Broker) handleLeaderAndISR(ctx *Context, req *protocol.LeaderAndISRRequ
 				setErr(i, p, err)
 				continue
 			}
+			b.hooks.runLeadershipChange(replica.Partition, true)
 		} else if contains(p.Replicas, b.config.ID) && (p.Leader != b.config.ID) {
 			// is command asking this broker to follow leader who it isn't a leader of already
 			if err := b.startReplica(replica); err != protocol.ErrNone {
@@ -366,6 +791,7 @@ func (b *Broker) handleLeaderAndISR(ctx *Context, req *protocol.LeaderAndISRRequ
 				setErr(i, p, err)
 				continue
 			}
+			b.hooks.runLeadershipChange(replica.Partition, false)
 		}
 		res.Partitions[i] = &protocol.LeaderAndISRPartition{Partition: p.Partition, Topic: p.Topic, ErrorCode: protocol.ErrNone.Code()}
 	}
@@ -385,40 +811,112 @@ func (b *Broker) handleOffsets(ctx *Context, req *protocol.OffsetsRequest) *prot
 		for _, p := range t.Partitions {
 			pres := new(protocol.PartitionResponse)
 			pres.Partition = p.Partition
+			if !b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, t.Topic) {
+				pres.ErrorCode = protocol.ErrTopicAuthorizationFailed.Code()
+				res.Responses[i].PartitionResponses = append(res.Responses[i].PartitionResponses, pres)
+				continue
+			}
 			replica, err := b.replicaLookup.Replica(t.Topic, p.Partition)
 			if err != nil {
 				// TODO: have replica lookup return an error with a code
 				pres.ErrorCode = protocol.ErrUnknown.Code()
+				res.Responses[i].PartitionResponses = append(res.Responses[i].PartitionResponses, pres)
 				continue
 			}
 			var offset int64
-			if p.Timestamp == -2 {
+			timestamp := int64(-1)
+			switch p.Timestamp {
+			case -2:
 				offset = replica.Log.OldestOffset()
-			} else {
+			case -1:
 				// TODO: this is nil because i'm not sending the leader and isr requests telling the new leader to start the replica and instantiate the log...
 				offset = replica.Log.NewestOffset()
+			default:
+				l, ok := replica.Log.(interface {
+					OffsetForTime(int64) (int64, int64)
+				})
+				if !ok {
+					pres.ErrorCode = protocol.ErrUnsupportedForMessageFormat.Code()
+					res.Responses[i].PartitionResponses = append(res.Responses[i].PartitionResponses, pres)
+					continue
+				}
+				offset, timestamp = l.OffsetForTime(p.Timestamp)
 			}
 			pres.Offsets = []int64{offset}
+			if req.Version() >= 1 {
+				pres.Offset = offset
+				pres.Timestamp = time.Unix(0, timestamp*int64(time.Millisecond))
+			}
 			res.Responses[i].PartitionResponses = append(res.Responses[i].PartitionResponses, pres)
 		}
 	}
 	return res
 }
 
-func (b *Broker) handleProduce(ctx *Context, req *protocol.ProduceRequest) *protocol.ProduceResponse {
+// holdProduce responds to the produce off the run loop, once the records
+// staged in burst buffers are appended and the response has been held for its
+// throttle time, and returns whether it will. Otherwise the response can be
+// sent right away.
+func (b *Broker) holdProduce(ctx *Context, res protocol.ResponseBody, produceRes *protocol.ProduceResponse, wait func(), timeout time.Duration, responses chan<- *Context) bool {
+	if wait == nil && produceRes.ThrottleTime <= 0 {
+		return false
+	}
+	go func() {
+		if wait != nil {
+			wait()
+		}
+		b.holdThrottled(ctx, produceRes.ThrottleTime, timeout)
+		b.respond(ctx, res, responses)
+	}()
+	return true
+}
+
+// handleProduce appends the request's records, in the transaction of the
+// producer's session if it's sent in a transactional produce request. If any
+// are staged in burst buffers, it also returns a func that waits for them to
+// be appended and fills in their partitions' responses, which mustn't be sent
+// until it returns.
+func (b *Broker) handleProduce(ctx *Context, req *protocol.ProduceRequest, txn *protocol.TransactionalProduceRequest) (*protocol.ProduceResponse, func()) {
 	sp := span(ctx, b.tracer, "produce")
 	defer sp.Finish()
 	res := new(protocol.ProduceResponse)
 	res.APIVersion = req.Version()
 	res.Responses = make([]*protocol.ProduceTopicResponse, len(req.TopicData))
+	// the appends may run in the background if the request has no timeout
+	var throttleMu sync.Mutex
+	var waits []func()
 	log.Debug.Printf("broker/%d: produce: %#v", b.config.ID, req)
+	if txn != nil {
+		err := protocol.ErrInvalidRequest
+		if req.TransactionalID != nil && *req.TransactionalID != "" {
+			err = b.addTransactionPartitions(*req.TransactionalID, txn.ProducerID, txn.ProducerEpoch, req.TopicData)
+		}
+		if err != protocol.ErrNone {
+			log.Error.Printf("broker/%d: add transaction partitions error: %s", b.config.ID, err)
+			for i, td := range req.TopicData {
+				tres := make([]*protocol.ProducePartitionResponse, len(td.Data))
+				for j, p := range td.Data {
+					tres[j] = &protocol.ProducePartitionResponse{Partition: p.Partition, ErrorCode: err.Code()}
+				}
+				res.Responses[i] = &protocol.ProduceTopicResponse{Topic: td.Topic, PartitionResponses: tres}
+			}
+			return res, nil
+		}
+	}
 	for i, td := range req.TopicData {
 		log.Debug.Printf("broker/%d: produce to partition: %d: %v", b.config.ID, i, td)
 		tres := make([]*protocol.ProducePartitionResponse, len(td.Data))
 		for j, p := range td.Data {
-			pres := &protocol.ProducePartitionResponse{}
+			// the offsets are -1 unless the records are appended
+			pres := &protocol.ProducePartitionResponse{BaseOffset: -1, LogStartOffset: -1}
 			pres.Partition = p.Partition
-			err := b.withTimeout(req.Timeout, func() protocol.Error {
+			var stagedMu sync.Mutex
+			var staged *stagedRecords
+			var stagedReplica *Replica
+			err := b.withTimeout(ctx, req.Timeout, func(ctx *Context) protocol.Error {
+				if !b.authorized(ctx, policy.WriteOperation, policy.TopicResource, td.Topic) {
+					return protocol.ErrTopicAuthorizationFailed
+				}
 				state := b.fsm.State()
 				_, t, err := state.GetTopic(td.Topic)
 				if err != nil {
@@ -429,22 +927,108 @@ func (b *Broker) handleProduce(ctx *Context, req *protocol.ProduceRequest) *prot
 					log.Error.Printf("broker/%d: produce to partition error: unknown topic", b.config.ID)
 					return protocol.ErrUnknownTopicOrPartition
 				}
+				if brokers, _ := mirrorSource(t); len(brokers) > 0 {
+					return protocol.ErrPolicyViolation.WithErr(fmt.Errorf("topic %s is a read-only mirror", td.Topic))
+				}
 				replica, err := b.replicaLookup.Replica(td.Topic, p.Partition)
 				if err != nil || replica == nil || replica.Log == nil {
 					log.Error.Printf("broker/%d: produce to partition error: %s", b.config.ID, err)
 					pres.Partition = p.Partition
 					return protocol.ErrReplicaNotAvailable
 				}
-				offset, appendErr := replica.Log.Append(p.RecordSet)
-				if appendErr != nil {
-					log.Error.Printf("broker/%d: log append error: %s", b.config.ID, err)
-					return protocol.ErrUnknown
+				if replica.Partition.Leader != b.config.ID {
+					pres.CurrentLeader = b.currentLeader(td.Topic, p.Partition)
+					return protocol.ErrNotLeaderForPartition
+				}
+				if b.logDirOffline() {
+					return protocol.ErrKafkaStorageError
+				}
+				// leader not available is retriable and has producers
+				// look the leader up again, so they pick up the partition's
+				// new leader after a reassignment cutover and back off
+				// until it's writable otherwise
+				if _, part, err := state.GetPartition(td.Topic, p.Partition); err == nil && part != nil && part.ReadOnly {
+					msg := fmt.Sprintf("partition %s-%d is read-only", td.Topic, p.Partition)
+					pres.ErrorMessage = &msg
+					return protocol.ErrLeaderNotAvailable
 				}
+				if recordErr, err := b.validateTransactional(req, txn, td.Topic, p.Partition, p.RecordSet); err != protocol.ErrNone {
+					if recordErr != nil {
+						pres.RecordErrors = []*protocol.RecordError{recordErr}
+						pres.ErrorMessage = recordErr.BatchIndexErrorMessage
+					}
+					return err
+				}
+				if recordErr := b.validateRecords(t, p.RecordSet); recordErr != nil {
+					pres.RecordErrors = []*protocol.RecordError{recordErr}
+					pres.ErrorMessage = recordErr.BatchIndexErrorMessage
+					return protocol.ErrInvalidRecord
+				}
+				if recordErr := validateTimestamps(t.Config, p.RecordSet, time.Now()); recordErr != nil {
+					pres.RecordErrors = []*protocol.RecordError{recordErr}
+					pres.ErrorMessage = recordErr.BatchIndexErrorMessage
+					return protocol.ErrInvalidTimestamp
+				}
+				recordSet, recordErr := b.interceptAppend(&AppendInfo{Topic: td.Topic, Partition: p.Partition, Client: ctx.Client()}, p.RecordSet)
+				if recordErr != nil {
+					pres.RecordErrors = []*protocol.RecordError{recordErr}
+					pres.ErrorMessage = recordErr.BatchIndexErrorMessage
+					return protocol.ErrInvalidRecord
+				}
+				// the producer's told the request timed out unless it's
+				// committed first, and will retry, so the records aren't
+				// appended twice
+				if !ctx.commit() {
+					return protocol.ErrRequestTimedOut
+				}
+				if t.Config.GetInt64("produce.burst.buffer.bytes") > 0 {
+					b.startBurstBuffer(replica)
+				}
+				offset, s, appendErr := b.appendRecords(ctx, replica, recordSet)
+				if appendErr != protocol.ErrNone {
+					return appendErr
+				}
+				if s != nil {
+					stagedMu.Lock()
+					staged, stagedReplica = s, replica
+					stagedMu.Unlock()
+				}
+				b.traffic.record(td.Topic, p.Partition, ctx.Client().ID(), int64(len(p.RecordSet)), 0, time.Now())
+				b.sampler.sample(td.Topic, recordSet)
+				throttle := b.throttles.record(td.Topic, t.Config.GetInt64("produce.byte.rate"), len(p.RecordSet), time.Now())
+				if nsThrottle := b.throttleNamespace(td.Topic, len(p.RecordSet), time.Now()); nsThrottle > throttle {
+					throttle = nsThrottle
+				}
+				throttleMu.Lock()
+				if throttle > res.ThrottleTime {
+					res.ThrottleTime = throttle
+				}
+				throttleMu.Unlock()
 				pres.BaseOffset = offset
-				pres.LogAppendTime = time.Now()
+				pres.LogStartOffset = replica.Log.OldestOffset()
+				if t.Config.GetString("message.timestamp.type") == "LogAppendTime" {
+					pres.LogAppendTime = time.Now()
+				}
 				return protocol.ErrNone
 			})
 			pres.ErrorCode = err.Code()
+			if err == protocol.ErrNotLeaderForPartition {
+				res.NodeEndpoints = b.addLeaderEndpoint(res.NodeEndpoints, pres.CurrentLeader.LeaderID)
+			}
+			stagedMu.Lock()
+			if err == protocol.ErrNone && staged != nil {
+				topic, staged, replica := td.Topic, staged, stagedReplica
+				waits = append(waits, func() {
+					offset, err := b.waitStaged(ctx, replica, staged)
+					pres.BaseOffset = offset
+					pres.ErrorCode = err.Code()
+					if err == protocol.ErrNotLeaderForPartition {
+						pres.CurrentLeader = b.currentLeader(topic, pres.Partition)
+						res.NodeEndpoints = b.addLeaderEndpoint(res.NodeEndpoints, pres.CurrentLeader.LeaderID)
+					}
+				})
+			}
+			stagedMu.Unlock()
 			tres[j] = pres
 		}
 		res.Responses[i] = &protocol.ProduceTopicResponse{
@@ -452,9 +1036,317 @@ func (b *Broker) handleProduce(ctx *Context, req *protocol.ProduceRequest) *prot
 			PartitionResponses: tres,
 		}
 	}
+	if len(waits) == 0 {
+		return res, nil
+	}
+	return res, func() {
+		for _, wait := range waits {
+			wait()
+		}
+	}
+}
+
+func (b *Broker) handleInitProducerID(ctx *Context, req *protocol.InitProducerIDRequest) *protocol.InitProducerIDResponse {
+	sp := span(ctx, b.tracer, "init producer id")
+	defer sp.Finish()
+	res := new(protocol.InitProducerIDResponse)
+	res.APIVersion = req.Version()
+	res.ProducerID = -1
+	res.ProducerEpoch = -1
+
+	var transactionalID string
+	if req.TransactionalID != nil {
+		transactionalID = *req.TransactionalID
+		if req.TransactionTimeout <= 0 || req.TransactionTimeout > b.config.TransactionMaxTimeout {
+			res.ErrorCode = protocol.ErrInvalidTransactionTimeout.Code()
+			return res
+		}
+	}
+	out, err := b.raftApply(structs.InitProducerRequestType, structs.InitProducerRequest{
+		TransactionalID:    transactionalID,
+		TransactionTimeout: req.TransactionTimeout,
+	})
+	if err == nil {
+		if e, ok := out.(error); ok {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Error.Printf("broker/%d: init producer error: %s", b.config.ID, err)
+		res.ErrorCode = protocol.ErrUnknown.Code()
+		return res
+	}
+	producer := out.(*structs.InitProducerResponse)
+	if len(producer.Aborted) > 0 || len(producer.Committed) > 0 {
+		// the producer retries until its last transaction's finished
+		if err := b.finishTransaction(producer); err != protocol.ErrNone {
+			res.ErrorCode = err.Code()
+			return res
+		}
+	}
+	res.ProducerID = producer.Producer.ProducerID
+	res.ProducerEpoch = producer.Producer.ProducerEpoch
+	return res
+}
+
+// recordValidators returns the validators listed in the topic's
+// record.validators config.
+func recordValidators(config structs.TopicConfig) ([]policy.RecordValidator, error) {
+	var validators []policy.RecordValidator
+	for _, name := range strings.Split(config.GetString("record.validators"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		v, err := policy.Validator(name)
+		if err != nil {
+			return nil, err
+		}
+		validators = append(validators, v)
+	}
+	return validators, nil
+}
+
+// validateRecords runs the topic's record validators over the record set's
+// records, decompressing compressed messages to validate the records in them.
+// It returns the error for the first invalid record, with its index among the
+// record set's records, or nil if they're all valid.
+func (b *Broker) validateRecords(topic *structs.Topic, recordSet []byte) *protocol.RecordError {
+	validators, err := recordValidators(topic.Config)
+	if err != nil {
+		log.Error.Printf("broker/%d: record validators of %s error: %s", b.config.ID, topic.Topic, err)
+	}
+	if len(validators) == 0 {
+		return nil
+	}
+	var index int
+	validate := func(m commitlog.Message) *protocol.RecordError {
+		r := &policy.Record{Key: m.Key(), Value: m.Value()}
+		if m.MagicByte() > 0 {
+			r.Timestamp = time.Unix(0, m.Timestamp()*int64(time.Millisecond))
+		}
+		for _, v := range validators {
+			if err := v.ValidateRecord(topic.Topic, r); err != nil {
+				return newRecordError(index, err.Error())
+			}
+		}
+		index++
+		return nil
+	}
+	for _, ms := range commitlog.MessageSets(recordSet) {
+		for _, m := range ms.Messages() {
+			if !m.Compressed() {
+				if recordErr := validate(m); recordErr != nil {
+					return recordErr
+				}
+				continue
+			}
+			sets, err := m.DecompressLimit(maxDecompressedBytes)
+			if err != nil {
+				return newRecordError(index, fmt.Sprintf("decompress records failed: %s", err))
+			}
+			for _, inner := range sets {
+				for _, m := range inner.Messages() {
+					if recordErr := validate(m); recordErr != nil {
+						return recordErr
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// appendRecords appends the record set to the replica's log, or stages it if
+// the topic has a delivery delay and it isn't due yet, or a burst buffer with
+// room for it. Delayed records don't have an offset until they're released so
+// their offset is -1. Records staged in the burst buffer are returned to wait
+// on for their offset.
+func (b *Broker) appendRecords(ctx context.Context, replica *Replica, recordSet []byte) (int64, *stagedRecords, protocol.Error) {
+	if replica.delayQueue != nil {
+		staged, err := replica.delayQueue.Stage(recordSet)
+		if err != nil {
+			log.Error.Printf("broker/%d: stage delayed records error: %s", b.config.ID, err)
+			return 0, nil, protocol.ErrUnknown.WithErr(err)
+		}
+		if staged {
+			return -1, nil, protocol.ErrNone
+		}
+	}
+	if q := replica.burstBuffer; q != nil {
+		staged, err := q.Append(recordSet)
+		if err != nil {
+			return 0, nil, b.appendError(replica, err)
+		}
+		return -1, staged, protocol.ErrNone
+	}
+	offset, err := b.appendLog(ctx, replica, recordSet)
+	if err != nil {
+		return 0, nil, b.appendError(replica, err)
+	}
+	return offset, nil, protocol.ErrNone
+}
+
+// waitStaged waits for the records staged in the replica's burst buffer to be
+// appended and returns their offset. If ctx is done first, e.g. because the
+// request timed out, they're taken out of the buffer unless they're already
+// being appended.
+func (b *Broker) waitStaged(ctx context.Context, replica *Replica, staged *stagedRecords) (int64, protocol.Error) {
+	offset, err := staged.Wait(ctx)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return -1, protocol.ErrRequestTimedOut
+	}
+	if err != nil {
+		return -1, b.appendError(replica, err)
+	}
+	return offset, protocol.ErrNone
+}
+
+// appendError returns the error to respond with for a failed append to the
+// replica's log.
+func (b *Broker) appendError(replica *Replica, err error) protocol.Error {
+	switch err {
+	case protocol.ErrNotLeaderForPartition:
+		return protocol.ErrNotLeaderForPartition
+	case context.Canceled, context.DeadlineExceeded:
+		return protocol.ErrRequestTimedOut
+	}
+	log.Error.Printf("broker/%d: log append error: %s", b.config.ID, err)
+	if l, ok := replica.Log.(interface{ Failed() error }); ok && l.Failed() != nil {
+		b.failLogDir(l.Failed())
+		return protocol.ErrKafkaStorageError
+	}
+	return protocol.ErrUnknown
+}
+
+// startAppendQueues starts a pool of append workers for each data dir,
+// closed when the broker shuts down, so partitions only compete for the
+// workers of the disk they're on.
+func (b *Broker) startAppendQueues() {
+	queues := map[string]*appendQueue{
+		b.config.DataDir: newAppendQueue(b.config.AppendWorkers, b.config.AppendQuantumBytes),
+	}
+	closeQueues := func() {
+		for _, q := range queues {
+			q.close()
+		}
+	}
+	if !b.runner.run("append workers", "append queues", func(stop <-chan struct{}) {
+		<-stop
+		closeQueues()
+	}) {
+		closeQueues()
+		return
+	}
+	b.appends = queues
+}
+
+// partitionDataDir returns the data dir the partition's log is in.
+func (b *Broker) partitionDataDir(topic string, partition int32) string {
+	return filepath.Dir(filepath.Dir(b.partitionDir(topic, partition)))
+}
+
+// appendLog appends the record set to the replica's log, on its data dir's
+// append workers if the broker has them. It isn't appended if ctx is done
+// first.
+func (b *Broker) appendLog(ctx context.Context, replica *Replica, recordSet []byte) (int64, error) {
+	if q := b.appends[b.partitionDataDir(replica.Partition.Topic, replica.Partition.ID)]; q != nil {
+		return q.append(ctx, replica.Partition.Topic, replica.Partition.ID, len(recordSet), func() (int64, error) {
+			return replica.Log.Append(recordSet)
+		})
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return replica.Log.Append(recordSet)
+}
+
+// failLogDir takes the data dir offline after a partition's log failed, e.g.
+// because an fsync returned EIO. The OS may have dropped the dirty pages so
+// the dir's logs can't be trusted to have what they acknowledged, and the
+// broker stops serving produces and fetches until it's restarted and its
+// logs recovered.
+func (b *Broker) failLogDir(err error) {
+	if atomic.CompareAndSwapInt32(&b.logDirFailed, 0, 1) {
+		log.Error.Printf("broker/%d: log dir %s offline: %s", b.config.ID, b.config.DataDir, err)
+	}
+}
+
+// logDirOffline returns whether the data dir's been taken offline.
+func (b *Broker) logDirOffline() bool {
+	return atomic.LoadInt32(&b.logDirFailed) == 1
+}
+
+func (b *Broker) handleNack(ctx *Context, req *protocol.NackRequest) *protocol.NackResponse {
+	sp := span(ctx, b.tracer, "nack")
+	defer sp.Finish()
+	res := new(protocol.NackResponse)
+	res.APIVersion = req.Version()
+	res.Responses = make([]*protocol.NackTopicResponse, len(req.Topics))
+	for i, t := range req.Topics {
+		tres := &protocol.NackTopicResponse{
+			Topic:      t.Topic,
+			Partitions: make([]*protocol.NackPartitionResponse, len(t.Partitions)),
+		}
+		for j, p := range t.Partitions {
+			err, failed := protocol.ErrTopicAuthorizationFailed, p.Offsets
+			if b.authorized(ctx, policy.ReadOperation, policy.TopicResource, t.Topic) {
+				if err, failed = b.nack(t.Topic, p); err != protocol.ErrNone {
+					log.Error.Printf("broker/%d: nack %s-%d error: %s", b.config.ID, t.Topic, p.Partition, err)
+				}
+			}
+			tres.Partitions[j] = &protocol.NackPartitionResponse{
+				Partition:     p.Partition,
+				ErrorCode:     err.Code(),
+				FailedOffsets: failed,
+			}
+		}
+		res.Responses[i] = tres
+	}
 	return res
 }
 
+// nack routes the records at the nacked offsets to the topic's retry or
+// dead-letter topic. All of the records are read and routed before any are
+// produced, so a bad offset or policy fails the nack without routing any of
+// them. If producing one fails it stops there and returns the offsets that
+// weren't routed, so only they're nacked again rather than duplicating the
+// records before them.
+func (b *Broker) nack(topic string, p *protocol.NackPartition) (protocol.Error, []int64) {
+	replica, err := b.replicaLookup.Replica(topic, p.Partition)
+	if err != nil || replica == nil || replica.Log == nil {
+		return protocol.ErrUnknownTopicOrPartition, p.Offsets
+	}
+	if replica.Partition.Leader != b.config.ID {
+		return protocol.ErrNotLeaderForPartition, p.Offsets
+	}
+	targets := make([]string, len(p.Offsets))
+	recordSets := make([][]byte, len(p.Offsets))
+	for i, offset := range p.Offsets {
+		rdr, err := replica.Log.NewReader(offset, 0)
+		if err != nil {
+			return protocol.ErrOffsetOutOfRange.WithErr(err), p.Offsets
+		}
+		ms, err := commitlog.ReadMessageSet(rdr)
+		if err != nil {
+			return protocol.ErrOffsetOutOfRange.WithErr(err), p.Offsets
+		}
+		if ms.Offset() != offset {
+			return protocol.ErrOffsetOutOfRange, p.Offsets
+		}
+		target, recordSet, perr := b.routeNack(topic, p.Partition, ms, p.Reason)
+		if perr != protocol.ErrNone {
+			return perr, p.Offsets
+		}
+		targets[i], recordSets[i] = target, recordSet
+	}
+	for i := range p.Offsets {
+		if perr := b.produceTo(targets[i], p.Partition, recordSets[i]); perr != protocol.ErrNone {
+			return perr, p.Offsets[i:]
+		}
+	}
+	return protocol.ErrNone, nil
+}
+
 func (b *Broker) handleMetadata(ctx *Context, req *protocol.MetadataRequest) *protocol.MetadataResponse {
 	sp := span(ctx, b.tracer, "metadata")
 	defer sp.Finish()
@@ -523,23 +1415,36 @@ func (b *Broker) handleMetadata(ctx *Context, req *protocol.MetadataRequest) *pr
 				ISR:                p.ISR,
 			})
 		}
-		return &protocol.TopicMetadata{
+		tm := &protocol.TopicMetadata{
 			TopicErrorCode:    protocol.ErrNone.Code(),
 			Topic:             topic.Topic,
 			PartitionMetadata: partitionMetadata,
 		}
+		if req.Version() >= 10 {
+			tm.TopicID = topicID(topic)
+		}
+		return tm
 	}
-	if len(req.Topics) == 0 {
+	if len(req.Topics) == 0 && len(req.TopicIDs) == 0 {
 		// Respond with metadata for all topics
 		// how to handle err here?
 		_, topics, _ := state.GetTopics()
 		topicMetadata = make([]*protocol.TopicMetadata, 0, len(topics))
 		for _, topic := range topics {
+			// the topics the client can't describe are left out
+			if !b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, topic.Topic) {
+				continue
+			}
 			topicMetadata = append(topicMetadata, topicMetadataFn(topic, protocol.ErrNone))
 		}
 	} else {
 		topicMetadata = make([]*protocol.TopicMetadata, 0, len(req.Topics))
 		for _, topicName := range req.Topics {
+			// checked first so the client can't tell whether the topic exists
+			if !b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, topicName) {
+				topicMetadata = append(topicMetadata, topicMetadataFn(&structs.Topic{Topic: topicName}, protocol.ErrTopicAuthorizationFailed))
+				continue
+			}
 			_, topic, err := state.GetTopic(topicName)
 			if topic == nil {
 				topicMetadata = append(topicMetadata, topicMetadataFn(&structs.Topic{Topic: topicName}, protocol.ErrUnknownTopicOrPartition))
@@ -549,6 +1454,32 @@ func (b *Broker) handleMetadata(ctx *Context, req *protocol.MetadataRequest) *pr
 				topicMetadata = append(topicMetadata, topicMetadataFn(topic, protocol.ErrNone))
 			}
 		}
+		for _, id := range req.TopicIDs {
+			_, topic, err := state.GetTopicByID(uuid.UUID(id).String())
+			if topic != nil && !b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, topic.Topic) {
+				topicMetadata = append(topicMetadata, &protocol.TopicMetadata{TopicErrorCode: protocol.ErrTopicAuthorizationFailed.Code(), TopicID: id})
+			} else if topic == nil {
+				topicMetadata = append(topicMetadata, &protocol.TopicMetadata{TopicErrorCode: protocol.ErrUnknownTopicID.Code(), TopicID: id})
+			} else if err != nil {
+				topicMetadata = append(topicMetadata, &protocol.TopicMetadata{TopicErrorCode: protocol.ErrUnknown.Code(), TopicID: id})
+			} else {
+				topicMetadata = append(topicMetadata, topicMetadataFn(topic, protocol.ErrNone))
+			}
+		}
+	}
+	if staleness := b.metadataStaleness(); b.config.MetadataMaxStaleness > 0 && staleness > b.config.MetadataMaxStaleness {
+		// the topics may have moved since this broker last heard from the
+		// controller so have the client retry, likely with another broker
+		log.Info.Printf("broker/%d: metadata is %s stale, max is %s", b.config.ID, staleness, b.config.MetadataMaxStaleness)
+		for i, tm := range topicMetadata {
+			if tm.TopicErrorCode == protocol.ErrNone.Code() {
+				topicMetadata[i] = &protocol.TopicMetadata{
+					TopicErrorCode: protocol.ErrLeaderNotAvailable.Code(),
+					Topic:          tm.Topic,
+					TopicID:        tm.TopicID,
+				}
+			}
+		}
 	}
 	res := &protocol.MetadataResponse{
 		Brokers:       brokers,
@@ -558,6 +1489,20 @@ func (b *Broker) handleMetadata(ctx *Context, req *protocol.MetadataRequest) *pr
 	return res
 }
 
+// metadataStaleness returns how long it's been since the broker's metadata was
+// known to be up to date, i.e. since it last heard from the controller. The
+// controller's metadata is always up to date.
+func (b *Broker) metadataStaleness() time.Duration {
+	if b.isController() || b.cluster == nil {
+		return 0
+	}
+	last := b.cluster.LastContact()
+	if last.IsZero() {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(last)
+}
+
 func (b *Broker) handleFindCoordinator(ctx *Context, req *protocol.FindCoordinatorRequest) *protocol.FindCoordinatorResponse {
 	sp := span(ctx, b.tracer, "find coordinator")
 	defer sp.Finish()
@@ -575,7 +1520,7 @@ func (b *Broker) handleFindCoordinator(ctx *Context, req *protocol.FindCoordinat
 	if err != nil {
 		goto ERROR
 	}
-	i = int32(util.Hash(req.CoordinatorKey) % uint64(len(topic.Partitions)))
+	i = coordinatorPartition(req.CoordinatorKey, len(topic.Partitions))
 	_, p, err = state.GetPartition(OffsetsTopicName, i)
 	if err != nil {
 		goto ERROR
@@ -609,6 +1554,16 @@ func (b *Broker) handleJoinGroup(ctx *Context, r *protocol.JoinGroupRequest) *pr
 	res := &protocol.JoinGroupResponse{}
 	res.APIVersion = r.Version()
 
+	if err := b.validateJoinTimeouts(r); err != protocol.ErrNone {
+		log.Info.Printf("broker/%d: join group %s: session timeout %dms, rebalance timeout %dms: %s", b.config.ID, r.GroupID, r.SessionTimeout, r.RebalanceTimeout, err)
+		res.ErrorCode = err.Code()
+		return res
+	}
+	if !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, r.GroupID) {
+		res.ErrorCode = protocol.ErrGroupAuthorizationFailed.Code()
+		return res
+	}
+
 	// // TODO: distribute this.
 	state := b.fsm.State()
 
@@ -629,14 +1584,28 @@ func (b *Broker) handleJoinGroup(ctx *Context, r *protocol.JoinGroupRequest) *pr
 			Members:     make(map[string]structs.Member),
 		}
 	}
+	if err := validateGroupProtocol(group, r); err != protocol.ErrNone {
+		log.Info.Printf("broker/%d: join group %s: protocol type %s: %s", b.config.ID, r.GroupID, r.ProtocolType, err)
+		res.ErrorCode = err.Code()
+		return res
+	}
 	if r.MemberID == "" {
 		// for group member IDs -- can replace with something else
 		r.MemberID = ctx.Header().ClientID + "-" + uuid.NewV1().String()
 		group.Members[r.MemberID] = structs.Member{ID: r.MemberID}
 	}
+	if m, ok := group.Members[r.MemberID]; ok {
+		m.Protocols = nil
+		for _, p := range r.GroupProtocols {
+			m.Protocols = append(m.Protocols, structs.MemberProtocol{Name: p.ProtocolName, Metadata: p.ProtocolMetadata})
+		}
+		group.Members[r.MemberID] = m
+	}
 	if group.LeaderID == "" {
 		group.LeaderID = r.MemberID
 	}
+	group.ProtocolType = r.ProtocolType
+	selectGroupProtocol(group)
 	_, err = b.raftApply(structs.RegisterGroupRequestType, structs.RegisterGroupRequest{
 		Group: *group,
 	})
@@ -647,6 +1616,7 @@ func (b *Broker) handleJoinGroup(ctx *Context, r *protocol.JoinGroupRequest) *pr
 	}
 
 	res.GenerationID = 0
+	res.GroupProtocol = group.Protocol
 	res.LeaderID = group.LeaderID
 	res.MemberID = r.MemberID
 
@@ -667,6 +1637,10 @@ func (b *Broker) handleLeaveGroup(ctx *Context, r *protocol.LeaveGroupRequest) *
 
 	res := &protocol.LeaveGroupResponse{}
 	res.APIVersion = r.Version()
+	if !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, r.GroupID) {
+		res.ErrorCode = protocol.ErrGroupAuthorizationFailed.Code()
+		return res
+	}
 
 	// // TODO: distribute this.
 	state := b.fsm.State()
@@ -686,6 +1660,7 @@ func (b *Broker) handleLeaveGroup(ctx *Context, r *protocol.LeaveGroupRequest) *
 	}
 
 	delete(group.Members, r.MemberID)
+	selectGroupProtocol(group)
 
 	_, err = b.raftApply(structs.RegisterGroupRequestType, structs.RegisterGroupRequest{
 		Group: *group,
@@ -705,6 +1680,10 @@ func (b *Broker) handleSyncGroup(ctx *Context, r *protocol.SyncGroupRequest) *pr
 	state := b.fsm.State()
 	res := &protocol.SyncGroupResponse{}
 	res.APIVersion = r.Version()
+	if !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, r.GroupID) {
+		res.ErrorCode = protocol.ErrGroupAuthorizationFailed.Code()
+		return res
+	}
 
 	_, group, err := state.GetGroup(r.GroupID)
 	if err != nil {
@@ -789,6 +1768,10 @@ func (b *Broker) handleHeartbeat(ctx *Context, r *protocol.HeartbeatRequest) *pr
 
 	res := &protocol.HeartbeatResponse{}
 	res.APIVersion = r.Version()
+	if !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, r.GroupID) {
+		res.ErrorCode = protocol.ErrGroupAuthorizationFailed.Code()
+		return res
+	}
 
 	state := b.fsm.State()
 	_, group, err := state.GetGroup(r.GroupID)
@@ -814,26 +1797,90 @@ func (b *Broker) handleFetch(ctx *Context, r *protocol.FetchRequest) *protocol.F
 		Responses: make(protocol.FetchTopicResponses, len(r.Topics)),
 	}
 	fres.APIVersion = r.Version()
+	// responseBytes is what's left of the response's max bytes, which v3
+	// fetches set. Each partition's read is capped to it, so a partition
+	// only gets records if the ones before it left room.
+	responseBytes := int32(math.MaxInt32)
+	if r.Version() >= 3 && r.MaxBytes > 0 {
+		responseBytes = r.MaxBytes
+	}
 	for i, topic := range r.Topics {
 		fr := &protocol.FetchTopicResponse{
 			Topic:              topic.Topic,
+			TopicID:            topic.TopicID,
 			PartitionResponses: make([]*protocol.FetchPartitionResponse, len(topic.Partitions)),
 		}
+		topicErr := protocol.ErrNone
+		if !topic.TopicID.IsZero() {
+			topic.Topic, topicErr = b.topicName(topic.TopicID)
+		}
 		for j, p := range topic.Partitions {
 			fpres := &protocol.FetchPartitionResponse{}
 			fpres.Partition = p.Partition
-			err := b.withTimeout(r.MaxWaitTime, func() protocol.Error {
-				replica, err := b.replicaLookup.Replica(topic.Topic, p.Partition)
+			if topicErr != protocol.ErrNone {
+				fpres.ErrorCode = topicErr.Code()
+				fr.PartitionResponses[j] = fpres
+				continue
+			}
+			err := b.withTimeout(ctx, r.MaxWaitTime, func(ctx *Context) protocol.Error {
+				// followers replicate every namespace's topics, but only
+				// brokers fetch as them
+				if r.ReplicaID >= 0 && !b.brokerAuthorized(ctx) {
+					return protocol.ErrClusterAuthorizationFailed
+				}
+				if r.ReplicaID < 0 && !b.authorized(ctx, policy.ReadOperation, policy.TopicResource, topic.Topic) {
+					return protocol.ErrTopicAuthorizationFailed
+				}
+				// debugging fetches read followers' records past what's
+				// been replicated, so only the cluster's operators can
+				if r.ReplicaID == debuggingReplicaID && !b.authorized(ctx, policy.ReadOperation, policy.ClusterResource, "") {
+					return protocol.ErrClusterAuthorizationFailed
+				}
+				name, staging := stagingTopic(topic.Topic)
+				if staging && r.ReplicaID < 0 {
+					// only followers fetch staging logs
+					return protocol.ErrUnknownTopicOrPartition
+				}
+				replica, err := b.replicaLookup.Replica(name, p.Partition)
 				if err != nil {
 					return protocol.ErrReplicaNotAvailable
 				}
-				if replica.Partition.Leader != b.config.ID {
+				if replica.Partition.Leader != b.config.ID && r.ReplicaID != debuggingReplicaID {
+					fpres.CurrentLeader = b.currentLeader(name, p.Partition)
 					return protocol.ErrNotLeaderForPartition
 				}
-				if replica.Log == nil {
+				l := replica.Log
+				if staging {
+					q := replica.delayQueue
+					if q == nil {
+						return protocol.ErrUnknownTopicOrPartition
+					}
+					l = q.staging
+				}
+				if l == nil {
 					return protocol.ErrReplicaNotAvailable
 				}
-				rdr, rdrErr := replica.Log.NewReader(p.FetchOffset, p.MaxBytes)
+				if b.logDirOffline() {
+					return protocol.ErrKafkaStorageError
+				}
+				if r.ReplicaID >= 0 && !staging {
+					replica.fetchedBy(r.ReplicaID, p.FetchOffset)
+				}
+				maxBytes := p.MaxBytes
+				if maxBytes > responseBytes {
+					maxBytes = responseBytes
+				}
+				if maxBytes <= 0 {
+					// the response is full, the partition's records are
+					// fetched next time
+					if replica.Partition.Leader == b.config.ID && !staging {
+						fpres.HighWatermark = replica.highWatermark()
+					} else {
+						fpres.HighWatermark = l.NewestOffset() - 1
+					}
+					return protocol.ErrNone
+				}
+				rdr, rdrErr := l.NewReader(p.FetchOffset, maxBytes)
 				if rdrErr != nil {
 					log.Error.Printf("broker/%d: replica log read error: %s", b.config.ID, rdrErr)
 					return protocol.ErrUnknown.WithErr(rdrErr)
@@ -841,6 +1888,9 @@ func (b *Broker) handleFetch(ctx *Context, r *protocol.FetchRequest) *protocol.F
 				buf := new(bytes.Buffer)
 				var n int32
 				for n < r.MinBytes {
+					if ctx.Err() != nil {
+						return protocol.ErrRequestTimedOut
+					}
 					// TODO: copy these bytes to outer bytes
 					nn, err := io.Copy(buf, rdr)
 					if err != nil && err != io.EOF {
@@ -853,21 +1903,272 @@ func (b *Broker) handleFetch(ctx *Context, r *protocol.FetchRequest) *protocol.F
 						break
 					}
 				}
-				fpres.HighWatermark = replica.Log.NewestOffset() - 1
+				if replica.Partition.Leader == b.config.ID && !staging {
+					fpres.HighWatermark = replica.highWatermark()
+				} else {
+					fpres.HighWatermark = l.NewestOffset() - 1
+				}
 				fpres.RecordSet = buf.Bytes()
+				if valid, offset := b.verifier.verify(fpres.RecordSet); offset >= 0 {
+					log.Error.Printf("broker/%d: corrupt message set at offset %d of %s-%d found by fetch", b.config.ID, offset, topic.Topic, p.Partition)
+					b.verifier.corrupt(topic.Topic, p.Partition)
+					if len(valid) == 0 {
+						fpres.RecordSet = nil
+						return protocol.ErrCorruptMessage
+					}
+					// the fetcher gets the error fetching from the corrupt
+					// set next
+					fpres.RecordSet = valid
+				}
+				if magic := fetchMessageFormat(r.Version()); magic < 1 && r.ReplicaID < 0 {
+					_, t, err := b.fsm.State().GetTopic(topic.Topic)
+					if err != nil {
+						return protocol.ErrUnknown.WithErr(err)
+					}
+					if t != nil {
+						var convErr protocol.Error
+						if fpres.RecordSet, convErr = b.downConvert(t, fpres.RecordSet, magic); convErr != protocol.ErrNone {
+							fpres.RecordSet = nil
+							return convErr
+						}
+					}
+				}
+				responseBytes -= int32(len(fpres.RecordSet))
+				// followers' fetches are replication and debugging fetches
+				// verification, not consumer traffic
+				if r.ReplicaID < 0 && r.ReplicaID != debuggingReplicaID {
+					b.traffic.record(topic.Topic, p.Partition, ctx.Client().ID(), 0, int64(len(fpres.RecordSet)), time.Now())
+				}
 				return protocol.ErrNone
 			})
 			fpres.ErrorCode = err.Code()
+			if err == protocol.ErrNotLeaderForPartition {
+				fres.NodeEndpoints = b.addLeaderEndpoint(fres.NodeEndpoints, fpres.CurrentLeader.LeaderID)
+			}
 			fr.PartitionResponses[j] = fpres
 		}
 		fres.Responses[i] = fr
 	}
-	return fres
+	return fres
+}
+
+func (b *Broker) handleFilteredFetch(ctx *Context, req *protocol.FilteredFetchRequest) *protocol.FilteredFetchResponse {
+	sp := span(ctx, b.tracer, "filtered fetch")
+	defer sp.Finish()
+	res := new(protocol.FilteredFetchResponse)
+	res.APIVersion = req.Version()
+	res.Fetch = b.handleFetch(ctx, req.Fetch)
+	for i, tr := range res.Fetch.Responses {
+		for j, pr := range tr.PartitionResponses {
+			fp := &protocol.FilteredFetchPartition{
+				Topic:      tr.Topic,
+				Partition:  pr.Partition,
+				NextOffset: req.Fetch.Topics[i].Partitions[j].FetchOffset,
+			}
+			if pr.ErrorCode == protocol.ErrNone.Code() {
+				pr.RecordSet, fp.NextOffset, fp.Skipped = b.filterRecordSet(b.segmentIDs(tr.Topic, pr.Partition), pr.RecordSet, req.Filter, fp.NextOffset)
+			}
+			res.Partitions = append(res.Partitions, fp)
+		}
+	}
+	return res
+}
+
+// segmentIDs returns a func returning the ID of the segment of the partition's
+// log with the offset, or nil if the log doesn't have segment IDs.
+func (b *Broker) segmentIDs(topic string, partition int32) func(int64) uint64 {
+	replica, err := b.replicaLookup.Replica(topic, partition)
+	if err != nil || replica.Log == nil {
+		return nil
+	}
+	if l, ok := replica.Log.(interface{ SegmentID(int64) uint64 }); ok {
+		return l.SegmentID
+	}
+	return nil
+}
+
+// filterRecordSet drops the message sets without a record matching the filter.
+// Compressed message sets are decompressed to check their records, through
+// the broker's decompression cache by the IDs of the segments they were read
+// from if segmentID's set, and kept whole if they have a match or can't be
+// decompressed. It returns the filtered record set, the offset to fetch from
+// next, and how many message sets it dropped.
+func (b *Broker) filterRecordSet(segmentID func(int64) uint64, recordSet []byte, filter *protocol.RecordFilter, next int64) ([]byte, int64, int32) {
+	var filtered []byte
+	var skipped int32
+	for _, ms := range commitlog.MessageSets(recordSet) {
+		next = ms.Offset() + 1
+		if !b.matchMessageSet(segmentID, ms, filter) {
+			skipped++
+			continue
+		}
+		filtered = append(filtered, ms...)
+	}
+	return filtered, next, skipped
+}
+
+// matchMessageSet returns whether the message set has a record matching the
+// filter.
+func (b *Broker) matchMessageSet(segmentID func(int64) uint64, ms commitlog.MessageSet, filter *protocol.RecordFilter) bool {
+	for _, m := range ms.Messages() {
+		if !m.Compressed() {
+			if filter.Match(m.Key()) {
+				return true
+			}
+			continue
+		}
+		var segment uint64
+		if segmentID != nil {
+			segment = segmentID(ms.Offset())
+		}
+		inner, err := b.decompressed.decompress(segment, ms.Offset(), m)
+		if err != nil {
+			log.Error.Printf("broker/%d: decompress message set at %d error: %s", b.config.ID, ms.Offset(), err)
+			return true
+		}
+		for _, ims := range inner {
+			for _, im := range ims.Messages() {
+				if filter.Match(im.Key()) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (b *Broker) handleShareFetch(ctx *Context, req *protocol.ShareFetchRequest) *protocol.ShareFetchResponse {
+	sp := span(ctx, b.tracer, "share fetch")
+	defer sp.Finish()
+	res := new(protocol.ShareFetchResponse)
+	res.APIVersion = req.Version()
+	if req.GroupID == "" {
+		res.ErrorCode = protocol.ErrInvalidGroupId.Code()
+		return res
+	}
+	if req.MemberID == "" {
+		res.ErrorCode = protocol.ErrUnknownMemberId.Code()
+		return res
+	}
+	if !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, req.GroupID) {
+		res.ErrorCode = protocol.ErrGroupAuthorizationFailed.Code()
+		return res
+	}
+	now := time.Now()
+	res.Responses = make([]*protocol.ShareFetchTopicResponse, len(req.Topics))
+	for i, t := range req.Topics {
+		tres := &protocol.ShareFetchTopicResponse{
+			Topic:      t.Topic,
+			Partitions: make([]*protocol.ShareFetchPartitionResponse, len(t.Partitions)),
+		}
+		for j, partition := range t.Partitions {
+			pres := &protocol.ShareFetchPartitionResponse{Partition: partition}
+			replica, err := b.replicaLookup.Replica(t.Topic, partition)
+			switch {
+			case !b.authorized(ctx, policy.ReadOperation, policy.TopicResource, t.Topic):
+				pres.ErrorCode = protocol.ErrTopicAuthorizationFailed.Code()
+			case err != nil || replica == nil || replica.Log == nil:
+				pres.ErrorCode = protocol.ErrUnknownTopicOrPartition.Code()
+			case replica.Partition.Leader != b.config.ID:
+				pres.ErrorCode = protocol.ErrNotLeaderForPartition.Code()
+			default:
+				key := sharePartitionKey{group: req.GroupID, topic: t.Topic, partition: partition}
+				pres.RecordSet, pres.AcquiredRecords, err = b.shareGroups.acquire(key, req.MemberID, replica.Log, replica.highWatermark(), int(req.MaxRecords), now)
+				if err != nil {
+					log.Error.Printf("broker/%d: share fetch %s-%d error: %s", b.config.ID, t.Topic, partition, err)
+					pres.ErrorCode = protocol.ErrUnknown.Code()
+				}
+			}
+			tres.Partitions[j] = pres
+		}
+		res.Responses[i] = tres
+	}
+	return res
+}
+
+func (b *Broker) handleShareAcknowledge(ctx *Context, req *protocol.ShareAcknowledgeRequest) *protocol.ShareAcknowledgeResponse {
+	sp := span(ctx, b.tracer, "share acknowledge")
+	defer sp.Finish()
+	res := new(protocol.ShareAcknowledgeResponse)
+	res.APIVersion = req.Version()
+	res.Responses = make([]*protocol.ShareAcknowledgeTopicResponse, len(req.Topics))
+	for i, t := range req.Topics {
+		tres := &protocol.ShareAcknowledgeTopicResponse{
+			Topic:      t.Topic,
+			Partitions: make([]*protocol.ShareAcknowledgePartitionResponse, len(t.Partitions)),
+		}
+		for j, p := range t.Partitions {
+			err := protocol.ErrTopicAuthorizationFailed
+			if !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, req.GroupID) {
+				err = protocol.ErrGroupAuthorizationFailed
+			} else if b.authorized(ctx, policy.ReadOperation, policy.TopicResource, t.Topic) {
+				key := sharePartitionKey{group: req.GroupID, topic: t.Topic, partition: p.Partition}
+				err = b.shareGroups.acknowledge(key, req.MemberID, p.Acknowledgements, time.Now())
+			}
+			tres.Partitions[j] = &protocol.ShareAcknowledgePartitionResponse{
+				Partition: p.Partition,
+				ErrorCode: err.Code(),
+			}
+		}
+		res.Responses[i] = tres
+	}
+	return res
+}
+
+// topicName returns the name of the topic with the given ID.
+func (b *Broker) topicName(id protocol.UUID) (string, protocol.Error) {
+	_, topic, err := b.fsm.State().GetTopicByID(uuid.UUID(id).String())
+	if err != nil {
+		return "", protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil {
+		return "", protocol.ErrUnknownTopicID
+	}
+	return topic.Topic, protocol.ErrNone
 }
 
-func (b *Broker) handleSaslHandshake(ctx *Context, req *protocol.SaslHandshakeRequest) *protocol.SaslHandshakeResponse {
-	panic("not implemented: sasl handshake")
-	return nil
+// topicID returns the topic's ID in its wire format.
+func topicID(topic *structs.Topic) protocol.UUID {
+	id, err := uuid.FromString(topic.ID)
+	if err != nil {
+		return protocol.UUID{}
+	}
+	return protocol.UUID(id)
+}
+
+// currentLeader returns the partition's leader according to the fsm, which
+// may be newer than what the local replica knows.
+func (b *Broker) currentLeader(topic string, partition int32) protocol.LeaderIDAndEpoch {
+	leader := protocol.LeaderIDAndEpoch{LeaderID: -1, LeaderEpoch: -1}
+	_, p, err := b.fsm.State().GetPartition(topic, partition)
+	if err != nil || p == nil {
+		return leader
+	}
+	leader.LeaderID = p.Leader
+	leader.LeaderEpoch = p.LeaderEpoch
+	return leader
+}
+
+// addLeaderEndpoint adds the leader's endpoint to the given endpoints if it's
+// known and not in there already.
+func (b *Broker) addLeaderEndpoint(endpoints []*protocol.Broker, leaderID int32) []*protocol.Broker {
+	if leaderID == -1 {
+		return endpoints
+	}
+	for _, e := range endpoints {
+		if e.NodeID == leaderID {
+			return endpoints
+		}
+	}
+	broker := b.brokerLookup.BrokerByID(raft.ServerID(fmt.Sprintf("%d", leaderID)))
+	if broker == nil {
+		return endpoints
+	}
+	return append(endpoints, &protocol.Broker{
+		NodeID: broker.ID.Int32(),
+		Host:   broker.Host(),
+		Port:   broker.Port(),
+	})
 }
 
 func (b *Broker) handleListGroups(ctx *Context, req *protocol.ListGroupsRequest) *protocol.ListGroupsResponse {
@@ -887,10 +2188,12 @@ func (b *Broker) handleListGroups(ctx *Context, req *protocol.ListGroupsRequest)
 		return res
 	}
 	for _, group := range groups {
+		if !b.authorized(ctx, policy.DescribeOperation, policy.GroupResource, group.Group) {
+			continue
+		}
 		res.Groups = append(res.Groups, protocol.ListGroup{
-			GroupID: group.Group,
-			// TODO: add protocol type
-			ProtocolType: "consumer",
+			GroupID:      group.Group,
+			ProtocolType: group.ProtocolType,
 		})
 	}
 	return res
@@ -903,12 +2206,14 @@ func (b *Broker) handleDescribeGroups(ctx *Context, req *protocol.DescribeGroups
 	res.APIVersion = req.Version()
 	state := b.fsm.State()
 
-	fmt.Println("describe")
-	fmt.Println("describe")
-	fmt.Println("describe")
-
 	for _, id := range req.GroupIDs {
-		group := protocol.Group{}
+		group := protocol.Group{GroupMembers: make(map[string]*protocol.GroupMember)}
+		if !b.authorized(ctx, policy.DescribeOperation, policy.GroupResource, id) {
+			group.ErrorCode = protocol.ErrGroupAuthorizationFailed.Code()
+			group.GroupID = id
+			res.Groups = append(res.Groups, group)
+			continue
+		}
 		_, g, err := state.GetGroup(id)
 		if err != nil {
 			group.ErrorCode = protocol.ErrUnknown.Code()
@@ -916,10 +2221,16 @@ func (b *Broker) handleDescribeGroups(ctx *Context, req *protocol.DescribeGroups
 			res.Groups = append(res.Groups, group)
 			return res
 		}
+		if g == nil {
+			group.ErrorCode = protocol.ErrInvalidGroupId.Code()
+			group.GroupID = id
+			res.Groups = append(res.Groups, group)
+			continue
+		}
 		group.GroupID = id
-		group.State = "Stable"
-		group.ProtocolType = "consumer"
-		group.Protocol = "consumer"
+		group.State = groupState(g)
+		group.ProtocolType = g.ProtocolType
+		group.Protocol = g.Protocol
 		for id, member := range g.Members {
 			group.GroupMembers[id] = &protocol.GroupMember{
 				ClientID: member.ID,
@@ -929,53 +2240,203 @@ func (b *Broker) handleDescribeGroups(ctx *Context, req *protocol.DescribeGroups
 				GroupMemberAssignment: member.Assignment,
 			}
 		}
-		res.Groups = append(res.Groups)
+		res.Groups = append(res.Groups, group)
 
 	}
 
 	return res
 }
 
+// groupState returns the Kafka name of the group's state. The coordinator
+// doesn't track rebalances, joins complete straight away, so a group with
+// members is stable.
+func groupState(g *structs.Group) string {
+	if len(g.Members) == 0 {
+		return "Empty"
+	}
+	return "Stable"
+}
+
 func (b *Broker) handleStopReplica(ctx *Context, req *protocol.StopReplicaRequest) *protocol.StopReplicaResponse {
-	panic("not implemented: stop replica")
-	return nil
+	sp := span(ctx, b.tracer, "stop replica")
+	defer sp.Finish()
+	res := &protocol.StopReplicaResponse{
+		Partitions: make([]*protocol.StopReplicaResponsePartition, len(req.Partitions)),
+	}
+	for i, p := range req.Partitions {
+		err := protocol.ErrNone
+		if replica, rerr := b.replicaLookup.Replica(p.Topic, p.Partition); rerr == nil {
+			b.replicaLookup.RemoveReplica(replica)
+			if serr := b.stopReplica(replica, req.DeletePartitions); serr != nil {
+				err = protocol.ErrUnknown.WithErr(serr)
+			}
+		}
+		res.Partitions[i] = &protocol.StopReplicaResponsePartition{
+			Topic:     p.Topic,
+			Partition: p.Partition,
+			ErrorCode: err.Code(),
+		}
+	}
+	return res
 }
 
+// handleUpdateMetadata acknowledges the controller's metadata. Brokers get the
+// cluster's metadata by replicating the controller's raft log, so there's
+// nothing in the request they don't already have.
 func (b *Broker) handleUpdateMetadata(ctx *Context, req *protocol.UpdateMetadataRequest) *protocol.UpdateMetadataResponse {
-	panic("not implemented: update metadata")
-	return nil
+	sp := span(ctx, b.tracer, "update metadata")
+	defer sp.Finish()
+	return &protocol.UpdateMetadataResponse{}
 }
 
+// handleControlledShutdown starts moving the leadership of the partitions the
+// broker leads to their other in-sync replicas before it shuts down, and
+// returns those it still leads, e.g. because their moves haven't been applied
+// yet or they have no other live replica in sync, for the broker to retry or
+// give up on.
 func (b *Broker) handleControlledShutdown(ctx *Context, req *protocol.ControlledShutdownRequest) *protocol.ControlledShutdownResponse {
-	panic("not implemented: controlled shutdown")
-	return nil
+	sp := span(ctx, b.tracer, "controlled shutdown")
+	defer sp.Finish()
+	res := &protocol.ControlledShutdownResponse{APIVersion: req.Version()}
+	if !b.isController() {
+		res.ErrorCode = protocol.ErrNotController.Code()
+		return res
+	}
+	if _, err := b.moveLeadershipFrom(req.BrokerID); err != nil {
+		log.Error.Printf("broker/%d: controlled shutdown of broker %d error: %s", b.config.ID, req.BrokerID, err)
+		res.ErrorCode = protocol.ErrUnknown.Code()
+		return res
+	}
+	_, partitions, err := b.fsm.State().PartitionsByLeader(req.BrokerID)
+	if err != nil {
+		res.ErrorCode = protocol.ErrUnknown.Code()
+		return res
+	}
+	for _, p := range partitions {
+		res.PartitionsRemaining = append(res.PartitionsRemaining, &protocol.ControlledShutdownPartition{Topic: p.Topic, Partition: p.Partition})
+	}
+	return res
 }
 
+// handleOffsetCommit commits the group's offsets to its partition of the
+// offsets topic, if this broker's its coordinator. They're kept for the
+// request's retention, or the broker's if it doesn't have one, once the group
+// has no members.
 func (b *Broker) handleOffsetCommit(ctx *Context, req *protocol.OffsetCommitRequest) *protocol.OffsetCommitResponse {
-	panic("not implemented: offset commit")
-	return nil
+	sp := span(ctx, b.tracer, "offset commit")
+	defer sp.Finish()
+
+	res := new(protocol.OffsetCommitResponse)
+	res.APIVersion = req.Version()
+	res.Responses = make([]protocol.OffsetCommitTopicResponse, len(req.Topics))
+
+	state := b.fsm.State()
+	groupErr := protocol.ErrNone
+	_, group, err := state.GetGroup(req.GroupID)
+	if err != nil {
+		log.Error.Printf("broker/%d: get group error: %s", b.config.ID, err)
+		groupErr = protocol.ErrUnknown
+	} else if !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, req.GroupID) {
+		groupErr = protocol.ErrGroupAuthorizationFailed
+	} else if group != nil && req.Version() >= 1 && req.GenerationID >= 0 && req.GenerationID != group.GenerationID {
+		// only members of the group's current generation commit, consumers
+		// managing their own partitions commit without a generation
+		groupErr = protocol.ErrIllegalGeneration
+	} else if _, _, perr := b.coordinatorLog(req.GroupID); perr != protocol.ErrNone {
+		groupErr = perr
+	}
+
+	var retention time.Duration
+	if req.Version() >= 2 && req.RetentionTime > 0 {
+		retention = time.Duration(req.RetentionTime) * time.Millisecond
+	}
+	now := time.Now()
+	var offsets []committedOffset
+	for i, t := range req.Topics {
+		res.Responses[i].Topic = t.Topic
+		res.Responses[i].PartitionResponses = make([]protocol.OffsetCommitPartitionResponse, len(t.Partitions))
+		for j, p := range t.Partitions {
+			pres := &res.Responses[i].PartitionResponses[j]
+			pres.Partition = p.Partition
+			pres.ErrorCode = groupErr.Code()
+			if groupErr != protocol.ErrNone {
+				continue
+			}
+			_, partition, err := state.GetPartition(t.Topic, p.Partition)
+			if err != nil {
+				pres.ErrorCode = protocol.ErrUnknown.Code()
+				continue
+			}
+			if partition == nil {
+				pres.ErrorCode = protocol.ErrUnknownTopicOrPartition.Code()
+				continue
+			}
+			offset := structs.GroupOffset{
+				Group:     req.GroupID,
+				Topic:     t.Topic,
+				Partition: p.Partition,
+				Offset:    p.Offset,
+			}
+			if p.Metadata != nil {
+				offset.Metadata = *p.Metadata
+			}
+			offsets = append(offsets, b.newCommittedOffset(offset, retention, now))
+		}
+	}
+	if len(offsets) == 0 {
+		return res
+	}
+	if perr := b.writeOffsets(offsets, false); perr != protocol.ErrNone {
+		log.Error.Printf("broker/%d: commit offsets error: %s", b.config.ID, perr)
+		for _, t := range res.Responses {
+			for j := range t.PartitionResponses {
+				if t.PartitionResponses[j].ErrorCode == protocol.ErrNone.Code() {
+					t.PartitionResponses[j].ErrorCode = perr.Code()
+				}
+			}
+		}
+	}
+	return res
 }
 
 func (b *Broker) handleOffsetFetch(ctx *Context, req *protocol.OffsetFetchRequest) *protocol.OffsetFetchResponse {
-	sp := span(ctx, b.tracer, "create topic")
+	sp := span(ctx, b.tracer, "offset fetch")
 	defer sp.Finish()
 
 	res := new(protocol.OffsetFetchResponse)
 	res.APIVersion = req.Version()
 	res.Responses = make([]protocol.OffsetFetchTopicResponse, len(req.Topics))
 
-	// state := b.fsm.State()
-
-	// _, g, err := state.GetGroup(req.GroupID)
-
-	// // If group doesn't exist then create it?
-	// if err != nil {
-	// 	// TODO: handle err
-	// 	panic(err)
-	// }
+	perr := protocol.ErrNone
+	var offsets []committedOffset
+	if !b.authorized(ctx, policy.DescribeOperation, policy.GroupResource, req.GroupID) {
+		perr = protocol.ErrGroupAuthorizationFailed
+	} else if offsets, perr = b.groupOffsets(req.GroupID); perr != protocol.ErrNone && perr != protocol.ErrNotCoordinator {
+		log.Error.Printf("broker/%d: get group offsets error: %s", b.config.ID, perr)
+	}
+	committed := make(map[string]map[int32]committedOffset)
+	for _, o := range offsets {
+		if committed[o.Topic] == nil {
+			committed[o.Topic] = make(map[int32]committedOffset)
+		}
+		committed[o.Topic][o.Partition] = o
+	}
 
+	for i, t := range req.Topics {
+		res.Responses[i].Topic = t.Topic
+		res.Responses[i].Partitions = make([]protocol.OffsetFetchPartition, len(t.Partitions))
+		for j, id := range t.Partitions {
+			// partitions the group hasn't committed have offset -1
+			p := protocol.OffsetFetchPartition{Partition: id, Offset: -1, ErrorCode: perr.Code()}
+			if o, ok := committed[t.Topic][id]; ok {
+				metadata := o.Metadata
+				p.Offset = o.Offset
+				p.Metadata = &metadata
+			}
+			res.Responses[i].Partitions[j] = p
+		}
+	}
 	return res
-
 }
 
 // isController returns true if this is the cluster controller.
@@ -984,7 +2445,7 @@ func (b *Broker) isController() bool {
 }
 
 func (b *Broker) isLeader() bool {
-	return b.raft.State() == raft.Leader
+	return b.store.IsLeader()
 }
 
 // createPartition is used to add a partition across the cluster.
@@ -995,7 +2456,37 @@ func (b *Broker) createPartition(partition structs.Partition) error {
 	return err
 }
 
+// registerTopic is used to register the topic and its partitions across the
+// cluster with a single raft apply.
+func (b *Broker) registerTopic(topic structs.Topic, partitions []structs.Partition) error {
+	batch := new(structs.BatchRequest)
+	if err := batch.Add(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{Topic: topic}); err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if err := batch.Add(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{Partition: partition}); err != nil {
+			return err
+		}
+	}
+	return b.raftApplyBatch(batch)
+}
+
 // startReplica is used to start a replica on this, including creating its commit log.
+// logRetention returns how many bytes and how long the topic's log keeps
+// segments. Retention's opt-in: logs are only cut by size or age if the topic
+// sets retention.bytes or retention.ms itself, so existing topics don't start
+// losing data to the default week's retention.
+func logRetention(config structs.TopicConfig) (int64, time.Duration) {
+	size, age := int64(-1), time.Duration(0)
+	if config.Get("retention.bytes").Value != nil {
+		size = config.GetInt64("retention.bytes")
+	}
+	if config.Get("retention.ms").Value != nil {
+		age = time.Duration(config.GetInt64("retention.ms")) * time.Millisecond
+	}
+	return size, age
+}
+
 func (b *Broker) startReplica(replica *Replica) protocol.Error {
 	b.Lock()
 	defer b.Unlock()
@@ -1011,11 +2502,36 @@ func (b *Broker) startReplica(replica *Replica) protocol.Error {
 	}
 
 	if replica.Log == nil {
+		path := b.partitionDir(topic.Topic, replica.Partition.ID)
+		if err := b.migratePartitionDir(path, topic.Topic, replica.Partition.ID); err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		if err := b.ensurePartitionMetadata(path, topic.ID); err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		// the max compaction lag defaults to forever, which overflows a duration
+		maxCompactionLag := time.Duration(-1)
+		if lag := topic.Config.GetInt64("max.compaction.lag.ms"); lag < int64(math.MaxInt64/time.Millisecond) {
+			maxCompactionLag = time.Duration(lag) * time.Millisecond
+		}
+		retentionBytes, retentionAge := logRetention(topic.Config)
 		log, err := commitlog.New(commitlog.Options{
-			Path:            filepath.Join(b.config.DataDir, "data", fmt.Sprintf("%d", replica.Partition.ID)),
-			MaxSegmentBytes: 1024,
-			MaxLogBytes:     -1,
-			CleanupPolicy:   commitlog.CleanupPolicy(topic.Config.GetValue("cleanup.policy").(string)),
+			Path:                   path,
+			MaxSegmentBytes:        1024,
+			MaxSegmentAge:          time.Duration(topic.Config.GetInt64("segment.ms")) * time.Millisecond,
+			SegmentJitter:          time.Duration(topic.Config.GetInt64("segment.jitter.ms")) * time.Millisecond,
+			MaxLogBytes:            retentionBytes,
+			MaxLogAge:              retentionAge,
+			CleanupPolicy:          commitlog.CleanupPolicy(topic.Config.GetString("cleanup.policy")),
+			DeleteRetention:        time.Duration(topic.Config.GetInt64("delete.retention.ms")) * time.Millisecond,
+			MinCleanableDirtyRatio: topic.Config.GetFloat64("min.cleanable.dirty.ratio"),
+			MaxCompactionLag:       maxCompactionLag,
+			OffsetMapBytes:         b.config.CompactionOffsetMapBytes,
+			FlushMessages:          topic.Config.GetInt64("flush.messages"),
+			Manifest:               topic.Config.GetBool("segment.manifest.enable"),
+			CompactionPaused:       b.inMaintenance,
+			FDCache:                b.fds,
+			Failpoints:             b.faults.failpoints(),
 		})
 		if err != nil {
 			return protocol.ErrUnknown.WithErr(err)
@@ -1024,9 +2540,182 @@ func (b *Broker) startReplica(replica *Replica) protocol.Error {
 		// TODO: register leader-change listener on r.replica.Partition.id
 	}
 
+	delay := topic.Config.GetInt64("delivery.delay.ms")
+	scheduled := topic.Config.GetBool("delivery.scheduled.enable")
+	if replica.delayQueue == nil && (delay > 0 || scheduled) {
+		q, err := newDelayQueue(delayQueueConfig{
+			Dir:       b.partitionDir(topic.Topic, replica.Partition.ID),
+			Delay:     time.Duration(delay) * time.Millisecond,
+			Scheduled: scheduled,
+			Release: func(recordSet []byte) error {
+				_, err := b.appendLog(context.Background(), replica, recordSet)
+				return err
+			},
+			// only the leader releases records, a follower gets them by
+			// replicating
+			Leader: func() bool {
+				return replica.leader() == b.config.ID
+			},
+		})
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		replica.delayQueue = q
+		ok := b.runner.run("delay queues", fmt.Sprintf("%s-%d", replica.Partition.Topic, replica.Partition.ID), func(stop <-chan struct{}) {
+			q.Run(stop)
+			q.Close()
+		})
+		if !ok {
+			// already shut down
+			q.Close()
+		}
+	}
+
 	return protocol.ErrNone
 }
 
+// startBurstBuffer starts the replica's burst buffer if it doesn't have one.
+// It's started by the first produce after the topic's given a burst buffer,
+// and reads the topic's configs as it goes so it picks up their changes.
+func (b *Broker) startBurstBuffer(replica *Replica) {
+	b.Lock()
+	defer b.Unlock()
+	if replica.burstBuffer != nil {
+		return
+	}
+	topic, partition := replica.Partition.Topic, replica.Partition.ID
+	q := newBurstBuffer(burstBufferConfig{
+		Limits: func() (int64, int64) {
+			_, t, err := b.fsm.State().GetTopic(topic)
+			if err != nil || t == nil {
+				return 0, 0
+			}
+			return t.Config.GetInt64("produce.burst.buffer.bytes"), t.Config.GetInt64("produce.burst.drain.byte.rate")
+		},
+		Append: func(recordSet []byte) (int64, error) {
+			// the records are only acknowledged once they're appended, a
+			// follower gets them by replicating
+			if replica.leader() != b.config.ID {
+				return 0, protocol.ErrNotLeaderForPartition
+			}
+			return b.appendLog(context.Background(), replica, recordSet)
+		},
+	})
+	ok := b.runner.run("burst buffers", fmt.Sprintf("%s-%d", topic, partition), func(stop <-chan struct{}) {
+		q.Run(stop)
+		if err := q.Close(); err != nil {
+			log.Error.Printf("broker/%d: drain burst buffer of %s-%d error: %s", b.config.ID, topic, partition, err)
+		}
+	})
+	if !ok {
+		// already shut down
+		return
+	}
+	replica.burstBuffer = q
+}
+
+// stopReplica stops what runs for the replica: its replicators, delay queue,
+// and burst buffer, and drops its share groups' state. Its log's deleted if
+// delete is set, otherwise it's left open for a replica replacing it.
+func (b *Broker) stopReplica(replica *Replica, delete bool) error {
+	b.Lock()
+	defer b.Unlock()
+	b.shareGroups.removePartition(replica.Partition.Topic, replica.Partition.ID)
+	for _, r := range []*Replicator{replica.Replicator, replica.stagingReplicator} {
+		if r != nil {
+			r.Close()
+		}
+	}
+	replica.Replicator = nil
+	replica.stagingReplicator = nil
+	var err error
+	if replica.delayQueue != nil {
+		if cerr := replica.delayQueue.Close(); cerr != nil {
+			err = errors.Wrap(cerr, "close delay queue failed")
+		}
+		replica.delayQueue = nil
+	}
+	if replica.burstBuffer != nil {
+		if cerr := replica.burstBuffer.Close(); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "drain burst buffer failed")
+		}
+		replica.burstBuffer = nil
+	}
+	if delete && replica.Log != nil {
+		if derr := replica.Log.Delete(); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// partitionDir returns the directory holding the partition's data.
+func (b *Broker) partitionDir(topic string, partition int32) string {
+	return filepath.Join(b.config.DataDir, "data", fmt.Sprintf("%s-%d", topic, partition))
+}
+
+// migratePartitionDir moves the partition's data to its directory from the one
+// named by its ID alone, where brokers kept partitions before their
+// directories were named by their topics too. Those brokers kept the same
+// partition of every topic in the one directory, so it's only moved if no other
+// topic has the partition on this broker. Otherwise whose data it is isn't
+// known and it's left for the operator to move.
+func (b *Broker) migratePartitionDir(dir, topic string, partition int32) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return err
+	}
+	old := filepath.Join(b.config.DataDir, "data", strconv.Itoa(int(partition)))
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, topics, err := b.fsm.State().GetTopics()
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		if t.Topic != topic && contains(t.Partitions[partition], b.config.ID) {
+			log.Info.Printf("broker/%d: not moving partition data from %s to %s, it may be %s's", b.config.ID, old, dir, t.Topic)
+			return nil
+		}
+	}
+	log.Info.Printf("broker/%d: moving partition data from %s to %s", b.config.ID, old, dir)
+	return os.Rename(old, dir)
+}
+
+// ensurePartitionMetadata records the topic's ID in the partition's directory. If
+// the directory holds data for another topic with the same name, i.e. one that
+// was deleted and recreated, that stale data's moved to the quarantine dir
+// first, where it's kept for the operator to inspect or delete.
+func (b *Broker) ensurePartitionMetadata(dir, topicID string) error {
+	if topicID == "" {
+		return nil
+	}
+	path := filepath.Join(dir, partitionMetadataFile)
+	p, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(strings.TrimPrefix(string(p), "topic_id:"))
+		if id == topicID {
+			return nil
+		}
+		quarantine := filepath.Join(b.config.DataDir, quarantineDir, filepath.Base(dir)+"."+id)
+		log.Info.Printf("broker/%d: quarantining stale partition data in %s to %s: topic id %s, want %s", b.config.ID, dir, quarantine, id, topicID)
+		if err = os.MkdirAll(filepath.Dir(quarantine), 0755); err != nil {
+			return err
+		}
+		if err = os.Rename(dir, quarantine); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte("topic_id: "+topicID+"\n"), 0644)
+}
+
 // createTopic is used to create the topic across the cluster.
 func (b *Broker) createTopic(ctx *Context, topic *protocol.CreateTopicRequest) protocol.Error {
 	state := b.fsm.State()
@@ -1034,26 +2723,39 @@ func (b *Broker) createTopic(ctx *Context, topic *protocol.CreateTopicRequest) p
 	if t != nil {
 		return protocol.ErrTopicAlreadyExists
 	}
-	ps, err := b.buildPartitions(topic.Topic, topic.NumPartitions, topic.ReplicationFactor)
-	if err != protocol.ErrNone {
-		return err
+	var ps []structs.Partition
+	if len(topic.ReplicaAssignment) > 0 {
+		ps = assignedPartitions(topic.Topic, topic.ReplicaAssignment)
+	} else {
+		var err protocol.Error
+		if ps, err = b.buildPartitions(topic.Topic, topic.NumPartitions, topic.ReplicationFactor); err != protocol.ErrNone {
+			return err
+		}
 	}
 	tt := structs.Topic{
+		ID:         uuid.NewV4().String(),
 		Topic:      topic.Topic,
 		Partitions: make(map[int32][]int32),
+		Config:     structs.NewTopicConfig(),
 	}
 	for _, partition := range ps {
 		tt.Partitions[partition.ID] = partition.AR
 	}
-	// TODO: create/set topic config here
-	if _, err := b.raftApply(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{Topic: tt}); err != nil {
-		return protocol.ErrUnknown.WithErr(err)
-	}
-	for _, partition := range ps {
-		if err := b.createPartition(partition); err != nil {
-			return protocol.ErrUnknown.WithErr(err)
+	for name, value := range topic.Configs {
+		if value == nil {
+			continue
 		}
+		if err := tt.Config.SetString(name, *value); err != nil {
+			return protocol.ErrInvalidConfig.WithErr(err)
+		}
+	}
+	if _, err := recordValidators(tt.Config); err != nil {
+		return protocol.ErrInvalidConfig.WithErr(err)
 	}
+	if err := b.registerTopic(tt, ps); err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	b.publishEvent(ClusterEvent{Type: TopicCreated, Topic: tt.Topic})
 	// could move this up maybe and do the iteration once
 	req := &protocol.LeaderAndISRRequest{
 		ControllerID: b.config.ID,
@@ -1078,11 +2780,7 @@ func (b *Broker) createTopic(ctx *Context, topic *protocol.CreateTopicRequest) p
 				panic(fmt.Sprintf("broker/%d: handling leader and isr error: %d", b.config.ID, errCode))
 			}
 		} else {
-			conn, err := Dial("tcp", broker.BrokerAddr)
-			if err != nil {
-				return protocol.ErrUnknown.WithErr(err)
-			}
-			res, err := conn.LeaderAndISR(req)
+			res, err := b.peers.LeaderAndISR(ctx, broker.ID.Int32(), req, b.fenceController)
 			if err != nil {
 				// handle err and responses
 				return protocol.ErrUnknown.WithErr(err)
@@ -1090,44 +2788,40 @@ func (b *Broker) createTopic(ctx *Context, topic *protocol.CreateTopicRequest) p
 			spew.Dump("leader and isr res", res)
 		}
 	}
+	if req := mirrorCheckpointTopic(topic, tt.Config); req != nil {
+		if err := b.createTopic(ctx, req); err != protocol.ErrNone && err != protocol.ErrTopicAlreadyExists {
+			log.Error.Printf("broker/%d: create mirror checkpoint topic %s error: %s", b.config.ID, req.Topic, err)
+			return err
+		}
+	}
+	for _, req := range nackTopics(topic, tt.Config) {
+		if err := b.createTopic(ctx, req); err != protocol.ErrNone && err != protocol.ErrTopicAlreadyExists {
+			log.Error.Printf("broker/%d: create nack topic %s error: %s", b.config.ID, req.Topic, err)
+			return err
+		}
+	}
 	return protocol.ErrNone
 }
 
 func (b *Broker) buildPartitions(topic string, partitionsCount int32, replicationFactor int16) ([]structs.Partition, protocol.Error) {
-	brokers := b.brokerLookup.Brokers()
+	brokers := b.schedulableBrokers()
 	count := len(brokers)
 
 	if int(replicationFactor) > count {
 		return nil, protocol.ErrInvalidReplicationFactor
 	}
 
-	// container/ring is dope af
-	r := ring.New(count)
-	for i := 0; i < r.Len(); i++ {
-		r.Value = brokers[i]
-		r = r.Next()
-	}
-
-	var partitions []structs.Partition
-
-	for i := int32(0); i < partitionsCount; i++ {
-		// TODO: maybe just go next here too
-		r = r.Move(rand.Intn(count))
-		leader := r.Value.(*metadata.Broker)
-		replicas := []int32{leader.ID.Int32()}
-		for i := int16(0); i < replicationFactor-1; i++ {
-			r = r.Next()
-			replicas = append(replicas, r.Value.(*metadata.Broker).ID.Int32())
-		}
-		partition := structs.Partition{
+	assignments := assignReplicas(brokers, partitionsCount, replicationFactor, rand.Intn(count), rand.Intn(count))
+	partitions := make([]structs.Partition, 0, len(assignments))
+	for i, replicas := range assignments {
+		partitions = append(partitions, structs.Partition{
 			Topic:     topic,
-			ID:        i,
-			Partition: i,
-			Leader:    leader.ID.Int32(),
+			ID:        int32(i),
+			Partition: int32(i),
+			Leader:    replicas[0],
 			AR:        replicas,
 			ISR:       replicas,
-		}
-		partitions = append(partitions, partition)
+		})
 	}
 
 	return partitions, protocol.ErrNone
@@ -1137,6 +2831,10 @@ func (b *Broker) buildPartitions(topic string, partitionsCount int32, replicatio
 func (b *Broker) Leave() error {
 	log.Info.Printf("broker/%d: starting leave", b.config.ID)
 
+	if b.cluster == nil {
+		return nil
+	}
+
 	numPeers, err := b.numPeers()
 	if err != nil {
 		log.Error.Printf("broker/%d: check raft peers error: %s", b.config.ID, err)
@@ -1145,8 +2843,7 @@ func (b *Broker) Leave() error {
 
 	isLeader := b.isLeader()
 	if isLeader && numPeers > 1 {
-		future := b.raft.RemoveServer(raft.ServerID(fmt.Sprintf("%d", b.config.ID)), 0, 0)
-		if err := future.Error(); err != nil {
+		if err := b.cluster.RemoveServer(raft.ServerID(fmt.Sprintf("%d", b.config.ID))); err != nil {
 			log.Error.Printf("broker/%d: remove ourself as raft peer error: %s", b.config.ID, err)
 		}
 	}
@@ -1167,15 +2864,15 @@ func (b *Broker) Leave() error {
 			time.Sleep(50 * time.Millisecond)
 
 			// Get the latest configuration.
-			future := b.raft.GetConfiguration()
-			if err := future.Error(); err != nil {
+			servers, err := b.cluster.Servers()
+			if err != nil {
 				log.Error.Printf("broker/%d: get raft configuration error: %s", b.config.ID, err)
 				break
 			}
 
 			// See if we are no longer included.
 			left = true
-			for _, server := range future.Configuration().Servers {
+			for _, server := range servers {
 				if server.Address == raft.ServerAddress(b.config.RaftAddr) {
 					left = false
 					break
@@ -1196,24 +2893,29 @@ func (b *Broker) Shutdown() error {
 	if b.shutdown {
 		return nil
 	}
+	b.hooks.runBeforeShutdown()
 	b.shutdown = true
+	b.cancel()
+	for _, s := range b.runner.stop(b.config.ShutdownTimeout) {
+		log.Error.Printf("broker/%d: shutdown gave up waiting on %s: still running: %s", b.config.ID, s.name, strings.Join(s.running, ", "))
+	}
 	close(b.shutdownCh)
 
 	if b.serf != nil {
 		b.serf.Shutdown()
 	}
 
-	if b.raft != nil {
-		b.raftTransport.Close()
-		future := b.raft.Shutdown()
-		if err := future.Error(); err != nil {
-			log.Error.Printf("broker/%d: shutdown error: %s", b.config.ID, err)
-		}
-		if b.raftStore != nil {
-			b.raftStore.Close()
+	b.peers.close()
+
+	if b.store != nil {
+		if err := b.store.Close(); err != nil {
+			log.Error.Printf("broker/%d: close metadata store error: %s", b.config.ID, err)
 		}
 	}
 
+	b.markCleanShutdown()
+	b.releaseDataDir()
+
 	return nil
 }
 
@@ -1223,6 +2925,8 @@ func (b *Broker) becomeFollower(replica *Replica, cmd *protocol.PartitionState)
 	// stop replicator to current leader
 	b.Lock()
 	defer b.Unlock()
+	// the new leader has its own share groups' state
+	b.shareGroups.removePartition(replica.Partition.Topic, replica.Partition.ID)
 	if replica.Replicator != nil {
 		if err := replica.Replicator.Close(); err != nil {
 			return protocol.ErrUnknown.WithErr(err)
@@ -1236,32 +2940,97 @@ func (b *Broker) becomeFollower(replica *Replica, cmd *protocol.PartitionState)
 	if broker == nil {
 		return protocol.ErrBrokerNotAvailable
 	}
-	conn, err := NewDialer(fmt.Sprintf("jocko-replicator-%d", b.config.ID)).Dial("tcp", broker.BrokerAddr)
+	dialer := NewDialer(fmt.Sprintf("jocko-replicator-%d", b.config.ID))
+	dialer.TLS = b.interBrokerTLS
+	conn, err := dialer.Dial("tcp", broker.PeerAddr())
 	if err != nil {
 		return protocol.ErrUnknown.WithErr(err)
 	}
-	r := NewReplicator(ReplicatorConfig{}, replica, conn)
+	r := NewReplicator(b.replicatorConfig(), replica, conn)
 	replica.Replicator = r
 	if !b.config.DevMode {
-		r.Replicate()
+		b.replicate(replica, r)
+	}
+	if replica.delayQueue != nil {
+		// the staging log's replicated over its own connection, keeping the
+		// leader's offsets since its markers refer to them
+		conn, err := dialer.Dial("tcp", broker.PeerAddr())
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		config := b.replicatorConfig()
+		config.Topic = replica.Partition.Topic + stagingTopicSuffix
+		config.KeepOffsets = true
+		staging := &Replica{
+			BrokerID:  b.config.ID,
+			Partition: replica.Partition,
+			IsLocal:   true,
+			Log:       replica.delayQueue.staging,
+		}
+		r := NewReplicator(config, staging, conn)
+		replica.stagingReplicator = r
+		if !b.config.DevMode {
+			b.replicate(staging, r)
+		}
 	}
 	return protocol.ErrNone
 }
 
+// replicate starts the replicator, closed on shutdown if it hasn't been yet.
+// A replicator that fails to append leaves the replica to fall out of the ISR,
+// and takes the data dir offline if the log failed.
+func (b *Broker) replicate(replica *Replica, r *Replicator) {
+	r.Replicate()
+	ok := b.runner.run("replica fetchers", fmt.Sprintf("%s-%d", r.config.Topic, replica.Partition.ID), func(stop <-chan struct{}) {
+		select {
+		case <-stop:
+			r.Close()
+		case <-r.Stopped():
+		}
+		<-r.Stopped()
+		if err := r.Err(); errors.Cause(err) == commitlog.ErrLogFailed {
+			b.failLogDir(err)
+		}
+	})
+	if !ok {
+		// already shut down
+		r.Close()
+	}
+}
+
+// replicatorConfig returns the config for replicating from partitions' leaders
+// set by the broker's replica fetch configs.
+func (b *Broker) replicatorConfig() ReplicatorConfig {
+	return ReplicatorConfig{
+		MinBytes:         b.config.ReplicaFetchMinBytes,
+		MaxWaitTime:      b.config.ReplicaFetchWaitMax,
+		MaxBytes:         b.config.ReplicaFetchMaxBytes,
+		ResponseMaxBytes: b.config.ReplicaFetchResponseMaxBytes,
+		Backoff:          b.config.ReplicaFetchBackoff,
+		MaxBackoff:       b.config.ReplicaFetchMaxBackoff,
+	}
+}
+
 func (b *Broker) becomeLeader(replica *Replica, cmd *protocol.PartitionState) protocol.Error {
 	b.Lock()
 	defer b.Unlock()
-	if replica.Replicator != nil {
-		if err := replica.Replicator.Close(); err != nil {
+	for _, r := range []*Replicator{replica.Replicator, replica.stagingReplicator} {
+		if r == nil {
+			continue
+		}
+		if err := r.Close(); err != nil {
 			return protocol.ErrUnknown.WithErr(err)
 		}
-		replica.Replicator = nil
 	}
+	replica.Replicator = nil
+	replica.stagingReplicator = nil
+	replica.Lock()
 	replica.Partition.Leader = cmd.Leader
 	replica.Partition.AR = cmd.Replicas
 	replica.Partition.ISR = cmd.ISR
 	replica.Partition.LeaderEpoch = cmd.ZKVersion
-	return protocol.ErrNone
+	replica.Unlock()
+	return b.startMirror(replica)
 }
 
 func contains(rs []int32, r int32) bool {
@@ -1297,13 +3066,12 @@ func (b *Broker) isReadyForConsistentReads() bool {
 }
 
 func (b *Broker) numPeers() (int, error) {
-	future := b.raft.GetConfiguration()
-	if err := future.Error(); err != nil {
+	servers, err := b.cluster.Servers()
+	if err != nil {
 		return 0, err
 	}
-	raftConfig := future.Configuration()
 	var numPeers int
-	for _, server := range raftConfig.Servers {
+	for _, server := range servers {
 		if server.Suffrage == raft.Voter {
 			numPeers++
 		}
@@ -1312,6 +3080,9 @@ func (b *Broker) numPeers() (int, error) {
 }
 
 func (b *Broker) LANMembers() []serf.Member {
+	if b.serf == nil {
+		return []serf.Member{b.localMember()}
+	}
 	return b.serf.Members()
 }
 
@@ -1324,9 +3095,62 @@ type Replica struct {
 	Hw         int64
 	Leo        int64
 	Replicator *Replicator
+	// stagingReplicator replicates the delay queue's staging log on a
+	// follower.
+	stagingReplicator *Replicator
+	// delayQueue holds back records until they're due if the topic has a
+	// delivery delay.
+	delayQueue *delayQueue
+	// burstBuffer stages produced records and drains them to the log at a
+	// smoothed rate if the topic has a burst buffer.
+	burstBuffer *burstBuffer
+	// fetched is the offset each follower last fetched from, i.e. the end of
+	// its log, which the leader advances the high watermark with.
+	fetched map[int32]int64
 	sync.Mutex
 }
 
+// leader returns the ID of the partition's leader.
+func (r *Replica) leader() int32 {
+	r.Lock()
+	defer r.Unlock()
+	return r.Partition.Leader
+}
+
+// fetchedBy records the offset the follower fetched from on the leader.
+func (r *Replica) fetchedBy(id int32, offset int64) {
+	r.Lock()
+	defer r.Unlock()
+	if r.fetched == nil {
+		r.fetched = make(map[int32]int64)
+	}
+	r.fetched[id] = offset
+}
+
+// highWatermark returns the offset the partition's records are replicated to
+// by all of its in sync replicas, the end of the leader's log if it has no
+// followers. It only moves forward, and it's only known on the leader.
+func (r *Replica) highWatermark() int64 {
+	r.Lock()
+	defer r.Unlock()
+	if r.Log == nil {
+		return r.Hw
+	}
+	hw := r.Log.NewestOffset()
+	for _, id := range r.Partition.ISR {
+		if id == r.BrokerID {
+			continue
+		}
+		if offset := r.fetched[id]; offset < hw {
+			hw = offset
+		}
+	}
+	if hw > r.Hw {
+		r.Hw = hw
+	}
+	return r.Hw
+}
+
 func (r Replica) String() string {
 	return fmt.Sprintf("replica: %d {broker: %d, leader: %d, hw: %d, leo: %d}", r.Partition.ID, r.BrokerID, r.Partition.Leader, r.Hw, r.Leo)
 }
@@ -1343,26 +3167,21 @@ func (b *Broker) offsetsTopic(ctx *Context) (topic *structs.Topic, err error) {
 		return
 	}
 
-	// doesn't exist so let's create it
-	partitions, err := b.buildPartitions(OffsetsTopicName, 50, b.config.OffsetsTopicReplicationFactor)
-	if err != protocol.ErrNone {
-		return nil, err
-	}
-	topic = &structs.Topic{
-		Topic:      OffsetsTopicName,
-		Internal:   true,
-		Partitions: make(map[int32][]int32),
-	}
-	for _, p := range partitions {
-		topic.Partitions[p.Partition] = p.AR
-	}
-	_, err = b.raftApply(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
-		Topic: *topic,
+	// doesn't exist so let's create it, compacted so each group's partition
+	// keeps the latest offsets it committed, and start its replicas
+	compact := commitlog.CompactCleanupPolicy
+	perr := b.createTopic(ctx, &protocol.CreateTopicRequest{
+		Topic:             OffsetsTopicName,
+		NumPartitions:     int32(OffsetsTopicNumPartitions),
+		ReplicationFactor: b.config.OffsetsTopicReplicationFactor,
+		Configs:           map[string]*string{"cleanup.policy": &compact},
 	})
-	for _, partition := range partitions {
-		if err := b.createPartition(partition); err != nil {
-			return nil, err
-		}
+	if perr != protocol.ErrNone && perr != protocol.ErrTopicAlreadyExists {
+		return nil, perr
+	}
+	_, topic, err = b.fsm.State().GetTopic(OffsetsTopicName)
+	if err == nil && topic == nil {
+		err = protocol.ErrUnknownTopicOrPartition
 	}
 	return
 }
@@ -1372,35 +3191,43 @@ func (b *Broker) debugSnapshot() {
 
 }
 
-func (b *Broker) withTimeout(timeout time.Duration, fn func() protocol.Error) protocol.Error {
+// withTimeout calls fn with a context for the request that's done once the
+// timeout's passed, so fn can give up rather than keep working for a request
+// that's been responded to. If fn committed to the request before then it's
+// waited for instead. fn's called in the background if there's no timeout,
+// its context's then only done when the broker shuts down.
+func (b *Broker) withTimeout(ctx *Context, timeout time.Duration, fn func(*Context) protocol.Error) protocol.Error {
 	if timeout <= 0 {
-		go fn()
+		go fn(ctx)
 		return protocol.ErrNone
 	}
 
-	c := make(chan protocol.Error, 1)
-	defer close(c)
+	tctx, cancel := ctx.withTimeout(timeout)
+	defer cancel()
 
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+	// not closed since fn may finish after the timeout
+	c := make(chan protocol.Error, 1)
 
 	go func() {
-		c <- fn()
+		c <- fn(tctx)
 	}()
 
 	select {
 	case err := <-c:
 		return err
-	case <-timer.C:
-		return protocol.ErrRequestTimedOut
+	case <-tctx.Done():
+		if tctx.expire() {
+			return protocol.ErrRequestTimedOut
+		}
+		return <-c
 	}
 }
 
-func (b *Broker) logState() {
+func (b *Broker) logState(stop <-chan struct{}) {
 	t := time.NewTicker(b.logStateInterval)
 	for {
 		select {
-		case <-b.shutdownCh:
+		case <-stop:
 			return
 		case <-t.C:
 			var buf bytes.Buffer
@@ -0,0 +1,342 @@
+package jocko
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// brokerClientRetries is how many times a request to another broker is
+	// retried after failing on its connection, brokerClientRetryBackoff
+	// apart, doubling each time.
+	brokerClientRetries      = 3
+	brokerClientRetryBackoff = 100 * time.Millisecond
+	// brokerClientTimeout is how long a request to another broker, with its
+	// retries, has if its context has no deadline.
+	brokerClientTimeout = 30 * time.Second
+)
+
+var errUnknownBroker = errors.New("unknown broker")
+
+// brokerClient sends requests to the cluster's other brokers, i.e. the
+// controller's leader and ISR requests and the records forwarded to
+// partitions' leaders, instead of dialing a connection for each request. It
+// keeps a connection per broker, negotiating the API versions to use with the
+// broker when it connects, so brokers of different versions work together
+// during rolling upgrades. A request that fails on its connection is retried
+// on a new one if it's safe to send twice, checking first that it isn't
+// fenced, e.g. that the broker's still the controller or a partition's leader
+// hasn't moved, so a stale request isn't sent. A request, with its retries, is
+// given up on once its context's done. Followers' replicators keep their own
+// connections to their leaders since they long poll.
+type brokerClient struct {
+	lookup *brokerLookup
+	dialer *Dialer
+
+	mu      sync.Mutex
+	conns   map[int32]*brokerConn
+	metrics *Metrics
+}
+
+type brokerConn struct {
+	addr     string
+	conn     *Conn
+	versions map[int16]protocol.APIVersion
+}
+
+func newBrokerClient(id int32, lookup *brokerLookup) *brokerClient {
+	return &brokerClient{
+		lookup: lookup,
+		dialer: NewDialer(fmt.Sprintf("jocko-broker-%d", id)),
+		conns:  make(map[int32]*brokerConn),
+	}
+}
+
+// LeaderAndISR sends the leader and ISR request to the broker with the highest
+// version both support.
+func (c *brokerClient) LeaderAndISR(ctx context.Context, id int32, req *protocol.LeaderAndISRRequest, fenced func() error) (*protocol.LeaderAndISRResponse, error) {
+	var res *protocol.LeaderAndISRResponse
+	err := c.do(ctx, id, protocol.LeaderAndISRKey, fenced, true, func(bc *brokerConn) (err error) {
+		if req.APIVersion, err = negotiateVersion(bc.versions, protocol.LeaderAndISRKey, maxVersion(protocol.LeaderAndISRKey)); err != nil {
+			return err
+		}
+		res, err = bc.conn.LeaderAndISR(req)
+		return err
+	})
+	return res, err
+}
+
+// Produce sends the produce request to the broker, downgrading its version if
+// the broker doesn't support it. It isn't retried once it's been sent since
+// brokers don't deduplicate produced records, so the records could be
+// appended twice, it's up to the caller to retry.
+func (c *brokerClient) Produce(ctx context.Context, id int32, req *protocol.ProduceRequest, fenced func() error) (*protocol.ProduceResponse, error) {
+	var res *protocol.ProduceResponse
+	err := c.do(ctx, id, protocol.ProduceKey, fenced, false, func(bc *brokerConn) (err error) {
+		if req.APIVersion, err = negotiateVersion(bc.versions, protocol.ProduceKey, req.APIVersion); err != nil {
+			return err
+		}
+		res, err = bc.conn.Produce(req)
+		return err
+	})
+	return res, err
+}
+
+// WriteTxnMarkers asks the partitions' leader to write the transactions'
+// markers. It's safe to retry since a marker written twice ends the same
+// transaction, the second one ending no records.
+func (c *brokerClient) WriteTxnMarkers(ctx context.Context, id int32, req *protocol.WriteTxnMarkersRequest, fenced func() error) (*protocol.WriteTxnMarkersResponse, error) {
+	var res *protocol.WriteTxnMarkersResponse
+	err := c.do(ctx, id, protocol.WriteTxnMarkersKey, fenced, true, func(bc *brokerConn) (err error) {
+		if req.APIVersion, err = negotiateVersion(bc.versions, protocol.WriteTxnMarkersKey, maxVersion(protocol.WriteTxnMarkersKey)); err != nil {
+			return err
+		}
+		res, err = bc.conn.WriteTxnMarkers(req)
+		return err
+	})
+	return res, err
+}
+
+// ReadIndex asks the controller for the index of the metadata log to wait for
+// before serving a consistent read.
+func (c *brokerClient) ReadIndex(ctx context.Context, id int32, req *protocol.ReadIndexRequest) (*protocol.ReadIndexResponse, error) {
+	var res *protocol.ReadIndexResponse
+	err := c.do(ctx, id, protocol.ReadIndexKey, nil, true, func(bc *brokerConn) (err error) {
+		if req.APIVersion, err = negotiateVersion(bc.versions, protocol.ReadIndexKey, maxVersion(protocol.ReadIndexKey)); err != nil {
+			return err
+		}
+		res, err = bc.conn.ReadIndex(req)
+		return err
+	})
+	return res, err
+}
+
+// Fetch sends the fetch request to the broker, downgrading its version if the
+// broker doesn't support it.
+func (c *brokerClient) Fetch(ctx context.Context, id int32, req *protocol.FetchRequest) (*protocol.FetchResponse, error) {
+	var res *protocol.FetchResponse
+	err := c.do(ctx, id, protocol.FetchKey, nil, true, func(bc *brokerConn) (err error) {
+		if req.APIVersion, err = negotiateVersion(bc.versions, protocol.FetchKey, req.APIVersion); err != nil {
+			return err
+		}
+		res, err = bc.conn.Fetch(req)
+		return err
+	})
+	return res, err
+}
+
+// OffsetFetch asks the group's coordinator for the offsets the group
+// committed.
+func (c *brokerClient) OffsetFetch(ctx context.Context, id int32, req *protocol.OffsetFetchRequest) (*protocol.OffsetFetchResponse, error) {
+	var res *protocol.OffsetFetchResponse
+	err := c.do(ctx, id, protocol.OffsetFetchKey, nil, true, func(bc *brokerConn) (err error) {
+		if req.APIVersion, err = negotiateVersion(bc.versions, protocol.OffsetFetchKey, maxVersion(protocol.OffsetFetchKey)); err != nil {
+			return err
+		}
+		res, err = bc.conn.OffsetFetch(req)
+		return err
+	})
+	return res, err
+}
+
+// do calls fn with the connection to the broker, retrying it on a new
+// connection if it fails. Requests that aren't idempotent are only retried if
+// connecting failed, not once they may have been sent. The request isn't
+// sent, or retried, once fenced returns an error or the context's done.
+func (c *brokerClient) do(ctx context.Context, id int32, key int16, fenced func() error, idempotent bool, fn func(*brokerConn) error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, brokerClientTimeout)
+		defer cancel()
+	}
+	labels := []string{"broker", strconv.Itoa(int(id)), "api_key", strconv.Itoa(int(key))}
+	backoff := brokerClientRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fenced != nil {
+			if err := fenced(); err != nil {
+				return err
+			}
+		}
+		sent := false
+		bc, err := c.connect(ctx, id)
+		if err == nil {
+			sent = true
+			if err = c.call(ctx, id, bc, fn); err == nil {
+				c.count(func(m *Metrics) *Counter { return m.BrokerRequests }, "broker_requests", labels)
+				return nil
+			}
+			c.drop(id, bc)
+		}
+		c.count(func(m *Metrics) *Counter { return m.BrokerRequestErrors }, "broker_request_errors", labels)
+		if err == errUnknownBroker || err == protocol.ErrUnsupportedVersion || attempt == brokerClientRetries || (sent && !idempotent) {
+			return err
+		}
+		c.count(func(m *Metrics) *Counter { return m.BrokerRequestRetries }, "broker_request_retries", labels)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// call calls fn with the connection to the broker. If the context's done first
+// the connection's dropped, which fails the request fn's waiting on.
+func (c *brokerClient) call(ctx context.Context, id int32, bc *brokerConn, fn func(*brokerConn) error) error {
+	// not closed since fn may finish after the context's done
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(bc)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		c.drop(id, bc)
+		return ctx.Err()
+	}
+}
+
+// connect returns the connection to the broker, dialing it and asking for its
+// API versions if there isn't one or the broker's address changed. It dials
+// without holding the client's lock so a slow or unreachable broker doesn't
+// hold up requests to the others.
+func (c *brokerClient) connect(ctx context.Context, id int32) (*brokerConn, error) {
+	broker := c.lookup.BrokerByID(raft.ServerID(fmt.Sprintf("%d", id)))
+	if broker == nil {
+		return nil, errUnknownBroker
+	}
+	c.mu.Lock()
+	if bc, ok := c.conns[id]; ok {
+		if bc.addr == broker.PeerAddr() {
+			c.mu.Unlock()
+			return bc, nil
+		}
+		bc.conn.Close()
+		delete(c.conns, id)
+	}
+	c.mu.Unlock()
+	conn, err := c.dialer.DialContext(ctx, "tcp", broker.PeerAddr())
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.APIVersions(&protocol.APIVersionsRequest{APIVersion: 1})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	bc := &brokerConn{
+		addr:     broker.PeerAddr(),
+		conn:     conn,
+		versions: make(map[int16]protocol.APIVersion, len(res.APIVersions)),
+	}
+	for _, v := range res.APIVersions {
+		bc.versions[v.APIKey] = v
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if other, ok := c.conns[id]; ok && other.addr == bc.addr {
+		// another request connected first
+		conn.Close()
+		return other, nil
+	}
+	if other, ok := c.conns[id]; ok {
+		other.conn.Close()
+	}
+	c.conns[id] = bc
+	return bc, nil
+}
+
+// drop closes the connection to the broker so the next request redials.
+func (c *brokerClient) drop(id int32, bc *brokerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[id] == bc {
+		delete(c.conns, id)
+	}
+	bc.conn.Close()
+}
+
+// close closes the connections to the brokers.
+func (c *brokerClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, bc := range c.conns {
+		bc.conn.Close()
+		delete(c.conns, id)
+	}
+}
+
+func (c *brokerClient) count(counter func(*Metrics) *Counter, name string, labels []string) {
+	c.mu.Lock()
+	m := c.metrics
+	c.mu.Unlock()
+	if m == nil {
+		return
+	}
+	m.add(counter(m), name, 1, labels...)
+}
+
+// negotiateVersion returns the highest version of the API up to max that the
+// broker with the given versions supports.
+func negotiateVersion(versions map[int16]protocol.APIVersion, key, max int16) (int16, error) {
+	v, ok := versions[key]
+	if !ok {
+		return 0, protocol.ErrUnsupportedVersion
+	}
+	if max > v.MaxVersion {
+		max = v.MaxVersion
+	}
+	if max < v.MinVersion {
+		return 0, protocol.ErrUnsupportedVersion
+	}
+	return max, nil
+}
+
+// maxVersion returns the highest version of the API this broker supports.
+func maxVersion(key int16) int16 {
+	for _, v := range protocol.APIVersions {
+		if v.APIKey == key {
+			return v.MaxVersion
+		}
+	}
+	return 0
+}
+
+// fenceController fences requests the broker sends as the controller once it
+// isn't anymore.
+func (b *Broker) fenceController() error {
+	if !b.isController() {
+		return protocol.ErrNotController
+	}
+	return nil
+}
+
+// fenceLeader returns a fence for requests forwarded to the partition's leader
+// once its leader isn't the given broker anymore.
+func (b *Broker) fenceLeader(topic string, partition, leader int32) func() error {
+	return func() error {
+		_, p, err := b.fsm.State().GetPartition(topic, partition)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return protocol.ErrUnknownTopicOrPartition
+		}
+		if p.Leader != leader {
+			return protocol.ErrNotLeaderForPartition
+		}
+		return nil
+	}
+}
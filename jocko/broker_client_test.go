@@ -0,0 +1,102 @@
+package jocko
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	versions := map[int16]protocol.APIVersion{
+		protocol.ProduceKey:      {APIKey: protocol.ProduceKey, MinVersion: 0, MaxVersion: 3},
+		protocol.LeaderAndISRKey: {APIKey: protocol.LeaderAndISRKey, MinVersion: 1, MaxVersion: 1},
+	}
+	tests := []struct {
+		name string
+		key  int16
+		max  int16
+		exp  int16
+		err  error
+	}{
+		{name: "supported", key: protocol.ProduceKey, max: 2, exp: 2},
+		{name: "downgraded", key: protocol.ProduceKey, max: 5, exp: 3},
+		{name: "too old", key: protocol.LeaderAndISRKey, max: 0, err: protocol.ErrUnsupportedVersion},
+		{name: "unknown api", key: protocol.FetchKey, max: 0, err: protocol.ErrUnsupportedVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := negotiateVersion(versions, test.key, test.max)
+			require.Equal(t, test.err, err)
+			require.Equal(t, test.exp, v)
+		})
+	}
+}
+
+func TestBrokerClientRetries(t *testing.T) {
+	// the broker answers api versions requests and drops the connection on
+	// any other request
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	var mu sync.Mutex
+	requests := make(map[int16]int)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var size int32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					buf := make([]byte, size)
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					key := int16(binary.BigEndian.Uint16(buf))
+					if key != protocol.APIVersionsKey {
+						mu.Lock()
+						requests[key]++
+						mu.Unlock()
+						return
+					}
+					b, err := protocol.Encode(&protocol.Response{
+						CorrelationID: int32(binary.BigEndian.Uint32(buf[4:])),
+						Body:          &protocol.APIVersionsResponse{APIVersion: 1, APIVersions: protocol.APIVersions},
+					})
+					if err != nil {
+						return
+					}
+					if _, err := conn.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	lookup := NewBrokerLookup()
+	lookup.AddBroker(&metadata.Broker{ID: 2, RaftAddr: "broker-2", BrokerAddr: ln.Addr().String()})
+	c := newBrokerClient(1, lookup)
+	defer c.close()
+
+	// produces may have been appended so aren't sent again
+	_, err = c.Produce(context.Background(), 2, &protocol.ProduceRequest{Acks: 1}, nil)
+	require.Error(t, err)
+	_, err = c.LeaderAndISR(context.Background(), 2, &protocol.LeaderAndISRRequest{}, nil)
+	require.Error(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, requests[protocol.ProduceKey])
+	require.Equal(t, brokerClientRetries+1, requests[protocol.LeaderAndISRKey])
+}
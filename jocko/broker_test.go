@@ -6,20 +6,22 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/hashicorp/consul/testutil/retry"
-	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/require"
 
 	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
 	"github.com/travisjeffery/jocko/jocko/structs"
 	"github.com/travisjeffery/jocko/log"
 	"github.com/travisjeffery/jocko/protocol"
@@ -104,7 +106,11 @@ func TestBroker_Run(t *testing.T) {
 				responses: []*Context{{
 					header: &protocol.RequestHeader{CorrelationID: 1},
 					res: &protocol.Response{CorrelationID: 1, Body: &protocol.CreateTopicsResponse{
-						TopicErrorCodes: []*protocol.TopicErrorCode{{Topic: "test-topic", ErrorCode: protocol.ErrInvalidReplicationFactor.Code()}},
+						TopicErrorCodes: []*protocol.TopicErrorCode{{
+							Topic:        "test-topic",
+							ErrorCode:    protocol.ErrInvalidReplicationFactor.Code(),
+							ErrorMessage: &invalidReplicationFactorMsg,
+						}},
 					}},
 				}},
 			},
@@ -284,7 +290,7 @@ func TestBroker_Run(t *testing.T) {
 								PartitionResponses: []*protocol.FetchPartitionResponse{{
 									Partition:     0,
 									ErrorCode:     protocol.ErrNone.Code(),
-									HighWatermark: 0,
+									HighWatermark: 1,
 									RecordSet:     mustEncode(&protocol.MessageSet{Offset: 0, Messages: []*protocol.Message{{Value: []byte("The message.")}}}),
 								}},
 							}}},
@@ -389,7 +395,7 @@ func TestBroker_Run(t *testing.T) {
 					res: &protocol.Response{CorrelationID: 2, Body: &protocol.ProduceResponse{
 						Responses: []*protocol.ProduceTopicResponse{{
 							Topic:              "another-topic",
-							PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, ErrorCode: protocol.ErrUnknownTopicOrPartition.Code()}},
+							PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: -1, LogStartOffset: -1, ErrorCode: protocol.ErrUnknownTopicOrPartition.Code()}},
 						}},
 					}}}},
 			},
@@ -439,6 +445,35 @@ func TestBroker_Run(t *testing.T) {
 					}},
 				}},
 			},
+		},		{
+			name: "controlled shutdown",
+			fields: fields{
+				topics: map[*structs.Topic][]*structs.Partition{
+					&structs.Topic{Topic: "test-topic", Partitions: map[int32][]int32{0: []int32{1}}}: []*structs.Partition{{
+						Topic:           "test-topic",
+						ID:              0,
+						Partition:       0,
+						Leader:          1,
+						AR:              []int32{1},
+						ISR:             []int32{1},
+					}},
+				},
+			},
+			args: args{
+				requestCh:  make(chan *Context, 2),
+				responseCh: make(chan *Context, 2),
+				requests: []*Context{{
+					header: &protocol.RequestHeader{CorrelationID: 1},
+					req:    &protocol.ControlledShutdownRequest{APIVersion: 1, BrokerID: 1},
+				}},
+				responses: []*Context{{
+					header: &protocol.RequestHeader{CorrelationID: 1},
+					res: &protocol.Response{CorrelationID: 1, Body: &protocol.ControlledShutdownResponse{
+						APIVersion:          1,
+						PartitionsRemaining: []*protocol.ControlledShutdownPartition{{Topic: "test-topic", Partition: 0}},
+					}},
+				}},
+			},
 		},
 	}
 	for _, tt := range tests {
@@ -610,8 +645,9 @@ func TestBroker_Run_JoinSyncGroup(t *testing.T) {
 			ClientID:      "join-and-sync",
 		},
 		req: &protocol.JoinGroupRequest{
-			GroupID:      "test-group",
-			ProtocolType: "consumer",
+			GroupID:        "test-group",
+			SessionTimeout: 10000,
+			ProtocolType:   "consumer",
 			GroupProtocols: []*protocol.GroupProtocol{{
 				ProtocolName:     "protocolname",
 				ProtocolMetadata: []byte("protocolmetadata"),
@@ -1047,7 +1083,7 @@ func waitForLeader(t *testing.T, servers ...*Server) {
 	retry.Run(t, func(r *retry.R) {
 		var leader *Server
 		for _, s := range servers {
-			if raft.Leader == s.broker().raft.State() {
+			if s.broker().isController() {
 				leader = s
 			}
 		}
@@ -1106,6 +1142,8 @@ func wantPeers(s *Broker, peers int) error {
 	return nil
 }
 
+var invalidReplicationFactorMsg = "invalid replication factor: replication factor 2 is larger than the 1 live brokers"
+
 func handleProduceResponse(t *testing.T, res *protocol.ProduceResponse) {
 	for _, response := range res.Responses {
 		for _, pr := range response.PartitionResponses {
@@ -1123,3 +1161,115 @@ func handleProduceResponse(t *testing.T, res *protocol.ProduceResponse) {
 func (s *Server) broker() *Broker {
 	return s.handler.(*Broker)
 }
+
+func TestDisabledAPIs(t *testing.T) {
+	req := require.New(t)
+	disabled := []int16{protocol.DeleteTopicsKey, protocol.AlterConfigsKey}
+	versions := enabledAPIVersions(disabled)
+	req.Equal(len(protocol.APIVersions)-2, len(versions))
+	for _, v := range versions {
+		req.False(apiDisabled(disabled, v.APIKey))
+	}
+	req.Equal(protocol.APIVersions, enabledAPIVersions(nil))
+
+	res := unsupportedVersion(&protocol.RequestHeader{APIKey: protocol.DeleteTopicsKey, APIVersion: 0}, disabled)
+	req.Equal(&protocol.UnsupportedVersionResponse{ErrorCode: protocol.ErrUnsupportedVersion.Code()}, res)
+	res = unsupportedVersion(&protocol.RequestHeader{APIKey: protocol.APIVersionsKey, APIVersion: 5}, disabled)
+	req.Equal(versions, res.(*protocol.APIVersionsResponse).APIVersions)
+
+	req.NoError(ValidateDisabledAPIs(disabled))
+	for _, key := range []int16{protocol.APIVersionsKey, protocol.LeaderAndISRKey, protocol.StopReplicaKey, protocol.FetchKey, protocol.UpdateMetadataKey} {
+		req.Error(ValidateDisabledAPIs([]int16{protocol.DeleteTopicsKey, key}), protocol.APIKeyName(key))
+	}
+}
+
+func TestBroker_PartitionDir(t *testing.T) {
+	req := require.New(t)
+	dataDir, err := ioutil.TempDir("", "jocko-partition-dir")
+	req.NoError(err)
+	defer os.RemoveAll(dataDir)
+	f, err := fsm.New(opentracing.GlobalTracer())
+	req.NoError(err)
+	b := &Broker{config: &config.Config{ID: 1, DataDir: dataDir}, fsm: f}
+	req.NoError(f.State().EnsureTopic(1, &structs.Topic{Topic: "test-topic", Partitions: map[int32][]int32{0: {1}, 1: {1}}}))
+	req.NoError(f.State().EnsureTopic(2, &structs.Topic{Topic: "other-topic", Partitions: map[int32][]int32{0: {2}, 1: {1}}}))
+
+	// data kept by the partition's ID alone is moved to its directory
+	old := filepath.Join(dataDir, "data", "0")
+	req.NoError(os.MkdirAll(old, 0755))
+	req.NoError(ioutil.WriteFile(filepath.Join(old, "00000000000000000000.log"), []byte("v"), 0644))
+	dir := b.partitionDir("test-topic", 0)
+	req.NoError(b.migratePartitionDir(dir, "test-topic", 0))
+	_, err = os.Stat(filepath.Join(dir, "00000000000000000000.log"))
+	req.NoError(err)
+	_, err = os.Stat(old)
+	req.True(os.IsNotExist(err))
+
+	// unless another topic has the partition here too and it may be its
+	shared := filepath.Join(dataDir, "data", "1")
+	req.NoError(os.MkdirAll(shared, 0755))
+	req.NoError(b.migratePartitionDir(b.partitionDir("test-topic", 1), "test-topic", 1))
+	_, err = os.Stat(shared)
+	req.NoError(err)
+	_, err = os.Stat(b.partitionDir("test-topic", 1))
+	req.True(os.IsNotExist(err))
+
+	// data of a recreated topic's quarantined rather than deleted
+	req.NoError(b.ensurePartitionMetadata(dir, "a"))
+	req.NoError(b.ensurePartitionMetadata(dir, "b"))
+	_, err = os.Stat(filepath.Join(dataDir, quarantineDir, "test-topic-0.a", "00000000000000000000.log"))
+	req.NoError(err)
+	p, err := ioutil.ReadFile(filepath.Join(dir, partitionMetadataFile))
+	req.NoError(err)
+	req.Equal("topic_id: b\n", string(p))
+}
+
+func TestLogRetention(t *testing.T) {
+	req := require.New(t)
+	// topics that don't set retention keep everything
+	config := structs.NewTopicConfig()
+	size, age := logRetention(config)
+	req.Equal(int64(-1), size)
+	req.Equal(time.Duration(0), age)
+
+	config.SetValue("retention.bytes", int64(1024))
+	config.SetValue("retention.ms", int64(60000))
+	size, age = logRetention(config)
+	req.Equal(int64(1024), size)
+	req.Equal(time.Minute, age)
+}
+
+func TestAlterTopicConfigs(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(opentracing.GlobalTracer())
+	req.NoError(err)
+	b := &Broker{config: &config.Config{ID: 1}, fsm: f, store: &fsmStore{fsm: f}, tracer: opentracing.NoopTracer{}}
+	topicConfig := structs.NewTopicConfig()
+	topicConfig.SetValue("retention.ms", int64(1000))
+	partition := structs.Partition{Topic: "test", ID: 0, Partition: 0, Leader: 1, AR: []int32{1}, ISR: []int32{1}}
+	req.NoError(b.registerTopic(structs.Topic{Topic: "test", Partitions: map[int32][]int32{0: partition.AR}, Config: topicConfig}, []structs.Partition{partition}))
+
+	// the request's configs replace the topic's rather than merge into them
+	size := "2048"
+	req.Equal(protocol.ErrNone, b.alterTopicConfigs(protocol.AlterConfigsResource{
+		Type:    protocol.TopicResourceType,
+		Name:    "test",
+		Entries: []protocol.AlterConfigsEntry{{Name: "retention.bytes", Value: &size}},
+	}, false))
+	_, topic, err := f.State().GetTopic("test")
+	req.NoError(err)
+	req.Nil(topic.Config.Get("retention.ms").Value)
+	req.Equal(int64(2048), topic.Config.GetInt64("retention.bytes"))
+	req.Equal(map[int32][]int32{0: {1}}, topic.Partitions)
+
+	invalid := "soon"
+	req.Equal(protocol.ErrInvalidConfig.Code(), b.alterTopicConfigs(protocol.AlterConfigsResource{
+		Type:    protocol.TopicResourceType,
+		Name:    "test",
+		Entries: []protocol.AlterConfigsEntry{{Name: "retention.ms", Value: &invalid}},
+	}, false).Code())
+	req.Equal(protocol.ErrUnknownTopicOrPartition, b.alterTopicConfigs(protocol.AlterConfigsResource{
+		Type: protocol.TopicResourceType,
+		Name: "missing",
+	}, false))
+}
@@ -0,0 +1,246 @@
+package jocko
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/log"
+)
+
+const defaultBurstDrainTick = 10 * time.Millisecond
+
+// burstBuffer absorbs bursts of records produced to a topic with a burst
+// buffer. Record sets that fit in the buffer are staged, in memory, and drained
+// to the partition's log in order at the topic's drain rate, so a burst is
+// written out over time rather than holding up the broker's other requests
+// behind its appends. Record sets that don't fit are appended synchronously
+// once the buffer's drained ahead of them.
+//
+// Staged records aren't acknowledged until they're drained, so if the broker
+// loses the partition's leadership, or crashes, before they are, their
+// producers get an error, or time out, and retry.
+type burstBuffer struct {
+	// limits returns the most bytes staged at a time and the bytes a second
+	// drained, so changes to the topic's configs are picked up.
+	limits func() (bytes int64, drainRate int64)
+	tick   time.Duration
+	append func(recordSet []byte) (int64, error)
+
+	// appendMu orders the drained and synchronous appends, and guards the
+	// budget.
+	appendMu sync.Mutex
+	// budget is how many bytes the drain can append, carried between ticks
+	// while there's a backlog so a set bigger than a tick's worth delays the
+	// next.
+	budget int64
+
+	mu     sync.Mutex
+	staged []*stagedRecords
+	size   int
+	closed bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+type burstBufferConfig struct {
+	// Limits returns the most bytes of record sets staged at a time, and how
+	// many bytes a second are drained to the log, or as fast as they're
+	// staged if it's 0. It's called on each append and tick.
+	Limits func() (bytes int64, drainRate int64)
+	// Append appends a record set to the partition's log.
+	Append func(recordSet []byte) (int64, error)
+	Tick   time.Duration
+}
+
+func newBurstBuffer(config burstBufferConfig) *burstBuffer {
+	if config.Tick == 0 {
+		config.Tick = defaultBurstDrainTick
+	}
+	return &burstBuffer{
+		limits: config.Limits,
+		tick:   config.Tick,
+		append: config.Append,
+		done:   make(chan struct{}),
+	}
+}
+
+// stagedRecords is a record set in the buffer. done's closed once it's been
+// appended, or failed, and offset or err set.
+type stagedRecords struct {
+	q         *burstBuffer
+	recordSet []byte
+	offset    int64
+	err       error
+	done      chan struct{}
+	// canceled and appending are guarded by the buffer's mu.
+	canceled  bool
+	appending bool
+}
+
+func (s *stagedRecords) finish(offset int64, err error) {
+	s.offset, s.err = offset, err
+	close(s.done)
+}
+
+// Wait waits for the record set to be appended and returns its offset. If ctx
+// is done first the record set's canceled, and dropped rather than appended,
+// unless it's already being appended, in which case that's waited for.
+func (s *stagedRecords) Wait(ctx context.Context) (int64, error) {
+	select {
+	case <-s.done:
+		return s.offset, s.err
+	case <-ctx.Done():
+	}
+	s.q.mu.Lock()
+	canceled := !s.appending
+	s.canceled = s.canceled || canceled
+	s.q.mu.Unlock()
+	if !canceled {
+		<-s.done
+		return s.offset, s.err
+	}
+	return -1, ctx.Err()
+}
+
+// Append stages the record set if it fits in the buffer, to be waited on for
+// its offset once it's drained. Otherwise, or once the buffer's closed, it's
+// appended behind the staged records and returned done.
+func (q *burstBuffer) Append(recordSet []byte) (*stagedRecords, error) {
+	bytes, _ := q.limits()
+	s := &stagedRecords{q: q, recordSet: recordSet, done: make(chan struct{})}
+	q.mu.Lock()
+	if !q.closed && int64(q.size+len(recordSet)) <= bytes {
+		q.staged = append(q.staged, s)
+		q.size += len(recordSet)
+		q.mu.Unlock()
+		return s, nil
+	}
+	q.mu.Unlock()
+	offset, err := q.AppendSync(recordSet)
+	if err != nil {
+		return nil, err
+	}
+	s.finish(offset, nil)
+	return s, nil
+}
+
+// AppendSync drains the staged records and appends the record set behind
+// them, e.g. for a transaction's marker, which has to follow its records.
+func (q *burstBuffer) AppendSync(recordSet []byte) (int64, error) {
+	q.appendMu.Lock()
+	defer q.appendMu.Unlock()
+	if err := q.drain(true); err != nil {
+		return 0, err
+	}
+	return q.append(recordSet)
+}
+
+// Staged returns the number of bytes staged and not yet drained.
+func (q *burstBuffer) Staged() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Run drains the staged records a tick's worth at a time until the buffer's
+// closed or stop is.
+func (q *burstBuffer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(q.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			q.advance()
+		}
+	}
+}
+
+// Close stops the ticks and drains what's staged. If the staged records can't
+// be appended, e.g. because the broker's no longer the partition's leader,
+// they're failed with the error so their producers retry.
+func (q *burstBuffer) Close() error {
+	q.once.Do(func() { close(q.done) })
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.appendMu.Lock()
+	defer q.appendMu.Unlock()
+	err := q.drain(true)
+	if err != nil {
+		q.mu.Lock()
+		for _, s := range q.staged {
+			s.finish(-1, err)
+		}
+		q.staged = nil
+		q.size = 0
+		q.mu.Unlock()
+	}
+	return err
+}
+
+// advance drains the tick's worth of staged records.
+func (q *burstBuffer) advance() {
+	q.appendMu.Lock()
+	defer q.appendMu.Unlock()
+	_, rate := q.limits()
+	perTick := rate * int64(q.tick) / int64(time.Second)
+	if rate > 0 && perTick == 0 {
+		perTick = 1
+	}
+	all := perTick <= 0
+	if !all {
+		q.budget += perTick
+	}
+	if err := q.drain(all); err != nil {
+		log.Error.Printf("burst buffer: drain error: %s", err)
+	}
+	// an idle buffer doesn't save up for a burst
+	if q.Staged() == 0 && q.budget > 0 {
+		q.budget = 0
+	}
+}
+
+// drain appends the staged record sets in order while there's budget, or all
+// of them, stopping at the first that fails so it's retried. appendMu must be
+// held.
+func (q *burstBuffer) drain(all bool) error {
+	for all || q.budget > 0 {
+		q.mu.Lock()
+		if len(q.staged) == 0 {
+			q.mu.Unlock()
+			return nil
+		}
+		s := q.staged[0]
+		if s.canceled {
+			q.staged[0] = nil
+			q.staged = q.staged[1:]
+			q.size -= len(s.recordSet)
+			q.mu.Unlock()
+			s.finish(-1, context.Canceled)
+			continue
+		}
+		s.appending = true
+		q.mu.Unlock()
+		offset, err := q.append(s.recordSet)
+		q.mu.Lock()
+		if err != nil {
+			s.appending = false
+			q.mu.Unlock()
+			return err
+		}
+		q.staged[0] = nil
+		q.staged = q.staged[1:]
+		q.size -= len(s.recordSet)
+		q.mu.Unlock()
+		s.finish(offset, nil)
+		if !all {
+			q.budget -= int64(len(s.recordSet))
+		}
+	}
+	return nil
+}
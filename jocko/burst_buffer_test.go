@@ -0,0 +1,162 @@
+package jocko
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBurstBuffer(t *testing.T) {
+	var mu sync.Mutex
+	var appended []string
+	var failed error
+	q := newBurstBuffer(burstBufferConfig{
+		// a tick drains 4 bytes
+		Limits: func() (int64, int64) { return 10, 4000 },
+		Tick:   time.Millisecond,
+		Append: func(recordSet []byte) (int64, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed != nil {
+				return 0, failed
+			}
+			appended = append(appended, string(recordSet))
+			return int64(len(appended) - 1), nil
+		},
+	})
+	appendedRecords := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), appended...)
+	}
+
+	// the burst's staged until the buffer's full, and waits to be appended
+	var staged []*stagedRecords
+	for _, rs := range []string{"aaa", "bbb", "ccc"} {
+		s, err := q.Append([]byte(rs))
+		require.NoError(t, err)
+		select {
+		case <-s.done:
+			t.Fatal("staged records done before they're appended")
+		default:
+		}
+		staged = append(staged, s)
+	}
+	require.Equal(t, 9, q.Staged())
+	require.Empty(t, appendedRecords())
+
+	// a tick drains its worth, the last set it starts can overdraw the
+	// budget which the next tick pays back
+	q.advance()
+	require.Equal(t, []string{"aaa", "bbb"}, appendedRecords())
+	q.advance()
+	require.Equal(t, []string{"aaa", "bbb", "ccc"}, appendedRecords())
+	require.Equal(t, 0, q.Staged())
+	for i, s := range staged {
+		offset, err := s.Wait(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, int64(i), offset)
+	}
+
+	// an idle buffer doesn't save up, and a set that doesn't fit is appended
+	// behind the staged ones
+	q.advance()
+	q.advance()
+	_, err := q.Append([]byte("dddddd"))
+	require.NoError(t, err)
+	s, err := q.Append([]byte("eeeeee"))
+	require.NoError(t, err)
+	offset, err := s.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(4), offset)
+	require.Equal(t, []string{"aaa", "bbb", "ccc", "dddddd", "eeeeee"}, appendedRecords())
+
+	// failed drains are retried
+	_, err = q.Append([]byte("f"))
+	require.NoError(t, err)
+	mu.Lock()
+	failed = errors.New("failed")
+	mu.Unlock()
+	q.advance()
+	require.Equal(t, 1, q.Staged())
+	mu.Lock()
+	failed = nil
+	mu.Unlock()
+	q.advance()
+	require.Equal(t, 0, q.Staged())
+
+	// closing drains what's staged, and appends after aren't staged
+	go q.Run(nil)
+	_, err = q.Append([]byte("g"))
+	require.NoError(t, err)
+	require.NoError(t, q.Close())
+	require.Equal(t, 0, q.Staged())
+	s, err = q.Append([]byte("h"))
+	require.NoError(t, err)
+	offset, err = s.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(7), offset)
+	require.Equal(t, []string{"aaa", "bbb", "ccc", "dddddd", "eeeeee", "f", "g", "h"}, appendedRecords())
+}
+
+func TestBurstBufferClosedFailsStaged(t *testing.T) {
+	notLeader := errors.New("not leader")
+	limit := int64(10)
+	var mu sync.Mutex
+	q := newBurstBuffer(burstBufferConfig{
+		Limits: func() (int64, int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			return limit, 1
+		},
+		Tick:   time.Hour,
+		Append: func(recordSet []byte) (int64, error) { return 0, notLeader },
+	})
+
+	// records staged when the leadership's lost are failed, not dropped
+	s, err := q.Append([]byte("aaa"))
+	require.NoError(t, err)
+	require.Equal(t, notLeader, q.Close())
+	_, err = s.Wait(context.Background())
+	require.Equal(t, notLeader, err)
+	require.Equal(t, 0, q.Staged())
+
+	// the limits are read on each append
+	q = newBurstBuffer(burstBufferConfig{
+		Limits: func() (int64, int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			return limit, 1
+		},
+		Tick:   time.Hour,
+		Append: func(recordSet []byte) (int64, error) { return 0, nil },
+	})
+	_, err = q.Append([]byte("aaa"))
+	require.NoError(t, err)
+	require.Equal(t, 3, q.Staged())
+	mu.Lock()
+	limit = 0
+	mu.Unlock()
+	s, err = q.Append([]byte("bbb"))
+	require.NoError(t, err)
+	_, err = s.Wait(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, q.Staged())
+
+	// records whose produce timed out before they're appended are dropped
+	mu.Lock()
+	limit = 10
+	mu.Unlock()
+	s, err = q.Append([]byte("ccc"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.Wait(ctx)
+	require.Equal(t, context.Canceled, err)
+	q.advance()
+	require.Equal(t, 0, q.Staged())
+}
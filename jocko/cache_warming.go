@@ -0,0 +1,228 @@
+package jocko
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/travisjeffery/jocko/log"
+)
+
+const (
+	// heatMapFile is written to the data dir with the partitions' traffic
+	// while the broker runs, if it warms the page cache, for the next start
+	// to warm it with the hottest partitions' tails.
+	heatMapFile = ".jocko_heatmap"
+	// heatMapInterval is how often the heat map's written, so it's recent
+	// even if the broker doesn't shut down cleanly.
+	heatMapInterval = time.Minute
+	// warmReadBytes is how much of a segment's read at a time warming it.
+	warmReadBytes = 1024 * 1024
+	// heatHalfLife is how long after a partition was last active its traffic
+	// counts for half as much, so partitions that are busy now are warmed
+	// before ones that were busy long ago.
+	heatHalfLife = time.Hour
+)
+
+// partitionHeat is a partition's traffic in the heat map.
+type partitionHeat struct {
+	Topic      string    `json:"topic"`
+	Partition  int32     `json:"partition"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// score is the partition's bytes produced and fetched, weighted by how long
+// before now it was last active.
+func (h *partitionHeat) score(now time.Time) float64 {
+	age := now.Sub(h.LastActive)
+	if age < 0 {
+		age = 0
+	}
+	return float64(h.BytesIn+h.BytesOut) * math.Exp2(-float64(age)/float64(heatHalfLife))
+}
+
+// heat returns the partitions' traffic since the broker started, hottest
+// first.
+func (t *trafficStats) heat(now time.Time) []*partitionHeat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	heat := make([]*partitionHeat, 0, len(t.partitions))
+	for tp, c := range t.partitions {
+		heat = append(heat, &partitionHeat{
+			Topic:      tp.topic,
+			Partition:  tp.partition,
+			BytesIn:    c.in,
+			BytesOut:   c.out,
+			LastActive: c.last,
+		})
+	}
+	sortHeat(heat, now)
+	return heat
+}
+
+// sortHeat sorts the partitions by their scores at now, hottest first.
+func sortHeat(heat []*partitionHeat, now time.Time) {
+	sort.SliceStable(heat, func(i, j int) bool {
+		return heat[i].score(now) > heat[j].score(now)
+	})
+}
+
+// writeHeatMap writes the partitions' traffic to the data dir's heat map,
+// replacing the last one if there's been traffic since the broker started.
+func (b *Broker) writeHeatMap() {
+	heat := b.traffic.heat(time.Now())
+	if len(heat) == 0 {
+		return
+	}
+	buf, err := json.Marshal(heat)
+	if err == nil {
+		path := filepath.Join(b.config.DataDir, heatMapFile)
+		if err = ioutil.WriteFile(path+".tmp", buf, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Error.Printf("broker/%d: write heat map error: %s", b.config.ID, err)
+	}
+}
+
+// readHeatMap returns the partitions' traffic from the data dir's heat map,
+// hottest first, or nil if there isn't one.
+func readHeatMap(dataDir string) ([]*partitionHeat, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dataDir, heatMapFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var heat []*partitionHeat
+	if err := json.Unmarshal(buf, &heat); err != nil {
+		return nil, err
+	}
+	sortHeat(heat, time.Now())
+	return heat, nil
+}
+
+// warmPageCache reads the tails of the partitions that were hottest, favouring
+// the most recently active, when the broker last ran, CacheWarmBytes of each of
+// up to CacheWarmPartitions of them, so they're in the page cache for the first
+// consumers after a restart rather than read from a cold disk. It returns early
+// once stop is closed.
+func (b *Broker) warmPageCache(stop <-chan struct{}) {
+	heat, err := readHeatMap(b.config.DataDir)
+	if err != nil {
+		log.Error.Printf("broker/%d: read heat map error: %s", b.config.ID, err)
+		return
+	}
+	if len(heat) > b.config.CacheWarmPartitions {
+		heat = heat[:b.config.CacheWarmPartitions]
+	}
+	start := time.Now()
+	var warmed int64
+	for _, h := range heat {
+		n, err := warmPartition(b.partitionDir(h.Topic, h.Partition), b.config.CacheWarmBytes, stop)
+		warmed += n
+		if err != nil {
+			log.Error.Printf("broker/%d: warm %s-%d error: %s", b.config.ID, h.Topic, h.Partition, err)
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+	log.Info.Printf("broker/%d: warmed page cache with %d bytes of %d partitions in %s", b.config.ID, warmed, len(heat), time.Since(start))
+}
+
+// warmPartition reads up to n bytes from the end of the partition's log,
+// newest segments first, and returns how many it read.
+func warmPartition(dir string, n int64, stop <-chan struct{}) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		// the partition's been moved or deleted since
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var segments []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".log") {
+			segments = append(segments, f.Name())
+		}
+	}
+	// segments are named by their zero padded base offsets
+	sort.Sort(sort.Reverse(sort.StringSlice(segments)))
+	var read int64
+	buf := make([]byte, warmReadBytes)
+	for _, name := range segments {
+		if read >= n {
+			break
+		}
+		r, err := warmFile(filepath.Join(dir, name), n-read, buf, stop)
+		read += r
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// warmFile reads up to n bytes from the end of the file.
+func warmFile(path string, n int64, buf []byte, stop <-chan struct{}) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset := fi.Size() - n
+	if offset < 0 {
+		offset = 0
+	}
+	var read int64
+	for pos := offset; pos < fi.Size(); {
+		select {
+		case <-stop:
+			return read, nil
+		default:
+		}
+		m, err := f.ReadAt(buf, pos)
+		read += int64(m)
+		pos += int64(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// writeHeatMaps writes the heat map each heatMapInterval until stop is closed.
+func (b *Broker) writeHeatMaps(stop <-chan struct{}) {
+	t := time.NewTicker(heatMapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			b.writeHeatMap()
+			return
+		case <-t.C:
+			b.writeHeatMap()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+)
+
+func TestHeatMap(t *testing.T) {
+	req := require.New(t)
+	dir, err := ioutil.TempDir("", "heatmaptest")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	b := &Broker{config: &config.Config{DataDir: dir}, traffic: newTrafficStats()}
+
+	// nothing's written without traffic
+	b.writeHeatMap()
+	heat, err := readHeatMap(dir)
+	req.NoError(err)
+	req.Nil(heat)
+
+	now := time.Now()
+	b.traffic.record("test", 0, "client", 100, 10, now)
+	b.traffic.record("test", 1, "client", 10, 1000, now)
+	b.traffic.record("other", 0, "client", 500, 10, now)
+	// the most traffic but long ago
+	b.traffic.record("stale", 0, "client", 0, 100000, now.Add(-24*time.Hour))
+	b.writeHeatMap()
+	heat, err = readHeatMap(dir)
+	req.NoError(err)
+	req.Equal(4, len(heat))
+	req.Equal("test", heat[0].Topic)
+	req.Equal(int32(1), heat[0].Partition)
+	req.Equal(int64(1000), heat[0].BytesOut)
+	req.Equal("other", heat[1].Topic)
+	req.Equal(int32(0), heat[2].Partition)
+	req.Equal("stale", heat[3].Topic)
+}
+
+func TestWarmPartition(t *testing.T) {
+	req := require.New(t)
+	dir, err := ioutil.TempDir("", "warmtest")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	for name, size := range map[string]int{
+		"00000000000000000000.log":   100,
+		"00000000000000000000.index": 100,
+		"00000000000000000010.log":   30,
+	} {
+		req.NoError(ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644))
+	}
+
+	// the newest segment's read first, then the tail of the one before
+	n, err := warmPartition(dir, 50, nil)
+	req.NoError(err)
+	req.Equal(int64(50), n)
+	n, err = warmPartition(dir, 1000, nil)
+	req.NoError(err)
+	req.Equal(int64(130), n)
+
+	n, err = warmPartition(filepath.Join(dir, "missing"), 50, nil)
+	req.NoError(err)
+	req.Equal(int64(0), n)
+}
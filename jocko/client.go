@@ -0,0 +1,183 @@
+package jocko
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// defaultListener is the name of the listener on the broker's address,
+	// as opposed to the listeners configured by name.
+	defaultListener = "PLAINTEXT"
+	// anonymousPrincipal is the principal of clients that haven't
+	// authenticated.
+	anonymousPrincipal = "User:ANONYMOUS"
+)
+
+// ClientInfo describes the client on the other end of a connection. The server
+// creates one per connection and every request read from the connection
+// carries it in its context, so handlers can apply quotas and ACLs, audit and
+// measure requests per client without keeping their own state per connection.
+// Its methods are safe to call on a nil ClientInfo, e.g. for requests that
+// didn't come from a connection.
+type ClientInfo struct {
+	// Addr is the client's address.
+	Addr net.Addr
+	// Listener is the name of the listener the client connected to.
+	Listener string
+
+	mu          sync.RWMutex
+	id          string
+	principal   string
+	apiVersions map[int16]int16
+	// sasl is the client's SASL exchange, from its handshake until it's
+	// authenticated.
+	sasl *scramServer
+	// authenticated is whether the client's finished a SASL exchange, and
+	// tokenID the delegation token it authenticated with. sessionExpiry is
+	// when, in ms since the epoch, the session the client was given ends.
+	authenticated bool
+	tokenID       string
+	sessionExpiry int64
+}
+
+func newClientInfo(conn net.Conn, listener string) *ClientInfo {
+	return &ClientInfo{
+		Addr:        conn.RemoteAddr(),
+		Listener:    listener,
+		principal:   anonymousPrincipal,
+		apiVersions: make(map[int16]int16),
+	}
+}
+
+// ID returns the client ID the client sent with its last request.
+func (c *ClientInfo) ID() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.id
+}
+
+// Principal returns who the client authenticated as.
+func (c *ClientInfo) Principal() string {
+	if c == nil {
+		return anonymousPrincipal
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.principal
+}
+
+// SetPrincipal sets who the client authenticated as, e.g. with its TLS
+// certificate.
+func (c *ClientInfo) SetPrincipal(principal string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.principal = principal
+}
+
+// tlsPrincipal returns who the client on the TLS connection authenticated as:
+// User: and the common name of its verified certificate, e.g. User:alice, or
+// the anonymous principal if it didn't send one.
+func tlsPrincipal(conn *tls.Conn) (string, error) {
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 || chains[0][0].Subject.CommonName == "" {
+		return anonymousPrincipal, nil
+	}
+	return "User:" + chains[0][0].Subject.CommonName, nil
+}
+
+// DelegationToken returns the ID of the delegation token the client
+// authenticated with, if it did.
+func (c *ClientInfo) DelegationToken() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tokenID
+}
+
+// startSASL starts the client's SASL exchange, unless it's already
+// authenticated.
+func (c *ClientInfo) startSASL(s *scramServer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authenticated {
+		return false
+	}
+	c.sasl = s
+	return true
+}
+
+func (c *ClientInfo) saslExchange() *scramServer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sasl
+}
+
+// authenticate ends the client's SASL exchange, with the client authenticated
+// as the token's owner.
+func (c *ClientInfo) authenticate(token *structs.DelegationToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sasl = nil
+	c.authenticated = true
+	c.principal = token.Owner
+	c.tokenID = token.TokenID
+	c.sessionExpiry = token.ExpiryTimestamp
+}
+
+// session returns the delegation token the client authenticated with and when
+// its session ends.
+func (c *ClientInfo) session() (string, int64) {
+	if c == nil {
+		return "", 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tokenID, c.sessionExpiry
+}
+
+// APIVersion returns the version of the API the client uses, i.e. the version
+// of its last request with the API key.
+func (c *ClientInfo) APIVersion(key int16) (int16, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.apiVersions[key]
+	return v, ok
+}
+
+// APIVersions returns the versions of the APIs the client's used by API key.
+func (c *ClientInfo) APIVersions() map[int16]int16 {
+	versions := make(map[int16]int16)
+	if c == nil {
+		return versions
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for k, v := range c.apiVersions {
+		versions[k] = v
+	}
+	return versions
+}
+
+// observe records the client ID and API version of a request from the client.
+func (c *ClientInfo) observe(header *protocol.RequestHeader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id = header.ClientID
+	c.apiVersions[header.APIKey] = header.APIVersion
+}
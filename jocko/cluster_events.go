@@ -0,0 +1,228 @@
+package jocko
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// ClusterEventsTopicName is the topic the controller publishes cluster
+	// events to when the broker's PublishClusterEvents is set. Each record's
+	// value is a ClusterEvent as JSON, keyed by its type. The topic has one
+	// partition so the events are consumed in the order they happened.
+	ClusterEventsTopicName = "__cluster_events"
+	// clusterEventsBuffer is how many events can wait to be published. Events
+	// past it are dropped, so a cluster that can't take the events doesn't
+	// hold up the controller.
+	clusterEventsBuffer = 1024
+	// clusterEventsRetryInterval is how long publishing waits to try again
+	// after it fails, e.g. while the events topic's leader is moving.
+	clusterEventsRetryInterval = time.Second
+)
+
+// ClusterEventType is the type of a cluster event.
+type ClusterEventType string
+
+const (
+	// BrokerJoined is published when a broker joins the cluster, and
+	// BrokerLeft when it leaves or is reaped. BrokerFailed is published when
+	// a broker fails its health check, before its partitions' leaders move.
+	BrokerJoined ClusterEventType = "broker_joined"
+	BrokerLeft   ClusterEventType = "broker_left"
+	BrokerFailed ClusterEventType = "broker_failed"
+	// ControllerChanged is published by a broker when it becomes the
+	// cluster's controller.
+	ControllerChanged ClusterEventType = "controller_changed"
+	// LeaderChanged is published when the controller moves a partition's
+	// leader, and ISRShrunk when it takes replicas out of a partition's ISR.
+	LeaderChanged ClusterEventType = "leader_changed"
+	ISRShrunk     ClusterEventType = "isr_shrunk"
+	// TopicCreated and TopicDeleted are published when a topic's created or
+	// deleted.
+	TopicCreated ClusterEventType = "topic_created"
+	TopicDeleted ClusterEventType = "topic_deleted"
+)
+
+// ClusterEvent is the value of a record in the cluster events topic. Only the
+// fields the event's type has are set.
+type ClusterEvent struct {
+	Type ClusterEventType `json:"type"`
+	Time time.Time        `json:"time"`
+	// Controller is the ID of the controller that published the event.
+	Controller int32 `json:"controller"`
+	// Broker is the ID of the broker that joined, left, or failed, and Reason
+	// why it left.
+	Broker *int32 `json:"broker,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	// Partition, Leader, and ISR are the partition's for leader and ISR
+	// changes, and PreviousLeader and PreviousISR what they were before.
+	Partition      *int32  `json:"partition,omitempty"`
+	Leader         *int32  `json:"leader,omitempty"`
+	PreviousLeader *int32  `json:"previous_leader,omitempty"`
+	ISR            []int32 `json:"isr,omitempty"`
+	PreviousISR    []int32 `json:"previous_isr,omitempty"`
+}
+
+// publishEvent queues the event to be published to the cluster events topic,
+// if the broker publishes them. It never blocks: the event's dropped if the
+// queue's full.
+func (b *Broker) publishEvent(e ClusterEvent) {
+	if !b.config.PublishClusterEvents {
+		return
+	}
+	e.Time = time.Now()
+	e.Controller = b.config.ID
+	select {
+	case b.eventsCh <- e:
+	default:
+		log.Error.Printf("broker/%d: cluster events queue full, dropping %s event", b.config.ID, e.Type)
+	}
+}
+
+// brokerEvent returns the event for the broker.
+func brokerEvent(typ ClusterEventType, id int32, reason string) ClusterEvent {
+	return ClusterEvent{Type: typ, Broker: &id, Reason: reason}
+}
+
+// partitionEvents returns the events for the controller changing the
+// partition from prev, which is nil if the partition's new.
+func partitionEvents(prev *structs.Partition, p structs.Partition) []ClusterEvent {
+	if prev == nil {
+		return nil
+	}
+	var events []ClusterEvent
+	id := p.Partition
+	if p.Leader != prev.Leader {
+		leader, prevLeader := p.Leader, prev.Leader
+		events = append(events, ClusterEvent{
+			Type:           LeaderChanged,
+			Topic:          p.Topic,
+			Partition:      &id,
+			Leader:         &leader,
+			PreviousLeader: &prevLeader,
+			ISR:            p.ISR,
+			PreviousISR:    prev.ISR,
+		})
+	}
+	for _, r := range prev.ISR {
+		if !contains(p.ISR, r) {
+			events = append(events, ClusterEvent{
+				Type:        ISRShrunk,
+				Topic:       p.Topic,
+				Partition:   &id,
+				ISR:         p.ISR,
+				PreviousISR: prev.ISR,
+			})
+			break
+		}
+	}
+	return events
+}
+
+// publishClusterEvents publishes the queued events to the cluster events topic
+// until stop is closed, batching those queued together. Events that fail to
+// publish are retried, the oldest dropped if too many pile up.
+func (b *Broker) publishClusterEvents(stop <-chan struct{}) {
+	var pending []ClusterEvent
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			// the events queued before shutdown are published if they can be
+			pending = b.drainEvents(pending)
+			if len(pending) > 0 {
+				if err := b.writeClusterEvents(pending); err != protocol.ErrNone {
+					log.Error.Printf("broker/%d: publish %d cluster events on shutdown error: %s", b.config.ID, len(pending), err)
+				}
+			}
+			return
+		case e := <-b.eventsCh:
+			pending = append(pending, e)
+			if retry != nil {
+				// waiting to try again
+				continue
+			}
+		case <-retry:
+			retry = nil
+		}
+		pending = b.drainEvents(pending)
+		if err := b.writeClusterEvents(pending); err != protocol.ErrNone {
+			log.Error.Printf("broker/%d: publish %d cluster events error: %s", b.config.ID, len(pending), err)
+			if n := len(pending) - clusterEventsBuffer; n > 0 {
+				log.Error.Printf("broker/%d: dropping %d unpublished cluster events", b.config.ID, n)
+				pending = pending[n:]
+			}
+			retry = time.After(clusterEventsRetryInterval)
+			continue
+		}
+		pending = nil
+	}
+}
+
+// drainEvents adds the queued events to pending without waiting for more.
+func (b *Broker) drainEvents(pending []ClusterEvent) []ClusterEvent {
+	for {
+		select {
+		case e := <-b.eventsCh:
+			pending = append(pending, e)
+		default:
+			return pending
+		}
+	}
+}
+
+// writeClusterEvents produces the events to the cluster events topic, creating
+// it first if this broker's the controller and it doesn't exist yet.
+func (b *Broker) writeClusterEvents(events []ClusterEvent) protocol.Error {
+	_, topic, err := b.fsm.State().GetTopic(ClusterEventsTopicName)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil {
+		if !b.isController() {
+			return protocol.ErrUnknownTopicOrPartition
+		}
+		if err := b.createTopic(&Context{parent: context.Background()}, b.clusterEventsTopic()); err != protocol.ErrNone && err != protocol.ErrTopicAlreadyExists {
+			return err
+		}
+	}
+	msgs := make([]commitlog.Message, 0, len(events))
+	for _, e := range events {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		msg, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: e.Time,
+			Key:       []byte(e.Type),
+			Value:     value,
+		})
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return b.produceTo(ClusterEventsTopicName, 0, commitlog.NewMessageSet(0, msgs...))
+}
+
+// clusterEventsTopic returns the request to create the cluster events topic,
+// replicated like the offsets topic unless the cluster has fewer brokers.
+func (b *Broker) clusterEventsTopic() *protocol.CreateTopicRequest {
+	replicationFactor := b.config.OffsetsTopicReplicationFactor
+	if n := len(b.brokerLookup.Brokers()); n > 0 && n < int(replicationFactor) {
+		replicationFactor = int16(n)
+	}
+	return &protocol.CreateTopicRequest{
+		Topic:             ClusterEventsTopicName,
+		NumPartitions:     1,
+		ReplicationFactor: replicationFactor,
+	}
+}
@@ -0,0 +1,51 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/structs"
+)
+
+func TestPartitionEvents(t *testing.T) {
+	req := require.New(t)
+	prev := &structs.Partition{Topic: "test", Partition: 1, Leader: 1, ISR: []int32{1, 2, 3}}
+
+	// new partitions are in their topic's created event
+	req.Empty(partitionEvents(nil, *prev))
+	req.Empty(partitionEvents(prev, *prev))
+
+	events := partitionEvents(prev, structs.Partition{Topic: "test", Partition: 1, Leader: 2, ISR: []int32{2, 3}})
+	req.Equal(2, len(events))
+	req.Equal(LeaderChanged, events[0].Type)
+	req.Equal(int32(1), *events[0].Partition)
+	req.Equal(int32(2), *events[0].Leader)
+	req.Equal(int32(1), *events[0].PreviousLeader)
+	req.Equal(ISRShrunk, events[1].Type)
+	req.Equal([]int32{2, 3}, events[1].ISR)
+	req.Equal([]int32{1, 2, 3}, events[1].PreviousISR)
+
+	// growing the ISR isn't a shrink
+	events = partitionEvents(prev, structs.Partition{Topic: "test", Partition: 1, Leader: 1, ISR: []int32{1, 2, 3, 4}})
+	req.Empty(events)
+}
+
+func TestPublishEvent(t *testing.T) {
+	req := require.New(t)
+	b := &Broker{config: &config.Config{ID: 1}, eventsCh: make(chan ClusterEvent, 1)}
+
+	// nothing's queued unless the broker publishes events
+	b.publishEvent(ClusterEvent{Type: TopicCreated, Topic: "test"})
+	req.Equal(0, len(b.eventsCh))
+
+	b.config.PublishClusterEvents = true
+	b.publishEvent(ClusterEvent{Type: TopicCreated, Topic: "test"})
+	// the queue's full so this one's dropped rather than blocking
+	b.publishEvent(ClusterEvent{Type: TopicDeleted, Topic: "test"})
+	events := b.drainEvents(nil)
+	req.Equal(1, len(events))
+	req.Equal(TopicCreated, events[0].Type)
+	req.Equal(int32(1), events[0].Controller)
+	req.False(events[0].Time.IsZero())
+}
@@ -6,18 +6,45 @@ import (
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/jocko/reporter"
 )
 
 const (
 	DefaultLANSerfPort = 8301
 )
 
+// ReadConsistency is how up to date the metadata a broker serves to admin and
+// metadata requests has to be.
+type ReadConsistency string
+
+const (
+	// StaleReads serves the broker's metadata as it is, which on brokers
+	// other than the controller may not have caught up with recent changes,
+	// e.g. a topic that was just created.
+	StaleReads ReadConsistency = "stale"
+	// LinearizableReads waits until the broker's metadata has every change
+	// made before the request, getting the index of the metadata log to wait
+	// for from the controller, which confirms with a quorum of the brokers
+	// that it's still the controller.
+	LinearizableReads ReadConsistency = "linearizable"
+	// UnverifiedReads is like LinearizableReads except the controller
+	// doesn't confirm with a quorum of the brokers that it's still the
+	// controller. It saves a round trip to the quorum, but isn't
+	// linearizable: a controller that's been deposed without knowing it yet
+	// hands out its stale index.
+	UnverifiedReads ReadConsistency = "unverified"
+)
+
 // Config holds the configuration for a Config.
 type Config struct {
-	ID                            int32
-	NodeName                      string
-	DataDir                       string
-	DevMode                       bool
+	ID       int32
+	NodeName string
+	DataDir  string
+	DevMode  bool
+	// Standalone runs the broker on its own without raft and serf. Its
+	// metadata is kept in a log in the data dir.
+	Standalone                    bool
 	Addr                          string
 	SerfLANConfig                 *serf.Config
 	RaftConfig                    *raft.Config
@@ -31,6 +58,260 @@ type Config struct {
 	LeaveDrainTime                time.Duration
 	ReconcileInterval             time.Duration
 	OffsetsTopicReplicationFactor int16
+	// ShareRecordLockDuration is how long a share group member has to
+	// acknowledge a record it acquired before it's delivered to another member.
+	ShareRecordLockDuration time.Duration
+	// ShareMaxDeliveryCount is the number of times a share group's record is
+	// delivered before it's dropped.
+	ShareMaxDeliveryCount int16
+	// CreateTopicPolicy validates create topic requests if set.
+	CreateTopicPolicy policy.CreateTopicPolicy
+	// AlterConfigsPolicy validates alter configs requests if set.
+	AlterConfigsPolicy policy.AlterConfigsPolicy
+	// MetadataMaxStaleness is how long a broker that isn't the controller
+	// serves metadata for after it last heard from the controller. Zero
+	// serves it regardless.
+	MetadataMaxStaleness time.Duration
+	// MetadataReadConsistency is how up to date the metadata the broker
+	// serves to Metadata, DescribeConfigs, DescribeGroups, and ListGroups
+	// requests has to be, so automation that creates a topic and then
+	// describes it on another broker sees it. Stale reads by default.
+	MetadataReadConsistency ReadConsistency
+	// MetadataReadTimeout is how long a consistent read waits for the
+	// broker's metadata to catch up before failing the request.
+	MetadataReadTimeout time.Duration
+	// ReplicaFetchMaxBytes is the max number of bytes a follower fetches for
+	// a partition at a time, and ReplicaFetchResponseMaxBytes the max for a
+	// whole fetch response.
+	ReplicaFetchMaxBytes         int32
+	ReplicaFetchResponseMaxBytes int32
+	// ReplicaFetchMinBytes is the number of bytes a follower waits for up to
+	// ReplicaFetchWaitMax before the leader responds to its fetch.
+	ReplicaFetchMinBytes int32
+	ReplicaFetchWaitMax  time.Duration
+	// ReplicaFetchBackoff is how long a follower waits to fetch again after
+	// an error, doubling with each error in a row up to ReplicaFetchMaxBackoff.
+	ReplicaFetchBackoff    time.Duration
+	ReplicaFetchMaxBackoff time.Duration
+	// Rack is the rack the broker's in. Partitions' replicas are spread
+	// across racks if every broker has one.
+	Rack string
+	// LeaderPriority ranks the broker as the cluster's raft leader, which is
+	// its controller, e.g. higher for brokers with better disks or network.
+	// Once an election's settled for LeaderTransferDelay, the leader hands
+	// leadership to the live voter with the highest priority if it's higher
+	// than its own. 0, the default, is the lowest.
+	LeaderPriority      int
+	LeaderTransferDelay time.Duration
+	// TransactionMaxTimeout is the longest transaction timeout a producer can
+	// ask for.
+	TransactionMaxTimeout time.Duration
+	// GroupInitialRebalanceDelay is how long the coordinator waits for more
+	// members to join a new group before its first rebalance.
+	GroupInitialRebalanceDelay time.Duration
+	// ControllerMaxLeaderChanges is the most partition leadership changes
+	// the controller applies and sends to the brokers at a time. The rest
+	// are queued and applied in the background, ControllerLeaderChangeInterval
+	// apart, so brokers failing together don't flood the cluster with
+	// metadata updates and fetcher restarts. If 0, they're all applied at
+	// once.
+	ControllerMaxLeaderChanges     int
+	ControllerLeaderChangeInterval time.Duration
+	// Listeners are more addresses the broker serves clients on besides
+	// Addr, e.g. to serve TLS to clients outside the cluster.
+	Listeners []ListenerConfig
+	// MaxOpenSegmentFiles is the most partition log segment files the broker
+	// keeps open. Segments' files are opened when they're read or written
+	// and the least recently used are closed past the limit. If 0, every
+	// segment's files stay open.
+	MaxOpenSegmentFiles int
+	// CompactionOffsetMapBytes bounds the memory of the map of keys to their
+	// latest offsets a compacted partition's cleaned with. Partitions with
+	// more keys than fit are cleaned in several passes over their logs
+	// rather than running the broker out of memory. If 0, it's unbounded.
+	CompactionOffsetMapBytes int64
+	// GroupLagExportInterval is how often the broker writes the lag of the
+	// consumer groups' offsets committed for the partitions it leads to the
+	// compacted __consumer_lag topic, so dashboards can consume it instead of
+	// asking every broker. If 0, lag isn't exported.
+	GroupLagExportInterval time.Duration
+	// OffsetsRetention is how long consumer groups' committed offsets are
+	// kept after they're committed once their groups have no members, unless
+	// the commit asks for its own retention.
+	OffsetsRetention time.Duration
+	// OffsetsRetentionCheckInterval is how often the broker deletes the
+	// expired offsets of the groups it coordinates. If 0, they're kept.
+	OffsetsRetentionCheckInterval time.Duration
+	// OffsetsSnapshotInterval is how often the broker snapshots the offsets
+	// committed to the partitions of the offsets topic it leads, so when it
+	// becomes their coordinator again it reads the snapshots and the records
+	// after them rather than the whole partitions. If 0, there are none.
+	OffsetsSnapshotInterval time.Duration
+	// PublishClusterEvents has the controller publish the cluster's events,
+	// e.g. brokers joining and leaving, partitions' leaders moving, and
+	// topics being created, to the __cluster_events topic for operators to
+	// consume as an audit trail with standard tooling.
+	PublishClusterEvents bool
+	// FetchDecompressionCacheBytes is the most bytes of decompressed batches
+	// the broker keeps for filtered fetches, so consumers reading the same
+	// batches don't each decompress them. If 0, nothing's cached.
+	FetchDecompressionCacheBytes int64
+	// VerifySegmentManifests checks partitions' rolled segments against
+	// their manifests on startup and logs those that don't match.
+	VerifySegmentManifests bool
+	// InterBrokerTLS, if set, secures the brokers' connections to each other
+	// with mutual TLS, so only brokers with a certificate it trusts can join
+	// the cluster's raft quorum and replicate its partitions.
+	InterBrokerTLS *InterBrokerTLSConfig
+	// GroupMinSessionTimeout and GroupMaxSessionTimeout bound the session
+	// timeouts consumers can join groups with. A short timeout fails
+	// consumers on a GC pause, a long one leaves a dead consumer's partitions
+	// unconsumed.
+	GroupMinSessionTimeout time.Duration
+	GroupMaxSessionTimeout time.Duration
+	// GroupMaxRebalanceTimeout is the longest rebalance timeout consumers can
+	// join groups with, so one consumer can't hold up its group's rebalances.
+	GroupMaxRebalanceTimeout time.Duration
+	// Authorizer, if it's set, limits the topics, groups, and configs a
+	// client's shown to those its principal's authorized to describe.
+	Authorizer policy.Authorizer
+	// DelegationTokenSecret is the secret, shared by the brokers, that
+	// delegation tokens' HMACs are derived from. Delegation tokens, and SCRAM
+	// authentication with them, are disabled if it's empty.
+	DelegationTokenSecret string
+	// DelegationTokenMaxLifetime is the longest a delegation token can be
+	// renewed for, and DelegationTokenExpiryTime how long it's valid for
+	// after it's created or renewed.
+	DelegationTokenMaxLifetime time.Duration
+	DelegationTokenExpiryTime  time.Duration
+	// AppendWorkers is how many workers append produced records to the logs
+	// of each data dir's partitions. The workers take turns between the
+	// partitions, appending up to AppendQuantumBytes of a partition's records
+	// at a turn, so one busy partition doesn't delay the others' appends. 0,
+	// the default, to append on the produce request's goroutine.
+	AppendWorkers      int
+	AppendQuantumBytes int
+	// TopicConfigProfiles are named bundles of topic configs, e.g. a
+	// compacted-changelog profile, that topics are created with by setting
+	// their config.profile config to the profile's name. Configs the topic's
+	// created with override the profile's.
+	TopicConfigProfiles map[string]map[string]string
+	// Namespaces split the cluster's topics and groups between tenants, e.g.
+	// teams sharing the cluster. Only a namespace's principals can see and use
+	// its topics and groups.
+	Namespaces []NamespaceConfig
+	// MaxInFlightRequestsPerConnection is the most requests a connection can
+	// have in flight, read but not yet responded to. The server stops reading
+	// the connection's requests until one's responded to. 0 for no limit.
+	MaxInFlightRequestsPerConnection int
+	// SocketRequestMaxBytes is the biggest request the server reads. A
+	// connection sending a bigger one is closed before it's read, so a bad
+	// size from a client can't have the broker allocate it. 0 for no limit.
+	SocketRequestMaxBytes int32
+	// RequestTimeout is how long the server waits for a request to be handled
+	// before responding with a request timed out error and canceling it, so a
+	// stuck handler doesn't hold up its connection. It has to be longer than
+	// requests can wait on purpose, e.g. joins waiting for their group's
+	// rebalance. 0 for no timeout.
+	RequestTimeout time.Duration
+	// ShutdownTimeout is how long shutdown waits for each of the broker's
+	// subsystems, e.g. its replica fetchers, to stop before it gives up on it,
+	// logs what's still running, and moves on. 0 to wait as long as it takes.
+	ShutdownTimeout time.Duration
+	// CacheWarmBytes is how many bytes of the tails of the partitions that
+	// were hottest when the broker last ran it reads on start, for up to
+	// CacheWarmPartitions of them, so the first consumers after a restart
+	// read them from the page cache rather than a cold disk. 0 to not warm
+	// the page cache.
+	CacheWarmBytes      int64
+	CacheWarmPartitions int
+	// ProduceSampleRate is the fraction of produced record sets, e.g. 0.01,
+	// the broker decodes to report topics' record counts, record sizes, and
+	// key cardinality for capacity planning. 0 to not sample them.
+	ProduceSampleRate float64
+	// FetchVerifyRate is the fraction of fetched record sets, e.g. 0.01, the
+	// broker checks the CRCs of as it reads them, 1 to check all of them, so
+	// disk corruption's logged and counted when it's read rather than found by
+	// consumers failing to decode it. Fetches stop short of a corrupt message
+	// set, or fail with a corrupt message error if it's the first fetched. 0
+	// to not check them.
+	FetchVerifyRate float64
+	// DisabledAPIs are the keys of the APIs, e.g. DeleteTopics, the broker
+	// rejects as unsupported and leaves out of its ApiVersions responses, to
+	// turn off APIs the cluster's operators don't want clients using. They're
+	// only disabled on this broker, clients can still use them on brokers
+	// without them disabled, so every broker needs them set to disable them
+	// across the cluster. The APIs the brokers need from each other, e.g.
+	// Fetch, can't be disabled.
+	DisabledAPIs []int16
+	// MetricsReporter, if set, is told of the broker's metrics, e.g. to report
+	// them to an existing telemetry stack.
+	MetricsReporter reporter.MetricsReporter
+}
+
+// ListenerConfig configures an address the broker serves clients on.
+type ListenerConfig struct {
+	// Name identifies the listener, e.g. SSL or EXTERNAL.
+	Name string
+	Addr string
+	// Certificates are the TLS certificates the listener serves, picked by
+	// the host name clients ask for with SNI. The first certificate's served
+	// to clients that don't send one or ask for a name none of them has. The
+	// listener's plaintext if there are none.
+	Certificates []CertificateConfig
+	// ClientCAFile is a PEM file of the CAs the listener trusts. If set,
+	// clients have to present a certificate signed by one of them, and
+	// they're authenticated as User: and its common name, e.g. User:alice.
+	ClientCAFile string
+}
+
+// NamespaceConfig configures a tenant's namespace. Topics and groups named
+// with the namespace's name and a dot as their prefix, e.g. payments.orders,
+// are in the namespace.
+type NamespaceConfig struct {
+	Name string
+	// Principals are the principals, e.g. User:alice, the namespace belongs
+	// to.
+	Principals []string
+	// ProduceByteRate limits the rate bytes are produced to the namespace's
+	// topics together, throttling their producers like the topics'
+	// produce.byte.rate config. 0 for no limit.
+	ProduceByteRate int64
+	// TopicConfigs are the configs the namespace's topics are created with
+	// unless they're created with others, including by config profiles.
+	TopicConfigs map[string]string
+}
+
+// InterBrokerTLSConfig configures the certificates brokers identify themselves
+// to each other with, which are separate from those served to clients. They're
+// required on raft connections, on serf's TCP streams, which members join and
+// sync state over, and on the inter-broker listener. Serf's UDP gossip isn't
+// covered, so the gossip encryption key, SerfLANConfig's MemberlistConfig's
+// SecretKey, must be set too.
+type InterBrokerTLSConfig struct {
+	// CertFile and KeyFile are the broker's certificate and key, used both
+	// to serve and to connect to other brokers.
+	CertFile string
+	KeyFile  string
+	// CAFile is a PEM file of the CAs that sign brokers' certificates.
+	CAFile string
+	// AllowedIdentities are the names of the brokers allowed to connect: their
+	// certificates' DNS names, or else common names. Any certificate signed
+	// by the CAs is allowed if it's empty.
+	AllowedIdentities []string
+	// Listener names the listener in Listeners that brokers send each other
+	// requests on, i.e. the controller's requests, forwarded records, and
+	// replicas' fetches. It's served with the broker's certificate and
+	// requires the other brokers' rather than using its own TLS settings.
+	// It's required: the controller's requests, and fetches by replicas,
+	// are only served on it.
+	Listener string
+}
+
+// CertificateConfig is a PEM encoded certificate and its key.
+type CertificateConfig struct {
+	CertFile string
+	KeyFile  string
 }
 
 // DefaultConfig creates/returns a default configuration.
@@ -41,13 +322,44 @@ func DefaultConfig() *Config {
 	}
 
 	conf := &Config{
-		DevMode:                       false,
-		NodeName:                      hostname,
-		SerfLANConfig:                 serfDefaultConfig(),
-		RaftConfig:                    raft.DefaultConfig(),
-		LeaveDrainTime:                5 * time.Second,
-		ReconcileInterval:             60 * time.Second,
-		OffsetsTopicReplicationFactor: 3,
+		DevMode:                          false,
+		NodeName:                         hostname,
+		SerfLANConfig:                    serfDefaultConfig(),
+		RaftConfig:                       raft.DefaultConfig(),
+		LeaveDrainTime:                   5 * time.Second,
+		ReconcileInterval:                60 * time.Second,
+		LeaderTransferDelay:              30 * time.Second,
+		MetadataMaxStaleness:             10 * time.Second,
+		MetadataReadConsistency:          StaleReads,
+		MetadataReadTimeout:              5 * time.Second,
+		ReplicaFetchMaxBytes:             1024 * 1024,
+		ReplicaFetchResponseMaxBytes:     10 * 1024 * 1024,
+		ReplicaFetchMinBytes:             1,
+		ReplicaFetchWaitMax:              500 * time.Millisecond,
+		ReplicaFetchBackoff:              time.Second,
+		ReplicaFetchMaxBackoff:           30 * time.Second,
+		TransactionMaxTimeout:            15 * time.Minute,
+		GroupInitialRebalanceDelay:       3 * time.Second,
+		ControllerMaxLeaderChanges:       100,
+		ControllerLeaderChangeInterval:   500 * time.Millisecond,
+		OffsetsTopicReplicationFactor:    3,
+		OffsetsRetention:                 7 * 24 * time.Hour,
+		OffsetsRetentionCheckInterval:    10 * time.Minute,
+		OffsetsSnapshotInterval:          time.Minute,
+		ShareRecordLockDuration:          30 * time.Second,
+		ShareMaxDeliveryCount:            5,
+		FetchDecompressionCacheBytes:     32 * 1024 * 1024,
+		GroupMinSessionTimeout:           6 * time.Second,
+		GroupMaxSessionTimeout:           30 * time.Minute,
+		GroupMaxRebalanceTimeout:         30 * time.Minute,
+		DelegationTokenMaxLifetime:       7 * 24 * time.Hour,
+		DelegationTokenExpiryTime:        24 * time.Hour,
+		MaxInFlightRequestsPerConnection: 100,
+		SocketRequestMaxBytes:            100 * 1024 * 1024,
+		AppendQuantumBytes:               256 * 1024,
+		ShutdownTimeout:                  30 * time.Second,
+		CacheWarmPartitions:              100,
+		CompactionOffsetMapBytes:         64 * 1024 * 1024,
 	}
 
 	conf.SerfLANConfig.ReconnectTimeout = 3 * 24 * time.Hour
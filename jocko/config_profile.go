@@ -0,0 +1,53 @@
+package jocko
+
+import (
+	"fmt"
+
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// configProfileConfig is the config topics are created with to apply one of
+// the broker's config profiles. It isn't kept as one of the topic's configs.
+const configProfileConfig = "config.profile"
+
+// validateConfigProfiles checks that the profiles' configs are valid topic
+// configs, so a bad profile fails the broker's start rather than the topics
+// created with it.
+func validateConfigProfiles(profiles map[string]map[string]string) error {
+	for name, configs := range profiles {
+		cfg := structs.NewTopicConfig()
+		for k, v := range configs {
+			if err := cfg.SetString(k, v); err != nil {
+				return fmt.Errorf("config profile %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyConfigProfile replaces the request's config profile with the profile's
+// configs, so teams creating topics for the same use get the same configs.
+// Configs in the request override the profile's.
+func (b *Broker) applyConfigProfile(req *protocol.CreateTopicRequest) protocol.Error {
+	name, ok := req.Configs[configProfileConfig]
+	if !ok {
+		return protocol.ErrNone
+	}
+	delete(req.Configs, configProfileConfig)
+	if name == nil {
+		return protocol.ErrNone
+	}
+	profile, ok := b.config.TopicConfigProfiles[*name]
+	if !ok {
+		return protocol.ErrInvalidConfig.WithErr(fmt.Errorf("unknown config profile %s", *name))
+	}
+	for k, v := range profile {
+		if _, ok := req.Configs[k]; ok {
+			continue
+		}
+		v := v
+		req.Configs[k] = &v
+	}
+	return protocol.ErrNone
+}
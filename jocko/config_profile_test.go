@@ -0,0 +1,34 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestApplyConfigProfile(t *testing.T) {
+	b := &Broker{config: &config.Config{TopicConfigProfiles: map[string]map[string]string{
+		"compacted-changelog": {"cleanup.policy": "compact", "segment.ms": "3600000"},
+	}}}
+	str := func(s string) *string { return &s }
+
+	req := &protocol.CreateTopicRequest{Configs: map[string]*string{
+		"config.profile": str("compacted-changelog"),
+		"segment.ms":     str("60000"),
+	}}
+	require.Equal(t, protocol.ErrNone, b.applyConfigProfile(req))
+	require.Equal(t, map[string]string{"cleanup.policy": "compact", "segment.ms": "60000"}, configValues(req.Configs))
+
+	req = &protocol.CreateTopicRequest{Configs: map[string]*string{"config.profile": str("missing")}}
+	require.Equal(t, protocol.ErrInvalidConfig.Code(), b.applyConfigProfile(req).Code())
+
+	req = &protocol.CreateTopicRequest{}
+	require.Equal(t, protocol.ErrNone, b.applyConfigProfile(req))
+}
+
+func TestValidateConfigProfiles(t *testing.T) {
+	require.NoError(t, validateConfigProfiles(map[string]map[string]string{"compacted": {"cleanup.policy": "compact"}}))
+	require.Error(t, validateConfigProfiles(map[string]map[string]string{"bad": {"cleanup.policy": "sometimes"}}))
+}
@@ -107,9 +107,33 @@ func (c *Conn) CreateTopics(req *protocol.CreateTopicRequests) (*protocol.Create
 	return &resp, nil
 }
 
-// Produce sends a produce request and returns the response.
+// Produce sends a produce request and returns the response. A request with
+// acks 0 isn't answered, so an empty response is returned once it's written.
 func (c *Conn) Produce(req *protocol.ProduceRequest) (*protocol.ProduceResponse, error) {
 	var resp protocol.ProduceResponse
+	if req.Acks == 0 {
+		if _, err := c.doRequest(&c.wdeadline, func(deadline time.Time, id int32) error {
+			return c.writeRequest(req)
+		}); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	}
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TransactionalProduce sends a transactional produce request and returns the
+// response.
+func (c *Conn) TransactionalProduce(req *protocol.TransactionalProduceRequest) (*protocol.TransactionalProduceResponse, error) {
+	var resp protocol.TransactionalProduceResponse
 	err := c.readOperation(func(deadline time.Time, id int32) error {
 		return c.writeRequest(req)
 	}, func(deadline time.Time, size int) error {
@@ -233,6 +257,62 @@ func (c *Conn) FindCoordinator(req *protocol.FindCoordinatorRequest) (*protocol.
 	return &resp, nil
 }
 
+// InitProducerID sends an init producer id request and returns the response.
+func (c *Conn) InitProducerID(req *protocol.InitProducerIDRequest) (*protocol.InitProducerIDResponse, error) {
+	var resp protocol.InitProducerIDResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// EndTxn sends an end txn request and returns the response.
+func (c *Conn) EndTxn(req *protocol.EndTxnRequest) (*protocol.EndTxnResponse, error) {
+	var resp protocol.EndTxnResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// TxnOffsetCommit sends a txn offset commit request and returns the response.
+func (c *Conn) TxnOffsetCommit(req *protocol.TxnOffsetCommitRequest) (*protocol.TxnOffsetCommitResponse, error) {
+	var resp protocol.TxnOffsetCommitResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// WriteTxnMarkers sends a write txn markers request and returns the response.
+func (c *Conn) WriteTxnMarkers(req *protocol.WriteTxnMarkersRequest) (*protocol.WriteTxnMarkersResponse, error) {
+	var resp protocol.WriteTxnMarkersResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Heartbeat sends a heartbeat request and returns the response.
 func (c *Conn) Heartbeat(req *protocol.HeartbeatRequest) (*protocol.HeartbeatResponse, error) {
 	var resp protocol.HeartbeatResponse
@@ -401,6 +481,248 @@ func (c *Conn) DescribeConfigs(req *protocol.DescribeConfigsRequest) (*protocol.
 	return &resp, nil
 }
 
+// Nack sends a nack request and returns the response.
+func (c *Conn) Nack(req *protocol.NackRequest) (*protocol.NackResponse, error) {
+	var resp protocol.NackResponse
+	err := c.writeOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// FilteredFetch sends a filtered fetch request and returns the response.
+func (c *Conn) FilteredFetch(req *protocol.FilteredFetchRequest) (*protocol.FilteredFetchResponse, error) {
+	var resp protocol.FilteredFetchResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ShareFetch sends a share fetch request and returns the response.
+func (c *Conn) ShareFetch(req *protocol.ShareFetchRequest) (*protocol.ShareFetchResponse, error) {
+	var resp protocol.ShareFetchResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ShareAcknowledge sends a share acknowledge request and returns the response.
+func (c *Conn) ShareAcknowledge(req *protocol.ShareAcknowledgeRequest) (*protocol.ShareAcknowledgeResponse, error) {
+	var resp protocol.ShareAcknowledgeResponse
+	err := c.writeOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DescribeTraffic sends a describe traffic request and returns the response.
+func (c *Conn) DescribeTraffic(req *protocol.DescribeTrafficRequest) (*protocol.DescribeTrafficResponse, error) {
+	var resp protocol.DescribeTrafficResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AlterPartitionReadOnly sends an alter partition read-only request and returns
+// the response.
+func (c *Conn) AlterPartitionReadOnly(req *protocol.AlterPartitionReadOnlyRequest) (*protocol.AlterPartitionReadOnlyResponse, error) {
+	var resp protocol.AlterPartitionReadOnlyResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AlterBrokerMaintenance sends an alter broker maintenance request and returns
+// the response.
+func (c *Conn) AlterBrokerMaintenance(req *protocol.AlterBrokerMaintenanceRequest) (*protocol.AlterBrokerMaintenanceResponse, error) {
+	var resp protocol.AlterBrokerMaintenanceResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AlterFaultInjection sends an alter fault injection request and returns the
+// response.
+func (c *Conn) AlterFaultInjection(req *protocol.AlterFaultInjectionRequest) (*protocol.AlterFaultInjectionResponse, error) {
+	var resp protocol.AlterFaultInjectionResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AlterOffsetsTopicPartitions sends an alter offsets topic partitions request
+// and returns the response.
+func (c *Conn) AlterOffsetsTopicPartitions(req *protocol.AlterOffsetsTopicPartitionsRequest) (*protocol.AlterOffsetsTopicPartitionsResponse, error) {
+	var resp protocol.AlterOffsetsTopicPartitionsResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DescribeClock sends a describe clock request and returns the response.
+func (c *Conn) DescribeClock(req *protocol.DescribeClockRequest) (*protocol.DescribeClockResponse, error) {
+	var resp protocol.DescribeClockResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DescribeLogStats sends a describe log stats request and returns the response.
+func (c *Conn) DescribeLogStats(req *protocol.DescribeLogStatsRequest) (*protocol.DescribeLogStatsResponse, error) {
+	var resp protocol.DescribeLogStatsResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReadIndex sends a read index request and returns the response.
+func (c *Conn) ReadIndex(req *protocol.ReadIndexRequest) (*protocol.ReadIndexResponse, error) {
+	var resp protocol.ReadIndexResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SaslAuthenticate sends a sasl authenticate request and returns the response.
+func (c *Conn) SaslAuthenticate(req *protocol.SaslAuthenticateRequest) (*protocol.SaslAuthenticateResponse, error) {
+	var resp protocol.SaslAuthenticateResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateDelegationToken sends a create delegation token request and returns the response.
+func (c *Conn) CreateDelegationToken(req *protocol.CreateDelegationTokenRequest) (*protocol.CreateDelegationTokenResponse, error) {
+	var resp protocol.CreateDelegationTokenResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RenewDelegationToken sends a renew delegation token request and returns the response.
+func (c *Conn) RenewDelegationToken(req *protocol.RenewDelegationTokenRequest) (*protocol.RenewDelegationTokenResponse, error) {
+	var resp protocol.RenewDelegationTokenResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ExpireDelegationToken sends an expire delegation token request and returns the response.
+func (c *Conn) ExpireDelegationToken(req *protocol.ExpireDelegationTokenRequest) (*protocol.ExpireDelegationTokenResponse, error) {
+	var resp protocol.ExpireDelegationTokenResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DescribeDelegationToken sends a describe delegation token request and returns the response.
+func (c *Conn) DescribeDelegationToken(req *protocol.DescribeDelegationTokenRequest) (*protocol.DescribeDelegationTokenResponse, error) {
+	var resp protocol.DescribeDelegationTokenResponse
+	err := c.readOperation(func(deadline time.Time, id int32) error {
+		return c.writeRequest(req)
+	}, func(deadline time.Time, size int) error {
+		return c.readResponse(&resp, size, req.Version())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 func (c *Conn) readResponse(resp protocol.VersionedDecoder, size int, version int16) error {
 	b, err := c.rbuf.Peek(size)
 	if err != nil {
@@ -472,7 +794,7 @@ func (c *Conn) doRequest(d *connDeadline, write wop) (int32, error) {
 		c.conn.Close()
 	}
 	c.wlock.Unlock()
-	return c.correlationID, nil
+	return id, err
 }
 
 func (c *Conn) waitResponse(d *connDeadline, id int32) (deadline time.Time, size int, lock *sync.Mutex, err error) {
@@ -512,7 +834,7 @@ func (c *Conn) writeDeadline() time.Time {
 func (c *Conn) peekResponseSizeAndID() (int32, int32, error) {
 	b, err := c.rbuf.Peek(8)
 	if err != nil {
-		return 0, 0, nil
+		return 0, 0, err
 	}
 	size, id := protocol.MakeInt32(b[:4]), protocol.MakeInt32(b[4:])
 	return size, id, nil
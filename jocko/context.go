@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/travisjeffery/jocko/protocol"
@@ -13,14 +14,25 @@ import (
 type Context struct {
 	mu     sync.Mutex
 	conn   io.ReadWriter
+	client *ClientInfo
 	err    error
 	header *protocol.RequestHeader
 	parent context.Context
 	req    interface{}
 	res    interface{}
 	vals   map[interface{}]interface{}
+	// timeout is whether the handler committed to the request or it timed
+	// out first, for a context with a timeout.
+	timeout *int32
 }
 
+// The states of a context with a timeout.
+const (
+	timeoutPending int32 = iota
+	timeoutCommitted
+	timeoutExpired
+)
+
 func (ctx *Context) Request() interface{} {
 	return ctx.req
 }
@@ -33,16 +45,64 @@ func (c *Context) Header() *protocol.RequestHeader {
 	return c.header
 }
 
+// Client returns the client that sent the request.
+func (c *Context) Client() *ClientInfo {
+	return c.client
+}
+
+// Deadline, Done, and Err are the request's parent context's, which is
+// canceled when the server shuts down and may have the request's timeout.
 func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
-	return time.Time{}, false
+	if ctx.parent == nil {
+		return time.Time{}, false
+	}
+	return ctx.parent.Deadline()
 }
 
 func (ctx *Context) Done() <-chan struct{} {
-	return nil
+	if ctx.parent == nil {
+		return nil
+	}
+	return ctx.parent.Done()
 }
 
 func (ctx *Context) Err() error {
-	return ctx.err
+	if ctx.err != nil || ctx.parent == nil {
+		return ctx.err
+	}
+	return ctx.parent.Err()
+}
+
+// withTimeout returns a copy of the request's context that's done once the
+// timeout's passed or the request's context is done.
+func (ctx *Context) withTimeout(timeout time.Duration) (*Context, context.CancelFunc) {
+	parent, cancel := context.WithTimeout(ctx, timeout)
+	return &Context{
+		parent:  parent,
+		conn:    ctx.conn,
+		client:  ctx.client,
+		header:  ctx.header,
+		req:     ctx.req,
+		timeout: new(int32),
+	}, cancel
+}
+
+// commit is called by a handler before it does what can't be undone, e.g.
+// appending a produce's records, and returns false if the request's already
+// timed out. Once it's committed the request isn't responded to as timed out
+// until the handler's done, so it's never reported timed out after it took
+// effect.
+func (ctx *Context) commit() bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return ctx.timeout == nil || atomic.CompareAndSwapInt32(ctx.timeout, timeoutPending, timeoutCommitted)
+}
+
+// expire marks the request timed out unless its handler's committed to it,
+// and returns whether it did.
+func (ctx *Context) expire() bool {
+	return ctx.timeout == nil || atomic.CompareAndSwapInt32(ctx.timeout, timeoutPending, timeoutExpired)
 }
 
 func (ctx *Context) String() string {
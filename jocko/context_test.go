@@ -0,0 +1,61 @@
+package jocko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestWithTimeout(t *testing.T) {
+	b := &Broker{}
+	parent, cancel := context.WithCancel(context.Background())
+	ctx := &Context{parent: parent}
+	// fn's held until it's checked so it can't finish before the timeout
+	release := make(chan struct{})
+	defer close(release)
+
+	done := make(chan error, 1)
+	err := b.withTimeout(ctx, 10*time.Millisecond, func(ctx *Context) protocol.Error {
+		<-ctx.Done()
+		done <- ctx.Err()
+		<-release
+		return protocol.ErrNone
+	})
+	require.Equal(t, protocol.ErrRequestTimedOut, err)
+	require.Equal(t, context.DeadlineExceeded, <-done)
+
+	// canceling the request's context, e.g. on shutdown, stops fn too
+	go cancel()
+	err = b.withTimeout(ctx, time.Hour, func(ctx *Context) protocol.Error {
+		<-release
+		return protocol.ErrNone
+	})
+	require.Equal(t, protocol.ErrRequestTimedOut, err)
+	require.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestWithTimeoutCommitted(t *testing.T) {
+	b := &Broker{}
+	ctx := &Context{parent: context.Background()}
+
+	// fn committed before the timeout so it's waited for
+	err := b.withTimeout(ctx, 10*time.Millisecond, func(ctx *Context) protocol.Error {
+		require.True(t, ctx.commit())
+		<-ctx.Done()
+		return protocol.ErrNone
+	})
+	require.Equal(t, protocol.ErrNone, err)
+
+	// fn can't commit once the request's timed out
+	committed := make(chan bool, 1)
+	err = b.withTimeout(ctx, 10*time.Millisecond, func(ctx *Context) protocol.Error {
+		<-ctx.Done()
+		committed <- ctx.commit()
+		return protocol.ErrNone
+	})
+	require.Equal(t, protocol.ErrRequestTimedOut, err)
+	require.False(t, <-committed)
+}
@@ -0,0 +1,49 @@
+package jocko
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/travisjeffery/jocko/log"
+)
+
+// dataDirLockFile is locked in the data dir while the broker runs.
+const dataDirLockFile = ".lock"
+
+// errDataDirLocked is returned when another broker process has the data dir.
+var errDataDirLocked = fmt.Errorf("data dir is locked by another broker process")
+
+// lockDataDir takes an exclusive lock on the data dir's lock file so two
+// broker processes can't run against the same data dir and corrupt each
+// other's segments. The lock's held until releaseDataDir, or until the process
+// dies.
+func (b *Broker) lockDataDir() error {
+	if b.config.DataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(b.config.DataDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(b.config.DataDir, dataDirLockFile)
+	f, err := lockFile(path)
+	if err != nil {
+		if err == errDataDirLocked {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return fmt.Errorf("lock %s: %v", path, err)
+	}
+	b.dirLock = f
+	return nil
+}
+
+// releaseDataDir releases the data dir's lock.
+func (b *Broker) releaseDataDir() {
+	if b.dirLock == nil {
+		return
+	}
+	if err := unlockFile(b.dirLock); err != nil {
+		log.Error.Printf("broker/%d: release data dir lock error: %s", b.config.ID, err)
+	}
+	b.dirLock = nil
+}
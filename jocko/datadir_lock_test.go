@@ -0,0 +1,31 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+)
+
+func TestNewBrokerReleasesDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadir-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the logs can't be recovered since the data dir's data isn't a dir
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data"), nil, 0644))
+
+	cfg := config.DefaultConfig()
+	cfg.DataDir = dir
+	cfg.DevMode = false
+	_, err = NewBroker(cfg, opentracing.NoopTracer{})
+	require.Error(t, err)
+
+	// the failed broker released the data dir's lock
+	b := &Broker{config: cfg}
+	require.NoError(t, b.lockDataDir())
+	b.releaseDataDir()
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package jocko
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file and takes an exclusive flock on it. The kernel drops
+// the lock when the process exits, so a broker that crashed doesn't leave its
+// data dir locked.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errDataDirLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlockFile(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
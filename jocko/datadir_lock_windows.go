@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package jocko
+
+import (
+	"os"
+)
+
+// lockFile creates the file exclusively since there's no flock. A broker that
+// crashed leaves it behind and it has to be removed before the broker starts
+// again.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, errDataDirLocked
+	}
+	return f, err
+}
+
+func unlockFile(f *os.File) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,99 @@
+package jocko
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+// maxDecompressedBytes is the most a message's decompressed to, so a small
+// compressed message can't take the broker's memory.
+const maxDecompressedBytes = 64 * 1024 * 1024
+
+// decompressionCache keeps the message sets of recently decompressed messages,
+// least recently used first out once they're over the max bytes, so consumers
+// fanning out over a partition's tail with filtered fetches don't each
+// decompress the same batches. Entries are keyed by the ID of the segment the
+// message was read from, its offset, and its CRC, since a partition's offset
+// can have another message after the log's cleaned or its topic's recreated
+// but a segment's can't. The CRC covers the segment being replaced between
+// reading the message and looking up its ID.
+type decompressionCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	entries  map[decompressionKey]*list.Element
+}
+
+type decompressionKey struct {
+	segment uint64
+	offset  int64
+	crc     int32
+}
+
+type decompressionEntry struct {
+	key  decompressionKey
+	sets []commitlog.MessageSet
+	size int64
+}
+
+// newDecompressionCache returns a cache of up to maxBytes of decompressed
+// message sets, or nil if maxBytes isn't positive so nothing's cached.
+func newDecompressionCache(maxBytes int64) *decompressionCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &decompressionCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[decompressionKey]*list.Element),
+	}
+}
+
+// decompress returns the message sets compressed in the message at the offset
+// of the segment with the ID, from the cache if they're in it. Messages from
+// unknown segments, with ID 0, aren't cached. It's safe to call on a nil
+// cache.
+func (c *decompressionCache) decompress(segment uint64, offset int64, m commitlog.Message) ([]commitlog.MessageSet, error) {
+	if c == nil || segment == 0 {
+		return m.DecompressLimit(maxDecompressedBytes)
+	}
+	key := decompressionKey{segment: segment, offset: offset, crc: m.Crc()}
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*decompressionEntry).sets, nil
+	}
+	c.mu.Unlock()
+
+	sets, err := m.DecompressLimit(maxDecompressedBytes)
+	if err != nil {
+		return nil, err
+	}
+	entry := &decompressionEntry{key: key, sets: sets}
+	for _, ms := range sets {
+		entry.size += int64(len(ms))
+	}
+	if entry.size > c.maxBytes {
+		return sets, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return sets, nil
+	}
+	c.entries[key] = c.ll.PushFront(entry)
+	c.bytes += entry.size
+	for c.bytes > c.maxBytes {
+		oldest := c.ll.Back()
+		e := oldest.Value.(*decompressionEntry)
+		c.ll.Remove(oldest)
+		delete(c.entries, e.key)
+		c.bytes -= e.size
+	}
+	return sets, nil
+}
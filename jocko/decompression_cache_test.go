@@ -0,0 +1,98 @@
+package jocko
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func gzipMessage(t *testing.T, keys ...string) commitlog.Message {
+	var inner []byte
+	for i, key := range keys {
+		msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Key: []byte(key), Value: []byte("value")})
+		require.NoError(t, err)
+		inner = append(inner, commitlog.NewMessageSet(uint64(i), msg)...)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(inner)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Attributes: commitlog.CompressionGZIP, Timestamp: time.Now(), Value: buf.Bytes()})
+	require.NoError(t, err)
+	return msg
+}
+
+func TestDecompressionCache(t *testing.T) {
+	req := require.New(t)
+	m := gzipMessage(t, "a", "b")
+	sets, err := m.Decompress()
+	req.NoError(err)
+	req.Len(sets, 2)
+	size := int64(len(sets[0]) + len(sets[1]))
+
+	c := newDecompressionCache(2 * size)
+	for offset := int64(0); offset < 3; offset++ {
+		got, err := c.decompress(1, offset, m)
+		req.NoError(err)
+		req.Equal(sets, got)
+	}
+	// the oldest entry was evicted to stay under the max
+	req.Equal(2*size, c.bytes)
+	req.Len(c.entries, 2)
+	_, ok := c.entries[decompressionKey{segment: 1, offset: 0, crc: m.Crc()}]
+	req.False(ok)
+
+	// messages from other segments at the same offsets are other messages
+	other := gzipMessage(t, "c")
+	otherSets, err := other.Decompress()
+	req.NoError(err)
+	got, err := c.decompress(2, 2, other)
+	req.NoError(err)
+	req.Equal(otherSets, got)
+
+	// messages from unknown segments aren't cached
+	cached := c.bytes
+	_, err = c.decompress(0, 3, m)
+	req.NoError(err)
+	req.Equal(cached, c.bytes)
+
+	// a nil cache decompresses every time
+	var nilCache *decompressionCache
+	got, err = nilCache.decompress(1, 0, m)
+	req.NoError(err)
+	req.Equal(sets, got)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	req := require.New(t)
+	m := gzipMessage(t, "a", "b")
+	sets, err := m.Decompress()
+	req.NoError(err)
+	size := int64(len(sets[0]) + len(sets[1]))
+
+	_, err = m.DecompressLimit(size - 1)
+	req.Equal(commitlog.ErrDecompressedTooLarge, err)
+	got, err := m.DecompressLimit(size)
+	req.NoError(err)
+	req.Equal(sets, got)
+}
+
+func TestFilterRecordSet_Compressed(t *testing.T) {
+	req := require.New(t)
+	b := &Broker{decompressed: newDecompressionCache(1 << 20)}
+	matching := commitlog.NewMessageSet(5, gzipMessage(t, "other", "tenant-a/1"))
+	other := commitlog.NewMessageSet(6, gzipMessage(t, "tenant-b/1"))
+	filter := &protocol.RecordFilter{KeyPrefix: []byte("tenant-a/")}
+
+	segmentID := func(int64) uint64 { return 1 }
+	filtered, next, skipped := b.filterRecordSet(segmentID, append(append([]byte{}, matching...), other...), filter, 0)
+	req.Equal([]byte(matching), filtered)
+	req.Equal(int64(7), next)
+	req.Equal(int32(1), skipped)
+}
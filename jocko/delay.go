@@ -0,0 +1,452 @@
+package jocko
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	stagingDir          = "staging"
+	defaultWheelTick    = 100 * time.Millisecond
+	defaultWheelSize    = 512
+	stagingSegmentBytes = 1024 * 1024
+	// stagingTopicSuffix is appended to a topic's name to fetch a partition's
+	// staging log rather than the partition, which followers do to replicate
+	// it. Topic names can't have a slash so it can't name a real topic.
+	stagingTopicSuffix = "/staging"
+	// maxReleaseBackoff is the longest a release that keeps failing waits
+	// before it's retried.
+	maxReleaseBackoff = time.Minute
+)
+
+var (
+	// releasedKey is the key of the markers the leader appends to the staging
+	// log once it's released a staged record, their value being the record's
+	// staging offset.
+	releasedKey = []byte("released")
+
+	errDelayQueueClosed = errors.New("delay queue closed")
+)
+
+// timingWheel tracks when staged records are due. Each slot holds the timers due
+// in one tick; timers further out than the wheel's span wait out as many
+// rotations as they need to.
+type timingWheel struct {
+	tick  time.Duration
+	slots [][]*timer
+	pos   int
+}
+
+type timer struct {
+	offset int64
+	rounds int
+}
+
+func newTimingWheel(tick time.Duration, size int) *timingWheel {
+	return &timingWheel{
+		tick:  tick,
+		slots: make([][]*timer, size),
+	}
+}
+
+// add schedules the offset to fire d from now, rounded up to the next tick. A
+// timer that's already due fires on the next tick.
+func (w *timingWheel) add(offset int64, d time.Duration) {
+	ticks := int((d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	slot := (w.pos + ticks) % len(w.slots)
+	w.slots[slot] = append(w.slots[slot], &timer{
+		offset: offset,
+		rounds: (ticks - 1) / len(w.slots),
+	})
+}
+
+// advance moves the wheel forward a tick and returns the offsets now due.
+func (w *timingWheel) advance() (due []int64) {
+	w.pos = (w.pos + 1) % len(w.slots)
+	var pending []*timer
+	for _, t := range w.slots[w.pos] {
+		if t.rounds > 0 {
+			t.rounds--
+			pending = append(pending, t)
+			continue
+		}
+		due = append(due, t.offset)
+	}
+	w.slots[w.pos] = pending
+	return due
+}
+
+// delayQueue holds back records produced to a topic with a delivery delay until
+// they're due. Staged records are appended to a staging log in the partition's
+// directory and a timing wheel tracks when each is due, so memory use is bounded
+// by the number of pending records rather than their size. Once a record is due
+// the leader appends it to the partition's log, making it visible to consumers,
+// and then appends a marker for it to the staging log.
+//
+// Followers replicate the staging log like the partition's, so the records
+// staged and the markers of those released are on the followers too and the
+// one that takes over as leader releases what's still pending. The staging log
+// is read into the queue as it's appended to, and segments with only released
+// records are deleted.
+//
+// Records are released in the order they're due, so their order in the
+// partition's log may differ from the order they were produced in. A record's
+// released again if its leader fails before its marker's replicated, i.e.
+// delivery is at-least-once.
+type delayQueue struct {
+	delay     time.Duration
+	scheduled bool
+	staging   *commitlog.CommitLog
+	release   func(recordSet []byte) error
+	leader    func() bool
+
+	mu    sync.Mutex
+	wheel *timingWheel
+	// pending are the staging offsets of the records not yet released, and
+	// how many times in a row releasing them failed.
+	pending map[int64]int
+	// next is the staging offset to read into the queue from next.
+	next   int64
+	closed bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+type delayQueueConfig struct {
+	// Dir is the partition's directory; the staging log goes in a subdirectory.
+	Dir string
+	// Delay is how long after being produced a record is held back.
+	Delay time.Duration
+	// Scheduled holds records back until their timestamp, i.e. the producer sets
+	// each record's timestamp to when it should be delivered.
+	Scheduled bool
+	// Release appends a due record set to the partition's log.
+	Release func(recordSet []byte) error
+	// Leader returns whether the broker leads the partition. Only the leader
+	// releases records, nil means it always does.
+	Leader       func() bool
+	Tick         time.Duration
+	Size         int
+	SegmentBytes int64
+}
+
+// newDelayQueue opens the partition's staging log and reschedules the records
+// staged but not yet released.
+func newDelayQueue(config delayQueueConfig) (*delayQueue, error) {
+	if config.Tick == 0 {
+		config.Tick = defaultWheelTick
+	}
+	if config.Size == 0 {
+		config.Size = defaultWheelSize
+	}
+	if config.SegmentBytes == 0 {
+		config.SegmentBytes = stagingSegmentBytes
+	}
+	staging, err := commitlog.New(commitlog.Options{
+		Path:            filepath.Join(config.Dir, stagingDir),
+		MaxSegmentBytes: config.SegmentBytes,
+		MaxLogBytes:     -1,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "open staging log failed")
+	}
+	q := &delayQueue{
+		delay:     config.Delay,
+		scheduled: config.Scheduled,
+		staging:   staging,
+		release:   config.Release,
+		leader:    config.Leader,
+		wheel:     newTimingWheel(config.Tick, config.Size),
+		pending:   make(map[int64]int),
+		next:      staging.OldestOffset(),
+		done:      make(chan struct{}),
+	}
+	if err := q.scan(time.Now()); err != nil {
+		staging.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// due returns when the record set should be delivered.
+func (q *delayQueue) due(recordSet []byte, now time.Time) time.Time {
+	due := now.Add(q.delay)
+	if !q.scheduled {
+		return due
+	}
+	for _, m := range commitlog.MessageSet(recordSet).Messages() {
+		if m.MagicByte() == 0 {
+			continue
+		}
+		if t := time.Unix(0, m.Timestamp()*int64(time.Millisecond)); t.After(due) {
+			due = t
+		}
+	}
+	return due
+}
+
+// Stage holds the record set back if it isn't due yet and reports whether it
+// did. The staged record wraps the record set in a message whose timestamp is
+// when it's due, so the schedule's replicated and survives a restart.
+func (q *delayQueue) Stage(recordSet []byte) (bool, error) {
+	now := time.Now()
+	due := q.due(recordSet, now)
+	if !due.After(now) {
+		return false, nil
+	}
+	m, err := protocol.Encode(&protocol.Message{
+		MagicByte: 1,
+		Timestamp: due,
+		Value:     recordSet,
+	})
+	if err != nil {
+		return false, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false, errDelayQueueClosed
+	}
+	if _, err := q.staging.Append(commitlog.NewMessageSet(0, m)); err != nil {
+		return false, err
+	}
+	return true, q.scan(now)
+}
+
+// Pending returns the number of staged records not yet released.
+func (q *delayQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Run releases records as they come due until the queue's closed or stop is.
+func (q *delayQueue) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(q.wheel.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			q.advance()
+		}
+	}
+}
+
+// Close stops releasing records and closes the staging log.
+func (q *delayQueue) Close() error {
+	var err error
+	q.once.Do(func() {
+		close(q.done)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.closed = true
+		err = q.staging.Close()
+	})
+	return err
+}
+
+// advance reads what's been replicated to the staging log since the last tick,
+// moves the wheel forward a tick, and, on the leader, releases the records now
+// due. A follower holds on to them in case it takes over.
+func (q *delayQueue) advance() {
+	leader := q.leader == nil || q.leader()
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	if err := q.scan(time.Now()); err != nil {
+		log.Error.Printf("delay queue: read staging log error: %s", err)
+	}
+	due := q.wheel.advance()
+	if !leader {
+		for _, offset := range due {
+			q.wheel.add(offset, q.wheel.tick)
+		}
+		due = nil
+	}
+	q.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+	for _, offset := range due {
+		recordSet, err := q.read(offset)
+		if err == errDelayQueueClosed {
+			return
+		}
+		if err == nil && recordSet == nil {
+			continue
+		}
+		if err != nil {
+			// it won't read any better next time
+			log.Error.Printf("delay queue: dropping unreadable staged record at offset %d: %s", offset, err)
+		} else if err = q.release(recordSet); err != nil {
+			q.retry(offset, err)
+			continue
+		}
+		if err := q.released(offset); err != nil {
+			log.Error.Printf("delay queue: mark offset %d released error: %s", offset, err)
+		}
+	}
+	if err := q.truncate(); err != nil {
+		log.Error.Printf("delay queue: truncate staging log error: %s", err)
+	}
+}
+
+// retry reschedules the record whose release failed, backing off
+// exponentially with each failure in a row up to maxReleaseBackoff.
+func (q *delayQueue) retry(offset int64, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	attempts, ok := q.pending[offset]
+	if !ok {
+		return
+	}
+	backoff := q.wheel.tick << uint(attempts)
+	if backoff > maxReleaseBackoff || backoff <= 0 {
+		backoff = maxReleaseBackoff
+	} else {
+		q.pending[offset] = attempts + 1
+	}
+	log.Error.Printf("delay queue: release offset %d error, retrying in %s: %s", offset, backoff, err)
+	q.wheel.add(offset, backoff)
+}
+
+// read returns the record set staged at the offset, or nil if it's been
+// released already.
+func (q *delayQueue) read(offset int64) ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, errDelayQueueClosed
+	}
+	if _, ok := q.pending[offset]; !ok {
+		return nil, nil
+	}
+	r, err := q.staging.NewReader(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := commitlog.ReadMessageSet(r)
+	if err != nil {
+		return nil, err
+	}
+	msgs := ms.Messages()
+	if len(msgs) == 0 {
+		return nil, errors.Errorf("empty staged message set at offset %d", offset)
+	}
+	return msgs[0].Value(), nil
+}
+
+// released appends the marker for the record staged at the offset.
+func (q *delayQueue) released(offset int64) error {
+	value := make([]byte, 8)
+	protocol.Encoding.PutUint64(value, uint64(offset))
+	m, err := protocol.Encode(&protocol.Message{
+		MagicByte: 1,
+		Timestamp: time.Now(),
+		Key:       releasedKey,
+		Value:     value,
+	})
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, offset)
+	if q.closed {
+		return errDelayQueueClosed
+	}
+	_, err = q.staging.Append(commitlog.NewMessageSet(0, m))
+	return err
+}
+
+// truncate deletes the staging segments before the one with the oldest
+// pending record, they only have released records and markers.
+func (q *delayQueue) truncate() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	low := q.next
+	for offset := range q.pending {
+		if offset < low {
+			low = offset
+		}
+	}
+	base := q.staging.OldestOffset()
+	for _, s := range q.staging.Segments() {
+		if s.BaseOffset <= low && s.BaseOffset > base {
+			base = s.BaseOffset
+		}
+	}
+	if base == q.staging.OldestOffset() {
+		return nil
+	}
+	return q.staging.Truncate(base)
+}
+
+// scan reads the staging log from where it last left off, scheduling the
+// records staged and dropping those whose markers it reads. The caller holds
+// the lock.
+func (q *delayQueue) scan(now time.Time) error {
+	if oldest := q.staging.OldestOffset(); q.next < oldest {
+		// a follower's log starts over at the leader's oldest offset
+		q.next = oldest
+	}
+	if q.next >= q.staging.NewestOffset() {
+		return nil
+	}
+	r, err := q.staging.NewReader(q.next, 0)
+	if err != nil {
+		return err
+	}
+	for {
+		ms, err := commitlog.ReadMessageSet(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the rest's still being appended
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		q.next = ms.Offset() + 1
+		msgs := ms.Messages()
+		if len(msgs) == 0 {
+			continue
+		}
+		m := msgs[0]
+		if bytes.Equal(m.Key(), releasedKey) {
+			delete(q.pending, int64(protocol.Encoding.Uint64(m.Value())))
+			continue
+		}
+		due := time.Unix(0, m.Timestamp()*int64(time.Millisecond))
+		q.pending[ms.Offset()] = 0
+		q.wheel.add(ms.Offset(), due.Sub(now))
+	}
+}
+
+// stagingTopic returns the topic of a fetch of a partition's staging log and
+// true if the fetched topic names one.
+func stagingTopic(topic string) (string, bool) {
+	if !strings.HasSuffix(topic, stagingTopicSuffix) {
+		return topic, false
+	}
+	return strings.TrimSuffix(topic, stagingTopicSuffix), true
+}
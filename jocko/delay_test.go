@@ -0,0 +1,124 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestTimingWheel(t *testing.T) {
+	w := newTimingWheel(time.Millisecond, 4)
+	w.add(1, 0)
+	w.add(2, 2*time.Millisecond)
+	w.add(3, 6*time.Millisecond)
+
+	var fired [][]int64
+	for i := 0; i < 6; i++ {
+		fired = append(fired, w.advance())
+	}
+	require.Equal(t, [][]int64{{1}, {2}, nil, nil, nil, {3}}, fired)
+}
+
+func TestDelayQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var released []string
+	config := delayQueueConfig{
+		Dir:       dir,
+		Scheduled: true,
+		Release: func(recordSet []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			released = append(released, string(commitlog.MessageSet(recordSet).Messages()[0].Value()))
+			return nil
+		},
+		Tick: time.Millisecond,
+		Size: 8,
+	}
+	q, err := newDelayQueue(config)
+	require.NoError(t, err)
+
+	now := time.Now()
+	stage := func(q *delayQueue, value string, at time.Time) bool {
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: at, Value: []byte(value)})
+		require.NoError(t, err)
+		staged, err := q.Stage(commitlog.NewMessageSet(0, m))
+		require.NoError(t, err)
+		return staged
+	}
+	require.False(t, stage(q, "now", now.Add(-time.Second)))
+	require.True(t, stage(q, "soon", now.Add(20*time.Millisecond)))
+	require.True(t, stage(q, "later", now.Add(time.Hour)))
+	require.Equal(t, 2, q.Pending())
+
+	for q.Pending() == 2 {
+		q.advance()
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, []string{"soon"}, released)
+	require.NoError(t, q.Close())
+
+	// the record that's not due yet is rescheduled on restart, the released one isn't
+	q, err = newDelayQueue(config)
+	require.NoError(t, err)
+	defer q.Close()
+	require.Equal(t, 1, q.Pending())
+	_, ok := q.pending[1]
+	require.True(t, ok)
+}
+
+func TestDelayQueueFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayqueue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	leader := false
+	released := 0
+	q, err := newDelayQueue(delayQueueConfig{
+		Dir:   dir,
+		Delay: time.Millisecond,
+		Release: func(recordSet []byte) error {
+			released++
+			return nil
+		},
+		Leader:       func() bool { return leader },
+		Tick:         time.Millisecond,
+		Size:         8,
+		SegmentBytes: 64,
+	})
+	require.NoError(t, err)
+	defer q.Close()
+
+	for _, value := range []string{"a", "b", "c"} {
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte(value)})
+		require.NoError(t, err)
+		staged, err := q.Stage(commitlog.NewMessageSet(0, m))
+		require.NoError(t, err)
+		require.True(t, staged)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		q.advance()
+	}
+	// a follower holds on to its due records
+	require.Equal(t, 0, released)
+	require.Equal(t, 3, q.Pending())
+
+	leader = true
+	for q.Pending() > 0 {
+		q.advance()
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, 3, released)
+	// the segments with only released records and markers are deleted
+	require.NotEqual(t, int64(0), q.staging.OldestOffset())
+}
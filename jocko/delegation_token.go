@@ -0,0 +1,374 @@
+package jocko
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func (b *Broker) handleSaslHandshake(ctx *Context, req *protocol.SaslHandshakeRequest) *protocol.SaslHandshakeResponse {
+	sp := span(ctx, b.tracer, "sasl handshake")
+	defer sp.Finish()
+	res := &protocol.SaslHandshakeResponse{}
+	res.APIVersion = req.Version()
+	if b.config.DelegationTokenSecret != "" {
+		for _, m := range scramMechanisms {
+			res.EnabledMechanisms = append(res.EnabledMechanisms, m.name)
+		}
+	}
+	mechanism, ok := scramMechanismByName(req.Mechanism)
+	if !ok || b.config.DelegationTokenSecret == "" {
+		res.ErrorCode = protocol.ErrUnsupportedSaslMechanism.Code()
+		return res
+	}
+	if ctx.Client() == nil || !ctx.Client().startSASL(newScramServer(mechanism, b.scramCredentials)) {
+		res.ErrorCode = protocol.ErrIllegalSaslState.Code()
+		return res
+	}
+	return res
+}
+
+func (b *Broker) handleSaslAuthenticate(ctx *Context, req *protocol.SaslAuthenticateRequest) *protocol.SaslAuthenticateResponse {
+	sp := span(ctx, b.tracer, "sasl authenticate")
+	defer sp.Finish()
+	res := &protocol.SaslAuthenticateResponse{}
+	res.APIVersion = req.Version()
+	client := ctx.Client()
+	var exchange *scramServer
+	if client != nil {
+		exchange = client.saslExchange()
+	}
+	if exchange == nil {
+		res.ErrorCode = protocol.ErrIllegalSaslState.Code()
+		return res
+	}
+	reply, token, err := exchange.step(req.AuthBytes)
+	if err != nil {
+		log.Info.Printf("broker/%d: sasl authentication from %s failed: %s", b.config.ID, client.Addr, err)
+		// the client's told it failed, not why, so it can't probe for tokens
+		client.startSASL(nil)
+		msg := protocol.ErrSaslAuthenticationFailed.Error()
+		res.ErrorCode = protocol.ErrSaslAuthenticationFailed.Code()
+		res.ErrorMessage = &msg
+		return res
+	}
+	res.AuthBytes = reply
+	if token != nil {
+		client.authenticate(token)
+		res.SessionLifetime = time.Duration(token.ExpiryTimestamp-nowMillis()) * time.Millisecond
+	}
+	return res
+}
+
+// scramCredentials returns the unexpired delegation token with the ID and its
+// SCRAM password, the base64 encoded HMAC.
+func (b *Broker) scramCredentials(tokenID string) (*structs.DelegationToken, string, error) {
+	_, token, err := b.fsm.State().GetDelegationToken(tokenID)
+	if err != nil {
+		return nil, "", err
+	}
+	if token == nil {
+		return nil, "", fmt.Errorf("unknown delegation token %s", tokenID)
+	}
+	if token.ExpiryTimestamp <= nowMillis() {
+		return nil, "", fmt.Errorf("delegation token %s expired", tokenID)
+	}
+	return token, base64.StdEncoding.EncodeToString(b.delegationTokenHMAC(tokenID)), nil
+}
+
+// sessionValid returns whether the client's session is still valid. Clients
+// that authenticated with a delegation token only are until the end of the
+// session lifetime they were given, or until the token's expired or deleted if
+// that's sooner, and renewing the token doesn't extend their session.
+func (b *Broker) sessionValid(client *ClientInfo) bool {
+	tokenID, expiry := client.session()
+	if tokenID == "" {
+		return true
+	}
+	now := nowMillis()
+	if expiry <= now {
+		return false
+	}
+	_, token, err := b.fsm.State().GetDelegationToken(tokenID)
+	if err != nil || token == nil {
+		return false
+	}
+	return token.ExpiryTimestamp > now
+}
+
+// delegationTokenHMAC derives the token's HMAC from its ID and the brokers'
+// shared secret.
+func (b *Broker) delegationTokenHMAC(tokenID string) []byte {
+	mac := hmac.New(sha512.New, []byte(b.config.DelegationTokenSecret))
+	mac.Write([]byte(tokenID))
+	return mac.Sum(nil)
+}
+
+func (b *Broker) handleCreateDelegationToken(ctx *Context, req *protocol.CreateDelegationTokenRequest) *protocol.CreateDelegationTokenResponse {
+	sp := span(ctx, b.tracer, "create delegation token")
+	defer sp.Finish()
+	res := &protocol.CreateDelegationTokenResponse{}
+	res.APIVersion = req.Version()
+	if err := b.checkDelegationTokenRequest(ctx); err != protocol.ErrNone {
+		res.ErrorCode = err.Code()
+		return res
+	}
+	token, err := b.createDelegationToken(ctx.Client().Principal(), req.Renewers, req.MaxLifetime)
+	if err != protocol.ErrNone {
+		res.ErrorCode = err.Code()
+		return res
+	}
+	res.Owner = splitPrincipal(token.Owner)
+	res.IssueTimestamp = token.IssueTimestamp
+	res.ExpiryTimestamp = token.ExpiryTimestamp
+	res.MaxTimestamp = token.MaxTimestamp
+	res.TokenID = token.TokenID
+	res.HMAC = b.delegationTokenHMAC(token.TokenID)
+	return res
+}
+
+func (b *Broker) createDelegationToken(owner string, renewers []protocol.DelegationTokenPrincipal, maxLifetime time.Duration) (*structs.DelegationToken, protocol.Error) {
+	id := make([]byte, 16)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if maxLifetime <= 0 || maxLifetime > b.config.DelegationTokenMaxLifetime {
+		maxLifetime = b.config.DelegationTokenMaxLifetime
+	}
+	now := nowMillis()
+	token := structs.DelegationToken{
+		TokenID:        base64.RawURLEncoding.EncodeToString(id),
+		Owner:          owner,
+		IssueTimestamp: now,
+		MaxTimestamp:   now + int64(maxLifetime/time.Millisecond),
+		Salt:           salt,
+	}
+	token.ExpiryTimestamp = minInt64(now+int64(b.config.DelegationTokenExpiryTime/time.Millisecond), token.MaxTimestamp)
+	for _, r := range renewers {
+		token.Renewers = append(token.Renewers, r.PrincipalType+":"+r.Name)
+	}
+	if _, err := b.raftApply(structs.RegisterDelegationTokenRequestType, structs.RegisterDelegationTokenRequest{Token: token}); err != nil {
+		log.Error.Printf("broker/%d: create delegation token for %s error: %s", b.config.ID, owner, err)
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	log.Info.Printf("broker/%d: created delegation token %s for %s", b.config.ID, token.TokenID, owner)
+	return &token, protocol.ErrNone
+}
+
+func (b *Broker) handleRenewDelegationToken(ctx *Context, req *protocol.RenewDelegationTokenRequest) *protocol.RenewDelegationTokenResponse {
+	sp := span(ctx, b.tracer, "renew delegation token")
+	defer sp.Finish()
+	res := &protocol.RenewDelegationTokenResponse{}
+	res.APIVersion = req.Version()
+	period := req.RenewPeriod
+	if period < 0 {
+		period = b.config.DelegationTokenExpiryTime
+	}
+	expiry, err := b.setDelegationTokenExpiry(ctx, req.HMAC, period)
+	res.ErrorCode = err.Code()
+	res.ExpiryTimestamp = expiry
+	return res
+}
+
+func (b *Broker) handleExpireDelegationToken(ctx *Context, req *protocol.ExpireDelegationTokenRequest) *protocol.ExpireDelegationTokenResponse {
+	sp := span(ctx, b.tracer, "expire delegation token")
+	defer sp.Finish()
+	res := &protocol.ExpireDelegationTokenResponse{}
+	res.APIVersion = req.Version()
+	period := req.ExpiryTimePeriod
+	if period < 0 {
+		period = 0
+	}
+	expiry, err := b.setDelegationTokenExpiry(ctx, req.HMAC, period)
+	res.ErrorCode = err.Code()
+	res.ExpiryTimestamp = expiry
+	return res
+}
+
+// setDelegationTokenExpiry sets the token with the HMAC to expire after the
+// period, but no later than its max timestamp, and deletes it if that's now.
+// Only the token's owner and renewers can change its expiry.
+func (b *Broker) setDelegationTokenExpiry(ctx *Context, tokenHMAC []byte, period time.Duration) (int64, protocol.Error) {
+	if err := b.checkDelegationTokenRequest(ctx); err != protocol.ErrNone {
+		return -1, err
+	}
+	token, err := b.delegationTokenByHMAC(tokenHMAC)
+	if err != nil {
+		return -1, protocol.ErrUnknown.WithErr(err)
+	}
+	if token == nil {
+		return -1, protocol.ErrDelegationTokenNotFound
+	}
+	principal := ctx.Client().Principal()
+	if !canRenew(token, principal) {
+		return -1, protocol.ErrDelegationTokenOwnerMismatch
+	}
+	now := nowMillis()
+	if token.ExpiryTimestamp <= now {
+		return -1, protocol.ErrDelegationTokenExpired
+	}
+	expiry := minInt64(now+int64(period/time.Millisecond), token.MaxTimestamp)
+	if expiry <= now {
+		if _, err := b.raftApply(structs.DeregisterDelegationTokenRequestType, structs.DeregisterDelegationTokenRequest{TokenID: token.TokenID}); err != nil {
+			log.Error.Printf("broker/%d: expire delegation token %s error: %s", b.config.ID, token.TokenID, err)
+			return -1, protocol.ErrUnknown.WithErr(err)
+		}
+		log.Info.Printf("broker/%d: %s expired delegation token %s", b.config.ID, principal, token.TokenID)
+		return now, protocol.ErrNone
+	}
+	tokenCopy := *token
+	tokenCopy.ExpiryTimestamp = expiry
+	if _, err := b.raftApply(structs.RegisterDelegationTokenRequestType, structs.RegisterDelegationTokenRequest{Token: tokenCopy}); err != nil {
+		log.Error.Printf("broker/%d: set delegation token %s expiry error: %s", b.config.ID, token.TokenID, err)
+		return -1, protocol.ErrUnknown.WithErr(err)
+	}
+	return expiry, protocol.ErrNone
+}
+
+func (b *Broker) handleDescribeDelegationToken(ctx *Context, req *protocol.DescribeDelegationTokenRequest) *protocol.DescribeDelegationTokenResponse {
+	sp := span(ctx, b.tracer, "describe delegation token")
+	defer sp.Finish()
+	res := &protocol.DescribeDelegationTokenResponse{}
+	res.APIVersion = req.Version()
+	if err := b.checkDelegationTokenPrincipal(ctx); err != protocol.ErrNone {
+		res.ErrorCode = err.Code()
+		return res
+	}
+	_, tokens, err := b.fsm.State().GetDelegationTokens()
+	if err != nil {
+		res.ErrorCode = protocol.ErrUnknown.Code()
+		return res
+	}
+	owners := make(map[string]bool, len(req.Owners))
+	for _, o := range req.Owners {
+		owners[o.PrincipalType+":"+o.Name] = true
+	}
+	principal := ctx.Client().Principal()
+	now := nowMillis()
+	for _, t := range tokens {
+		if t.ExpiryTimestamp <= now || (req.Owners != nil && !owners[t.Owner]) || !canRenew(t, principal) {
+			continue
+		}
+		token := protocol.DelegationToken{
+			Owner:           splitPrincipal(t.Owner),
+			IssueTimestamp:  t.IssueTimestamp,
+			ExpiryTimestamp: t.ExpiryTimestamp,
+			MaxTimestamp:    t.MaxTimestamp,
+			TokenID:         t.TokenID,
+			HMAC:            []byte{},
+		}
+		// the HMAC's the token's password, renewers only get to see it
+		// exists
+		if t.Owner == principal {
+			token.HMAC = b.delegationTokenHMAC(t.TokenID)
+		}
+		for _, r := range t.Renewers {
+			token.Renewers = append(token.Renewers, splitPrincipal(r))
+		}
+		res.Tokens = append(res.Tokens, token)
+	}
+	return res
+}
+
+// checkDelegationTokenRequest checks that the controller can create or change
+// tokens for the client.
+func (b *Broker) checkDelegationTokenRequest(ctx *Context) protocol.Error {
+	if err := b.checkDelegationTokenPrincipal(ctx); err != protocol.ErrNone {
+		return err
+	}
+	if !b.isController() {
+		return protocol.ErrNotController
+	}
+	return protocol.ErrNone
+}
+
+// checkDelegationTokenPrincipal checks that the client can use the delegation
+// token APIs. Clients that haven't authenticated can't, since tokens belong to
+// principals, and neither can those authenticated with a token, so a leaked
+// token can't be used to keep itself alive or make more.
+func (b *Broker) checkDelegationTokenPrincipal(ctx *Context) protocol.Error {
+	if b.config.DelegationTokenSecret == "" {
+		return protocol.ErrDelegationTokenAuthDisabled
+	}
+	if ctx.Client().Principal() == anonymousPrincipal || ctx.Client().DelegationToken() != "" {
+		return protocol.ErrDelegationTokenRequestNotAllowed
+	}
+	return protocol.ErrNone
+}
+
+func (b *Broker) delegationTokenByHMAC(tokenHMAC []byte) (*structs.DelegationToken, error) {
+	_, tokens, err := b.fsm.State().GetDelegationTokens()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if hmac.Equal(b.delegationTokenHMAC(t.TokenID), tokenHMAC) {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// deleteExpiredDelegationTokens deletes the tokens that have expired. It's run
+// by the controller.
+func (b *Broker) deleteExpiredDelegationTokens() error {
+	_, tokens, err := b.fsm.State().GetDelegationTokens()
+	if err != nil {
+		return err
+	}
+	now := nowMillis()
+	for _, t := range tokens {
+		if t.ExpiryTimestamp > now {
+			continue
+		}
+		if _, err := b.raftApply(structs.DeregisterDelegationTokenRequestType, structs.DeregisterDelegationTokenRequest{TokenID: t.TokenID}); err != nil {
+			return err
+		}
+		log.Info.Printf("broker/%d: deleted expired delegation token %s", b.config.ID, t.TokenID)
+	}
+	return nil
+}
+
+func canRenew(token *structs.DelegationToken, principal string) bool {
+	if token.Owner == principal {
+		return true
+	}
+	for _, r := range token.Renewers {
+		if r == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPrincipal splits a principal like User:alice into its type and name.
+func splitPrincipal(principal string) protocol.DelegationTokenPrincipal {
+	i := strings.IndexByte(principal, ':')
+	if i == -1 {
+		return protocol.DelegationTokenPrincipal{PrincipalType: "User", Name: principal}
+	}
+	return protocol.DelegationTokenPrincipal{PrincipalType: principal[:i], Name: principal[i+1:]}
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
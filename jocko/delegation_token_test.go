@@ -0,0 +1,151 @@
+package jocko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fsmStore applies changes straight to the FSM.
+type fsmStore struct {
+	fsm   *fsm.FSM
+	index uint64
+}
+
+func (s *fsmStore) Apply(buf []byte) (interface{}, error) {
+	s.index++
+	return s.fsm.Apply(&raft.Log{Index: s.index, Data: buf}), nil
+}
+
+func (s *fsmStore) IsLeader() bool { return true }
+
+func (s *fsmStore) Close() error { return nil }
+
+func TestDelegationTokens(t *testing.T) {
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	require.NoError(t, err)
+	b := &Broker{
+		config: &config.Config{
+			DelegationTokenSecret:      "secret",
+			DelegationTokenMaxLifetime: time.Hour,
+			DelegationTokenExpiryTime:  time.Minute,
+		},
+		fsm:    f,
+		store:  &fsmStore{fsm: f},
+		tracer: stdopentracing.NoopTracer{},
+	}
+	newCtx := func(principal string) *Context {
+		client := &ClientInfo{apiVersions: make(map[int16]int16)}
+		client.SetPrincipal(principal)
+		return &Context{parent: context.Background(), client: client}
+	}
+	alice := newCtx("User:alice")
+
+	// tokens belong to principals, so clients that haven't authenticated
+	// can't make them
+	res := b.handleCreateDelegationToken(newCtx(anonymousPrincipal), &protocol.CreateDelegationTokenRequest{MaxLifetime: -1})
+	require.Equal(t, protocol.ErrDelegationTokenRequestNotAllowed.Code(), res.ErrorCode)
+
+	created := b.handleCreateDelegationToken(alice, &protocol.CreateDelegationTokenRequest{
+		Renewers:    []protocol.DelegationTokenPrincipal{{PrincipalType: "User", Name: "bob"}},
+		MaxLifetime: -1,
+	})
+	require.Equal(t, protocol.ErrNone.Code(), created.ErrorCode)
+	require.Equal(t, protocol.DelegationTokenPrincipal{PrincipalType: "User", Name: "alice"}, created.Owner)
+	require.Equal(t, created.IssueTimestamp+time.Minute.Nanoseconds()/1e6, created.ExpiryTimestamp)
+	require.Equal(t, created.IssueTimestamp+time.Hour.Nanoseconds()/1e6, created.MaxTimestamp)
+
+	// a short-lived client authenticates as alice with the token
+	authenticate := func(tokenID string, tokenHMAC []byte) (*Context, error) {
+		ctx := newCtx(anonymousPrincipal)
+		sasl := DelegationTokenSASL(tokenID, tokenHMAC)
+		handshake := b.handleSaslHandshake(ctx, &protocol.SaslHandshakeRequest{APIVersion: 1, Mechanism: sasl.Mechanism})
+		require.Equal(t, protocol.ErrNone.Code(), handshake.ErrorCode)
+		require.Contains(t, handshake.EnabledMechanisms, scramSHA256)
+		mechanism, _ := scramMechanismByName(sasl.Mechanism)
+		client, err := newScramClient(mechanism, sasl.User, sasl.Pass)
+		require.NoError(t, err)
+		res := b.handleSaslAuthenticate(ctx, &protocol.SaslAuthenticateRequest{AuthBytes: client.first()})
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[res.ErrorCode]
+		}
+		final, err := client.final(res.AuthBytes)
+		require.NoError(t, err)
+		res = b.handleSaslAuthenticate(ctx, &protocol.SaslAuthenticateRequest{APIVersion: 1, AuthBytes: final})
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[res.ErrorCode]
+		}
+		require.True(t, res.SessionLifetime > 0 && res.SessionLifetime <= time.Minute)
+		return ctx, client.verify(res.AuthBytes)
+	}
+	worker, err := authenticate(created.TokenID, created.HMAC)
+	require.NoError(t, err)
+	require.Equal(t, "User:alice", worker.Client().Principal())
+	require.Equal(t, created.TokenID, worker.Client().DelegationToken())
+	require.True(t, b.sessionValid(worker.Client()))
+	_, err = authenticate(created.TokenID, []byte("wrong"))
+	require.Equal(t, protocol.ErrSaslAuthenticationFailed, err)
+
+	// the token can't be used to make more tokens
+	res = b.handleCreateDelegationToken(worker, &protocol.CreateDelegationTokenRequest{MaxLifetime: -1})
+	require.Equal(t, protocol.ErrDelegationTokenRequestNotAllowed.Code(), res.ErrorCode)
+
+	other, err := authenticate(created.TokenID, created.HMAC)
+	require.NoError(t, err)
+
+	// bob can renew and see it, mallory can't
+	renewed := b.handleRenewDelegationToken(newCtx("User:bob"), &protocol.RenewDelegationTokenRequest{HMAC: created.HMAC, RenewPeriod: 2 * time.Hour})
+	require.Equal(t, protocol.ErrNone.Code(), renewed.ErrorCode)
+	require.Equal(t, created.MaxTimestamp, renewed.ExpiryTimestamp)
+	renewed = b.handleRenewDelegationToken(newCtx("User:mallory"), &protocol.RenewDelegationTokenRequest{HMAC: created.HMAC, RenewPeriod: -1})
+	require.Equal(t, protocol.ErrDelegationTokenOwnerMismatch.Code(), renewed.ErrorCode)
+	described := b.handleDescribeDelegationToken(newCtx("User:bob"), &protocol.DescribeDelegationTokenRequest{})
+	require.Len(t, described.Tokens, 1)
+	require.Equal(t, created.TokenID, described.Tokens[0].TokenID)
+	// only the owner sees the HMAC
+	require.Empty(t, described.Tokens[0].HMAC)
+	described = b.handleDescribeDelegationToken(alice, &protocol.DescribeDelegationTokenRequest{})
+	require.Len(t, described.Tokens, 1)
+	require.Equal(t, created.HMAC, described.Tokens[0].HMAC)
+	described = b.handleDescribeDelegationToken(newCtx("User:mallory"), &protocol.DescribeDelegationTokenRequest{})
+	require.Len(t, described.Tokens, 0)
+
+	// renewing the token doesn't extend the sessions of clients using it, so
+	// they're disconnected once theirs end
+	_, expiry := worker.Client().session()
+	require.Equal(t, created.ExpiryTimestamp, expiry)
+	worker.Client().sessionExpiry = nowMillis()
+	require.False(t, b.sessionValid(worker.Client()))
+	require.True(t, b.sessionValid(other.Client()))
+
+	// expiring it deletes it and it can't authenticate anymore
+	expired := b.handleExpireDelegationToken(alice, &protocol.ExpireDelegationTokenRequest{HMAC: created.HMAC, ExpiryTimePeriod: -1})
+	require.Equal(t, protocol.ErrNone.Code(), expired.ErrorCode)
+	_, token, err := f.State().GetDelegationToken(created.TokenID)
+	require.NoError(t, err)
+	require.Nil(t, token)
+	_, err = authenticate(created.TokenID, created.HMAC)
+	require.Equal(t, protocol.ErrSaslAuthenticationFailed, err)
+	// and the session of the client that authenticated with it's over
+	require.False(t, b.sessionValid(other.Client()))
+	require.True(t, b.sessionValid(alice.Client()))
+}
+
+func TestScramClient(t *testing.T) {
+	// the example exchange from RFC 7677, without the tokenauth extension
+	mechanism, _ := scramMechanismByName(scramSHA256)
+	client := &scramClient{mechanism: mechanism, user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	client.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	final, err := client.final([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	require.NoError(t, err)
+	require.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(final))
+	require.NoError(t, client.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+	require.Error(t, client.verify([]byte("v=AAAA")))
+}
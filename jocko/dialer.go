@@ -3,19 +3,36 @@ package jocko
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/travisjeffery/jocko/protocol"
 )
 
 const (
 	defaultRTT = 1 * time.Second
 	maxTimeout = time.Duration(math.MaxInt32) * time.Millisecond
 	minTimeout = time.Duration(math.MinInt32) * time.Millisecond
+
+	defaultReconnectBackoff    = 50 * time.Millisecond
+	defaultReconnectBackoffMax = 1 * time.Second
+	// reconnectJitter is the fraction a reconnect backoff is randomly
+	// shortened or lengthened by.
+	reconnectJitter = 0.2
 )
 
+// ErrBrokerBlacklisted is returned when dialing an address whose last dials
+// failed and whose reconnect backoff hasn't passed yet.
+var ErrBrokerBlacklisted = errors.New("broker blacklisted after failed dials")
+
 // Dialer is like the net.Dialer API but for opening connections to Jocko brokers.
 type Dialer struct {
 	// Unique ID for client connections established by this Dialer.
@@ -38,8 +55,19 @@ type Dialer struct {
 	TLS *tls.Config
 	// DualStack enables RFC 6555-compliant "happy eyeballs" dialing.
 	DualStack bool
-	// SASL enables SASL plain authentication.
+	// SASL enables SASL authentication.
 	SASL *SASL
+	// ReconnectBackoff is how long an address is blacklisted after a dial to
+	// it fails, so a flapping broker isn't hit by every client redialing it.
+	// The backoff doubles with each failure in a row, up to
+	// ReconnectBackoffMax, and is jittered so clients spread their redials.
+	// If 0, failed addresses are dialed again right away.
+	ReconnectBackoff time.Duration
+	// ReconnectBackoffMax is the max an address is blacklisted for. If 0,
+	// default is 1s.
+	ReconnectBackoffMax time.Duration
+
+	backoffs reconnectBackoffs
 }
 
 var (
@@ -49,9 +77,11 @@ var (
 // NewDialer creates a new dialer.
 func NewDialer(clientID string) *Dialer {
 	return &Dialer{
-		Timeout:   10 * time.Second,
-		DualStack: true,
-		ClientID:  clientID,
+		Timeout:             10 * time.Second,
+		DualStack:           true,
+		ClientID:            clientID,
+		ReconnectBackoff:    defaultReconnectBackoff,
+		ReconnectBackoffMax: defaultReconnectBackoffMax,
 	}
 }
 
@@ -82,11 +112,81 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (*Con
 		defer cancel()
 	}
 
+	if d.ReconnectBackoff > 0 && d.backoffs.blacklisted(address, time.Now()) {
+		return nil, ErrBrokerBlacklisted
+	}
 	c, err := d.dialContext(ctx, network, address)
 	if err != nil {
+		// the broker isn't at fault if the caller gave up on the dial
+		if d.ReconnectBackoff > 0 && ctx.Err() != context.Canceled {
+			d.backoffs.failed(address, d.ReconnectBackoff, d.ReconnectBackoffMax, time.Now())
+		}
 		return nil, err
 	}
-	return NewConn(c, d.ClientID)
+	if d.ReconnectBackoff > 0 {
+		d.backoffs.succeeded(address)
+	}
+	conn, err := NewConn(c, d.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if d.SASL != nil && d.SASL.Mechanism != "" && d.SASL.Mechanism != saslPlain {
+		if err := conn.authenticateSCRAM(ctx, d.SASL); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// reconnectBackoffs tracks the addresses whose dials have been failing and
+// until when they're blacklisted.
+type reconnectBackoffs struct {
+	mu    sync.Mutex
+	addrs map[string]*reconnectBackoff
+}
+
+type reconnectBackoff struct {
+	failures uint
+	until    time.Time
+}
+
+func (r *reconnectBackoffs) blacklisted(addr string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.addrs[addr]
+	return ok && now.Before(b.until)
+}
+
+// failed records a failed dial to the address and blacklists it for the
+// backoff, doubled for each earlier failure in a row and jittered.
+func (r *reconnectBackoffs) failed(addr string, backoff, max time.Duration, now time.Time) {
+	if max == 0 {
+		max = defaultReconnectBackoffMax
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.addrs == nil {
+		r.addrs = make(map[string]*reconnectBackoff)
+	}
+	b, ok := r.addrs[addr]
+	if !ok {
+		b = new(reconnectBackoff)
+		r.addrs[addr] = b
+	}
+	delay := max
+	if b.failures < 32 && backoff<<b.failures > 0 && backoff<<b.failures < max {
+		delay = backoff << b.failures
+	}
+	b.failures++
+	jitter := (rand.Float64()*2 - 1) * reconnectJitter
+	b.until = now.Add(delay + time.Duration(float64(delay)*jitter))
+}
+
+func (r *reconnectBackoffs) succeeded(addr string) {
+	r.mu.Lock()
+	delete(r.addrs, addr)
+	r.mu.Unlock()
 }
 
 func (d *Dialer) dialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
@@ -120,7 +220,7 @@ func (d *Dialer) dialContext(ctx context.Context, network, address string) (conn
 		}
 	}
 
-	if d.SASL != nil {
+	if d.SASL != nil && (d.SASL.Mechanism == "" || d.SASL.Mechanism == saslPlain) {
 		if err = d.connectSASLPlain(ctx, conn); err != nil {
 			conn.Close()
 			return
@@ -180,6 +280,69 @@ type Resolver interface {
 	LookupHost(ctx context.Context, host string) ([]string, error)
 }
 
+const saslPlain = "PLAIN"
+
+// SASL configures how the dialer authenticates its connections.
 type SASL struct {
 	User, Pass string
+	// Mechanism is PLAIN, the default, or SCRAM-SHA-256 or SCRAM-SHA-512,
+	// which authenticate with a delegation token.
+	Mechanism string
+}
+
+// DelegationTokenSASL returns the SASL config authenticating with the
+// delegation token with the ID and HMAC, e.g. as returned by
+// CreateDelegationToken.
+func DelegationTokenSASL(tokenID string, hmac []byte) *SASL {
+	return &SASL{
+		User:      tokenID,
+		Pass:      base64.StdEncoding.EncodeToString(hmac),
+		Mechanism: scramSHA512,
+	}
+}
+
+// authenticateSCRAM authenticates the connection with a SCRAM exchange.
+func (c *Conn) authenticateSCRAM(ctx context.Context, sasl *SASL) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	mechanism, ok := scramMechanismByName(sasl.Mechanism)
+	if !ok {
+		return fmt.Errorf("unsupported sasl mechanism %s", sasl.Mechanism)
+	}
+	handshake, err := c.SaslHandshake(&protocol.SaslHandshakeRequest{APIVersion: 1, Mechanism: mechanism.name})
+	if err != nil {
+		return err
+	}
+	if handshake.ErrorCode != protocol.ErrNone.Code() {
+		return protocol.Errs[handshake.ErrorCode]
+	}
+	client, err := newScramClient(mechanism, sasl.User, sasl.Pass)
+	if err != nil {
+		return err
+	}
+	step := func(msg []byte) ([]byte, error) {
+		res, err := c.SaslAuthenticate(&protocol.SaslAuthenticateRequest{AuthBytes: msg})
+		if err != nil {
+			return nil, err
+		}
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[res.ErrorCode]
+		}
+		return res.AuthBytes, nil
+	}
+	serverFirst, err := step(client.first())
+	if err != nil {
+		return err
+	}
+	clientFinal, err := client.final(serverFirst)
+	if err != nil {
+		return err
+	}
+	serverFinal, err := step(clientFinal)
+	if err != nil {
+		return err
+	}
+	return client.verify(serverFinal)
 }
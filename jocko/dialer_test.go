@@ -0,0 +1,40 @@
+package jocko
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialerReconnectBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	d := NewDialer("test")
+	d.ReconnectBackoff = 100 * time.Millisecond
+	_, err = d.Dial("tcp", addr)
+	require.Error(t, err)
+	require.NotEqual(t, ErrBrokerBlacklisted, err)
+
+	// the failed address isn't dialed again until its backoff passes
+	_, err = d.Dial("tcp", addr)
+	require.Equal(t, ErrBrokerBlacklisted, err)
+
+	// the backoff doubles with each failure in a row, up to the max
+	now := time.Now()
+	var r reconnectBackoffs
+	for i, exp := range []time.Duration{100, 200, 400, 500, 500} {
+		r.failed(addr, 100*time.Millisecond, 500*time.Millisecond, now)
+		delay := r.addrs[addr].until.Sub(now)
+		exp *= time.Millisecond
+		require.InDelta(t, float64(exp), float64(delay), float64(exp)*reconnectJitter, "failure %d", i)
+	}
+	require.True(t, r.blacklisted(addr, now))
+	require.False(t, r.blacklisted(addr, now.Add(time.Second)))
+	r.succeeded(addr)
+	require.False(t, r.blacklisted(addr, now))
+}
@@ -0,0 +1,443 @@
+package jocko
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// DoctorConfig is what the doctor inspects and the limits it checks against.
+type DoctorConfig struct {
+	// BrokerAddr is the address of a broker in the running cluster to find
+	// its brokers with. The cluster isn't inspected if it's empty.
+	BrokerAddr string
+	// DataDir is a broker's data dir to inspect, best while the broker's
+	// stopped since the segments being written to can look torn. It isn't
+	// inspected if it's empty.
+	DataDir string
+	// MaxClockSkew is the most a broker's clock can be off from this
+	// machine's.
+	MaxClockSkew time.Duration
+	// MinOpenFiles is the open file limit to have on top of what the data
+	// dir's segments take, for connections. The limit checked is the
+	// doctor's, so run it the way the broker's run, e.g. as its user.
+	MinOpenFiles uint64
+	// QuotaSaturation is the share of a topic's produce.byte.rate its
+	// producers can use before it's reported, e.g. 0.9.
+	QuotaSaturation float64
+}
+
+// Diagnosis is a problem the doctor found and how to fix it.
+type Diagnosis struct {
+	Check   string
+	Problem string
+	Fix     string
+}
+
+func (d *Diagnosis) String() string {
+	return fmt.Sprintf("%s: %s\n  fix: %s", d.Check, d.Problem, d.Fix)
+}
+
+// Doctor inspects the running cluster and the data dir for common
+// misconfigurations: brokers that disagree on the cluster's brokers or
+// topics, e.g. because they joined different clusters, clock skew,
+// partitions under their min in-sync replicas, segments and indexes that are
+// inconsistent, data from another cluster or a deleted topic, an open file
+// limit too low for the data dir, and topics at their produce quotas. It
+// returns what it finds with suggested fixes, or an error if it can't inspect
+// the cluster at all.
+func Doctor(dialer *Dialer, config DoctorConfig) ([]*Diagnosis, error) {
+	var diagnoses []*Diagnosis
+	var md *protocol.MetadataResponse
+	if config.BrokerAddr != "" {
+		var err error
+		var d []*Diagnosis
+		if md, d, err = doctorCluster(dialer, config); err != nil {
+			return nil, err
+		}
+		diagnoses = append(diagnoses, d...)
+	}
+	var segments int
+	if config.DataDir != "" {
+		var err error
+		var d []*Diagnosis
+		if segments, d, err = doctorDataDir(config.DataDir, md); err != nil {
+			return nil, err
+		}
+		diagnoses = append(diagnoses, d...)
+	}
+	if d := doctorOpenFiles(segments, config.MinOpenFiles); d != nil {
+		diagnoses = append(diagnoses, d)
+	}
+	return diagnoses, nil
+}
+
+// doctorCluster asks each of the cluster's brokers for its view of the
+// cluster, its clock, and its traffic, and the cluster for its topics'
+// configs. It returns the metadata of the broker at the config's address.
+func doctorCluster(dialer *Dialer, config DoctorConfig) (*protocol.MetadataResponse, []*Diagnosis, error) {
+	conn, err := dialer.Dial("tcp", config.BrokerAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	md, err := conn.Metadata(&protocol.MetadataRequest{APIVersion: 1})
+	if err != nil {
+		return nil, nil, err
+	}
+	configs, err := topicConfigs(conn, md, "min.insync.replicas", "produce.byte.rate", topicIDConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	setTopicIDs(md, configs)
+
+	var diagnoses []*Diagnosis
+	views := make(map[int32]*protocol.MetadataResponse)
+	var traffic []*protocol.DescribeTrafficResponse
+	for _, broker := range md.Brokers {
+		check := fmt.Sprintf("broker %d", broker.NodeID)
+		conn, err := dialer.Dial("tcp", broker.Addr())
+		if err != nil {
+			diagnoses = append(diagnoses, &Diagnosis{
+				Check:   check,
+				Problem: fmt.Sprintf("connect to %s failed: %s", broker.Addr(), err),
+				Fix:     "check the broker's running and the address it advertises is reachable from here",
+			})
+			continue
+		}
+		if view, err := conn.Metadata(&protocol.MetadataRequest{APIVersion: 1}); err == nil {
+			if ids, err := topicConfigs(conn, view, topicIDConfig); err == nil {
+				setTopicIDs(view, ids)
+				views[broker.NodeID] = view
+			}
+		}
+		if _, skew, err := clockSkew(conn); err == nil {
+			if d := doctorClockSkew(broker.NodeID, skew, config.MaxClockSkew); d != nil {
+				diagnoses = append(diagnoses, d)
+			}
+		}
+		if res, err := conn.DescribeTraffic(&protocol.DescribeTrafficRequest{APIVersion: 1}); err == nil && res.ErrorCode == protocol.ErrNone.Code() {
+			traffic = append(traffic, res)
+		}
+		conn.Close()
+	}
+	diagnoses = append(diagnoses, doctorMembership(views)...)
+	diagnoses = append(diagnoses, doctorISR(md, configs)...)
+	diagnoses = append(diagnoses, doctorQuotas(traffic, configs, config.QuotaSaturation)...)
+	return md, diagnoses, nil
+}
+
+// topicConfigs returns the named configs of the cluster's topics by topic.
+func topicConfigs(conn *Conn, md *protocol.MetadataResponse, names ...string) (map[string]map[string]string, error) {
+	req := &protocol.DescribeConfigsRequest{}
+	for _, t := range md.TopicMetadata {
+		req.Resources = append(req.Resources, protocol.DescribeConfigsResource{
+			Type:        protocol.TopicResourceType,
+			Name:        t.Topic,
+			ConfigNames: names,
+		})
+	}
+	configs := make(map[string]map[string]string)
+	if len(req.Resources) == 0 {
+		return configs, nil
+	}
+	res, err := conn.DescribeConfigs(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res.Resources {
+		if r.ErrorCode != protocol.ErrNone.Code() {
+			continue
+		}
+		configs[r.Name] = make(map[string]string)
+		for _, e := range r.ConfigEntries {
+			if e.Value != nil {
+				configs[r.Name][e.Name] = *e.Value
+			}
+		}
+	}
+	return configs, nil
+}
+
+// setTopicIDs sets the metadata's topics' IDs from their topic.id configs,
+// since the Metadata versions brokers serve don't have them.
+func setTopicIDs(md *protocol.MetadataResponse, configs map[string]map[string]string) {
+	for _, t := range md.TopicMetadata {
+		if id, err := uuid.FromString(configs[t.Topic][topicIDConfig]); err == nil {
+			t.TopicID = protocol.UUID(id)
+		}
+	}
+}
+
+func doctorClockSkew(id int32, skew, max time.Duration) *Diagnosis {
+	if skew < 0 {
+		skew = -skew
+	}
+	if max <= 0 || skew <= max {
+		return nil
+	}
+	return &Diagnosis{
+		Check:   fmt.Sprintf("broker %d", id),
+		Problem: fmt.Sprintf("clock is off by %s from this machine's, over the max of %s", skew, max),
+		Fix:     "run NTP or chrony on the brokers, skew breaks time-based retention, segment rolling, and delegation token expiry",
+	}
+}
+
+// doctorMembership compares the brokers' views of the cluster. Brokers that
+// see different brokers, or the same topics with different IDs, have joined
+// different clusters or are partitioned from each other.
+func doctorMembership(views map[int32]*protocol.MetadataResponse) []*Diagnosis {
+	ids := make([]int, 0, len(views))
+	for id := range views {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	if len(ids) < 2 {
+		return nil
+	}
+	var diagnoses []*Diagnosis
+	first := views[int32(ids[0])]
+	for _, id := range ids[1:] {
+		md := views[int32(id)]
+		if want, got := brokerIDs(first), brokerIDs(md); want != got {
+			diagnoses = append(diagnoses, &Diagnosis{
+				Check:   fmt.Sprintf("broker %d", id),
+				Problem: fmt.Sprintf("sees brokers %s but broker %d sees %s", got, ids[0], want),
+				Fix:     "the brokers have joined different clusters or can't reach each other, check their --join addresses and that their serf and raft ports are open between them",
+			})
+		}
+		topicIDs := make(map[string]protocol.UUID)
+		for _, t := range first.TopicMetadata {
+			topicIDs[t.Topic] = t.TopicID
+		}
+		for _, t := range md.TopicMetadata {
+			want, ok := topicIDs[t.Topic]
+			if !ok || want == t.TopicID {
+				continue
+			}
+			diagnoses = append(diagnoses, &Diagnosis{
+				Check:   fmt.Sprintf("broker %d", id),
+				Problem: fmt.Sprintf("has topic %s as %s but broker %d has it as %s", t.Topic, uuid.UUID(t.TopicID), ids[0], uuid.UUID(want)),
+				Fix:     "one of the brokers is from another cluster or has stale raft state, stop it, move its data dir aside, and join it to the cluster again",
+			})
+		}
+	}
+	return diagnoses
+}
+
+func brokerIDs(md *protocol.MetadataResponse) string {
+	ids := make([]int, 0, len(md.Brokers))
+	for _, b := range md.Brokers {
+		ids = append(ids, int(b.NodeID))
+	}
+	sort.Ints(ids)
+	return fmt.Sprint(ids)
+}
+
+// doctorISR returns the partitions with fewer in-sync replicas than their
+// topic's min.insync.replicas, which can't take acks=all produces.
+func doctorISR(md *protocol.MetadataResponse, configs map[string]map[string]string) []*Diagnosis {
+	var diagnoses []*Diagnosis
+	for _, t := range md.TopicMetadata {
+		minISR, err := strconv.Atoi(configs[t.Topic]["min.insync.replicas"])
+		if err != nil || minISR <= 1 {
+			continue
+		}
+		for _, p := range t.PartitionMetadata {
+			check := fmt.Sprintf("partition %s-%d", t.Topic, p.PartitionID)
+			if len(p.Replicas) < minISR {
+				diagnoses = append(diagnoses, &Diagnosis{
+					Check:   check,
+					Problem: fmt.Sprintf("has %d replicas, under its topic's min.insync.replicas of %d, so it can never take acks=all produces", len(p.Replicas), minISR),
+					Fix:     "lower the topic's min.insync.replicas or add replicas to the partition",
+				})
+				continue
+			}
+			if len(p.ISR) >= minISR {
+				continue
+			}
+			diagnoses = append(diagnoses, &Diagnosis{
+				Check:   check,
+				Problem: fmt.Sprintf("has %d in-sync replicas %v, under its topic's min.insync.replicas of %d", len(p.ISR), p.ISR, minISR),
+				Fix:     fmt.Sprintf("check replicas %v are running and catching up to leader %d, e.g. with jocko verify-replicas", outOfSync(p), p.Leader),
+			})
+		}
+	}
+	return diagnoses
+}
+
+// outOfSync returns the partition's replicas that aren't in its ISR.
+func outOfSync(p *protocol.PartitionMetadata) []int32 {
+	isr := make(map[int32]bool, len(p.ISR))
+	for _, id := range p.ISR {
+		isr[id] = true
+	}
+	var out []int32
+	for _, id := range p.Replicas {
+		if !isr[id] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// doctorQuotas returns the topics whose produce rate over the brokers'
+// traffic windows is at least the saturation share of their
+// produce.byte.rate, whose producers are being throttled or soon will be.
+func doctorQuotas(traffic []*protocol.DescribeTrafficResponse, configs map[string]map[string]string, saturation float64) []*Diagnosis {
+	if saturation <= 0 {
+		return nil
+	}
+	bytesIn := make(map[string]int64)
+	window := trafficWindow
+	for _, res := range traffic {
+		window = res.Window
+		for _, s := range res.Topics {
+			bytesIn[s.Name] += s.WindowBytesIn
+		}
+	}
+	topics := make([]string, 0, len(bytesIn))
+	for topic := range bytesIn {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	var diagnoses []*Diagnosis
+	for _, topic := range topics {
+		quota, err := strconv.ParseInt(configs[topic]["produce.byte.rate"], 10, 64)
+		if err != nil || quota <= 0 {
+			continue
+		}
+		rate := float64(bytesIn[topic]) / window.Seconds()
+		if rate < saturation*float64(quota) {
+			continue
+		}
+		diagnoses = append(diagnoses, &Diagnosis{
+			Check:   "topic " + topic,
+			Problem: fmt.Sprintf("is produced to at %.0f bytes/s, %.0f%% of its produce.byte.rate of %d", rate, rate/float64(quota)*100, quota),
+			Fix:     "raise the topic's produce.byte.rate if its producers are meant to send this much, or find the client sending more than it should with jocko topic hot",
+		})
+	}
+	return diagnoses
+}
+
+// doctorDataDir checks the data dir's partitions' segments and indexes and
+// that their topic IDs match the cluster's, if its metadata's given. It
+// returns the number of segments.
+func doctorDataDir(dataDir string, md *protocol.MetadataResponse) (int, []*Diagnosis, error) {
+	dir := filepath.Join(dataDir, "data")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "read data dir failed")
+	}
+	clusterIDs := make(map[string]string)
+	if md != nil {
+		for _, t := range md.TopicMetadata {
+			if !t.TopicID.IsZero() {
+				clusterIDs[t.Topic] = uuid.UUID(t.TopicID).String()
+			}
+		}
+	}
+	var diagnoses []*Diagnosis
+	var segments int
+	// the IDs of the topics' partitions in the data dir, to find those that
+	// disagree without the cluster's
+	dirIDs := make(map[string]map[string][]string)
+	for _, file := range files {
+		i := strings.LastIndex(file.Name(), "-")
+		if !file.IsDir() || i < 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(file.Name()[i+1:]); err != nil {
+			continue
+		}
+		topic, path := file.Name()[:i], filepath.Join(dir, file.Name())
+		mismatches, err := commitlog.CheckLog(path)
+		if err != nil {
+			return 0, nil, errors.Wrapf(err, "check %s failed", file.Name())
+		}
+		for _, m := range mismatches {
+			diagnoses = append(diagnoses, &Diagnosis{
+				Check:   "partition " + file.Name(),
+				Problem: m.String(),
+				Fix:     segmentFix(m),
+			})
+		}
+		logs, _ := filepath.Glob(filepath.Join(path, "*"+commitlog.LogFileSuffix))
+		segments += len(logs)
+
+		p, err := ioutil.ReadFile(filepath.Join(path, partitionMetadataFile))
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSpace(strings.TrimPrefix(string(p), "topic_id:"))
+		if want, ok := clusterIDs[topic]; ok && want != id {
+			diagnoses = append(diagnoses, &Diagnosis{
+				Check:   "partition " + file.Name(),
+				Problem: fmt.Sprintf("has topic ID %s but the cluster's topic %s is %s", id, topic, want),
+				Fix:     "the data's from a deleted topic or another cluster, the broker moves it to the quarantine dir when it starts the replica, or point --data-dir at this cluster's data if it's the wrong dir",
+			})
+		}
+		if dirIDs[topic] == nil {
+			dirIDs[topic] = make(map[string][]string)
+		}
+		dirIDs[topic][id] = append(dirIDs[topic][id], file.Name())
+	}
+	if md == nil {
+		for topic, ids := range dirIDs {
+			if len(ids) < 2 {
+				continue
+			}
+			diagnoses = append(diagnoses, &Diagnosis{
+				Check:   "topic " + topic,
+				Problem: fmt.Sprintf("partitions have %d different topic IDs: %v", len(ids), ids),
+				Fix:     "some are from a deleted topic or another cluster, run the doctor with --broker-addr to find which, the broker replaces them when it starts their replicas",
+			})
+		}
+	}
+	return segments, diagnoses, nil
+}
+
+// segmentFix suggests a fix for the segment's problem.
+func segmentFix(m commitlog.SegmentMismatch) string {
+	switch {
+	case strings.HasPrefix(m.Reason, "torn"):
+		return "a write was interrupted, e.g. by a crash, the broker truncates it when it recovers the log on start"
+	case strings.HasPrefix(m.Reason, "index"):
+		return "stop the broker and delete the index file, it's rebuilt from the log"
+	case strings.HasPrefix(m.Reason, "leftover"):
+		return "stop the broker and delete the file"
+	default:
+		return "stop the broker and delete the partition's dir so the replica fetches it from its leader, or restore it from a backup"
+	}
+}
+
+// doctorOpenFiles checks the open file limit covers a log and index file per
+// segment, plus the min for connections.
+func doctorOpenFiles(segments int, min uint64) *Diagnosis {
+	limit, err := openFileLimit()
+	if err != nil {
+		return nil
+	}
+	want := uint64(2*segments) + min
+	if limit >= want {
+		return nil
+	}
+	return &Diagnosis{
+		Check:   "open file limit",
+		Problem: fmt.Sprintf("%d is under the %d the data dir's %d segments' files take plus %d for connections", limit, want, segments, min),
+		Fix:     "raise it with ulimit -n or systemd's LimitNOFILE, or cap the segment files kept open with --max-open-segment-files",
+	}
+}
@@ -0,0 +1,171 @@
+package jocko
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestDoctor(t *testing.T) {
+	req := require.New(t)
+	s, dir := NewTestServer(t, func(cfg *config.Config) {
+		cfg.Bootstrap = true
+		cfg.BootstrapExpect = 1
+		cfg.StartAsLeader = true
+	}, nil)
+	defer os.RemoveAll(dir)
+	req.NoError(s.Start(context.Background()))
+	defer s.Shutdown()
+
+	dialer := &Dialer{Resolver: &net.Resolver{}}
+	conn, err := dialer.Dial("tcp", s.Addr().String())
+	req.NoError(err)
+	defer conn.Close()
+	minISR := "2"
+	_, err = conn.CreateTopics(&protocol.CreateTopicRequests{Requests: []*protocol.CreateTopicRequest{{
+		Topic:             "test-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]*string{"min.insync.replicas": &minISR},
+	}}})
+	req.NoError(err)
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(filepath.Join(dir, "data", "test-topic-0", partitionMetadataFile)); err != nil {
+			r.Fatal(err)
+		}
+	})
+	// a partition left from a deleted topic of the same name
+	stale := filepath.Join(dir, "data", "test-topic-1")
+	req.NoError(os.MkdirAll(stale, 0755))
+	req.NoError(ioutil.WriteFile(filepath.Join(stale, partitionMetadataFile), []byte("topic_id: 01000000-0000-0000-0000-000000000000\n"), 0644))
+
+	diagnoses, err := Doctor(dialer, DoctorConfig{
+		BrokerAddr:   s.Addr().String(),
+		DataDir:      dir,
+		MaxClockSkew: time.Minute,
+	})
+	req.NoError(err)
+	req.Equal(2, len(diagnoses), "%v", diagnoses)
+	req.Equal("partition test-topic-0", diagnoses[0].Check)
+	req.Contains(diagnoses[0].Problem, "under its topic's min.insync.replicas of 2")
+	req.Equal("partition test-topic-1", diagnoses[1].Check)
+	req.Contains(diagnoses[1].Problem, "has topic ID 01000000-0000-0000-0000-000000000000 but the cluster's topic test-topic is")
+}
+
+func TestDoctorMembership(t *testing.T) {
+	req := require.New(t)
+	view := func(brokers []int32, topicID byte) *protocol.MetadataResponse {
+		md := &protocol.MetadataResponse{TopicMetadata: []*protocol.TopicMetadata{{Topic: "test", TopicID: protocol.UUID{topicID}}}}
+		for _, id := range brokers {
+			md.Brokers = append(md.Brokers, &protocol.Broker{NodeID: id})
+		}
+		return md
+	}
+	req.Empty(doctorMembership(map[int32]*protocol.MetadataResponse{
+		1: view([]int32{1, 2}, 1),
+		2: view([]int32{2, 1}, 1),
+	}))
+
+	// broker 3 joined another cluster with a topic of the same name
+	diagnoses := doctorMembership(map[int32]*protocol.MetadataResponse{
+		1: view([]int32{1, 2, 3}, 1),
+		2: view([]int32{1, 2, 3}, 1),
+		3: view([]int32{3}, 2),
+	})
+	req.Equal(2, len(diagnoses))
+	req.Equal("broker 3", diagnoses[0].Check)
+	req.Equal("sees brokers [3] but broker 1 sees [1 2 3]", diagnoses[0].Problem)
+	req.Contains(diagnoses[1].Problem, "has topic test as")
+}
+
+func TestDoctorISR(t *testing.T) {
+	req := require.New(t)
+	md := &protocol.MetadataResponse{TopicMetadata: []*protocol.TopicMetadata{{
+		Topic: "test",
+		PartitionMetadata: []*protocol.PartitionMetadata{
+			{PartitionID: 0, Leader: 1, Replicas: []int32{1, 2, 3}, ISR: []int32{1, 2}},
+			{PartitionID: 1, Leader: 2, Replicas: []int32{1, 2, 3}, ISR: []int32{2}},
+			{PartitionID: 2, Leader: 1, Replicas: []int32{1}, ISR: []int32{1}},
+		},
+	}, {
+		Topic:             "other",
+		PartitionMetadata: []*protocol.PartitionMetadata{{PartitionID: 0, Leader: 1, Replicas: []int32{1, 2}, ISR: []int32{1}}},
+	}}}
+	configs := map[string]map[string]string{
+		"test":  {"min.insync.replicas": "2"},
+		"other": {"min.insync.replicas": "1"},
+	}
+	diagnoses := doctorISR(md, configs)
+	req.Equal(2, len(diagnoses))
+	req.Equal("partition test-1", diagnoses[0].Check)
+	req.Contains(diagnoses[0].Fix, "replicas [1 3]")
+	req.Equal("partition test-2", diagnoses[1].Check)
+	req.Contains(diagnoses[1].Problem, "can never take acks=all produces")
+}
+
+func TestDoctorQuotas(t *testing.T) {
+	req := require.New(t)
+	traffic := []*protocol.DescribeTrafficResponse{
+		{Window: 10 * time.Second, Topics: []*protocol.TrafficStats{{Name: "busy", WindowBytesIn: 5000}, {Name: "idle", WindowBytesIn: 100}}},
+		{Window: 10 * time.Second, Topics: []*protocol.TrafficStats{{Name: "busy", WindowBytesIn: 4500}, {Name: "unlimited", WindowBytesIn: 1 << 30}}},
+	}
+	configs := map[string]map[string]string{
+		"busy":      {"produce.byte.rate": "1000"},
+		"idle":      {"produce.byte.rate": "1000"},
+		"unlimited": {"produce.byte.rate": "0"},
+	}
+	diagnoses := doctorQuotas(traffic, configs, 0.9)
+	req.Equal(1, len(diagnoses))
+	req.Equal("topic busy", diagnoses[0].Check)
+	req.Equal("is produced to at 950 bytes/s, 95% of its produce.byte.rate of 1000", diagnoses[0].Problem)
+	req.Empty(doctorQuotas(traffic, configs, 0))
+}
+
+func TestDoctorDataDir(t *testing.T) {
+	req := require.New(t)
+	dir, err := ioutil.TempDir("", "doctor")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+
+	id := func(b byte) string { return fmt.Sprintf("%02x000000-0000-0000-0000-000000000000", b) }
+	partition := func(name, topicID string) string {
+		path := filepath.Join(dir, "data", name)
+		req.NoError(os.MkdirAll(path, 0755))
+		req.NoError(ioutil.WriteFile(filepath.Join(path, partitionMetadataFile), []byte("topic_id: "+topicID+"\n"), 0644))
+		req.NoError(ioutil.WriteFile(filepath.Join(path, "00000000000000000000.log"), nil, 0644))
+		return path
+	}
+	partition("test-0", id(1))
+	partition("test-1", id(2))
+	torn := partition("other-0", id(3))
+	req.NoError(ioutil.WriteFile(filepath.Join(torn, "00000000000000000000.log"), []byte("torn"), 0644))
+
+	segments, diagnoses, err := doctorDataDir(dir, nil)
+	req.NoError(err)
+	req.Equal(3, segments)
+	req.Equal(2, len(diagnoses))
+	req.Equal("partition other-0", diagnoses[0].Check)
+	req.Contains(diagnoses[0].Problem, "torn message set")
+	req.Equal("topic test", diagnoses[1].Check)
+
+	// with the cluster's IDs the stale partition's found
+	md := &protocol.MetadataResponse{TopicMetadata: []*protocol.TopicMetadata{
+		{Topic: "test", TopicID: protocol.UUID{2}},
+		{Topic: "other", TopicID: protocol.UUID{3}},
+	}}
+	_, diagnoses, err = doctorDataDir(dir, md)
+	req.NoError(err)
+	req.Equal(2, len(diagnoses))
+	req.Equal("partition test-0", diagnoses[1].Check)
+	req.Equal("has topic ID "+id(1)+" but the cluster's topic test is "+id(2), diagnoses[1].Problem)
+}
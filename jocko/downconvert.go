@@ -0,0 +1,75 @@
+package jocko
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// fetchMessageFormat returns the newest message format version clients
+// fetching with the version can decode. Fetch v0 and v1 only have v0
+// messages, v1 messages came with fetch v2.
+func fetchMessageFormat(version int16) int8 {
+	if version < 2 {
+		return 0
+	}
+	return 1
+}
+
+// downConvert converts the fetched record set's messages to the message
+// format version magic for clients too old to decode them, rather than send
+// them bytes they can't decode. Message sets already in the format are sent
+// as they are. It returns ErrUnsupportedVersion if the record set needs
+// converting and the topic has message.downconversion.enable off.
+func (b *Broker) downConvert(topic *structs.Topic, recordSet []byte, magic int8) ([]byte, protocol.Error) {
+	start := time.Now()
+	sets := commitlog.MessageSets(recordSet)
+	var out []byte
+	var converted int
+	for i, ms := range sets {
+		c, ok, err := ms.DownConvert(magic)
+		if err != nil {
+			log.Error.Printf("broker/%d: down convert %s message set at offset %d error: %s", b.config.ID, topic.Topic, ms.Offset(), err)
+			return nil, protocol.ErrCorruptMessage.WithErr(err)
+		}
+		if !ok {
+			if out != nil {
+				out = append(out, ms...)
+			}
+			continue
+		}
+		if !topic.Config.GetBool("message.downconversion.enable") {
+			return nil, protocol.ErrUnsupportedVersion.WithErr(fmt.Errorf("topic %s has message down conversion disabled", topic.Topic))
+		}
+		if out == nil {
+			out = make([]byte, 0, len(recordSet))
+			for _, prev := range sets[:i] {
+				out = append(out, prev...)
+			}
+		}
+		out = append(out, c...)
+		converted++
+	}
+	if converted == 0 {
+		// left whole, including a partial message set at the end
+		return recordSet, protocol.ErrNone
+	}
+	b.traffic.recordDownConversion(topic.Topic, converted, time.Since(start))
+	return out, protocol.ErrNone
+}
+
+// recordDownConversion counts the message sets converted to an older message
+// format for the topic's fetches, and the time it took.
+func (t *trafficStats) recordDownConversion(topic string, sets int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.metrics == nil {
+		return
+	}
+	t.metrics.add(t.metrics.DownConversions, "down_conversions", float64(sets), "topic", topic)
+	t.metrics.add(t.metrics.DownConversionSeconds, "down_conversion_seconds", d.Seconds(), "topic", topic)
+}
@@ -0,0 +1,138 @@
+package jocko
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	networkReadFault  = "network read"
+	networkWriteFault = "network write"
+)
+
+var errInjectedFault = errors.New("injected fault")
+
+// faultInjector injects the faults set with AlterFaultInjection requests into
+// the broker's logs and client connections. It's only created for brokers
+// built with the faultinject tag, so release builds can't be slowed down by
+// mistake, and a nil *faultInjector injects nothing.
+type faultInjector struct {
+	storage *commitlog.Failpoints
+
+	mu      sync.RWMutex
+	network map[string]commitlog.Fault
+}
+
+func (f *faultInjector) failpoints() *commitlog.Failpoints {
+	if f == nil {
+		return nil
+	}
+	return f.storage
+}
+
+// set injects the fault at the point, or removes the point's fault if the fault
+// has no delay or error.
+func (f *faultInjector) set(point string, fault commitlog.Fault) protocol.Error {
+	remove := fault.Delay <= 0 && fault.Err == nil
+	switch point {
+	case networkReadFault, networkWriteFault:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if remove {
+			delete(f.network, point)
+		} else {
+			f.network[point] = fault
+		}
+	case string(commitlog.SegmentWriteFailpoint), string(commitlog.SegmentSyncFailpoint), string(commitlog.SegmentReadFailpoint),
+		string(commitlog.IndexWriteFailpoint), string(commitlog.IndexSyncFailpoint):
+		if remove {
+			f.storage.Disable(commitlog.Failpoint(point))
+		} else {
+			f.storage.Enable(commitlog.Failpoint(point), fault)
+		}
+	default:
+		return protocol.ErrInvalidRequest
+	}
+	return protocol.ErrNone
+}
+
+// inject waits out the network fault at the point, if there is one, and returns
+// its error.
+func (f *faultInjector) inject(point string) error {
+	f.mu.RLock()
+	fault, ok := f.network[point]
+	f.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	return fault.Err
+}
+
+// faultConn is a client connection with the broker's network faults injected
+// into its reads and writes.
+type faultConn struct {
+	net.Conn
+	faults *faultInjector
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	if err := c.faults.inject(networkReadFault); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if err := c.faults.inject(networkWriteFault); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// wrapConn returns the connection with the broker's network faults injected.
+func (b *Broker) wrapConn(conn net.Conn) net.Conn {
+	if b.faults == nil {
+		return conn
+	}
+	return &faultConn{Conn: conn, faults: b.faults}
+}
+
+func (b *Broker) handleAlterFaultInjection(ctx *Context, req *protocol.AlterFaultInjectionRequest) *protocol.AlterFaultInjectionResponse {
+	sp := span(ctx, b.tracer, "alter fault injection")
+	defer sp.Finish()
+	res := &protocol.AlterFaultInjectionResponse{
+		Faults: make([]*protocol.AlterFaultInjectionResult, len(req.Faults)),
+	}
+	res.APIVersion = req.Version()
+	authorized := b.authorized(ctx, policy.AlterOperation, policy.ClusterResource, "")
+	for i, f := range req.Faults {
+		err := protocol.ErrInvalidRequest
+		if !authorized {
+			err = protocol.ErrClusterAuthorizationFailed
+		} else if b.faults != nil {
+			fault := commitlog.Fault{Delay: f.Delay, Count: int(f.Count)}
+			if f.Error {
+				fault.Err = errInjectedFault
+			}
+			err = b.faults.set(f.Point, fault)
+		}
+		if err == protocol.ErrNone {
+			log.Info.Printf("broker/%d: injecting fault at %s: delay: %s, error: %t, count: %d", b.config.ID, f.Point, f.Delay, f.Error, f.Count)
+		}
+		res.Faults[i] = &protocol.AlterFaultInjectionResult{
+			Point:     f.Point,
+			ErrorCode: err.Code(),
+		}
+	}
+	return res
+}
@@ -0,0 +1,8 @@
+//go:build !faultinject
+// +build !faultinject
+
+package jocko
+
+func newFaultInjector() *faultInjector {
+	return nil
+}
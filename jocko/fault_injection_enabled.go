@@ -0,0 +1,15 @@
+//go:build faultinject
+// +build faultinject
+
+package jocko
+
+import (
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		storage: commitlog.NewFailpoints(),
+		network: make(map[string]commitlog.Fault),
+	}
+}
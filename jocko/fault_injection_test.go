@@ -0,0 +1,47 @@
+package jocko
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestFaultInjector(t *testing.T) {
+	// what newFaultInjector returns with the faultinject tag
+	faults := &faultInjector{
+		storage: commitlog.NewFailpoints(),
+		network: make(map[string]commitlog.Fault),
+	}
+	b := &Broker{faults: faults}
+
+	require.Equal(t, protocol.ErrInvalidRequest, faults.set("disk", commitlog.Fault{Delay: time.Second}))
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	conn := b.wrapConn(server)
+	go client.Write([]byte("x"))
+
+	require.Equal(t, protocol.ErrNone, faults.set(networkReadFault, commitlog.Fault{Delay: 50 * time.Millisecond}))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	require.Equal(t, protocol.ErrNone, faults.set(networkReadFault, commitlog.Fault{Err: errInjectedFault}))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, errInjectedFault, err)
+
+	// no delay or error removes the fault
+	require.Equal(t, protocol.ErrNone, faults.set(networkReadFault, commitlog.Fault{}))
+	go client.Write([]byte("x"))
+	_, err = conn.Read(make([]byte, 1))
+	require.NoError(t, err)
+
+	// brokers built without the tag don't wrap their connections
+	require.Equal(t, server, (&Broker{}).wrapConn(server))
+}
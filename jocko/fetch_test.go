@@ -0,0 +1,78 @@
+package jocko
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestFetchResponseMaxBytes(t *testing.T) {
+	req := require.New(t)
+	dir, err := ioutil.TempDir("", "fetch")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+
+	b := &Broker{
+		config:        &config.Config{ID: 1},
+		tracer:        stdopentracing.NoopTracer{},
+		replicaLookup: NewReplicaLookup(),
+		verifier:      newFetchVerifier(0),
+		traffic:       newTrafficStats(),
+	}
+	var size int
+	for _, id := range []int32{0, 1} {
+		l, err := commitlog.New(commitlog.Options{Path: filepath.Join(dir, "test", string('0'+id)), MaxSegmentBytes: 1024, MaxLogBytes: -1})
+		req.NoError(err)
+		defer l.Close()
+		msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")})
+		req.NoError(err)
+		ms := commitlog.NewMessageSet(0, msg)
+		_, err = l.Append(ms)
+		req.NoError(err)
+		size = len(ms)
+		b.replicaLookup.AddReplica(&Replica{Partition: structs.Partition{Topic: "test", ID: id, Leader: 1}, Log: l})
+	}
+	ctx := &Context{parent: context.Background(), client: &ClientInfo{}}
+	fetch := func(version int16, maxBytes int32) [][]byte {
+		res := b.handleFetch(ctx, &protocol.FetchRequest{
+			APIVersion:  version,
+			ReplicaID:   -1,
+			MaxWaitTime: time.Second,
+			MinBytes:    1,
+			MaxBytes:    maxBytes,
+			Topics: []*protocol.FetchTopic{{Topic: "test", Partitions: []*protocol.FetchPartition{
+				{Partition: 0, MaxBytes: 1024},
+				{Partition: 1, MaxBytes: 1024},
+			}}},
+		})
+		var sets [][]byte
+		for _, p := range res.Responses[0].PartitionResponses {
+			req.Equal(protocol.ErrNone.Code(), p.ErrorCode)
+			sets = append(sets, p.RecordSet)
+		}
+		return sets
+	}
+
+	// the first partition fills the response
+	sets := fetch(3, int32(size))
+	req.Len(sets[0], size)
+	req.Empty(sets[1])
+
+	sets = fetch(3, int32(2*size))
+	req.Len(sets[0], size)
+	req.Len(sets[1], size)
+
+	// fetches before v3 don't have the response's max bytes
+	sets = fetch(2, int32(size))
+	req.Len(sets[1], size)
+}
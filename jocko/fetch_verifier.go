@@ -0,0 +1,67 @@
+package jocko
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+// fetchVerifier checks the CRCs of a sample of the fetched record sets as
+// they're read from disk, so silent disk corruption's caught, and alerted on,
+// by the broker rather than found by consumers failing to decode what they
+// fetched.
+type fetchVerifier struct {
+	mu      sync.Mutex
+	rate    float64
+	rand    *rand.Rand
+	metrics *Metrics
+}
+
+// newFetchVerifier returns a verifier checking the fraction of record sets
+// given by rate, all of them if it's 1 and none if it's 0.
+func newFetchVerifier(rate float64) *fetchVerifier {
+	return &fetchVerifier{
+		rate: rate,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// verify checks the record set's message sets' CRCs if it's picked for the
+// sample. It returns the record set up to its first corrupt message set and
+// that set's offset, or the whole record set and -1 if none are corrupt or it
+// wasn't checked. A partial message set at the end isn't corrupt, it's what
+// the fetch's max bytes cut off.
+func (v *fetchVerifier) verify(recordSet []byte) ([]byte, int64) {
+	if v.rate <= 0 {
+		return recordSet, -1
+	}
+	if v.rate < 1 {
+		v.mu.Lock()
+		picked := v.rand.Float64() < v.rate
+		v.mu.Unlock()
+		if !picked {
+			return recordSet, -1
+		}
+	}
+	var n int
+	for _, ms := range commitlog.MessageSets(recordSet) {
+		if !ms.Verify() {
+			return recordSet[:n], ms.Offset()
+		}
+		n += len(ms)
+	}
+	return recordSet, -1
+}
+
+// corrupt counts a corrupt message set found fetching the partition.
+func (v *fetchVerifier) corrupt(topic string, partition int32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.metrics == nil {
+		return
+	}
+	v.metrics.add(v.metrics.FetchCorruptions, "fetch_corruptions", 1, "topic", topic, "partition", strconv.Itoa(int(partition)))
+}
@@ -0,0 +1,41 @@
+package jocko
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestFetchVerifier(t *testing.T) {
+	req := require.New(t)
+	var recordSet []byte
+	var sets []commitlog.MessageSet
+	for offset := uint64(0); offset < 3; offset++ {
+		msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")})
+		req.NoError(err)
+		ms := commitlog.NewMessageSet(offset, msg)
+		sets = append(sets, ms)
+		recordSet = append(recordSet, ms...)
+	}
+	v := newFetchVerifier(1)
+
+	// a partial message set at the end isn't corrupt
+	partial := recordSet[:len(recordSet)-3]
+	valid, offset := v.verify(partial)
+	req.Equal(int64(-1), offset)
+	req.Equal(partial, valid)
+
+	// flip a byte of the second set's value
+	recordSet[len(sets[0])+len(sets[1])-1] ^= 0xff
+	valid, offset = v.verify(recordSet)
+	req.Equal(int64(1), offset)
+	req.Equal([]byte(sets[0]), valid)
+
+	// verifying's off by default
+	valid, offset = newFetchVerifier(0).verify(recordSet)
+	req.Equal(int64(-1), offset)
+	req.Equal(recordSet, valid)
+}
@@ -2,6 +2,7 @@ package fsm
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/travisjeffery/jocko/jocko/structs"
 	"github.com/travisjeffery/jocko/log"
@@ -14,7 +15,31 @@ func init() {
 	registerCommand(structs.DeregisterTopicRequestType, (*FSM).applyDeregisterTopic)
 	registerCommand(structs.RegisterPartitionRequestType, (*FSM).applyRegisterPartition)
 	registerCommand(structs.DeregisterPartitionRequestType, (*FSM).applyDeregisterPartition)
+	registerCommand(structs.SetPartitionReadOnlyRequestType, (*FSM).applySetPartitionReadOnly)
+	registerCommand(structs.SetTopicConfigRequestType, (*FSM).applySetTopicConfig)
 	registerCommand(structs.RegisterGroupRequestType, (*FSM).applyRegisterGroup)
+	registerCommand(structs.BatchRequestType, (*FSM).applyBatch)
+	registerCommand(structs.InitProducerRequestType, (*FSM).applyInitProducer)
+	registerCommand(structs.RegisterProducerRequestType, (*FSM).applyRegisterProducer)
+	registerCommand(structs.RegisterDelegationTokenRequestType, (*FSM).applyRegisterDelegationToken)
+	registerCommand(structs.DeregisterDelegationTokenRequestType, (*FSM).applyDeregisterDelegationToken)
+}
+
+// applyBatch applies the requests in the batch in order at the same index, in
+// one transaction so a batch that fails leaves the state as it was. The caller
+// can retry it, which is safe since the appliers are idempotent.
+func (c *FSM) applyBatch(buf []byte, index uint64) interface{} {
+	var req structs.BatchRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := c.state.EnsureBatch(index, &req); err != nil {
+		log.Error.Printf("EnsureBatch error: %s", err)
+		return err
+	}
+
+	return nil
 }
 
 func (c *FSM) applyRegisterGroup(buf []byte, index uint64) interface{} {
@@ -31,6 +56,138 @@ func (c *FSM) applyRegisterGroup(buf []byte, index uint64) interface{} {
 	return nil
 }
 
+// applyInitProducer starts a new session for the producer. Producers without a
+// transactional ID get a new producer ID each time, they're the index of the
+// log entry so they're unique. A producer with one keeps its producer ID and
+// gets the next epoch, or a new ID once the epoch's run out, and the partitions
+// of its previous session's ongoing transaction are returned to be aborted, or
+// committed along with its offsets if the session was committing it. The
+// transaction's kept in the new session until the broker's written its
+// markers and cleared it.
+func (c *FSM) applyInitProducer(buf []byte, index uint64) interface{} {
+	var req structs.InitProducerRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	res := &structs.InitProducerResponse{
+		Producer: structs.Producer{
+			TransactionalID:    req.TransactionalID,
+			ProducerID:         int64(index),
+			TransactionTimeout: req.TransactionTimeout,
+		},
+	}
+	if req.TransactionalID == "" {
+		return res
+	}
+	_, existing, err := c.state.GetProducer(req.TransactionalID)
+	if err != nil {
+		log.Error.Printf("GetProducer error: %s", err)
+		return err
+	}
+	if existing != nil {
+		if existing.Committing {
+			res.Committed = existing.Partitions
+			res.Producer.Offsets = existing.Offsets
+		} else {
+			res.Aborted = existing.Partitions
+		}
+		res.Producer.Partitions = existing.Partitions
+		res.Producer.Committing = existing.Committing
+		res.Producer.Aborting = !existing.Committing && len(existing.Partitions) > 0
+		if existing.ProducerEpoch < math.MaxInt16 {
+			res.Producer.ProducerID = existing.ProducerID
+			res.Producer.ProducerEpoch = existing.ProducerEpoch + 1
+		}
+	}
+	if err := c.state.EnsureProducer(index, &res.Producer); err != nil {
+		log.Error.Printf("EnsureProducer error: %s", err)
+		return err
+	}
+	return res
+}
+
+// applyRegisterProducer updates the producer's session if it hasn't been
+// modified since the session in the request was read, so an update made from
+// a stale read, e.g. by a fenced instance of the producer, doesn't overwrite
+// a newer one. A partition's only in one producer's transaction at a time, so
+// two producers can't both add it.
+func (c *FSM) applyRegisterProducer(buf []byte, index uint64) interface{} {
+	var req structs.RegisterProducerRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	_, existing, err := c.state.GetProducer(req.Producer.TransactionalID)
+	if err != nil {
+		log.Error.Printf("GetProducer error: %s", err)
+		return err
+	}
+	var modifyIndex uint64
+	if existing != nil {
+		modifyIndex = existing.ModifyIndex
+	}
+	if req.Producer.ModifyIndex != modifyIndex {
+		return ErrProducerModified
+	}
+	if len(req.Producer.Partitions) > 0 {
+		_, producers, err := c.state.GetProducers()
+		if err != nil {
+			log.Error.Printf("GetProducers error: %s", err)
+			return err
+		}
+		for _, other := range producers {
+			if other.TransactionalID == req.Producer.TransactionalID {
+				continue
+			}
+			for topic, partitions := range req.Producer.Partitions {
+				for _, p := range partitions {
+					for _, o := range other.Partitions[topic] {
+						if o == p {
+							return ErrPartitionInTransaction
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if err := c.state.EnsureProducer(index, &req.Producer); err != nil {
+		log.Error.Printf("EnsureProducer error: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *FSM) applyRegisterDelegationToken(buf []byte, index uint64) interface{} {
+	var req structs.RegisterDelegationTokenRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := c.state.EnsureDelegationToken(index, &req.Token); err != nil {
+		log.Error.Printf("EnsureDelegationToken error: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *FSM) applyDeregisterDelegationToken(buf []byte, index uint64) interface{} {
+	var req structs.DeregisterDelegationTokenRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := c.state.DeleteDelegationToken(index, req.TokenID); err != nil {
+		log.Error.Printf("DeleteDelegationToken error: %s", err)
+		return err
+	}
+
+	return nil
+}
+
 func (c *FSM) applyRegisterNode(buf []byte, index uint64) interface{} {
 	var req structs.RegisterNodeRequest
 	if err := structs.Decode(buf, &req); err != nil {
@@ -93,7 +250,31 @@ func (c *FSM) applyRegisterPartition(buf []byte, index uint64) interface{} {
 		panic(fmt.Errorf("failed to decode request: %v", err))
 	}
 
-	if err := c.state.EnsurePartition(index, &req.Partition); err != nil {
+	if err := c.state.RegisterPartition(index, &req.Partition); err != nil {
+		log.Error.Printf("RegisterPartition error: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *FSM) applySetPartitionReadOnly(buf []byte, index uint64) interface{} {
+	var req structs.SetPartitionReadOnlyRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	_, existing, err := c.state.GetPartition(req.Topic, req.Partition)
+	if err != nil {
+		log.Error.Printf("GetPartition error: %s", err)
+		return err
+	}
+	if existing == nil {
+		return ErrUnknownPartition
+	}
+	partition := *existing
+	partition.ReadOnly = req.ReadOnly
+	if err := c.state.EnsurePartition(index, &partition); err != nil {
 		log.Error.Printf("EnsurePartition error: %s", err)
 		return err
 	}
@@ -101,6 +282,30 @@ func (c *FSM) applyRegisterPartition(buf []byte, index uint64) interface{} {
 	return nil
 }
 
+func (c *FSM) applySetTopicConfig(buf []byte, index uint64) interface{} {
+	var req structs.SetTopicConfigRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	_, existing, err := c.state.GetTopic(req.Topic)
+	if err != nil {
+		log.Error.Printf("GetTopic error: %s", err)
+		return err
+	}
+	if existing == nil {
+		return ErrUnknownTopic
+	}
+	topic := *existing
+	topic.Config = req.Config
+	if err := c.state.EnsureTopic(index, &topic); err != nil {
+		log.Error.Printf("EnsureTopic error: %s", err)
+		return err
+	}
+
+	return nil
+}
+
 func (c *FSM) applyDeregisterPartition(buf []byte, index uint64) interface{} {
 	var req structs.DeregisterPartitionRequest
 	if err := structs.Decode(buf, &req); err != nil {
@@ -69,6 +69,41 @@ func TestRegisterTopic(t *testing.T) {
 	}
 }
 
+func TestSetTopicConfig(t *testing.T) {
+	fsm, err := New(stdopentracing.GlobalTracer())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config := structs.NewTopicConfig()
+	config.SetValue("retention.ms", int64(1000))
+	buf, err := structs.Encode(structs.SetTopicConfigRequestType, structs.SetTopicConfigRequest{Topic: "topic1", Config: config})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != ErrUnknownTopic {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	if err := fsm.state.EnsureTopic(1, &structs.Topic{Topic: "topic1", Partitions: map[int32][]int32{0: {1}}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp := fsm.Apply(makeLog(buf)); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, topic, err := fsm.state.GetTopic("topic1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if topic.Config.GetInt64("retention.ms") != 1000 {
+		t.Fatalf("bad config: %v", topic.Config.GetValue("retention.ms"))
+	}
+	if len(topic.Partitions) != 1 {
+		t.Fatalf("bad partitions: %v", topic.Partitions)
+	}
+}
+
 func TestRegisterPartition(t *testing.T) {
 	fsm, err := New(stdopentracing.GlobalTracer())
 	if err != nil {
@@ -131,6 +166,108 @@ func TestRegisterGroup(t *testing.T) {
 	}
 }
 
+func TestBatch(t *testing.T) {
+	fsm, err := New(stdopentracing.GlobalTracer())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	batch := new(structs.BatchRequest)
+	if err := batch.Add(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+		Topic: structs.Topic{Topic: "test-topic", Partitions: map[int32][]int32{0: {1}, 1: {1}}},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, id := range []int32{0, 1} {
+		if err := batch.Add(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{
+			Partition: structs.Partition{ID: id, Partition: id, Topic: "test-topic", Leader: 1},
+		}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	buf, err := structs.Encode(structs.BatchRequestType, batch)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, topic, err := fsm.state.GetTopic("test-topic")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if topic == nil {
+		t.Fatalf("topic not found")
+	}
+	for _, id := range []int32{0, 1} {
+		_, partition, err := fsm.state.GetPartition("test-topic", id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if partition == nil {
+			t.Fatalf("partition not found: %d", id)
+		}
+	}
+
+	// re-applying the same batch at a later index is a no-op
+	l := makeLog(buf)
+	l.Index = 2
+	if resp := fsm.Apply(l); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	_, partition, err := fsm.state.GetPartition("test-topic", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if partition.ModifyIndex != 1 {
+		t.Fatalf("bad index: %d", partition.ModifyIndex)
+	}
+}
+
+func TestBatchFailed(t *testing.T) {
+	fsm, err := New(stdopentracing.GlobalTracer())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.state.EnsureTopic(1, &structs.Topic{Topic: "test-topic", ID: "a"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// the topic's id doesn't match so the partition registered before it
+	// isn't applied either
+	batch := new(structs.BatchRequest)
+	if err := batch.Add(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{
+		Partition: structs.Partition{ID: 0, Partition: 0, Topic: "test-topic", Leader: 1},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := batch.Add(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+		Topic: structs.Topic{Topic: "test-topic", ID: "b", Partitions: map[int32][]int32{0: {1}}},
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf, err := structs.Encode(structs.BatchRequestType, batch)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l := makeLog(buf)
+	l.Index = 2
+	if resp := fsm.Apply(l); resp == nil {
+		t.Fatalf("expected error")
+	}
+
+	_, partition, err := fsm.state.GetPartition("test-topic", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if partition != nil {
+		t.Fatalf("partition registered: %v", partition)
+	}
+}
+
 func makeLog(buf []byte) *raft.Log {
 	return &raft.Log{
 		Index: 1,
@@ -139,3 +276,103 @@ func makeLog(buf []byte) *raft.Log {
 		Data:  buf,
 	}
 }
+
+func TestInitProducer(t *testing.T) {
+	fsm, err := New(stdopentracing.GlobalTracer())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	apply := func(index uint64, msgType structs.MessageType, req interface{}) interface{} {
+		buf, err := structs.Encode(msgType, req)
+		if err != nil {
+			panic(err)
+		}
+		return fsm.Apply(&raft.Log{Index: index, Data: buf})
+	}
+
+	res := apply(1, structs.InitProducerRequestType, structs.InitProducerRequest{TransactionalID: "txn"}).(*structs.InitProducerResponse)
+	if res.Producer.ProducerID != 1 || res.Producer.ProducerEpoch != 0 {
+		t.Fatalf("bad producer: %v", res.Producer)
+	}
+
+	producer := res.Producer
+	producer.Partitions = map[string][]int32{"topic": {0, 1}}
+	if resp := apply(2, structs.RegisterProducerRequestType, structs.RegisterProducerRequest{Producer: producer}); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// initializing again bumps the epoch and aborts the ongoing transaction
+	res = apply(3, structs.InitProducerRequestType, structs.InitProducerRequest{TransactionalID: "txn"}).(*structs.InitProducerResponse)
+	if res.Producer.ProducerID != 1 || res.Producer.ProducerEpoch != 1 {
+		t.Fatalf("bad producer: %v", res.Producer)
+	}
+	if len(res.Aborted["topic"]) != 2 {
+		t.Fatalf("bad aborted: %v", res.Aborted)
+	}
+	_, stored, err := fsm.state.GetProducer("txn")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// the transaction's kept until its markers are written
+	if stored.ProducerEpoch != 1 || len(stored.Partitions["topic"]) != 2 || !stored.Aborting {
+		t.Fatalf("bad stored producer: %v", stored)
+	}
+	// a session registered from a stale read doesn't overwrite the newer one
+	if resp := apply(4, structs.RegisterProducerRequestType, structs.RegisterProducerRequest{Producer: producer}); resp != ErrProducerModified {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	// producers without a transactional id get new ids
+	res = apply(5, structs.InitProducerRequestType, structs.InitProducerRequest{}).(*structs.InitProducerResponse)
+	if res.Producer.ProducerID != 5 {
+		t.Fatalf("bad producer: %v", res.Producer)
+	}
+
+	// a transaction left partway through committing is committed
+	producer = *stored
+	producer.Partitions = map[string][]int32{"topic": {1}}
+	producer.Offsets = []structs.GroupOffset{{Group: "group", Topic: "topic", Partition: 1, Offset: 10}}
+	producer.Committing = true
+	producer.Aborting = false
+	if resp := apply(6, structs.RegisterProducerRequestType, structs.RegisterProducerRequest{Producer: producer}); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	res = apply(7, structs.InitProducerRequestType, structs.InitProducerRequest{TransactionalID: "txn"}).(*structs.InitProducerResponse)
+	if len(res.Aborted) != 0 || len(res.Committed["topic"]) != 1 {
+		t.Fatalf("bad committed: %v, aborted: %v", res.Committed, res.Aborted)
+	}
+	// its offsets are still to be committed too
+	if len(res.Producer.Offsets) != 1 || res.Producer.Offsets[0].Offset != 10 {
+		t.Fatalf("bad offsets: %v", res.Producer.Offsets)
+	}
+}
+
+func TestRegisterProducerConflict(t *testing.T) {
+	fsm, err := New(stdopentracing.GlobalTracer())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	apply := func(index uint64, msgType structs.MessageType, req interface{}) interface{} {
+		buf, err := structs.Encode(msgType, req)
+		if err != nil {
+			panic(err)
+		}
+		return fsm.Apply(&raft.Log{Index: index, Data: buf})
+	}
+
+	a := apply(1, structs.InitProducerRequestType, structs.InitProducerRequest{TransactionalID: "a"}).(*structs.InitProducerResponse).Producer
+	b := apply(2, structs.InitProducerRequestType, structs.InitProducerRequest{TransactionalID: "b"}).(*structs.InitProducerResponse).Producer
+	a.Partitions = map[string][]int32{"topic": {0}}
+	if resp := apply(3, structs.RegisterProducerRequestType, structs.RegisterProducerRequest{Producer: a}); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+	// the partition's in a's transaction until it ends
+	b.Partitions = map[string][]int32{"topic": {1, 0}}
+	if resp := apply(4, structs.RegisterProducerRequestType, structs.RegisterProducerRequest{Producer: b}); resp != ErrPartitionInTransaction {
+		t.Fatalf("resp: %v", resp)
+	}
+	b.Partitions = map[string][]int32{"topic": {1}}
+	if resp := apply(5, structs.RegisterProducerRequestType, structs.RegisterProducerRequest{Producer: b}); resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+}
@@ -1,11 +1,14 @@
 package fsm
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	memdb "github.com/hashicorp/go-memdb"
 	"github.com/hashicorp/raft"
@@ -18,6 +21,19 @@ import (
 
 var (
 	fsmVerboseLogs bool
+
+	// ErrProducerModified is returned when a producer's session is
+	// registered with a different modify index than the stored session's.
+	ErrProducerModified = errors.New("producer modified")
+	// ErrPartitionInTransaction is returned when a producer's session is
+	// registered with a partition in another producer's transaction.
+	ErrPartitionInTransaction = errors.New("partition in another transaction")
+	// ErrUnknownPartition is returned when a partition that isn't registered
+	// is set read-only.
+	ErrUnknownPartition = errors.New("unknown partition")
+	// ErrUnknownTopic is returned when a topic that isn't registered has its
+	// config set.
+	ErrUnknownTopic = errors.New("unknown topic")
 )
 
 type command func(buf []byte, index uint64) interface{}
@@ -49,6 +65,9 @@ type FSM struct {
 	state     *Store
 	tracer    opentracing.Tracer
 	nodeID    NodeID
+	// applied is the index of the last log applied to the state, accessed
+	// atomically.
+	applied uint64
 }
 
 // New returns a new FSM instance.
@@ -89,7 +108,15 @@ func (c *FSM) State() *Store {
 	return c.state
 }
 
+// AppliedIndex returns the index of the last log applied to the state. Unlike
+// raft's applied index it's only updated once the log's been applied, so
+// reads of the state after waiting for an index see the log's changes.
+func (c *FSM) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&c.applied)
+}
+
 func (c *FSM) Apply(l *raft.Log) interface{} {
+	defer atomic.StoreUint64(&c.applied, l.Index)
 	buf := l.Data
 	msgType := structs.MessageType(buf[0])
 	if fn := c.apply[msgType]; fn != nil {
@@ -140,6 +167,7 @@ func (c *FSM) Restore(old io.ReadCloser) error {
 	oldState := c.state
 	c.state = newState
 	c.stateLock.Unlock()
+	atomic.StoreUint64(&c.applied, header.LastIndex)
 
 	oldState.Abandon()
 	return nil
@@ -380,11 +408,6 @@ func (s *Store) EnsureTopic(idx uint64, topic *structs.Topic) error {
 	sp := s.tracer.StartSpan("store: ensure topic")
 	s.vlog(sp, "topic", topic)
 	sp.SetTag("node id", s.nodeID)
-
-	if topic.Config == nil {
-		topic.Config = structs.NewTopicConfig()
-	}
-
 	defer sp.Finish()
 
 	tx := s.db.Txn(true)
@@ -397,6 +420,10 @@ func (s *Store) EnsureTopic(idx uint64, topic *structs.Topic) error {
 }
 
 func (s *Store) ensureTopicTxn(tx *memdb.Txn, idx uint64, topic *structs.Topic) error {
+	if topic.Config == nil {
+		topic.Config = structs.NewTopicConfig()
+	}
+
 	var t *structs.Topic
 	existing, err := tx.First("topics", "id", topic.Topic)
 	if err != nil {
@@ -407,6 +434,20 @@ func (s *Store) ensureTopicTxn(tx *memdb.Txn, idx uint64, topic *structs.Topic)
 		t = existing.(*structs.Topic)
 	}
 
+	if t != nil && t.ID != "" {
+		if topic.ID == "" {
+			topic.ID = t.ID
+		} else if topic.ID != t.ID {
+			return fmt.Errorf("topic %s already exists with id %s", topic.Topic, t.ID)
+		}
+	}
+
+	if t != nil && topicEqual(t, topic) {
+		// nothing changed, skip the write so re-applying is a no-op
+		topic.RaftIndex = t.RaftIndex
+		return nil
+	}
+
 	if t != nil {
 		topic.CreateIndex = t.CreateIndex
 		topic.ModifyIndex = idx
@@ -448,6 +489,28 @@ func (s *Store) GetTopic(id string) (uint64, *structs.Topic, error) {
 	return idx, nil, nil
 }
 
+// GetTopicByID is used to get the topic with the given immutable ID.
+func (s *Store) GetTopicByID(id string) (uint64, *structs.Topic, error) {
+	sp := s.tracer.StartSpan("store: get topic by id")
+	sp.LogKV("id", id)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	idx := maxIndexTxn(tx, "topics")
+
+	topic, err := tx.First("topics", "topic_id", id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("topic lookup failed: %s", err)
+	}
+	if topic != nil {
+		return idx, topic.(*structs.Topic), nil
+	}
+
+	return idx, nil, nil
+}
+
 func (s *Store) GetTopics() (uint64, []*structs.Topic, error) {
 	sp := s.tracer.StartSpan("store: get topics")
 	sp.SetTag("node id", s.nodeID)
@@ -648,6 +711,182 @@ func (s *Store) deleteGroupTxn(tx *memdb.Txn, idx uint64, id string) error {
 	return nil
 }
 
+// EnsureProducer is used to upsert producer sessions.
+func (s *Store) EnsureProducer(idx uint64, producer *structs.Producer) error {
+	sp := s.tracer.StartSpan("store: ensure producer")
+	s.vlog(sp, "producer", producer)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	existing, err := tx.First("producers", "id", producer.TransactionalID)
+	if err != nil {
+		return fmt.Errorf("producer lookup failed: %s", err)
+	}
+	if existing != nil {
+		producer.CreateIndex = existing.(*structs.Producer).CreateIndex
+	} else {
+		producer.CreateIndex = idx
+	}
+	producer.ModifyIndex = idx
+
+	if err := tx.Insert("producers", producer); err != nil {
+		return fmt.Errorf("failed inserting producer: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"producers", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	tx.Commit()
+	return nil
+}
+
+// GetProducer is used to get the session of the producer with the
+// transactional ID.
+func (s *Store) GetProducer(transactionalID string) (uint64, *structs.Producer, error) {
+	sp := s.tracer.StartSpan("store: get producer")
+	sp.LogKV("transactional id", transactionalID)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	idx := maxIndexTxn(tx, "producers")
+
+	producer, err := tx.First("producers", "id", transactionalID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("producer lookup failed: %s", err)
+	}
+	if producer != nil {
+		return idx, producer.(*structs.Producer), nil
+	}
+	return idx, nil, nil
+}
+
+// GetProducers is used to get the sessions of the transactional producers.
+func (s *Store) GetProducers() (uint64, []*structs.Producer, error) {
+	sp := s.tracer.StartSpan("store: get producers")
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	idx := maxIndexTxn(tx, "producers")
+	it, err := tx.Get("producers", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("producer lookup failed: %s", err)
+	}
+	var producers []*structs.Producer
+	for next := it.Next(); next != nil; next = it.Next() {
+		producers = append(producers, next.(*structs.Producer))
+	}
+	return idx, producers, nil
+}
+
+// EnsureDelegationToken is used to upsert delegation tokens.
+func (s *Store) EnsureDelegationToken(idx uint64, token *structs.DelegationToken) error {
+	sp := s.tracer.StartSpan("store: ensure delegation token")
+	s.vlog(sp, "delegation token", token)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	existing, err := tx.First("delegation_tokens", "id", token.TokenID)
+	if err != nil {
+		return fmt.Errorf("delegation token lookup failed: %s", err)
+	}
+	if existing != nil {
+		token.CreateIndex = existing.(*structs.DelegationToken).CreateIndex
+	} else {
+		token.CreateIndex = idx
+	}
+	token.ModifyIndex = idx
+
+	if err := tx.Insert("delegation_tokens", token); err != nil {
+		return fmt.Errorf("failed inserting delegation token: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"delegation_tokens", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	tx.Commit()
+	return nil
+}
+
+// GetDelegationToken is used to get the delegation token with the ID.
+func (s *Store) GetDelegationToken(id string) (uint64, *structs.DelegationToken, error) {
+	sp := s.tracer.StartSpan("store: get delegation token")
+	sp.LogKV("token id", id)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	idx := maxIndexTxn(tx, "delegation_tokens")
+
+	token, err := tx.First("delegation_tokens", "id", id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("delegation token lookup failed: %s", err)
+	}
+	if token != nil {
+		return idx, token.(*structs.DelegationToken), nil
+	}
+	return idx, nil, nil
+}
+
+// GetDelegationTokens is used to get every delegation token.
+func (s *Store) GetDelegationTokens() (uint64, []*structs.DelegationToken, error) {
+	sp := s.tracer.StartSpan("store: get delegation tokens")
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	idx := maxIndexTxn(tx, "delegation_tokens")
+
+	it, err := tx.Get("delegation_tokens", "id")
+	if err != nil {
+		return 0, nil, fmt.Errorf("delegation token lookup failed: %s", err)
+	}
+
+	var tokens []*structs.DelegationToken
+	for next := it.Next(); next != nil; next = it.Next() {
+		tokens = append(tokens, next.(*structs.DelegationToken))
+	}
+
+	return idx, tokens, nil
+}
+
+// DeleteDelegationToken is used to delete the delegation token with the ID.
+func (s *Store) DeleteDelegationToken(idx uint64, id string) error {
+	sp := s.tracer.StartSpan("store: delete delegation token")
+	sp.LogKV("token id", id)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	token, err := tx.First("delegation_tokens", "id", id)
+	if err != nil {
+		return fmt.Errorf("delegation token lookup failed: %s", err)
+	}
+	if token == nil {
+		return nil
+	}
+	if err := tx.Delete("delegation_tokens", token); err != nil {
+		return fmt.Errorf("failed deleting delegation token: %s", err)
+	}
+	if err := tx.Insert("index", &IndexEntry{"delegation_tokens", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	tx.Commit()
+	return nil
+}
+
 func (s *Store) EnsurePartition(idx uint64, partition *structs.Partition) error {
 	sp := s.tracer.StartSpan("store: ensure partition")
 	s.vlog(sp, "partition", partition)
@@ -663,6 +902,33 @@ func (s *Store) EnsurePartition(idx uint64, partition *structs.Partition) error
 	return nil
 }
 
+// RegisterPartition registers the partition, keeping the registered
+// partition's read-only mode since the request may have been made from a read
+// of the partition before it changed.
+func (s *Store) RegisterPartition(idx uint64, partition *structs.Partition) error {
+	sp := s.tracer.StartSpan("store: register partition")
+	s.vlog(sp, "partition", partition)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+	if err := s.registerPartitionTxn(tx, idx, partition); err != nil {
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+func (s *Store) registerPartitionTxn(tx *memdb.Txn, idx uint64, partition *structs.Partition) error {
+	existing, err := tx.First("partitions", "id", partition.Topic, partition.Partition)
+	if err != nil {
+		return fmt.Errorf("partition lookup failed: %s", err)
+	}
+	partition.ReadOnly = existing != nil && existing.(*structs.Partition).ReadOnly
+	return s.ensurePartitionTxn(tx, idx, partition)
+}
+
 func (s *Store) ensurePartitionTxn(tx *memdb.Txn, idx uint64, partition *structs.Partition) error {
 	var t *structs.Partition
 	existing, err := tx.First("partitions", "id", partition.Topic, partition.Partition)
@@ -674,6 +940,12 @@ func (s *Store) ensurePartitionTxn(tx *memdb.Txn, idx uint64, partition *structs
 		t = existing.(*structs.Partition)
 	}
 
+	if t != nil && partitionEqual(t, partition) {
+		// nothing changed, skip the write so re-applying is a no-op
+		partition.RaftIndex = t.RaftIndex
+		return nil
+	}
+
 	if t != nil {
 		partition.CreateIndex = t.CreateIndex
 		partition.ModifyIndex = idx
@@ -693,6 +965,53 @@ func (s *Store) ensurePartitionTxn(tx *memdb.Txn, idx uint64, partition *structs
 	return nil
 }
 
+// EnsureBatch applies the batch's requests in order in one transaction, so
+// either all of them are applied or none are. Batches can have topic,
+// partition, and group registrations.
+func (s *Store) EnsureBatch(idx uint64, req *structs.BatchRequest) error {
+	sp := s.tracer.StartSpan("store: ensure batch")
+	s.vlog(sp, "req", req)
+	sp.SetTag("node id", s.nodeID)
+	defer sp.Finish()
+
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+	for _, r := range req.Requests {
+		if len(r) == 0 {
+			continue
+		}
+		if err := s.ensureBatchTxn(tx, idx, structs.MessageType(r[0]), r[1:]); err != nil {
+			return err
+		}
+	}
+	tx.Commit()
+	return nil
+}
+
+func (s *Store) ensureBatchTxn(tx *memdb.Txn, idx uint64, msgType structs.MessageType, buf []byte) error {
+	switch msgType {
+	case structs.RegisterTopicRequestType:
+		var req structs.RegisterTopicRequest
+		if err := structs.Decode(buf, &req); err != nil {
+			return fmt.Errorf("failed to decode request: %v", err)
+		}
+		return s.ensureTopicTxn(tx, idx, &req.Topic)
+	case structs.RegisterPartitionRequestType:
+		var req structs.RegisterPartitionRequest
+		if err := structs.Decode(buf, &req); err != nil {
+			return fmt.Errorf("failed to decode request: %v", err)
+		}
+		return s.registerPartitionTxn(tx, idx, &req.Partition)
+	case structs.RegisterGroupRequestType:
+		var req structs.RegisterGroupRequest
+		if err := structs.Decode(buf, &req); err != nil {
+			return fmt.Errorf("failed to decode request: %v", err)
+		}
+		return s.ensureGroupTxn(tx, idx, &req.Group)
+	}
+	return fmt.Errorf("unsupported batch message type: %d", msgType)
+}
+
 // GetPartition is used to get partitions.
 func (s *Store) GetPartition(topic string, id int32) (uint64, *structs.Partition, error) {
 	sp := s.tracer.StartSpan("store: get partition")
@@ -791,6 +1110,20 @@ func (s *Store) deletePartitionTxn(tx *memdb.Txn, idx uint64, topic string, id i
 	return nil
 }
 
+// topicEqual returns true if the topics are the same, ignoring their raft indexes.
+func topicEqual(a, b *structs.Topic) bool {
+	x, y := *a, *b
+	x.RaftIndex, y.RaftIndex = structs.RaftIndex{}, structs.RaftIndex{}
+	return reflect.DeepEqual(x, y)
+}
+
+// partitionEqual returns true if the partitions are the same, ignoring their raft indexes.
+func partitionEqual(a, b *structs.Partition) bool {
+	x, y := *a, *b
+	x.RaftIndex, y.RaftIndex = structs.RaftIndex{}, structs.RaftIndex{}
+	return reflect.DeepEqual(x, y)
+}
+
 // maxIndex is a helper used to retrieve the highest known index amongst a set of tables in the db.
 func (s *Store) maxIndex(tables ...string) uint64 {
 	tx := s.db.Txn(false)
@@ -937,6 +1270,14 @@ func topicsTableSchema() *memdb.TableSchema {
 					Lowercase: true,
 				},
 			},
+			"topic_id": &memdb.IndexSchema{
+				Name:         "topic_id",
+				AllowMissing: true,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "ID",
+				},
+			},
 		},
 	}
 }
@@ -1009,12 +1350,46 @@ func groupTableSchema() *memdb.TableSchema {
 	}
 }
 
+func producerTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "producers",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "TransactionalID",
+				},
+			},
+		},
+	}
+}
+
+func delegationTokenTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "delegation_tokens",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "TokenID",
+				},
+			},
+		},
+	}
+}
+
 func init() {
 	registerSchema(indexTableSchema)
 	registerSchema(nodesTableSchema)
 	registerSchema(topicsTableSchema)
 	registerSchema(partitionsTableSchema)
 	registerSchema(groupTableSchema)
+	registerSchema(producerTableSchema)
+	registerSchema(delegationTokenTableSchema)
 
 	e := os.Getenv("JOCKODEBUG")
 	if strings.Contains(e, "fsm=1") {
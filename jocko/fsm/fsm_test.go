@@ -1,6 +1,8 @@
 package fsm
 
 import (
+	"bytes"
+	"io/ioutil"
 	"reflect"
 	"testing"
 
@@ -135,6 +137,44 @@ func TestStore_RegisterTopic(t *testing.T) {
 	}
 }
 
+func TestStore_TopicID(t *testing.T) {
+	s := testStore(t)
+
+	if err := s.EnsureTopic(0, &structs.Topic{ID: "id1", Topic: "topic1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, topic, err := s.GetTopicByID("id1"); err != nil || topic == nil || topic.Topic != "topic1" {
+		t.Fatalf("bad: %#v (err: %v)", topic, err)
+	}
+
+	// updates without an id keep the existing one
+	if err := s.EnsureTopic(1, &structs.Topic{Topic: "topic1", Internal: true}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, topic, err := s.GetTopic("topic1"); err != nil || topic.ID != "id1" {
+		t.Fatalf("bad: %#v (err: %v)", topic, err)
+	}
+
+	// the id can't be changed
+	if err := s.EnsureTopic(2, &structs.Topic{ID: "id2", Topic: "topic1"}); err == nil {
+		t.Fatalf("expected error changing topic id")
+	}
+
+	// recreating the topic gives it a new id
+	if err := s.DeleteTopic(3, "topic1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.EnsureTopic(4, &structs.Topic{ID: "id2", Topic: "topic1"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, topic, err := s.GetTopicByID("id1"); err != nil || topic != nil {
+		t.Fatalf("bad: %#v (err: %v)", topic, err)
+	}
+	if _, topic, err := s.GetTopicByID("id2"); err != nil || topic == nil {
+		t.Fatalf("bad: %#v (err: %v)", topic, err)
+	}
+}
+
 func testRegisterTopic(t *testing.T, s *Store, idx uint64, id string) {
 	if err := s.EnsureTopic(idx, &structs.Topic{Topic: id}); err != nil {
 		t.Fatalf("err: %s", err)
@@ -277,3 +317,56 @@ func testRegisterGroup(t *testing.T, s *Store, idx uint64, id string) {
 		t.Fatalf("bad group: %#v", result)
 	}
 }
+
+type testSnapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { return nil }
+func (s *testSnapshotSink) Close() error  { return nil }
+
+func TestFSM_SnapshotRestore(t *testing.T) {
+	fsm, err := New(stdopentracing.GlobalTracer())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.state.EnsureTopic(1, &structs.Topic{Topic: "topic"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := fsm.state.EnsureGroup(2, &structs.Group{Group: "group", Coordinator: 1, Members: map[string]structs.Member{"m": {ID: "m"}}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := new(testSnapshotSink)
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	restored, err := New(stdopentracing.GlobalTracer())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := restored.Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, topic, err := restored.state.GetTopic("topic")
+	if err != nil || topic == nil {
+		t.Fatalf("topic not restored: %v", err)
+	}
+	idx, group, err := restored.state.GetGroup("group")
+	if err != nil || group == nil {
+		t.Fatalf("group not restored: %v", err)
+	}
+	if _, ok := group.Members["m"]; !ok || group.Coordinator != 1 {
+		t.Fatalf("bad group: %v", group)
+	}
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
@@ -73,3 +73,62 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 func (s *snapshot) Release() {
 	s.state.Close()
 }
+
+// tableSnapshots are the tables written to snapshots with the message type
+// their rows are tagged with and a constructor for decoding them, so a broker
+// restores the state from its latest snapshot and replays only the log after
+// it instead of the whole log, e.g. when it becomes the coordinator of groups.
+var tableSnapshots = []struct {
+	table   string
+	msgType structs.MessageType
+	newRow  func() interface{}
+}{
+	{"nodes", structs.RegisterNodeRequestType, func() interface{} { return new(structs.Node) }},
+	{"topics", structs.RegisterTopicRequestType, func() interface{} { return new(structs.Topic) }},
+	{"partitions", structs.RegisterPartitionRequestType, func() interface{} { return new(structs.Partition) }},
+	{"groups", structs.RegisterGroupRequestType, func() interface{} { return new(structs.Group) }},
+	{"producers", structs.RegisterProducerRequestType, func() interface{} { return new(structs.Producer) }},
+	{"delegation_tokens", structs.RegisterDelegationTokenRequestType, func() interface{} { return new(structs.DelegationToken) }},
+}
+
+func init() {
+	for _, t := range tableSnapshots {
+		registerPersister(persistTable(t.table, t.msgType))
+		registerRestorer(t.msgType, restoreTable(t.table, t.newRow))
+	}
+}
+
+// persistTable returns a persister writing each of the table's rows prefixed
+// with the message type.
+func persistTable(table string, msgType structs.MessageType) persister {
+	return func(s *snapshot, sink raft.SnapshotSink, encoder *codec.Encoder) error {
+		it, err := s.state.tx.Get(table, "id")
+		if err != nil {
+			return err
+		}
+		for row := it.Next(); row != nil; row = it.Next() {
+			if _, err := sink.Write([]byte{byte(msgType)}); err != nil {
+				return err
+			}
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// restoreTable returns a restorer inserting a row written by persistTable into
+// the table.
+func restoreTable(table string, newRow func() interface{}) restorer {
+	return func(header *snapshotHeader, restore *Restore, decoder *codec.Decoder) error {
+		row := newRow()
+		if err := decoder.Decode(row); err != nil {
+			return err
+		}
+		if err := restore.tx.Insert(table, row); err != nil {
+			return fmt.Errorf("failed restoring %s: %s", table, err)
+		}
+		return restore.tx.Insert("index", &IndexEntry{table, header.LastIndex})
+	}
+}
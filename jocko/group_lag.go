@@ -0,0 +1,195 @@
+package jocko
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// GroupLagTopicName is the compacted topic groups' lag is exported to
+	// when the broker's GroupLagExportInterval is set. Each record's value is
+	// a protocol.GroupLag keyed by the group and partition, so the topic
+	// keeps the latest lag of each, and a group's records all go to the same
+	// partition.
+	GroupLagTopicName          = "__consumer_lag"
+	groupLagTopicNumPartitions = 10
+	// groupLagFetchTimeout bounds the fetches of other brokers' high
+	// watermarks.
+	groupLagFetchTimeout = 5 * time.Second
+)
+
+// exportGroupLag writes the lag of the groups' committed offsets each
+// GroupLagExportInterval until stop is closed.
+func (b *Broker) exportGroupLag(stop <-chan struct{}) {
+	t := time.NewTicker(b.config.GroupLagExportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := b.writeGroupLag(time.Now()); err != protocol.ErrNone {
+				log.Error.Printf("broker/%d: export group lag error: %s", b.config.ID, err)
+			}
+		}
+	}
+}
+
+// writeGroupLag produces the lag of the offsets committed by the groups this
+// broker coordinates, so every group's exported by one broker, behind the high
+// watermarks of their partitions. The controller creates the lag topic if it
+// doesn't exist yet and the other brokers wait for it.
+func (b *Broker) writeGroupLag(now time.Time) protocol.Error {
+	state := b.fsm.State()
+	_, topic, err := state.GetTopic(GroupLagTopicName)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil {
+		if !b.isController() {
+			return protocol.ErrNone
+		}
+		if err := b.createTopic(&Context{parent: context.Background()}, b.groupLagTopic()); err != protocol.ErrNone && err != protocol.ErrTopicAlreadyExists {
+			return err
+		}
+	}
+	offsets, perr := b.coordinatedOffsets()
+	if perr != protocol.ErrNone {
+		return perr
+	}
+	hws := b.highWatermarks(offsets)
+	msgs := make(map[int32][]commitlog.Message)
+	for _, o := range offsets {
+		hw, ok := hws[lagPartition{o.Topic, o.Partition}]
+		if !ok {
+			continue
+		}
+		lag := &protocol.GroupLag{
+			Group:           o.Group,
+			Topic:           o.Topic,
+			Partition:       o.Partition,
+			CommittedOffset: o.Offset,
+			HighWatermark:   hw,
+		}
+		if lag.Lag = lag.HighWatermark - lag.CommittedOffset; lag.Lag < 0 {
+			lag.Lag = 0
+		}
+		value, err := protocol.Encode(lag)
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		msg, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: now,
+			Key:       []byte(fmt.Sprintf("%s-%d/%s", o.Topic, o.Partition, o.Group)),
+			Value:     value,
+		})
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		partition := groupLagPartition(o.Group)
+		msgs[partition] = append(msgs[partition], msg)
+	}
+	for partition, ms := range msgs {
+		if err := b.produceTo(GroupLagTopicName, partition, commitlog.NewMessageSet(0, ms...)); err != protocol.ErrNone {
+			return err
+		}
+	}
+	return protocol.ErrNone
+}
+
+// lagPartition is a partition groups' lag is exported for.
+type lagPartition struct {
+	topic     string
+	partition int32
+}
+
+// highWatermarks returns the high watermarks of the partitions the offsets
+// were committed for, from their replicas if this broker leads them and by
+// fetching nothing from their leaders otherwise. Those whose leaders can't be
+// reached are left out.
+func (b *Broker) highWatermarks(offsets []committedOffset) map[lagPartition]int64 {
+	state := b.fsm.State()
+	hws := make(map[lagPartition]int64)
+	remote := make(map[int32]map[string][]int32)
+	for _, o := range offsets {
+		tp := lagPartition{o.Topic, o.Partition}
+		if _, ok := hws[tp]; ok {
+			continue
+		}
+		_, p, err := state.GetPartition(o.Topic, o.Partition)
+		if err != nil || p == nil {
+			continue
+		}
+		if p.Leader != b.config.ID {
+			if remote[p.Leader] == nil {
+				remote[p.Leader] = make(map[string][]int32)
+			}
+			if !containsPartition(remote[p.Leader][o.Topic], o.Partition) {
+				remote[p.Leader][o.Topic] = append(remote[p.Leader][o.Topic], o.Partition)
+			}
+			continue
+		}
+		replica, err := b.replicaLookup.Replica(o.Topic, o.Partition)
+		if err != nil || replica.Log == nil {
+			continue
+		}
+		hws[tp] = replica.highWatermark()
+	}
+	for leader, topics := range remote {
+		req := &protocol.FetchRequest{
+			ReplicaID:   -1,
+			MaxWaitTime: groupLagFetchTimeout,
+		}
+		for topic, partitions := range topics {
+			ft := &protocol.FetchTopic{Topic: topic}
+			for _, partition := range partitions {
+				ft.Partitions = append(ft.Partitions, &protocol.FetchPartition{Partition: partition})
+			}
+			req.Topics = append(req.Topics, ft)
+		}
+		res, err := b.peers.Fetch(b.ctx, leader, req)
+		if err != nil {
+			log.Error.Printf("broker/%d: fetch high watermarks from broker %d error: %s", b.config.ID, leader, err)
+			continue
+		}
+		for _, t := range res.Responses {
+			for _, p := range t.PartitionResponses {
+				if p.ErrorCode == protocol.ErrNone.Code() {
+					hws[lagPartition{t.Topic, p.Partition}] = p.HighWatermark
+				}
+			}
+		}
+	}
+	return hws
+}
+
+// groupLagTopic returns the request to create the group lag topic, replicated
+// like the offsets topic unless the cluster has fewer brokers.
+func (b *Broker) groupLagTopic() *protocol.CreateTopicRequest {
+	replicationFactor := b.config.OffsetsTopicReplicationFactor
+	if n := len(b.brokerLookup.Brokers()); n > 0 && n < int(replicationFactor) {
+		replicationFactor = int16(n)
+	}
+	compact := commitlog.CompactCleanupPolicy
+	return &protocol.CreateTopicRequest{
+		Topic:             GroupLagTopicName,
+		NumPartitions:     groupLagTopicNumPartitions,
+		ReplicationFactor: replicationFactor,
+		Configs:           map[string]*string{"cleanup.policy": &compact},
+	}
+}
+
+// groupLagPartition returns the partition of the lag topic the group's lag is
+// written to.
+func groupLagPartition(group string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(group))
+	return int32(h.Sum32() % groupLagTopicNumPartitions)
+}
@@ -0,0 +1,526 @@
+package jocko
+
+import (
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/jocko/util"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// offsetKey is the key of a record in the offsets topic, the group and the
+// partition it committed an offset for.
+type offsetKey struct {
+	Group     string
+	Topic     string
+	Partition int32
+}
+
+func (k *offsetKey) Encode(e protocol.PacketEncoder) (err error) {
+	if err = e.PutString(k.Group); err != nil {
+		return err
+	}
+	if err = e.PutString(k.Topic); err != nil {
+		return err
+	}
+	e.PutInt32(k.Partition)
+	return nil
+}
+
+func (k *offsetKey) Decode(d protocol.PacketDecoder) (err error) {
+	if k.Group, err = d.String(); err != nil {
+		return err
+	}
+	if k.Topic, err = d.String(); err != nil {
+		return err
+	}
+	k.Partition, err = d.Int32()
+	return err
+}
+
+// offsetValue is the value of a record in the offsets topic, the offset the
+// group committed. The timestamps are in ms since the epoch.
+type offsetValue struct {
+	Offset          int64
+	Metadata        string
+	CommitTimestamp int64
+	// ExpireTimestamp is when the offset's deleted if its group has no
+	// members by then.
+	ExpireTimestamp int64
+}
+
+func (v *offsetValue) Encode(e protocol.PacketEncoder) (err error) {
+	e.PutInt64(v.Offset)
+	if err = e.PutString(v.Metadata); err != nil {
+		return err
+	}
+	e.PutInt64(v.CommitTimestamp)
+	e.PutInt64(v.ExpireTimestamp)
+	return nil
+}
+
+func (v *offsetValue) Decode(d protocol.PacketDecoder) (err error) {
+	if v.Offset, err = d.Int64(); err != nil {
+		return err
+	}
+	if v.Metadata, err = d.String(); err != nil {
+		return err
+	}
+	if v.CommitTimestamp, err = d.Int64(); err != nil {
+		return err
+	}
+	v.ExpireTimestamp, err = d.Int64()
+	return err
+}
+
+// committedOffset is an offset a group committed.
+type committedOffset struct {
+	offsetKey
+	offsetValue
+}
+
+// offsetStore keeps the offsets consumer groups commit. They're records in
+// the partition of the offsets topic whose leader coordinates the group, keyed
+// by the group and partition so compaction keeps each one's latest, and
+// tombstoned once they expire. The coordinator reads its partitions' records
+// back as it's asked for them, picking up from where it last read.
+//
+// What's been read of a partition is snapshotted to a file in its dir, so a
+// broker that becomes its coordinator reads the snapshot and the records after
+// it rather than the whole partition.
+type offsetStore struct {
+	mu         sync.Mutex
+	partitions map[int32]*offsetsPartition
+	// dir returns the dir of the partition of the offsets topic its snapshot's
+	// kept in. If it's nil there are no snapshots.
+	dir func(partition int32) string
+}
+
+// offsetsPartition is what's been read of a partition of the offsets topic.
+type offsetsPartition struct {
+	log     CommitLog
+	next    int64
+	offsets map[offsetKey]offsetValue
+	// crc is the CRC of the message set before next, which a snapshot's
+	// checked against to tell the log still has what was read.
+	crc uint32
+}
+
+// offsetsSnapshotFile is the file in a partition of the offsets topic's dir its
+// snapshot's kept in.
+const offsetsSnapshotFile = "offsets.snapshot"
+
+func newOffsetStore(dir func(partition int32) string) *offsetStore {
+	return &offsetStore{partitions: make(map[int32]*offsetsPartition), dir: dir}
+}
+
+// partition returns what's been read of the partition of the offsets topic,
+// starting from its snapshot if its replica's new. The store's lock must be
+// held.
+func (s *offsetStore) partition(partition int32, l CommitLog) *offsetsPartition {
+	p, ok := s.partitions[partition]
+	if !ok || p.log != l {
+		// the partition's replica is new, e.g. it was reassigned to this
+		// broker and back
+		p = &offsetsPartition{log: l}
+		if s.dir != nil {
+			p.load(filepath.Join(s.dir(partition), offsetsSnapshotFile))
+		}
+		s.partitions[partition] = p
+	}
+	return p
+}
+
+// committed returns the offsets in the log of the partition of the offsets
+// topic that match.
+func (s *offsetStore) committed(partition int32, l CommitLog, match func(offsetKey) bool) ([]committedOffset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.partition(partition, l)
+	if err := p.scan(); err != nil {
+		return nil, err
+	}
+	var offsets []committedOffset
+	for k, v := range p.offsets {
+		if match(k) {
+			offsets = append(offsets, committedOffset{offsetKey: k, offsetValue: v})
+		}
+	}
+	return offsets, nil
+}
+
+// scan reads the log from where it last left off. It reads the log again
+// from the start if it no longer has what was read, e.g. because it's been
+// truncated to a new leader's.
+func (p *offsetsPartition) scan() error {
+	if p.offsets == nil || p.next < p.log.OldestOffset() || p.next > p.log.NewestOffset() {
+		p.next = p.log.OldestOffset()
+		p.offsets = make(map[offsetKey]offsetValue)
+	}
+	if p.next >= p.log.NewestOffset() {
+		return nil
+	}
+	r, err := p.log.NewReader(p.next, 0)
+	if err != nil {
+		return err
+	}
+	for {
+		ms, err := commitlog.ReadMessageSet(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the rest's still being appended
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p.next = ms.Offset() + 1
+		p.crc = crc32.ChecksumIEEE(ms)
+		for _, m := range ms.Messages() {
+			if m.Control() || m.Compressed() {
+				continue
+			}
+			var k offsetKey
+			if err := k.Decode(protocol.NewDecoder(m.Key())); err != nil {
+				// not an offset, e.g. something produced to the topic
+				continue
+			}
+			if m.Value() == nil {
+				delete(p.offsets, k)
+				continue
+			}
+			var v offsetValue
+			if err := v.Decode(protocol.NewDecoder(m.Value())); err != nil {
+				continue
+			}
+			p.offsets[k] = v
+		}
+	}
+}
+
+// snapshot writes the snapshot of what's been read of the partition of the
+// offsets topic, after reading the rest of its log. It's written without
+// holding the store's lock.
+func (s *offsetStore) snapshot(partition int32, l CommitLog) error {
+	if s.dir == nil {
+		return nil
+	}
+	s.mu.Lock()
+	p := s.partition(partition, l)
+	if err := p.scan(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	snap := &offsetsSnapshot{Next: p.next, CRC: p.crc}
+	for k, v := range p.offsets {
+		snap.Offsets = append(snap.Offsets, committedOffset{offsetKey: k, offsetValue: v})
+	}
+	s.mu.Unlock()
+
+	b, err := protocol.Encode(snap)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir(partition), offsetsSnapshotFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load starts the partition from the snapshot at the path if the log still
+// has the message set it was taken after. Otherwise it's read from the start.
+func (p *offsetsPartition) load(path string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var snap offsetsSnapshot
+	if err := snap.Decode(protocol.NewDecoder(b)); err != nil {
+		return
+	}
+	if snap.Next <= p.log.OldestOffset() || snap.Next > p.log.NewestOffset() {
+		return
+	}
+	r, err := p.log.NewReader(snap.Next-1, 0)
+	if err != nil {
+		return
+	}
+	ms, err := commitlog.ReadMessageSet(r)
+	if err != nil || ms.Offset() != snap.Next-1 || crc32.ChecksumIEEE(ms) != snap.CRC {
+		// the log's been truncated or compacted since
+		return
+	}
+	p.next = snap.Next
+	p.crc = snap.CRC
+	p.offsets = make(map[offsetKey]offsetValue, len(snap.Offsets))
+	for _, o := range snap.Offsets {
+		p.offsets[o.offsetKey] = o.offsetValue
+	}
+}
+
+// offsetsSnapshot is a snapshot of what's been read of a partition of the
+// offsets topic: the offsets committed by the records before Next.
+type offsetsSnapshot struct {
+	Next    int64
+	CRC     uint32
+	Offsets []committedOffset
+}
+
+func (s *offsetsSnapshot) Encode(e protocol.PacketEncoder) (err error) {
+	e.PutInt64(s.Next)
+	e.PutInt32(int32(s.CRC))
+	if err = e.PutArrayLength(len(s.Offsets)); err != nil {
+		return err
+	}
+	for i := range s.Offsets {
+		if err = s.Offsets[i].offsetKey.Encode(e); err != nil {
+			return err
+		}
+		if err = s.Offsets[i].offsetValue.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *offsetsSnapshot) Decode(d protocol.PacketDecoder) (err error) {
+	if s.Next, err = d.Int64(); err != nil {
+		return err
+	}
+	crc, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	s.CRC = uint32(crc)
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	s.Offsets = make([]committedOffset, n)
+	for i := range s.Offsets {
+		if err = s.Offsets[i].offsetKey.Decode(d); err != nil {
+			return err
+		}
+		if err = s.Offsets[i].offsetValue.Decode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotOffsets snapshots the partitions of the offsets topic this broker
+// leads each OffsetsSnapshotInterval until stop is closed.
+func (b *Broker) snapshotOffsets(stop <-chan struct{}) {
+	t := time.NewTicker(b.config.OffsetsSnapshotInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			for _, replica := range b.replicaLookup.Replicas() {
+				if replica.Partition.Topic != OffsetsTopicName || replica.leader() != b.config.ID || replica.Log == nil {
+					continue
+				}
+				if err := b.offsets.snapshot(replica.Partition.ID, replica.Log); err != nil {
+					log.Error.Printf("broker/%d: snapshot offsets partition %d error: %s", b.config.ID, replica.Partition.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// coordinatorPartition returns the partition of the offsets topic whose
+// leader coordinates the group, and that its offsets are committed to.
+func coordinatorPartition(group string, partitions int) int32 {
+	return int32(util.Hash(group) % uint64(partitions))
+}
+
+// coordinatorLog returns the partition of the offsets topic the group's
+// offsets are committed to and its log, if this broker leads it and so
+// coordinates the group.
+func (b *Broker) coordinatorLog(group string) (int32, CommitLog, protocol.Error) {
+	_, topic, err := b.fsm.State().GetTopic(OffsetsTopicName)
+	if err != nil {
+		return 0, nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil || len(topic.Partitions) == 0 {
+		return 0, nil, protocol.ErrCoordinatorNotAvailable
+	}
+	partition := coordinatorPartition(group, len(topic.Partitions))
+	replica, err := b.replicaLookup.Replica(OffsetsTopicName, partition)
+	if err != nil || replica.leader() != b.config.ID {
+		return 0, nil, protocol.ErrNotCoordinator
+	}
+	if replica.Log == nil {
+		return 0, nil, protocol.ErrCoordinatorLoadInProgress
+	}
+	return partition, replica.Log, protocol.ErrNone
+}
+
+// groupOffsets returns the offsets the group committed if this broker
+// coordinates it.
+func (b *Broker) groupOffsets(group string) ([]committedOffset, protocol.Error) {
+	partition, l, perr := b.coordinatorLog(group)
+	if perr != protocol.ErrNone {
+		return nil, perr
+	}
+	offsets, err := b.offsets.committed(partition, l, func(k offsetKey) bool {
+		return k.Group == group
+	})
+	if err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	return offsets, protocol.ErrNone
+}
+
+// coordinatedOffsets returns the offsets committed by the groups this broker
+// coordinates. The offsets of groups that moved to other partitions when the
+// offsets topic grew are left out, they've been copied to their new ones.
+func (b *Broker) coordinatedOffsets() ([]committedOffset, protocol.Error) {
+	_, topic, err := b.fsm.State().GetTopic(OffsetsTopicName)
+	if err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil {
+		return nil, protocol.ErrNone
+	}
+	n := len(topic.Partitions)
+	var offsets []committedOffset
+	for id := int32(0); id < int32(n); id++ {
+		replica, err := b.replicaLookup.Replica(OffsetsTopicName, id)
+		if err != nil || replica.leader() != b.config.ID || replica.Log == nil {
+			continue
+		}
+		partition := id
+		committed, err := b.offsets.committed(partition, replica.Log, func(k offsetKey) bool {
+			return coordinatorPartition(k.Group, n) == partition
+		})
+		if err != nil {
+			return nil, protocol.ErrUnknown.WithErr(err)
+		}
+		offsets = append(offsets, committed...)
+	}
+	return offsets, protocol.ErrNone
+}
+
+// newCommittedOffset returns the offset committed now. It's kept for the
+// retention once its group's empty, or for the broker's OffsetsRetention if
+// the retention's not positive.
+func (b *Broker) newCommittedOffset(o structs.GroupOffset, retention time.Duration, now time.Time) committedOffset {
+	if retention <= 0 {
+		retention = b.config.OffsetsRetention
+	}
+	commit := now.UnixNano() / int64(time.Millisecond)
+	return committedOffset{
+		offsetKey: offsetKey{Group: o.Group, Topic: o.Topic, Partition: o.Partition},
+		offsetValue: offsetValue{
+			Offset:          o.Offset,
+			Metadata:        o.Metadata,
+			CommitTimestamp: commit,
+			ExpireTimestamp: commit + int64(retention/time.Millisecond),
+		},
+	}
+}
+
+// writeOffsets produces the offsets to their groups' partitions of the
+// offsets topic, or their tombstones if they're deleted.
+func (b *Broker) writeOffsets(offsets []committedOffset, deleted bool) protocol.Error {
+	_, topic, err := b.fsm.State().GetTopic(OffsetsTopicName)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil || len(topic.Partitions) == 0 {
+		return protocol.ErrCoordinatorNotAvailable
+	}
+	now := time.Now()
+	msgs := make(map[int32][]commitlog.Message)
+	for i := range offsets {
+		o := &offsets[i]
+		key, err := protocol.Encode(&o.offsetKey)
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		var value []byte
+		if !deleted {
+			if value, err = protocol.Encode(&o.offsetValue); err != nil {
+				return protocol.ErrUnknown.WithErr(err)
+			}
+		}
+		msg, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: now,
+			Key:       key,
+			Value:     value,
+		})
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		partition := coordinatorPartition(o.Group, len(topic.Partitions))
+		msgs[partition] = append(msgs[partition], msg)
+	}
+	for partition, ms := range msgs {
+		if err := b.produceTo(OffsetsTopicName, partition, commitlog.NewMessageSet(0, ms...)); err != protocol.ErrNone {
+			return err
+		}
+	}
+	return protocol.ErrNone
+}
+
+// expireOffsets deletes the expired offsets, and removes the share groups
+// unused for the OffsetsRetention, each OffsetsRetentionCheckInterval until
+// stop is closed.
+func (b *Broker) expireOffsets(stop <-chan struct{}) {
+	t := time.NewTicker(b.config.OffsetsRetentionCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			if err := b.deleteExpiredOffsets(now); err != protocol.ErrNone {
+				log.Error.Printf("broker/%d: expire offsets error: %s", b.config.ID, err)
+			}
+			b.shareGroups.expire(now.Add(-b.config.OffsetsRetention))
+		}
+	}
+}
+
+// deleteExpiredOffsets deletes the offsets past their retention of the groups
+// this broker coordinates that have no members. A group's members keep its
+// offsets however long ago they were committed.
+func (b *Broker) deleteExpiredOffsets(now time.Time) protocol.Error {
+	offsets, perr := b.coordinatedOffsets()
+	if perr != protocol.ErrNone {
+		return perr
+	}
+	state := b.fsm.State()
+	ms := now.UnixNano() / int64(time.Millisecond)
+	var expired []committedOffset
+	for _, o := range offsets {
+		if o.ExpireTimestamp > ms {
+			continue
+		}
+		_, group, err := state.GetGroup(o.Group)
+		if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		if group != nil && len(group.Members) > 0 {
+			continue
+		}
+		expired = append(expired, o)
+	}
+	if len(expired) == 0 {
+		return protocol.ErrNone
+	}
+	return b.writeOffsets(expired, true)
+}
@@ -0,0 +1,196 @@
+package jocko
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// startOffsetsTopic registers an offsets topic with one partition the broker
+// leads and starts its replica, so the broker coordinates every group.
+func startOffsetsTopic(t *testing.T, b *Broker) (*Replica, func()) {
+	dir, err := ioutil.TempDir("", "offsets")
+	require.NoError(t, err)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+	partition := structs.Partition{Topic: OffsetsTopicName, ID: 0, Partition: 0, Leader: b.config.ID, AR: []int32{b.config.ID}, ISR: []int32{b.config.ID}}
+	require.NoError(t, b.registerTopic(structs.Topic{Topic: OffsetsTopicName, Partitions: map[int32][]int32{0: partition.AR}}, []structs.Partition{partition}))
+	replica := &Replica{BrokerID: b.config.ID, Partition: partition, IsLocal: true, Log: l}
+	if b.replicaLookup == nil {
+		b.replicaLookup = NewReplicaLookup()
+	}
+	b.replicaLookup.AddReplica(replica)
+	b.offsets = newOffsetStore(nil)
+	return replica, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestOffsetCommit(t *testing.T) {
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	require.NoError(t, err)
+	b := &Broker{
+		config: &config.Config{ID: 1, OffsetsRetention: time.Hour},
+		fsm:    f,
+		store:  &fsmStore{fsm: f},
+		tracer: stdopentracing.NoopTracer{},
+		ctx:    context.Background(),
+	}
+	_, err = b.raftApply(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{
+		Partition: structs.Partition{Topic: "test", ID: 0, Partition: 0, Leader: 1, AR: []int32{1}, ISR: []int32{1}},
+	})
+	require.NoError(t, err)
+	ctx := &Context{parent: context.Background()}
+	metadata := "meta"
+	commit := func(group string, offset, retention int64) int16 {
+		res := b.handleOffsetCommit(ctx, &protocol.OffsetCommitRequest{
+			APIVersion:    2,
+			GroupID:       group,
+			GenerationID:  -1,
+			RetentionTime: retention,
+			Topics: []protocol.OffsetCommitTopicRequest{{
+				Topic:      "test",
+				Partitions: []protocol.OffsetCommitPartitionRequest{{Partition: 0, Offset: offset, Metadata: &metadata}},
+			}},
+		})
+		return res.Responses[0].PartitionResponses[0].ErrorCode
+	}
+	fetch := func(group string) protocol.OffsetFetchPartition {
+		res := b.handleOffsetFetch(ctx, &protocol.OffsetFetchRequest{
+			GroupID: group,
+			Topics:  []protocol.OffsetFetchTopicRequest{{Topic: "test", Partitions: []int32{0}}},
+		})
+		return res.Responses[0].Partitions[0]
+	}
+
+	// there's no coordinator until the offsets topic's created
+	require.Equal(t, protocol.ErrCoordinatorNotAvailable.Code(), commit("group", 1, -1))
+
+	replica, stop := startOffsetsTopic(t, b)
+	defer stop()
+	require.Equal(t, protocol.ErrNone.Code(), commit("group", 5, -1))
+	require.Equal(t, protocol.ErrNone.Code(), commit("group", 10, -1))
+	require.Equal(t, protocol.ErrNone.Code(), commit("short-lived", 20, 1))
+	got := fetch("group")
+	require.Equal(t, protocol.ErrNone.Code(), got.ErrorCode)
+	require.Equal(t, int64(10), got.Offset)
+	require.Equal(t, "meta", *got.Metadata)
+	require.Equal(t, int64(-1), fetch("other").Offset)
+
+	// the offsets are read back from the log
+	b.offsets = newOffsetStore(nil)
+	require.Equal(t, int64(10), fetch("group").Offset)
+	require.Equal(t, int64(20), fetch("short-lived").Offset)
+
+	// offsets past their retention are deleted once their groups are empty
+	_, err = b.raftApply(structs.RegisterGroupRequestType, structs.RegisterGroupRequest{
+		Group: structs.Group{Group: "short-lived", Members: map[string]structs.Member{"member": {ID: "member"}}},
+	})
+	require.NoError(t, err)
+	later := time.Now().Add(time.Minute)
+	require.Equal(t, protocol.ErrNone, b.deleteExpiredOffsets(later))
+	require.Equal(t, int64(20), fetch("short-lived").Offset)
+	_, err = b.raftApply(structs.RegisterGroupRequestType, structs.RegisterGroupRequest{
+		Group: structs.Group{Group: "short-lived"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, protocol.ErrNone, b.deleteExpiredOffsets(later))
+	require.Equal(t, int64(-1), fetch("short-lived").Offset)
+	require.Equal(t, int64(10), fetch("group").Offset)
+	require.Equal(t, protocol.ErrNone, b.deleteExpiredOffsets(later.Add(time.Hour)))
+	require.Equal(t, int64(-1), fetch("group").Offset)
+
+	// only the coordinator has the group's offsets
+	replica.Partition.Leader = 2
+	require.Equal(t, protocol.ErrNotCoordinator.Code(), commit("group", 30, -1))
+	require.Equal(t, protocol.ErrNotCoordinator.Code(), fetch("group").ErrorCode)
+}
+
+func TestReplica_HighWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "high-watermark")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+	defer l.Close()
+	ms, err := protocol.Encode(&protocol.MessageSet{Messages: []*protocol.Message{{MagicByte: 1, Value: []byte("value")}}})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(ms)
+		require.NoError(t, err)
+	}
+	replica := &Replica{BrokerID: 1, Partition: structs.Partition{Leader: 1, ISR: []int32{1, 2, 3}}, Log: l}
+
+	// it's held back by the followers in sync that haven't fetched
+	require.Equal(t, int64(0), replica.highWatermark())
+	replica.fetchedBy(2, 3)
+	replica.fetchedBy(3, 1)
+	require.Equal(t, int64(1), replica.highWatermark())
+	replica.fetchedBy(3, 2)
+	require.Equal(t, int64(2), replica.highWatermark())
+	// followers out of sync don't hold it back, and it doesn't go back
+	replica.Partition.ISR = []int32{1, 2}
+	require.Equal(t, int64(3), replica.highWatermark())
+	replica.Partition.ISR = []int32{1, 2, 3}
+	require.Equal(t, int64(3), replica.highWatermark())
+}
+
+func TestOffsetStore_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+	defer l.Close()
+	commit := func(group string, offset int64) {
+		key, err := protocol.Encode(&offsetKey{Group: group, Topic: "test"})
+		require.NoError(t, err)
+		value, err := protocol.Encode(&offsetValue{Offset: offset})
+		require.NoError(t, err)
+		msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Key: key, Value: value})
+		require.NoError(t, err)
+		_, err = l.Append(commitlog.NewMessageSet(0, msg))
+		require.NoError(t, err)
+	}
+	committed := func(s *offsetStore) map[string]int64 {
+		offsets, err := s.committed(0, l, func(offsetKey) bool { return true })
+		require.NoError(t, err)
+		got := make(map[string]int64)
+		for _, o := range offsets {
+			got[o.Group] = o.Offset
+		}
+		return got
+	}
+	partitionDir := func(int32) string { return dir }
+
+	commit("a", 1)
+	commit("b", 2)
+	require.NoError(t, newOffsetStore(partitionDir).snapshot(0, l))
+	commit("a", 3)
+
+	// a new coordinator starts from the snapshot and reads the rest
+	s := newOffsetStore(partitionDir)
+	s.mu.Lock()
+	require.Equal(t, int64(2), s.partition(0, l).next)
+	s.mu.Unlock()
+	require.Equal(t, map[string]int64{"a": 3, "b": 2}, committed(s))
+
+	// the snapshot's not used if the log no longer has what it was taken
+	// after
+	require.NoError(t, l.Reset(0))
+	commit("c", 4)
+	commit("d", 5)
+	s = newOffsetStore(partitionDir)
+	require.Equal(t, map[string]int64{"c": 4, "d": 5}, committed(s))
+}
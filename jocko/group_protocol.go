@@ -0,0 +1,118 @@
+package jocko
+
+import (
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// validateGroupProtocol checks that the member can join the group: it has to
+// join with a protocol type and protocols, the same protocol type as the
+// group's other members, and a protocol all of them support. Groups aren't
+// only for consumers, e.g. apps can use them to elect a leader, so any
+// protocol type is allowed as long as the members agree on it.
+func validateGroupProtocol(group *structs.Group, r *protocol.JoinGroupRequest) protocol.Error {
+	if r.ProtocolType == "" || len(r.GroupProtocols) == 0 {
+		return protocol.ErrInconsistentGroupProtocol
+	}
+	for _, p := range r.GroupProtocols {
+		if p.ProtocolName == "" {
+			return protocol.ErrInconsistentGroupProtocol
+		}
+	}
+	if !hasOtherMembers(group, r.MemberID) {
+		return protocol.ErrNone
+	}
+	if group.ProtocolType != "" && group.ProtocolType != r.ProtocolType {
+		return protocol.ErrInconsistentGroupProtocol
+	}
+	for _, p := range r.GroupProtocols {
+		if supportedByOthers(group, r.MemberID, p.ProtocolName) {
+			return protocol.ErrNone
+		}
+	}
+	return protocol.ErrInconsistentGroupProtocol
+}
+
+func hasOtherMembers(group *structs.Group, memberID string) bool {
+	for id := range group.Members {
+		if id != memberID {
+			return true
+		}
+	}
+	return false
+}
+
+func supportedByOthers(group *structs.Group, memberID, name string) bool {
+	for id, m := range group.Members {
+		if id != memberID && memberProtocol(m, name) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func memberProtocol(m structs.Member, name string) *structs.MemberProtocol {
+	for i, p := range m.Protocols {
+		if p.Name == name {
+			return &m.Protocols[i]
+		}
+	}
+	return nil
+}
+
+// selectGroupProtocol sets the group's protocol to the one of those all of its
+// members support that's the most members' first choice, ties going to the
+// leader's preference, and sets each member's metadata to theirs for it. The
+// group's protocol type and protocol are reset if it's empty.
+func selectGroupProtocol(group *structs.Group) {
+	if len(group.Members) == 0 {
+		group.ProtocolType = ""
+		group.Protocol = ""
+		return
+	}
+	leader, ok := group.Members[group.LeaderID]
+	if !ok {
+		for _, m := range group.Members {
+			leader = m
+			break
+		}
+	}
+	// the candidates are in the leader's order of preference to break ties
+	var candidates []string
+	for _, p := range leader.Protocols {
+		if supportedByOthers(group, leader.ID, p.Name) {
+			candidates = append(candidates, p.Name)
+		}
+	}
+	votes := make(map[string]int)
+	for _, m := range group.Members {
+		for _, p := range m.Protocols {
+			if containsString(candidates, p.Name) {
+				votes[p.Name]++
+				break
+			}
+		}
+	}
+	group.Protocol = ""
+	for _, name := range candidates {
+		if group.Protocol == "" || votes[name] > votes[group.Protocol] {
+			group.Protocol = name
+		}
+	}
+	for id, m := range group.Members {
+		m.Metadata = nil
+		if p := memberProtocol(m, group.Protocol); p != nil {
+			m.Metadata = p.Metadata
+		}
+		group.Members[id] = m
+	}
+}
+
+func containsString(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestValidateGroupProtocol(t *testing.T) {
+	group := &structs.Group{
+		ProtocolType: "consumer",
+		Members: map[string]structs.Member{
+			"a": {ID: "a", Protocols: []structs.MemberProtocol{{Name: "range"}, {Name: "roundrobin"}}},
+			"b": {ID: "b", Protocols: []structs.MemberProtocol{{Name: "roundrobin"}}},
+		},
+	}
+	protocols := func(names ...string) (ps []*protocol.GroupProtocol) {
+		for _, name := range names {
+			ps = append(ps, &protocol.GroupProtocol{ProtocolName: name})
+		}
+		return ps
+	}
+	tests := []struct {
+		name  string
+		group *structs.Group
+		req   *protocol.JoinGroupRequest
+		want  protocol.Error
+	}{
+		{"supported by all", group, &protocol.JoinGroupRequest{ProtocolType: "consumer", GroupProtocols: protocols("sticky", "roundrobin")}, protocol.ErrNone},
+		{"no protocol type", group, &protocol.JoinGroupRequest{GroupProtocols: protocols("roundrobin")}, protocol.ErrInconsistentGroupProtocol},
+		{"no protocols", group, &protocol.JoinGroupRequest{ProtocolType: "consumer"}, protocol.ErrInconsistentGroupProtocol},
+		{"other protocol type", group, &protocol.JoinGroupRequest{ProtocolType: "connect", GroupProtocols: protocols("roundrobin")}, protocol.ErrInconsistentGroupProtocol},
+		{"not supported by all", group, &protocol.JoinGroupRequest{ProtocolType: "consumer", GroupProtocols: protocols("range")}, protocol.ErrInconsistentGroupProtocol},
+		// a's the only other member and supports range
+		{"rejoin", group, &protocol.JoinGroupRequest{MemberID: "b", ProtocolType: "consumer", GroupProtocols: protocols("range")}, protocol.ErrNone},
+		{"empty group", &structs.Group{Members: map[string]structs.Member{}}, &protocol.JoinGroupRequest{ProtocolType: "election", GroupProtocols: protocols("leader")}, protocol.ErrNone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, validateGroupProtocol(test.group, test.req))
+		})
+	}
+}
+
+func TestSelectGroupProtocol(t *testing.T) {
+	group := &structs.Group{
+		LeaderID:     "a",
+		ProtocolType: "consumer",
+		Members: map[string]structs.Member{
+			"a": {ID: "a", Protocols: []structs.MemberProtocol{{Name: "range", Metadata: []byte("a-range")}, {Name: "roundrobin", Metadata: []byte("a-rr")}}},
+			"b": {ID: "b", Protocols: []structs.MemberProtocol{{Name: "roundrobin", Metadata: []byte("b-rr")}, {Name: "range", Metadata: []byte("b-range")}}},
+			"c": {ID: "c", Protocols: []structs.MemberProtocol{{Name: "roundrobin", Metadata: []byte("c-rr")}, {Name: "range", Metadata: []byte("c-range")}}},
+		},
+	}
+	selectGroupProtocol(group)
+	require.Equal(t, "roundrobin", group.Protocol)
+	require.Equal(t, []byte("a-rr"), group.Members["a"].Metadata)
+	require.Equal(t, []byte("c-rr"), group.Members["c"].Metadata)
+
+	// ties go to the leader's preference
+	delete(group.Members, "c")
+	selectGroupProtocol(group)
+	require.Equal(t, "range", group.Protocol)
+	require.Equal(t, []byte("b-range"), group.Members["b"].Metadata)
+
+	delete(group.Members, "a")
+	delete(group.Members, "b")
+	selectGroupProtocol(group)
+	require.Equal(t, "", group.ProtocolType)
+	require.Equal(t, "", group.Protocol)
+}
+
+func TestGroupState(t *testing.T) {
+	group := &structs.Group{Members: map[string]structs.Member{}}
+	require.Equal(t, "Empty", groupState(group))
+	group.Members["a"] = structs.Member{ID: "a"}
+	require.Equal(t, "Stable", groupState(group))
+}
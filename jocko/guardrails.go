@@ -0,0 +1,80 @@
+package jocko
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// validateTopicLayout checks the new topic's partitions and replicas can be
+// placed on the cluster as it is, so a topic the controller can't create
+// properly is rejected with why rather than created under-replicated or with
+// replicas that never start.
+func (b *Broker) validateTopicLayout(req *protocol.CreateTopicRequest) protocol.Error {
+	live := make(map[int32]bool)
+	for _, broker := range b.schedulableBrokers() {
+		live[broker.ID.Int32()] = true
+	}
+	if len(req.ReplicaAssignment) == 0 {
+		if req.NumPartitions <= 0 {
+			return protocol.ErrInvalidPartitions.WithErr(fmt.Errorf("number of partitions must be positive, got %d", req.NumPartitions))
+		}
+		if req.ReplicationFactor <= 0 {
+			return protocol.ErrInvalidReplicationFactor.WithErr(fmt.Errorf("replication factor must be positive, got %d", req.ReplicationFactor))
+		}
+		if int(req.ReplicationFactor) > len(live) {
+			return protocol.ErrInvalidReplicationFactor.WithErr(fmt.Errorf("replication factor %d is larger than the %d live brokers", req.ReplicationFactor, len(live)))
+		}
+		return protocol.ErrNone
+	}
+
+	if req.NumPartitions > 0 && int(req.NumPartitions) != len(req.ReplicaAssignment) {
+		return protocol.ErrInvalidReplicaAssignment.WithErr(fmt.Errorf("%d partitions requested but %d assigned", req.NumPartitions, len(req.ReplicaAssignment)))
+	}
+	replicationFactor := -1
+	for id := int32(0); id < int32(len(req.ReplicaAssignment)); id++ {
+		replicas, ok := req.ReplicaAssignment[id]
+		if !ok {
+			return protocol.ErrInvalidReplicaAssignment.WithErr(fmt.Errorf("partitions must be numbered from 0, partition %d isn't assigned", id))
+		}
+		if len(replicas) == 0 {
+			return protocol.ErrInvalidReplicaAssignment.WithErr(fmt.Errorf("partition %d has no replicas", id))
+		}
+		if replicationFactor == -1 {
+			replicationFactor = len(replicas)
+		} else if len(replicas) != replicationFactor {
+			return protocol.ErrInvalidReplicaAssignment.WithErr(fmt.Errorf("partition %d has %d replicas, partition 0 has %d", id, len(replicas), replicationFactor))
+		}
+		seen := make(map[int32]bool, len(replicas))
+		for _, r := range replicas {
+			if seen[r] {
+				return protocol.ErrInvalidReplicaAssignment.WithErr(fmt.Errorf("partition %d has broker %d assigned more than once", id, r))
+			}
+			seen[r] = true
+			if !live[r] {
+				return protocol.ErrInvalidReplicaAssignment.WithErr(fmt.Errorf("partition %d is assigned to broker %d, which isn't live or is in maintenance", id, r))
+			}
+		}
+	}
+	return protocol.ErrNone
+}
+
+// assignedPartitions returns the topic's partitions with the replicas they're
+// assigned, led by their first replica.
+func assignedPartitions(topic string, assignment map[int32][]int32) []structs.Partition {
+	partitions := make([]structs.Partition, 0, len(assignment))
+	for id, replicas := range assignment {
+		partitions = append(partitions, structs.Partition{
+			Topic:     topic,
+			ID:        id,
+			Partition: id,
+			Leader:    replicas[0],
+			AR:        replicas,
+			ISR:       replicas,
+		})
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].ID < partitions[j].ID })
+	return partitions
+}
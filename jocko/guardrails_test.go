@@ -0,0 +1,49 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestValidateTopicLayout(t *testing.T) {
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	require.NoError(t, err)
+	b := &Broker{fsm: f, brokerLookup: NewBrokerLookup()}
+	for _, id := range []metadata.NodeID{1, 2, 3} {
+		b.brokerLookup.AddBroker(&metadata.Broker{ID: id, RaftAddr: "broker-" + id.String()})
+	}
+	// broker 3's failed
+	buf, err := structs.Encode(structs.RegisterNodeRequestType, structs.RegisterNodeRequest{
+		Node: structs.Node{Node: 3, Check: &structs.HealthCheck{Status: structs.HealthCritical}},
+	})
+	require.NoError(t, err)
+	f.Apply(&raft.Log{Data: buf})
+
+	tests := []struct {
+		name string
+		req  *protocol.CreateTopicRequest
+		code int16
+	}{
+		{"ok", &protocol.CreateTopicRequest{NumPartitions: 3, ReplicationFactor: 2}, protocol.ErrNone.Code()},
+		{"no partitions", &protocol.CreateTopicRequest{NumPartitions: 0, ReplicationFactor: 1}, protocol.ErrInvalidPartitions.Code()},
+		{"rf larger than live brokers", &protocol.CreateTopicRequest{NumPartitions: 1, ReplicationFactor: 3}, protocol.ErrInvalidReplicationFactor.Code()},
+		{"assigned", &protocol.CreateTopicRequest{ReplicaAssignment: map[int32][]int32{0: {1, 2}, 1: {2, 1}}}, protocol.ErrNone.Code()},
+		{"assigned to failed broker", &protocol.CreateTopicRequest{ReplicaAssignment: map[int32][]int32{0: {1, 3}}}, protocol.ErrInvalidReplicaAssignment.Code()},
+		{"assigned to unknown broker", &protocol.CreateTopicRequest{ReplicaAssignment: map[int32][]int32{0: {4}}}, protocol.ErrInvalidReplicaAssignment.Code()},
+		{"assigned twice", &protocol.CreateTopicRequest{ReplicaAssignment: map[int32][]int32{0: {1, 1}}}, protocol.ErrInvalidReplicaAssignment.Code()},
+		{"uneven replicas", &protocol.CreateTopicRequest{ReplicaAssignment: map[int32][]int32{0: {1, 2}, 1: {1}}}, protocol.ErrInvalidReplicaAssignment.Code()},
+		{"gap in partitions", &protocol.CreateTopicRequest{ReplicaAssignment: map[int32][]int32{0: {1}, 2: {2}}}, protocol.ErrInvalidReplicaAssignment.Code()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.code, b.validateTopicLayout(test.req).Code())
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package jocko
+
+import (
+	"sync"
+
+	"github.com/travisjeffery/jocko/jocko/structs"
+)
+
+// hooks are the funcs applications embedding the broker registered to be
+// called at points in its life, e.g. to warm caches, register with service
+// discovery, or drain clients. They're called synchronously so the broker waits
+// on them.
+type hooks struct {
+	mu               sync.Mutex
+	started          []func()
+	becameController []func()
+	leadershipChange []func(partition structs.Partition, leader bool)
+	beforeShutdown   []func()
+	interceptors     []AppendInterceptor
+
+	isStarted    bool
+	isController bool
+	shuttingDown bool
+}
+
+// OnStarted registers fn to be called when the broker starts handling
+// requests, or right away if it already has.
+func (b *Broker) OnStarted(fn func()) {
+	b.hooks.mu.Lock()
+	b.hooks.started = append(b.hooks.started, fn)
+	started := b.hooks.isStarted
+	b.hooks.mu.Unlock()
+	if started {
+		fn()
+	}
+}
+
+// OnBecameController registers fn to be called when the broker becomes the
+// cluster's controller, or right away if it already is.
+func (b *Broker) OnBecameController(fn func()) {
+	b.hooks.mu.Lock()
+	b.hooks.becameController = append(b.hooks.becameController, fn)
+	controller := b.hooks.isController
+	b.hooks.mu.Unlock()
+	if controller {
+		fn()
+	}
+}
+
+// OnPartitionLeadershipChange registers fn to be called when the broker becomes
+// a partition's leader, or one of its followers.
+func (b *Broker) OnPartitionLeadershipChange(fn func(partition structs.Partition, leader bool)) {
+	b.hooks.mu.Lock()
+	b.hooks.leadershipChange = append(b.hooks.leadershipChange, fn)
+	b.hooks.mu.Unlock()
+}
+
+// BeforeShutdown registers fn to be called when the broker starts shutting
+// down. It's called while the broker still handles requests, so it can drain
+// clients before they're disconnected.
+func (b *Broker) BeforeShutdown(fn func()) {
+	b.hooks.mu.Lock()
+	b.hooks.beforeShutdown = append(b.hooks.beforeShutdown, fn)
+	b.hooks.mu.Unlock()
+}
+
+func (h *hooks) runStarted() {
+	h.mu.Lock()
+	h.isStarted = true
+	fns := append([]func(){}, h.started...)
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+func (h *hooks) runBecameController() {
+	h.mu.Lock()
+	h.isController = true
+	fns := append([]func(){}, h.becameController...)
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+func (h *hooks) lostController() {
+	h.mu.Lock()
+	h.isController = false
+	h.mu.Unlock()
+}
+
+func (h *hooks) runLeadershipChange(partition structs.Partition, leader bool) {
+	h.mu.Lock()
+	fns := append([]func(structs.Partition, bool){}, h.leadershipChange...)
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn(partition, leader)
+	}
+}
+
+// runBeforeShutdown calls the before shutdown hooks the first time it's
+// called.
+func (h *hooks) runBeforeShutdown() {
+	h.mu.Lock()
+	if h.shuttingDown {
+		h.mu.Unlock()
+		return
+	}
+	h.shuttingDown = true
+	fns := append([]func(){}, h.beforeShutdown...)
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// beforeShutdown has the server call the broker's before shutdown hooks before
+// it stops handling requests.
+func (b *Broker) beforeShutdown() {
+	b.hooks.runBeforeShutdown()
+}
@@ -0,0 +1,40 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/structs"
+)
+
+func TestHooks(t *testing.T) {
+	b := &Broker{}
+	var calls []string
+	b.OnStarted(func() { calls = append(calls, "started") })
+	b.OnBecameController(func() { calls = append(calls, "controller") })
+	b.OnPartitionLeadershipChange(func(p structs.Partition, leader bool) {
+		if leader {
+			calls = append(calls, "leader "+p.Topic)
+		} else {
+			calls = append(calls, "follower "+p.Topic)
+		}
+	})
+	b.BeforeShutdown(func() { calls = append(calls, "shutdown") })
+
+	b.hooks.runStarted()
+	b.hooks.runBecameController()
+	b.hooks.runLeadershipChange(structs.Partition{Topic: "a"}, true)
+	b.hooks.runLeadershipChange(structs.Partition{Topic: "b"}, false)
+	b.hooks.runBeforeShutdown()
+	b.hooks.runBeforeShutdown()
+	require.Equal(t, []string{"started", "controller", "leader a", "follower b", "shutdown"}, calls)
+
+	// hooks registered late are called right away if the broker's already
+	// started or the controller
+	calls = nil
+	b.OnStarted(func() { calls = append(calls, "late started") })
+	b.OnBecameController(func() { calls = append(calls, "late controller") })
+	b.hooks.lostController()
+	b.OnBecameController(func() { calls = append(calls, "not controller") })
+	require.Equal(t, []string{"late started", "late controller"}, calls)
+}
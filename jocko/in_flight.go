@@ -0,0 +1,75 @@
+package jocko
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// inFlightRequest tracks a request from when it's read until its response is
+// written or it times out, whichever's first.
+type inFlightRequest struct {
+	once sync.Once
+	// slots is the request's connection's in flight requests, nil if they
+	// aren't limited.
+	slots  chan struct{}
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+// finish frees the request's slot and returns whether this call finished it.
+// It's finished once, so a response to a request that timed out is dropped.
+func (r *inFlightRequest) finish() (finished bool) {
+	r.once.Do(func() {
+		finished = true
+		if r.slots != nil {
+			<-r.slots
+		}
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		if r.cancel != nil {
+			r.cancel()
+		}
+	})
+	return finished
+}
+
+// timeOut responds to the request with a request timed out error if it hasn't
+// been responded to yet. The request's context is canceled so its handler
+// can give up, and the handler's response is dropped when it's done. A request
+// there's no timed out response for is left to its handler, so its place in
+// the connection's responses is still filled.
+func (s *Server) timeOut(reqCtx *Context, r *inFlightRequest) {
+	req, ok := reqCtx.req.(protocol.Body)
+	if !ok {
+		return
+	}
+	body := protocol.ErrorResponse(req, protocol.ErrRequestTimedOut)
+	if body == nil {
+		return
+	}
+	if !r.finish() {
+		return
+	}
+	log.Info.Printf("server/%d: request timed out after %s: %s", s.config.ID, s.config.RequestTimeout, reqCtx)
+	span := opentracing.SpanFromContext(reqCtx)
+	span.LogKV("msg", "request timed out")
+	s.responseCh <- &Context{
+		// the response takes the request's place in the connection's
+		// responses so it's written in order
+		parent: context.WithValue(opentracing.ContextWithSpan(s.ctx, span), responseSlotKey, reqCtx.Value(responseSlotKey)),
+		conn:   reqCtx.conn,
+		client: reqCtx.client,
+		header: reqCtx.header,
+		req:    reqCtx.req,
+		res: &protocol.Response{
+			CorrelationID: reqCtx.header.CorrelationID,
+			Body:          body,
+		},
+	}
+}
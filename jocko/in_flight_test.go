@@ -0,0 +1,58 @@
+package jocko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestInFlightRequestFinish(t *testing.T) {
+	slots := make(chan struct{}, 1)
+	slots <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &inFlightRequest{slots: slots, cancel: cancel}
+	require.True(t, r.finish())
+	require.Equal(t, 0, len(slots))
+	require.Error(t, ctx.Err())
+	// a late response's dropped
+	require.False(t, r.finish())
+}
+
+func TestServerTimeOut(t *testing.T) {
+	s := &Server{
+		config:     &config.Config{RequestTimeout: time.Second},
+		responseCh: make(chan *Context, 1),
+		ctx:        context.Background(),
+	}
+	span := opentracing.NoopTracer{}.StartSpan("request")
+	slot := newResponseOrder().slot()
+	reqCtx := &Context{
+		parent: context.WithValue(opentracing.ContextWithSpan(context.Background(), span), responseSlotKey, slot),
+		header: &protocol.RequestHeader{CorrelationID: 7},
+		req:    &protocol.HeartbeatRequest{APIVersion: 1},
+	}
+	r := &inFlightRequest{}
+	s.timeOut(reqCtx, r)
+	respCtx := <-s.responseCh
+	// the response keeps the request's place in the connection's responses
+	require.Equal(t, slot, respCtx.Value(responseSlotKey))
+	res := respCtx.res.(*protocol.Response)
+	require.Equal(t, int32(7), res.CorrelationID)
+	require.Equal(t, &protocol.HeartbeatResponse{APIVersion: 1, ErrorCode: protocol.ErrRequestTimedOut.Code()}, res.Body)
+
+	// the handler's response is dropped, as is a second timeout
+	require.False(t, r.finish())
+	s.timeOut(reqCtx, r)
+	require.Equal(t, 0, len(s.responseCh))
+
+	// a request without a timed out response is left to its handler
+	r = &inFlightRequest{}
+	s.timeOut(&Context{parent: context.Background(), header: &protocol.RequestHeader{}}, r)
+	require.Equal(t, 0, len(s.responseCh))
+	require.True(t, r.finish())
+}
@@ -0,0 +1,262 @@
+package jocko
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// interBrokerHandshakeTimeout is how long a broker connecting to serf's TCP
+// stream has to finish its TLS handshake.
+const interBrokerHandshakeTimeout = 10 * time.Second
+
+// interBrokerTLSConfig loads the broker's certificate and the CAs that sign
+// brokers' certificates. The config's used to both serve and connect, and
+// requires the other end to present a certificate for an allowed identity.
+func interBrokerTLSConfig(c *config.InterBrokerTLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load inter-broker certificate %s failed", c.CertFile)
+	}
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read inter-broker CA file failed")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates in inter-broker CA file %s", c.CAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		// brokers are dialed by address, which their certificates needn't
+		// name, and may not have client auth key usage, so both ends verify
+		// the chain against the CAs with verifyBrokerCertificate instead
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyBrokerCertificate(pool, c.AllowedIdentities),
+	}, nil
+}
+
+// validateInterBrokerTLS checks that nothing's left for brokers to reach each
+// other over in the clear: they connect on the inter-broker listener, since a
+// broker without one is dialed on its plaintext address, and serf's gossip,
+// which its TLS doesn't cover, is encrypted.
+func validateInterBrokerTLS(c *config.Config) error {
+	if c.InterBrokerTLS.Listener == "" {
+		return errors.New("inter-broker TLS requires an inter-broker listener")
+	}
+	if _, ok := interBrokerListener(c); !ok {
+		return errors.Errorf("inter-broker listener %s isn't one of the broker's listeners", c.InterBrokerTLS.Listener)
+	}
+	if c.SerfLANConfig == nil || c.SerfLANConfig.MemberlistConfig == nil || len(c.SerfLANConfig.MemberlistConfig.SecretKey) == 0 {
+		return errors.New("inter-broker TLS requires a serf gossip encryption key")
+	}
+	return nil
+}
+
+// interBrokerAPI returns whether the request is one only brokers send each
+// other: the controller's requests, transactions' markers, and replicas'
+// fetches.
+func interBrokerAPI(req interface{}) bool {
+	switch req := req.(type) {
+	case *protocol.LeaderAndISRRequest, *protocol.StopReplicaRequest, *protocol.UpdateMetadataRequest, *protocol.ControlledShutdownRequest, *protocol.WriteTxnMarkersRequest:
+		return true
+	case *protocol.FetchRequest:
+		return req.ReplicaID >= 0
+	}
+	return false
+}
+
+// interBrokerAllowed returns whether the request can be served on the listener
+// it came in on. With inter-broker TLS, brokers' requests are only served on
+// the inter-broker listener, whose clients have proved they're brokers.
+func interBrokerAllowed(c *config.Config, listener string, req interface{}) bool {
+	if c.InterBrokerTLS == nil || !interBrokerAPI(req) {
+		return true
+	}
+	return listener == c.InterBrokerTLS.Listener
+}
+
+// verifyBrokerCertificate returns a function checking that a peer's certificate
+// is signed by one of the CAs and names one of the allowed identities.
+func verifyBrokerCertificate(pool *x509.CertPool, allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	identities := make(map[string]bool, len(allowed))
+	for _, id := range allowed {
+		identities[id] = true
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no broker certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.Wrap(err, "parse broker certificate failed")
+			}
+			certs[i] = cert
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return errors.Wrap(err, "verify broker certificate failed")
+		}
+		if len(identities) == 0 {
+			return nil
+		}
+		names := certificateNames(certs[0])
+		for _, name := range names {
+			if identities[name] {
+				return nil
+			}
+		}
+		return errors.Errorf("broker identity %v not allowed", names)
+	}
+}
+
+// tlsStreamLayer is a raft stream layer over mutual TLS.
+type tlsStreamLayer struct {
+	net.Listener
+	config *tls.Config
+}
+
+func newTLSStreamLayer(addr string, config *tls.Config) (*tlsStreamLayer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsStreamLayer{Listener: tls.NewListener(ln, config), config: config}, nil
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), l.config)
+}
+
+// tlsMemberlistTransport is memberlist's transport with its TCP streams, which
+// nodes join and push and pull their state over, over mutual TLS. Its UDP
+// packets are left to memberlist's gossip encryption.
+type tlsMemberlistTransport struct {
+	*memberlist.NetTransport
+	config     *tls.Config
+	streamCh   chan net.Conn
+	shutdownCh chan struct{}
+}
+
+func newTLSMemberlistTransport(mc *memberlist.Config, config *tls.Config) (*tlsMemberlistTransport, error) {
+	nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{mc.BindAddr},
+		BindPort:  mc.BindPort,
+		Logger:    mc.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &tlsMemberlistTransport{
+		NetTransport: nt,
+		config:       config,
+		streamCh:     make(chan net.Conn),
+		shutdownCh:   make(chan struct{}),
+	}
+	go t.accept()
+	return t, nil
+}
+
+// accept handshakes the streams accepted by the underlying transport and
+// passes on those from brokers with allowed certificates.
+func (t *tlsMemberlistTransport) accept() {
+	for {
+		select {
+		case conn := <-t.NetTransport.StreamCh():
+			go t.handshake(conn)
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+func (t *tlsMemberlistTransport) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, t.config)
+	tlsConn.SetDeadline(time.Now().Add(interBrokerHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Error.Printf("memberlist: tls handshake with %s error: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	select {
+	case t.streamCh <- tlsConn:
+	case <-t.shutdownCh:
+		conn.Close()
+	}
+}
+
+func (t *tlsMemberlistTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+func (t *tlsMemberlistTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.NetTransport.DialTimeout(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, t.config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (t *tlsMemberlistTransport) Shutdown() error {
+	close(t.shutdownCh)
+	return t.NetTransport.Shutdown()
+}
+
+// listen listens on the listener, with the inter-broker TLS config rather than
+// its own if it's the inter-broker listener.
+func (s *Server) listen(lc config.ListenerConfig) (net.Listener, error) {
+	c := s.config.InterBrokerTLS
+	if c == nil || c.Listener != lc.Name {
+		return listen(lc)
+	}
+	tlsConfig, err := interBrokerTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", lc.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// interBrokerListener returns the config's inter-broker listener, if it has one.
+func interBrokerListener(c *config.Config) (config.ListenerConfig, bool) {
+	if c.InterBrokerTLS == nil || c.InterBrokerTLS.Listener == "" {
+		return config.ListenerConfig{}, false
+	}
+	for _, lc := range c.Listeners {
+		if lc.Name == c.InterBrokerTLS.Listener {
+			return lc, true
+		}
+	}
+	return config.ListenerConfig{}, false
+}
@@ -0,0 +1,98 @@
+package jocko
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestValidateInterBrokerTLS(t *testing.T) {
+	c := &config.Config{
+		Listeners:      []config.ListenerConfig{{Name: "BROKER", Addr: "localhost:9095"}},
+		InterBrokerTLS: &config.InterBrokerTLSConfig{},
+		SerfLANConfig:  &serf.Config{MemberlistConfig: &memberlist.Config{}},
+	}
+	require.Error(t, validateInterBrokerTLS(c), "no listener")
+	c.InterBrokerTLS.Listener = "OTHER"
+	require.Error(t, validateInterBrokerTLS(c), "unknown listener")
+	c.InterBrokerTLS.Listener = "BROKER"
+	require.Error(t, validateInterBrokerTLS(c), "no gossip key")
+	c.SerfLANConfig.MemberlistConfig.SecretKey = make([]byte, 32)
+	require.NoError(t, validateInterBrokerTLS(c))
+}
+
+func TestInterBrokerAllowed(t *testing.T) {
+	c := &config.Config{InterBrokerTLS: &config.InterBrokerTLSConfig{Listener: "BROKER"}}
+	for _, req := range []interface{}{
+		&protocol.LeaderAndISRRequest{},
+		&protocol.StopReplicaRequest{},
+		&protocol.UpdateMetadataRequest{},
+		&protocol.ControlledShutdownRequest{},
+		&protocol.FetchRequest{ReplicaID: 1},
+	} {
+		require.False(t, interBrokerAllowed(c, defaultListener, req), "%T", req)
+		require.True(t, interBrokerAllowed(c, "BROKER", req), "%T", req)
+		require.True(t, interBrokerAllowed(&config.Config{}, defaultListener, req), "%T", req)
+	}
+	require.True(t, interBrokerAllowed(c, defaultListener, &protocol.FetchRequest{ReplicaID: -1}))
+	require.True(t, interBrokerAllowed(c, defaultListener, &protocol.ProduceRequest{}))
+}
+
+func TestVerifyBrokerCertificate(t *testing.T) {
+	ca, caKey := testCertificate(t, "ca", nil, nil)
+	other, otherKey := testCertificate(t, "other-ca", nil, nil)
+	broker1, _ := testCertificate(t, "broker-1", ca, caKey)
+	broker2, _ := testCertificate(t, "broker-2", ca, caKey)
+	imposter, _ := testCertificate(t, "broker-1", other, otherKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	verify := verifyBrokerCertificate(pool, nil)
+	require.NoError(t, verify([][]byte{broker1.Raw}, nil))
+	require.NoError(t, verify([][]byte{broker2.Raw}, nil))
+	require.Error(t, verify([][]byte{imposter.Raw}, nil))
+	require.Error(t, verify(nil, nil))
+
+	verify = verifyBrokerCertificate(pool, []string{"broker-1"})
+	require.NoError(t, verify([][]byte{broker1.Raw}, nil))
+	require.Error(t, verify([][]byte{broker2.Raw}, nil))
+	require.Error(t, verify([][]byte{imposter.Raw}, nil))
+}
+
+// testCertificate returns a certificate for the name signed by the parent, or
+// a self-signed CA certificate if parent's nil.
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
@@ -0,0 +1,225 @@
+package jocko
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// AppendInfo describes the record set being appended.
+type AppendInfo struct {
+	Topic     string
+	Partition int32
+	// Client is the client that produced the records.
+	Client *ClientInfo
+}
+
+// AppendRecord is a record being appended to a partition. The log's message
+// format has no record headers, so interceptors annotate records by changing
+// their key, value, or timestamp, e.g. wrapping the value in an envelope with
+// the tenant.
+type AppendRecord struct {
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+}
+
+// AppendInterceptor is called with the records produced to a partition after
+// they're validated and before they're written to the log. It can change the
+// records, or veto them by returning an error, which rejects their batch with
+// an invalid record error. Records in compressed batches are decompressed for
+// it, and recompressed with the same codec if it changes them.
+type AppendInterceptor interface {
+	InterceptAppend(info *AppendInfo, records []*AppendRecord) error
+}
+
+// AppendInterceptorFunc is a func used as an append interceptor.
+type AppendInterceptorFunc func(info *AppendInfo, records []*AppendRecord) error
+
+func (f AppendInterceptorFunc) InterceptAppend(info *AppendInfo, records []*AppendRecord) error {
+	return f(info, records)
+}
+
+// AddAppendInterceptor adds the interceptor to the end of the broker's chain.
+// Interceptors are called in the order they're added, each with the records
+// as the one before left them, until one vetoes them.
+func (b *Broker) AddAppendInterceptor(i AppendInterceptor) {
+	b.hooks.mu.Lock()
+	b.hooks.interceptors = append(b.hooks.interceptors, i)
+	b.hooks.mu.Unlock()
+}
+
+// interceptAppend runs the interceptors over each message set in the record
+// set and returns the record set with the sets they changed re-encoded. It
+// returns the error for the first message set they vetoed.
+func (b *Broker) interceptAppend(info *AppendInfo, recordSet []byte) ([]byte, *protocol.RecordError) {
+	b.hooks.mu.Lock()
+	interceptors := b.hooks.interceptors
+	b.hooks.mu.Unlock()
+	if len(interceptors) == 0 {
+		return recordSet, nil
+	}
+	var out []byte
+	for i, ms := range commitlog.MessageSets(recordSet) {
+		changed, err := interceptMessages(interceptors, info, ms.Messages())
+		if err != nil {
+			msg := err.Error()
+			return nil, &protocol.RecordError{BatchIndex: int32(i), BatchIndexErrorMessage: &msg}
+		}
+		if changed == nil {
+			out = append(out, ms...)
+			continue
+		}
+		out = append(out, commitlog.NewMessageSet(uint64(ms.Offset()), changed...)...)
+	}
+	return out, nil
+}
+
+// interceptMessages runs the interceptors over the messages' records and
+// returns the messages re-encoded, or nil if none of them changed. A
+// compressed message's records are intercepted on their own.
+func interceptMessages(interceptors []AppendInterceptor, info *AppendInfo, msgs []commitlog.Message) ([]commitlog.Message, error) {
+	var records []*AppendRecord
+	for _, m := range msgs {
+		if m.Compressed() {
+			return interceptEach(interceptors, info, msgs)
+		}
+		r := &AppendRecord{Key: m.Key(), Value: m.Value()}
+		if m.MagicByte() > 0 {
+			r.Timestamp = time.Unix(0, m.Timestamp()*int64(time.Millisecond))
+		}
+		records = append(records, r)
+	}
+	for _, interceptor := range interceptors {
+		if err := interceptor.InterceptAppend(info, records); err != nil {
+			return nil, err
+		}
+	}
+	return reencodeMessages(msgs, records)
+}
+
+// interceptEach intercepts the messages one at a time, for message sets that
+// mix compressed messages with others.
+func interceptEach(interceptors []AppendInterceptor, info *AppendInfo, msgs []commitlog.Message) ([]commitlog.Message, error) {
+	out := make([]commitlog.Message, 0, len(msgs))
+	changed := false
+	for _, m := range msgs {
+		var c []commitlog.Message
+		var err error
+		if m.Compressed() {
+			c, err = interceptCompressed(interceptors, info, m)
+		} else {
+			c, err = interceptMessages(interceptors, info, []commitlog.Message{m})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			out = append(out, m)
+			continue
+		}
+		changed = true
+		out = append(out, c...)
+	}
+	if !changed {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// interceptCompressed runs the interceptors over the records compressed in
+// the message, all at once, and returns the message recompressed with the
+// same codec, or nil if none of them changed.
+func interceptCompressed(interceptors []AppendInterceptor, info *AppendInfo, m commitlog.Message) ([]commitlog.Message, error) {
+	sets, err := m.DecompressLimit(maxDecompressedBytes)
+	if err != nil {
+		return nil, err
+	}
+	var records []*AppendRecord
+	for _, ms := range sets {
+		for _, im := range ms.Messages() {
+			r := &AppendRecord{Key: im.Key(), Value: im.Value()}
+			if im.MagicByte() > 0 {
+				r.Timestamp = time.Unix(0, im.Timestamp()*int64(time.Millisecond))
+			}
+			records = append(records, r)
+		}
+	}
+	for _, interceptor := range interceptors {
+		if err := interceptor.InterceptAppend(info, records); err != nil {
+			return nil, err
+		}
+	}
+	var value []byte
+	changed := false
+	for _, ms := range sets {
+		msgs := ms.Messages()
+		c, err := reencodeMessages(msgs, records[:len(msgs)])
+		if err != nil {
+			return nil, err
+		}
+		records = records[len(msgs):]
+		if c == nil {
+			value = append(value, ms...)
+			continue
+		}
+		changed = true
+		// the inner sets keep their offsets, relative to the wrapper's
+		value = append(value, commitlog.NewMessageSet(uint64(ms.Offset()), c...)...)
+	}
+	if !changed {
+		return nil, nil
+	}
+	compressed, err := commitlog.Compress(m.Codec(), value)
+	if err != nil {
+		return nil, err
+	}
+	wrapper := &protocol.Message{
+		MagicByte:  m.MagicByte(),
+		Attributes: m.Attributes(),
+		Key:        m.Key(),
+		Value:      compressed,
+	}
+	if m.MagicByte() > 0 {
+		wrapper.Timestamp = time.Unix(0, m.Timestamp()*int64(time.Millisecond))
+	}
+	b, err := protocol.Encode(wrapper)
+	if err != nil {
+		return nil, err
+	}
+	return []commitlog.Message{b}, nil
+}
+
+// reencodeMessages returns the messages encoded with the records' keys, values,
+// and timestamps, or nil if none of them changed.
+func reencodeMessages(msgs []commitlog.Message, records []*AppendRecord) ([]commitlog.Message, error) {
+	same := true
+	for i, m := range msgs {
+		r := records[i]
+		if !bytes.Equal(m.Key(), r.Key) || !bytes.Equal(m.Value(), r.Value) ||
+			(m.MagicByte() > 0 && m.Timestamp() != r.Timestamp.UnixNano()/int64(time.Millisecond)) {
+			same = false
+			break
+		}
+	}
+	if same {
+		return nil, nil
+	}
+	changed := make([]commitlog.Message, 0, len(records))
+	for i, m := range msgs {
+		b, err := protocol.Encode(&protocol.Message{
+			MagicByte:  m.MagicByte(),
+			Attributes: m.Attributes(),
+			Timestamp:  records[i].Timestamp,
+			Key:        records[i].Key,
+			Value:      records[i].Value,
+		})
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, b)
+	}
+	return changed, nil
+}
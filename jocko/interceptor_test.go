@@ -0,0 +1,78 @@
+package jocko
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestInterceptAppend(t *testing.T) {
+	req := require.New(t)
+	b := &Broker{}
+	b.AddAppendInterceptor(AppendInterceptorFunc(func(info *AppendInfo, records []*AppendRecord) error {
+		for _, r := range records {
+			if string(r.Key) == "bad" {
+				return fmt.Errorf("vetoed")
+			}
+			r.Value = bytes.ToUpper(r.Value)
+		}
+		return nil
+	}))
+	b.AddAppendInterceptor(AppendInterceptorFunc(func(info *AppendInfo, records []*AppendRecord) error {
+		for _, r := range records {
+			r.Value = append([]byte(info.Topic+":"), r.Value...)
+		}
+		return nil
+	}))
+
+	ts := time.Unix(1500000000, 0)
+	messageSet := func(key, value string) []byte {
+		msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: ts, Key: []byte(key), Value: []byte(value)})
+		req.NoError(err)
+		return commitlog.NewMessageSet(0, msg)
+	}
+	info := &AppendInfo{Topic: "test-topic"}
+
+	out, recordErr := b.interceptAppend(info, append(messageSet("a", "hello"), messageSet("b", "world")...))
+	req.Nil(recordErr)
+	var values []string
+	for _, ms := range commitlog.MessageSets(out) {
+		for _, m := range ms.Messages() {
+			values = append(values, string(m.Value()))
+			req.Equal(ts.UnixNano()/int64(time.Millisecond), m.Timestamp())
+		}
+	}
+	req.Equal([]string{"test-topic:HELLO", "test-topic:WORLD"}, values)
+
+	_, recordErr = b.interceptAppend(info, append(messageSet("a", "hello"), messageSet("bad", "world")...))
+	req.NotNil(recordErr)
+	req.Equal(int32(1), recordErr.BatchIndex)
+	req.Equal("vetoed", *recordErr.BatchIndexErrorMessage)
+
+	// compressed sets are decompressed for the interceptors and recompressed
+	out, recordErr = b.interceptAppend(info, commitlog.NewMessageSet(0, gzipMessage(t, "c", "d")))
+	req.Nil(recordErr)
+	sets := commitlog.MessageSets(out)
+	req.Len(sets, 1)
+	wrapper := sets[0].Messages()[0]
+	req.Equal(int8(commitlog.CompressionGZIP), wrapper.Codec())
+	inner, err := wrapper.Decompress()
+	req.NoError(err)
+	values = nil
+	for i, ms := range inner {
+		req.Equal(int64(i), ms.Offset())
+		for _, m := range ms.Messages() {
+			values = append(values, string(m.Value()))
+		}
+	}
+	req.Equal([]string{"test-topic:VALUE", "test-topic:VALUE"}, values)
+
+	_, recordErr = b.interceptAppend(info, commitlog.NewMessageSet(0, gzipMessage(t, "c", "bad")))
+	req.NotNil(recordErr)
+	req.Equal("vetoed", *recordErr.BatchIndexErrorMessage)
+}
@@ -21,32 +21,68 @@ const (
 	barrierWriteTimeout = 2 * time.Minute
 )
 
+// setupCluster sets up the store the broker shares the cluster's metadata
+// with, the one newStore opens or raft if it's nil.
+func (b *Broker) setupCluster(newStore MetadataStoreFactory) (err error) {
+	b.fsm, err = fsm.New(b.tracer, fsm.NodeID(b.config.ID))
+	if err != nil {
+		return err
+	}
+	if newStore == nil {
+		s, err := b.setupRaft()
+		if err != nil {
+			return err
+		}
+		b.store, b.cluster = s, s
+		return nil
+	}
+	store, err := newStore(b.fsm)
+	if err != nil {
+		return err
+	}
+	cluster, ok := store.(ClusterMetadataStore)
+	if !ok {
+		store.Close()
+		return fmt.Errorf("metadata store %T can't be shared by a cluster, run standalone to use it", store)
+	}
+	b.store, b.cluster = store, cluster
+	return nil
+}
+
 // setupRaft is used to setup and initialize Raft.
-func (b *Broker) setupRaft() (err error) {
+func (b *Broker) setupRaft() (_ *raftMetadataStore, err error) {
+	s := &raftMetadataStore{}
 	// If we have an unclean exit then attempt to close the Raft store.
 	defer func() {
-		if b.raft == nil && b.raftStore != nil {
-			if err := b.raftStore.Close(); err != nil {
+		if s.raft == nil && s.bolt != nil {
+			if err := s.bolt.Close(); err != nil {
 				log.Error.Printf("leader/%d: close raft store error: %s", b.config.ID, err)
 			}
 		}
+		if s.raft == nil && s.transport != nil {
+			s.transport.Close()
+		}
 	}()
 
-	b.fsm, err = fsm.New(b.tracer, fsm.NodeID(b.config.ID))
-	if err != nil {
-		return err
-	}
-
-	trans, err := raft.NewTCPTransport(b.config.RaftAddr,
-		nil,
-		3,
-		10*time.Second,
-		nil,
-	)
-	if err != nil {
-		return err
+	var trans *raft.NetworkTransport
+	if b.interBrokerTLS != nil {
+		stream, err := newTLSStreamLayer(b.config.RaftAddr, b.interBrokerTLS)
+		if err != nil {
+			return nil, err
+		}
+		trans = raft.NewNetworkTransport(stream, 3, 10*time.Second, nil)
+	} else {
+		trans, err = raft.NewTCPTransport(b.config.RaftAddr,
+			nil,
+			3,
+			10*time.Second,
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
 	}
-	b.raftTransport = trans
+	s.transport = trans
 
 	b.config.RaftConfig.LocalID = raft.ServerID(fmt.Sprintf("%d", b.config.ID))
 	b.config.RaftConfig.StartAsLeader = b.config.StartAsLeader
@@ -57,33 +93,33 @@ func (b *Broker) setupRaft() (err error) {
 	var snap raft.SnapshotStore
 	if b.config.DevMode {
 		store := raft.NewInmemStore()
-		b.raftInmem = store
+		s.inmem = store
 		stable = store
 		logStore = store
 		snap = raft.NewInmemSnapshotStore()
 	} else {
 		path := filepath.Join(b.config.DataDir, raftState)
 		if err := ensurePath(path, true); err != nil {
-			return err
+			return nil, err
 		}
 
 		// create the backend raft store for logs and stable storage.
 		store, err := raftboltdb.NewBoltStore(filepath.Join(path, "raft.db"))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		b.raftStore = store
+		s.bolt = store
 		stable = store
 
 		cacheStore, err := raft.NewLogCache(raftLogCacheSize, store)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		logStore = cacheStore
 
 		snapshots, err := raft.NewFileSnapshotStore(path, snapshotsRetained, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		snap = snapshots
 	}
@@ -91,7 +127,7 @@ func (b *Broker) setupRaft() (err error) {
 	if b.config.Bootstrap || b.config.DevMode {
 		hasState, err := raft.HasExistingState(logStore, stable, snap)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if !hasState {
 			configuration := raft.Configuration{
@@ -103,28 +139,32 @@ func (b *Broker) setupRaft() (err error) {
 				},
 			}
 			if err := raft.BootstrapCluster(b.config.RaftConfig, logStore, stable, snap, trans, configuration); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
 	// setup up a channel for reliable leader notifications.
-	raftNotifyCh := make(chan bool, 1)
-	b.config.RaftConfig.NotifyCh = raftNotifyCh
-	b.raftNotifyCh = raftNotifyCh
+	s.notifyCh = make(chan bool, 1)
+	b.config.RaftConfig.NotifyCh = s.notifyCh
 
 	// setup raft store
-	b.raft, err = raft.NewRaft(b.config.RaftConfig, b.fsm, logStore, stable, snap, trans)
-	return err
+	s.raft, err = raft.NewRaft(b.config.RaftConfig, b.fsm, logStore, stable, snap, trans)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func (b *Broker) monitorLeadership() {
-	raftNotifyCh := b.raftNotifyCh
+// monitorLeadership runs the leader loop while this broker's the controller,
+// until stop is closed.
+func (b *Broker) monitorLeadership(stop <-chan struct{}) {
+	leaderCh := b.cluster.LeaderCh()
 	var weAreLeaderCh chan struct{}
 	var leaderLoop sync.WaitGroup
 	for {
 		select {
-		case isLeader := <-raftNotifyCh:
+		case isLeader := <-leaderCh:
 			switch {
 			case isLeader:
 				if weAreLeaderCh != nil {
@@ -150,7 +190,11 @@ func (b *Broker) monitorLeadership() {
 				weAreLeaderCh = nil
 				log.Info.Printf("leader/%d: cluster leadership lost", b.config.ID)
 			}
-		case <-b.shutdownCh:
+		case <-stop:
+			if weAreLeaderCh != nil {
+				close(weAreLeaderCh)
+				leaderLoop.Wait()
+			}
 			return
 		}
 	}
@@ -158,24 +202,29 @@ func (b *Broker) monitorLeadership() {
 
 func (b *Broker) revokeLeadership() error {
 	b.resetConsistentReadReady()
+	b.hooks.lostController()
 	return nil
 }
 
 func (b *Broker) establishLeadership() error {
 	b.setConsistentReadReady()
+	b.hooks.runBecameController()
+	b.publishEvent(ClusterEvent{Type: ControllerChanged})
 	return nil
 }
 
 // leaderLoop runs as long as we are the leader to run various maintenance activities.
 func (b *Broker) leaderLoop(stopCh chan struct{}) {
 	var reconcileCh chan serf.Member
+	// transferCh fires once the election's settled, after which leadership's
+	// handed to a preferred leader on each reconcile
+	var transferCh <-chan time.Time
 	establishedLeader := false
 
 RECONCILE:
 	reconcileCh = nil
 	interval := time.After(b.config.ReconcileInterval)
-	barrier := b.raft.Barrier(barrierWriteTimeout)
-	if err := barrier.Error(); err != nil {
+	if err := b.cluster.Barrier(barrierWriteTimeout); err != nil {
 		log.Error.Printf("leader/%d: wait for barrier error: %s", b.config.ID, err)
 		goto WAIT
 	}
@@ -186,6 +235,7 @@ RECONCILE:
 			goto WAIT
 		}
 		establishedLeader = true
+		transferCh = time.After(b.config.LeaderTransferDelay)
 		defer func() {
 			if err := b.revokeLeadership(); err != nil {
 				log.Error.Printf("leader/%d: revoke leadership error: %s", b.config.ID, err)
@@ -198,6 +248,14 @@ RECONCILE:
 		goto WAIT
 	}
 
+	if err := b.deleteExpiredDelegationTokens(); err != nil {
+		log.Error.Printf("leader/%d: delete expired delegation tokens error: %s", b.config.ID, err)
+	}
+
+	if transferCh == nil {
+		b.transferLeadership()
+	}
+
 	reconcileCh = b.reconcileCh
 
 WAIT:
@@ -205,10 +263,11 @@ WAIT:
 		select {
 		case <-stopCh:
 			return
-		case <-b.shutdownCh:
-			return
 		case <-interval:
 			goto RECONCILE
+		case <-transferCh:
+			transferCh = nil
+			b.transferLeadership()
 		case member := <-reconcileCh:
 			b.reconcileMember(member)
 		}
@@ -309,8 +368,11 @@ func (b *Broker) handleAliveMember(m serf.Member) error {
 			},
 		},
 	}
-	_, err = b.raftApply(structs.RegisterNodeRequestType, &req)
-	return err
+	if _, err = b.raftApply(structs.RegisterNodeRequestType, &req); err != nil {
+		return err
+	}
+	b.publishEvent(brokerEvent(BrokerJoined, meta.ID.Int32(), ""))
+	return nil
 }
 
 func (b *Broker) raftApply(t structs.MessageType, msg interface{}) (interface{}, error) {
@@ -318,11 +380,23 @@ func (b *Broker) raftApply(t structs.MessageType, msg interface{}) (interface{},
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode request: %v", err)
 	}
-	future := b.raft.Apply(buf, 30*time.Second)
-	if err := future.Error(); err != nil {
-		return nil, err
+	return b.store.Apply(buf)
+}
+
+// raftApplyBatch is used to apply the batched requests with a single raft log
+// entry. It returns the error from the first request that failed to apply.
+func (b *Broker) raftApplyBatch(batch *structs.BatchRequest) error {
+	if batch.Len() == 0 {
+		return nil
 	}
-	return future.Response(), nil
+	resp, err := b.raftApply(structs.BatchRequestType, batch)
+	if err != nil {
+		return err
+	}
+	if err, ok := resp.(error); ok {
+		return err
+	}
+	return nil
 }
 
 func (b *Broker) handleLeftMember(m serf.Member) error {
@@ -362,11 +436,17 @@ func (b *Broker) handleDeregisterMember(reason string, member serf.Member) error
 	req := structs.DeregisterNodeRequest{
 		Node: structs.Node{Node: meta.ID.Int32()},
 	}
-	_, err = b.raftApply(structs.DeregisterNodeRequestType, &req)
-	return err
+	if _, err = b.raftApply(structs.DeregisterNodeRequestType, &req); err != nil {
+		return err
+	}
+	b.publishEvent(brokerEvent(BrokerLeft, meta.ID.Int32(), reason))
+	return nil
 }
 
 func (b *Broker) joinCluster(m serf.Member, parts *metadata.Broker) error {
+	if b.cluster == nil {
+		return nil
+	}
 	if parts.Bootstrap {
 		members := b.LANMembers()
 		for _, member := range members {
@@ -378,8 +458,8 @@ func (b *Broker) joinCluster(m serf.Member, parts *metadata.Broker) error {
 		}
 	}
 
-	configFuture := b.raft.GetConfiguration()
-	if err := configFuture.Error(); err != nil {
+	servers, err := b.cluster.Servers()
+	if err != nil {
 		log.Error.Printf("leader/%d: get raft configuration error: %s", b.config.ID, err)
 		return err
 	}
@@ -388,26 +468,26 @@ func (b *Broker) joinCluster(m serf.Member, parts *metadata.Broker) error {
 	// fix up our address, which would make us step down. This is only
 	// safe to attempt if there are multiple servers available.
 	if m.Name == b.config.NodeName {
-		if l := len(configFuture.Configuration().Servers); l < 3 {
+		if l := len(servers); l < 3 {
 			log.Debug.Printf("leader/%d: skipping self join since cluster is too small: servers: %d", b.config.ID, l)
 			return nil
 		}
 	}
 
-	for _, server := range configFuture.Configuration().Servers {
+	for _, server := range servers {
 		if server.Address == raft.ServerAddress(parts.RaftAddr) || server.ID == raft.ServerID(parts.ID.String()) {
 			if server.Address == raft.ServerAddress(parts.RaftAddr) && server.ID == raft.ServerID(parts.ID.String()) {
 				// no-op if this is being called on an existing server
 				return nil
 			}
-			future := b.raft.RemoveServer(server.ID, 0, 0)
+			err := b.cluster.RemoveServer(server.ID)
 			if server.Address == raft.ServerAddress(parts.RaftAddr) {
-				if err := future.Error(); err != nil {
+				if err != nil {
 					return fmt.Errorf("error removing server with duplicate address %q: %s", server.Address, err)
 				}
 				log.Info.Printf("removed server with duplicated address: %s", server.Address)
 			} else {
-				if err := future.Error(); err != nil {
+				if err != nil {
 					return fmt.Errorf("removing server with duplicate ID %q: %s", server.ID, err)
 				}
 				log.Info.Printf("removed server with duplicate ID: %s", server.ID)
@@ -416,15 +496,13 @@ func (b *Broker) joinCluster(m serf.Member, parts *metadata.Broker) error {
 	}
 
 	if parts.NonVoter {
-		addFuture := b.raft.AddNonvoter(raft.ServerID(parts.ID.String()), raft.ServerAddress(parts.RaftAddr), 0, 0)
-		if err := addFuture.Error(); err != nil {
+		if err := b.cluster.AddNonvoter(raft.ServerID(parts.ID.String()), raft.ServerAddress(parts.RaftAddr)); err != nil {
 			log.Error.Printf("leader/%d: add raft peer error: %s", b.config.ID, err)
 			return err
 		}
 	} else {
 		log.Debug.Printf("leader/%d: join cluster: add voter: %s", b.config.ID, parts.ID)
-		addFuture := b.raft.AddVoter(raft.ServerID(parts.ID.String()), raft.ServerAddress(parts.RaftAddr), 0, 0)
-		if err := addFuture.Error(); err != nil {
+		if err := b.cluster.AddVoter(raft.ServerID(parts.ID.String()), raft.ServerAddress(parts.RaftAddr)); err != nil {
 			log.Error.Printf("leader/%d: add raft peer error: %s", b.config.ID, err)
 			return err
 		}
@@ -439,9 +517,18 @@ func (b *Broker) handleFailedMember(m serf.Member) error {
 		return nil
 	}
 
+	state := b.fsm.State()
+
+	// keep the node in maintenance if it was, so it isn't given leaders when
+	// it's back
+	_, existing, err := state.GetNode(meta.ID.Int32())
+	if err != nil {
+		return err
+	}
 	req := structs.RegisterNodeRequest{
 		Node: structs.Node{
-			Node: meta.ID.Int32(),
+			Node:        meta.ID.Int32(),
+			Maintenance: existing != nil && existing.Maintenance,
 			Check: &structs.HealthCheck{
 				Node:    m.Tags["raft_addr"],
 				CheckID: structs.SerfCheckID,
@@ -454,11 +541,10 @@ func (b *Broker) handleFailedMember(m serf.Member) error {
 	if _, err := b.raftApply(structs.RegisterNodeRequestType, &req); err != nil {
 		return err
 	}
+	b.publishEvent(brokerEvent(BrokerFailed, meta.ID.Int32(), ""))
 
 	// TODO should put all the following some where else. maybe onBrokerChange or handleBrokerChange
 
-	state := b.fsm.State()
-
 	_, partitions, err := state.GetPartitions()
 	if err != nil {
 		panic(err)
@@ -477,7 +563,7 @@ func (b *Broker) handleFailedMember(m serf.Member) error {
 	// TODO: add an index for this. have same code in broker.go:handleMetadata(...)
 	var passing []*structs.Node
 	for _, n := range nodes {
-		if n.Check.Status == structs.HealthPassing && n.ID != meta.ID.Int32() {
+		if n.Check.Status == structs.HealthPassing && !n.Maintenance && n.ID != meta.ID.Int32() {
 			passing = append(passing, n)
 		}
 	}
@@ -487,6 +573,8 @@ func (b *Broker) handleFailedMember(m serf.Member) error {
 	if err != nil {
 		return err
 	}
+	// batch the coordinator and leader changes so they're applied with one raft log entry
+	batch := new(structs.BatchRequest)
 	for _, group := range groups {
 		i := rand.Intn(len(passing))
 		node := passing[i]
@@ -494,16 +582,12 @@ func (b *Broker) handleFailedMember(m serf.Member) error {
 		req := structs.RegisterGroupRequest{
 			Group: *group,
 		}
-		if _, err = b.raftApply(structs.RegisterGroupRequestType, req); err != nil {
+		if err = batch.Add(structs.RegisterGroupRequestType, req); err != nil {
 			return err
 		}
 	}
 
-	leaderAndISRReq := &protocol.LeaderAndISRRequest{
-		ControllerID:    b.config.ID,
-		PartitionStates: make([]*protocol.PartitionState, 0, len(partitions)),
-		// TODO: LiveLeaders, ControllerEpoch
-	}
+	changes := make([]structs.Partition, 0, len(partitions))
 	for _, p := range partitions {
 		i := rand.Intn(len(passing))
 		// TODO: check that old leader won't be in this list, will have been deregistered removed from fsm
@@ -526,64 +610,207 @@ func (b *Broker) handleFailedMember(m serf.Member) error {
 
 		// TODO: need to update epochs
 
-		req := structs.RegisterPartitionRequest{
-			Partition: structs.Partition{
-				Topic:     p.Topic,
-				ID:        p.Partition,
-				Partition: p.Partition,
-				Leader:    node.Node,
-				AR:        ar,
-				ISR:       isr,
-			},
-		}
-		if _, err = b.raftApply(structs.RegisterPartitionRequestType, req); err != nil {
-			return err
-		}
-		// TODO: need to send on leader and isr changes now i think
-		leaderAndISRReq.PartitionStates = append(leaderAndISRReq.PartitionStates, &protocol.PartitionState{
+		changes = append(changes, structs.Partition{
 			Topic:     p.Topic,
+			ID:        p.Partition,
 			Partition: p.Partition,
-			// TODO: ControllerEpoch, LeaderEpoch, ZKVersion - lol
-			Leader:   p.Leader,
-			ISR:      p.ISR,
-			Replicas: p.AR,
+			Leader:    node.Node,
+			AR:        ar,
+			ISR:       isr,
 		})
 	}
+	return b.applyLeaderChanges(batch, changes)
+}
 
-	// TODO: optimize this to send requests to only nodes affected
-	for _, n := range passing {
-		broker := b.brokerLookup.BrokerByID(raft.ServerID(fmt.Sprintf("%d", n.Node)))
-		if broker == nil {
-			// TODO: this probably shouldn't happen -- likely a root issue to fix
-			log.Error.Printf("trying to assign partitions to unknown broker: %s", n)
-			continue
+// leaderChanges are the partition leadership changes queued behind the ones
+// the controller's applying, and whether they're being paced out. Its lock's
+// held while changes are applied so a queued change can't overwrite a newer
+// one for the same partition.
+type leaderChanges struct {
+	sync.Mutex
+	pending []structs.Partition
+	running bool
+}
+
+// applyLeaderChanges registers the partitions' new leaders and sends the
+// changes to the brokers replicating them. At most ControllerMaxLeaderChanges
+// partitions are changed at once and the rest are queued and applied in the
+// background, ControllerLeaderChangeInterval apart, so a broker isn't
+// restarting fetchers for every partition at once when many brokers fail
+// together, e.g. when the cluster's restarted. The batch's requests are
+// applied with the first partitions.
+func (b *Broker) applyLeaderChanges(batch *structs.BatchRequest, partitions []structs.Partition) error {
+	size := b.config.ControllerMaxLeaderChanges
+	if size <= 0 || size > len(partitions) {
+		size = len(partitions)
+	}
+	b.leaderChanges.Lock()
+	defer b.leaderChanges.Unlock()
+	b.leaderChanges.pending = replacePartitions(b.leaderChanges.pending, partitions[:size], partitions[size:])
+	b.paceLeaderChanges(true)
+	return b.applyLeaderChangeBatch(batch, partitions[:size])
+}
+
+// queueLeaderChanges queues the partitions' leader changes to be applied in
+// the background, for changes made off a request's path.
+func (b *Broker) queueLeaderChanges(partitions []structs.Partition) {
+	b.leaderChanges.Lock()
+	defer b.leaderChanges.Unlock()
+	b.leaderChanges.pending = replacePartitions(b.leaderChanges.pending, nil, partitions)
+	b.paceLeaderChanges(false)
+}
+
+// paceLeaderChanges starts applying the queued leader changes if they aren't
+// being already, waiting ControllerLeaderChangeInterval first if wait is set.
+// The leader changes' lock must be held.
+func (b *Broker) paceLeaderChanges(wait bool) {
+	if len(b.leaderChanges.pending) == 0 || b.leaderChanges.running {
+		return
+	}
+	b.leaderChanges.running = b.runner.run("leadership", "paced leader changes", func(stop <-chan struct{}) {
+		b.applyQueuedLeaderChanges(stop, wait)
+	})
+}
+
+// applyQueuedLeaderChanges applies the queued leader changes, at most
+// ControllerMaxLeaderChanges every ControllerLeaderChangeInterval, until
+// there are none left or the broker's no longer the controller.
+func (b *Broker) applyQueuedLeaderChanges(stop <-chan struct{}, wait bool) {
+	for ; ; wait = true {
+		if wait {
+			select {
+			case <-time.After(b.config.ControllerLeaderChangeInterval):
+			case <-stop:
+				b.leaderChanges.Lock()
+				b.leaderChanges.running = false
+				b.leaderChanges.Unlock()
+				return
+			}
 		}
-		conn, err := defaultDialer.Dial("tcp", broker.BrokerAddr)
-		if err != nil {
-			return err
+		b.leaderChanges.Lock()
+		if !b.isController() {
+			// the new controller reassigns the partitions itself
+			b.leaderChanges.pending = nil
 		}
-		_, err = conn.LeaderAndISR(leaderAndISRReq)
-		if err != nil {
+		n := b.config.ControllerMaxLeaderChanges
+		if n <= 0 || n > len(b.leaderChanges.pending) {
+			n = len(b.leaderChanges.pending)
+		}
+		if n == 0 {
+			b.leaderChanges.running = false
+			b.leaderChanges.Unlock()
+			return
+		}
+		next := b.leaderChanges.pending[:n]
+		b.leaderChanges.pending = b.leaderChanges.pending[n:]
+		if err := b.applyLeaderChangeBatch(new(structs.BatchRequest), next); err != nil {
+			log.Error.Printf("leader/%d: apply leader changes error: %s", b.config.ID, err)
+		}
+		log.Info.Printf("leader/%d: applied %d leader changes, %d left", b.config.ID, n, len(b.leaderChanges.pending))
+		b.leaderChanges.Unlock()
+	}
+}
+
+// replacePartitions returns the pending changes without those for the
+// applied or queued partitions, followed by the queued ones.
+func replacePartitions(pending, applied, queued []structs.Partition) []structs.Partition {
+	changed := make(map[string]map[int32]bool)
+	for _, ps := range [][]structs.Partition{applied, queued} {
+		for _, p := range ps {
+			if changed[p.Topic] == nil {
+				changed[p.Topic] = make(map[int32]bool)
+			}
+			changed[p.Topic][p.Partition] = true
+		}
+	}
+	var kept []structs.Partition
+	for _, p := range pending {
+		if !changed[p.Topic][p.Partition] {
+			kept = append(kept, p)
+		}
+	}
+	return append(kept, queued...)
+}
+
+// applyLeaderChangeBatch registers the partitions' new leaders with the
+// batch's requests and sends the changes to the brokers replicating them. A
+// broker that can't be sent the changes doesn't stop the others getting them,
+// its error's returned after they have.
+func (b *Broker) applyLeaderChangeBatch(batch *structs.BatchRequest, partitions []structs.Partition) error {
+	// TODO: ControllerEpoch, LeaderEpoch, ZKVersion, LiveLeaders
+	req := &protocol.LeaderAndISRRequest{
+		ControllerID:    b.config.ID,
+		PartitionStates: make([]*protocol.PartitionState, 0, len(partitions)),
+	}
+	brokers := make(map[int32]struct{})
+	var events []ClusterEvent
+	for _, p := range partitions {
+		if err := batch.Add(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{Partition: p}); err != nil {
 			return err
 		}
+		if b.config.PublishClusterEvents {
+			_, prev, err := b.fsm.State().GetPartition(p.Topic, p.Partition)
+			if err != nil {
+				return err
+			}
+			events = append(events, partitionEvents(prev, p)...)
+		}
+		req.PartitionStates = append(req.PartitionStates, &protocol.PartitionState{
+			Topic:     p.Topic,
+			Partition: p.Partition,
+			Leader:    p.Leader,
+			ISR:       p.ISR,
+			Replicas:  p.AR,
+		})
+		brokers[p.Leader] = struct{}{}
+		for _, r := range p.AR {
+			brokers[r] = struct{}{}
+		}
+	}
+	if err := b.raftApplyBatch(batch); err != nil {
+		return err
 	}
+	for _, e := range events {
+		b.publishEvent(e)
+	}
+	var err error
+	for id := range brokers {
+		if serr := b.sendLeaderAndISR(id, req); serr != nil {
+			log.Error.Printf("leader/%d: send leader and isr to broker %d error: %s", b.config.ID, id, serr)
+			if err == nil {
+				err = serr
+			}
+		}
+	}
+	return err
+}
 
-	return nil
+// sendLeaderAndISR sends the leader and ISR request to the broker.
+func (b *Broker) sendLeaderAndISR(id int32, req *protocol.LeaderAndISRRequest) error {
+	_, err := b.peers.LeaderAndISR(b.ctx, id, req, b.fenceController)
+	if err == errUnknownBroker {
+		// TODO: this probably shouldn't happen -- likely a root issue to fix
+		log.Error.Printf("trying to assign partitions to unknown broker: %d", id)
+		return nil
+	}
+	return err
 }
 
 func (b *Broker) removeServer(m serf.Member, meta *metadata.Broker) error {
-	configFuture := b.raft.GetConfiguration()
-	if err := configFuture.Error(); err != nil {
+	if b.cluster == nil {
+		return nil
+	}
+	servers, err := b.cluster.Servers()
+	if err != nil {
 		log.Error.Printf("leader/%d: get raft configuration error: %s", b.config.ID, err)
 		return err
 	}
-	for _, server := range configFuture.Configuration().Servers {
+	for _, server := range servers {
 		if server.ID != raft.ServerID(meta.ID.String()) {
 			continue
 		}
 		log.Info.Printf("leader/%d: removing server by id: %s", b.config.ID, server.ID)
-		future := b.raft.RemoveServer(raft.ServerID(meta.ID.String()), 0, 0)
-		if err := future.Error(); err != nil {
+		if err := b.cluster.RemoveServer(raft.ServerID(meta.ID.String())); err != nil {
 			log.Error.Printf("leader/%d: remove server error: %s", b.config.ID, err)
 			return err
 		}
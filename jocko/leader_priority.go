@@ -0,0 +1,55 @@
+package jocko
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/log"
+)
+
+// transferLeadership hands the cluster's leadership to the preferred leader,
+// if there's a live voter with a higher leader priority than this broker's.
+func (b *Broker) transferLeadership() {
+	servers, err := b.cluster.Servers()
+	if err != nil {
+		log.Error.Printf("leader/%d: get raft configuration error: %s", b.config.ID, err)
+		return
+	}
+	preferred, ok := preferredLeader(b.config.LeaderPriority, servers, b.LANMembers())
+	if !ok {
+		return
+	}
+	log.Info.Printf("leader/%d: transferring leadership to preferred leader %d with priority %d", b.config.ID, preferred.ID, preferred.LeaderPriority)
+	if err := b.cluster.TransferLeadership(raft.ServerID(preferred.ID.String()), raft.ServerAddress(preferred.RaftAddr)); err != nil {
+		log.Error.Printf("leader/%d: transfer leadership to %d error: %s", b.config.ID, preferred.ID, err)
+	}
+}
+
+// preferredLeader returns the live voter with the highest leader priority, the
+// lowest ID breaking ties, if its priority's higher than the leader's.
+func preferredLeader(priority int, servers []raft.Server, members []serf.Member) (*metadata.Broker, bool) {
+	voters := make(map[raft.ServerID]raft.ServerAddress)
+	for _, s := range servers {
+		if s.Suffrage == raft.Voter {
+			voters[s.ID] = s.Address
+		}
+	}
+	var preferred *metadata.Broker
+	for _, m := range members {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+		broker, ok := metadata.IsBroker(m)
+		if !ok || broker.LeaderPriority <= priority {
+			continue
+		}
+		if addr, ok := voters[raft.ServerID(broker.ID.String())]; !ok || addr != raft.ServerAddress(broker.RaftAddr) {
+			continue
+		}
+		if preferred == nil || broker.LeaderPriority > preferred.LeaderPriority ||
+			(broker.LeaderPriority == preferred.LeaderPriority && broker.ID < preferred.ID) {
+			preferred = broker
+		}
+	}
+	return preferred, preferred != nil
+}
@@ -0,0 +1,48 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+)
+
+func TestPreferredLeader(t *testing.T) {
+	member := func(id, priority string, status serf.MemberStatus) serf.Member {
+		tags := map[string]string{"role": "jocko", "id": id, "raft_addr": "raft-" + id}
+		if priority != "" {
+			tags["leader_priority"] = priority
+		}
+		return serf.Member{Name: id, Tags: tags, Status: status}
+	}
+	servers := []raft.Server{
+		{ID: "1", Address: "raft-1", Suffrage: raft.Voter},
+		{ID: "2", Address: "raft-2", Suffrage: raft.Voter},
+		{ID: "3", Address: "raft-3", Suffrage: raft.Voter},
+		{ID: "4", Address: "raft-4", Suffrage: raft.Nonvoter},
+	}
+	tests := []struct {
+		name     string
+		priority int
+		members  []serf.Member
+		want     metadata.NodeID
+	}{
+		{"no priorities", 0, []serf.Member{member("1", "", serf.StatusAlive), member("2", "", serf.StatusAlive)}, 0},
+		{"highest", 0, []serf.Member{member("1", "", serf.StatusAlive), member("2", "1", serf.StatusAlive), member("3", "2", serf.StatusAlive)}, 3},
+		{"ties go to lowest id", 0, []serf.Member{member("3", "2", serf.StatusAlive), member("2", "2", serf.StatusAlive)}, 2},
+		{"leader's already preferred", 2, []serf.Member{member("2", "2", serf.StatusAlive)}, 0},
+		{"failed", 0, []serf.Member{member("2", "1", serf.StatusFailed)}, 0},
+		{"non-voter", 0, []serf.Member{member("4", "1", serf.StatusAlive)}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			preferred, ok := preferredLeader(test.priority, servers, test.members)
+			require.Equal(t, test.want != 0, ok)
+			if ok {
+				require.Equal(t, test.want, preferred.ID)
+			}
+		})
+	}
+}
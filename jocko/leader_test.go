@@ -0,0 +1,20 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/structs"
+)
+
+func TestReplacePartitions(t *testing.T) {
+	p := func(topic string, partition, leader int32) structs.Partition {
+		return structs.Partition{Topic: topic, ID: partition, Partition: partition, Leader: leader}
+	}
+	pending := []structs.Partition{p("a", 0, 1), p("a", 1, 1), p("b", 0, 1)}
+	applied := []structs.Partition{p("a", 0, 2)}
+	queued := []structs.Partition{p("b", 0, 3), p("c", 0, 3)}
+
+	// the pending changes overtaken by newer ones are dropped
+	require.Equal(t, []structs.Partition{p("a", 1, 1), p("b", 0, 3), p("c", 0, 3)}, replacePartitions(pending, applied, queued))
+}
@@ -0,0 +1,100 @@
+package jocko
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/jocko/config"
+)
+
+// listen listens on the listener's address, with TLS if it has certificates.
+func listen(lc config.ListenerConfig) (net.Listener, error) {
+	ln, err := net.Listen("tcp", lc.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(lc.Certificates) == 0 {
+		return ln, nil
+	}
+	tlsConfig, err := listenerTLSConfig(lc)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// listenerTLSConfig loads the listener's certificates and the CAs it trusts to
+// sign client certificates.
+func listenerTLSConfig(lc config.ListenerConfig) (*tls.Config, error) {
+	certs := make([]tls.Certificate, 0, len(lc.Certificates))
+	for _, c := range lc.Certificates {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load certificate %s failed", c.CertFile)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, errors.Wrapf(err, "parse certificate %s failed", c.CertFile)
+		}
+		certs = append(certs, cert)
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return selectCertificate(certs, hello.ServerName), nil
+		},
+	}
+	if lc.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(lc.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read client CA file failed")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in client CA file %s", lc.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// selectCertificate returns the certificate for the SNI host name: the first
+// one with the name, or else one with a wildcard matching it, or else the
+// first certificate.
+func selectCertificate(certs []tls.Certificate, name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var wildcard string
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		wildcard = "*" + name[i:]
+	}
+	var match *tls.Certificate
+	for i := range certs {
+		for _, n := range certificateNames(certs[i].Leaf) {
+			n = strings.ToLower(n)
+			if n == name {
+				return &certs[i]
+			}
+			if match == nil && wildcard != "" && n == wildcard {
+				match = &certs[i]
+			}
+		}
+	}
+	if match != nil {
+		return match
+	}
+	return &certs[0]
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	if cert == nil {
+		return nil
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames
+	}
+	return []string{cert.Subject.CommonName}
+}
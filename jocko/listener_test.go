@@ -0,0 +1,87 @@
+package jocko
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+)
+
+func TestSelectCertificate(t *testing.T) {
+	certs := []tls.Certificate{
+		{Leaf: &x509.Certificate{DNSNames: []string{"default.example.com"}}},
+		{Leaf: &x509.Certificate{DNSNames: []string{"*.internal.example.com"}}},
+		{Leaf: &x509.Certificate{DNSNames: []string{"kafka.example.com", "jocko.example.com"}}},
+		{Leaf: &x509.Certificate{DNSNames: []string{"broker.internal.example.com"}}},
+		{Leaf: &x509.Certificate{Subject: pkix.Name{CommonName: "legacy.example.com"}}},
+	}
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"", 0},
+		{"unknown.example.com", 0},
+		{"jocko.example.com", 2},
+		{"JOCKO.example.com.", 2},
+		{"broker.internal.example.com", 3},
+		{"other.internal.example.com", 1},
+		{"a.b.internal.example.com", 0},
+		{"legacy.example.com", 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.True(t, selectCertificate(certs, test.name) == &certs[test.want])
+		})
+	}
+}
+
+func TestTLSPrincipal(t *testing.T) {
+	ca, caKey := testCertificate(t, "ca", nil, nil)
+	server, serverKey := testCertificate(t, "broker", ca, caKey)
+	alice, aliceKey := testCertificate(t, "alice", ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	principal := func(client *x509.Certificate, clientKey *ecdsa.PrivateKey, auth tls.ClientAuthType) string {
+		sc, cc := net.Pipe()
+		defer cc.Close()
+		clientConfig := &tls.Config{RootCAs: pool, ServerName: "broker"}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}}
+		}
+		go tls.Client(cc, clientConfig).Handshake()
+		p, err := tlsPrincipal(tls.Server(sc, &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+			ClientCAs:    pool,
+			ClientAuth:   auth,
+		}))
+		require.NoError(t, err)
+		return p
+	}
+	require.Equal(t, "User:alice", principal(alice, aliceKey, tls.RequireAndVerifyClientCert))
+	require.Equal(t, anonymousPrincipal, principal(nil, nil, tls.NoClientCert))
+}
+
+func TestServeReturnsOnClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{config: &config.Config{}, shutdownCh: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.serve(context.Background(), ln, defaultListener)
+		close(done)
+	}()
+	require.NoError(t, ln.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after the listener closed")
+	}
+}
@@ -0,0 +1,144 @@
+package jocko
+
+import (
+	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func (b *Broker) handleAlterBrokerMaintenance(ctx *Context, req *protocol.AlterBrokerMaintenanceRequest) *protocol.AlterBrokerMaintenanceResponse {
+	sp := span(ctx, b.tracer, "alter broker maintenance")
+	defer sp.Finish()
+	res := &protocol.AlterBrokerMaintenanceResponse{}
+	res.APIVersion = req.Version()
+	if !b.authorized(ctx, policy.AlterOperation, policy.ClusterResource, "") {
+		res.ErrorCode = protocol.ErrClusterAuthorizationFailed.Code()
+		return res
+	}
+	if !b.isController() {
+		res.ErrorCode = protocol.ErrNotController.Code()
+		return res
+	}
+	moved, err := b.setBrokerMaintenance(req.BrokerID, req.Maintenance)
+	res.ErrorCode = err.Code()
+	res.Moved = moved
+	return res
+}
+
+// setBrokerMaintenance puts the broker into maintenance mode, or takes it out,
+// across the cluster. Putting it in moves its partitions' leadership to other
+// replicas in the background and returns how many are moving. Nothing moves
+// back when it's taken out, its replicas just become eligible to lead again.
+func (b *Broker) setBrokerMaintenance(id int32, maintenance bool) (int32, protocol.Error) {
+	_, node, err := b.fsm.State().GetNode(id)
+	if err != nil {
+		return 0, protocol.ErrUnknown.WithErr(err)
+	}
+	if node == nil {
+		return 0, protocol.ErrBrokerNotAvailable
+	}
+	if node.Maintenance != maintenance {
+		nodeCopy := *node
+		nodeCopy.Maintenance = maintenance
+		if _, err := b.raftApply(structs.RegisterNodeRequestType, &structs.RegisterNodeRequest{Node: nodeCopy}); err != nil {
+			log.Error.Printf("broker/%d: set broker %d maintenance %t error: %s", b.config.ID, id, maintenance, err)
+			return 0, protocol.ErrUnknown.WithErr(err)
+		}
+		log.Info.Printf("broker/%d: set broker %d maintenance %t", b.config.ID, id, maintenance)
+	}
+	if !maintenance {
+		return 0, protocol.ErrNone
+	}
+	// run even if the broker was already in maintenance, in case a move failed
+	moved, err := b.moveLeadershipFrom(id)
+	if err != nil {
+		log.Error.Printf("broker/%d: move leadership from broker %d error: %s", b.config.ID, id, err)
+		return moved, protocol.ErrUnknown.WithErr(err)
+	}
+	return moved, protocol.ErrNone
+}
+
+// moveLeadershipFrom queues moving the leadership of the partitions the broker
+// leads to another of their in-sync replicas that's alive and not in
+// maintenance, and returns how many it queued. The moves are applied in the
+// background, paced like the controller's other leader changes. The broker
+// stays in their replicas and ISR and follows the new leader. Partitions
+// without such a replica keep their leader rather than go offline.
+func (b *Broker) moveLeadershipFrom(id int32) (int32, error) {
+	state := b.fsm.State()
+	_, partitions, err := state.PartitionsByLeader(id)
+	if err != nil {
+		return 0, err
+	}
+	schedulable, err := b.schedulableNodes()
+	if err != nil {
+		return 0, err
+	}
+	changes := make([]structs.Partition, 0, len(partitions))
+	for _, p := range partitions {
+		leader := int32(-1)
+		for _, r := range p.ISR {
+			if _, ok := schedulable[r]; ok && r != id {
+				leader = r
+				break
+			}
+		}
+		if leader == -1 {
+			log.Info.Printf("broker/%d: no in-sync replica to move %s-%d's leadership to, keeping leader %d", b.config.ID, p.Topic, p.Partition, id)
+			continue
+		}
+		change := *p
+		change.Leader = leader
+		changes = append(changes, change)
+	}
+	b.queueLeaderChanges(changes)
+	return int32(len(changes)), nil
+}
+
+// schedulableNodes returns the nodes that are alive and not in maintenance, so
+// can be given new replicas and leaders.
+func (b *Broker) schedulableNodes() (map[int32]*structs.Node, error) {
+	_, nodes, err := b.fsm.State().GetNodes()
+	if err != nil {
+		return nil, err
+	}
+	schedulable := make(map[int32]*structs.Node, len(nodes))
+	for _, n := range nodes {
+		if n.Check != nil && n.Check.Status == structs.HealthPassing && !n.Maintenance {
+			schedulable[n.Node] = n
+		}
+	}
+	return schedulable, nil
+}
+
+// schedulableBrokers returns the known brokers that aren't in maintenance or
+// known to have failed, to assign new partitions' replicas to. Brokers that
+// haven't been registered yet are included.
+func (b *Broker) schedulableBrokers() []*metadata.Broker {
+	brokers := b.brokerLookup.Brokers()
+	_, nodes, err := b.fsm.State().GetNodes()
+	if err != nil {
+		return brokers
+	}
+	unschedulable := make(map[int32]bool)
+	for _, n := range nodes {
+		if n.Maintenance || (n.Check != nil && n.Check.Status == structs.HealthCritical) {
+			unschedulable[n.Node] = true
+		}
+	}
+	schedulable := make([]*metadata.Broker, 0, len(brokers))
+	for _, broker := range brokers {
+		if !unschedulable[broker.ID.Int32()] {
+			schedulable = append(schedulable, broker)
+		}
+	}
+	return schedulable
+}
+
+// inMaintenance returns whether this broker's in maintenance mode.
+func (b *Broker) inMaintenance() bool {
+	_, node, err := b.fsm.State().GetNode(b.config.ID)
+	return err == nil && node != nil && node.Maintenance
+}
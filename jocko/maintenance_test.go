@@ -0,0 +1,86 @@
+package jocko
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/testutil"
+)
+
+func TestBroker_AlterBrokerMaintenance(t *testing.T) {
+	setup := func(t *testing.T) (*Broker, *fsm.FSM) {
+		f, err := fsm.New(stdopentracing.GlobalTracer())
+		require.NoError(t, err)
+		b := &Broker{
+			config: &config.Config{ID: 1, ControllerMaxLeaderChanges: 1, ControllerLeaderChangeInterval: 10 * time.Millisecond},
+			fsm:    f,
+			store:  &fsmStore{fsm: f},
+			tracer: stdopentracing.NoopTracer{},
+			ctx:    context.Background(),
+			runner: newRunner(),
+			// the brokers aren't known so they aren't sent the changes
+			peers:        newBrokerClient(1, NewBrokerLookup()),
+			brokerLookup: NewBrokerLookup(),
+		}
+		b.runner.add("leadership")
+		for _, id := range []int32{1, 2} {
+			b.brokerLookup.AddBroker(&metadata.Broker{ID: metadata.NodeID(id), RaftAddr: fmt.Sprintf("broker-%d", id)})
+			_, err := b.raftApply(structs.RegisterNodeRequestType, structs.RegisterNodeRequest{
+				Node: structs.Node{Node: id, Check: &structs.HealthCheck{Status: structs.HealthPassing}},
+			})
+			require.NoError(t, err)
+		}
+		require.NoError(t, b.registerTopic(structs.Topic{Topic: "test-topic", Partitions: map[int32][]int32{0: {1, 2}, 1: {1, 2}, 2: {1}}}, []structs.Partition{
+			{Topic: "test-topic", ID: 0, Partition: 0, Leader: 1, AR: []int32{1, 2}, ISR: []int32{1, 2}},
+			{Topic: "test-topic", ID: 1, Partition: 1, Leader: 1, AR: []int32{1, 2}, ISR: []int32{1, 2}},
+			// no other replica to move to
+			{Topic: "test-topic", ID: 2, Partition: 2, Leader: 1, AR: []int32{1}, ISR: []int32{1}},
+		}))
+		return b, f
+	}
+	leaders := func(t *testing.T, f *fsm.FSM) []int32 {
+		var leaders []int32
+		for id := int32(0); id < 3; id++ {
+			_, p, err := f.State().GetPartition("test-topic", id)
+			require.NoError(t, err)
+			leaders = append(leaders, p.Leader)
+		}
+		return leaders
+	}
+	ctx := &Context{parent: context.Background()}
+	req := &protocol.AlterBrokerMaintenanceRequest{BrokerID: 1, Maintenance: true}
+
+	t.Run("moves in the background", func(t *testing.T) {
+		b, f := setup(t)
+		defer b.runner.stop(time.Second)
+		res := b.handleAlterBrokerMaintenance(ctx, req)
+		require.Equal(t, protocol.ErrNone.Code(), res.ErrorCode)
+		require.Equal(t, int32(2), res.Moved)
+		testutil.WaitForResult(func() (bool, error) {
+			got := leaders(t, f)
+			return got[0] == 2 && got[1] == 2, fmt.Errorf("leaders: %v", got)
+		}, func(err error) { t.Fatal(err) })
+		require.Equal(t, int32(1), leaders(t, f)[2])
+		require.True(t, b.inMaintenance())
+	})
+
+	t.Run("doesn't move on the request path", func(t *testing.T) {
+		b, f := setup(t)
+		// nothing runs the queued moves
+		b.runner.stop(time.Second)
+		res := b.handleAlterBrokerMaintenance(ctx, req)
+		require.Equal(t, protocol.ErrNone.Code(), res.ErrorCode)
+		require.Equal(t, int32(2), res.Moved)
+		require.Equal(t, []int32{1, 1, 1}, leaders(t, f))
+		require.True(t, b.inMaintenance())
+	})
+}
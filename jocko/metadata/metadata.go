@@ -28,6 +28,21 @@ type Broker struct {
 	RaftAddr    string
 	SerfLANAddr string
 	BrokerAddr  string
+	// Rack is the rack the broker's in, if it's set.
+	Rack string
+	// LeaderPriority ranks the broker as the cluster's raft leader.
+	LeaderPriority int
+	// InterBrokerAddr is the address of the listener other brokers send
+	// requests to, if the broker has one.
+	InterBrokerAddr string
+}
+
+// PeerAddr returns the address other brokers connect to the broker on.
+func (b Broker) PeerAddr() string {
+	if b.InterBrokerAddr != "" {
+		return b.InterBrokerAddr
+	}
+	return b.BrokerAddr
 }
 
 func (b Broker) Host() string {
@@ -70,6 +85,14 @@ func IsBroker(m serf.Member) (*Broker, bool) {
 		}
 	}
 
+	priority := 0
+	if priorityStr, ok := m.Tags["leader_priority"]; ok {
+		priority, err = strconv.Atoi(priorityStr)
+		if err != nil {
+			return nil, false
+		}
+	}
+
 	_, bootstrap := m.Tags["bootstrap"]
 	_, nonVoter := m.Tags["non_voter"]
 
@@ -80,14 +103,17 @@ func IsBroker(m serf.Member) (*Broker, bool) {
 	}
 
 	return &Broker{
-		ID:          NodeID(id),
-		Name:        m.Tags["name"],
-		Bootstrap:   bootstrap,
-		Expect:      expect,
-		NonVoter:    nonVoter,
-		Status:      m.Status,
-		RaftAddr:    m.Tags["raft_addr"],
-		SerfLANAddr: m.Tags["serf_lan_addr"],
-		BrokerAddr:  m.Tags["broker_addr"],
+		ID:              NodeID(id),
+		Name:            m.Tags["name"],
+		Bootstrap:       bootstrap,
+		Expect:          expect,
+		NonVoter:        nonVoter,
+		Status:          m.Status,
+		RaftAddr:        m.Tags["raft_addr"],
+		SerfLANAddr:     m.Tags["serf_lan_addr"],
+		BrokerAddr:      m.Tags["broker_addr"],
+		Rack:            m.Tags["rack"],
+		LeaderPriority:  priority,
+		InterBrokerAddr: m.Tags["inter_broker_addr"],
 	}, true
 }
@@ -0,0 +1,165 @@
+package jocko
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+)
+
+// MetadataStore replicates changes to the cluster's metadata and applies them
+// to the broker's FSM. Brokers in a cluster use raft, a standalone broker logs
+// the changes to a file, and applications embedding the broker can bring their
+// own, e.g. one backed by etcd, or one in memory for tests.
+type MetadataStore interface {
+	// Apply replicates the encoded change and applies it to the FSM,
+	// returning the FSM's response.
+	Apply(buf []byte) (interface{}, error)
+	// IsLeader returns whether the broker leads the store, which makes it
+	// the controller.
+	IsLeader() bool
+	Close() error
+}
+
+// ClusterMetadataStore is a metadata store shared by the brokers of a
+// cluster. The controller adds brokers to it as they join the cluster and
+// removes them as they leave.
+type ClusterMetadataStore interface {
+	MetadataStore
+	// LeaderCh receives true when the broker becomes the store's leader and
+	// false when it stops being it.
+	LeaderCh() <-chan bool
+	// Leader returns the address of the store's leader, or "" if it's not
+	// known.
+	Leader() raft.ServerAddress
+	// LastContact returns when the broker last heard from the leader.
+	LastContact() time.Time
+	// LastIndex returns the index of the last change the broker has, which
+	// is 0 if it's never been part of a cluster.
+	LastIndex() (uint64, error)
+	// Barrier waits until the changes made before it was called are
+	// applied to the FSM. It's only called on the leader.
+	Barrier(timeout time.Duration) error
+	// VerifyLeader confirms with the other members that the broker's still
+	// the leader.
+	VerifyLeader() error
+	// Servers returns the members of the store.
+	Servers() ([]raft.Server, error)
+	AddVoter(id raft.ServerID, addr raft.ServerAddress) error
+	AddNonvoter(id raft.ServerID, addr raft.ServerAddress) error
+	RemoveServer(id raft.ServerID) error
+	// TransferLeadership hands the store's leadership to the member.
+	TransferLeadership(id raft.ServerID, addr raft.ServerAddress) error
+	// Bootstrap starts a new cluster made up of the servers.
+	Bootstrap(servers []raft.Server) error
+}
+
+// MetadataStoreFactory opens a metadata store that applies changes to the FSM.
+type MetadataStoreFactory func(fsm *fsm.FSM) (MetadataStore, error)
+
+// NewStandaloneBroker creates a broker that runs without raft and serf, with
+// its metadata kept in the store newStore opens. Its membership isn't managed
+// for it so it runs on its own, like a broker with config.Standalone set,
+// which keeps its metadata in a file in the data dir.
+func NewStandaloneBroker(config *config.Config, tracer opentracing.Tracer, newStore MetadataStoreFactory) (*Broker, error) {
+	config.Standalone = true
+	return newBroker(config, tracer, newStore)
+}
+
+// NewBrokerWithStore creates a broker that keeps its metadata in the store
+// newStore opens instead of raft. Unless config.Standalone is set it joins
+// its cluster with serf like any other broker, so the store must be a
+// ClusterMetadataStore.
+func NewBrokerWithStore(config *config.Config, tracer opentracing.Tracer, newStore MetadataStoreFactory) (*Broker, error) {
+	return newBroker(config, tracer, newStore)
+}
+
+// raftMetadataStore replicates metadata changes with raft.
+type raftMetadataStore struct {
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	// one of bolt or inmem is set, inmem in dev mode
+	bolt     *raftboltdb.BoltStore
+	inmem    *raft.InmemStore
+	notifyCh chan bool
+}
+
+func (s *raftMetadataStore) Apply(buf []byte) (interface{}, error) {
+	future := s.raft.Apply(buf, 30*time.Second)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	return future.Response(), nil
+}
+
+func (s *raftMetadataStore) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+func (s *raftMetadataStore) LeaderCh() <-chan bool {
+	return s.notifyCh
+}
+
+func (s *raftMetadataStore) Leader() raft.ServerAddress {
+	return s.raft.Leader()
+}
+
+func (s *raftMetadataStore) LastContact() time.Time {
+	return s.raft.LastContact()
+}
+
+func (s *raftMetadataStore) LastIndex() (uint64, error) {
+	if s.inmem != nil {
+		return s.inmem.LastIndex()
+	}
+	return s.bolt.LastIndex()
+}
+
+func (s *raftMetadataStore) Barrier(timeout time.Duration) error {
+	return s.raft.Barrier(timeout).Error()
+}
+
+func (s *raftMetadataStore) VerifyLeader() error {
+	return s.raft.VerifyLeader().Error()
+}
+
+func (s *raftMetadataStore) Servers() ([]raft.Server, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	return future.Configuration().Servers, nil
+}
+
+func (s *raftMetadataStore) AddVoter(id raft.ServerID, addr raft.ServerAddress) error {
+	return s.raft.AddVoter(id, addr, 0, 0).Error()
+}
+
+func (s *raftMetadataStore) AddNonvoter(id raft.ServerID, addr raft.ServerAddress) error {
+	return s.raft.AddNonvoter(id, addr, 0, 0).Error()
+}
+
+func (s *raftMetadataStore) RemoveServer(id raft.ServerID) error {
+	return s.raft.RemoveServer(id, 0, 0).Error()
+}
+
+func (s *raftMetadataStore) TransferLeadership(id raft.ServerID, addr raft.ServerAddress) error {
+	return s.raft.LeadershipTransferToServer(id, addr).Error()
+}
+
+func (s *raftMetadataStore) Bootstrap(servers []raft.Server) error {
+	return s.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+}
+
+// Close shuts raft down along with its transport and log store.
+func (s *raftMetadataStore) Close() error {
+	s.transport.Close()
+	err := s.raft.Shutdown().Error()
+	if s.bolt != nil {
+		s.bolt.Close()
+	}
+	return err
+}
@@ -1,6 +1,9 @@
 package jocko
 
-import "github.com/go-kit/kit/metrics/prometheus"
+import (
+	"github.com/go-kit/kit/metrics/prometheus"
+	"github.com/travisjeffery/jocko/jocko/reporter"
+)
 
 // Alias prometheus' counter, probably only need to use Inc() though.
 type Counter = prometheus.Counter
@@ -8,4 +11,63 @@ type Counter = prometheus.Counter
 // Metrics is used for tracking metrics.
 type Metrics struct {
 	RequestsHandled Counter
+	// BytesIn and BytesOut count the bytes produced and fetched by consumers,
+	// labeled by topic and client_id. They aren't counted if nil.
+	BytesIn  *Counter
+	BytesOut *Counter
+	// PartitionBytesIn and PartitionBytesOut count them labeled by topic and
+	// partition, to find hot partitions. They aren't counted if nil.
+	PartitionBytesIn  *Counter
+	PartitionBytesOut *Counter
+	// BrokerRequests, BrokerRequestErrors, and BrokerRequestRetries count the
+	// requests sent to other brokers, e.g. the controller's, labeled by broker
+	// and api_key. They aren't counted if nil.
+	BrokerRequests       *Counter
+	BrokerRequestErrors  *Counter
+	BrokerRequestRetries *Counter
+	// DownConversions counts the message sets converted to an older message
+	// format for old clients' fetches, and DownConversionSeconds the time spent
+	// converting them, labeled by topic. They aren't counted if nil.
+	DownConversions       *Counter
+	DownConversionSeconds *Counter
+	// FetchCorruptions counts the corrupt message sets found checking fetched
+	// record sets' CRCs, labeled by topic and partition. It isn't counted if
+	// nil.
+	FetchCorruptions *Counter
+	// Reporter, if set, is told of all of the above by the names of their
+	// fields in snake case, e.g. bytes_in, along with the requests the server
+	// handles (requests, labeled by api_key), their latency (request_seconds),
+	// its open connections (connections), and, if produced records are
+	// sampled, the sampled record sets and records (sampled_record_sets,
+	// sampled_records), their average size and count per set
+	// (sampled_record_bytes_avg, sampled_records_per_set_avg), and the
+	// estimated number of distinct keys (key_cardinality), labeled by topic.
+	Reporter reporter.MetricsReporter
+}
+
+// add adds the delta to the counter, if it's set, and reports it.
+func (m *Metrics) add(c *Counter, name string, delta float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	if c != nil {
+		c.With(labels...).Add(delta)
+	}
+	if m.Reporter != nil {
+		m.Reporter.Counter(name, delta, labels...)
+	}
+}
+
+// set reports the gauge's value.
+func (m *Metrics) set(name string, value float64, labels ...string) {
+	if m != nil && m.Reporter != nil {
+		m.Reporter.Gauge(name, value, labels...)
+	}
+}
+
+// observe reports the histogram's value.
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	if m != nil && m.Reporter != nil {
+		m.Reporter.Histogram(name, value, labels...)
+	}
 }
@@ -0,0 +1,308 @@
+package jocko
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+var errMirrorClient = errors.New("mirror client only fetches")
+
+// mirrorCheckpointSuffix is appended to a mirror topic's name to get the
+// topic its offset checkpoints are written to.
+const mirrorCheckpointSuffix = ".checkpoints"
+
+// mirrorCheckpointTopic returns the request to create the compacted topic a
+// mirror topic's offset checkpoints are written to, or nil if the topic isn't
+// a mirror. It has as many partitions as the mirror and each partition's
+// checkpoints go to the same partition, keyed by the partition, so its latest
+// checkpoint is the last record there.
+func mirrorCheckpointTopic(req *protocol.CreateTopicRequest, config structs.TopicConfig) *protocol.CreateTopicRequest {
+	if config.GetString("mirror.source.brokers") == "" {
+		return nil
+	}
+	compact := commitlog.CompactCleanupPolicy
+	return &protocol.CreateTopicRequest{
+		Topic:             req.Topic + mirrorCheckpointSuffix,
+		NumPartitions:     req.NumPartitions,
+		ReplicationFactor: req.ReplicationFactor,
+		Configs:           map[string]*string{"cleanup.policy": &compact},
+	}
+}
+
+// mirrorSource returns the brokers of the cluster the topic mirrors and the
+// topic it mirrors there, or no brokers if the topic isn't a mirror.
+func mirrorSource(topic *structs.Topic) ([]string, string) {
+	var brokers []string
+	for _, addr := range strings.Split(topic.Config.GetString("mirror.source.brokers"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			brokers = append(brokers, addr)
+		}
+	}
+	source := topic.Config.GetString("mirror.source.topic")
+	if source == "" {
+		source = topic.Topic
+	}
+	return brokers, source
+}
+
+// mirrorClient fetches a partition from its leader in another cluster. It
+// looks up the leader with the cluster's brokers before fetching and again
+// whenever a fetch fails, so the mirror follows leadership changes there.
+type mirrorClient struct {
+	brokers   []string
+	topic     string
+	partition int32
+	dial      func(addr string) (*Conn, error)
+
+	mu     sync.Mutex
+	leader *Conn
+}
+
+func (c *mirrorClient) Fetch(req *protocol.FetchRequest) (*protocol.FetchResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == nil {
+		leader, err := c.dialLeader()
+		if err != nil {
+			return nil, err
+		}
+		c.leader = leader
+	}
+	res, err := c.leader.Fetch(req)
+	if err == nil {
+		for _, t := range res.Responses {
+			for _, p := range t.PartitionResponses {
+				if p.ErrorCode == protocol.ErrNotLeaderForPartition.Code() {
+					err = protocol.ErrNotLeaderForPartition
+				}
+			}
+		}
+	}
+	if err != nil {
+		c.leader.Close()
+		c.leader = nil
+	}
+	return res, err
+}
+
+// dialLeader asks the source cluster's brokers in turn who leads the partition
+// and dials it.
+func (c *mirrorClient) dialLeader() (*Conn, error) {
+	err := fmt.Errorf("no source brokers")
+	for _, addr := range c.brokers {
+		var conn *Conn
+		if conn, err = c.dial(addr); err != nil {
+			continue
+		}
+		var res *protocol.MetadataResponse
+		res, err = conn.Metadata(&protocol.MetadataRequest{Topics: []string{c.topic}})
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		var leader *protocol.Broker
+		if leader, err = res.Leader(c.topic, c.partition); err != nil {
+			continue
+		}
+		return c.dial(leader.Addr())
+	}
+	return nil, err
+}
+
+func (c *mirrorClient) CreateTopics(*protocol.CreateTopicRequests) (*protocol.CreateTopicsResponse, error) {
+	return nil, errMirrorClient
+}
+
+func (c *mirrorClient) LeaderAndISR(*protocol.LeaderAndISRRequest) (*protocol.LeaderAndISRResponse, error) {
+	return nil, errMirrorClient
+}
+
+// startMirror starts replicating the partition from its leader in the source
+// cluster if the topic's a mirror. Only the partition's leader in this cluster
+// links to the source; its followers replicate from it as usual.
+func (b *Broker) startMirror(replica *Replica) protocol.Error {
+	_, topic, err := b.fsm.State().GetTopic(replica.Partition.Topic)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if topic == nil {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	brokers, source := mirrorSource(topic)
+	if len(brokers) == 0 {
+		return protocol.ErrNone
+	}
+	log.Info.Printf("broker/%d: mirroring %s-%d from %s in %v", b.config.ID, topic.Topic, replica.Partition.ID, source, brokers)
+	dialer := NewDialer(fmt.Sprintf("jocko-mirror-%d", b.config.ID))
+	config := b.replicatorConfig()
+	config.Mirror = true
+	config.Topic = source
+	config.CheckpointInterval = time.Duration(topic.Config.GetInt64("mirror.checkpoint.interval.ms")) * time.Millisecond
+	config.Checkpoint = func(sourceOffset, offset int64) {
+		b.writeMirrorCheckpoint(&protocol.MirrorCheckpoint{
+			SourceTopic:  source,
+			Topic:        topic.Topic,
+			Partition:    replica.Partition.ID,
+			SourceOffset: sourceOffset,
+			Offset:       offset,
+		})
+	}
+	r := NewReplicator(config, replica, &mirrorClient{
+		brokers:   brokers,
+		topic:     source,
+		partition: replica.Partition.ID,
+		dial: func(addr string) (*Conn, error) {
+			return dialer.Dial("tcp", addr)
+		},
+	})
+	replica.Replicator = r
+	if !b.config.DevMode {
+		b.replicate(replica, r)
+	}
+	return protocol.ErrNone
+}
+
+// writeMirrorCheckpoint produces the checkpoint to the mirror's checkpoint
+// topic. A checkpoint that fails is only logged since the next one replaces it.
+func (b *Broker) writeMirrorCheckpoint(cp *protocol.MirrorCheckpoint) {
+	value, err := protocol.Encode(cp)
+	if err != nil {
+		log.Error.Printf("broker/%d: encode mirror checkpoint error: %s", b.config.ID, err)
+		return
+	}
+	msg, err := protocol.Encode(&protocol.Message{
+		MagicByte: 1,
+		Timestamp: time.Now(),
+		Key:       []byte(strconv.Itoa(int(cp.Partition))),
+		Value:     value,
+	})
+	if err != nil {
+		log.Error.Printf("broker/%d: encode mirror checkpoint error: %s", b.config.ID, err)
+		return
+	}
+	if err := b.produceTo(cp.Topic+mirrorCheckpointSuffix, cp.Partition, commitlog.NewMessageSet(0, msg)); err != protocol.ErrNone {
+		log.Error.Printf("broker/%d: write mirror checkpoint for %s-%d error: %s", b.config.ID, cp.Topic, cp.Partition, err)
+	}
+}
+
+// MirrorCheckpoints returns the latest offset checkpoint of each of the mirror
+// topic's partitions, read from its checkpoint topic in the mirror's cluster
+// through the broker at addr. Partitions that haven't been checkpointed yet
+// are left out.
+func MirrorCheckpoints(dialer *Dialer, addr, topic string) (map[int32]*protocol.MirrorCheckpoint, error) {
+	checkpointTopic := topic + mirrorCheckpointSuffix
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.Metadata(&protocol.MetadataRequest{Topics: []string{checkpointTopic}})
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	checkpoints := make(map[int32]*protocol.MirrorCheckpoint)
+	for _, tm := range res.TopicMetadata {
+		if tm.TopicErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[tm.TopicErrorCode]
+		}
+		for _, pm := range tm.PartitionMetadata {
+			leader, err := res.Leader(checkpointTopic, pm.PartitionID)
+			if err != nil {
+				return nil, err
+			}
+			cp, err := latestMirrorCheckpoint(dialer, leader.Addr(), checkpointTopic, pm.PartitionID)
+			if err != nil {
+				return nil, err
+			}
+			if cp != nil {
+				checkpoints[pm.PartitionID] = cp
+			}
+		}
+	}
+	return checkpoints, nil
+}
+
+// latestMirrorCheckpoint fetches the last checkpoint in the partition from its
+// leader, or nil if the partition's empty.
+func latestMirrorCheckpoint(dialer *Dialer, addr, topic string, partition int32) (*protocol.MirrorCheckpoint, error) {
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ores, err := conn.Offsets(&protocol.OffsetsRequest{
+		ReplicaID: -1,
+		Topics: []*protocol.OffsetsTopic{{
+			Topic:      topic,
+			Partitions: []*protocol.OffsetsPartition{{Partition: partition, Timestamp: -1, MaxNumOffsets: 1}},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	newest := int64(-1)
+	for _, r := range ores.Responses {
+		for _, p := range r.PartitionResponses {
+			if p.ErrorCode != protocol.ErrNone.Code() {
+				return nil, protocol.Errs[p.ErrorCode]
+			}
+			if len(p.Offsets) > 0 {
+				newest = p.Offsets[0]
+			}
+		}
+	}
+	if newest <= 0 {
+		return nil, nil
+	}
+	fres, err := conn.Fetch(&protocol.FetchRequest{
+		ReplicaID: -1,
+		MinBytes:  1,
+		MaxBytes:  1 << 20,
+		Topics: []*protocol.FetchTopic{{
+			Topic:      topic,
+			Partitions: []*protocol.FetchPartition{{Partition: partition, FetchOffset: newest - 1, MaxBytes: 1 << 20}},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var cp *protocol.MirrorCheckpoint
+	for _, r := range fres.Responses {
+		for _, p := range r.PartitionResponses {
+			if p.ErrorCode != protocol.ErrNone.Code() {
+				return nil, protocol.Errs[p.ErrorCode]
+			}
+			for _, ms := range commitlog.MessageSets(p.RecordSet) {
+				for _, m := range ms.Messages() {
+					cp = new(protocol.MirrorCheckpoint)
+					if err := cp.Decode(protocol.NewDecoder(m.Value())); err != nil {
+						return nil, protocol.ErrCorruptMessage.WithErr(err)
+					}
+				}
+			}
+		}
+	}
+	return cp, nil
+}
+
+// TranslateMirrorOffset translates a consumer's offset in the source partition
+// to the offset to resume from in the mirror after failing over. Offsets up to
+// the checkpoint are shifted by the difference between its offsets, which is
+// zero unless the mirror started over. Later offsets go back to just after the
+// checkpoint since those records may not have been mirrored, and it's better
+// to consume them twice than to skip them.
+func TranslateMirrorOffset(cp *protocol.MirrorCheckpoint, offset int64) int64 {
+	if offset > cp.SourceOffset+1 {
+		offset = cp.SourceOffset + 1
+	}
+	return offset - cp.SourceOffset + cp.Offset
+}
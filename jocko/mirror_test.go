@@ -0,0 +1,178 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+	"github.com/travisjeffery/jocko/testutil"
+)
+
+// sourceLeader is a leader in the source cluster whose log starts at offset 5.
+// The compacted offsets are gaps in its log.
+type sourceLeader struct {
+	mu        sync.Mutex
+	topic     string
+	fetches   []*protocol.FetchRequest
+	compacted map[int64]bool
+}
+
+func (s *sourceLeader) Fetch(req *protocol.FetchRequest) (*protocol.FetchResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches = append(s.fetches, req)
+	var recordSet []byte
+	for offset := int64(5); offset < 8; offset++ {
+		if offset < req.Topics[0].Partitions[0].FetchOffset || s.compacted[offset] {
+			continue
+		}
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("v")})
+		if err != nil {
+			return nil, err
+		}
+		recordSet = append(recordSet, commitlog.NewMessageSet(uint64(offset), m)...)
+	}
+	return &protocol.FetchResponse{Responses: protocol.FetchTopicResponses{{
+		Topic:              req.Topics[0].Topic,
+		PartitionResponses: protocol.FetchPartitionResponses{{RecordSet: recordSet, HighWatermark: 7}},
+	}}}, nil
+}
+
+func (s *sourceLeader) CreateTopics(*protocol.CreateTopicRequests) (*protocol.CreateTopicsResponse, error) {
+	return nil, errMirrorClient
+}
+
+func (s *sourceLeader) LeaderAndISR(*protocol.LeaderAndISRRequest) (*protocol.LeaderAndISRResponse, error) {
+	return nil, errMirrorClient
+}
+
+func TestReplicator_Mirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+
+	replica := &Replica{
+		Partition: structs.Partition{Topic: "mirror", ID: 0, Leader: 1, AR: []int32{1}},
+		BrokerID:  1,
+		Log:       l,
+	}
+	source := &sourceLeader{}
+	r := NewReplicator(ReplicatorConfig{Mirror: true, Topic: "source"}, replica, source)
+	r.Replicate()
+	defer r.Close()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return l.NewestOffset() == 8, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	// the mirror keeps the source's offsets
+	require.Equal(t, int64(5), l.OldestOffset())
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	require.Equal(t, "source", source.fetches[0].Topics[0].Topic)
+	require.Equal(t, int32(-1), source.fetches[0].ReplicaID)
+}
+
+func TestReplicator_MirrorCompacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+
+	replica := &Replica{
+		Partition: structs.Partition{Topic: "mirror", ID: 0, Leader: 1, AR: []int32{1}},
+		BrokerID:  1,
+		Log:       l,
+	}
+	source := &sourceLeader{compacted: map[int64]bool{6: true}}
+	r := NewReplicator(ReplicatorConfig{Mirror: true, Topic: "source"}, replica, source)
+	r.Replicate()
+	defer r.Close()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return l.NewestOffset() == 8, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	// the compacted offset's a gap in the mirror too
+	rd, err := l.NewReader(6, 0)
+	require.NoError(t, err)
+	ms, err := commitlog.ReadMessageSet(rd)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), ms.Offset())
+}
+
+func TestReplicator_MirrorCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+
+	replica := &Replica{
+		Partition: structs.Partition{Topic: "mirror", ID: 0, Leader: 1, AR: []int32{1}},
+		BrokerID:  1,
+		Log:       l,
+	}
+	var mu sync.Mutex
+	var checkpoints [][2]int64
+	release := make(chan struct{})
+	r := NewReplicator(ReplicatorConfig{
+		Mirror: true,
+		Topic:  "source",
+		Checkpoint: func(sourceOffset, offset int64) {
+			<-release
+			mu.Lock()
+			defer mu.Unlock()
+			checkpoints = append(checkpoints, [2]int64{sourceOffset, offset})
+		},
+	}, replica, &sourceLeader{})
+	r.Replicate()
+	defer r.Close()
+
+	// appending doesn't wait on the checkpoints being written
+	testutil.WaitForResult(func() (bool, error) {
+		return l.NewestOffset() == 8, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	close(release)
+	testutil.WaitForResult(func() (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n := len(checkpoints)
+		return n > 0 && checkpoints[n-1] == [2]int64{7, 7}, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	mu.Lock()
+	// checkpoints written in the background may skip to the latest one
+	for i, cp := range checkpoints {
+		require.Equal(t, cp[0], cp[1])
+		if i > 0 {
+			require.True(t, cp[0] > checkpoints[i-1][0])
+		}
+	}
+	mu.Unlock()
+	// the replicator's stopped before its log's closed and removed
+	r.Close()
+	<-r.Stopped()
+	require.NoError(t, l.Close())
+
+	cp := &protocol.MirrorCheckpoint{SourceOffset: 7, Offset: 2}
+	require.Equal(t, int64(1), TranslateMirrorOffset(cp, 6))
+	require.Equal(t, int64(3), TranslateMirrorOffset(cp, 8))
+	// offsets past the checkpoint may not have been mirrored
+	require.Equal(t, int64(3), TranslateMirrorOffset(cp, 20))
+}
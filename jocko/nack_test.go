@@ -0,0 +1,91 @@
+package jocko
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestNackFailedOffsets(t *testing.T) {
+	req := require.New(t)
+	dir, err := ioutil.TempDir("", "nack")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	apply := func(typ structs.MessageType, r interface{}) {
+		buf, err := structs.Encode(typ, r)
+		req.NoError(err)
+		f.Apply(&raft.Log{Data: buf})
+	}
+	// the dead-letter topic's missing so records that run out of retries
+	// can't be routed
+	topicConfig := structs.NewTopicConfig()
+	req.NoError(topicConfig.SetString("nack.policy", nackPolicyRetry))
+	req.NoError(topicConfig.SetString("retry.max.attempts", "1"))
+	for _, topic := range []string{"test", "test" + retryTopicSuffix} {
+		apply(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+			Topic: structs.Topic{Topic: topic, Partitions: map[int32][]int32{0: {1}}, Config: topicConfig},
+		})
+		apply(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{
+			Partition: structs.Partition{Topic: topic, ID: 0, Partition: 0, Leader: 1},
+		})
+	}
+	b := &Broker{
+		config:        &config.Config{ID: 1},
+		fsm:           f,
+		store:         &fsmStore{fsm: f},
+		tracer:        stdopentracing.NoopTracer{},
+		ctx:           context.Background(),
+		replicaLookup: NewReplicaLookup(),
+	}
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1 << 20, MaxLogBytes: -1})
+	req.NoError(err)
+	defer l.Close()
+	b.replicaLookup.AddReplica(&Replica{Partition: structs.Partition{Topic: "test" + retryTopicSuffix, ID: 0, Leader: 1}, Log: l})
+	// the first record has retries left and the second doesn't
+	for _, attempts := range []int32{0, 1} {
+		value, err := protocol.Encode(&protocol.RetryRecord{Topic: "test", Attempts: attempts, Value: []byte("value")})
+		req.NoError(err)
+		msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: value})
+		req.NoError(err)
+		_, err = l.Append(commitlog.NewMessageSet(0, msg))
+		req.NoError(err)
+	}
+
+	ctx := &Context{parent: context.Background(), client: &ClientInfo{}}
+	nack := func(offsets ...int64) *protocol.NackPartitionResponse {
+		res := b.handleNack(ctx, &protocol.NackRequest{
+			APIVersion: 1,
+			Topics: []*protocol.NackTopic{{
+				Topic:      "test" + retryTopicSuffix,
+				Partitions: []*protocol.NackPartition{{Partition: 0, Offsets: offsets}},
+			}},
+		})
+		return res.Responses[0].Partitions[0]
+	}
+
+	// a bad offset fails the nack before any records are routed
+	res := nack(0, 5)
+	req.Equal(protocol.ErrOffsetOutOfRange.Code(), res.ErrorCode)
+	req.Equal([]int64{0, 5}, res.FailedOffsets)
+	req.Equal(int64(2), l.NewestOffset())
+
+	// only the record that wasn't routed is to be nacked again
+	res = nack(0, 1)
+	req.Equal(protocol.ErrUnknownTopicOrPartition.Code(), res.ErrorCode)
+	req.Equal([]int64{1}, res.FailedOffsets)
+	req.Equal(int64(3), l.NewestOffset())
+}
@@ -0,0 +1,106 @@
+package jocko
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// namespaces are the tenants' namespaces by name. Topics and groups outside
+// them are left to the authorizer, if there is one.
+type namespaces map[string]*config.NamespaceConfig
+
+// newNamespaces checks the namespaces' configs, so a bad namespace fails the
+// broker's start rather than its topics' creation.
+func newNamespaces(cfgs []config.NamespaceConfig) (namespaces, error) {
+	ns := make(namespaces)
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		if cfg.Name == "" || strings.Contains(cfg.Name, ".") {
+			return nil, fmt.Errorf("namespace name %q is empty or has a dot", cfg.Name)
+		}
+		if _, ok := ns[cfg.Name]; ok {
+			return nil, fmt.Errorf("namespace %s is configured twice", cfg.Name)
+		}
+		topicConfig := structs.NewTopicConfig()
+		for k, v := range cfg.TopicConfigs {
+			if err := topicConfig.SetString(k, v); err != nil {
+				return nil, fmt.Errorf("namespace %s: %v", cfg.Name, err)
+			}
+		}
+		ns[cfg.Name] = cfg
+	}
+	return ns, nil
+}
+
+// namespace returns the namespace the topic or group's in, or nil if it isn't
+// in one.
+func (ns namespaces) namespace(name string) *config.NamespaceConfig {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return nil
+	}
+	return ns[name[:i]]
+}
+
+// allowed returns whether the principal can see and use the topic or group,
+// i.e. it isn't in a namespace or it's in one of the principal's.
+func (ns namespaces) allowed(principal, name string) bool {
+	n := ns.namespace(name)
+	if n == nil {
+		return true
+	}
+	for _, p := range n.Principals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// member returns whether the principal's one of a namespace's.
+func (ns namespaces) member(principal string) bool {
+	for _, n := range ns {
+		for _, p := range n.Principals {
+			if p == principal {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyNamespaceConfigs adds the topic's namespace's topic configs to the
+// request's, keeping those it already has.
+func (b *Broker) applyNamespaceConfigs(req *protocol.CreateTopicRequest) {
+	n := b.namespaces.namespace(req.Topic)
+	if n == nil {
+		return
+	}
+	if req.Configs == nil && len(n.TopicConfigs) > 0 {
+		req.Configs = make(map[string]*string)
+	}
+	for k, v := range n.TopicConfigs {
+		if _, ok := req.Configs[k]; ok {
+			continue
+		}
+		v := v
+		req.Configs[k] = &v
+	}
+}
+
+// throttleNamespace takes n bytes produced to the topic from its namespace's
+// produce quota and returns how long the producer should be throttled for.
+func (b *Broker) throttleNamespace(topic string, n int, now time.Time) time.Duration {
+	ns := b.namespaces.namespace(topic)
+	if ns == nil {
+		return 0
+	}
+	// topic names can't have colons so the namespace's bucket can't be a
+	// topic's
+	return b.throttles.record("namespace:"+ns.Name, ns.ProduceByteRate, n, now)
+}
@@ -0,0 +1,104 @@
+package jocko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestNamespaces(t *testing.T) {
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	require.NoError(t, err)
+	apply := func(typ structs.MessageType, req interface{}) {
+		buf, err := structs.Encode(typ, req)
+		require.NoError(t, err)
+		f.Apply(&raft.Log{Data: buf})
+	}
+	for _, topic := range []string{"payments.orders", "search.docs", "shared"} {
+		apply(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+			Topic: structs.Topic{Topic: topic, Partitions: map[int32][]int32{}, Config: structs.NewTopicConfig()},
+		})
+	}
+	ns, err := newNamespaces([]config.NamespaceConfig{
+		{Name: "payments", Principals: []string{"alice"}, ProduceByteRate: 100, TopicConfigs: map[string]string{"retention.ms": "1000"}},
+		{Name: "search", Principals: []string{"bob"}},
+	})
+	require.NoError(t, err)
+	b := &Broker{config: &config.Config{Addr: "localhost:9092"}, fsm: f, store: &fsmStore{fsm: f}, namespaces: ns, throttles: newProduceThrottles(), tracer: stdopentracing.NoopTracer{}}
+	client := &ClientInfo{}
+	client.SetPrincipal("alice")
+	ctx := &Context{parent: context.Background(), client: client}
+
+	// alice sees her namespace's topics and those outside namespaces
+	metadata := b.handleMetadata(ctx, &protocol.MetadataRequest{})
+	var topics []string
+	for _, tm := range metadata.TopicMetadata {
+		topics = append(topics, tm.Topic)
+	}
+	require.ElementsMatch(t, []string{"payments.orders", "shared"}, topics)
+	metadata = b.handleMetadata(ctx, &protocol.MetadataRequest{Topics: []string{"search.docs"}})
+	require.Equal(t, protocol.ErrTopicAuthorizationFailed.Code(), metadata.TopicMetadata[0].TopicErrorCode)
+
+	offsets := b.handleOffsetFetch(ctx, &protocol.OffsetFetchRequest{GroupID: "search.indexer", Topics: []protocol.OffsetFetchTopicRequest{{Topic: "search.docs", Partitions: []int32{0}}}})
+	require.Equal(t, protocol.ErrGroupAuthorizationFailed.Code(), offsets.Responses[0].Partitions[0].ErrorCode)
+
+	// every request for another namespace's topics and groups is refused
+	heartbeat := b.handleHeartbeat(ctx, &protocol.HeartbeatRequest{GroupID: "search.indexer"})
+	require.Equal(t, protocol.ErrGroupAuthorizationFailed.Code(), heartbeat.ErrorCode)
+	groups := b.handleDescribeGroups(ctx, &protocol.DescribeGroupsRequest{GroupIDs: []string{"search.indexer"}})
+	require.Equal(t, protocol.ErrGroupAuthorizationFailed.Code(), groups.Groups[0].ErrorCode)
+	listed := b.handleOffsets(ctx, &protocol.OffsetsRequest{Topics: []*protocol.OffsetsTopic{{Topic: "search.docs", Partitions: []*protocol.OffsetsPartition{{Partition: 0, Timestamp: -1}}}}})
+	require.Equal(t, protocol.ErrTopicAuthorizationFailed.Code(), listed.Responses[0].PartitionResponses[0].ErrorCode)
+	altered := b.handleAlterConfigs(ctx, &protocol.AlterConfigsRequest{Resources: []protocol.AlterConfigsResource{{Type: protocol.TopicResourceType, Name: "search.docs"}}})
+	require.Equal(t, protocol.ErrTopicAuthorizationFailed.Code(), altered.Resources[0].ErrorCode)
+	// fetching as a replica skips the topic's checks, so only brokers can
+	fetched := b.handleFetch(ctx, &protocol.FetchRequest{ReplicaID: 1, MaxWaitTime: time.Second, Topics: []*protocol.FetchTopic{
+		{Topic: "search.docs", Partitions: []*protocol.FetchPartition{{Partition: 0}}},
+		{Topic: "search.docs" + stagingTopicSuffix, Partitions: []*protocol.FetchPartition{{Partition: 0}}},
+	}})
+	require.Equal(t, protocol.ErrClusterAuthorizationFailed.Code(), fetched.Responses[0].PartitionResponses[0].ErrorCode)
+	require.Equal(t, protocol.ErrClusterAuthorizationFailed.Code(), fetched.Responses[1].PartitionResponses[0].ErrorCode)
+
+	// tenants can't alter other namespaces' partitions or the cluster
+	readOnly := b.handleAlterPartitionReadOnly(ctx, &protocol.AlterPartitionReadOnlyRequest{Partitions: []*protocol.PartitionReadOnly{{Topic: "search.docs", Partition: 0, ReadOnly: true}}})
+	require.Equal(t, protocol.ErrTopicAuthorizationFailed.Code(), readOnly.Partitions[0].ErrorCode)
+	maintenance := b.handleAlterBrokerMaintenance(ctx, &protocol.AlterBrokerMaintenanceRequest{BrokerID: 1, Maintenance: true})
+	require.Equal(t, protocol.ErrClusterAuthorizationFailed.Code(), maintenance.ErrorCode)
+	migrated := b.handleAlterOffsetsTopicPartitions(ctx, &protocol.AlterOffsetsTopicPartitionsRequest{Partitions: 100})
+	require.Equal(t, protocol.ErrClusterAuthorizationFailed.Code(), migrated.ErrorCode)
+
+	// the namespace's topics get its default configs
+	req := &protocol.CreateTopicRequest{Topic: "payments.refunds"}
+	b.applyNamespaceConfigs(req)
+	require.Equal(t, "1000", *req.Configs["retention.ms"])
+	retention := "5000"
+	req = &protocol.CreateTopicRequest{Topic: "payments.refunds", Configs: map[string]*string{"retention.ms": &retention}}
+	b.applyNamespaceConfigs(req)
+	require.Equal(t, "5000", *req.Configs["retention.ms"])
+
+	// the namespace's topics share its produce quota
+	now := time.Now()
+	require.Equal(t, time.Duration(0), b.throttleNamespace("payments.orders", 60, now))
+	require.Equal(t, 200*time.Millisecond, b.throttleNamespace("payments.refunds", 60, now))
+	require.Equal(t, time.Duration(0), b.throttleNamespace("shared", 1000, now))
+}
+
+func TestNewNamespaces(t *testing.T) {
+	for _, cfgs := range [][]config.NamespaceConfig{
+		{{Name: ""}},
+		{{Name: "a.b"}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a", TopicConfigs: map[string]string{"retention.ms": "soon"}}},
+	} {
+		_, err := newNamespaces(cfgs)
+		require.Error(t, err)
+	}
+}
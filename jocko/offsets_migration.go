@@ -0,0 +1,216 @@
+package jocko
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/jocko/util"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func (b *Broker) handleAlterOffsetsTopicPartitions(ctx *Context, req *protocol.AlterOffsetsTopicPartitionsRequest) *protocol.AlterOffsetsTopicPartitionsResponse {
+	sp := span(ctx, b.tracer, "alter offsets topic partitions")
+	defer sp.Finish()
+	res := &protocol.AlterOffsetsTopicPartitionsResponse{}
+	res.APIVersion = req.Version()
+	if !b.authorized(ctx, policy.AlterOperation, policy.ClusterResource, "") {
+		res.ErrorCode = protocol.ErrClusterAuthorizationFailed.Code()
+		return res
+	}
+	if !b.isController() {
+		res.ErrorCode = protocol.ErrNotController.Code()
+		return res
+	}
+	moves, err := b.migrateOffsetsTopic(ctx, req.Partitions, req.ValidateOnly, req.Force)
+	if err != protocol.ErrNone {
+		log.Info.Printf("broker/%d: alter offsets topic partitions to %d rejected: %s", b.config.ID, req.Partitions, err)
+	}
+	res.ErrorCode = err.Code()
+	res.Moves = moves
+	return res
+}
+
+// migrateOffsetsTopic grows the offsets topic to the number of partitions and
+// hands the groups now hashed to other partitions off to those partitions'
+// leaders. The new partitions, the topic, and the groups' coordinators are
+// registered with one raft log entry so FindCoordinator never sees a partition
+// count without its partitions. Groups' members are in the replicated state,
+// and the moved groups' offsets are read from their old partitions and copied
+// to their new ones, so the groups carry on with their new coordinator. An
+// offset committed to the new coordinator before it's copied is overwritten
+// by the older one, so the group consumes some records again. It's refused
+// while groups are rebalancing unless it's forced, since their members would
+// be sent to another coordinator mid-rebalance.
+func (b *Broker) migrateOffsetsTopic(ctx *Context, count int32, validateOnly, force bool) ([]*protocol.GroupCoordinatorMove, protocol.Error) {
+	topic, err := b.offsetsTopic(ctx)
+	if err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	prev := int32(len(topic.Partitions))
+	if count <= prev {
+		// partitions can't be removed, and the same count moves nothing
+		return nil, protocol.ErrInvalidPartitions.WithErr(fmt.Errorf("offsets topic has %d partitions, it can only grow", prev))
+	}
+	state := b.fsm.State()
+	_, groups, err := state.GetGroups()
+	if err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if !force {
+		for _, g := range groups {
+			if g.State == structs.GroupStatePreparingRebalance || g.State == structs.GroupStateCompletingRebalance {
+				return nil, protocol.ErrRebalanceInProgress
+			}
+		}
+	}
+
+	replicationFactor := int16(len(topic.Partitions[0]))
+	built, perr := b.buildPartitions(OffsetsTopicName, count, replicationFactor)
+	if perr != protocol.ErrNone {
+		return nil, perr
+	}
+	leaders := make(map[int32]int32, count)
+	for i := int32(0); i < prev; i++ {
+		_, p, err := state.GetPartition(OffsetsTopicName, i)
+		if err != nil {
+			return nil, protocol.ErrUnknown.WithErr(err)
+		}
+		if p != nil {
+			leaders[i] = p.Leader
+		}
+	}
+	var added []structs.Partition
+	for _, p := range built {
+		if p.ID >= prev {
+			added = append(added, p)
+			leaders[p.ID] = p.Leader
+		}
+	}
+
+	var moves []*protocol.GroupCoordinatorMove
+	var moved []*structs.Group
+	for _, g := range groups {
+		hash := util.Hash(g.Group)
+		from := int32(hash % uint64(prev))
+		to := int32(hash % uint64(count))
+		if from == to {
+			continue
+		}
+		moves = append(moves, &protocol.GroupCoordinatorMove{
+			GroupID:         g.Group,
+			FromPartition:   from,
+			ToPartition:     to,
+			FromCoordinator: leaders[from],
+			ToCoordinator:   leaders[to],
+		})
+		moved = append(moved, g)
+	}
+	sort.Slice(moves, func(i, j int) bool { return moves[i].GroupID < moves[j].GroupID })
+	if validateOnly {
+		return moves, protocol.ErrNone
+	}
+	offsets, perr := b.movedOffsets(ctx, moves)
+	if perr != protocol.ErrNone {
+		return nil, perr
+	}
+
+	topicCopy := *topic
+	topicCopy.Partitions = make(map[int32][]int32, count)
+	for id, ar := range topic.Partitions {
+		topicCopy.Partitions[id] = ar
+	}
+	for _, p := range added {
+		topicCopy.Partitions[p.ID] = p.AR
+	}
+	batch := new(structs.BatchRequest)
+	if err := batch.Add(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{Topic: topicCopy}); err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	for _, g := range moved {
+		groupCopy := *g
+		groupCopy.Coordinator = leaders[int32(util.Hash(g.Group)%uint64(count))]
+		if err := batch.Add(structs.RegisterGroupRequestType, structs.RegisterGroupRequest{Group: groupCopy}); err != nil {
+			return nil, protocol.ErrUnknown.WithErr(err)
+		}
+	}
+	// registers the new partitions with the batch and starts their replicas,
+	// all at once rather than paced like other leader changes so it's one
+	// raft log entry
+	if err := b.applyLeaderChangeBatch(batch, added); err != nil {
+		log.Error.Printf("broker/%d: migrate offsets topic to %d partitions error: %s", b.config.ID, count, err)
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if len(offsets) > 0 {
+		if perr := b.writeOffsets(offsets, false); perr != protocol.ErrNone {
+			log.Error.Printf("broker/%d: copy moved groups' offsets error: %s", b.config.ID, perr)
+			return moves, perr
+		}
+	}
+	log.Info.Printf("broker/%d: migrated offsets topic from %d to %d partitions, moved %d groups", b.config.ID, prev, count, len(moves))
+	return moves, protocol.ErrNone
+}
+
+// movedOffsets returns the offsets the moved groups committed to their old
+// partitions, read from the log if this broker leads the partition and asked
+// of its leader otherwise.
+func (b *Broker) movedOffsets(ctx *Context, moves []*protocol.GroupCoordinatorMove) ([]committedOffset, protocol.Error) {
+	var offsets []committedOffset
+	var topics []protocol.OffsetFetchTopicRequest
+	now := time.Now()
+	for _, m := range moves {
+		if m.FromCoordinator == b.config.ID {
+			replica, err := b.replicaLookup.Replica(OffsetsTopicName, m.FromPartition)
+			if err != nil || replica.Log == nil {
+				return nil, protocol.ErrCoordinatorNotAvailable
+			}
+			group := m.GroupID
+			committed, err := b.offsets.committed(m.FromPartition, replica.Log, func(k offsetKey) bool {
+				return k.Group == group
+			})
+			if err != nil {
+				return nil, protocol.ErrUnknown.WithErr(err)
+			}
+			offsets = append(offsets, committed...)
+			continue
+		}
+		if topics == nil {
+			// every partition's asked for since the group could've
+			// committed any of them
+			_, ts, err := b.fsm.State().GetTopics()
+			if err != nil {
+				return nil, protocol.ErrUnknown.WithErr(err)
+			}
+			for _, t := range ts {
+				ft := protocol.OffsetFetchTopicRequest{Topic: t.Topic}
+				for id := range t.Partitions {
+					ft.Partitions = append(ft.Partitions, id)
+				}
+				topics = append(topics, ft)
+			}
+		}
+		res, err := b.peers.OffsetFetch(ctx, m.FromCoordinator, &protocol.OffsetFetchRequest{GroupID: m.GroupID, Topics: topics})
+		if err != nil {
+			return nil, protocol.ErrCoordinatorNotAvailable.WithErr(err)
+		}
+		for _, t := range res.Responses {
+			for _, p := range t.Partitions {
+				if p.ErrorCode != protocol.ErrNone.Code() {
+					return nil, protocol.Errs[p.ErrorCode]
+				}
+				if p.Offset < 0 {
+					continue
+				}
+				offset := structs.GroupOffset{Group: m.GroupID, Topic: t.Topic, Partition: p.Partition, Offset: p.Offset}
+				if p.Metadata != nil {
+					offset.Metadata = *p.Metadata
+				}
+				offsets = append(offsets, b.newCommittedOffset(offset, 0, now))
+			}
+		}
+	}
+	return offsets, protocol.ErrNone
+}
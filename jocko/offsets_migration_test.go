@@ -0,0 +1,80 @@
+package jocko
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestMigrateOffsetsTopic(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	store := &fsmStore{fsm: f}
+	b := &Broker{
+		config: &config.Config{ID: 1, OffsetsTopicReplicationFactor: 1, ControllerMaxLeaderChanges: 1},
+		fsm:    f,
+		store:  store,
+		tracer: stdopentracing.NoopTracer{},
+		ctx:    context.Background(),
+		// the new partitions' leaders aren't known so they aren't sent the
+		// changes
+		peers:         newBrokerClient(1, NewBrokerLookup()),
+		brokerLookup:  NewBrokerLookup(),
+		replicaLookup: NewReplicaLookup(),
+		offsets:       newOffsetStore(nil),
+	}
+	b.brokerLookup.AddBroker(&metadata.Broker{ID: 1, RaftAddr: "broker-1"})
+	topic := structs.Topic{Topic: OffsetsTopicName, Internal: true, Partitions: map[int32][]int32{0: {1}, 1: {1}}}
+	partitions := []structs.Partition{
+		{Topic: OffsetsTopicName, ID: 0, Partition: 0, Leader: 1, AR: []int32{1}, ISR: []int32{1}},
+		{Topic: OffsetsTopicName, ID: 1, Partition: 1, Leader: 1, AR: []int32{1}, ISR: []int32{1}},
+	}
+	req.NoError(b.registerTopic(topic, partitions))
+	// the old partitions' replicas, the moved groups' offsets are read from
+	// them
+	for _, p := range partitions {
+		dir, err := ioutil.TempDir("", "offsets")
+		req.NoError(err)
+		defer os.RemoveAll(dir)
+		l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+		req.NoError(err)
+		defer l.Close()
+		b.replicaLookup.AddReplica(&Replica{BrokerID: 1, Partition: p, IsLocal: true, Log: l})
+	}
+	for i := 0; i < 10; i++ {
+		_, err := b.raftApply(structs.RegisterGroupRequestType, structs.RegisterGroupRequest{
+			Group: structs.Group{Group: fmt.Sprintf("group-%d", i), Coordinator: 1, State: structs.GroupStateStable},
+		})
+		req.NoError(err)
+	}
+
+	ctx := &Context{parent: context.Background(), client: &ClientInfo{apiVersions: make(map[int16]int16)}}
+	index := store.index
+	moves, perr := b.migrateOffsetsTopic(ctx, 8, false, false)
+	req.Equal(protocol.ErrNone, perr)
+	req.NotEmpty(moves)
+
+	// the topic, its new partitions, and the moved groups are one raft log
+	// entry, not paced by the max leader changes
+	req.Equal(index+1, store.index)
+	_, migrated, err := f.State().GetTopic(OffsetsTopicName)
+	req.NoError(err)
+	req.Len(migrated.Partitions, 8)
+	for id := int32(2); id < 8; id++ {
+		_, p, err := f.State().GetPartition(OffsetsTopicName, id)
+		req.NoError(err)
+		req.NotNil(p)
+	}
+}
@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Operation is what a request does to a resource.
+type Operation string
+
+const (
+	DescribeOperation Operation = "describe"
+	// ReadOperation is fetching a topic or consuming as a group's member.
+	ReadOperation Operation = "read"
+	// WriteOperation is producing to a topic.
+	WriteOperation  Operation = "write"
+	CreateOperation Operation = "create"
+	DeleteOperation Operation = "delete"
+	// AlterOperation is changing a resource, e.g. a topic's configs or a
+	// broker's maintenance mode.
+	AlterOperation Operation = "alter"
+	// ClusterActionOperation is what brokers do to each other, e.g. fetching
+	// as a partition's replica.
+	ClusterActionOperation Operation = "cluster_action"
+)
+
+// ResourceType is the type of resource a request acts on.
+type ResourceType string
+
+const (
+	// ClusterResource is the cluster as a whole, its name's empty.
+	ClusterResource ResourceType = "cluster"
+	TopicResource   ResourceType = "topic"
+	GroupResource   ResourceType = "group"
+)
+
+// Authorizer decides whether a principal can run an operation on a resource.
+// The broker checks every request for a topic or group with it, and only shows
+// clients the topics, groups, and configs their principal's authorized to
+// describe.
+type Authorizer interface {
+	Authorize(principal string, op Operation, typ ResourceType, name string) bool
+}
+
+// AuthorizerFunc adapts a func to an Authorizer.
+type AuthorizerFunc func(principal string, op Operation, typ ResourceType, name string) bool
+
+func (f AuthorizerFunc) Authorize(principal string, op Operation, typ ResourceType, name string) bool {
+	return f(principal, op, typ, name)
+}
+
+var authorizers = make(map[string]Authorizer)
+
+// RegisterAuthorizer makes the authorizer available by the name. It panics if
+// the authorizer's nil or the name's taken.
+func RegisterAuthorizer(name string, a Authorizer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if a == nil {
+		panic("policy: register authorizer is nil")
+	}
+	if _, ok := authorizers[name]; ok {
+		panic("policy: register authorizer twice: " + name)
+	}
+	authorizers[name] = a
+}
+
+// AuthorizerByName returns the authorizer registered with the name.
+func AuthorizerByName(name string) (Authorizer, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	a, ok := authorizers[name]
+	if !ok {
+		return nil, fmt.Errorf("policy: unknown authorizer %q (registered: %v)", name, authorizerNames())
+	}
+	return a, nil
+}
+
+func authorizerNames() (names []string) {
+	for name := range authorizers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
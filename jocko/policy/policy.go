@@ -0,0 +1,149 @@
+// Package policy has the interfaces for plugging in policies that validate
+// admin requests, e.g. to enforce topic naming conventions or replication
+// minimums. Policies are compiled in: a package registers its policies by
+// name in an init func and the broker's configured with the names to use.
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// CreateTopicRequest is a request to create a topic.
+type CreateTopicRequest struct {
+	Topic             string
+	NumPartitions     int32
+	ReplicationFactor int16
+	Configs           map[string]string
+}
+
+// AlterConfigsRequest is a request to alter a topic's configs.
+type AlterConfigsRequest struct {
+	Topic string
+	// Configs are the configs being set.
+	Configs map[string]string
+}
+
+// CreateTopicPolicy validates requests to create topics. The error it returns
+// is sent back to the client with a policy violation.
+type CreateTopicPolicy interface {
+	ValidateCreateTopic(req *CreateTopicRequest) error
+}
+
+// AlterConfigsPolicy validates requests to alter topics' configs.
+type AlterConfigsPolicy interface {
+	ValidateAlterConfigs(req *AlterConfigsRequest) error
+}
+
+var (
+	mu                   sync.RWMutex
+	createTopicPolicies  = make(map[string]CreateTopicPolicy)
+	alterConfigsPolicies = make(map[string]AlterConfigsPolicy)
+)
+
+// RegisterCreateTopicPolicy makes the policy available by the name. It panics
+// if the policy's nil or the name's taken.
+func RegisterCreateTopicPolicy(name string, p CreateTopicPolicy) {
+	mu.Lock()
+	defer mu.Unlock()
+	if p == nil {
+		panic("policy: register create topic policy is nil")
+	}
+	if _, ok := createTopicPolicies[name]; ok {
+		panic("policy: register create topic policy twice: " + name)
+	}
+	createTopicPolicies[name] = p
+}
+
+// RegisterAlterConfigsPolicy makes the policy available by the name. It panics
+// if the policy's nil or the name's taken.
+func RegisterAlterConfigsPolicy(name string, p AlterConfigsPolicy) {
+	mu.Lock()
+	defer mu.Unlock()
+	if p == nil {
+		panic("policy: register alter configs policy is nil")
+	}
+	if _, ok := alterConfigsPolicies[name]; ok {
+		panic("policy: register alter configs policy twice: " + name)
+	}
+	alterConfigsPolicies[name] = p
+}
+
+// CreateTopic returns the create topic policy registered with the name.
+func CreateTopic(name string) (CreateTopicPolicy, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := createTopicPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("policy: unknown create topic policy %q (registered: %v)", name, createTopicNames())
+	}
+	return p, nil
+}
+
+// AlterConfigs returns the alter configs policy registered with the name.
+func AlterConfigs(name string) (AlterConfigsPolicy, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := alterConfigsPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("policy: unknown alter configs policy %q (registered: %v)", name, alterConfigsNames())
+	}
+	return p, nil
+}
+
+func createTopicNames() (names []string) {
+	for name := range createTopicPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func alterConfigsNames() (names []string) {
+	for name := range alterConfigsPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rules is a policy for common conventions. Zero values aren't enforced.
+type Rules struct {
+	// TopicName is the pattern topic names have to match.
+	TopicName *regexp.Regexp
+	// MaxPartitions is the most partitions a topic can have.
+	MaxPartitions int32
+	// MinReplicationFactor is the least replication factor a topic can have.
+	MinReplicationFactor int16
+	// LockedConfigs are configs that can't be set when creating or altering
+	// topics.
+	LockedConfigs []string
+}
+
+func (r *Rules) ValidateCreateTopic(req *CreateTopicRequest) error {
+	if r.TopicName != nil && !r.TopicName.MatchString(req.Topic) {
+		return fmt.Errorf("topic name %s doesn't match %s", req.Topic, r.TopicName)
+	}
+	if r.MaxPartitions > 0 && req.NumPartitions > r.MaxPartitions {
+		return fmt.Errorf("topic can't have more than %d partitions, requested %d", r.MaxPartitions, req.NumPartitions)
+	}
+	if r.MinReplicationFactor > 0 && req.ReplicationFactor < r.MinReplicationFactor {
+		return fmt.Errorf("topic needs a replication factor of at least %d, requested %d", r.MinReplicationFactor, req.ReplicationFactor)
+	}
+	return r.validateConfigs(req.Configs)
+}
+
+func (r *Rules) ValidateAlterConfigs(req *AlterConfigsRequest) error {
+	return r.validateConfigs(req.Configs)
+}
+
+func (r *Rules) validateConfigs(configs map[string]string) error {
+	for _, name := range r.LockedConfigs {
+		if _, ok := configs[name]; ok {
+			return fmt.Errorf("config %s can't be set", name)
+		}
+	}
+	return nil
+}
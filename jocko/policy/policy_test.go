@@ -0,0 +1,74 @@
+package policy
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRules(t *testing.T) {
+	r := &Rules{
+		TopicName:            regexp.MustCompile(`^[a-z]+\.[a-z]+$`),
+		MaxPartitions:        8,
+		MinReplicationFactor: 2,
+		LockedConfigs:        []string{"retention.ms"},
+	}
+	valid := &CreateTopicRequest{Topic: "team.events", NumPartitions: 8, ReplicationFactor: 2}
+	require.NoError(t, r.ValidateCreateTopic(valid))
+
+	for _, req := range []*CreateTopicRequest{
+		{Topic: "events", NumPartitions: 1, ReplicationFactor: 2},
+		{Topic: "team.events", NumPartitions: 9, ReplicationFactor: 2},
+		{Topic: "team.events", NumPartitions: 1, ReplicationFactor: 1},
+		{Topic: "team.events", NumPartitions: 1, ReplicationFactor: 2, Configs: map[string]string{"retention.ms": "1"}},
+	} {
+		require.Error(t, r.ValidateCreateTopic(req), req.Topic)
+	}
+	require.Error(t, r.ValidateAlterConfigs(&AlterConfigsRequest{Topic: "team.events", Configs: map[string]string{"retention.ms": "1"}}))
+}
+
+func TestRegister(t *testing.T) {
+	RegisterCreateTopicPolicy("test", &Rules{})
+	p, err := CreateTopic("test")
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	_, err = CreateTopic("missing")
+	require.Error(t, err)
+	require.Panics(t, func() { RegisterCreateTopicPolicy("test", &Rules{}) })
+}
+
+func TestRecordValidators(t *testing.T) {
+	v, err := Validator("key-required")
+	require.NoError(t, err)
+	require.Error(t, v.ValidateRecord("t", &Record{Value: []byte("v")}))
+	require.NoError(t, v.ValidateRecord("t", &Record{Key: []byte{}, Value: []byte("v")}))
+
+	RegisterRecordValidator("max-4", MaxRecordBytes(4))
+	v, err = Validator("max-4")
+	require.NoError(t, err)
+	require.NoError(t, v.ValidateRecord("t", &Record{Key: []byte("k"), Value: []byte("abc")}))
+	require.Error(t, v.ValidateRecord("t", &Record{Key: []byte("k"), Value: []byte("abcd")}))
+	_, err = Validator("missing")
+	require.Error(t, err)
+}
+
+func TestSchemaIDValidator(t *testing.T) {
+	v, err := Validator("value-schema-id")
+	require.NoError(t, err)
+	require.NoError(t, v.ValidateRecord("t", &Record{Value: []byte{0, 0, 0, 0, 7, 'a'}}))
+	require.NoError(t, v.ValidateRecord("t", &Record{}))
+	for _, value := range [][]byte{
+		[]byte(`{"a":1}`),
+		{0, 0, 0},
+		{1, 0, 0, 0, 7},
+		{0, 0, 0, 0, 0},
+	} {
+		require.Error(t, v.ValidateRecord("t", &Record{Value: value}), "%v", value)
+	}
+
+	v, err = Validator("key-schema-id")
+	require.NoError(t, err)
+	require.NoError(t, v.ValidateRecord("t", &Record{Key: []byte{0, 0, 0, 0, 1}, Value: []byte("v")}))
+	require.Error(t, v.ValidateRecord("t", &Record{Key: []byte("k"), Value: []byte{0, 0, 0, 0, 1}}))
+}
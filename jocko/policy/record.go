@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Record is a record being produced.
+type Record struct {
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+}
+
+// RecordValidator validates records as they're produced to topics listing it
+// in their record.validators config. The broker rejects the batch holding a
+// record the validator returns an error for with an invalid record error.
+// Records in compressed batches aren't validated since the broker doesn't
+// decompress them.
+type RecordValidator interface {
+	ValidateRecord(topic string, r *Record) error
+}
+
+// RecordValidatorFunc is a func used as a record validator.
+type RecordValidatorFunc func(topic string, r *Record) error
+
+func (f RecordValidatorFunc) ValidateRecord(topic string, r *Record) error {
+	return f(topic, r)
+}
+
+var recordValidators = map[string]RecordValidator{
+	"key-required": RecordValidatorFunc(func(topic string, r *Record) error {
+		if r.Key == nil {
+			return fmt.Errorf("records produced to %s need a key", topic)
+		}
+		return nil
+	}),
+	"key-schema-id":   SchemaID{Key: true},
+	"value-schema-id": SchemaID{},
+}
+
+// RegisterRecordValidator makes the validator available by the name. It panics
+// if the validator's nil or the name's taken.
+func RegisterRecordValidator(name string, v RecordValidator) {
+	mu.Lock()
+	defer mu.Unlock()
+	if v == nil {
+		panic("policy: register record validator is nil")
+	}
+	if _, ok := recordValidators[name]; ok {
+		panic("policy: register record validator twice: " + name)
+	}
+	recordValidators[name] = v
+}
+
+// Validator returns the record validator registered with the name. The
+// key-required validator, which rejects records without keys, and the
+// key-schema-id and value-schema-id validators, which reject records whose key
+// or value isn't framed with a schema id, are always registered.
+func Validator(name string) (RecordValidator, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	v, ok := recordValidators[name]
+	if !ok {
+		var names []string
+		for name := range recordValidators {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("policy: unknown record validator %q (registered: %v)", name, names)
+	}
+	return v, nil
+}
+
+// MaxRecordBytes is a validator limiting the size of records' keys and values
+// together.
+type MaxRecordBytes int
+
+func (m MaxRecordBytes) ValidateRecord(topic string, r *Record) error {
+	if n := len(r.Key) + len(r.Value); n > int(m) {
+		return fmt.Errorf("record is %d bytes, more than the max of %d", n, int(m))
+	}
+	return nil
+}
+
+// schemaIDMagicByte is the first byte of data framed with a schema registry's
+// wire format, followed by the big endian 4 byte schema id.
+const schemaIDMagicByte = 0
+
+// SchemaID is a validator checking records' values, or keys if Key's set,
+// start with the magic byte and schema id that schema registry serializers
+// frame data with. The schema id isn't looked up in a registry; it's to catch
+// producers that aren't using the serializer. Null keys and values, e.g.
+// tombstones, are valid.
+type SchemaID struct {
+	Key bool
+}
+
+func (s SchemaID) ValidateRecord(topic string, r *Record) error {
+	b, field := r.Value, "value"
+	if s.Key {
+		b, field = r.Key, "key"
+	}
+	if b == nil {
+		return nil
+	}
+	if len(b) < 5 || b[0] != schemaIDMagicByte {
+		return fmt.Errorf("record %s produced to %s doesn't start with a schema id", field, topic)
+	}
+	if id := int32(binary.BigEndian.Uint32(b[1:5])); id <= 0 {
+		return fmt.Errorf("record %s produced to %s has invalid schema id %d", field, topic, id)
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package jocko
+
+import (
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// addTransactionPartitions adds the partitions the producer's writing to its
+// ongoing transaction, so they're aborted if the producer's initialized again
+// before the transaction ends. A partition's only in one transaction at a
+// time since the message format doesn't say which transaction a message's in,
+// so read_committed consumers can only tell by the partition's next marker.
+// The producer's checked on every produce, so a fenced instance's records
+// aren't appended to the new instance's transaction.
+func (b *Broker) addTransactionPartitions(transactionalID string, producerID int64, producerEpoch int16, topics []*protocol.TopicData) protocol.Error {
+	producer, perr := b.transactionalProducer(transactionalID, producerID, producerEpoch)
+	if perr != protocol.ErrNone {
+		return perr
+	}
+	if producer.Committing || producer.Aborting {
+		// the producer has to finish its last transaction before it starts
+		// another
+		return protocol.ErrConcurrentTransactions
+	}
+	updated := copyProducer(producer)
+	var added bool
+	for _, td := range topics {
+		for _, d := range td.Data {
+			if !containsPartition(updated.Partitions[td.Topic], d.Partition) {
+				updated.Partitions[td.Topic] = append(updated.Partitions[td.Topic], d.Partition)
+				added = true
+			}
+		}
+	}
+	if !added {
+		return protocol.ErrNone
+	}
+	// the fsm checks no other transaction has the partitions as it stores
+	// the session, so two producers can't both add one
+	return b.registerProducer(updated)
+}
+
+// registerProducer stores the producer's updated session, unless the session
+// it was updated from is stale.
+func (b *Broker) registerProducer(producer structs.Producer) protocol.Error {
+	out, err := b.raftApply(structs.RegisterProducerRequestType, structs.RegisterProducerRequest{Producer: producer})
+	if err == nil {
+		err, _ = out.(error)
+	}
+	return b.producerError(producer, err)
+}
+
+// producerError returns the error to respond with for a failed update of the
+// producer's session. An update of a stale session fails with
+// ErrInvalidProducerEpoch if the producer's been fenced since, or
+// ErrConcurrentTransactions for the request to be retried otherwise, as does
+// one adding a partition that's in another transaction.
+func (b *Broker) producerError(producer structs.Producer, err error) protocol.Error {
+	if err == nil {
+		return protocol.ErrNone
+	}
+	if err == fsm.ErrPartitionInTransaction {
+		return protocol.ErrConcurrentTransactions
+	}
+	if err != fsm.ErrProducerModified {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	_, current, err := b.fsm.State().GetProducer(producer.TransactionalID)
+	if err == nil && current != nil && (current.ProducerID != producer.ProducerID || current.ProducerEpoch != producer.ProducerEpoch) {
+		return protocol.ErrInvalidProducerEpoch
+	}
+	return protocol.ErrConcurrentTransactions
+}
+
+// finishTransaction writes the markers of the transaction the producer's last
+// session left ongoing, and its offsets if it's committed, then clears it from
+// the producer's new session. It's kept in the session until they're written,
+// so if they fail the producer's initialized again to retry them rather than
+// the transaction being left open on its partitions.
+func (b *Broker) finishTransaction(init *structs.InitProducerResponse) protocol.Error {
+	var err error
+	if len(init.Aborted) > 0 {
+		err = b.endTransaction(init.Producer, init.Aborted, protocol.ControlRecordAbort)
+	}
+	if len(init.Committed) > 0 {
+		err = b.endTransaction(init.Producer, init.Committed, protocol.ControlRecordCommit)
+	}
+	if init.Producer.Committing {
+		if perr := b.commitTxnOffsets(init.Producer); perr != protocol.ErrNone {
+			err = perr
+		}
+	}
+	if err != nil {
+		return protocol.ErrConcurrentTransactions
+	}
+	ended := copyProducer(&init.Producer)
+	ended.Partitions = nil
+	ended.Offsets = nil
+	ended.Committing = false
+	ended.Aborting = false
+	return b.registerProducer(ended)
+}
+
+// copyProducer copies the producer's session so it can be changed, since the
+// one in the store is shared.
+func copyProducer(producer *structs.Producer) structs.Producer {
+	updated := *producer
+	updated.Partitions = make(map[string][]int32, len(producer.Partitions))
+	for topic, partitions := range producer.Partitions {
+		updated.Partitions[topic] = append([]int32(nil), partitions...)
+	}
+	updated.Offsets = append([]structs.GroupOffset(nil), producer.Offsets...)
+	return updated
+}
+
+// transactionalProducer returns the producer's session if the producer ID and
+// epoch are its current session's, i.e. the producer hasn't been fenced by a
+// newer instance of it.
+func (b *Broker) transactionalProducer(transactionalID string, producerID int64, producerEpoch int16) (*structs.Producer, protocol.Error) {
+	_, producer, err := b.fsm.State().GetProducer(transactionalID)
+	if err != nil {
+		return nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if producer == nil || producer.ProducerID != producerID {
+		return nil, protocol.ErrInvalidProducerIdMapping
+	}
+	if producer.ProducerEpoch != producerEpoch {
+		return nil, protocol.ErrInvalidProducerEpoch
+	}
+	return producer, protocol.ErrNone
+}
+
+func (b *Broker) handleEndTxn(ctx *Context, req *protocol.EndTxnRequest) *protocol.EndTxnResponse {
+	sp := span(ctx, b.tracer, "end txn")
+	defer sp.Finish()
+	res := &protocol.EndTxnResponse{APIVersion: req.Version()}
+	if err := b.endTxn(req); err != protocol.ErrNone {
+		log.Error.Printf("broker/%d: end transaction of %s error: %s", b.config.ID, req.TransactionalID, err)
+		res.ErrorCode = err.Code()
+	}
+	return res
+}
+
+// endTxn commits or aborts the producer's ongoing transaction. A commit marks
+// it committing, after which it's committed even if its offsets and markers
+// aren't all written: they're written when the commit's retried or the
+// producer's initialized again.
+func (b *Broker) endTxn(req *protocol.EndTxnRequest) protocol.Error {
+	producer, perr := b.transactionalProducer(req.TransactionalID, req.ProducerID, req.ProducerEpoch)
+	if perr != protocol.ErrNone {
+		return perr
+	}
+	typ := protocol.ControlRecordAbort
+	if req.Committed {
+		typ = protocol.ControlRecordCommit
+		if !producer.Committing {
+			committing := copyProducer(producer)
+			committing.Committing = true
+			if err := b.registerProducer(committing); err != protocol.ErrNone {
+				return err
+			}
+		}
+		if err := b.commitTxnOffsets(*producer); err != protocol.ErrNone {
+			return err
+		}
+	} else if producer.Committing {
+		return protocol.ErrInvalidTxnState
+	}
+	if err := b.endTransaction(*producer, producer.Partitions, typ); err != nil {
+		// the transaction's left ongoing so the producer can retry ending it
+		if perr, ok := err.(protocol.Error); ok {
+			return perr
+		}
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	// read again since marking it committing modified it
+	if producer, perr = b.transactionalProducer(req.TransactionalID, req.ProducerID, req.ProducerEpoch); perr != protocol.ErrNone {
+		return perr
+	}
+	ended := copyProducer(producer)
+	ended.Partitions = nil
+	ended.Offsets = nil
+	ended.Committing = false
+	return b.registerProducer(ended)
+}
+
+func (b *Broker) handleTxnOffsetCommit(ctx *Context, req *protocol.TxnOffsetCommitRequest) *protocol.TxnOffsetCommitResponse {
+	sp := span(ctx, b.tracer, "txn offset commit")
+	defer sp.Finish()
+	res := &protocol.TxnOffsetCommitResponse{APIVersion: req.Version()}
+	res.Responses = make([]protocol.OffsetCommitTopicResponse, len(req.Topics))
+
+	producer, txnErr := b.transactionalProducer(req.TransactionalID, req.ProducerID, req.ProducerEpoch)
+	if txnErr == protocol.ErrNone && producer.Committing {
+		txnErr = protocol.ErrConcurrentTransactions
+	}
+	if txnErr == protocol.ErrNone && !b.authorized(ctx, policy.ReadOperation, policy.GroupResource, req.GroupID) {
+		txnErr = protocol.ErrGroupAuthorizationFailed
+	}
+	state := b.fsm.State()
+	var offsets []structs.GroupOffset
+	for i, t := range req.Topics {
+		res.Responses[i].Topic = t.Topic
+		res.Responses[i].PartitionResponses = make([]protocol.OffsetCommitPartitionResponse, len(t.Partitions))
+		for j, p := range t.Partitions {
+			pres := &res.Responses[i].PartitionResponses[j]
+			pres.Partition = p.Partition
+			pres.ErrorCode = txnErr.Code()
+			if txnErr != protocol.ErrNone {
+				continue
+			}
+			_, partition, err := state.GetPartition(t.Topic, p.Partition)
+			if err != nil {
+				pres.ErrorCode = protocol.ErrUnknown.Code()
+				continue
+			}
+			if partition == nil {
+				pres.ErrorCode = protocol.ErrUnknownTopicOrPartition.Code()
+				continue
+			}
+			offset := structs.GroupOffset{
+				Group:     req.GroupID,
+				Topic:     t.Topic,
+				Partition: p.Partition,
+				Offset:    p.Offset,
+			}
+			if p.Metadata != nil {
+				offset.Metadata = *p.Metadata
+			}
+			offsets = append(offsets, offset)
+		}
+	}
+	if len(offsets) == 0 {
+		return res
+	}
+	// the offsets replace those committed earlier in the transaction
+	updated := copyProducer(producer)
+	updated.Offsets = updated.Offsets[:0]
+	for _, o := range producer.Offsets {
+		var replaced bool
+		for _, n := range offsets {
+			if o.Group == n.Group && o.Topic == n.Topic && o.Partition == n.Partition {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			updated.Offsets = append(updated.Offsets, o)
+		}
+	}
+	updated.Offsets = append(updated.Offsets, offsets...)
+	if err := b.registerProducer(updated); err != protocol.ErrNone {
+		log.Error.Printf("broker/%d: txn offset commit error: %s", b.config.ID, err)
+		for _, t := range res.Responses {
+			for j := range t.PartitionResponses {
+				t.PartitionResponses[j].ErrorCode = err.Code()
+			}
+		}
+	}
+	return res
+}
+
+// commitTxnOffsets commits the offsets committed with the producer's
+// transaction to their groups.
+func (b *Broker) commitTxnOffsets(producer structs.Producer) protocol.Error {
+	if len(producer.Offsets) == 0 {
+		return protocol.ErrNone
+	}
+	now := time.Now()
+	offsets := make([]committedOffset, len(producer.Offsets))
+	for i, o := range producer.Offsets {
+		offsets[i] = b.newCommittedOffset(o, 0, now)
+	}
+	return b.writeOffsets(offsets, false)
+}
+
+func containsPartition(partitions []int32, partition int32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTransactional checks the producer can produce the record set's
+// messages to the partition. Only brokers write markers, with write txn
+// markers requests, so clients can't end other producers' transactions.
+// Transactional messages are only accepted in transactional produce requests,
+// whose producer's live session has the partition in its transaction, since
+// read_committed consumers hold them until the partition's next marker, and
+// all the messages in those requests must be transactional.
+func (b *Broker) validateTransactional(req *protocol.ProduceRequest, txn *protocol.TransactionalProduceRequest, topic string, partition int32, recordSet []byte) (*protocol.RecordError, protocol.Error) {
+	for i, ms := range commitlog.MessageSets(recordSet) {
+		msgs, err := decompressedMessages(ms)
+		if err != nil {
+			return newRecordError(i, err.Error()), protocol.ErrCorruptMessage
+		}
+		for _, m := range msgs {
+			if m.Control() {
+				return newRecordError(i, "control records are only written by brokers"), protocol.ErrInvalidRecord
+			}
+			if m.Compressed() {
+				// its records are checked
+				continue
+			}
+			if m.Transactional() && txn == nil {
+				return newRecordError(i, "transactional records are only accepted in transactional produce requests"), protocol.ErrInvalidRecord
+			}
+			if !m.Transactional() && txn != nil {
+				return newRecordError(i, "records produced in a transaction must be transactional"), protocol.ErrInvalidRecord
+			}
+		}
+	}
+	if txn == nil {
+		return nil, protocol.ErrNone
+	}
+	producer, perr := b.transactionalProducer(*req.TransactionalID, txn.ProducerID, txn.ProducerEpoch)
+	if perr != protocol.ErrNone {
+		return nil, perr
+	}
+	if producer.Committing || producer.Aborting || !containsPartition(producer.Partitions[topic], partition) {
+		return nil, protocol.ErrInvalidTxnState
+	}
+	return nil, protocol.ErrNone
+}
+
+// decompressedMessages returns the message set's messages, followed by the
+// messages compressed in them.
+func decompressedMessages(ms commitlog.MessageSet) ([]commitlog.Message, error) {
+	msgs := ms.Messages()
+	for _, m := range msgs {
+		if !m.Compressed() {
+			continue
+		}
+		sets, err := m.DecompressLimit(maxDecompressedBytes)
+		if err != nil {
+			return nil, err
+		}
+		for _, inner := range sets {
+			msgs = append(msgs, inner.Messages()...)
+		}
+	}
+	return msgs, nil
+}
+
+func newRecordError(batchIndex int, msg string) *protocol.RecordError {
+	return &protocol.RecordError{BatchIndex: int32(batchIndex), BatchIndexErrorMessage: &msg}
+}
+
+// endTransaction writes the markers of the type to the partitions of the
+// producer's transaction so read_committed consumers deliver, or skip, its
+// records. It writes to all the partitions and returns the first error.
+func (b *Broker) endTransaction(producer structs.Producer, partitions map[string][]int32, typ protocol.ControlRecordType) error {
+	var firstErr error
+	for topic, ids := range partitions {
+		for _, id := range ids {
+			if err := b.writeMarker(producer, topic, id, typ); err != nil {
+				log.Error.Printf("broker/%d: end transaction of %s on %s-%d error: %s", b.config.ID, producer.TransactionalID, topic, id, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+// writeMarker appends the marker to the partition, or asks the partition's
+// leader to if it's another broker.
+func (b *Broker) writeMarker(producer structs.Producer, topic string, partition int32, typ protocol.ControlRecordType) error {
+	_, p, err := b.fsm.State().GetPartition(topic, partition)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	if p.Leader == b.config.ID {
+		if perr := b.appendMarker(topic, partition, typ); perr != protocol.ErrNone {
+			return perr
+		}
+		return nil
+	}
+	res, err := b.peers.WriteTxnMarkers(b.ctx, p.Leader, &protocol.WriteTxnMarkersRequest{
+		Markers: []*protocol.WritableTxnMarker{{
+			ProducerID:    producer.ProducerID,
+			ProducerEpoch: producer.ProducerEpoch,
+			Committed:     typ == protocol.ControlRecordCommit,
+			Topics:        []*protocol.WritableTxnMarkerTopic{{Topic: topic, Partitions: []int32{partition}}},
+		}},
+	}, b.fenceLeader(topic, partition, p.Leader))
+	if err == errUnknownBroker {
+		return protocol.ErrLeaderNotAvailable
+	}
+	if err != nil {
+		return err
+	}
+	if code := res.Markers[0].Topics[0].Partitions[0].ErrorCode; code != protocol.ErrNone.Code() {
+		return protocol.Errs[code]
+	}
+	return nil
+}
+
+// appendMarker appends a marker of the type to the partition the way produced
+// records are, following the transaction's staged records.
+func (b *Broker) appendMarker(topic string, partition int32, typ protocol.ControlRecordType) protocol.Error {
+	replica, err := b.replicaLookup.Replica(topic, partition)
+	if err != nil || replica == nil || replica.Log == nil {
+		return protocol.ErrReplicaNotAvailable
+	}
+	if replica.Partition.Leader != b.config.ID {
+		return protocol.ErrNotLeaderForPartition
+	}
+	if b.logDirOffline() {
+		return protocol.ErrKafkaStorageError
+	}
+	if _, p, err := b.fsm.State().GetPartition(topic, partition); err == nil && p != nil && p.ReadOnly {
+		return protocol.ErrLeaderNotAvailable
+	}
+	key, err := protocol.Encode(&protocol.ControlRecord{Type: typ})
+	if err != nil {
+		panic(err)
+	}
+	m, err := protocol.Encode(&protocol.Message{
+		MagicByte:  1,
+		Attributes: protocol.ControlAttribute,
+		Timestamp:  time.Now(),
+		Key:        key,
+		Value:      []byte{},
+	})
+	if err != nil {
+		panic(err)
+	}
+	_, staged, perr := b.appendRecords(b.ctx, replica, commitlog.NewMessageSet(0, m))
+	if perr == protocol.ErrNone && staged != nil {
+		_, perr = b.waitStaged(b.ctx, replica, staged)
+	}
+	return perr
+}
+
+func (b *Broker) handleWriteTxnMarkers(ctx *Context, req *protocol.WriteTxnMarkersRequest) *protocol.WriteTxnMarkersResponse {
+	sp := span(ctx, b.tracer, "write txn markers")
+	defer sp.Finish()
+	// only brokers write markers
+	authorized := b.brokerAuthorized(ctx)
+	res := &protocol.WriteTxnMarkersResponse{APIVersion: req.Version()}
+	for _, m := range req.Markers {
+		typ := protocol.ControlRecordAbort
+		if m.Committed {
+			typ = protocol.ControlRecordCommit
+		}
+		mres := &protocol.WritableTxnMarkerResult{ProducerID: m.ProducerID}
+		for _, t := range m.Topics {
+			tres := &protocol.WritableTxnMarkerTopicResult{Topic: t.Topic}
+			for _, partition := range t.Partitions {
+				err := protocol.ErrClusterAuthorizationFailed
+				if authorized {
+					err = b.appendMarker(t.Topic, partition, typ)
+				}
+				if err != protocol.ErrNone {
+					log.Error.Printf("broker/%d: write txn marker to %s-%d error: %s", b.config.ID, t.Topic, partition, err)
+				}
+				tres.Partitions = append(tres.Partitions, &protocol.WritableTxnMarkerPartitionResult{Partition: partition, ErrorCode: err.Code()})
+			}
+			mres.Topics = append(mres.Topics, tres)
+		}
+		res.Markers = append(res.Markers, mres)
+	}
+	return res
+}
@@ -0,0 +1,214 @@
+package jocko
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestTransactions(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	b := &Broker{
+		config: &config.Config{ID: 1, TransactionMaxTimeout: time.Minute},
+		fsm:    f,
+		store:  &fsmStore{fsm: f},
+		tracer: stdopentracing.NoopTracer{},
+		ctx:    context.Background(),
+		// the partition's leader isn't known so its markers can't be written
+		peers: newBrokerClient(1, NewBrokerLookup()),
+	}
+	for _, id := range []int32{0, 1} {
+		_, err := b.raftApply(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{
+			Partition: structs.Partition{ID: id, Partition: id, Topic: "test", Leader: 2},
+		})
+		req.NoError(err)
+	}
+	ctx := &Context{parent: context.Background(), client: &ClientInfo{apiVersions: make(map[int16]int16)}}
+	initProducer := func(transactionalID string) *protocol.InitProducerIDResponse {
+		res := b.handleInitProducerID(ctx, &protocol.InitProducerIDRequest{TransactionalID: &transactionalID, TransactionTimeout: time.Second})
+		req.Equal(protocol.ErrNone.Code(), res.ErrorCode)
+		return res
+	}
+	commitOffset := func(transactionalID string, producer *protocol.InitProducerIDResponse, offset int64) int16 {
+		res := b.handleTxnOffsetCommit(ctx, &protocol.TxnOffsetCommitRequest{
+			TransactionalID: transactionalID,
+			GroupID:         "group",
+			ProducerID:      producer.ProducerID,
+			ProducerEpoch:   producer.ProducerEpoch,
+			Topics: []protocol.TxnOffsetCommitTopicRequest{{
+				Topic:      "test",
+				Partitions: []protocol.TxnOffsetCommitPartitionRequest{{Partition: 0, Offset: offset}},
+			}},
+		})
+		return res.Responses[0].PartitionResponses[0].ErrorCode
+	}
+	_, stop := startOffsetsTopic(t, b)
+	defer stop()
+	groupOffsets := func() []committedOffset {
+		offsets, err := b.groupOffsets("group")
+		req.Equal(protocol.ErrNone, err)
+		return offsets
+	}
+	topics := func(partition int32) []*protocol.TopicData {
+		return []*protocol.TopicData{{Topic: "test", Data: []*protocol.Data{{Partition: partition}}}}
+	}
+
+	a := initProducer("a")
+	req.Equal(protocol.ErrNone, b.addTransactionPartitions("a", a.ProducerID, a.ProducerEpoch, topics(0)))
+	// another transaction can't write to the partition until a's ends
+	bp := initProducer("b")
+	req.Equal(protocol.ErrConcurrentTransactions, b.addTransactionPartitions("b", bp.ProducerID, bp.ProducerEpoch, topics(0)))
+	req.Equal(protocol.ErrNone, b.addTransactionPartitions("b", bp.ProducerID, bp.ProducerEpoch, topics(1)))
+	// every produce's fenced by the producer's epoch
+	req.Equal(protocol.ErrInvalidProducerEpoch, b.addTransactionPartitions("b", bp.ProducerID, bp.ProducerEpoch-1, topics(1)))
+	req.Equal(protocol.ErrInvalidProducerIdMapping, b.addTransactionPartitions("b", bp.ProducerID+1, bp.ProducerEpoch, topics(1)))
+
+	// the transaction's offsets aren't committed until it is
+	req.Equal(protocol.ErrNone.Code(), commitOffset("a", a, 5))
+	req.Equal(protocol.ErrNone.Code(), commitOffset("a", a, 10))
+	req.Empty(groupOffsets())
+	req.Equal(protocol.ErrInvalidProducerEpoch.Code(), commitOffset("a", &protocol.InitProducerIDResponse{ProducerID: a.ProducerID, ProducerEpoch: a.ProducerEpoch + 1}, 15))
+	req.Equal(protocol.ErrInvalidProducerEpoch, b.endTxn(&protocol.EndTxnRequest{TransactionalID: "a", ProducerID: a.ProducerID, ProducerEpoch: a.ProducerEpoch + 1, Committed: true}))
+
+	// the commit's offsets are committed though its markers aren't written yet
+	commit := &protocol.EndTxnRequest{TransactionalID: "a", ProducerID: a.ProducerID, ProducerEpoch: a.ProducerEpoch, Committed: true}
+	req.Equal(protocol.ErrLeaderNotAvailable, b.endTxn(commit))
+	offsets := groupOffsets()
+	req.Equal(1, len(offsets))
+	req.Equal(int64(10), offsets[0].Offset)
+	_, producer, err := f.State().GetProducer("a")
+	req.NoError(err)
+	req.True(producer.Committing)
+	// a committing transaction can't be aborted, or its producer start another
+	req.Equal(protocol.ErrInvalidTxnState, b.endTxn(&protocol.EndTxnRequest{TransactionalID: "a", ProducerID: a.ProducerID, ProducerEpoch: a.ProducerEpoch}))
+	req.Equal(protocol.ErrConcurrentTransactions.Code(), commitOffset("a", a, 20))
+
+	// initializing b again fences the last instance, but its transaction's
+	// kept until its abort markers are written
+	transactionalID := "b"
+	res := b.handleInitProducerID(ctx, &protocol.InitProducerIDRequest{TransactionalID: &transactionalID, TransactionTimeout: time.Second})
+	req.Equal(protocol.ErrConcurrentTransactions.Code(), res.ErrorCode)
+	_, producer, err = f.State().GetProducer("b")
+	req.NoError(err)
+	req.True(producer.Aborting)
+	req.Equal([]int32{1}, producer.Partitions["test"])
+	req.Equal(protocol.ErrInvalidProducerEpoch, b.addTransactionPartitions("b", bp.ProducerID, bp.ProducerEpoch, topics(1)))
+
+	// aborting drops the transaction's offsets
+	req.Equal(protocol.ErrNone.Code(), commitOffset("c", initProducer("c"), 30))
+	_, producer, err = f.State().GetProducer("c")
+	req.NoError(err)
+	req.Empty(producer.Partitions)
+	req.Equal(protocol.ErrNone, b.endTxn(&protocol.EndTxnRequest{TransactionalID: "c", ProducerID: producer.ProducerID, ProducerEpoch: producer.ProducerEpoch}))
+	_, producer, err = f.State().GetProducer("c")
+	req.NoError(err)
+	req.Empty(producer.Offsets)
+	req.Equal(int64(10), groupOffsets()[0].Offset)
+}
+
+func TestValidateTransactional(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	b := &Broker{
+		config: &config.Config{ID: 1, TransactionMaxTimeout: time.Minute},
+		fsm:    f,
+		store:  &fsmStore{fsm: f},
+		tracer: stdopentracing.NoopTracer{},
+	}
+	ctx := &Context{parent: context.Background(), client: &ClientInfo{apiVersions: make(map[int16]int16)}}
+	transactionalID := "a"
+	init := b.handleInitProducerID(ctx, &protocol.InitProducerIDRequest{TransactionalID: &transactionalID, TransactionTimeout: time.Second})
+	req.Equal(protocol.ErrNone.Code(), init.ErrorCode)
+	req.Equal(protocol.ErrNone, b.addTransactionPartitions("a", init.ProducerID, init.ProducerEpoch, []*protocol.TopicData{{Topic: "test", Data: []*protocol.Data{{Partition: 0}}}}))
+
+	message := func(attributes int8) []byte {
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Attributes: attributes, Timestamp: time.Now(), Value: []byte("value")})
+		req.NoError(err)
+		return m
+	}
+	gzipped := func(attributes int8) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(commitlog.NewMessageSet(0, message(attributes)))
+		req.NoError(err)
+		req.NoError(w.Close())
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Attributes: commitlog.CompressionGZIP, Timestamp: time.Now(), Value: buf.Bytes()})
+		req.NoError(err)
+		return m
+	}
+	produce := &protocol.ProduceRequest{APIVersion: 3, TransactionalID: &transactionalID}
+	txn := &protocol.TransactionalProduceRequest{ProducerID: init.ProducerID, ProducerEpoch: init.ProducerEpoch, Produce: produce}
+	validate := func(txn *protocol.TransactionalProduceRequest, partition int32, msgs ...[]byte) protocol.Error {
+		var recordSet []byte
+		for i, m := range msgs {
+			recordSet = append(recordSet, commitlog.NewMessageSet(uint64(i), m)...)
+		}
+		_, err := b.validateTransactional(produce, txn, "test", partition, recordSet)
+		return err
+	}
+
+	req.Equal(protocol.ErrNone, validate(nil, 0, message(0)))
+	req.Equal(protocol.ErrNone, validate(txn, 0, message(protocol.TransactionalAttribute), gzipped(protocol.TransactionalAttribute)))
+	// clients can't write markers, even compressed ones
+	recordErr, err := b.validateTransactional(produce, nil, "test", 0, append(commitlog.NewMessageSet(0, message(0)), commitlog.NewMessageSet(1, message(protocol.ControlAttribute))...))
+	req.Equal(protocol.ErrInvalidRecord, err)
+	req.Equal(int32(1), recordErr.BatchIndex)
+	req.Equal(protocol.ErrInvalidRecord, validate(txn, 0, gzipped(protocol.ControlAttribute|protocol.TransactionalAttribute)))
+	// the transactional bit's only trusted in a transactional produce, whose
+	// producer's live session has the partition
+	req.Equal(protocol.ErrInvalidRecord, validate(nil, 0, message(protocol.TransactionalAttribute)))
+	req.Equal(protocol.ErrInvalidRecord, validate(nil, 0, gzipped(protocol.TransactionalAttribute)))
+	req.Equal(protocol.ErrInvalidRecord, validate(txn, 0, message(0)))
+	req.Equal(protocol.ErrInvalidTxnState, validate(txn, 1, message(protocol.TransactionalAttribute)))
+	fenced := *txn
+	fenced.ProducerEpoch--
+	req.Equal(protocol.ErrInvalidProducerEpoch, validate(&fenced, 0, message(protocol.TransactionalAttribute)))
+}
+
+func TestValidateRecords(t *testing.T) {
+	req := require.New(t)
+	b := &Broker{config: &config.Config{ID: 1}}
+	topic := &structs.Topic{Topic: "test", Config: structs.NewTopicConfig()}
+	req.NoError(topic.Config.SetString("record.validators", "key-required"))
+
+	message := func(key []byte) []byte {
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Key: key, Value: []byte("value")})
+		req.NoError(err)
+		return m
+	}
+	gzipped := func(msgs ...[]byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		for i, m := range msgs {
+			_, err := w.Write(commitlog.NewMessageSet(uint64(i), m))
+			req.NoError(err)
+		}
+		req.NoError(w.Close())
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Attributes: commitlog.CompressionGZIP, Timestamp: time.Now(), Value: buf.Bytes()})
+		req.NoError(err)
+		return m
+	}
+
+	recordSet := append(commitlog.NewMessageSet(0, message([]byte("k"))), commitlog.NewMessageSet(1, gzipped(message([]byte("k")), message([]byte("k"))))...)
+	req.Nil(b.validateRecords(topic, recordSet))
+
+	// compressed records are validated and the error has the invalid
+	// record's index rather than its message set's
+	recordSet = append(commitlog.NewMessageSet(0, message([]byte("k"))), commitlog.NewMessageSet(1, gzipped(message([]byte("k")), message(nil)))...)
+	recordErr := b.validateRecords(topic, recordSet)
+	req.NotNil(recordErr)
+	req.Equal(int32(2), recordErr.BatchIndex)
+}
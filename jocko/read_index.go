@@ -0,0 +1,141 @@
+package jocko
+
+import (
+	"context"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// readIndexPollInterval is how often a consistent read checks whether the
+// broker's metadata has caught up to its read index.
+const readIndexPollInterval = 5 * time.Millisecond
+
+// delayRead holds the metadata or admin request until the broker's metadata is
+// as up to date as its MetadataReadConsistency requires, then handles and
+// responds to it, and returns whether it did. Requests are held off the run
+// loop so a broker catching up doesn't hold up its other requests, and the
+// connection's later responses are held until the read's is written.
+func (b *Broker) delayRead(ctx *Context, responses chan<- *Context) bool {
+	if !b.consistentReads() {
+		return false
+	}
+	switch ctx.req.(type) {
+	case *protocol.MetadataRequest, *protocol.DescribeConfigsRequest, *protocol.DescribeGroupsRequest, *protocol.ListGroupsRequest:
+	default:
+		return false
+	}
+	go func() {
+		var res protocol.ResponseBody
+		if err := b.readBarrier(ctx); err != protocol.ErrNone {
+			log.Info.Printf("broker/%d: consistent read error: %s", b.config.ID, err)
+			res = protocol.ErrorResponse(ctx.req.(protocol.Body), err)
+		} else {
+			switch req := ctx.req.(type) {
+			case *protocol.MetadataRequest:
+				res = b.handleMetadata(ctx, req)
+			case *protocol.DescribeConfigsRequest:
+				res = b.handleDescribeConfigs(ctx, req)
+			case *protocol.DescribeGroupsRequest:
+				res = b.handleDescribeGroups(ctx, req)
+			case *protocol.ListGroupsRequest:
+				res = b.handleListGroups(ctx, req)
+			}
+		}
+		b.respond(ctx, res, responses)
+	}()
+	return true
+}
+
+// consistentReads returns whether the broker's metadata reads wait for its
+// metadata to catch up. A standalone broker's metadata is always up to date.
+func (b *Broker) consistentReads() bool {
+	c := b.config.MetadataReadConsistency
+	return b.cluster != nil && c != "" && c != config.StaleReads
+}
+
+// readBarrier waits until the broker's metadata has every change the
+// controller made before it was called. The controller gets the read index
+// itself, other brokers ask it for the index, like raft's read index, then
+// wait until they've applied the metadata log up to it.
+func (b *Broker) readBarrier(ctx context.Context) protocol.Error {
+	unverified := b.config.MetadataReadConsistency == config.UnverifiedReads
+	ctx, cancel := context.WithTimeout(ctx, b.config.MetadataReadTimeout)
+	defer cancel()
+	if b.isController() {
+		// the controller's applied every change it's acknowledged
+		_, err := b.readIndex(unverified)
+		return err
+	}
+	controller := b.brokerLookup.BrokerByAddr(b.cluster.Leader())
+	if controller == nil {
+		return protocol.ErrNotController
+	}
+	res, err := b.peers.ReadIndex(ctx, controller.ID.Int32(), &protocol.ReadIndexRequest{Unverified: unverified})
+	if err != nil {
+		if ctx.Err() != nil {
+			return protocol.ErrRequestTimedOut
+		}
+		return protocol.ErrNotController.WithErr(err)
+	}
+	if res.ErrorCode != protocol.ErrNone.Code() {
+		return protocol.Errs[res.ErrorCode]
+	}
+	return b.waitForIndex(ctx, uint64(res.Index))
+}
+
+// waitForIndex waits until the broker's applied the metadata log up to the
+// index, or the context's done.
+func (b *Broker) waitForIndex(ctx context.Context, index uint64) protocol.Error {
+	if b.fsm.AppliedIndex() >= index {
+		return protocol.ErrNone
+	}
+	ticker := time.NewTicker(readIndexPollInterval)
+	defer ticker.Stop()
+	for b.fsm.AppliedIndex() < index {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return protocol.ErrRequestTimedOut
+		}
+	}
+	return protocol.ErrNone
+}
+
+// readIndex returns the index of the metadata log the controller's applied,
+// which includes every change it's acknowledged. Unless unverified is set,
+// the controller first confirms with a quorum of the brokers that it's still
+// the controller, so one that's been deposed without knowing it yet doesn't
+// hand out a stale index.
+func (b *Broker) readIndex(unverified bool) (uint64, protocol.Error) {
+	// a new controller isn't ready until it's applied its predecessor's
+	// changes
+	if !b.isController() || !b.isReadyForConsistentReads() {
+		return 0, protocol.ErrNotController
+	}
+	if !unverified {
+		if err := b.cluster.VerifyLeader(); err != nil {
+			return 0, protocol.ErrNotController.WithErr(err)
+		}
+	}
+	return b.fsm.AppliedIndex(), protocol.ErrNone
+}
+
+func (b *Broker) handleReadIndex(ctx *Context, req *protocol.ReadIndexRequest) *protocol.ReadIndexResponse {
+	sp := span(ctx, b.tracer, "read index")
+	defer sp.Finish()
+	res := &protocol.ReadIndexResponse{APIVersion: req.Version()}
+	if b.cluster == nil {
+		res.ErrorCode = protocol.ErrNotController.Code()
+		return res
+	}
+	index, err := b.readIndex(req.Unverified)
+	if err != protocol.ErrNone {
+		res.ErrorCode = err.Code()
+		return res
+	}
+	res.Index = int64(index)
+	return res
+}
@@ -0,0 +1,61 @@
+package jocko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestWaitForIndex(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	apply := func(index uint64, topic string) {
+		buf, err := structs.Encode(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+			Topic: structs.Topic{Topic: topic, Partitions: map[int32][]int32{}, Config: structs.NewTopicConfig()},
+		})
+		req.NoError(err)
+		f.Apply(&raft.Log{Index: index, Data: buf})
+	}
+	b := &Broker{config: &config.Config{}, fsm: f}
+	apply(5, "test")
+	req.Equal(uint64(5), f.AppliedIndex())
+	req.Equal(protocol.ErrNone, b.waitForIndex(context.Background(), 5))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req.Equal(protocol.ErrRequestTimedOut, b.waitForIndex(ctx, 6))
+
+	// the read waits for the topic's registration, then sees it
+	done := make(chan protocol.Error, 1)
+	go func() {
+		done <- b.waitForIndex(context.Background(), 6)
+	}()
+	apply(6, "created")
+	req.Equal(protocol.ErrNone, <-done)
+	_, topic, err := f.State().GetTopic("created")
+	req.NoError(err)
+	req.NotNil(topic)
+}
+
+func TestConsistentReads(t *testing.T) {
+	req := require.New(t)
+	b := &Broker{config: &config.Config{MetadataReadConsistency: config.LinearizableReads}}
+	// standalone brokers' metadata is always up to date
+	req.False(b.consistentReads())
+
+	b.cluster = &raftMetadataStore{}
+	req.True(b.consistentReads())
+	b.config.MetadataReadConsistency = config.StaleReads
+	req.False(b.consistentReads())
+	b.config.MetadataReadConsistency = ""
+	req.False(b.consistentReads())
+}
@@ -0,0 +1,55 @@
+package jocko
+
+import (
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func (b *Broker) handleAlterPartitionReadOnly(ctx *Context, req *protocol.AlterPartitionReadOnlyRequest) *protocol.AlterPartitionReadOnlyResponse {
+	sp := span(ctx, b.tracer, "alter partition read-only")
+	defer sp.Finish()
+	res := &protocol.AlterPartitionReadOnlyResponse{
+		Partitions: make([]*protocol.AlterPartitionReadOnlyResult, len(req.Partitions)),
+	}
+	res.APIVersion = req.Version()
+	isController := b.isController()
+	for i, p := range req.Partitions {
+		err := protocol.ErrNotController
+		if !b.authorized(ctx, policy.AlterOperation, policy.TopicResource, p.Topic) {
+			err = protocol.ErrTopicAuthorizationFailed
+		} else if isController {
+			err = b.setPartitionReadOnly(p.Topic, p.Partition, p.ReadOnly)
+		}
+		res.Partitions[i] = &protocol.AlterPartitionReadOnlyResult{
+			Topic:     p.Topic,
+			Partition: p.Partition,
+			ErrorCode: err.Code(),
+		}
+	}
+	return res
+}
+
+// setPartitionReadOnly registers the partition as read-only, or writable again,
+// across the cluster.
+func (b *Broker) setPartitionReadOnly(topic string, partition int32, readOnly bool) protocol.Error {
+	resp, err := b.raftApply(structs.SetPartitionReadOnlyRequestType, structs.SetPartitionReadOnlyRequest{
+		Topic:     topic,
+		Partition: partition,
+		ReadOnly:  readOnly,
+	})
+	if err == nil {
+		err, _ = resp.(error)
+	}
+	if err == fsm.ErrUnknownPartition {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	if err != nil {
+		log.Error.Printf("broker/%d: set %s-%d read-only %t error: %s", b.config.ID, topic, partition, readOnly, err)
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	log.Info.Printf("broker/%d: set %s-%d read-only %t", b.config.ID, topic, partition, readOnly)
+	return protocol.ErrNone
+}
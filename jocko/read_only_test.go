@@ -0,0 +1,84 @@
+package jocko
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestReadOnlyPartition(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	b := &Broker{
+		config:        &config.Config{ID: 1},
+		fsm:           f,
+		store:         &fsmStore{fsm: f},
+		tracer:        stdopentracing.NoopTracer{},
+		ctx:           context.Background(),
+		replicaLookup: NewReplicaLookup(),
+		traffic:       newTrafficStats(),
+		sampler:       newRecordSampler(0),
+		throttles:     newProduceThrottles(),
+	}
+	partition := structs.Partition{Topic: "test", ID: 0, Partition: 0, Leader: 1, AR: []int32{1}, ISR: []int32{1}}
+	req.NoError(b.registerTopic(structs.Topic{Topic: "test", Partitions: map[int32][]int32{0: partition.AR}}, []structs.Partition{partition}))
+	dir, err := ioutil.TempDir("", "read-only")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	req.NoError(err)
+	defer l.Close()
+	b.replicaLookup.AddReplica(&Replica{BrokerID: 1, Partition: partition, IsLocal: true, Log: l})
+
+	ctx := &Context{parent: context.Background(), header: &protocol.RequestHeader{}, client: &ClientInfo{apiVersions: make(map[int16]int16)}}
+	msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("value")})
+	req.NoError(err)
+	produce := func() *protocol.ProducePartitionResponse {
+		res, wait := b.handleProduce(ctx, &protocol.ProduceRequest{
+			Acks:    1,
+			Timeout: time.Second,
+			TopicData: []*protocol.TopicData{{
+				Topic: "test",
+				Data:  []*protocol.Data{{Partition: 0, RecordSet: commitlog.NewMessageSet(0, msg)}},
+			}},
+		}, nil)
+		if wait != nil {
+			wait()
+		}
+		return res.Responses[0].PartitionResponses[0]
+	}
+
+	req.Equal(protocol.ErrNone, b.setPartitionReadOnly("test", 0, true))
+	// a leader change made from an earlier read of the partition keeps it
+	// read-only
+	moved := partition
+	moved.ISR = []int32{1, 2}
+	req.NoError(b.createPartition(moved))
+	_, p, err := f.State().GetPartition("test", 0)
+	req.NoError(err)
+	req.True(p.ReadOnly)
+	req.Equal([]int32{1, 2}, p.ISR)
+
+	// produces are rejected with a retriable error and nothing's appended
+	res := produce()
+	req.Equal(protocol.ErrLeaderNotAvailable.Code(), res.ErrorCode)
+	req.Equal("partition test-0 is read-only", *res.ErrorMessage)
+	req.Equal(int64(0), l.NewestOffset())
+
+	req.Equal(protocol.ErrNone, b.setPartitionReadOnly("test", 0, false))
+	req.Equal(protocol.ErrNone.Code(), produce().ErrorCode)
+	req.Equal(int64(1), l.NewestOffset())
+
+	req.Equal(protocol.ErrUnknownTopicOrPartition, b.setPartitionReadOnly("test", 1, true))
+}
@@ -0,0 +1,193 @@
+package jocko
+
+import (
+	"time"
+
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// delayedJoins holds the joins of new groups for the initial rebalance delay,
+// so when a group's first members join in quick succession they're joined in
+// one rebalance rather than one each. The held joins are only touched by the
+// delayed joins' goroutine, so a join can't be added to a group's joins as
+// they're being completed.
+type delayedJoins struct {
+	holdCh chan *heldJoin
+	// doneCh is closed when the goroutine's stopped, after which joins
+	// aren't held.
+	doneCh chan struct{}
+}
+
+// heldJoin is a join to hold, and where to say whether it was held.
+type heldJoin struct {
+	ctx       *Context
+	req       *protocol.JoinGroupRequest
+	responses chan<- *Context
+	held      chan bool
+}
+
+type delayedJoin struct {
+	joins     []*Context
+	responses chan<- *Context
+	// due is when the joins are completed unless another joins first.
+	due      time.Time
+	deadline time.Time
+}
+
+func newDelayedJoins() *delayedJoins {
+	return &delayedJoins{
+		holdCh: make(chan *heldJoin),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// runDelayedJoins holds joins and completes the groups' held joins once
+// they're due until stop's closed. Completing them on the same goroutine means
+// a join that comes after isn't held, it's handled as a join of the group
+// they've created. The held joins are responded to with a coordinator not
+// available error once the broker's shut down, so their members find the
+// group's coordinator again rather than wait on a response.
+func (b *Broker) runDelayedJoins(stop <-chan struct{}) {
+	d := b.delayedJoins
+	defer close(d.doneCh)
+	groups := make(map[string]*delayedJoin)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		var next time.Time
+		for _, dj := range groups {
+			if next.IsZero() || dj.due.Before(next) {
+				next = dj.due
+			}
+		}
+		var dueCh <-chan time.Time
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+			dueCh = timer.C
+		}
+		select {
+		case h := <-d.holdCh:
+			h.held <- b.holdJoin(groups, h)
+		case <-dueCh:
+		case <-stop:
+			timer.Stop()
+			for _, dj := range groups {
+				for _, ctx := range dj.joins {
+					b.respond(ctx, protocol.ErrorResponse(ctx.req.(protocol.Body), protocol.ErrCoordinatorNotAvailable), dj.responses)
+				}
+			}
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		now := time.Now()
+		for id, dj := range groups {
+			if dj.due.After(now) {
+				continue
+			}
+			delete(groups, id)
+			b.completeJoins(id, dj.joins, dj.responses)
+		}
+	}
+}
+
+// delayJoin holds the join if its group's new or already waiting for the
+// initial rebalance delay, and returns whether it did. Each join waits for the
+// delay again, up to the first join's rebalance timeout, after which all the
+// group's held joins are handled and responded to together.
+func (b *Broker) delayJoin(ctx *Context, req *protocol.JoinGroupRequest, responses chan<- *Context) bool {
+	if b.config.GroupInitialRebalanceDelay <= 0 || b.validateJoinTimeouts(req) != protocol.ErrNone {
+		return false
+	}
+	h := &heldJoin{ctx: ctx, req: req, responses: responses, held: make(chan bool, 1)}
+	select {
+	case b.delayedJoins.holdCh <- h:
+		return <-h.held
+	case <-b.delayedJoins.doneCh:
+		return false
+	}
+}
+
+// holdJoin adds the join to its group's held joins, and returns whether it
+// did. It's only called by runDelayedJoins.
+func (b *Broker) holdJoin(groups map[string]*delayedJoin, h *heldJoin) bool {
+	delay := b.config.GroupInitialRebalanceDelay
+	if dj, ok := groups[h.req.GroupID]; ok {
+		dj.joins = append(dj.joins, h.ctx)
+		if wait := time.Until(dj.deadline); wait < delay {
+			delay = wait
+		}
+		dj.due = time.Now().Add(delay)
+		return true
+	}
+	_, group, err := b.fsm.State().GetGroup(h.req.GroupID)
+	if err != nil || (group != nil && len(group.Members) > 0) {
+		return false
+	}
+	timeout := time.Duration(h.req.RebalanceTimeout) * time.Millisecond
+	if h.req.Version() == 0 {
+		timeout = time.Duration(h.req.SessionTimeout) * time.Millisecond
+	}
+	if timeout < delay {
+		timeout = delay
+	}
+	now := time.Now()
+	groups[h.req.GroupID] = &delayedJoin{
+		joins:     []*Context{h.ctx},
+		responses: h.responses,
+		due:       now.Add(delay),
+		deadline:  now.Add(timeout),
+	}
+	return true
+}
+
+// completeJoins handles the group's held joins and responds to them. The
+// leader's response lists every member that joined.
+func (b *Broker) completeJoins(groupID string, joins []*Context, responses chan<- *Context) {
+	log.Debug.Printf("broker/%d: join group %s: %d members after initial rebalance delay", b.config.ID, groupID, len(joins))
+	results := make([]*protocol.JoinGroupResponse, len(joins))
+	for i, ctx := range joins {
+		results[i] = b.handleJoinGroup(ctx, ctx.req.(*protocol.JoinGroupRequest))
+	}
+	_, group, err := b.fsm.State().GetGroup(groupID)
+	if err != nil {
+		log.Error.Printf("broker/%d: get group error: %s", b.config.ID, err)
+	}
+	for i, res := range results {
+		if group != nil && res.ErrorCode == protocol.ErrNone.Code() {
+			res.LeaderID = group.LeaderID
+			res.Members = nil
+			if res.LeaderID == res.MemberID {
+				for _, m := range group.Members {
+					res.Members = append(res.Members, protocol.Member{MemberID: m.ID, MemberMetadata: m.Metadata})
+				}
+			}
+		}
+		b.respond(joins[i], res, responses)
+	}
+}
+
+// validateJoinTimeouts checks the join's session and rebalance timeouts are in
+// the broker's bounds. Bounds that are zero aren't enforced.
+func (b *Broker) validateJoinTimeouts(req *protocol.JoinGroupRequest) protocol.Error {
+	session := time.Duration(req.SessionTimeout) * time.Millisecond
+	if session < b.config.GroupMinSessionTimeout {
+		return protocol.ErrInvalidSessionTimeout
+	}
+	if max := b.config.GroupMaxSessionTimeout; max > 0 && session > max {
+		return protocol.ErrInvalidSessionTimeout
+	}
+	// v0 joins don't have a rebalance timeout, it's their session timeout
+	if req.Version() > 0 {
+		rebalance := time.Duration(req.RebalanceTimeout) * time.Millisecond
+		if max := b.config.GroupMaxRebalanceTimeout; rebalance <= 0 || (max > 0 && rebalance > max) {
+			return protocol.ErrInvalidSessionTimeout
+		}
+	}
+	return protocol.ErrNone
+}
@@ -0,0 +1,172 @@
+package jocko
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestDelayJoin(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	b := &Broker{
+		config:       &config.Config{ID: 1, GroupInitialRebalanceDelay: 200 * time.Millisecond, GroupMaxRebalanceTimeout: time.Minute},
+		fsm:          f,
+		store:        &fsmStore{fsm: f},
+		tracer:       stdopentracing.NoopTracer{},
+		delayedJoins: newDelayedJoins(),
+	}
+	stop := make(chan struct{})
+	go b.runDelayedJoins(stop)
+	defer func() {
+		close(stop)
+		<-b.delayedJoins.doneCh
+	}()
+
+	responses := make(chan *Context, 64)
+	join := func(group string, i int) bool {
+		ctx := &Context{
+			parent: stdopentracing.ContextWithSpan(context.Background(), b.tracer.StartSpan("join")),
+			client: &ClientInfo{apiVersions: make(map[int16]int16)},
+			header: &protocol.RequestHeader{CorrelationID: int32(i), ClientID: "client"},
+			req: &protocol.JoinGroupRequest{
+				APIVersion:       1,
+				GroupID:          group,
+				SessionTimeout:   10000,
+				RebalanceTimeout: 1000,
+				ProtocolType:     "consumer",
+				GroupProtocols:   []*protocol.GroupProtocol{{ProtocolName: "range"}},
+			},
+		}
+		return b.delayJoin(ctx, ctx.req.(*protocol.JoinGroupRequest), responses)
+	}
+
+	// the group's first members join in one rebalance, each answered once
+	for i := 0; i < 3; i++ {
+		req.True(join("group", i))
+		time.Sleep(5 * time.Millisecond)
+	}
+	var leaders int
+	seen := make(map[int32]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case ctx := <-responses:
+			req.False(seen[ctx.header.CorrelationID])
+			seen[ctx.header.CorrelationID] = true
+			res := ctx.res.(*protocol.Response).Body.(*protocol.JoinGroupResponse)
+			req.Equal(protocol.ErrNone.Code(), res.ErrorCode)
+			if res.LeaderID == res.MemberID {
+				leaders++
+				req.Equal(3, len(res.Members))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("join not answered")
+		}
+	}
+	req.Equal(1, leaders)
+
+	// joins racing their groups' completion are answered once, or not held
+	// if they're after it
+	held := 0
+	for i := 0; i < 20; i++ {
+		req.True(join(fmt.Sprintf("group-%d", i), i))
+		time.Sleep(time.Duration(12*i) * time.Millisecond)
+		if join(fmt.Sprintf("group-%d", i), 100+i) {
+			held++
+		}
+	}
+	seen = make(map[int32]bool)
+	for len(seen) < 20+held {
+		select {
+		case ctx := <-responses:
+			req.False(seen[ctx.header.CorrelationID], "answered twice: %d", ctx.header.CorrelationID)
+			seen[ctx.header.CorrelationID] = true
+		case <-time.After(time.Second):
+			t.Fatalf("%d joins answered", len(seen))
+		}
+	}
+	select {
+	case ctx := <-responses:
+		t.Fatalf("answered twice: %d", ctx.header.CorrelationID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDelayJoinShutdown(t *testing.T) {
+	req := require.New(t)
+	f, err := fsm.New(stdopentracing.GlobalTracer())
+	req.NoError(err)
+	b := &Broker{
+		config:       &config.Config{ID: 1, GroupInitialRebalanceDelay: time.Minute, GroupMaxRebalanceTimeout: time.Minute},
+		fsm:          f,
+		store:        &fsmStore{fsm: f},
+		tracer:       stdopentracing.NoopTracer{},
+		delayedJoins: newDelayedJoins(),
+	}
+	stop := make(chan struct{})
+	go b.runDelayedJoins(stop)
+
+	responses := make(chan *Context, 1)
+	ctx := &Context{
+		parent: stdopentracing.ContextWithSpan(context.Background(), b.tracer.StartSpan("join")),
+		header: &protocol.RequestHeader{CorrelationID: 1},
+		req: &protocol.JoinGroupRequest{
+			APIVersion:       1,
+			GroupID:          "group",
+			SessionTimeout:   10000,
+			RebalanceTimeout: 1000,
+		},
+	}
+	req.True(b.delayJoin(ctx, ctx.req.(*protocol.JoinGroupRequest), responses))
+
+	// the held join's answered when the broker shuts down
+	close(stop)
+	<-b.delayedJoins.doneCh
+	select {
+	case ctx := <-responses:
+		res := ctx.res.(*protocol.Response).Body.(*protocol.JoinGroupResponse)
+		req.Equal(protocol.ErrCoordinatorNotAvailable.Code(), res.ErrorCode)
+	default:
+		t.Fatal("held join not answered")
+	}
+}
+
+func TestValidateJoinTimeouts(t *testing.T) {
+	b := &Broker{config: &config.Config{
+		GroupMinSessionTimeout:   6 * time.Second,
+		GroupMaxSessionTimeout:   time.Minute,
+		GroupMaxRebalanceTimeout: 5 * time.Minute,
+	}}
+	tests := []struct {
+		name             string
+		version          int16
+		sessionTimeout   int32
+		rebalanceTimeout int32
+		want             protocol.Error
+	}{
+		{"in bounds", 1, 10000, 60000, protocol.ErrNone},
+		{"session too short", 1, 1000, 60000, protocol.ErrInvalidSessionTimeout},
+		{"session too long", 1, 120000, 60000, protocol.ErrInvalidSessionTimeout},
+		{"rebalance too long", 1, 10000, 600000, protocol.ErrInvalidSessionTimeout},
+		{"no rebalance timeout", 1, 10000, 0, protocol.ErrInvalidSessionTimeout},
+		{"v0 has no rebalance timeout", 0, 10000, 0, protocol.ErrNone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &protocol.JoinGroupRequest{
+				APIVersion:       test.version,
+				SessionTimeout:   test.sessionTimeout,
+				RebalanceTimeout: test.rebalanceTimeout,
+			}
+			require.Equal(t, test.want, b.validateJoinTimeouts(req))
+		})
+	}
+}
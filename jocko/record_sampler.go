@@ -0,0 +1,218 @@
+package jocko
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+// hllPrecision is how many bits of a key's hash pick its HyperLogLog register,
+// 2^10 registers for a standard error of about 3%.
+const hllPrecision = 10
+
+const (
+	// sampleMaxBytes is the biggest record set that's sampled, so a big one
+	// isn't held on to or decoded.
+	sampleMaxBytes = 1 << 20
+	// sampleQueueBytes is how many bytes of picked record sets can wait to be
+	// decoded. Record sets picked while it's full aren't sampled.
+	sampleQueueBytes = 16 << 20
+)
+
+// recordSampler decodes a sample of the produced record sets to estimate each
+// topic's record counts, record sizes, and key cardinality for capacity
+// planning, without the cost of decoding every produced record. The picked
+// record sets are decoded by run, off the produce path.
+type recordSampler struct {
+	mu      sync.Mutex
+	rate    float64
+	rand    *rand.Rand
+	topics  map[string]*topicSample
+	metrics *Metrics
+
+	queue chan recordSample
+	// queued is how many bytes of record sets are in the queue.
+	queued int64
+}
+
+type recordSample struct {
+	topic     string
+	recordSet []byte
+}
+
+type topicSample struct {
+	sets    int64
+	records int64
+	bytes   int64
+	keys    *hyperLogLog
+}
+
+// newRecordSampler returns a sampler decoding the fraction of record sets
+// given by rate, none if it's 0.
+func newRecordSampler(rate float64) *recordSampler {
+	return &recordSampler{
+		rate:   rate,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		topics: make(map[string]*topicSample),
+		queue:  make(chan recordSample, 1024),
+	}
+}
+
+// sample queues the record set produced to the topic to be decoded if it's
+// picked for the sample. It doesn't wait on the queue, the record set's
+// dropped if the queue's full.
+func (s *recordSampler) sample(topic string, recordSet []byte) {
+	if s.rate <= 0 || len(recordSet) > sampleMaxBytes {
+		return
+	}
+	s.mu.Lock()
+	picked := s.rand.Float64() < s.rate
+	s.mu.Unlock()
+	if !picked {
+		return
+	}
+	n := int64(len(recordSet))
+	if atomic.AddInt64(&s.queued, n) > sampleQueueBytes {
+		atomic.AddInt64(&s.queued, -n)
+		return
+	}
+	select {
+	case s.queue <- recordSample{topic: topic, recordSet: recordSet}:
+	default:
+		atomic.AddInt64(&s.queued, -n)
+	}
+}
+
+// run decodes the queued record sets until stop is closed.
+func (s *recordSampler) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case rs := <-s.queue:
+			atomic.AddInt64(&s.queued, -int64(len(rs.recordSet)))
+			s.add(rs.topic, rs.recordSet)
+		}
+	}
+}
+
+// add decodes the record set produced to the topic and reports the topic's
+// stats.
+func (s *recordSampler) add(topic string, recordSet []byte) {
+	var records, size int64
+	var keys [][]byte
+	var walk func(sets []commitlog.MessageSet)
+	walk = func(sets []commitlog.MessageSet) {
+		for _, ms := range sets {
+			for _, m := range ms.Messages() {
+				if m.Compressed() {
+					inner, err := m.Decompress()
+					if err != nil {
+						continue
+					}
+					walk(inner)
+					continue
+				}
+				records++
+				size += int64(len(m.Key()) + len(m.Value()))
+				if key := m.Key(); key != nil {
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+	walk(commitlog.MessageSets(recordSet))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.topics[topic]
+	if !ok {
+		ts = &topicSample{keys: newHyperLogLog()}
+		s.topics[topic] = ts
+	}
+	ts.sets++
+	ts.records += records
+	ts.bytes += size
+	for _, key := range keys {
+		ts.keys.add(key)
+	}
+	s.metrics.add(nil, "sampled_record_sets", 1, "topic", topic)
+	s.metrics.add(nil, "sampled_records", float64(records), "topic", topic)
+	if ts.records > 0 {
+		s.metrics.set("sampled_record_bytes_avg", float64(ts.bytes)/float64(ts.records), "topic", topic)
+		s.metrics.set("sampled_records_per_set_avg", float64(ts.records)/float64(ts.sets), "topic", topic)
+	}
+	s.metrics.set("key_cardinality", ts.keys.count(), "topic", topic)
+}
+
+// stats returns the topic's sampled record sets and records, its average
+// record size, and its estimated number of distinct keys.
+func (s *recordSampler) stats(topic string) (sets, records int64, avgSize, keys float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.topics[topic]
+	if !ok {
+		return 0, 0, 0, 0
+	}
+	if ts.records > 0 {
+		avgSize = float64(ts.bytes) / float64(ts.records)
+	}
+	return ts.sets, ts.records, avgSize, ts.keys.count()
+}
+
+// hyperLogLog estimates the number of distinct keys added to it in a fixed
+// 2^hllPrecision bytes.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) add(key []byte) {
+	f := fnv.New64a()
+	f.Write(key)
+	x := mix64(f.Sum64())
+	i := x >> (64 - hllPrecision)
+	// the rank of the rest of the bits' first set bit
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// count returns the estimated number of distinct keys.
+func (h *hyperLogLog) count() float64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// mix64 spreads the FNV hash's bits, which are poorly mixed for short keys.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
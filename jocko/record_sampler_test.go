@@ -0,0 +1,69 @@
+package jocko
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+)
+
+func TestRecordSampler(t *testing.T) {
+	req := require.New(t)
+	s := newRecordSampler(1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.run(stop)
+		close(done)
+	}()
+	// each record has a one byte key and the five byte value
+	s.sample("test", commitlog.NewMessageSet(0, gzipMessage(t, "a", "b", "a")))
+	s.sample("test", commitlog.NewMessageSet(3, gzipMessage(t, "c")))
+	// the record sets are decoded off the produce path
+	retry.Run(t, func(r *retry.R) {
+		if sets, _, _, _ := s.stats("test"); sets != 2 {
+			r.Fatalf("sampled sets: %d", sets)
+		}
+	})
+	close(stop)
+	<-done
+	sets, records, avgSize, keys := s.stats("test")
+	req.Equal(int64(2), sets)
+	req.Equal(int64(4), records)
+	req.Equal(float64(6), avgSize)
+	req.InDelta(3, keys, 0.1)
+
+	sets, _, _, _ = s.stats("other")
+	req.Equal(int64(0), sets)
+
+	// sampling's off by default
+	s = newRecordSampler(0)
+	s.sample("test", commitlog.NewMessageSet(0, gzipMessage(t, "a")))
+	req.Equal(0, len(s.queue))
+}
+
+func TestRecordSamplerCaps(t *testing.T) {
+	req := require.New(t)
+	s := newRecordSampler(1)
+	// record sets that are too big aren't sampled
+	s.sample("test", make([]byte, sampleMaxBytes+1))
+	req.Equal(0, len(s.queue))
+
+	// nor are those picked while the queue's full
+	for i := 0; i < sampleQueueBytes/sampleMaxBytes+1; i++ {
+		s.sample("test", make([]byte, sampleMaxBytes))
+	}
+	req.Equal(sampleQueueBytes/sampleMaxBytes, len(s.queue))
+	req.Equal(int64(sampleQueueBytes), atomic.LoadInt64(&s.queued))
+}
+
+func TestHyperLogLog(t *testing.T) {
+	h := newHyperLogLog()
+	for i := 0; i < 100000; i++ {
+		h.add([]byte("key-" + strconv.Itoa(i%50000)))
+	}
+	require.InEpsilon(t, 50000, h.count(), 0.1)
+}
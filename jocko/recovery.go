@@ -0,0 +1,129 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/log"
+)
+
+// cleanShutdownFile is written to the data dir when the broker shuts down
+// gracefully, and removed when it starts.
+const cleanShutdownFile = ".jocko_cleanshutdown"
+
+// recoverLogs checks whether the broker shut down cleanly last time it ran and
+// if it didn't, verifies the partitions' logs and truncates them at any corrupt
+// records before the broker joins the cluster. Otherwise a broker that crashed
+// could serve records that were partially written.
+func (b *Broker) recoverLogs() error {
+	if b.config.DevMode {
+		return nil
+	}
+	marker := filepath.Join(b.config.DataDir, cleanShutdownFile)
+	if _, err := os.Stat(marker); err == nil {
+		b.recovered = true
+		return os.Remove(marker)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir := filepath.Join(b.config.DataDir, "data")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		b.recovered = true
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read data dir failed")
+	}
+	log.Info.Printf("broker/%d: unclean shutdown, recovering %d partition logs", b.config.ID, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		paths := []string{path}
+		if _, err := os.Stat(filepath.Join(path, stagingDir)); err == nil {
+			paths = append(paths, filepath.Join(path, stagingDir))
+		}
+		for _, path := range paths {
+			l, err := commitlog.New(commitlog.Options{
+				Path:            path,
+				MaxSegmentBytes: 1024,
+				MaxLogBytes:     -1,
+				Recover:         true,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "recover %s failed", path)
+			}
+			if err := l.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	log.Info.Printf("broker/%d: recovered partition logs", b.config.ID)
+	b.recovered = true
+	return nil
+}
+
+// markCleanShutdown writes the clean shutdown marker if the broker's logs were
+// recovered, so a broker that failed to start still recovers next time.
+func (b *Broker) markCleanShutdown() {
+	if b.config.DevMode || !b.recovered {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(b.config.DataDir, cleanShutdownFile), nil, 0644); err != nil {
+		log.Error.Printf("broker/%d: write clean shutdown marker error: %s", b.config.ID, err)
+	}
+}
+
+// VerifyManifests checks the rolled segments of the partitions' logs in the
+// data dir against their manifests, e.g. on startup or after restoring a
+// backup, and returns the segments that don't match by partition directory.
+// Partitions without a manifest are skipped.
+func VerifyManifests(dataDir string) (map[string][]commitlog.SegmentMismatch, error) {
+	dir := filepath.Join(dataDir, "data")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read data dir failed")
+	}
+	mismatches := make(map[string][]commitlog.SegmentMismatch)
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		m, err := commitlog.VerifyManifest(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "verify %s failed", file.Name())
+		}
+		if len(m) > 0 {
+			mismatches[file.Name()] = m
+		}
+	}
+	return mismatches, nil
+}
+
+// verifyManifests logs the partitions' segments that don't match their
+// manifests. They're only logged, since replicas that are behind or corrupt
+// can be fixed by deleting them and having them fetch from their leaders.
+func (b *Broker) verifyManifests() error {
+	if b.config.DevMode || !b.config.VerifySegmentManifests {
+		return nil
+	}
+	mismatches, err := VerifyManifests(b.config.DataDir)
+	if err != nil {
+		return err
+	}
+	for partition, m := range mismatches {
+		for _, s := range m {
+			log.Error.Printf("broker/%d: %s: %s doesn't match manifest", b.config.ID, partition, s)
+		}
+	}
+	return nil
+}
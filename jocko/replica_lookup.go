@@ -39,6 +39,19 @@ func (rl *replicaLookup) Replica(topic string, partition int32) (*Replica, error
 	return r, nil
 }
 
+// Replicas returns all of the replicas.
+func (rl *replicaLookup) Replicas() []*Replica {
+	rl.lock.RLock()
+	defer rl.lock.RUnlock()
+	var replicas []*Replica
+	for _, partitions := range rl.replica {
+		for _, r := range partitions {
+			replicas = append(replicas, r)
+		}
+	}
+	return replicas
+}
+
 func (rl *replicaLookup) RemoveReplica(replica *Replica) {
 	rl.lock.Lock()
 	defer rl.lock.Unlock()
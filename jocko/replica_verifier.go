@@ -0,0 +1,299 @@
+package jocko
+
+import (
+	"hash/crc32"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// debuggingReplicaID is the replica ID fetches are sent with to read the
+// partition from the broker they're sent to whether or not it leads it, e.g.
+// to verify its replicas. The fetching principal needs to be authorized to
+// read the cluster.
+const debuggingReplicaID = -2
+
+const defaultVerifyFetchMaxBytes = 1024 * 1024
+
+// ReplicaVerifierConfig for the replica verifier.
+type ReplicaVerifierConfig struct {
+	// BrokerAddr is the address of a broker used to look up the partitions'
+	// replicas.
+	BrokerAddr string
+	// Topics are the topics whose partitions are verified, all of them if
+	// empty.
+	Topics []string
+	// FetchMaxBytes is the most bytes fetched from each replica of a
+	// partition at a time. Defaults to 1MiB.
+	FetchMaxBytes int32
+	// FromEarliest has the verifier start at the partitions' earliest offsets
+	// rather than their latest.
+	FromEarliest bool
+}
+
+// ReplicaDivergence is a message set that differs between a partition's
+// replicas.
+type ReplicaDivergence struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	// Checksums are the CRC32 of each replica's message set at the offset,
+	// by broker ID.
+	Checksums map[int32]uint32
+}
+
+// ReplicaVerifier fetches the same offsets from all of the replicas of the
+// partitions and compares their message sets' checksums, picking up where it
+// left off each time it verifies.
+type ReplicaVerifier struct {
+	config  ReplicaVerifierConfig
+	dialer  *Dialer
+	conns   map[string]*Conn
+	offsets map[verifyPartition]int64
+}
+
+type verifyPartition struct {
+	topic     string
+	partition int32
+}
+
+// NewReplicaVerifier returns a replica verifier for the config, connecting to
+// the brokers with the dialer.
+func NewReplicaVerifier(dialer *Dialer, config ReplicaVerifierConfig) *ReplicaVerifier {
+	if config.FetchMaxBytes == 0 {
+		config.FetchMaxBytes = defaultVerifyFetchMaxBytes
+	}
+	return &ReplicaVerifier{
+		config:  config,
+		dialer:  dialer,
+		conns:   make(map[string]*Conn),
+		offsets: make(map[verifyPartition]int64),
+	}
+}
+
+// Verify fetches the partitions' next message sets from each of their
+// replicas and compares them, returning how many message sets all the
+// replicas had and matched, and the ones they didn't match on. Partitions
+// that a replica failed to fetch, e.g. because it's down, are verified from
+// the same offset next time.
+func (v *ReplicaVerifier) Verify() (int, []*ReplicaDivergence, error) {
+	conn, err := v.conn(v.config.BrokerAddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	md, err := conn.Metadata(&protocol.MetadataRequest{Topics: v.config.Topics})
+	if err != nil {
+		v.drop(v.config.BrokerAddr)
+		return 0, nil, err
+	}
+	addrs := make(map[int32]string)
+	for _, b := range md.Brokers {
+		addrs[b.NodeID] = b.Addr()
+	}
+
+	// the partitions to fetch from each replica, and the replicas of each
+	fetches := make(map[int32]map[string][]*protocol.FetchPartition)
+	replicas := make(map[verifyPartition][]int32)
+	for _, tm := range md.TopicMetadata {
+		if tm.TopicErrorCode != protocol.ErrNone.Code() {
+			continue
+		}
+		for _, pm := range tm.PartitionMetadata {
+			if pm.PartitionErrorCode != protocol.ErrNone.Code() {
+				continue
+			}
+			vp := verifyPartition{tm.Topic, pm.PartitionID}
+			offset, ok := v.offsets[vp]
+			if !ok {
+				if offset, err = v.startOffset(addrs[pm.Leader], vp); err != nil {
+					continue
+				}
+				v.offsets[vp] = offset
+			}
+			replicas[vp] = pm.Replicas
+			for _, id := range pm.Replicas {
+				if fetches[id] == nil {
+					fetches[id] = make(map[string][]*protocol.FetchPartition)
+				}
+				fetches[id][tm.Topic] = append(fetches[id][tm.Topic], &protocol.FetchPartition{
+					Partition:   pm.PartitionID,
+					FetchOffset: offset,
+					MaxBytes:    v.config.FetchMaxBytes,
+				})
+			}
+		}
+	}
+
+	fetched := make(map[verifyPartition]map[int32][]byte)
+	for id, topics := range fetches {
+		req := &protocol.FetchRequest{
+			APIVersion: 3,
+			ReplicaID:  debuggingReplicaID,
+			MaxBytes:   int32(len(topics)) * v.config.FetchMaxBytes,
+		}
+		for topic, partitions := range topics {
+			req.Topics = append(req.Topics, &protocol.FetchTopic{Topic: topic, Partitions: partitions})
+		}
+		addr, ok := addrs[id]
+		if !ok {
+			continue
+		}
+		conn, err := v.conn(addr)
+		if err != nil {
+			continue
+		}
+		res, err := conn.Fetch(req)
+		if err != nil {
+			v.drop(addr)
+			continue
+		}
+		for _, tr := range res.Responses {
+			for _, pr := range tr.PartitionResponses {
+				if pr.ErrorCode != protocol.ErrNone.Code() {
+					continue
+				}
+				vp := verifyPartition{tr.Topic, pr.Partition}
+				if fetched[vp] == nil {
+					fetched[vp] = make(map[int32][]byte)
+				}
+				fetched[vp][id] = pr.RecordSet
+			}
+		}
+	}
+
+	var matched int
+	var divergences []*ReplicaDivergence
+	for vp, ids := range replicas {
+		if len(fetched[vp]) != len(ids) {
+			continue
+		}
+		n, next, divs := compareReplicas(vp.topic, vp.partition, fetched[vp])
+		matched += n
+		divergences = append(divergences, divs...)
+		if next >= 0 {
+			v.offsets[vp] = next
+		}
+	}
+	return matched, divergences, nil
+}
+
+// Close closes the verifier's connections.
+func (v *ReplicaVerifier) Close() error {
+	for addr := range v.conns {
+		v.drop(addr)
+	}
+	return nil
+}
+
+// startOffset returns the offset to start verifying the partition at from its
+// leader.
+func (v *ReplicaVerifier) startOffset(addr string, vp verifyPartition) (int64, error) {
+	conn, err := v.conn(addr)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := int64(-1)
+	if v.config.FromEarliest {
+		timestamp = -2
+	}
+	res, err := conn.Offsets(&protocol.OffsetsRequest{
+		APIVersion: 1,
+		ReplicaID:  -1,
+		Topics: []*protocol.OffsetsTopic{{
+			Topic:      vp.topic,
+			Partitions: []*protocol.OffsetsPartition{{Partition: vp.partition, Timestamp: timestamp}},
+		}},
+	})
+	if err != nil {
+		v.drop(addr)
+		return 0, err
+	}
+	for _, r := range res.Responses {
+		for _, pr := range r.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return 0, protocol.Errs[pr.ErrorCode]
+			}
+			return pr.Offset, nil
+		}
+	}
+	return 0, protocol.ErrUnknownTopicOrPartition
+}
+
+func (v *ReplicaVerifier) conn(addr string) (*Conn, error) {
+	if conn, ok := v.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := v.dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	v.conns[addr] = conn
+	return conn, nil
+}
+
+func (v *ReplicaVerifier) drop(addr string) {
+	if conn, ok := v.conns[addr]; ok {
+		conn.Close()
+		delete(v.conns, addr)
+	}
+}
+
+// compareReplicas compares the message sets the partition's replicas returned
+// for the same fetch, up to the last one they all have. It returns how many of
+// them matched, the offset to fetch from next, or -1 if there were none to
+// compare, and where they diverged. Replicas that diverge on an offset are
+// compared from the next message set on, or, if they're at different offsets,
+// from past the earliest of them next time.
+func compareReplicas(topic string, partition int32, recordSets map[int32][]byte) (int, int64, []*ReplicaDivergence) {
+	sets := make(map[int32][]commitlog.MessageSet, len(recordSets))
+	n := -1
+	for id, rs := range recordSets {
+		sets[id] = commitlog.MessageSets(rs)
+		if n < 0 || len(sets[id]) < n {
+			n = len(sets[id])
+		}
+	}
+	var matched int
+	var divergences []*ReplicaDivergence
+	next := int64(-1)
+	for i := 0; i < n; i++ {
+		checksums := make(map[int32]uint32, len(sets))
+		var offset int64 = -1
+		var checksum uint32
+		offsetsMatch, checksumsMatch := true, true
+		for id, s := range sets {
+			ms := s[i]
+			checksums[id] = crc32.ChecksumIEEE(ms)
+			if offset < 0 {
+				offset, checksum = ms.Offset(), checksums[id]
+				continue
+			}
+			if ms.Offset() != offset {
+				offsetsMatch = false
+				if ms.Offset() < offset {
+					offset = ms.Offset()
+				}
+			}
+			if checksums[id] != checksum {
+				checksumsMatch = false
+			}
+		}
+		next = offset + 1
+		if offsetsMatch && checksumsMatch {
+			matched++
+			continue
+		}
+		divergences = append(divergences, &ReplicaDivergence{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    offset,
+			Checksums: checksums,
+		})
+		if !offsetsMatch {
+			// the rest are out of step, they're fetched again from past the
+			// earliest of the offsets
+			break
+		}
+	}
+	return matched, next, divergences
+}
@@ -0,0 +1,63 @@
+package jocko
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func verifyRecordSet(t *testing.T, offset uint64, values ...string) []byte {
+	var rs []byte
+	for i, value := range values {
+		msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Unix(0, 0), Value: []byte(value)})
+		require.NoError(t, err)
+		rs = append(rs, commitlog.NewMessageSet(offset+uint64(i), msg)...)
+	}
+	return rs
+}
+
+func TestCompareReplicas(t *testing.T) {
+	req := require.New(t)
+
+	// the follower's behind, so only the first two are compared
+	matched, next, divs := compareReplicas("test", 0, map[int32][]byte{
+		1: verifyRecordSet(t, 5, "a", "b", "c"),
+		2: verifyRecordSet(t, 5, "a", "b"),
+	})
+	req.Equal(2, matched)
+	req.Equal(int64(7), next)
+	req.Empty(divs)
+
+	// nothing to compare
+	matched, next, divs = compareReplicas("test", 0, map[int32][]byte{
+		1: verifyRecordSet(t, 5, "a"),
+		2: nil,
+	})
+	req.Equal(0, matched)
+	req.Equal(int64(-1), next)
+	req.Empty(divs)
+
+	// a differing record's reported and the rest still compared
+	matched, next, divs = compareReplicas("test", 0, map[int32][]byte{
+		1: verifyRecordSet(t, 5, "a", "b", "c"),
+		2: verifyRecordSet(t, 5, "a", "x", "c"),
+	})
+	req.Equal(2, matched)
+	req.Equal(int64(8), next)
+	req.Len(divs, 1)
+	req.Equal(int64(6), divs[0].Offset)
+	req.NotEqual(divs[0].Checksums[1], divs[0].Checksums[2])
+
+	// replicas out of step stop the comparison
+	matched, next, divs = compareReplicas("test", 0, map[int32][]byte{
+		1: verifyRecordSet(t, 5, "a", "b", "c"),
+		2: append(verifyRecordSet(t, 5, "a"), verifyRecordSet(t, 7, "c", "d")...),
+	})
+	req.Equal(1, matched)
+	req.Equal(int64(7), next)
+	req.Len(divs, 1)
+	req.Equal(int64(6), divs[0].Offset)
+}
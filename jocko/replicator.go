@@ -1,9 +1,12 @@
 package jocko
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/travisjeffery/jocko/commitlog"
 	"github.com/travisjeffery/jocko/log"
 	"github.com/travisjeffery/jocko/protocol"
 )
@@ -24,14 +27,47 @@ type Replicator struct {
 	offset              int64
 	msgs                chan []byte
 	done                chan struct{}
-	leader              client
-	backoff             *backoff.ExponentialBackOff
+	closeOnce           sync.Once
+	// stopped is closed once the fetch and append goroutines have returned.
+	stopped        chan struct{}
+	leader         client
+	backoff        *backoff.ExponentialBackOff
+	lastCheckpoint time.Time
+	// checkpoints holds the latest checkpoint until it's written, so a slow
+	// write doesn't hold up appending.
+	checkpoints chan mirrorOffsets
+	// err is the error the replicator stopped with, set before it's stopped.
+	err error
 }
 
 type ReplicatorConfig struct {
 	MinBytes int32
 	// todo: make this a time.Duration
 	MaxWaitTime time.Duration
+	// MaxBytes is the max number of bytes fetched for the partition and
+	// ResponseMaxBytes the max for the whole fetch response.
+	MaxBytes         int32
+	ResponseMaxBytes int32
+	// Backoff is how long to wait before fetching again after an error. It
+	// doubles with each error in a row up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Mirror replicates from a leader in another cluster. The replicator
+	// fetches as a consumer and keeps the source's offsets.
+	Mirror bool
+	// KeepOffsets appends the leader's message sets at the offsets they have
+	// in the leader, like a mirror does, e.g. for a staging log whose release
+	// markers refer to them.
+	KeepOffsets bool
+	// Topic is the topic to fetch from the leader. Defaults to the replica's
+	// topic.
+	Topic string
+	// Checkpoint is called by a mirror with a message set's offset in the
+	// source and the offset it was appended at, at most once every
+	// CheckpointInterval. It's called in the background and only with the
+	// latest offsets if it falls behind.
+	Checkpoint         func(sourceOffset, offset int64)
+	CheckpointInterval time.Duration
 }
 
 // NewReplicator returns a new replicator instance.
@@ -39,22 +75,73 @@ func NewReplicator(config ReplicatorConfig, replica *Replica, leader client) *Re
 	if config.MinBytes == 0 {
 		config.MinBytes = 1
 	}
+	if config.Topic == "" {
+		config.Topic = replica.Partition.Topic
+	}
 	bo := backoff.NewExponentialBackOff()
+	// keep retrying as long as the replicator runs
+	bo.MaxElapsedTime = 0
+	if config.Backoff > 0 {
+		bo.InitialInterval = config.Backoff
+	}
+	if config.MaxBackoff > 0 {
+		bo.MaxInterval = config.MaxBackoff
+	}
+	bo.Reset()
 	r := &Replicator{
-		config:  config,
-		replica: replica,
-		leader:  leader,
-		done:    make(chan struct{}, 2),
-		msgs:    make(chan []byte, 2),
-		backoff: bo,
+		config:      config,
+		replica:     replica,
+		leader:      leader,
+		done:        make(chan struct{}, 2),
+		stopped:     make(chan struct{}),
+		msgs:        make(chan []byte, 2),
+		backoff:     bo,
+		checkpoints: make(chan mirrorOffsets, 1),
 	}
+	r.offset = replica.Log.NewestOffset()
 	return r
 }
 
 // Replicate start fetching messages from the leader and appending them to the local commit log.
 func (r *Replicator) Replicate() {
-	go r.fetchMessages()
-	go r.appendMessages()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.fetchMessages()
+	}()
+	go func() {
+		defer wg.Done()
+		r.appendMessages()
+	}()
+	if r.config.Checkpoint != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.writeCheckpoints()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(r.stopped)
+	}()
+}
+
+// Stopped returns a channel closed once the replicator's stopped fetching and
+// appending after being closed or failing.
+func (r *Replicator) Stopped() <-chan struct{} {
+	return r.stopped
+}
+
+// Err returns the error the replicator stopped with, if it failed to append
+// to the replica's log. It's only set once the replicator's stopped.
+func (r *Replicator) Err() error {
+	select {
+	case <-r.stopped:
+		return r.err
+	default:
+		return nil
+	}
 }
 
 func (r *Replicator) fetchMessages() {
@@ -66,20 +153,27 @@ func (r *Replicator) fetchMessages() {
 		case <-r.done:
 			return
 		default:
+			replicaID := r.replica.BrokerID
+			if r.config.Mirror {
+				replicaID = -1
+			}
+			// v3 is the first version with the response's max bytes
 			fetchRequest = &protocol.FetchRequest{
-				ReplicaID:   r.replica.BrokerID,
+				APIVersion:  3,
+				ReplicaID:   replicaID,
 				MaxWaitTime: r.config.MaxWaitTime,
 				MinBytes:    r.config.MinBytes,
+				MaxBytes:    r.config.ResponseMaxBytes,
 				Topics: []*protocol.FetchTopic{{
-					Topic: r.replica.Partition.Topic,
+					Topic: r.config.Topic,
 					Partitions: []*protocol.FetchPartition{{
 						Partition:   r.replica.Partition.ID,
 						FetchOffset: r.offset,
+						MaxBytes:    r.config.MaxBytes,
 					}},
 				}},
 			}
 			fetchResponse, err = r.leader.Fetch(fetchRequest)
-			// TODO: probably shouldn't panic. just let this replica fall out of ISR.
 			if err != nil {
 				log.Error.Printf("replicator: fetch messages error: %s", err)
 				goto BACKOFF
@@ -93,12 +187,41 @@ func (r *Replicator) fetchMessages() {
 					if p.RecordSet == nil {
 						goto BACKOFF
 					}
-					offset := int64(protocol.Encoding.Uint64(p.RecordSet[:8]))
-					if offset > r.offset {
-						r.msgs <- p.RecordSet
+					// the message sets before the fetch offset were already
+					// appended, and a trailing partial one's fetched again
+					sets := commitlog.MessageSets(p.RecordSet)
+					var skipped int
+					for len(sets) > 0 && sets[0].Offset() < r.offset {
+						skipped += len(sets[0])
+						sets = sets[1:]
+					}
+					if len(sets) == 0 {
 						r.highwaterMarkOffset = p.HighWatermark
-						r.offset = offset
+						continue
 					}
+					if r.config.Mirror || r.config.KeepOffsets {
+						for _, ms := range sets {
+							// the append overwrites the offset once it's sent
+							next := ms.Offset() + 1
+							if !r.send(ms) {
+								return
+							}
+							r.offset = next
+						}
+						r.highwaterMarkOffset = p.HighWatermark
+						continue
+					}
+					// the sets are contiguous so they're appended together
+					end := skipped
+					for _, ms := range sets {
+						end += len(ms)
+					}
+					next := sets[len(sets)-1].Offset() + 1
+					if !r.send(p.RecordSet[skipped:end]) {
+						return
+					}
+					r.highwaterMarkOffset = p.HighWatermark
+					r.offset = next
 				}
 			}
 
@@ -106,27 +229,125 @@ func (r *Replicator) fetchMessages() {
 			continue
 
 		BACKOFF:
-			time.Sleep(r.backoff.NextBackOff())
+			select {
+			case <-r.done:
+				return
+			case <-time.After(r.backoff.NextBackOff()):
+			}
 		}
 	}
 }
 
+// send hands the fetched messages to the append goroutine, and returns false
+// if the replicator's closed first.
+func (r *Replicator) send(msgs []byte) bool {
+	select {
+	case r.msgs <- msgs:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
 func (r *Replicator) appendMessages() {
 	for {
 		select {
 		case <-r.done:
 			return
 		case msg := <-r.msgs:
-			_, err := r.replica.Log.Append(msg)
+			// the append overwrites the message set's offset
+			sourceOffset := commitlog.MessageSet(msg).Offset()
+			if r.config.Mirror || r.config.KeepOffsets {
+				if err := r.alignMirror(commitlog.MessageSet(msg)); err != nil {
+					log.Error.Printf("replicator: mirror %s-%d error: %s", r.config.Topic, r.replica.Partition.ID, err)
+					continue
+				}
+			}
+			offset, err := r.replica.Log.Append(msg)
 			if err != nil {
-				panic(err)
+				// the log may not have the messages, so the replicator
+				// stops rather than fetching past them
+				log.Error.Printf("replicator: append %s-%d error: %s", r.config.Topic, r.replica.Partition.ID, err)
+				r.err = err
+				r.Close()
+				return
 			}
+			if r.config.Mirror {
+				r.checkpoint(sourceOffset, offset)
+			}
+		}
+	}
+}
+
+// alignMirror makes sure the message set is appended at the offset it has in
+// the source. An empty log is started over at the message set's offset, e.g.
+// because the source already deleted its oldest segments, and the offsets the
+// source doesn't have, e.g. because they were compacted away, are skipped so
+// they're a gap in the log too. A message set before the log's newest offset
+// was already appended.
+func (r *Replicator) alignMirror(ms commitlog.MessageSet) error {
+	next := r.replica.Log.NewestOffset()
+	if ms.Offset() == next {
+		return nil
+	}
+	if ms.Offset() < next {
+		return fmt.Errorf("source offset %d is before the log's newest offset %d", ms.Offset(), next)
+	}
+	if next == r.replica.Log.OldestOffset() {
+		if resetter, ok := r.replica.Log.(interface{ Reset(int64) error }); ok {
+			return resetter.Reset(ms.Offset())
+		}
+	}
+	skipper, ok := r.replica.Log.(interface{ Skip(int64) error })
+	if !ok {
+		return fmt.Errorf("source offset %d doesn't follow the log's newest offset %d", ms.Offset(), next)
+	}
+	return skipper.Skip(ms.Offset())
+}
+
+// mirrorOffsets is a mirrored message set's offset in the source and the
+// offset it was appended at.
+type mirrorOffsets struct {
+	source, offset int64
+}
+
+// checkpoint queues the mirrored message set's offsets to be checkpointed if
+// the checkpoint interval's passed since the last checkpoint, replacing the
+// queued checkpoint if it hasn't been written yet.
+func (r *Replicator) checkpoint(sourceOffset, offset int64) {
+	if r.config.Checkpoint == nil || time.Since(r.lastCheckpoint) < r.config.CheckpointInterval {
+		return
+	}
+	r.lastCheckpoint = time.Now()
+	cp := mirrorOffsets{source: sourceOffset, offset: offset}
+	select {
+	case r.checkpoints <- cp:
+	default:
+		// the append loop's the only sender so there's room once the
+		// stale checkpoint's taken
+		select {
+		case <-r.checkpoints:
+		default:
+		}
+		r.checkpoints <- cp
+	}
+}
+
+// writeCheckpoints calls the checkpoint func with the queued checkpoints until
+// the replicator's closed.
+func (r *Replicator) writeCheckpoints() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case cp := <-r.checkpoints:
+			r.config.Checkpoint(cp.source, cp.offset)
 		}
 	}
 }
 
 // Close the replicator object when we are no longer following
 func (r *Replicator) Close() error {
-	close(r.done)
+	r.closeOnce.Do(func() { close(r.done) })
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/travisjeffery/jocko/commitlog"
 	"github.com/travisjeffery/jocko/jocko"
 	"github.com/travisjeffery/jocko/jocko/structs"
 	"github.com/travisjeffery/jocko/mock"
@@ -52,6 +53,28 @@ func TestBroker_Replicate(t *testing.T) {
 	require.NoError(t, replicator.Close())
 }
 
+func TestBroker_ReplicateAppendError(t *testing.T) {
+	c := newCommitLog()
+	c.AppendFunc = func(b []byte) (int64, error) {
+		return 0, commitlog.ErrLogFailed
+	}
+	replica := &jocko.Replica{
+		Partition: structs.Partition{Topic: "test", ID: 0, Leader: 0, AR: []int32{0}},
+		BrokerID:  0,
+		Log:       c,
+	}
+	replicator := jocko.NewReplicator(jocko.ReplicatorConfig{MinBytes: 5}, replica, mock.NewClient(4))
+	replicator.Replicate()
+
+	// the replicator stops with the error rather than fetching past it
+	select {
+	case <-replicator.Stopped():
+	case <-time.After(time.Second):
+		t.Fatal("replicator didn't stop")
+	}
+	require.Equal(t, commitlog.ErrLogFailed, replicator.Err())
+}
+
 type commitLog struct {
 	*mock.CommitLog
 	sync.RWMutex
@@ -0,0 +1,121 @@
+package reporter
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus reports metrics as Prometheus collectors, made and registered
+// the first time each metric's reported.
+type Prometheus struct {
+	namespace  string
+	registerer prometheus.Registerer
+
+	// server serves the metrics for scraping if the reporter was made by
+	// ServePrometheus.
+	server *http.Server
+
+	mu         sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+// NewPrometheus returns a reporter that registers its collectors, named under
+// the namespace, with the registerer.
+func NewPrometheus(namespace string, registerer prometheus.Registerer) *Prometheus {
+	return &Prometheus{
+		namespace:  namespace,
+		registerer: registerer,
+		counters:   make(map[string]*prometheus.CounterVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+	}
+}
+
+// ServePrometheus returns a reporter with its own registry and serves the
+// registry's metrics for scraping on the address's /metrics until it's closed.
+func ServePrometheus(addr string) (*Prometheus, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	registry := prometheus.NewRegistry()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	p := NewPrometheus("jocko", registry)
+	p.server = &http.Server{Handler: mux}
+	go p.server.Serve(ln)
+	return p, nil
+}
+
+// Close stops serving the metrics, if the reporter's serving them.
+func (p *Prometheus) Close() error {
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Close()
+}
+
+func (p *Prometheus) Counter(name string, delta float64, labels ...string) {
+	keys, values := split(labels)
+	p.mu.Lock()
+	c, ok := p.counters[name]
+	if !ok {
+		c = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: p.namespace, Name: name, Help: name}, keys)
+		if existing, ok := p.register(c).(*prometheus.CounterVec); ok {
+			c = existing
+		}
+		p.counters[name] = c
+	}
+	p.mu.Unlock()
+	c.WithLabelValues(values...).Add(delta)
+}
+
+func (p *Prometheus) Gauge(name string, value float64, labels ...string) {
+	keys, values := split(labels)
+	p.mu.Lock()
+	g, ok := p.gauges[name]
+	if !ok {
+		g = prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: p.namespace, Name: name, Help: name}, keys)
+		if existing, ok := p.register(g).(*prometheus.GaugeVec); ok {
+			g = existing
+		}
+		p.gauges[name] = g
+	}
+	p.mu.Unlock()
+	g.WithLabelValues(values...).Set(value)
+}
+
+func (p *Prometheus) Histogram(name string, value float64, labels ...string) {
+	keys, values := split(labels)
+	p.mu.Lock()
+	h, ok := p.histograms[name]
+	if !ok {
+		h = prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: p.namespace, Name: name, Help: name}, keys)
+		if existing, ok := p.register(h).(*prometheus.HistogramVec); ok {
+			h = existing
+		}
+		p.histograms[name] = h
+	}
+	p.mu.Unlock()
+	h.WithLabelValues(values...).Observe(value)
+}
+
+// register registers the collector and returns it, or returns the collector
+// already registered with its name, e.g. if two reporters share a registerer.
+func (p *Prometheus) register(c prometheus.Collector) prometheus.Collector {
+	if p.registerer == nil {
+		return c
+	}
+	if err := p.registerer.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+	}
+	return c
+}
@@ -0,0 +1,120 @@
+// Package reporter has the interface for plugging in where the broker reports
+// its metrics, e.g. to an existing telemetry stack. Reporters are compiled in:
+// a package registers its reporter by name in an init func and the broker's
+// configured with the name to use. Prometheus and statsd reporters are built
+// in.
+package reporter
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MetricsReporter is told of the broker's metrics as they change. Labels are
+// key value pairs, e.g. "topic", "events", and a metric's always reported with
+// the same keys. Reporters are called from the broker's request handling, so
+// they shouldn't block. A reporter holding resources, e.g. a listener, can
+// implement io.Closer to have them released when the broker's server shuts
+// down.
+type MetricsReporter interface {
+	// Counter adds the delta to the counter.
+	Counter(name string, delta float64, labels ...string)
+	// Gauge sets the gauge to the value.
+	Gauge(name string, value float64, labels ...string)
+	// Histogram observes the value, e.g. a request's latency in seconds.
+	Histogram(name string, value float64, labels ...string)
+}
+
+// Factory makes a reporter that reports to the address, e.g. the address to
+// serve Prometheus' scrapes on or of the statsd server to send metrics to.
+type Factory func(addr string) (MetricsReporter, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+func init() {
+	Register("prometheus", func(addr string) (MetricsReporter, error) { return ServePrometheus(addr) })
+	Register("statsd", func(addr string) (MetricsReporter, error) { return NewStatsd(addr, "jocko") })
+}
+
+// Register makes the reporter available by the name. It panics if the factory's
+// nil or the name's taken.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if f == nil {
+		panic("reporter: register factory is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("reporter: register factory twice: " + name)
+	}
+	factories[name] = f
+}
+
+// New returns a reporter made by the factory registered with the name.
+func New(name, addr string) (MetricsReporter, error) {
+	mu.RLock()
+	f, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("reporter: unknown reporter %q (registered: %v)", name, names())
+	}
+	return f(addr)
+}
+
+func names() (names []string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Multi reports to each of the reporters.
+type Multi []MetricsReporter
+
+func (m Multi) Counter(name string, delta float64, labels ...string) {
+	for _, r := range m {
+		r.Counter(name, delta, labels...)
+	}
+}
+
+func (m Multi) Gauge(name string, value float64, labels ...string) {
+	for _, r := range m {
+		r.Gauge(name, value, labels...)
+	}
+}
+
+func (m Multi) Histogram(name string, value float64, labels ...string) {
+	for _, r := range m {
+		r.Histogram(name, value, labels...)
+	}
+}
+
+// Close closes the reporters that are io.Closers and returns the first error.
+func (m Multi) Close() error {
+	var err error
+	for _, r := range m {
+		if c, ok := r.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// split returns the labels' keys and values.
+func split(labels []string) (keys, values []string) {
+	for i := 0; i+1 < len(labels); i += 2 {
+		keys = append(keys, labels[i])
+		values = append(values, labels[i+1])
+	}
+	return keys, values
+}
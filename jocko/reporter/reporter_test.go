@@ -0,0 +1,92 @@
+package reporter
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	Register("test", func(addr string) (MetricsReporter, error) { return Multi{}, nil })
+	r, err := New("test", "")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	_, err = New("missing", "")
+	require.Error(t, err)
+	require.Panics(t, func() { Register("test", func(addr string) (MetricsReporter, error) { return nil, nil }) })
+}
+
+func TestStatsd(t *testing.T) {
+	require.Equal(t, "jocko.bytes_in.topic.a_b:10|c", statsdLine("jocko", "bytes_in", 10, "c", []string{"topic", "a.b"}))
+	require.Equal(t, "request_seconds:0.25|h", statsdLine("", "request_seconds", 0.25, "h", nil))
+
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	s, err := NewStatsd(ln.LocalAddr().String(), "jocko")
+	require.NoError(t, err)
+	defer s.Close()
+	s.Gauge("connections", 3)
+	buf := make([]byte, 512)
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := ln.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "jocko.connections:3|g", string(buf[:n]))
+}
+
+func TestPrometheus(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := NewPrometheus("jocko", registry)
+	p.Counter("bytes_in", 10, "topic", "a")
+	p.Counter("bytes_in", 5, "topic", "a")
+	p.Gauge("connections", 2)
+	p.Histogram("request_seconds", 0.1, "api_key", "0")
+	// a second reporter on the registry shares its collectors
+	NewPrometheus("jocko", registry).Counter("bytes_in", 1, "topic", "a")
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		switch {
+		case m.Counter != nil:
+			values[f.GetName()] = m.Counter.GetValue()
+		case m.Gauge != nil:
+			values[f.GetName()] = m.Gauge.GetValue()
+		case m.Histogram != nil:
+			values[f.GetName()] = float64(m.Histogram.GetSampleCount())
+		}
+	}
+	require.Equal(t, map[string]float64{
+		"jocko_bytes_in":        16,
+		"jocko_connections":     2,
+		"jocko_request_seconds": 1,
+	}, values)
+}
+
+func TestServePrometheusClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	p, err := ServePrometheus(addr)
+	require.NoError(t, err)
+	res, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var r MetricsReporter = Multi{p}
+	require.NoError(t, r.(io.Closer).Close())
+	// the address is free again once the reporter's closed
+	ln, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	ln.Close()
+}
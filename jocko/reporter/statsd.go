@@ -0,0 +1,62 @@
+package reporter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Statsd reports metrics to a statsd server over UDP, a packet per metric.
+// Labels are folded into the metric's name since statsd doesn't have them,
+// e.g. bytes_in with topic events is sent as jocko.bytes_in.topic.events.
+// Send errors are dropped, like statsd clients do.
+type Statsd struct {
+	prefix string
+	conn   net.Conn
+}
+
+// NewStatsd returns a reporter that sends metrics, named under the prefix, to
+// the statsd server at the address.
+func NewStatsd(addr, prefix string) (*Statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Statsd{prefix: prefix, conn: conn}, nil
+}
+
+func (s *Statsd) Counter(name string, delta float64, labels ...string) {
+	s.send(name, delta, "c", labels)
+}
+
+func (s *Statsd) Gauge(name string, value float64, labels ...string) {
+	s.send(name, value, "g", labels)
+}
+
+func (s *Statsd) Histogram(name string, value float64, labels ...string) {
+	s.send(name, value, "h", labels)
+}
+
+// Close closes the reporter's connection.
+func (s *Statsd) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Statsd) send(name string, value float64, typ string, labels []string) {
+	s.conn.Write([]byte(statsdLine(s.prefix, name, value, typ, labels)))
+}
+
+func statsdLine(prefix, name string, value float64, typ string, labels []string) string {
+	parts := []string{name}
+	if prefix != "" {
+		parts = []string{prefix, name}
+	}
+	for _, l := range labels {
+		parts = append(parts, statsdSanitizer.Replace(l))
+	}
+	return fmt.Sprintf("%s:%s|%s", strings.Join(parts, "."), strconv.FormatFloat(value, 'f', -1, 64), typ)
+}
+
+// statsdSanitizer replaces the characters statsd uses to delimit metrics.
+var statsdSanitizer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "\n", "_")
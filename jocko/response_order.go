@@ -0,0 +1,58 @@
+package jocko
+
+// responseOrder holds a connection's responses until the responses to the
+// requests read before them are written. Clients match responses to their
+// requests in the order they sent them, and treat one out of order as fatal,
+// but requests handled off the broker's run loop, e.g. consistent reads and
+// delayed joins, can finish after requests read after them.
+type responseOrder struct {
+	// read is the sequence number of the next request read, it's only used
+	// by the connection's reader.
+	read uint64
+	// next is the sequence number of the next response to write, and
+	// pending the responses waiting for it. They're only used by the
+	// server's response writer.
+	next    uint64
+	pending map[uint64]*Context
+}
+
+// responseSlot is a request's place in its connection's responses.
+type responseSlot struct {
+	order *responseOrder
+	seq   uint64
+}
+
+func newResponseOrder() *responseOrder {
+	return &responseOrder{pending: make(map[uint64]*Context)}
+}
+
+// slot returns the place of the next request read in the connection's
+// responses.
+func (o *responseOrder) slot() *responseSlot {
+	s := &responseSlot{order: o, seq: o.read}
+	o.read++
+	return s
+}
+
+// write writes the response if the responses before it have been written, and
+// then the pending responses that were waiting for it, otherwise it holds the
+// response until they are. It returns the first error writing them.
+func (s *responseSlot) write(respCtx *Context, write func(*Context) error) error {
+	o := s.order
+	if s.seq != o.next {
+		o.pending[s.seq] = respCtx
+		return nil
+	}
+	err := write(respCtx)
+	for o.next++; ; o.next++ {
+		respCtx, ok := o.pending[o.next]
+		if !ok {
+			break
+		}
+		delete(o.pending, o.next)
+		if werr := write(respCtx); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
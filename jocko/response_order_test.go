@@ -0,0 +1,72 @@
+package jocko
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestResponseOrder(t *testing.T) {
+	req := require.New(t)
+	order := newResponseOrder()
+	var slots []*responseSlot
+	for i := 0; i < 4; i++ {
+		slots = append(slots, order.slot())
+	}
+	var written []int32
+	write := func(respCtx *Context) error {
+		written = append(written, respCtx.res.(*protocol.Response).CorrelationID)
+		return nil
+	}
+	response := func(id int32) *Context {
+		return &Context{res: &protocol.Response{CorrelationID: id}}
+	}
+
+	// later responses wait for the earlier ones
+	req.NoError(slots[2].write(response(2), write))
+	req.NoError(slots[1].write(response(1), write))
+	req.Empty(written)
+	req.NoError(slots[0].write(response(0), write))
+	req.Equal([]int32{0, 1, 2}, written)
+	req.NoError(slots[3].write(response(3), write))
+	req.Equal([]int32{0, 1, 2, 3}, written)
+}
+
+func TestServerWriteResponse_NoAcks(t *testing.T) {
+	req := require.New(t)
+	s := &Server{config: &config.Config{}, tracer: opentracing.NoopTracer{}}
+	var buf bytes.Buffer
+	write := func(acks int16) {
+		span := opentracing.NoopTracer{}.StartSpan("request")
+		req.NoError(s.writeResponse(&Context{
+			parent: opentracing.ContextWithSpan(context.Background(), span),
+			conn:   &bufConn{Writer: &buf},
+			header: &protocol.RequestHeader{CorrelationID: 1},
+			req:    &protocol.ProduceRequest{Acks: acks},
+			res:    &protocol.Response{CorrelationID: 1, Body: &protocol.ProduceResponse{}},
+		}))
+	}
+
+	// produce requests with acks 0 aren't answered
+	write(0)
+	req.Equal(0, buf.Len())
+	write(1)
+	req.NotEqual(0, buf.Len())
+}
+
+// bufConn is a connection responses are written to the writer of.
+type bufConn struct {
+	net.Conn
+	io.Writer
+}
+
+func (c *bufConn) Write(b []byte) (int, error) {
+	return c.Writer.Write(b)
+}
@@ -0,0 +1,179 @@
+package jocko
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// Nack policies set with a topic's nack.policy config. With the retry policy
+// nacked records go to the retry topic until they've failed
+// retry.max.attempts times and then to the dead-letter topic. With the dlq
+// policy they go straight to the dead-letter topic.
+const (
+	nackPolicyNone       = "none"
+	nackPolicyRetry      = "retry"
+	nackPolicyDeadLetter = "dlq"
+
+	retryTopicSuffix      = ".retry"
+	deadLetterTopicSuffix = ".dlq"
+
+	nackProduceTimeout = 10 * time.Second
+)
+
+// nackTopics returns the requests to create the retry and dead-letter topics
+// for a topic with the given config. The retry topic holds records back for the
+// topic's retry.backoff.ms using its delivery delay.
+func nackTopics(req *protocol.CreateTopicRequest, config structs.TopicConfig) []*protocol.CreateTopicRequest {
+	policy := config.GetString("nack.policy")
+	if policy == nackPolicyNone || policy == "" {
+		return nil
+	}
+	var reqs []*protocol.CreateTopicRequest
+	if policy == nackPolicyRetry {
+		backoff := strconv.FormatInt(config.GetInt64("retry.backoff.ms"), 10)
+		reqs = append(reqs, &protocol.CreateTopicRequest{
+			Topic:             req.Topic + retryTopicSuffix,
+			NumPartitions:     req.NumPartitions,
+			ReplicationFactor: req.ReplicationFactor,
+			Configs:           map[string]*string{"delivery.delay.ms": &backoff},
+		})
+	}
+	return append(reqs, &protocol.CreateTopicRequest{
+		Topic:             req.Topic + deadLetterTopicSuffix,
+		NumPartitions:     req.NumPartitions,
+		ReplicationFactor: req.ReplicationFactor,
+	})
+}
+
+// routeNack returns the topic a nacked message set goes to and the record set
+// to produce to it. Records nacked from a retry topic are already wrapped in a
+// retry record so only their attempts and reason are updated.
+func (b *Broker) routeNack(topic string, partition int32, ms commitlog.MessageSet, reason *string) (string, []byte, protocol.Error) {
+	if strings.HasSuffix(topic, deadLetterTopicSuffix) {
+		return "", nil, protocol.ErrPolicyViolation.WithErr(fmt.Errorf("can't nack dead letters"))
+	}
+	base := strings.TrimSuffix(topic, retryTopicSuffix)
+	_, t, err := b.fsm.State().GetTopic(base)
+	if err != nil {
+		return "", nil, protocol.ErrUnknown.WithErr(err)
+	}
+	if t == nil {
+		return "", nil, protocol.ErrUnknownTopicOrPartition
+	}
+	policy := t.Config.GetString("nack.policy")
+	if policy != nackPolicyRetry && policy != nackPolicyDeadLetter {
+		return "", nil, protocol.ErrPolicyViolation.WithErr(fmt.Errorf("topic %s doesn't accept nacks", base))
+	}
+	maxAttempts := int32(t.Config.GetInt64("retry.max.attempts"))
+
+	var target string
+	var msgs []commitlog.Message
+	now := time.Now()
+	for _, m := range ms.Messages() {
+		rec := &protocol.RetryRecord{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    ms.Offset(),
+			Key:       m.Key(),
+			Value:     m.Value(),
+		}
+		if m.MagicByte() > 0 {
+			rec.Timestamp = time.Unix(0, m.Timestamp()*int64(time.Millisecond))
+		}
+		if base != topic {
+			if err := rec.Decode(protocol.NewDecoder(m.Value())); err != nil {
+				return "", nil, protocol.ErrCorruptMessage.WithErr(err)
+			}
+		}
+		rec.Attempts++
+		rec.Reason = reason
+		if target == "" {
+			target = base + deadLetterTopicSuffix
+			if policy == nackPolicyRetry && rec.Attempts <= maxAttempts {
+				target = base + retryTopicSuffix
+			}
+		}
+		value, err := protocol.Encode(rec)
+		if err != nil {
+			return "", nil, protocol.ErrUnknown.WithErr(err)
+		}
+		msg, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: now,
+			Key:       rec.Key,
+			Value:     value,
+		})
+		if err != nil {
+			return "", nil, protocol.ErrUnknown.WithErr(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return target, commitlog.NewMessageSet(0, msgs...), protocol.ErrNone
+}
+
+// produceTo appends the record set to the partition of the topic, or to the
+// partition with the same ID modulo the topic's partition count if it has
+// fewer. It forwards the records to the partition's leader if that's another
+// broker.
+func (b *Broker) produceTo(topic string, partition int32, recordSet []byte) protocol.Error {
+	state := b.fsm.State()
+	_, t, err := state.GetTopic(topic)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if t == nil || len(t.Partitions) == 0 {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	partition = partition % int32(len(t.Partitions))
+	_, p, err := state.GetPartition(topic, partition)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if p == nil {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	if p.Leader == b.config.ID {
+		replica, err := b.replicaLookup.Replica(topic, partition)
+		if err != nil || replica == nil || replica.Log == nil {
+			return protocol.ErrReplicaNotAvailable
+		}
+		_, staged, perr := b.appendRecords(b.ctx, replica, recordSet)
+		if staged != nil {
+			_, perr = b.waitStaged(b.ctx, replica, staged)
+		}
+		return perr
+	}
+	res, err := b.peers.Produce(b.ctx, p.Leader, &protocol.ProduceRequest{
+		Acks:    1,
+		Timeout: nackProduceTimeout,
+		TopicData: []*protocol.TopicData{{
+			Topic: topic,
+			Data:  []*protocol.Data{{Partition: partition, RecordSet: recordSet}},
+		}},
+	}, b.fenceLeader(topic, partition, p.Leader))
+	if err == errUnknownBroker {
+		return protocol.ErrLeaderNotAvailable
+	}
+	if perr, ok := err.(protocol.Error); ok {
+		return perr
+	}
+	if err != nil {
+		log.Error.Printf("broker/%d: produce to %s-%d on broker %d error: %s", b.config.ID, topic, partition, p.Leader, err)
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	for _, tr := range res.Responses {
+		for _, pr := range tr.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return protocol.Errs[pr.ErrorCode]
+			}
+		}
+	}
+	return protocol.ErrNone
+}
@@ -0,0 +1,167 @@
+package jocko
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runner runs the broker's background goroutines, e.g. the replica fetchers,
+// grouped by the subsystem they belong to so shutdown can stop the subsystems
+// in order, each before those it depends on, waiting a bounded time for each
+// and reporting the subsystems holding it up.
+type runner struct {
+	mu         sync.Mutex
+	subsystems map[string]*subsystem
+	// names are the subsystems' names in the order they were added.
+	names   []string
+	stopped bool
+}
+
+type subsystem struct {
+	name string
+	// deps are the subsystems it depends on, stopped after it.
+	deps   []string
+	stopCh chan struct{}
+	// running counts the subsystem's running goroutines by name.
+	running map[string]int
+	wg      sync.WaitGroup
+}
+
+// blockedSubsystem is a subsystem whose goroutines didn't all return in time
+// on shutdown, and the names of those still running.
+type blockedSubsystem struct {
+	name    string
+	running []string
+}
+
+func (s *blockedSubsystem) String() string {
+	return fmt.Sprintf("%s %v", s.name, s.running)
+}
+
+func newRunner() *runner {
+	return &runner{subsystems: make(map[string]*subsystem)}
+}
+
+// add adds the subsystem, which depends on deps and so is stopped before them.
+func (r *runner) add(name string, deps ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subsystems[name] = &subsystem{
+		name:    name,
+		deps:    deps,
+		stopCh:  make(chan struct{}),
+		running: make(map[string]int),
+	}
+	r.names = append(r.names, name)
+}
+
+// run runs fn on a goroutine as one of the subsystem's, named name for
+// reports of what's blocking shutdown. fn has to return soon after stop is
+// closed. It returns false without running fn if the runner's stopped.
+func (r *runner) run(subsystemName, name string, fn func(stop <-chan struct{})) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.subsystems[subsystemName]
+	if !ok {
+		panic(fmt.Sprintf("runner: unknown subsystem %s", subsystemName))
+	}
+	if r.stopped {
+		return false
+	}
+	s.running[name]++
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			if s.running[name]--; s.running[name] == 0 {
+				delete(s.running, name)
+			}
+			r.mu.Unlock()
+			s.wg.Done()
+		}()
+		fn(s.stopCh)
+	}()
+	return true
+}
+
+// stop stops the subsystems, dependents first, waiting up to timeout for each
+// one's goroutines to return before moving on to the next. It returns the
+// subsystems it gave up waiting for. 0 to wait as long as it takes.
+func (r *runner) stop(timeout time.Duration) []*blockedSubsystem {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return nil
+	}
+	r.stopped = true
+	order := r.order()
+	r.mu.Unlock()
+
+	var blocked []*blockedSubsystem
+	for _, s := range order {
+		close(s.stopCh)
+		if s.wait(timeout) {
+			continue
+		}
+		r.mu.Lock()
+		b := &blockedSubsystem{name: s.name}
+		for name := range s.running {
+			b.running = append(b.running, name)
+		}
+		r.mu.Unlock()
+		sort.Strings(b.running)
+		blocked = append(blocked, b)
+	}
+	return blocked
+}
+
+// order returns the subsystems in the order they're stopped: each after the
+// subsystems depending on it, latest added first otherwise.
+func (r *runner) order() []*subsystem {
+	var order []*subsystem
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		for i := len(r.names) - 1; i >= 0; i-- {
+			dependent := r.subsystems[r.names[i]]
+			for _, dep := range dependent.deps {
+				if dep == name {
+					visit(dependent.name)
+				}
+			}
+		}
+		order = append(order, r.subsystems[name])
+	}
+	for i := len(r.names) - 1; i >= 0; i-- {
+		visit(r.names[i])
+	}
+	return order
+}
+
+// wait waits up to timeout for the subsystem's goroutines to return, and
+// returns whether they did.
+func (s *subsystem) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	if timeout <= 0 {
+		<-done
+		return true
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
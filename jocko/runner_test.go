@@ -0,0 +1,66 @@
+package jocko
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunner_StopsDependentsFirst(t *testing.T) {
+	req := require.New(t)
+	r := newRunner()
+	r.add("appends")
+	r.add("fetchers", "appends")
+	r.add("leadership")
+	r.add("serf", "leadership", "fetchers")
+
+	var mu sync.Mutex
+	var stopped []string
+	for _, name := range []string{"appends", "fetchers", "leadership", "serf"} {
+		name := name
+		req.True(r.run(name, name, func(stop <-chan struct{}) {
+			<-stop
+			mu.Lock()
+			stopped = append(stopped, name)
+			mu.Unlock()
+		}))
+	}
+	req.Empty(r.stop(time.Second))
+	req.Equal([]string{"serf", "leadership", "fetchers", "appends"}, stopped)
+
+	// nothing runs once it's stopped
+	req.False(r.run("appends", "late", func(stop <-chan struct{}) {
+		t.Fatal("ran after stop")
+	}))
+	req.Empty(r.stop(time.Second))
+}
+
+func TestRunner_ReportsBlockedSubsystems(t *testing.T) {
+	req := require.New(t)
+	r := newRunner()
+	r.add("cleaners")
+	r.add("fetchers", "cleaners")
+
+	release := make(chan struct{})
+	defer close(release)
+	r.run("fetchers", "test-0", func(stop <-chan struct{}) {
+		<-release
+	})
+	r.run("fetchers", "test-1", func(stop <-chan struct{}) {
+		<-stop
+	})
+	cleaned := make(chan struct{})
+	r.run("cleaners", "cleaner", func(stop <-chan struct{}) {
+		<-stop
+		close(cleaned)
+	})
+
+	start := time.Now()
+	blocked := r.stop(200 * time.Millisecond)
+	req.True(time.Since(start) < time.Second)
+	req.Equal([]*blockedSubsystem{{name: "fetchers", running: []string{"test-0"}}}, blocked)
+	// the cleaners were still stopped after giving up on the fetchers
+	<-cleaned
+}
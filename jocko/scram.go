@@ -0,0 +1,308 @@
+package jocko
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/jocko/structs"
+)
+
+const (
+	scramSHA256 = "SCRAM-SHA-256"
+	scramSHA512 = "SCRAM-SHA-512"
+	// scramIterations is how many times delegation tokens' SCRAM passwords
+	// are hashed.
+	scramIterations = 4096
+	// scramGS2Header is the GS2 header of clients that don't support channel
+	// binding and don't authorize as someone else.
+	scramGS2Header = "n,,"
+)
+
+// scramMechanism is a SCRAM (RFC 5802) mechanism and its hash.
+type scramMechanism struct {
+	name string
+	hash func() hash.Hash
+}
+
+var scramMechanisms = []scramMechanism{
+	{scramSHA256, sha256.New},
+	{scramSHA512, sha512.New},
+}
+
+func scramMechanismByName(name string) (scramMechanism, bool) {
+	for _, m := range scramMechanisms {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return scramMechanism{}, false
+}
+
+func (m scramMechanism) hmac(key []byte, msg string) []byte {
+	mac := hmac.New(m.hash, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func (m scramMechanism) h(b []byte) []byte {
+	h := m.hash()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// saltedPassword is Hi(password, salt, iterations), i.e. PBKDF2 with the
+// mechanism's HMAC and one block.
+func (m scramMechanism) saltedPassword(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(m.hash, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// scramCredentialsLookup returns the token with the ID a client's
+// authenticating with and the password it authenticates with.
+type scramCredentialsLookup func(tokenID string) (*structs.DelegationToken, string, error)
+
+// scramServer is the broker's side of a SCRAM exchange with a client
+// authenticating with a delegation token, i.e. with the tokenauth extension,
+// the token's ID as its username, and the token's HMAC as its password.
+type scramServer struct {
+	mechanism scramMechanism
+	lookup    scramCredentialsLookup
+
+	token           *structs.DelegationToken
+	storedKey       []byte
+	serverKey       []byte
+	gs2Header       string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+}
+
+func newScramServer(mechanism scramMechanism, lookup scramCredentialsLookup) *scramServer {
+	return &scramServer{mechanism: mechanism, lookup: lookup}
+}
+
+// step handles the client's next message and returns the reply, and the token
+// the client authenticated with once the exchange is done.
+func (s *scramServer) step(msg []byte) ([]byte, *structs.DelegationToken, error) {
+	if s.serverFirst == "" {
+		reply, err := s.first(string(msg))
+		return reply, nil, err
+	}
+	reply, err := s.final(string(msg))
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, s.token, nil
+}
+
+func (s *scramServer) first(msg string) ([]byte, error) {
+	// gs2-header is gs2-cbind-flag "," [authzid] ","
+	i := strings.IndexByte(msg, ',')
+	if i == -1 {
+		return nil, errors.New("invalid scram client first message")
+	}
+	j := strings.IndexByte(msg[i+1:], ',')
+	if j == -1 {
+		return nil, errors.New("invalid scram client first message")
+	}
+	if msg[0] != 'n' && msg[0] != 'y' {
+		return nil, errors.New("scram channel binding isn't supported")
+	}
+	s.gs2Header = msg[:i+j+2]
+	s.clientFirstBare = msg[i+j+2:]
+	attrs, err := scramAttributes(s.clientFirstBare)
+	if err != nil {
+		return nil, err
+	}
+	if attrs["tokenauth"] != "true" {
+		return nil, errors.New("only delegation tokens can authenticate with scram")
+	}
+	clientNonce := attrs["r"]
+	if clientNonce == "" {
+		return nil, errors.New("scram client nonce missing")
+	}
+	token, password, err := s.lookup(scramUnescape(attrs["n"]))
+	if err != nil {
+		return nil, err
+	}
+	salted := s.mechanism.saltedPassword(password, token.Salt, scramIterations)
+	s.token = token
+	s.storedKey = s.mechanism.h(s.mechanism.hmac(salted, "Client Key"))
+	s.serverKey = s.mechanism.hmac(salted, "Server Key")
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + serverNonce
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(token.Salt) + ",i=" + strconv.Itoa(scramIterations)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *scramServer) final(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i == -1 {
+		return nil, errors.New("scram client proof missing")
+	}
+	withoutProof := msg[:i]
+	attrs, err := scramAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, errors.New("scram channel binding mismatch")
+	}
+	if attrs["r"] != s.nonce {
+		return nil, errors.New("scram nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil {
+		return nil, errors.Wrap(err, "decode scram client proof failed")
+	}
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	signature := s.mechanism.hmac(s.storedKey, authMessage)
+	if len(proof) != len(signature) {
+		return nil, errors.New("invalid scram client proof")
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	if subtle.ConstantTimeCompare(s.mechanism.h(clientKey), s.storedKey) != 1 {
+		return nil, errors.New("invalid scram client proof")
+	}
+	return []byte("v=" + base64.StdEncoding.EncodeToString(s.mechanism.hmac(s.serverKey, authMessage))), nil
+}
+
+// scramClient is a client's side of a SCRAM exchange authenticating with a
+// delegation token.
+type scramClient struct {
+	mechanism scramMechanism
+	user      string
+	password  string
+
+	nonce           string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newScramClient(mechanism scramMechanism, user, password string) (*scramClient, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &scramClient{mechanism: mechanism, user: user, password: password, nonce: nonce}, nil
+}
+
+func (c *scramClient) first() []byte {
+	c.clientFirstBare = "n=" + scramEscape(c.user) + ",r=" + c.nonce + ",tokenauth=true"
+	return []byte(scramGS2Header + c.clientFirstBare)
+}
+
+func (c *scramClient) final(serverFirst []byte) ([]byte, error) {
+	attrs, err := scramAttributes(string(serverFirst))
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := attrs["e"]; ok {
+		return nil, errors.Errorf("scram authentication failed: %s", e)
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, errors.New("invalid scram server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, errors.Wrap(err, "decode scram salt failed")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("invalid scram iteration count")
+	}
+	c.saltedPassword = c.mechanism.saltedPassword(c.password, salt, iterations)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	c.authMessage = c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	clientKey := c.mechanism.hmac(c.saltedPassword, "Client Key")
+	signature := c.mechanism.hmac(c.mechanism.h(clientKey), c.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server's signature, so the client knows the server has the
+// token too.
+func (c *scramClient) verify(serverFinal []byte) error {
+	attrs, err := scramAttributes(string(serverFinal))
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs["e"]; ok {
+		return errors.Errorf("scram authentication failed: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return errors.Wrap(err, "decode scram server signature failed")
+	}
+	expected := c.mechanism.hmac(c.mechanism.hmac(c.saltedPassword, "Server Key"), c.authMessage)
+	if !hmac.Equal(signature, expected) {
+		return errors.New("invalid scram server signature")
+	}
+	return nil
+}
+
+// scramAttributes parses the comma separated key=value attributes of a SCRAM
+// message.
+func scramAttributes(msg string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		i := strings.IndexByte(attr, '=')
+		if i < 1 {
+			return nil, errors.Errorf("invalid scram attribute %q", attr)
+		}
+		attrs[attr[:i]] = attr[i+1:]
+	}
+	return attrs, nil
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+var (
+	scramEscaper   = strings.NewReplacer("=", "=3D", ",", "=2C")
+	scramUnescaper = strings.NewReplacer("=3D", "=", "=2C", ",")
+)
+
+func scramEscape(s string) string {
+	return scramEscaper.Replace(s)
+}
+
+func scramUnescape(s string) string {
+	return scramUnescaper.Replace(s)
+}
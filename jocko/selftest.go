@@ -0,0 +1,245 @@
+package jocko
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// selfTestChunk is the size of the writes and reads the data dir checks make.
+const selfTestChunk = 1 << 20
+
+// SelfTestConfig is what a broker's self-test checks and its limits to pass.
+type SelfTestConfig struct {
+	// DataDirs are the dirs the broker stores its logs under. Each has a file
+	// written, synced, and read back, and is created if it doesn't exist.
+	DataDirs []string
+	// WriteBytes is how many bytes are written to each data dir.
+	WriteBytes int64
+	// Syncs is how many small appends are each synced to measure fsync
+	// latency, and MaxSyncLatency is the slowest of them that passes.
+	Syncs          int
+	MaxSyncLatency time.Duration
+	// MinOpenFiles is the lowest open file limit that passes, since brokers
+	// keep a file per segment and index and a socket per connection open.
+	MinOpenFiles uint64
+	// BrokerAddr is the address of a broker in the cluster to find its brokers
+	// with. Connectivity to them and clock skew aren't checked if it's empty.
+	BrokerAddr string
+	// MaxClockSkew is the most a broker's clock can be off from this machine's
+	// to pass.
+	MaxClockSkew time.Duration
+}
+
+// SelfTestResult is the outcome of one of a self-test's checks.
+type SelfTestResult struct {
+	Check  string
+	Passed bool
+	Detail string
+}
+
+func (r *SelfTestResult) String() string {
+	status := "PASS"
+	if !r.Passed {
+		status = "FAIL"
+	}
+	return fmt.Sprintf("%s  %s: %s", status, r.Check, r.Detail)
+}
+
+// SelfTest checks the machine's fit to run a broker before it joins the
+// cluster: the data dirs' write, fsync, and read throughput and latency, the
+// open file limit, connectivity to the cluster's brokers, and their clocks'
+// skew from this machine's.
+func SelfTest(dialer *Dialer, config SelfTestConfig) []*SelfTestResult {
+	var results []*SelfTestResult
+	for _, dir := range config.DataDirs {
+		results = append(results, selfTestDataDir(dir, config))
+	}
+	results = append(results, selfTestOpenFiles(config.MinOpenFiles))
+	if config.BrokerAddr != "" {
+		results = append(results, selfTestCluster(dialer, config)...)
+	}
+	return results
+}
+
+// SelfTestPassed returns whether all of the self-test's checks passed.
+func SelfTestPassed(results []*SelfTestResult) bool {
+	for _, r := range results {
+		if !r.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func selfTestDataDir(dir string, config SelfTestConfig) *SelfTestResult {
+	r := &SelfTestResult{Check: "data dir " + dir}
+	fail := func(what string, err error) *SelfTestResult {
+		r.Detail = fmt.Sprintf("%s failed: %s", what, err)
+		return r
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fail("create", err)
+	}
+	f, err := ioutil.TempFile(dir, "jocko-self-test-")
+	if err != nil {
+		return fail("create file", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chunk := make([]byte, selfTestChunk)
+	start := time.Now()
+	var written int64
+	for written < config.WriteBytes {
+		n := int64(len(chunk))
+		if config.WriteBytes-written < n {
+			n = config.WriteBytes - written
+		}
+		if _, err := f.Write(chunk[:n]); err != nil {
+			return fail("write", err)
+		}
+		written += n
+	}
+	if err := f.Sync(); err != nil {
+		return fail("sync", err)
+	}
+	writeRate := rate(written, time.Since(start))
+
+	latencies := make([]time.Duration, 0, config.Syncs)
+	entry := make([]byte, 512)
+	for i := 0; i < config.Syncs; i++ {
+		if _, err := f.Write(entry); err != nil {
+			return fail("write", err)
+		}
+		start := time.Now()
+		if err := f.Sync(); err != nil {
+			return fail("sync", err)
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail("seek", err)
+	}
+	start = time.Now()
+	read, err := io.CopyBuffer(ioutil.Discard, f, chunk)
+	if err != nil {
+		return fail("read", err)
+	}
+	// likely from the page cache, so it's an upper bound
+	readRate := rate(read, time.Since(start))
+
+	r.Passed = true
+	r.Detail = fmt.Sprintf("write %.1f MB/s, read %.1f MB/s", writeRate, readRate)
+	if len(latencies) > 0 {
+		median, max := latencies[len(latencies)/2], latencies[len(latencies)-1]
+		r.Detail += fmt.Sprintf(", fsync median %s max %s", median, max)
+		if config.MaxSyncLatency > 0 && max > config.MaxSyncLatency {
+			r.Passed = false
+			r.Detail += fmt.Sprintf(", over the max of %s", config.MaxSyncLatency)
+		}
+	}
+	return r
+}
+
+func rate(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	return float64(n) / d.Seconds() / 1e6
+}
+
+func selfTestOpenFiles(min uint64) *SelfTestResult {
+	r := &SelfTestResult{Check: "open file limit"}
+	limit, err := openFileLimit()
+	if err == errOpenFileLimitUnsupported {
+		r.Passed = true
+		r.Detail = "not checked on this platform"
+		return r
+	}
+	if err != nil {
+		r.Detail = fmt.Sprintf("get limit failed: %s", err)
+		return r
+	}
+	r.Passed = limit >= min
+	r.Detail = fmt.Sprintf("%d, want at least %d", limit, min)
+	return r
+}
+
+// selfTestCluster checks that it can connect to each of the cluster's brokers
+// and that their clocks are close enough to this machine's. A broker's skew is
+// measured against the middle of the request's round trip, so it's accurate to
+// within half the round trip.
+func selfTestCluster(dialer *Dialer, config SelfTestConfig) []*SelfTestResult {
+	conn, err := dialer.Dial("tcp", config.BrokerAddr)
+	if err != nil {
+		return []*SelfTestResult{{Check: "cluster", Detail: fmt.Sprintf("connect to %s failed: %s", config.BrokerAddr, err)}}
+	}
+	md, err := conn.Metadata(&protocol.MetadataRequest{})
+	conn.Close()
+	if err != nil {
+		return []*SelfTestResult{{Check: "cluster", Detail: fmt.Sprintf("metadata from %s failed: %s", config.BrokerAddr, err)}}
+	}
+	results := make([]*SelfTestResult, 0, len(md.Brokers))
+	for _, broker := range md.Brokers {
+		r := &SelfTestResult{Check: fmt.Sprintf("broker %d at %s", broker.NodeID, broker.Addr())}
+		results = append(results, r)
+		conn, err := dialer.Dial("tcp", broker.Addr())
+		if err != nil {
+			r.Detail = fmt.Sprintf("connect failed: %s", err)
+			continue
+		}
+		rtt, skew, err := clockSkew(conn)
+		conn.Close()
+		if err != nil {
+			r.Detail = fmt.Sprintf("describe clock failed: %s", err)
+			continue
+		}
+		r.Passed = true
+		r.Detail = fmt.Sprintf("round trip %s, clock skew %s", rtt, skew)
+		if skew < 0 {
+			skew = -skew
+		}
+		if config.MaxClockSkew > 0 && skew > config.MaxClockSkew {
+			r.Passed = false
+			r.Detail += fmt.Sprintf(", over the max of %s", config.MaxClockSkew)
+		}
+	}
+	return results
+}
+
+// clockSkew returns the round trip of a describe clock request to the
+// broker and how far the broker's clock is off from this machine's, measured
+// against the middle of the round trip.
+func clockSkew(conn *Conn) (rtt, skew time.Duration, err error) {
+	sent := time.Now()
+	res, err := conn.DescribeClock(&protocol.DescribeClockRequest{})
+	received := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	if res.ErrorCode != protocol.ErrNone.Code() {
+		return 0, 0, protocol.Errs[res.ErrorCode]
+	}
+	rtt = received.Sub(sent)
+	mid := sent.Add(rtt / 2)
+	return rtt, time.Unix(0, res.Time*int64(time.Millisecond)).Sub(mid), nil
+}
+
+func (b *Broker) handleDescribeClock(ctx *Context, req *protocol.DescribeClockRequest) *protocol.DescribeClockResponse {
+	sp := span(ctx, b.tracer, "describe clock")
+	defer sp.Finish()
+	res := &protocol.DescribeClockResponse{
+		BrokerID: b.config.ID,
+		Time:     time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	res.APIVersion = req.Version()
+	return res
+}
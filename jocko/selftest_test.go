@@ -0,0 +1,38 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTestDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jocko-self-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the dir's created if it doesn't exist and the test file's cleaned up
+	dataDir := filepath.Join(dir, "data")
+	r := selfTestDataDir(dataDir, SelfTestConfig{WriteBytes: 3*selfTestChunk + 10, Syncs: 3})
+	require.True(t, r.Passed, r.Detail)
+	files, err := ioutil.ReadDir(dataDir)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(files))
+
+	r = selfTestDataDir(dataDir, SelfTestConfig{WriteBytes: 10, Syncs: 3, MaxSyncLatency: time.Nanosecond})
+	require.False(t, r.Passed)
+
+	f := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(f, nil, 0644))
+	r = selfTestDataDir(f, SelfTestConfig{WriteBytes: 10})
+	require.False(t, r.Passed)
+}
+
+func TestSelfTestPassed(t *testing.T) {
+	require.True(t, SelfTestPassed([]*SelfTestResult{{Passed: true}, {Passed: true}}))
+	require.False(t, SelfTestPassed([]*SelfTestResult{{Passed: true}, {Check: "open file limit"}}))
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package jocko
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errOpenFileLimitUnsupported = errors.New("open file limit unsupported")
+
+// openFileLimit returns the process's soft limit on open files.
+func openFileLimit() (uint64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, err
+	}
+	return uint64(rlim.Cur), nil
+}
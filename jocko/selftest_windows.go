@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package jocko
+
+import "errors"
+
+var errOpenFileLimitUnsupported = errors.New("open file limit unsupported")
+
+// openFileLimit isn't supported since Windows limits handles per process by
+// memory rather than with a limit to check.
+func openFileLimit() (uint64, error) {
+	return 0, errOpenFileLimitUnsupported
+}
@@ -35,6 +35,22 @@ func (b *Broker) setupSerf(config *serf.Config, ch chan serf.Event, path string)
 	config.Tags["raft_addr"] = b.config.RaftAddr
 	config.Tags["serf_lan_addr"] = fmt.Sprintf("%s:%d", b.config.SerfLANConfig.MemberlistConfig.BindAddr, b.config.SerfLANConfig.MemberlistConfig.BindPort)
 	config.Tags["broker_addr"] = b.config.Addr
+	if b.config.Rack != "" {
+		config.Tags["rack"] = b.config.Rack
+	}
+	if b.config.LeaderPriority != 0 {
+		config.Tags["leader_priority"] = fmt.Sprintf("%d", b.config.LeaderPriority)
+	}
+	if lc, ok := interBrokerListener(b.config); ok {
+		config.Tags["inter_broker_addr"] = lc.Addr
+	}
+	if b.interBrokerTLS != nil {
+		transport, err := newTLSMemberlistTransport(config.MemberlistConfig, b.interBrokerTLS)
+		if err != nil {
+			return nil, err
+		}
+		config.MemberlistConfig.Transport = transport
+	}
 	config.EventCh = ch
 	config.EnableNameConflictResolution = false
 	if !b.config.DevMode {
@@ -46,7 +62,7 @@ func (b *Broker) setupSerf(config *serf.Config, ch chan serf.Event, path string)
 	return serf.Create(config)
 }
 
-func (b *Broker) lanEventHandler() {
+func (b *Broker) lanEventHandler(stop <-chan struct{}) {
 	for {
 		select {
 		case e := <-b.eventChLAN:
@@ -60,7 +76,7 @@ func (b *Broker) lanEventHandler() {
 				b.lanNodeFailed(e.(serf.MemberEvent))
 				b.localMemberEvent(e.(serf.MemberEvent))
 			}
-		case <-b.shutdownCh:
+		case <-stop:
 			return
 		}
 	}
@@ -112,13 +128,7 @@ func (b *Broker) localMemberEvent(me serf.MemberEvent) {
 }
 
 func (b *Broker) maybeBootstrap() {
-	var index uint64
-	var err error
-	if b.config.DevMode {
-		index, err = b.raftInmem.LastIndex()
-	} else {
-		index, err = b.raftStore.LastIndex()
-	}
+	index, err := b.cluster.LastIndex()
 	if err != nil {
 		log.Error.Printf("broker/%d: read last raft index error: %s", b.config.ID, err)
 		return
@@ -152,7 +162,7 @@ func (b *Broker) maybeBootstrap() {
 		return
 	}
 
-	var configuration raft.Configuration
+	var servers []raft.Server
 	addrs := make([]string, 0, len(brokers))
 	for _, meta := range brokers {
 		addr := meta.RaftAddr
@@ -161,12 +171,11 @@ func (b *Broker) maybeBootstrap() {
 			ID:      raft.ServerID(meta.ID.String()),
 			Address: raft.ServerAddress(addr),
 		}
-		configuration.Servers = append(configuration.Servers, peer)
+		servers = append(servers, peer)
 	}
 
 	log.Info.Printf("broker/%d: found expected number of peers, attempting bootstrap: addrs: %v", b.config.ID, addrs)
-	future := b.raft.BootstrapCluster(configuration)
-	if err := future.Error(); err != nil {
+	if err := b.cluster.Bootstrap(servers); err != nil {
 		log.Error.Printf("broker/%d: bootstrap cluster error: %s", b.config.ID, err)
 	}
 	b.config.BootstrapExpect = 0
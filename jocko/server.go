@@ -2,14 +2,19 @@ package jocko
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	"github.com/travisjeffery/jocko/jocko/config"
 	"github.com/travisjeffery/jocko/log"
 	"github.com/travisjeffery/jocko/protocol"
@@ -21,6 +26,9 @@ var (
 	serverVerboseLogs    bool
 	requestQueueSpanKey  = contextKey("request queue span key")
 	responseQueueSpanKey = contextKey("response queue span key")
+	requestStartKey      = contextKey("request start key")
+	inFlightKey          = contextKey("in flight key")
+	responseSlotKey      = contextKey("response slot key")
 )
 
 func init() {
@@ -44,18 +52,34 @@ type Handler interface {
 type Server struct {
 	config       *config.Config
 	protocolLn   *net.TCPListener
+	listeners    []net.Listener
 	handler      Handler
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
 	metrics      *Metrics
+	conns        int64
 	requestCh    chan *Context
 	responseCh   chan *Context
 	tracer       opentracing.Tracer
 	close        func() error
+	// ctx is the requests' parent context, canceled when the server shuts
+	// down so the requests still being handled give up.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewServer(config *config.Config, handler Handler, metrics *Metrics, tracer opentracing.Tracer, close func() error) *Server {
+	if config.MetricsReporter != nil {
+		m := Metrics{}
+		if metrics != nil {
+			m = *metrics
+		}
+		if m.Reporter == nil {
+			m.Reporter = config.MetricsReporter
+		}
+		metrics = &m
+	}
 	s := &Server{
 		config:     config,
 		handler:    handler,
@@ -66,11 +90,16 @@ func NewServer(config *config.Config, handler Handler, metrics *Metrics, tracer
 		tracer:     tracer,
 		close:      close,
 	}
+	if h, ok := handler.(interface{ useMetrics(*Metrics) }); ok && metrics != nil {
+		h.useMetrics(metrics)
+	}
 	return s
 }
 
 // Start starts the service.
 func (s *Server) Start(ctx context.Context) error {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.ctx = ctx
 	protocolAddr, err := net.ResolveTCPAddr("tcp", s.config.Addr)
 	if err != nil {
 		return err
@@ -78,33 +107,23 @@ func (s *Server) Start(ctx context.Context) error {
 	if s.protocolLn, err = net.ListenTCP("tcp", protocolAddr); err != nil {
 		return err
 	}
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				break
-			case <-s.shutdownCh:
-				break
-			default:
-				conn, err := s.protocolLn.Accept()
-				if err != nil {
-					log.Error.Printf("server/%d: listener accept error: %s", s.config.ID, err)
-					continue
-				}
-
-				go s.handleRequest(conn)
-			}
+	go s.serve(ctx, s.protocolLn, defaultListener)
+	for _, lc := range s.config.Listeners {
+		ln, err := s.listen(lc)
+		if err != nil {
+			return errors.Wrapf(err, "listen on %s failed", lc.Name)
 		}
-	}()
+		s.listeners = append(s.listeners, ln)
+		go s.serve(ctx, ln, lc.Name)
+	}
 
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
-				break
+				return
 			case <-s.shutdownCh:
-				break
+				return
 			case respCtx := <-s.responseCh:
 				if queueSpan, ok := respCtx.Value(responseQueueSpanKey).(opentracing.Span); ok {
 					queueSpan.Finish()
@@ -122,6 +141,40 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
+// serve accepts connections on the listener and handles their requests until
+// the listener's closed.
+func (s *Server) serve(ctx context.Context, ln net.Listener, name string) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.shutdownCh:
+				return
+			default:
+			}
+			// like net/http, back off on temporary errors, e.g. running
+			// out of fds, and give up on the others
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Error.Printf("server/%d: listener %s accept error: %s; retrying in %s", s.config.ID, name, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Error.Printf("server/%d: listener %s accept error: %s", s.config.ID, name, err)
+			return
+		}
+		delay = 0
+		go s.handleRequest(conn, name)
+	}
+}
+
 func (s *Server) Leave() error {
 	return s.handler.Leave()
 }
@@ -135,8 +188,14 @@ func (s *Server) Shutdown() error {
 		return nil
 	}
 
+	if h, ok := s.handler.(interface{ beforeShutdown() }); ok {
+		h.beforeShutdown()
+	}
 	s.shutdown = true
 	close(s.shutdownCh)
+	if s.cancel != nil {
+		s.cancel()
+	}
 
 	if err := s.handler.Shutdown(); err != nil {
 		return err
@@ -144,14 +203,44 @@ func (s *Server) Shutdown() error {
 	if err := s.protocolLn.Close(); err != nil {
 		return err
 	}
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil {
+			return err
+		}
+	}
+	if c, ok := s.config.MetricsReporter.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
 
 	s.close()
 
 	return nil
 }
 
-func (s *Server) handleRequest(conn net.Conn) {
+func (s *Server) handleRequest(conn net.Conn, listener string) {
 	defer conn.Close()
+	var slots chan struct{}
+	if s.config.MaxInFlightRequestsPerConnection > 0 {
+		slots = make(chan struct{}, s.config.MaxInFlightRequestsPerConnection)
+	}
+	s.metrics.set("connections", float64(atomic.AddInt64(&s.conns, 1)))
+	defer func() { s.metrics.set("connections", float64(atomic.AddInt64(&s.conns, -1))) }()
+	client := newClientInfo(conn, listener)
+	if tc, ok := conn.(*tls.Conn); ok {
+		principal, err := tlsPrincipal(tc)
+		if err != nil {
+			log.Error.Printf("server/%d: %s: tls handshake error: %s", s.config.ID, client.Addr, err)
+			return
+		}
+		client.SetPrincipal(principal)
+	}
+	// brokers built with the faultinject tag can slow their connections
+	if h, ok := s.handler.(interface{ wrapConn(net.Conn) net.Conn }); ok {
+		conn = h.wrapConn(conn)
+	}
+	order := newResponseOrder()
 
 	for {
 		p := make([]byte, 4)
@@ -164,6 +253,7 @@ func (s *Server) handleRequest(conn net.Conn) {
 			break
 		}
 
+		start := time.Now()
 		span := s.tracer.StartSpan("request")
 		decodeSpan := s.tracer.StartSpan("server: decode request", opentracing.ChildOf(span.Context()))
 
@@ -171,107 +261,210 @@ func (s *Server) handleRequest(conn net.Conn) {
 		if size == 0 {
 			break // TODO: should this even happen?
 		}
+		// the size is the client's, so it's checked before it's allocated
+		if max := s.config.SocketRequestMaxBytes; max > 0 && size > uint32(max) {
+			log.Error.Printf("server/%d: %s: request of %d bytes is over the max of %d, closing connection", s.config.ID, client.Addr, size, max)
+			span.LogKV("msg", "request too big", "size", size)
+			span.Finish()
+			break
+		}
 
 		b := make([]byte, size+4) //+4 since we're going to copy the size into b
 		copy(b, p)
 
 		if _, err = io.ReadFull(conn, b[4:]); err != nil {
-			// TODO: handle request
+			log.Error.Printf("server/%d: %s: read request error: %s", s.config.ID, client.Addr, err)
 			span.LogKV("msg", "failed to read from connection", "err", err)
 			span.Finish()
-			panic(err)
+			break
 		}
 
 		d := protocol.NewDecoder(b)
 		header := new(protocol.RequestHeader)
-		if err := header.Decode(d); err != nil {
-			// TODO: handle err
+		if err := decodeRequest(func() error { return header.Decode(d) }); err != nil {
+			log.Error.Printf("server/%d: %s: decode request header failed: %s", s.config.ID, client.Addr, err)
 			span.LogKV("msg", "failed to decode header", "err", err)
 			span.Finish()
-			panic(err)
+			break
 		}
 
 		span.SetTag("api_key", header.APIKey)
 		span.SetTag("correlation_id", header.CorrelationID)
 		span.SetTag("client_id", header.ClientID)
+		span.SetTag("client_addr", client.Addr.String())
+		span.SetTag("principal", client.Principal())
 		span.SetTag("size", size)
 		span.SetTag("node_id", s.config.ID) // can I set this globally for the tracer?
 		span.SetTag("addr", s.config.Addr)
 
-		var req protocol.VersionedDecoder
-
-		switch header.APIKey {
-		case protocol.ProduceKey:
-			req = &protocol.ProduceRequest{}
-		case protocol.FetchKey:
-			req = &protocol.FetchRequest{}
-		case protocol.OffsetsKey:
-			req = &protocol.OffsetsRequest{}
-		case protocol.MetadataKey:
-			req = &protocol.MetadataRequest{}
-		case protocol.LeaderAndISRKey:
-			req = &protocol.LeaderAndISRRequest{}
-		case protocol.StopReplicaKey:
-			req = &protocol.StopReplicaRequest{}
-		case protocol.UpdateMetadataKey:
-			req = &protocol.UpdateMetadataRequest{}
-		case protocol.ControlledShutdownKey:
-			req = &protocol.ControlledShutdownRequest{}
-		case protocol.OffsetCommitKey:
-			req = &protocol.OffsetCommitRequest{}
-		case protocol.OffsetFetchKey:
-			req = &protocol.OffsetFetchRequest{}
-		case protocol.FindCoordinatorKey:
-			req = &protocol.FindCoordinatorRequest{}
-		case protocol.JoinGroupKey:
-			req = &protocol.JoinGroupRequest{}
-		case protocol.HeartbeatKey:
-			req = &protocol.HeartbeatRequest{}
-		case protocol.LeaveGroupKey:
-			req = &protocol.LeaveGroupRequest{}
-		case protocol.SyncGroupKey:
-			req = &protocol.SyncGroupRequest{}
-		case protocol.DescribeGroupsKey:
-			req = &protocol.DescribeGroupsRequest{}
-		case protocol.ListGroupsKey:
-			req = &protocol.ListGroupsRequest{}
-		case protocol.SaslHandshakeKey:
-			req = &protocol.SaslHandshakeRequest{}
-		case protocol.APIVersionsKey:
-			req = &protocol.APIVersionsRequest{}
-		case protocol.CreateTopicsKey:
-			req = &protocol.CreateTopicRequests{}
-		case protocol.DeleteTopicsKey:
-			req = &protocol.DeleteTopicsRequest{}
+		if !protocol.SupportsVersion(header.APIKey, header.APIVersion) || apiDisabled(s.config.DisabledAPIs, header.APIKey) {
+			decodeSpan.Finish()
+			log.Info.Printf("server/%d: %s: unsupported version %d", s.config.ID, header, header.APIVersion)
+			span.LogKV("msg", "unsupported version")
+			s.responseCh <- &Context{
+				parent: context.WithValue(opentracing.ContextWithSpan(s.ctx, span), responseSlotKey, order.slot()),
+				conn:   conn,
+				client: client,
+				header: header,
+				res: &protocol.Response{
+					CorrelationID: header.CorrelationID,
+					Body:          unsupportedVersion(header, s.config.DisabledAPIs),
+				},
+			}
+			continue
 		}
 
-		if err := req.Decode(d, header.APIVersion); err != nil {
+		req := protocol.NewRequest(header.APIKey)
+		if err := decodeRequest(func() error { return req.Decode(d, header.APIVersion) }); err != nil {
+			// there's no response to send for a request that can't be
+			// decoded, so like Kafka the connection's closed
 			log.Error.Printf("server/%d: %s: decode request failed: %s", s.config.ID, header, err)
 			span.LogKV("msg", "failed to decode request", "err", err)
 			span.Finish()
-			panic(err)
+			break
 		}
 
 		decodeSpan.Finish()
+		client.observe(header)
+
+		// like Kafka, clients whose session's ended are disconnected on
+		// their next request and have to authenticate again
+		if h, ok := s.handler.(interface{ sessionValid(*ClientInfo) bool }); ok && !h.sessionValid(client) {
+			log.Info.Printf("server/%d: %s: session of %s ended, closing connection", s.config.ID, client.Addr, client.Principal())
+			span.LogKV("msg", "session ended")
+			span.Finish()
+			break
+		}
+
+		if !interBrokerAllowed(s.config, client.Listener, req) {
+			log.Info.Printf("server/%d: %s: inter-broker request on listener %s", s.config.ID, header, client.Listener)
+			span.LogKV("msg", "inter-broker request not on the inter-broker listener")
+			s.responseCh <- &Context{
+				parent: context.WithValue(opentracing.ContextWithSpan(s.ctx, span), responseSlotKey, order.slot()),
+				conn:   conn,
+				client: client,
+				header: header,
+				res: &protocol.Response{
+					CorrelationID: header.CorrelationID,
+					Body:          protocol.ErrorResponse(req.(protocol.Body), protocol.ErrClusterAuthorizationFailed),
+				},
+			}
+			continue
+		}
 
-		ctx := opentracing.ContextWithSpan(context.Background(), span)
+		ctx := opentracing.ContextWithSpan(s.ctx, span)
 		queueSpan := s.tracer.StartSpan("server: queue request", opentracing.ChildOf(span.Context()))
 		ctx = context.WithValue(ctx, requestQueueSpanKey, queueSpan)
+		ctx = context.WithValue(ctx, requestStartKey, start)
+		ctx = context.WithValue(ctx, responseSlotKey, order.slot())
+
+		// wait for a slot, which stops reading the connection's requests
+		// while it has too many in flight
+		r := &inFlightRequest{slots: slots}
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		if s.config.RequestTimeout > 0 {
+			ctx, r.cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
+		}
+		ctx = context.WithValue(ctx, inFlightKey, r)
 
 		reqCtx := &Context{
 			parent: ctx,
 			header: header,
 			req:    req,
 			conn:   conn,
+			client: client,
 		}
 
 		log.Debug.Printf("server/%d: handle request: %s", s.config.ID, reqCtx)
 
+		if s.config.RequestTimeout > 0 {
+			r.timer = time.AfterFunc(s.config.RequestTimeout, func() { s.timeOut(reqCtx, r) })
+		}
 		s.requestCh <- reqCtx
 	}
 }
 
+// unsupportedVersion returns the response to a request for an API version the
+// broker doesn't support. An ApiVersions request gets a version 0 response,
+// which every client can read, listing the versions the broker does support so
+// the client can downgrade and retry.
+func unsupportedVersion(header *protocol.RequestHeader, disabled []int16) protocol.ResponseBody {
+	if header.APIKey == protocol.APIVersionsKey {
+		return &protocol.APIVersionsResponse{
+			ErrorCode:   protocol.ErrUnsupportedVersion.Code(),
+			APIVersions: enabledAPIVersions(disabled),
+		}
+	}
+	return &protocol.UnsupportedVersionResponse{
+		APIVersion: header.APIVersion,
+		ErrorCode:  protocol.ErrUnsupportedVersion.Code(),
+	}
+}
+
+// requiredAPIs can't be disabled: clients need ApiVersions to find the APIs
+// they can use, and the brokers send each other the others to replicate and
+// serve consistent reads, on whatever listener they're sent to.
+var requiredAPIs = []int16{
+	protocol.APIVersionsKey,
+	protocol.LeaderAndISRKey,
+	protocol.StopReplicaKey,
+	protocol.FetchKey,
+	protocol.UpdateMetadataKey,
+	protocol.ReadIndexKey,
+}
+
+// ValidateDisabledAPIs checks that none of the APIs are ones the cluster
+// needs to work.
+func ValidateDisabledAPIs(disabled []int16) error {
+	for _, key := range disabled {
+		if apiDisabled(requiredAPIs, key) {
+			return errors.Errorf("%s can't be disabled, the cluster needs it", protocol.APIKeyName(key))
+		}
+	}
+	return nil
+}
+
+// apiDisabled returns whether the API with the key is one of the disabled.
+func apiDisabled(disabled []int16, key int16) bool {
+	for _, k := range disabled {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// enabledAPIVersions returns the versions of the APIs the broker supports,
+// leaving out the disabled so clients don't try them.
+func enabledAPIVersions(disabled []int16) []protocol.APIVersion {
+	if len(disabled) == 0 {
+		return protocol.APIVersions
+	}
+	var versions []protocol.APIVersion
+	for _, v := range protocol.APIVersions {
+		if !apiDisabled(disabled, v.APIKey) {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
 func (s *Server) handleResponse(respCtx *Context) error {
+	if r, ok := respCtx.Value(inFlightKey).(*inFlightRequest); ok && !r.finish() {
+		// the request timed out and its timeout response was sent instead
+		log.Info.Printf("server/%d: drop response to timed out request: %s", s.config.ID, respCtx)
+		return nil
+	}
+	if slot, ok := respCtx.Value(responseSlotKey).(*responseSlot); ok {
+		return slot.write(respCtx, s.writeResponse)
+	}
+	return s.writeResponse(respCtx)
+}
+
+// writeResponse encodes the response and writes it to its connection.
+func (s *Server) writeResponse(respCtx *Context) error {
 	psp := opentracing.SpanFromContext(respCtx)
 	sp := s.tracer.StartSpan("server: handle response", opentracing.ChildOf(psp.Context()))
 
@@ -280,11 +473,24 @@ func (s *Server) handleResponse(respCtx *Context) error {
 	defer psp.Finish()
 	defer sp.Finish()
 
-	b, err := protocol.Encode(respCtx.res.(protocol.Encoder))
-	if err != nil {
-		return err
+	var err error
+	if req, ok := respCtx.req.(*protocol.ProduceRequest); !ok || req.Acks != 0 {
+		// like Kafka, produce requests with acks 0 aren't answered. The
+		// response's record sets are written from where they are rather
+		// than copied into one buffer first.
+		var bufs net.Buffers
+		if bufs, err = protocol.EncodeBuffers(respCtx.res.(protocol.Encoder)); err != nil {
+			return err
+		}
+		_, err = bufs.WriteTo(respCtx.conn)
+	}
+	if s.metrics != nil && respCtx.header != nil {
+		apiKey := strconv.Itoa(int(respCtx.header.APIKey))
+		s.metrics.add(nil, "requests", 1, "api_key", apiKey)
+		if start, ok := respCtx.Value(requestStartKey).(time.Time); ok {
+			s.metrics.observe("request_seconds", time.Since(start).Seconds(), "api_key", apiKey)
+		}
 	}
-	_, err = respCtx.conn.Write(b)
 	return err
 }
 
@@ -296,3 +502,15 @@ func (s *Server) Addr() net.Addr {
 func (s *Server) ID() int32 {
 	return s.config.ID
 }
+
+// decodeRequest calls decode, returning a panic as an error, so a malformed
+// request a decoder's missing a check for closes its connection rather than
+// crashing the broker.
+func decodeRequest(decode func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("decoder panic: %v", r)
+		}
+	}()
+	return decode()
+}
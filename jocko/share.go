@@ -0,0 +1,262 @@
+package jocko
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// maxShareFetchRecords caps the records a member acquires from a
+	// partition in a fetch, whatever max records it asks for.
+	maxShareFetchRecords = 500
+	// maxShareFetchBytes caps the size of a partition's records in a fetch.
+	// A record's always acquired if none have been yet, so a record bigger
+	// than the cap is still delivered.
+	maxShareFetchBytes = 1 << 20
+)
+
+// shareGroups tracks which records of the partitions the broker leads have
+// been acquired by share group members. The state's kept in memory, so if the
+// broker restarts or leadership moves the group consumes from the start of the
+// log again, i.e. delivery is at-least-once. Groups are removed once they
+// haven't fetched or acknowledged records for the offsets retention, like
+// consumer groups' offsets.
+type shareGroups struct {
+	lockDuration  time.Duration
+	maxDeliveries int16
+	maxBytes      int
+
+	// mu guards the groups map, each group's state is guarded by its own lock
+	// so groups don't wait on each other.
+	mu     sync.Mutex
+	groups map[string]*shareGroup
+}
+
+type shareGroup struct {
+	mu         sync.Mutex
+	partitions map[sharePartitionKey]*sharePartition
+	// used is when the group last fetched or acknowledged records.
+	used time.Time
+	// removed is set once the group's been removed, so a member that looked
+	// it up before then looks it up again.
+	removed bool
+}
+
+type sharePartitionKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+type sharePartition struct {
+	// next is the first offset not acquired by the group yet.
+	next int64
+	// records are the records before next that are acquired or waiting to
+	// be delivered again. Records that have been acknowledged aren't in here.
+	records map[int64]*shareRecord
+}
+
+type shareRecord struct {
+	// member has the record acquired until the deadline, it's empty if the
+	// record's available.
+	member     string
+	deadline   time.Time
+	deliveries int16
+}
+
+func newShareGroups(lockDuration time.Duration, maxDeliveries int16) *shareGroups {
+	return &shareGroups{
+		lockDuration:  lockDuration,
+		maxDeliveries: maxDeliveries,
+		maxBytes:      maxShareFetchBytes,
+		groups:        make(map[string]*shareGroup),
+	}
+}
+
+// lock returns the group, creating it if it's new, with its lock held.
+func (g *shareGroups) lock(name string) *shareGroup {
+	for {
+		g.mu.Lock()
+		group, ok := g.groups[name]
+		if !ok {
+			group = &shareGroup{partitions: make(map[sharePartitionKey]*sharePartition)}
+			g.groups[name] = group
+		}
+		g.mu.Unlock()
+		group.mu.Lock()
+		if !group.removed {
+			return group
+		}
+		group.mu.Unlock()
+		g.forget(name, group)
+	}
+}
+
+// expire removes the groups that haven't been used since before.
+func (g *shareGroups) expire(before time.Time) {
+	g.remove(func(group *shareGroup) bool {
+		return group.used.Before(before)
+	})
+}
+
+// removePartition removes the groups' state for the partition, e.g. because
+// the broker's stopped leading it, and the groups left without any.
+func (g *shareGroups) removePartition(topic string, partition int32) {
+	g.remove(func(group *shareGroup) bool {
+		for key := range group.partitions {
+			if key.topic == topic && key.partition == partition {
+				delete(group.partitions, key)
+			}
+		}
+		return len(group.partitions) == 0
+	})
+}
+
+// remove calls fn with each group's lock held and removes the groups it
+// returns true for. The groups are locked one at a time without holding the
+// groups map's lock, so the other groups aren't held up by a busy one.
+func (g *shareGroups) remove(fn func(*shareGroup) bool) {
+	g.mu.Lock()
+	groups := make(map[string]*shareGroup, len(g.groups))
+	for name, group := range g.groups {
+		groups[name] = group
+	}
+	g.mu.Unlock()
+	for name, group := range groups {
+		group.mu.Lock()
+		if !group.removed && fn(group) {
+			group.removed = true
+		}
+		removed := group.removed
+		group.mu.Unlock()
+		if removed {
+			g.forget(name, group)
+		}
+	}
+}
+
+// forget deletes the removed group from the groups map unless it's already
+// been replaced.
+func (g *shareGroups) forget(name string, group *shareGroup) {
+	g.mu.Lock()
+	if g.groups[name] == group {
+		delete(g.groups, name)
+	}
+	g.mu.Unlock()
+}
+
+// acquire acquires up to max records of the partition for the member, and at
+// most maxShareFetchRecords records and about maxBytes bytes of them. Records
+// whose locks have timed out or that were released are delivered again first,
+// then records the group hasn't seen below the high watermark hw. Records that
+// have been delivered the max number of times are dropped.
+func (g *shareGroups) acquire(key sharePartitionKey, member string, l CommitLog, hw int64, max int, now time.Time) ([]byte, []*protocol.AcquiredRecord, error) {
+	if max <= 0 || max > maxShareFetchRecords {
+		max = maxShareFetchRecords
+	}
+	group := g.lock(key.group)
+	defer group.mu.Unlock()
+	group.used = now
+	p, ok := group.partitions[key]
+	if !ok {
+		p = &sharePartition{
+			next:    l.OldestOffset(),
+			records: make(map[int64]*shareRecord),
+		}
+		group.partitions[key] = p
+	}
+
+	var available []int64
+	for offset, r := range p.records {
+		if r.member != "" && now.After(r.deadline) {
+			r.member = ""
+		}
+		if r.member == "" {
+			available = append(available, offset)
+		}
+	}
+	sort.Slice(available, func(i, j int) bool { return available[i] < available[j] })
+
+	var recordSet []byte
+	var acquired []*protocol.AcquiredRecord
+	full := func() bool {
+		return len(acquired) >= max || len(recordSet) >= g.maxBytes
+	}
+	take := func(offset int64, r *shareRecord) error {
+		rdr, err := l.NewReader(offset, 0)
+		if err != nil {
+			return err
+		}
+		ms, err := commitlog.ReadMessageSet(rdr)
+		if err != nil {
+			return err
+		}
+		r.member = member
+		r.deadline = now.Add(g.lockDuration)
+		r.deliveries++
+		recordSet = append(recordSet, ms...)
+		acquired = append(acquired, &protocol.AcquiredRecord{Offset: offset, DeliveryCount: r.deliveries})
+		return nil
+	}
+	for _, offset := range available {
+		if full() {
+			break
+		}
+		r := p.records[offset]
+		if r.deliveries >= g.maxDeliveries {
+			delete(p.records, offset)
+			continue
+		}
+		if err := take(offset, r); err != nil {
+			return nil, nil, err
+		}
+	}
+	for ; !full() && p.next < hw; p.next++ {
+		r := &shareRecord{}
+		if err := take(p.next, r); err != nil {
+			return nil, nil, err
+		}
+		p.records[p.next] = r
+	}
+	return recordSet, acquired, nil
+}
+
+// acknowledge applies the member's acknowledgements. It errors if one of the
+// records isn't acquired by the member, e.g. because its lock timed out, but
+// still applies the others.
+func (g *shareGroups) acknowledge(key sharePartitionKey, member string, acks []*protocol.ShareAcknowledgement, now time.Time) protocol.Error {
+	g.mu.Lock()
+	group, ok := g.groups[key.group]
+	g.mu.Unlock()
+	if !ok {
+		return protocol.ErrInvalidRecordState
+	}
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	p, ok := group.partitions[key]
+	if group.removed || !ok {
+		return protocol.ErrInvalidRecordState
+	}
+	group.used = now
+	perr := protocol.ErrNone
+	for _, a := range acks {
+		r, ok := p.records[a.Offset]
+		if !ok || r.member != member {
+			perr = protocol.ErrInvalidRecordState
+			continue
+		}
+		switch a.Type {
+		case protocol.AcknowledgeAccept, protocol.AcknowledgeReject:
+			delete(p.records, a.Offset)
+		case protocol.AcknowledgeRelease:
+			r.member = ""
+		default:
+			perr = protocol.ErrInvalidRequest
+		}
+	}
+	return perr
+}
@@ -0,0 +1,152 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestShareGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharegroups")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte(v)})
+		require.NoError(t, err)
+		_, err = l.Append(commitlog.NewMessageSet(0, m))
+		require.NoError(t, err)
+	}
+
+	g := newShareGroups(time.Minute, 2)
+	key := sharePartitionKey{group: "g", topic: "t", partition: 0}
+	now := time.Now()
+	offsets := func(acquired []*protocol.AcquiredRecord) (offsets []int64) {
+		for _, a := range acquired {
+			offsets = append(offsets, a.Offset)
+		}
+		return offsets
+	}
+
+	// members get disjoint records
+	rs, acquired, err := g.acquire(key, "m1", l, l.NewestOffset(), 2, now)
+	require.NoError(t, err)
+	require.Equal(t, []int64{0, 1}, offsets(acquired))
+	require.Equal(t, 2, len(commitlog.MessageSets(rs)))
+	_, acquired, err = g.acquire(key, "m2", l, l.NewestOffset(), 2, now)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, offsets(acquired))
+
+	// another member can't acknowledge m1's records
+	require.Equal(t, protocol.ErrInvalidRecordState, g.acknowledge(key, "m2", []*protocol.ShareAcknowledgement{{Offset: 0, Type: protocol.AcknowledgeAccept}}, now))
+	require.Equal(t, protocol.ErrNone, g.acknowledge(key, "m1", []*protocol.ShareAcknowledgement{
+		{Offset: 0, Type: protocol.AcknowledgeAccept},
+		{Offset: 1, Type: protocol.AcknowledgeRelease},
+	}, now))
+
+	// released and timed out records are delivered again
+	_, acquired, err = g.acquire(key, "m2", l, l.NewestOffset(), 10, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2}, offsets(acquired))
+	require.Equal(t, int16(2), acquired[0].DeliveryCount)
+
+	// records past the max deliveries are dropped
+	_, acquired, err = g.acquire(key, "m1", l, l.NewestOffset(), 10, now.Add(4*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 0, len(acquired))
+}
+
+func TestShareGroupsAcquireBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharegroups")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+	var size int
+	for _, v := range []string{"a", "b", "c", "d"} {
+		m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte(v)})
+		require.NoError(t, err)
+		ms := commitlog.NewMessageSet(0, m)
+		size = len(ms)
+		_, err = l.Append(ms)
+		require.NoError(t, err)
+	}
+
+	g := newShareGroups(time.Minute, 2)
+	g.maxBytes = 2 * size
+	now := time.Now()
+
+	// records past the high watermark aren't acquired
+	_, acquired, err := g.acquire(sharePartitionKey{group: "g1", topic: "t"}, "m", l, 1, 10, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(acquired))
+
+	// the byte cap bounds the records acquired
+	rs, acquired, err := g.acquire(sharePartitionKey{group: "g2", topic: "t"}, "m", l, l.NewestOffset(), 10, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(acquired))
+	require.Equal(t, 2*size, len(rs))
+
+	// a max records of 0 or less acquires up to the record cap
+	g.maxBytes = maxShareFetchBytes
+	_, acquired, err = g.acquire(sharePartitionKey{group: "g3", topic: "t"}, "m", l, l.NewestOffset(), 0, now)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(acquired))
+}
+
+func TestShareGroupsRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharegroups")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := commitlog.New(commitlog.Options{Path: dir, MaxSegmentBytes: 1024, MaxLogBytes: -1})
+	require.NoError(t, err)
+	m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Value: []byte("a")})
+	require.NoError(t, err)
+	_, err = l.Append(commitlog.NewMessageSet(0, m))
+	require.NoError(t, err)
+
+	g := newShareGroups(time.Minute, 2)
+	now := time.Now()
+	keys := []sharePartitionKey{
+		{group: "g1", topic: "t", partition: 0},
+		{group: "g1", topic: "t", partition: 1},
+		{group: "g2", topic: "t", partition: 0},
+	}
+	for i, key := range keys {
+		_, _, err := g.acquire(key, "m", l, l.NewestOffset(), 1, now.Add(time.Duration(i)*time.Hour))
+		require.NoError(t, err)
+	}
+	groups := func() []string {
+		var names []string
+		for name := range g.groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// g2's only partition is removed and g1 keeps its other one
+	g.removePartition("t", 0)
+	require.Equal(t, []string{"g1"}, groups())
+	require.Equal(t, protocol.ErrInvalidRecordState, g.acknowledge(keys[0], "m", []*protocol.ShareAcknowledgement{{Offset: 0, Type: protocol.AcknowledgeAccept}}, now))
+	require.Equal(t, protocol.ErrNone, g.acknowledge(keys[1], "m", []*protocol.ShareAcknowledgement{{Offset: 0, Type: protocol.AcknowledgeAccept}}, now.Add(3*time.Hour)))
+
+	// groups are removed once they're unused for the retention
+	g.expire(now.Add(3 * time.Hour))
+	require.Equal(t, []string{"g1"}, groups())
+	g.expire(now.Add(4 * time.Hour))
+	require.Empty(t, groups())
+
+	// a removed group starts from the log's oldest offset again
+	_, acquired, err := g.acquire(keys[1], "m", l, l.NewestOffset(), 1, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), acquired[0].Offset)
+	require.Equal(t, int16(1), acquired[0].DeliveryCount)
+}
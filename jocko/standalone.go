@@ -0,0 +1,294 @@
+package jocko
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/metadata"
+	"github.com/travisjeffery/jocko/log"
+)
+
+const (
+	standaloneState = "standalone/"
+	// standaloneEntryHeaderLen is the size and index before a metadata log
+	// entry.
+	standaloneEntryHeaderLen = 12
+	// maxStandaloneEntryBytes caps a metadata log entry, so a corrupt size
+	// isn't trusted to allocate it when it's replayed.
+	maxStandaloneEntryBytes = 64 << 20
+	// standaloneSnapshotEntries is how many entries are appended to the
+	// metadata log before it's compacted into a snapshot.
+	standaloneSnapshotEntries = 4096
+)
+
+// standaloneStore applies metadata changes straight to the FSM instead of
+// replicating them with raft, for a broker running on its own. The changes are
+// appended to a log that's replayed when the store's opened so the metadata
+// survives restarts, unless the log's path is empty. Every so often the FSM's
+// snapshotted next to the log and the log's truncated, so it doesn't grow
+// without bound.
+type standaloneStore struct {
+	fsm          *fsm.FSM
+	snapshotPath string
+	// snapshotEntries is how many entries the log has before it's compacted.
+	snapshotEntries int
+
+	mu      sync.Mutex
+	index   uint64
+	entries int
+	f       *os.File
+}
+
+func newStandaloneStore(f *fsm.FSM, path string) (*standaloneStore, error) {
+	s := &standaloneStore{fsm: f, snapshotEntries: standaloneSnapshotEntries}
+	if path == "" {
+		return s, nil
+	}
+	if err := ensurePath(path, false); err != nil {
+		return nil, err
+	}
+	s.snapshotPath = strings.TrimSuffix(path, filepath.Ext(path)) + ".snapshot"
+	if err := s.restore(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open metadata log failed")
+	}
+	s.f = file
+	if err := s.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// restore restores the FSM from the snapshot, if there is one. The snapshot's
+// the index of the last entry in it followed by the FSM's snapshot.
+func (s *standaloneStore) restore() error {
+	f, err := os.Open(s.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open metadata snapshot failed")
+	}
+	var index uint64
+	if err := binary.Read(f, binary.BigEndian, &index); err != nil {
+		f.Close()
+		return errors.Wrap(err, "read metadata snapshot failed")
+	}
+	if err := s.fsm.Restore(f); err != nil {
+		return errors.Wrap(err, "restore metadata snapshot failed")
+	}
+	s.index = index
+	return nil
+}
+
+// replay applies the log's entries after the snapshot to the FSM. Entries
+// already in the snapshot are skipped, they're left when the broker stops
+// after snapshotting but before truncating the log. An entry that was cut
+// short, e.g. by a crash while it was written, or whose header's corrupt is
+// truncated along with the rest of the log since it was never applied.
+func (s *standaloneStore) replay() error {
+	r := bufio.NewReader(s.f)
+	header := make([]byte, standaloneEntryHeaderLen)
+	var pos int64
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(header)
+		index := binary.BigEndian.Uint64(header[4:])
+		if size == 0 || size > maxStandaloneEntryBytes || index > s.index+1 {
+			log.Error.Printf("standalone: corrupt metadata log entry at %d, truncating", pos)
+			break
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			break
+		}
+		pos += standaloneEntryHeaderLen + int64(size)
+		if index <= s.index {
+			continue
+		}
+		s.index = index
+		s.entries++
+		s.fsm.Apply(&raft.Log{Index: s.index, Data: buf})
+	}
+	if err := s.f.Truncate(pos); err != nil {
+		return errors.Wrap(err, "truncate metadata log failed")
+	}
+	_, err := s.f.Seek(pos, io.SeekStart)
+	return err
+}
+
+// Apply writes the encoded request to the log and applies it to the FSM,
+// returning the FSM's response like a raft apply future would.
+func (s *standaloneStore) Apply(buf []byte) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		if len(buf) > maxStandaloneEntryBytes {
+			return nil, errors.Errorf("metadata log entry of %d bytes is too large", len(buf))
+		}
+		entry := make([]byte, standaloneEntryHeaderLen+len(buf))
+		binary.BigEndian.PutUint32(entry, uint32(len(buf)))
+		binary.BigEndian.PutUint64(entry[4:], s.index+1)
+		copy(entry[standaloneEntryHeaderLen:], buf)
+		if _, err := s.f.Write(entry); err != nil {
+			return nil, errors.Wrap(err, "write metadata log failed")
+		}
+		if err := s.f.Sync(); err != nil {
+			return nil, errors.Wrap(err, "sync metadata log failed")
+		}
+	}
+	s.index++
+	res := s.fsm.Apply(&raft.Log{Index: s.index, Data: buf})
+	if s.f != nil {
+		if s.entries++; s.entries >= s.snapshotEntries {
+			// the entry's applied and logged, so it isn't failed if
+			// compacting fails, the log's compacted after the next one
+			if err := s.snapshot(); err != nil {
+				log.Error.Printf("standalone: compact metadata log error: %s", err)
+			}
+		}
+	}
+	return res, nil
+}
+
+// snapshot writes the FSM's snapshot and then truncates the log. The store's
+// lock must be held.
+func (s *standaloneStore) snapshot() error {
+	snap, err := s.fsm.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	tmp := s.snapshotPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	sink := &standaloneSnapshotSink{File: f}
+	err = binary.Write(f, binary.BigEndian, s.index)
+	if err == nil {
+		err = snap.Persist(sink)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.snapshotPath); err != nil {
+		return err
+	}
+	// the rename has to be durable before the log's truncated, syncing a
+	// dir isn't supported everywhere so it's best effort
+	if dir, err := os.Open(filepath.Dir(s.snapshotPath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.entries = 0
+	return s.f.Sync()
+}
+
+// standaloneSnapshotSink is the file the FSM's snapshot is persisted to.
+type standaloneSnapshotSink struct {
+	*os.File
+}
+
+func (s *standaloneSnapshotSink) ID() string {
+	return "standalone"
+}
+
+// Cancel does nothing, the snapshot's removed if persisting it fails.
+func (s *standaloneSnapshotSink) Cancel() error {
+	return nil
+}
+
+func (s *standaloneStore) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// IsLeader returns true since the broker's the only one.
+func (s *standaloneStore) IsLeader() bool {
+	return true
+}
+
+// setupStandalone sets the broker up to run without raft and serf, with its
+// metadata in the store newStore opens, or logged to a file in the data dir if
+// it's nil. The broker's the only member of its cluster.
+func (b *Broker) setupStandalone(newStore MetadataStoreFactory) (err error) {
+	b.fsm, err = fsm.New(b.tracer, fsm.NodeID(b.config.ID))
+	if err != nil {
+		return err
+	}
+	if newStore == nil {
+		var path string
+		if !b.config.DevMode {
+			path = filepath.Join(b.config.DataDir, standaloneState, "metadata.log")
+		}
+		newStore = func(f *fsm.FSM) (MetadataStore, error) {
+			s, err := newStandaloneStore(f, path)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+	}
+	if b.store, err = newStore(b.fsm); err != nil {
+		return err
+	}
+
+	member := b.localMember()
+	meta, _ := metadata.IsBroker(member)
+	b.brokerLookup.AddBroker(meta)
+	if err := b.handleAliveMember(member); err != nil {
+		return fmt.Errorf("register node: %v", err)
+	}
+	b.setConsistentReadReady()
+	if b.store.IsLeader() {
+		b.hooks.runBecameController()
+	}
+	log.Info.Printf("broker/%d: running standalone", b.config.ID)
+	return nil
+}
+
+// localMember returns the serf member a standalone broker would be.
+func (b *Broker) localMember() serf.Member {
+	return serf.Member{
+		Name:   b.config.NodeName,
+		Status: serf.StatusAlive,
+		Tags: map[string]string{
+			"role":        "jocko",
+			"id":          fmt.Sprintf("%d", b.config.ID),
+			"raft_addr":   b.config.RaftAddr,
+			"broker_addr": b.config.Addr,
+		},
+	}
+}
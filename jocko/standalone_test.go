@@ -0,0 +1,157 @@
+package jocko
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	stdopentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/jocko/config"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+)
+
+func TestStandaloneStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standalone")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.log")
+
+	open := func() (*fsm.FSM, *standaloneStore) {
+		f, err := fsm.New(stdopentracing.GlobalTracer())
+		require.NoError(t, err)
+		s, err := newStandaloneStore(f, path)
+		require.NoError(t, err)
+		return f, s
+	}
+
+	_, s := open()
+	buf, err := structs.Encode(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+		Topic: structs.Topic{Topic: "test", Partitions: map[int32][]int32{0: {1}}},
+	})
+	require.NoError(t, err)
+	_, err = s.Apply(buf)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// a partially written entry is dropped on replay
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 9, 1})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	f, s := open()
+	defer s.Close()
+	_, topic, err := f.State().GetTopic("test")
+	require.NoError(t, err)
+	require.NotNil(t, topic)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(standaloneEntryHeaderLen+len(buf)), fi.Size())
+}
+
+func TestStandaloneStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standalone")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.log")
+
+	open := func() (*fsm.FSM, *standaloneStore) {
+		f, err := fsm.New(stdopentracing.GlobalTracer())
+		require.NoError(t, err)
+		s, err := newStandaloneStore(f, path)
+		require.NoError(t, err)
+		s.snapshotEntries = 2
+		return f, s
+	}
+	register := func(s *standaloneStore, topic string) []byte {
+		buf, err := structs.Encode(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+			Topic: structs.Topic{Topic: topic, Partitions: map[int32][]int32{0: {1}}},
+		})
+		require.NoError(t, err)
+		_, err = s.Apply(buf)
+		require.NoError(t, err)
+		return buf
+	}
+	topics := func(f *fsm.FSM) (names []string) {
+		_, ts, err := f.State().GetTopics()
+		require.NoError(t, err)
+		for _, t := range ts {
+			names = append(names, t.Topic)
+		}
+		return names
+	}
+
+	// the log's truncated once it's snapshotted
+	_, s := open()
+	register(s, "a")
+	register(s, "b")
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fi.Size())
+	buf := register(s, "c")
+	require.NoError(t, s.Close())
+
+	f, s := open()
+	require.ElementsMatch(t, []string{"a", "b", "c"}, topics(f))
+	require.Equal(t, uint64(3), s.index)
+	require.NoError(t, s.Close())
+
+	// entries left in the log after it's snapshotted aren't applied again,
+	// and a corrupt size isn't trusted
+	deleted, err := structs.Encode(structs.DeregisterTopicRequestType, structs.DeregisterTopicRequest{
+		Topic: structs.Topic{Topic: "a"},
+	})
+	require.NoError(t, err)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	for _, e := range []struct {
+		index uint64
+		buf   []byte
+	}{{2, deleted}, {3, buf}} {
+		entry := make([]byte, standaloneEntryHeaderLen)
+		binary.BigEndian.PutUint32(entry, uint32(len(e.buf)))
+		binary.BigEndian.PutUint64(entry[4:], e.index)
+		_, err = file.Write(append(entry, e.buf...))
+		require.NoError(t, err)
+	}
+	_, err = file.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 4})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	f, s = open()
+	defer s.Close()
+	require.ElementsMatch(t, []string{"a", "b", "c"}, topics(f))
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(2*standaloneEntryHeaderLen+len(deleted)+len(buf)), fi.Size())
+}
+
+func TestNewBrokerWithStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := config.DefaultConfig()
+	cfg.ID = 1
+	cfg.DataDir = dir
+	cfg.DevMode = true
+	newStore := func(f *fsm.FSM) (MetadataStore, error) {
+		return newStandaloneStore(f, "")
+	}
+
+	// the store can't manage a cluster's membership so it's only usable
+	// standalone
+	_, err = NewBrokerWithStore(cfg, stdopentracing.NoopTracer{}, newStore)
+	require.Error(t, err)
+
+	b, err := NewStandaloneBroker(cfg, stdopentracing.NoopTracer{}, newStore)
+	require.NoError(t, err)
+	defer b.Shutdown()
+	require.Nil(t, b.cluster)
+	require.True(t, b.isController())
+}
@@ -0,0 +1,225 @@
+package jocko
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/fsm"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/log"
+)
+
+// CleanConfig for cleaning a stopped broker's partition logs.
+type CleanConfig struct {
+	// DataDirs are the dirs the broker stores its logs under.
+	DataDirs []string
+	// Topics are the topics whose partitions are cleaned. They're required
+	// so a mistyped command can't delete records from every topic.
+	Topics []string
+	// OffsetMapBytes bounds the memory compacting each partition takes.
+	OffsetMapBytes int64
+}
+
+// CleanLogs runs retention and compaction once over the topics' partition logs
+// in the data dirs, e.g. to reclaim space on a full volume so the broker can
+// start. The partitions are cleaned with their topics' configs, read from the
+// broker's raft state, and those of topics it doesn't know are skipped. Each
+// data dir's locked while it's cleaned, so it fails if a broker's running on
+// it. It returns the bytes reclaimed by partition.
+func CleanLogs(config CleanConfig) (map[string]int64, error) {
+	if len(config.Topics) == 0 {
+		return nil, errors.New("no topics to clean")
+	}
+	reclaimed := make(map[string]int64)
+	for _, dataDir := range config.DataDirs {
+		if err := cleanDataDir(config, dataDir, reclaimed); err != nil {
+			return nil, err
+		}
+	}
+	return reclaimed, nil
+}
+
+func cleanDataDir(config CleanConfig, dataDir string, reclaimed map[string]int64) error {
+	lockPath := filepath.Join(dataDir, dataDirLockFile)
+	lock, err := lockFile(lockPath)
+	if err != nil {
+		return fmt.Errorf("%s: %v", lockPath, err)
+	}
+	defer unlockFile(lock)
+
+	topics, err := readTopics(dataDir)
+	if err != nil {
+		return err
+	}
+
+	// the logs need recovering if the broker didn't shut down cleanly
+	_, err = os.Stat(filepath.Join(dataDir, cleanShutdownFile))
+	recoverLogs := os.IsNotExist(err)
+
+	dir := filepath.Join(dataDir, "data")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read data dir failed")
+	}
+	for _, file := range files {
+		if !file.IsDir() || !cleanTopic(config.Topics, file.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		topic, ok := topics[file.Name()[:strings.LastIndex(file.Name(), "-")]]
+		if !ok {
+			log.Info.Printf("storage clean: skipping %s, its topic's config isn't known", path)
+			continue
+		}
+		before, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+		_, statErr := os.Stat(filepath.Join(path, commitlog.ManifestFile))
+		retentionBytes, retentionAge := logRetention(topic.Config)
+		l, err := commitlog.New(commitlog.Options{
+			Path:            path,
+			MaxSegmentBytes: 1024,
+			MaxLogBytes:     retentionBytes,
+			MaxLogAge:       retentionAge,
+			CleanupPolicy:   commitlog.CleanupPolicy(topic.Config.GetString("cleanup.policy")),
+			DeleteRetention: time.Duration(topic.Config.GetInt64("delete.retention.ms")) * time.Millisecond,
+			// compact regardless of the dirty ratio
+			MinCleanableDirtyRatio: 0,
+			MaxCompactionLag:       -1,
+			OffsetMapBytes:         config.OffsetMapBytes,
+			Manifest:               statErr == nil,
+			Recover:                recoverLogs,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "open %s failed", path)
+		}
+		if err := l.Clean(); err != nil {
+			l.Close()
+			return errors.Wrapf(err, "clean %s failed", path)
+		}
+		if err := l.Close(); err != nil {
+			return err
+		}
+		after, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+		reclaimed[file.Name()] = before - after
+	}
+	return nil
+}
+
+// readTopics returns the topics in the broker's raft state in the data dir, by
+// name, by restoring its latest snapshot and applying the logs after it. It's
+// empty if the data dir has no raft state.
+func readTopics(dataDir string) (map[string]*structs.Topic, error) {
+	path := filepath.Join(dataDir, raftState)
+	if _, err := os.Stat(filepath.Join(path, "raft.db")); os.IsNotExist(err) {
+		return nil, nil
+	}
+	f, err := fsm.New(fsm.Tracer(opentracing.NoopTracer{}))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(path, snapshotsRetained, ioutil.Discard)
+	if err != nil {
+		return nil, errors.Wrap(err, "open raft snapshots failed")
+	}
+	metas, err := snapshots.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "list raft snapshots failed")
+	}
+	var index uint64
+	if len(metas) > 0 {
+		_, rc, err := snapshots.Open(metas[0].ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "open raft snapshot failed")
+		}
+		if err := f.Restore(rc); err != nil {
+			return nil, errors.Wrap(err, "restore raft snapshot failed")
+		}
+		index = metas[0].Index
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(path, "raft.db"))
+	if err != nil {
+		return nil, errors.Wrap(err, "open raft log failed")
+	}
+	defer store.Close()
+	first, err := store.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	if first < index+1 {
+		first = index + 1
+	}
+	for i := first; first > 0 && i <= last; i++ {
+		var l raft.Log
+		if err := store.GetLog(i, &l); err != nil {
+			return nil, errors.Wrapf(err, "read raft log %d failed", i)
+		}
+		if l.Type == raft.LogCommand {
+			f.Apply(&l)
+		}
+	}
+	_, list, err := f.State().GetTopics()
+	if err != nil {
+		return nil, err
+	}
+	topics := make(map[string]*structs.Topic, len(list))
+	for _, topic := range list {
+		topics[topic.Topic] = topic
+	}
+	return topics, nil
+}
+
+// cleanTopic returns whether the partition dir, named topic-partition, is one
+// of the topics' partitions.
+func cleanTopic(topics []string, name string) bool {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return false
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return false
+	}
+	for _, topic := range topics {
+		if name[:i] == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// dirSize returns the total size of the files in the dir, not counting those
+// in its subdirs.
+func dirSize(path string) (int64, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %v", path, err)
+	}
+	var size int64
+	for _, f := range files {
+		if !f.IsDir() {
+			size += f.Size()
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,99 @@
+package jocko
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestCleanLogs(t *testing.T) {
+	req := require.New(t)
+	dataDir, err := ioutil.TempDir("", "storage-clean-test")
+	req.NoError(err)
+	defer os.RemoveAll(dataDir)
+
+	// a week old records over a few segments in each topic's partition
+	old := time.Now().Add(-7 * 24 * time.Hour)
+	for _, name := range []string{"expired-0", "other-0", "unknown-0"} {
+		l, err := commitlog.New(commitlog.Options{
+			Path:            filepath.Join(dataDir, "data", name),
+			MaxSegmentBytes: 100,
+			MaxLogBytes:     -1,
+		})
+		req.NoError(err)
+		for i := 0; i < 10; i++ {
+			msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: old, Value: []byte("value")})
+			req.NoError(err)
+			_, err = l.Append(commitlog.NewMessageSet(0, msg))
+			req.NoError(err)
+		}
+		req.True(len(l.Segments()) > 2)
+		req.NoError(l.Close())
+	}
+
+	// the broker's raft state has the expired topic's config, but not the
+	// unknown topic's, so its partition's skipped
+	writeTopics(t, dataDir, "expired", "other")
+
+	_, err = CleanLogs(CleanConfig{DataDirs: []string{dataDir}})
+	req.Error(err, "no topics")
+	reclaimed, err := CleanLogs(CleanConfig{
+		DataDirs: []string{dataDir},
+		Topics:   []string{"expired", "unknown"},
+	})
+	req.NoError(err)
+	req.Len(reclaimed, 1)
+	req.True(reclaimed["expired-0"] > 0)
+	_, ok := reclaimed["unknown-0"]
+	req.False(ok)
+
+	// the expired segments are gone but the offsets carry on
+	l, err := commitlog.New(commitlog.Options{Path: filepath.Join(dataDir, "data", "expired-0"), MaxLogBytes: -1})
+	req.NoError(err)
+	req.Equal(int64(10), l.OldestOffset())
+	req.Equal(int64(10), l.NewestOffset())
+	req.NoError(l.Close())
+
+	// the data dir's locked while a broker's running on it
+	lock, err := lockFile(filepath.Join(dataDir, dataDirLockFile))
+	req.NoError(err)
+	defer unlockFile(lock)
+	_, err = CleanLogs(CleanConfig{DataDirs: []string{dataDir}, Topics: []string{"expired"}})
+	req.Error(err)
+}
+
+// writeTopics writes raft state registering the topics, with a day's
+// retention, to the data dir.
+func writeTopics(t *testing.T, dataDir string, topics ...string) {
+	path := filepath.Join(dataDir, raftState)
+	require.NoError(t, os.MkdirAll(path, 0755))
+	store, err := raftboltdb.NewBoltStore(filepath.Join(path, "raft.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	for i, topic := range topics {
+		config := structs.NewTopicConfig()
+		config.SetValue("retention.ms", int64(24*time.Hour/time.Millisecond))
+		data, err := structs.Encode(structs.RegisterTopicRequestType, structs.RegisterTopicRequest{
+			Topic: structs.Topic{Topic: topic, Partitions: map[int32][]int32{0: {1}}, Config: config},
+		})
+		require.NoError(t, err)
+		require.NoError(t, store.StoreLog(&raft.Log{Index: uint64(i + 1), Type: raft.LogCommand, Data: data}))
+	}
+}
+
+func TestCleanTopic(t *testing.T) {
+	req := require.New(t)
+	req.False(cleanTopic(nil, "my-topic-3"))
+	req.False(cleanTopic([]string{"staging"}, "staging"))
+	req.True(cleanTopic([]string{"my-topic"}, "my-topic-3"))
+	req.False(cleanTopic([]string{"my"}, "my-topic-3"))
+}
@@ -2,6 +2,7 @@ package structs
 
 import (
 	"bytes"
+	"time"
 
 	"github.com/ugorji/go/codec"
 )
@@ -9,13 +10,20 @@ import (
 type MessageType uint8
 
 const (
-	RegisterNodeRequestType        MessageType = 0
-	DeregisterNodeRequestType                  = 1
-	RegisterTopicRequestType                   = 2
-	DeregisterTopicRequestType                 = 3
-	RegisterPartitionRequestType               = 4
-	DeregisterPartitionRequestType             = 5
-	RegisterGroupRequestType                   = 6
+	RegisterNodeRequestType              MessageType = 0
+	DeregisterNodeRequestType                        = 1
+	RegisterTopicRequestType                         = 2
+	DeregisterTopicRequestType                       = 3
+	RegisterPartitionRequestType                     = 4
+	DeregisterPartitionRequestType                   = 5
+	RegisterGroupRequestType                         = 6
+	BatchRequestType                                 = 7
+	InitProducerRequestType                          = 8
+	RegisterProducerRequestType                      = 9
+	RegisterDelegationTokenRequestType               = 11
+	DeregisterDelegationTokenRequestType             = 12
+	SetPartitionReadOnlyRequestType                  = 13
+	SetTopicConfigRequestType                        = 14
 )
 
 type CheckID string
@@ -65,6 +73,77 @@ type DeregisterPartitionRequest struct {
 	Partition Partition
 }
 
+// SetPartitionReadOnlyRequest puts a partition into read-only mode, or takes it
+// out of it. It only changes the partition's ReadOnly, so it doesn't undo a
+// leader change applied since the partition was read.
+type SetPartitionReadOnlyRequest struct {
+	Topic     string
+	Partition int32
+	ReadOnly  bool
+}
+
+// SetTopicConfigRequest replaces a topic's config. It only changes the topic's
+// config, so it doesn't undo a partition change applied since the topic was
+// read.
+type SetTopicConfigRequest struct {
+	Topic  string
+	Config TopicConfig
+}
+
+// InitProducerRequest gets a producer ID and epoch for a producer. Applying it
+// returns an *InitProducerResponse.
+type InitProducerRequest struct {
+	// TransactionalID identifies the producer across sessions, if it's empty
+	// the producer gets a new producer ID that isn't stored.
+	TransactionalID    string
+	TransactionTimeout time.Duration
+}
+
+// InitProducerResponse is the new session of the producer and the partitions
+// of the transaction its previous session left ongoing, which need aborting,
+// or committing if the previous session was partway through committing it.
+type InitProducerResponse struct {
+	Producer  Producer
+	Aborted   map[string][]int32
+	Committed map[string][]int32
+}
+
+type RegisterProducerRequest struct {
+	Producer Producer
+}
+
+// RegisterDelegationTokenRequest creates or updates a delegation token.
+type RegisterDelegationTokenRequest struct {
+	Token DelegationToken
+}
+
+// DeregisterDelegationTokenRequest deletes a delegation token, once it's
+// expired.
+type DeregisterDelegationTokenRequest struct {
+	TokenID string
+}
+
+// BatchRequest is used to apply multiple requests with a single raft log entry.
+type BatchRequest struct {
+	// Requests are the encoded requests, each prefixed with its message type.
+	Requests [][]byte
+}
+
+// Add encodes the given message and appends it to the batch.
+func (r *BatchRequest) Add(t MessageType, msg interface{}) error {
+	buf, err := Encode(t, msg)
+	if err != nil {
+		return err
+	}
+	r.Requests = append(r.Requests, buf)
+	return nil
+}
+
+// Len returns the number of requests in the batch.
+func (r *BatchRequest) Len() int {
+	return len(r.Requests)
+}
+
 // msgpackHandle is a shared handle for encoding/decoding of structs
 var msgpackHandle = &codec.MsgpackHandle{}
 
@@ -93,6 +172,9 @@ type Node struct {
 	Address string
 	Check   *HealthCheck
 	Meta    map[string]string
+	// Maintenance is set while the broker's in maintenance mode: it leads no
+	// partitions, isn't assigned new replicas, and doesn't compact its logs.
+	Maintenance bool
 	RaftIndex
 }
 
@@ -118,7 +200,9 @@ type HealthCheck struct {
 
 // Topic
 type Topic struct {
-	// ID is ID or name of the topic
+	// ID is the topic's UUID. It's assigned when the topic is created and never
+	// changes, so a topic that's deleted and recreated with the same name gets
+	// a new ID.
 	ID string
 	// Topic is the name of the topic
 	Topic string
@@ -149,15 +233,57 @@ type Partition struct {
 	// the leader and ISR info. TODO: this will probably have to change to fit better.
 	ControllerEpoch int32
 	LeaderEpoch     int32
+	// ReadOnly is set while produces to the partition are rejected, e.g.
+	// during a reassignment cutover. Fetches are still served. It's only
+	// changed by a SetPartitionReadOnlyRequest, registering the partition
+	// keeps it.
+	ReadOnly bool
+
+	RaftIndex
+}
+
+// Producer is the session of a transactional producer.
+type Producer struct {
+	TransactionalID string
+	ProducerID      int64
+	// ProducerEpoch is bumped each time the producer's initialized so older
+	// instances of the producer are fenced.
+	ProducerEpoch      int16
+	TransactionTimeout time.Duration
+	// Partitions are the partitions written to by the producer's ongoing
+	// transaction by topic.
+	Partitions map[string][]int32
+	// Offsets are the consumer groups' offsets committed with the ongoing
+	// transaction, committed to their groups when it is.
+	Offsets []GroupOffset
+	// Committing is set once the transaction's committed and until its
+	// offsets are written to the offsets topic and its commit markers to its
+	// partitions.
+	Committing bool
+	// Aborting is set when the producer's initialized again with a
+	// transaction ongoing and until its abort markers are written to its
+	// partitions.
+	Aborting bool
 
 	RaftIndex
 }
 
 // Member
 type Member struct {
-	ID         string
+	ID string
+	// Metadata is the member's metadata for the group's selected protocol.
 	Metadata   []byte
 	Assignment []byte
+	// Protocols are the protocols the member supports, in the order it
+	// prefers them.
+	Protocols []MemberProtocol
+}
+
+// MemberProtocol is a protocol a group member supports and its metadata for
+// it, e.g. the range assignor and the topics it subscribes to.
+type MemberProtocol struct {
+	Name     string
+	Metadata []byte
 }
 
 type GroupState int32
@@ -179,6 +305,38 @@ type Group struct {
 	Members      map[string]Member
 	State        GroupState
 	GenerationID int32
+	// ProtocolType is the kind of group, e.g. consumer or connect, which all
+	// of its members have to join with. It's reset when the group's empty.
+	ProtocolType string
+	// Protocol is the protocol selected for the group from those all of its
+	// members support.
+	Protocol string
 
 	RaftIndex
 }
+
+// DelegationToken is a token clients authenticate as its owner with. The
+// token's HMAC isn't stored, it's derived from the token ID with the brokers'
+// shared secret. The timestamps are in ms since the epoch.
+type DelegationToken struct {
+	TokenID         string
+	Owner           string
+	Renewers        []string
+	IssueTimestamp  int64
+	ExpiryTimestamp int64
+	MaxTimestamp    int64
+	// Salt is the salt of the token's SCRAM credentials.
+	Salt []byte
+
+	RaftIndex
+}
+
+// GroupOffset is the offset a consumer group committed for a partition, the
+// offset of the next record it'll consume.
+type GroupOffset struct {
+	Group     string
+	Topic     string
+	Partition int32
+	Offset    int64
+	Metadata  string
+}
@@ -1,5 +1,11 @@
 package structs
 
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
 type TopicConfig map[string]TopicConfigEntry
 
 func NewTopicConfig() TopicConfig {
@@ -7,8 +13,9 @@ func NewTopicConfig() TopicConfig {
 
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
-			Name:    "cleanup.policy",
-			Default: "delete",
+			Name:        "cleanup.policy",
+			Default:     "delete",
+			ValidValues: []interface{}{"delete", "compact", "compact,delete", "delete,compact"},
 		},
 		ServerDefault: "log.cleanup.policy",
 	})
@@ -29,6 +36,20 @@ func NewTopicConfig() TopicConfig {
 		ServerDefault: "log.cleaner.delete.retention.ms",
 	})
 
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "delivery.delay.ms",
+			Default: 0,
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "delivery.scheduled.enable",
+			Default: false,
+		},
+	})
+
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
 			Name:    "file.delete.delay.ms",
@@ -75,6 +96,14 @@ func NewTopicConfig() TopicConfig {
 		ServerDefault: "leader.replication.throttled.replicas",
 	})
 
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "max.compaction.lag.ms",
+			Default: int64(math.MaxInt64),
+		},
+		ServerDefault: "log.cleaner.max.compaction.lag.ms",
+	})
+
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
 			Name:    "max.message.bytes",
@@ -83,6 +112,14 @@ func NewTopicConfig() TopicConfig {
 		ServerDefault: "message.max.bytes",
 	})
 
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "message.downconversion.enable",
+			Default: true,
+		},
+		ServerDefault: "log.message.downconversion.enable",
+	})
+
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
 			Name:    "message.format.version",
@@ -130,6 +167,35 @@ func NewTopicConfig() TopicConfig {
 		ServerDefault: "min.insync.replicas",
 	})
 
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "mirror.checkpoint.interval.ms",
+			Default: 60000,
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "mirror.source.brokers",
+			Default: "",
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "mirror.source.topic",
+			Default: "",
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:        "nack.policy",
+			Default:     "none",
+			ValidValues: []interface{}{"none", "retry", "dlq"},
+		},
+	})
+
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
 			Name:    "preallocate",
@@ -138,6 +204,34 @@ func NewTopicConfig() TopicConfig {
 		ServerDefault: "log.preallocate",
 	})
 
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "produce.byte.rate",
+			Default: 0,
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "produce.burst.buffer.bytes",
+			Default: 0,
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "produce.burst.drain.byte.rate",
+			Default: 0,
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "record.validators",
+			Default: "",
+		},
+	})
+
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
 			Name:    "retention.bytes",
@@ -154,6 +248,20 @@ func NewTopicConfig() TopicConfig {
 		ServerDefault: "log.retention.ms",
 	})
 
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "retry.backoff.ms",
+			Default: 0,
+		},
+	})
+
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "retry.max.attempts",
+			Default: 3,
+		},
+	})
+
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
 			Name:    "segment.bytes",
@@ -178,6 +286,13 @@ func NewTopicConfig() TopicConfig {
 		ServerDefault: "log.roll.jitter.ms",
 	})
 
+	cfg.Set(TopicConfigEntry{
+		ConfigEntry: ConfigEntry{
+			Name:    "segment.manifest.enable",
+			Default: false,
+		},
+	})
+
 	cfg.Set(TopicConfigEntry{
 		ConfigEntry: ConfigEntry{
 			Name:    "segment.ms",
@@ -197,6 +312,15 @@ func NewTopicConfig() TopicConfig {
 	return cfg
 }
 
+// Clone returns a copy of the config that can be changed without changing it.
+func (c TopicConfig) Clone() TopicConfig {
+	clone := make(TopicConfig, len(c))
+	for name, e := range c {
+		clone[name] = e
+	}
+	return clone
+}
+
 func (c TopicConfig) Set(e TopicConfigEntry) {
 	c[e.Name] = e
 }
@@ -226,6 +350,119 @@ func (c TopicConfig) SetValue(name string, value interface{}) TopicConfig {
 	return c
 }
 
+// SetString parses the value as the type of the entry's default and sets it.
+// It errors if the config doesn't exist or the value doesn't parse.
+func (c TopicConfig) SetString(name, value string) error {
+	e, ok := c[name]
+	if !ok {
+		return fmt.Errorf("unknown config: %s", name)
+	}
+	var v interface{}
+	var err error
+	switch e.Default.(type) {
+	case int:
+		v, err = strconv.Atoi(value)
+	case int64:
+		v, err = strconv.ParseInt(value, 10, 64)
+	case bool:
+		v, err = strconv.ParseBool(value)
+	case float64:
+		v, err = strconv.ParseFloat(value, 64)
+	default:
+		v = value
+	}
+	if err == nil && len(e.ValidValues) > 0 {
+		err = fmt.Errorf("not a valid value")
+		for _, valid := range e.ValidValues {
+			if valid == v {
+				err = nil
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for config %s: %s", name, value)
+	}
+	e.Value = v
+	c[name] = e
+	return nil
+}
+
+// GetInt64 returns the config's value as an int64. Values decoded from the raft
+// log may not have the same type they were set with, so this handles any
+// numeric or string value.
+func (c TopicConfig) GetInt64(name string) int64 {
+	switch v := c.GetValue(name).(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	case []byte:
+		i, _ := strconv.ParseInt(string(v), 10, 64)
+		return i
+	}
+	return 0
+}
+
+// GetFloat64 returns the config's value as a float64.
+func (c TopicConfig) GetFloat64(name string) float64 {
+	switch v := c.GetValue(name).(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	case []byte:
+		f, _ := strconv.ParseFloat(string(v), 64)
+		return f
+	}
+	return 0
+}
+
+// GetString returns the config's value as a string.
+func (c TopicConfig) GetString(name string) string {
+	switch v := c.GetValue(name).(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// GetBool returns the config's value as a bool.
+func (c TopicConfig) GetBool(name string) bool {
+	switch v := c.GetValue(name).(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	case []byte:
+		b, _ := strconv.ParseBool(string(v))
+		return b
+	}
+	return false
+}
+
 type ConfigEntry struct {
 	Default     interface{}
 	Name        string
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/testutil/retry"
-	"github.com/hashicorp/raft"
 	"github.com/mitchellh/go-testing-interface"
 	dynaport "github.com/travisjeffery/go-dynaport"
 	"github.com/travisjeffery/jocko/jocko/config"
@@ -63,6 +62,7 @@ func NewTestServer(t testing.T, cbBroker func(cfg *config.Config), cbServer func
 	config.SerfLANConfig.MemberlistConfig.BindPort = ports[2]
 	config.LeaveDrainTime = 1 * time.Millisecond
 	config.ReconcileInterval = 300 * time.Millisecond
+	config.GroupInitialRebalanceDelay = 0
 
 	// Tighten the Serf timing
 	config.SerfLANConfig.MemberlistConfig.BindAddr = "127.0.0.1"
@@ -113,7 +113,7 @@ func WaitForLeader(t testing.T, servers ...*Server) (*Server, []*Server) {
 	}{nil, make(map[*Server]bool)}
 	retry.Run(t, func(r *retry.R) {
 		for _, s := range servers {
-			if raft.Leader == s.handler.(*Broker).raft.State() {
+			if s.handler.(*Broker).isController() {
 				tmp.leader = s
 			} else {
 				tmp.followers[s] = true
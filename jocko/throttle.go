@@ -0,0 +1,76 @@
+package jocko
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// produceThrottles limits the rate bytes are produced to each topic with the
+// topic's produce.byte.rate config. Each topic gets a token bucket holding up
+// to a second's worth of bytes. Produces are never rejected; a produce that
+// overdraws the bucket gets a throttle time for how long until the debt's
+// paid off, and its response is held for it so producers are slowed down
+// whether or not they wait it out themselves.
+type produceThrottles struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newProduceThrottles() *produceThrottles {
+	return &produceThrottles{buckets: make(map[string]*tokenBucket)}
+}
+
+// record takes n bytes produced to the topic at the given time from its
+// bucket and returns how long the producer should be throttled for. A rate of
+// zero or less means the topic isn't limited.
+func (t *produceThrottles) record(topic string, rate int64, n int, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rate <= 0 {
+		delete(t.buckets, topic)
+		return 0
+	}
+	b, ok := t.buckets[topic]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rate), last: now}
+		t.buckets[topic] = b
+	}
+	b.rate = float64(rate)
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// holdThrottled holds a produce's response for its throttle time. It's held
+// no longer than the request's timeout, so the producer doesn't time the
+// request out and retry it, and not at all once the request's canceled or the
+// broker's shutting down.
+func (b *Broker) holdThrottled(ctx context.Context, throttle, timeout time.Duration) {
+	if timeout > 0 && throttle > timeout {
+		throttle = timeout
+	}
+	if throttle <= 0 {
+		return
+	}
+	t := time.NewTimer(throttle)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	case <-b.shutdownCh:
+	}
+}
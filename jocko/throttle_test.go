@@ -0,0 +1,41 @@
+package jocko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProduceThrottles(t *testing.T) {
+	throttles := newProduceThrottles()
+	now := time.Now()
+
+	require.Equal(t, time.Duration(0), throttles.record("unlimited", 0, 1<<30, now))
+
+	// the first second's worth of bytes is free
+	require.Equal(t, time.Duration(0), throttles.record("test", 100, 100, now))
+	// then the producer's throttled until the overdraw's paid back
+	require.Equal(t, 500*time.Millisecond, throttles.record("test", 100, 50, now))
+	require.Equal(t, time.Duration(0), throttles.record("test", 100, 10, now.Add(time.Second)))
+}
+
+func TestHoldThrottled(t *testing.T) {
+	b := &Broker{shutdownCh: make(chan struct{})}
+	held := func(ctx context.Context, throttle, timeout time.Duration) time.Duration {
+		start := time.Now()
+		b.holdThrottled(ctx, throttle, timeout)
+		return time.Since(start)
+	}
+
+	require.True(t, held(context.Background(), 50*time.Millisecond, time.Second) >= 50*time.Millisecond)
+	// the response isn't held past the request's timeout
+	require.True(t, held(context.Background(), time.Minute, 50*time.Millisecond) < time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.True(t, held(ctx, time.Minute, 0) < time.Second)
+	close(b.shutdownCh)
+	require.True(t, held(context.Background(), time.Minute, 0) < time.Second)
+}
@@ -0,0 +1,41 @@
+package jocko
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// validateTimestamps returns an error for the first message set with a message
+// whose create time is further than the topic's
+// message.timestamp.difference.max.ms from now, so a producer with a broken
+// clock can't push the partition's max timestamp far into the future, where
+// it'd hide later records from ListOffsets by time and hold back time based
+// retention. Topics whose timestamps are the log append time aren't checked.
+func validateTimestamps(config structs.TopicConfig, recordSet []byte, now time.Time) *protocol.RecordError {
+	if config.GetString("message.timestamp.type") != "CreateTime" {
+		return nil
+	}
+	maxDiff := config.GetInt64("message.timestamp.difference.max.ms")
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	for i, ms := range commitlog.MessageSets(recordSet) {
+		for _, m := range ms.Messages() {
+			// messages without timestamps are left alone
+			if m.MagicByte() == 0 || m.Timestamp() < 0 {
+				continue
+			}
+			diff := m.Timestamp() - nowMs
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff > maxDiff {
+				msg := fmt.Sprintf("timestamp %d is more than %dms from the broker's time %d", m.Timestamp(), maxDiff, nowMs)
+				return &protocol.RecordError{BatchIndex: int32(i), BatchIndexErrorMessage: &msg}
+			}
+		}
+	}
+	return nil
+}
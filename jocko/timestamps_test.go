@@ -0,0 +1,37 @@
+package jocko
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/structs"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestValidateTimestamps(t *testing.T) {
+	now := time.Now()
+	recordSet := func(ts ...time.Time) []byte {
+		var b []byte
+		for i, t := range ts {
+			msg, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: t, Value: []byte("v")})
+			if err != nil {
+				panic(err)
+			}
+			b = append(b, commitlog.NewMessageSet(uint64(i), msg)...)
+		}
+		return b
+	}
+	config := structs.NewTopicConfig()
+	require.NoError(t, config.SetString("message.timestamp.difference.max.ms", "60000"))
+
+	require.Nil(t, validateTimestamps(config, recordSet(now, now.Add(-time.Minute), now.Add(time.Minute)), now))
+	err := validateTimestamps(config, recordSet(now, now.Add(time.Hour)), now)
+	require.NotNil(t, err)
+	require.Equal(t, int32(1), err.BatchIndex)
+	require.NotNil(t, validateTimestamps(config, recordSet(now.Add(-time.Hour)), now))
+
+	require.NoError(t, config.SetString("message.timestamp.type", "LogAppendTime"))
+	require.Nil(t, validateTimestamps(config, recordSet(now.Add(time.Hour)), now))
+}
@@ -0,0 +1,187 @@
+package jocko
+
+import (
+	"sort"
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// TopicDescription describes a topic's partitions: their sizes, estimated
+// message counts, and last writes, and how evenly they and their leaders are
+// spread.
+type TopicDescription struct {
+	Topic      string
+	Partitions []*PartitionDescription
+	// Size and Messages are the totals of the partitions'.
+	Size     int64
+	Messages int64
+	// Leaders is how many of the partitions each broker with replicas of the
+	// topic leads.
+	Leaders map[int32]int
+	// LeaderSkew is the most partitions a broker leads over an even share of
+	// the partitions between the brokers, e.g. 1 if they're spread evenly and
+	// 2 if a broker leads twice its share.
+	LeaderSkew float64
+}
+
+// PartitionDescription describes a partition's log on its leader.
+type PartitionDescription struct {
+	Partition int32
+	Leader    int32
+	Replicas  []int32
+	ISR       []int32
+	// Size is the bytes of the leader's log on disk.
+	Size int64
+	// Messages is estimated from the log's offsets, so it's the message
+	// sets in the log, less any compacted away.
+	Messages int64
+	// LastWrite is the greatest timestamp of the log's messages, zero if it
+	// isn't known.
+	LastWrite time.Time
+	// SizeSkew is the partition's size over the average of the topic's
+	// partitions, e.g. 2 if it's twice the size of the average.
+	SizeSkew float64
+	// Stale is whether the leader's log stats weren't available, e.g.
+	// because the leader's down.
+	Stale bool
+}
+
+// DescribeTopic describes the topic's partitions from the log stats of the
+// brokers, found through the broker at addr.
+func DescribeTopic(dialer *Dialer, addr, topic string) (*TopicDescription, error) {
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	md, err := conn.Metadata(&protocol.MetadataRequest{Topics: []string{topic}})
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, tm := range md.TopicMetadata {
+		if tm.TopicErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[tm.TopicErrorCode]
+		}
+	}
+	var stats []*protocol.DescribeLogStatsResponse
+	for _, broker := range md.Brokers {
+		conn, err := dialer.Dial("tcp", broker.Addr())
+		if err != nil {
+			// described without the broker's logs
+			continue
+		}
+		res, err := conn.DescribeLogStats(&protocol.DescribeLogStatsRequest{Topics: []string{topic}})
+		conn.Close()
+		if err != nil || res.ErrorCode != protocol.ErrNone.Code() {
+			continue
+		}
+		stats = append(stats, res)
+	}
+	return describeTopic(md, stats, topic), nil
+}
+
+func describeTopic(md *protocol.MetadataResponse, stats []*protocol.DescribeLogStatsResponse, topic string) *TopicDescription {
+	logs := make(map[int32]map[int32]*protocol.PartitionLogStats)
+	for _, res := range stats {
+		for _, p := range res.Partitions {
+			if p.Topic != topic {
+				continue
+			}
+			if logs[p.Partition] == nil {
+				logs[p.Partition] = make(map[int32]*protocol.PartitionLogStats)
+			}
+			logs[p.Partition][res.BrokerID] = p
+		}
+	}
+	d := &TopicDescription{Topic: topic, Leaders: make(map[int32]int)}
+	for _, tm := range md.TopicMetadata {
+		if tm.Topic != topic {
+			continue
+		}
+		for _, pm := range tm.PartitionMetadata {
+			pd := &PartitionDescription{
+				Partition: pm.PartitionID,
+				Leader:    pm.Leader,
+				Replicas:  pm.Replicas,
+				ISR:       pm.ISR,
+			}
+			if l, ok := logs[pm.PartitionID][pm.Leader]; ok {
+				pd.Size = l.Size
+				pd.Messages = l.LogEndOffset - l.LogStartOffset
+				if l.LastWrite >= 0 {
+					pd.LastWrite = time.Unix(0, l.LastWrite*int64(time.Millisecond))
+				}
+			} else {
+				pd.Stale = true
+			}
+			d.Size += pd.Size
+			d.Messages += pd.Messages
+			for _, id := range pm.Replicas {
+				if _, ok := d.Leaders[id]; !ok {
+					d.Leaders[id] = 0
+				}
+			}
+			if pm.Leader >= 0 {
+				d.Leaders[pm.Leader]++
+			}
+			d.Partitions = append(d.Partitions, pd)
+		}
+	}
+	sort.Slice(d.Partitions, func(i, j int) bool { return d.Partitions[i].Partition < d.Partitions[j].Partition })
+	if n := len(d.Partitions); n > 0 {
+		avg := float64(d.Size) / float64(n)
+		for _, pd := range d.Partitions {
+			if avg > 0 {
+				pd.SizeSkew = float64(pd.Size) / avg
+			}
+		}
+		var most int
+		for _, led := range d.Leaders {
+			if led > most {
+				most = led
+			}
+		}
+		if len(d.Leaders) > 0 {
+			d.LeaderSkew = float64(most) / (float64(n) / float64(len(d.Leaders)))
+		}
+	}
+	return d
+}
+
+func (b *Broker) handleDescribeLogStats(ctx *Context, req *protocol.DescribeLogStatsRequest) *protocol.DescribeLogStatsResponse {
+	sp := span(ctx, b.tracer, "describe log stats")
+	defer sp.Finish()
+	res := &protocol.DescribeLogStatsResponse{BrokerID: b.config.ID}
+	res.APIVersion = req.Version()
+	for _, r := range b.replicaLookup.Replicas() {
+		if r.Log == nil || (len(req.Topics) > 0 && !containsString(req.Topics, r.Partition.Topic)) {
+			continue
+		}
+		// like metadata, clients only see the topics they can describe
+		if !b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, r.Partition.Topic) {
+			continue
+		}
+		stats := &protocol.PartitionLogStats{
+			Topic:          r.Partition.Topic,
+			Partition:      r.Partition.ID,
+			LogStartOffset: r.Log.OldestOffset(),
+			LogEndOffset:   r.Log.NewestOffset(),
+			LastWrite:      -1,
+		}
+		if l, ok := r.Log.(interface {
+			Segments() []*commitlog.Segment
+		}); ok {
+			for _, s := range l.Segments() {
+				stats.Size += s.Position
+				if ts := s.MaxTimestamp(); ts > stats.LastWrite {
+					stats.LastWrite = ts
+				}
+			}
+		}
+		res.Partitions = append(res.Partitions, stats)
+	}
+	return res
+}
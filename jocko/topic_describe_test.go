@@ -0,0 +1,45 @@
+package jocko
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestDescribeTopic(t *testing.T) {
+	req := require.New(t)
+	md := &protocol.MetadataResponse{
+		TopicMetadata: []*protocol.TopicMetadata{{
+			Topic: "test",
+			PartitionMetadata: []*protocol.PartitionMetadata{
+				{PartitionID: 1, Leader: 1, Replicas: []int32{1, 2}},
+				{PartitionID: 0, Leader: 1, Replicas: []int32{1, 2}},
+				{PartitionID: 2, Leader: 3, Replicas: []int32{3, 1}},
+			},
+		}},
+	}
+	stats := []*protocol.DescribeLogStatsResponse{{
+		BrokerID: 1,
+		Partitions: []*protocol.PartitionLogStats{
+			{Topic: "test", Partition: 0, Size: 100, LogStartOffset: 0, LogEndOffset: 10, LastWrite: 1500000000000},
+			{Topic: "test", Partition: 1, Size: 500, LogStartOffset: 5, LogEndOffset: 55, LastWrite: -1},
+			// a follower's log isn't counted
+			{Topic: "test", Partition: 2, Size: 1000, LogStartOffset: 0, LogEndOffset: 100},
+			{Topic: "other", Partition: 0, Size: 1000},
+		},
+	}}
+	d := describeTopic(md, stats, "test")
+	req.Equal("test", d.Topic)
+	req.Len(d.Partitions, 3)
+	req.Equal(int32(0), d.Partitions[0].Partition)
+	req.Equal(int64(600), d.Size)
+	req.Equal(int64(60), d.Messages)
+	req.Equal(int64(1500000000000), d.Partitions[0].LastWrite.UnixNano()/1e6)
+	req.True(d.Partitions[1].LastWrite.IsZero())
+	req.Equal(2.5, d.Partitions[1].SizeSkew)
+	// broker 3's down
+	req.True(d.Partitions[2].Stale)
+	req.Equal(map[int32]int{1: 2, 2: 0, 3: 1}, d.Leaders)
+	req.Equal(2.0, d.LeaderSkew)
+}
@@ -0,0 +1,332 @@
+package jocko
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/jocko/policy"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// trafficSamples is how many samples, each trafficSampleDuration long, a
+	// traffic window is made of. The window rolls forward a sample at a time.
+	trafficSamples        = 6
+	trafficSampleDuration = 10 * time.Second
+	trafficWindow         = trafficSamples * trafficSampleDuration
+	// trafficIdleTimeout is how long a topic or client can go without
+	// traffic before it's forgotten, so client IDs don't pile up.
+	trafficIdleTimeout = time.Hour
+)
+
+// trafficStats counts the bytes produced to and fetched from the broker by
+// topic, by partition, and by client ID, for chargeback, tuning quotas, and
+// finding hot partitions. Counts are kept since the broker started and over a
+// rolling window.
+type trafficStats struct {
+	mu         sync.Mutex
+	topics     map[string]*trafficCounts
+	clients    map[string]*trafficCounts
+	partitions map[trafficPartition]*trafficCounts
+	pruned     time.Time
+	metrics    *Metrics
+}
+
+type trafficPartition struct {
+	topic     string
+	partition int32
+}
+
+type trafficCounts struct {
+	in, out int64
+	samples [trafficSamples]trafficSample
+	last    time.Time
+}
+
+type trafficSample struct {
+	start   time.Time
+	in, out int64
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{
+		topics:     make(map[string]*trafficCounts),
+		clients:    make(map[string]*trafficCounts),
+		partitions: make(map[trafficPartition]*trafficCounts),
+	}
+}
+
+// record counts the bytes produced to, in, and fetched from, out, the topic's
+// partition by the client at the given time.
+func (t *trafficStats) record(topic string, partition int32, clientID string, in, out int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range []struct {
+		counts map[string]*trafficCounts
+		name   string
+	}{{t.topics, topic}, {t.clients, clientID}} {
+		counts, ok := c.counts[c.name]
+		if !ok {
+			counts = new(trafficCounts)
+			c.counts[c.name] = counts
+		}
+		counts.add(in, out, now)
+	}
+	tp := trafficPartition{topic, partition}
+	counts, ok := t.partitions[tp]
+	if !ok {
+		counts = new(trafficCounts)
+		t.partitions[tp] = counts
+	}
+	counts.add(in, out, now)
+	if now.Sub(t.pruned) > trafficIdleTimeout {
+		t.prune(now)
+	}
+	if t.metrics != nil {
+		p := strconv.Itoa(int(partition))
+		if in > 0 {
+			t.metrics.add(t.metrics.BytesIn, "bytes_in", float64(in), "topic", topic, "client_id", clientID)
+			t.metrics.add(t.metrics.PartitionBytesIn, "partition_bytes_in", float64(in), "topic", topic, "partition", p)
+		}
+		if out > 0 {
+			t.metrics.add(t.metrics.BytesOut, "bytes_out", float64(out), "topic", topic, "client_id", clientID)
+			t.metrics.add(t.metrics.PartitionBytesOut, "partition_bytes_out", float64(out), "topic", topic, "partition", p)
+		}
+	}
+}
+
+func (t *trafficStats) prune(now time.Time) {
+	t.pruned = now
+	for _, counts := range []map[string]*trafficCounts{t.topics, t.clients} {
+		for name, c := range counts {
+			if now.Sub(c.last) > trafficIdleTimeout {
+				delete(counts, name)
+			}
+		}
+	}
+	for tp, c := range t.partitions {
+		if now.Sub(c.last) > trafficIdleTimeout {
+			delete(t.partitions, tp)
+		}
+	}
+}
+
+// describe returns the topics' and clients' counts at the given time, sorted by
+// name.
+func (t *trafficStats) describe(now time.Time) (topics, clients []*protocol.TrafficStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return describeTraffic(t.topics, now), describeTraffic(t.clients, now)
+}
+
+// describePartitions returns the partitions' counts at the given time, sorted
+// by topic and partition.
+func (t *trafficStats) describePartitions(now time.Time) []*protocol.PartitionTrafficStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]*protocol.PartitionTrafficStats, 0, len(t.partitions))
+	for tp, c := range t.partitions {
+		in, out := c.window(now)
+		stats = append(stats, &protocol.PartitionTrafficStats{
+			Topic:          tp.topic,
+			Partition:      tp.partition,
+			BytesIn:        c.in,
+			BytesOut:       c.out,
+			WindowBytesIn:  in,
+			WindowBytesOut: out,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Topic != stats[j].Topic {
+			return stats[i].Topic < stats[j].Topic
+		}
+		return stats[i].Partition < stats[j].Partition
+	})
+	return stats
+}
+
+func describeTraffic(counts map[string]*trafficCounts, now time.Time) []*protocol.TrafficStats {
+	stats := make([]*protocol.TrafficStats, 0, len(counts))
+	for name, c := range counts {
+		in, out := c.window(now)
+		stats = append(stats, &protocol.TrafficStats{
+			Name:           name,
+			BytesIn:        c.in,
+			BytesOut:       c.out,
+			WindowBytesIn:  in,
+			WindowBytesOut: out,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func (c *trafficCounts) add(in, out int64, now time.Time) {
+	c.in += in
+	c.out += out
+	c.last = now
+	start := now.Truncate(trafficSampleDuration)
+	s := &c.samples[(start.UnixNano()/int64(trafficSampleDuration))%trafficSamples]
+	if !s.start.Equal(start) {
+		*s = trafficSample{start: start}
+	}
+	s.in += in
+	s.out += out
+}
+
+// window returns the bytes counted in the samples still in the window.
+func (c *trafficCounts) window(now time.Time) (in, out int64) {
+	oldest := now.Truncate(trafficSampleDuration).Add(-(trafficSamples - 1) * trafficSampleDuration)
+	for _, s := range c.samples {
+		if !s.start.Before(oldest) && !s.start.After(now) {
+			in += s.in
+			out += s.out
+		}
+	}
+	return in, out
+}
+
+// useMetrics has the broker count its traffic, its requests to other brokers,
+// its sampled records, and the corruption its fetches find with the metrics
+// too.
+func (b *Broker) useMetrics(m *Metrics) {
+	b.traffic.mu.Lock()
+	b.traffic.metrics = m
+	b.traffic.mu.Unlock()
+	b.peers.mu.Lock()
+	b.peers.metrics = m
+	b.peers.mu.Unlock()
+	b.sampler.mu.Lock()
+	b.sampler.metrics = m
+	b.sampler.mu.Unlock()
+	b.verifier.mu.Lock()
+	b.verifier.metrics = m
+	b.verifier.mu.Unlock()
+}
+
+func (b *Broker) handleDescribeTraffic(ctx *Context, req *protocol.DescribeTrafficRequest) *protocol.DescribeTrafficResponse {
+	sp := span(ctx, b.tracer, "describe traffic")
+	defer sp.Finish()
+	res := &protocol.DescribeTrafficResponse{Window: trafficWindow}
+	res.APIVersion = req.Version()
+	now := time.Now()
+	topics, clients := b.traffic.describe(now)
+	for _, t := range topics {
+		if b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, t.Name) {
+			res.Topics = append(res.Topics, t)
+		}
+	}
+	// clients' traffic spans topics, so it's the cluster's to describe
+	if b.authorized(ctx, policy.DescribeOperation, policy.ClusterResource, "") {
+		res.Clients = clients
+	}
+	if res.APIVersion >= 1 {
+		for _, p := range b.traffic.describePartitions(now) {
+			if b.authorized(ctx, policy.DescribeOperation, policy.TopicResource, p.Topic) {
+				res.Partitions = append(res.Partitions, p)
+			}
+		}
+	}
+	return res
+}
+
+// HotPartition is a partition with more than its share of its topic's traffic,
+// e.g. because producers' keys are skewed.
+type HotPartition struct {
+	Topic     string
+	Partition int32
+	Leader    int32
+	// BytesInRate and BytesOutRate are the bytes per second produced to and
+	// fetched from the partition over the traffic window.
+	BytesInRate  float64
+	BytesOutRate float64
+	// Skew is the partition's share of its topic's traffic over an even
+	// share, e.g. 3 if it has three times as much as it would if the traffic
+	// were spread evenly over the topic's partitions.
+	Skew float64
+}
+
+// HotPartitions asks each of the cluster's brokers, found through the broker at
+// addr, for its partitions' traffic and returns the partitions with at least
+// minSkew times their share of their topic's, hottest first.
+func HotPartitions(dialer *Dialer, addr string, minSkew float64) ([]*HotPartition, error) {
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	md, err := conn.Metadata(&protocol.MetadataRequest{})
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	var traffic []*protocol.DescribeTrafficResponse
+	for _, broker := range md.Brokers {
+		conn, err := dialer.Dial("tcp", broker.Addr())
+		if err != nil {
+			return nil, err
+		}
+		res, err := conn.DescribeTraffic(&protocol.DescribeTrafficRequest{APIVersion: 1})
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		if res.ErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[res.ErrorCode]
+		}
+		traffic = append(traffic, res)
+	}
+	return hotPartitions(md, traffic, minSkew), nil
+}
+
+// hotPartitions sums the partitions' window traffic over the brokers, since a
+// partition's leader may have moved within the window, and compares each with
+// its topic's partitions' mean.
+func hotPartitions(md *protocol.MetadataResponse, traffic []*protocol.DescribeTrafficResponse, minSkew float64) []*HotPartition {
+	type counts struct{ in, out int64 }
+	byPartition := make(map[trafficPartition]*counts)
+	byTopic := make(map[string]int64)
+	window := trafficWindow
+	for _, res := range traffic {
+		window = res.Window
+		for _, p := range res.Partitions {
+			tp := trafficPartition{p.Topic, p.Partition}
+			c, ok := byPartition[tp]
+			if !ok {
+				c = new(counts)
+				byPartition[tp] = c
+			}
+			c.in += p.WindowBytesIn
+			c.out += p.WindowBytesOut
+			byTopic[p.Topic] += p.WindowBytesIn + p.WindowBytesOut
+		}
+	}
+	var hot []*HotPartition
+	for _, t := range md.TopicMetadata {
+		total := byTopic[t.Topic]
+		if len(t.PartitionMetadata) < 2 || total == 0 {
+			continue
+		}
+		for _, p := range t.PartitionMetadata {
+			c, ok := byPartition[trafficPartition{t.Topic, p.PartitionID}]
+			if !ok {
+				continue
+			}
+			skew := float64(c.in+c.out) * float64(len(t.PartitionMetadata)) / float64(total)
+			if skew < minSkew {
+				continue
+			}
+			hot = append(hot, &HotPartition{
+				Topic:        t.Topic,
+				Partition:    p.PartitionID,
+				Leader:       p.Leader,
+				BytesInRate:  float64(c.in) / window.Seconds(),
+				BytesOutRate: float64(c.out) / window.Seconds(),
+				Skew:         skew,
+			})
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool { return hot[i].Skew > hot[j].Skew })
+	return hot
+}
@@ -0,0 +1,91 @@
+package jocko
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestTrafficStats(t *testing.T) {
+	s := newTrafficStats()
+	now := time.Unix(1000, 0)
+	s.record("a", 0, "c1", 100, 0, now)
+	s.record("a", 1, "c2", 0, 40, now.Add(time.Second))
+	s.record("b", 0, "c1", 10, 0, now.Add(30*time.Second))
+
+	topics, clients := s.describe(now.Add(30 * time.Second))
+	require.Equal(t, []*protocol.TrafficStats{
+		{Name: "a", BytesIn: 100, BytesOut: 40, WindowBytesIn: 100, WindowBytesOut: 40},
+		{Name: "b", BytesIn: 10, WindowBytesIn: 10},
+	}, topics)
+	require.Equal(t, []*protocol.TrafficStats{
+		{Name: "c1", BytesIn: 110, WindowBytesIn: 110},
+		{Name: "c2", BytesOut: 40, WindowBytesOut: 40},
+	}, clients)
+
+	// the window rolls past the oldest samples but the totals are kept
+	topics, _ = s.describe(now.Add(trafficWindow))
+	require.Equal(t, &protocol.TrafficStats{Name: "a", BytesIn: 100, BytesOut: 40}, topics[0])
+	require.Equal(t, int64(10), topics[1].WindowBytesIn)
+
+	// idle topics and clients are forgotten
+	s.record("c", 0, "c3", 1, 0, now.Add(2*trafficIdleTimeout))
+	topics, clients = s.describe(now.Add(2 * trafficIdleTimeout))
+	require.Equal(t, 1, len(topics))
+	require.Equal(t, 1, len(clients))
+}
+
+func TestHotPartitions(t *testing.T) {
+	md := &protocol.MetadataResponse{TopicMetadata: []*protocol.TopicMetadata{
+		{Topic: "a", PartitionMetadata: []*protocol.PartitionMetadata{
+			{PartitionID: 0, Leader: 1}, {PartitionID: 1, Leader: 2}, {PartitionID: 2, Leader: 1}, {PartitionID: 3, Leader: 2},
+		}},
+		{Topic: "b", PartitionMetadata: []*protocol.PartitionMetadata{{PartitionID: 0, Leader: 1}}},
+	}}
+	traffic := []*protocol.DescribeTrafficResponse{
+		{Window: 10 * time.Second, Partitions: []*protocol.PartitionTrafficStats{
+			{Topic: "a", Partition: 0, WindowBytesIn: 700, WindowBytesOut: 100},
+			{Topic: "a", Partition: 2, WindowBytesIn: 100},
+			{Topic: "b", Partition: 0, WindowBytesIn: 1000},
+		}},
+		{Window: 10 * time.Second, Partitions: []*protocol.PartitionTrafficStats{
+			{Topic: "a", Partition: 1, WindowBytesIn: 100},
+		}},
+	}
+	// a-0 has 800 of the topic's 1000 bytes, 3.2 times its share; b has one
+	// partition so it can't be skewed
+	require.Equal(t, []*HotPartition{
+		{Topic: "a", Partition: 0, Leader: 1, BytesInRate: 70, BytesOutRate: 10, Skew: 3.2},
+	}, hotPartitions(md, traffic, 2))
+}
+
+type fakeReporter struct {
+	counters map[string]float64
+}
+
+func (r *fakeReporter) Counter(name string, delta float64, labels ...string) {
+	r.counters[name+fmt.Sprint(labels)] += delta
+}
+
+func (r *fakeReporter) Gauge(name string, value float64, labels ...string) {}
+
+func (r *fakeReporter) Histogram(name string, value float64, labels ...string) {}
+
+func TestTrafficStatsReporter(t *testing.T) {
+	r := &fakeReporter{counters: make(map[string]float64)}
+	s := newTrafficStats()
+	s.metrics = &Metrics{Reporter: r}
+	now := time.Unix(1000, 0)
+	s.record("a", 0, "c1", 100, 0, now)
+	s.record("a", 1, "c1", 10, 40, now)
+	require.Equal(t, map[string]float64{
+		"bytes_in[topic a client_id c1]":           110,
+		"bytes_out[topic a client_id c1]":          40,
+		"partition_bytes_in[topic a partition 0]":  100,
+		"partition_bytes_in[topic a partition 1]":  10,
+		"partition_bytes_out[topic a partition 1]": 40,
+	}, r.counters)
+}
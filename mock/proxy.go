@@ -27,9 +27,13 @@ func (p *Client) Fetch(fetchRequest *protocol.FetchRequest) (*protocol.FetchResp
 	if len(p.msgs) >= p.msgCount {
 		return &protocol.FetchResponse{}, nil
 	}
-	msgs := [][]byte{
-		[]byte("msg " + strconv.Itoa(len(p.msgs))),
-	}
+	// a message set of the message at the next offset
+	payload := []byte("msg " + strconv.Itoa(len(p.msgs)))
+	ms := make([]byte, 12+len(payload))
+	protocol.Encoding.PutUint64(ms[0:8], uint64(len(p.msgs)))
+	protocol.Encoding.PutUint32(ms[8:12], uint32(len(payload)))
+	copy(ms[12:], payload)
+	msgs := [][]byte{ms}
 	response := &protocol.FetchResponse{
 		Responses: protocol.FetchTopicResponses{{
 			Topic: fetchRequest.Topics[0].Topic,
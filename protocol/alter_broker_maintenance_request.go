@@ -0,0 +1,38 @@
+package protocol
+
+// AlterBrokerMaintenanceRequest is a Jocko extension for putting a broker into
+// or out of maintenance mode, e.g. for a kernel patching window. A broker in
+// maintenance stays in the cluster and keeps its replicas, but its partitions'
+// leadership is moved to other replicas, its logs aren't compacted, and it
+// isn't assigned new replicas or leaders. It's handled by the controller.
+type AlterBrokerMaintenanceRequest struct {
+	APIVersion int16
+
+	BrokerID    int32
+	Maintenance bool
+}
+
+func (r *AlterBrokerMaintenanceRequest) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(r.BrokerID)
+	e.PutBool(r.Maintenance)
+	return nil
+}
+
+func (r *AlterBrokerMaintenanceRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.BrokerID, err = d.Int32(); err != nil {
+		return err
+	}
+	if r.Maintenance, err = d.Bool(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *AlterBrokerMaintenanceRequest) Key() int16 {
+	return AlterBrokerMaintenanceKey
+}
+
+func (r *AlterBrokerMaintenanceRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,34 @@
+package protocol
+
+type AlterBrokerMaintenanceResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	// Moved is how many partitions' leadership is being moved off the broker.
+	Moved int32
+}
+
+func (r *AlterBrokerMaintenanceResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	e.PutInt32(r.Moved)
+	return nil
+}
+
+func (r *AlterBrokerMaintenanceResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	if r.Moved, err = d.Int32(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *AlterBrokerMaintenanceResponse) Key() int16 {
+	return AlterBrokerMaintenanceKey
+}
+
+func (r *AlterBrokerMaintenanceResponse) Version() int16 {
+	return r.APIVersion
+}
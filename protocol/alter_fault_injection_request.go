@@ -0,0 +1,79 @@
+package protocol
+
+import "time"
+
+// AlterFaultInjectionRequest is a Jocko extension for injecting latency and
+// errors into a broker's storage and network, so soak tests can check how the
+// cluster copes with a slow disk or network, e.g. that delayed requests time
+// out and ISRs shrink. It's only handled by brokers built with the faultinject
+// tag, others respond with ErrInvalidRequest.
+type AlterFaultInjectionRequest struct {
+	APIVersion int16
+
+	Faults []*FaultInjection
+}
+
+// FaultInjection is the fault to inject at a point: "segment write", "segment
+// sync", "segment read", "index write", "index sync", "network read", or
+// "network write". A fault without a delay or error removes the point's fault.
+type FaultInjection struct {
+	Point string
+	// Delay is how long each operation at the point waits before it runs.
+	Delay time.Duration
+	// Error fails the operations instead of running them.
+	Error bool
+	// Count is how many operations the fault's injected into before it's
+	// removed, or zero for until it's removed. Network faults ignore it.
+	Count int32
+}
+
+func (r *AlterFaultInjectionRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Faults)); err != nil {
+		return err
+	}
+	for _, f := range r.Faults {
+		if err = e.PutString(f.Point); err != nil {
+			return err
+		}
+		e.PutInt32(int32(f.Delay / time.Millisecond))
+		e.PutBool(f.Error)
+		e.PutInt32(f.Count)
+	}
+	return nil
+}
+
+func (r *AlterFaultInjectionRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	count, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Faults = make([]*FaultInjection, count)
+	for i := range r.Faults {
+		f := &FaultInjection{}
+		if f.Point, err = d.String(); err != nil {
+			return err
+		}
+		delay, err := d.Int32()
+		if err != nil {
+			return err
+		}
+		f.Delay = time.Duration(delay) * time.Millisecond
+		if f.Error, err = d.Bool(); err != nil {
+			return err
+		}
+		if f.Count, err = d.Int32(); err != nil {
+			return err
+		}
+		r.Faults[i] = f
+	}
+	return nil
+}
+
+func (r *AlterFaultInjectionRequest) Key() int16 {
+	return AlterFaultInjectionKey
+}
+
+func (r *AlterFaultInjectionRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,53 @@
+package protocol
+
+type AlterFaultInjectionResponse struct {
+	APIVersion int16
+
+	Faults []*AlterFaultInjectionResult
+}
+
+type AlterFaultInjectionResult struct {
+	Point     string
+	ErrorCode int16
+}
+
+func (r *AlterFaultInjectionResponse) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Faults)); err != nil {
+		return err
+	}
+	for _, f := range r.Faults {
+		if err = e.PutString(f.Point); err != nil {
+			return err
+		}
+		e.PutInt16(f.ErrorCode)
+	}
+	return nil
+}
+
+func (r *AlterFaultInjectionResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	count, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Faults = make([]*AlterFaultInjectionResult, count)
+	for i := range r.Faults {
+		f := &AlterFaultInjectionResult{}
+		if f.Point, err = d.String(); err != nil {
+			return err
+		}
+		if f.ErrorCode, err = d.Int16(); err != nil {
+			return err
+		}
+		r.Faults[i] = f
+	}
+	return nil
+}
+
+func (r *AlterFaultInjectionResponse) Key() int16 {
+	return AlterFaultInjectionKey
+}
+
+func (r *AlterFaultInjectionResponse) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,45 @@
+package protocol
+
+// AlterOffsetsTopicPartitionsRequest is a Jocko extension for growing the number
+// of partitions of the offsets topic, which groups are hashed to to find their
+// coordinator. Groups hashed to another partition afterwards are handed off to
+// its leader. It's handled by the controller.
+type AlterOffsetsTopicPartitionsRequest struct {
+	APIVersion int16
+
+	Partitions int32
+	// ValidateOnly returns the groups that would move without moving them.
+	ValidateOnly bool
+	// Force moves groups even if some are rebalancing, which fails their
+	// rebalances.
+	Force bool
+}
+
+func (r *AlterOffsetsTopicPartitionsRequest) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(r.Partitions)
+	e.PutBool(r.ValidateOnly)
+	e.PutBool(r.Force)
+	return nil
+}
+
+func (r *AlterOffsetsTopicPartitionsRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.Partitions, err = d.Int32(); err != nil {
+		return err
+	}
+	if r.ValidateOnly, err = d.Bool(); err != nil {
+		return err
+	}
+	if r.Force, err = d.Bool(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *AlterOffsetsTopicPartitionsRequest) Key() int16 {
+	return AlterOffsetsTopicPartitionsKey
+}
+
+func (r *AlterOffsetsTopicPartitionsRequest) Version() int16 {
+	return r.APIVersion
+}
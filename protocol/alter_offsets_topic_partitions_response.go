@@ -0,0 +1,75 @@
+package protocol
+
+type AlterOffsetsTopicPartitionsResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	Moves     []*GroupCoordinatorMove
+}
+
+// GroupCoordinatorMove is a group hashed to another offsets topic partition,
+// and so handed off to another coordinator, by the new partition count.
+type GroupCoordinatorMove struct {
+	GroupID         string
+	FromPartition   int32
+	ToPartition     int32
+	FromCoordinator int32
+	ToCoordinator   int32
+}
+
+func (r *AlterOffsetsTopicPartitionsResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	if err = e.PutArrayLength(len(r.Moves)); err != nil {
+		return err
+	}
+	for _, m := range r.Moves {
+		if err = e.PutString(m.GroupID); err != nil {
+			return err
+		}
+		e.PutInt32(m.FromPartition)
+		e.PutInt32(m.ToPartition)
+		e.PutInt32(m.FromCoordinator)
+		e.PutInt32(m.ToCoordinator)
+	}
+	return nil
+}
+
+func (r *AlterOffsetsTopicPartitionsResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	count, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Moves = make([]*GroupCoordinatorMove, count)
+	for i := range r.Moves {
+		m := &GroupCoordinatorMove{}
+		if m.GroupID, err = d.String(); err != nil {
+			return err
+		}
+		if m.FromPartition, err = d.Int32(); err != nil {
+			return err
+		}
+		if m.ToPartition, err = d.Int32(); err != nil {
+			return err
+		}
+		if m.FromCoordinator, err = d.Int32(); err != nil {
+			return err
+		}
+		if m.ToCoordinator, err = d.Int32(); err != nil {
+			return err
+		}
+		r.Moves[i] = m
+	}
+	return nil
+}
+
+func (r *AlterOffsetsTopicPartitionsResponse) Key() int16 {
+	return AlterOffsetsTopicPartitionsKey
+}
+
+func (r *AlterOffsetsTopicPartitionsResponse) Version() int16 {
+	return r.APIVersion
+}
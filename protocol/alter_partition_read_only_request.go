@@ -0,0 +1,63 @@
+package protocol
+
+// AlterPartitionReadOnlyRequest is a Jocko extension for putting partitions
+// into or out of read-only mode, e.g. while cutting over a reassignment or
+// recovering from a disaster. Produces to a read-only partition are rejected
+// with a retriable error while fetches are served as usual. It's handled by
+// the controller.
+type AlterPartitionReadOnlyRequest struct {
+	APIVersion int16
+
+	Partitions []*PartitionReadOnly
+}
+
+type PartitionReadOnly struct {
+	Topic     string
+	Partition int32
+	ReadOnly  bool
+}
+
+func (r *AlterPartitionReadOnlyRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Partitions)); err != nil {
+		return err
+	}
+	for _, p := range r.Partitions {
+		if err = e.PutString(p.Topic); err != nil {
+			return err
+		}
+		e.PutInt32(p.Partition)
+		e.PutBool(p.ReadOnly)
+	}
+	return nil
+}
+
+func (r *AlterPartitionReadOnlyRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	count, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Partitions = make([]*PartitionReadOnly, count)
+	for i := range r.Partitions {
+		p := &PartitionReadOnly{}
+		if p.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if p.Partition, err = d.Int32(); err != nil {
+			return err
+		}
+		if p.ReadOnly, err = d.Bool(); err != nil {
+			return err
+		}
+		r.Partitions[i] = p
+	}
+	return nil
+}
+
+func (r *AlterPartitionReadOnlyRequest) Key() int16 {
+	return AlterPartitionReadOnlyKey
+}
+
+func (r *AlterPartitionReadOnlyRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,58 @@
+package protocol
+
+type AlterPartitionReadOnlyResponse struct {
+	APIVersion int16
+
+	Partitions []*AlterPartitionReadOnlyResult
+}
+
+type AlterPartitionReadOnlyResult struct {
+	Topic     string
+	Partition int32
+	ErrorCode int16
+}
+
+func (r *AlterPartitionReadOnlyResponse) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Partitions)); err != nil {
+		return err
+	}
+	for _, p := range r.Partitions {
+		if err = e.PutString(p.Topic); err != nil {
+			return err
+		}
+		e.PutInt32(p.Partition)
+		e.PutInt16(p.ErrorCode)
+	}
+	return nil
+}
+
+func (r *AlterPartitionReadOnlyResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	count, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Partitions = make([]*AlterPartitionReadOnlyResult, count)
+	for i := range r.Partitions {
+		p := &AlterPartitionReadOnlyResult{}
+		if p.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if p.Partition, err = d.Int32(); err != nil {
+			return err
+		}
+		if p.ErrorCode, err = d.Int16(); err != nil {
+			return err
+		}
+		r.Partitions[i] = p
+	}
+	return nil
+}
+
+func (r *AlterPartitionReadOnlyResponse) Key() int16 {
+	return AlterPartitionReadOnlyKey
+}
+
+func (r *AlterPartitionReadOnlyResponse) Version() int16 {
+	return r.APIVersion
+}
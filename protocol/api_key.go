@@ -1,5 +1,10 @@
 package protocol
 
+import (
+	"strconv"
+	"strings"
+)
+
 // Protocol API keys. See: https://kafka.apache.org/protocol#protocol_api_keys
 const (
 	ProduceKey                 = 0
@@ -46,3 +51,100 @@ const (
 	DescribeDelegationTokenKey = 41
 	DeleteGroupsKey            = 42
 )
+
+// Jocko extension API keys. They're well outside the range Kafka uses so they
+// won't collide with APIs it adds.
+const (
+	NackKey                        = 1000
+	FilteredFetchKey               = 1001
+	ShareFetchKey                  = 1002
+	ShareAcknowledgeKey            = 1003
+	DescribeTrafficKey             = 1004
+	AlterPartitionReadOnlyKey      = 1005
+	AlterBrokerMaintenanceKey      = 1006
+	AlterFaultInjectionKey         = 1007
+	AlterOffsetsTopicPartitionsKey = 1008
+	DescribeClockKey               = 1009
+	DescribeLogStatsKey            = 1010
+	ReadIndexKey                   = 1011
+	TransactionalProduceKey        = 1012
+)
+
+// apiKeyNames are the APIs' names, Kafka's for its APIs.
+var apiKeyNames = map[int16]string{
+	ProduceKey:                     "Produce",
+	FetchKey:                       "Fetch",
+	OffsetsKey:                     "ListOffsets",
+	MetadataKey:                    "Metadata",
+	LeaderAndISRKey:                "LeaderAndIsr",
+	StopReplicaKey:                 "StopReplica",
+	UpdateMetadataKey:              "UpdateMetadata",
+	ControlledShutdownKey:          "ControlledShutdown",
+	OffsetCommitKey:                "OffsetCommit",
+	OffsetFetchKey:                 "OffsetFetch",
+	FindCoordinatorKey:             "FindCoordinator",
+	JoinGroupKey:                   "JoinGroup",
+	HeartbeatKey:                   "Heartbeat",
+	LeaveGroupKey:                  "LeaveGroup",
+	SyncGroupKey:                   "SyncGroup",
+	DescribeGroupsKey:              "DescribeGroups",
+	ListGroupsKey:                  "ListGroups",
+	SaslHandshakeKey:               "SaslHandshake",
+	APIVersionsKey:                 "ApiVersions",
+	CreateTopicsKey:                "CreateTopics",
+	DeleteTopicsKey:                "DeleteTopics",
+	DeleteRecordsKey:               "DeleteRecords",
+	InitProducerIDKey:              "InitProducerId",
+	OffsetForLeaderEpochKey:        "OffsetForLeaderEpoch",
+	AddPartitionsToTxnKey:          "AddPartitionsToTxn",
+	AddOffsetsToTxnKey:             "AddOffsetsToTxn",
+	EndTxnKey:                      "EndTxn",
+	WriteTxnMarkersKey:             "WriteTxnMarkers",
+	TxnOffsetCommitKey:             "TxnOffsetCommit",
+	DescribeAclsKey:                "DescribeAcls",
+	CreateAclsKey:                  "CreateAcls",
+	DeleteAclsKey:                  "DeleteAcls",
+	DescribeConfigsKey:             "DescribeConfigs",
+	AlterConfigsKey:                "AlterConfigs",
+	AlterReplicaLogDirsKey:         "AlterReplicaLogDirs",
+	DescribeLogDirsKey:             "DescribeLogDirs",
+	SaslAuthenticateKey:            "SaslAuthenticate",
+	CreatePartitionsKey:            "CreatePartitions",
+	CreateDelegationTokenKey:       "CreateDelegationToken",
+	RenewDelegationTokenKey:        "RenewDelegationToken",
+	ExpireDelegationTokenKey:       "ExpireDelegationToken",
+	DescribeDelegationTokenKey:     "DescribeDelegationToken",
+	DeleteGroupsKey:                "DeleteGroups",
+	NackKey:                        "Nack",
+	FilteredFetchKey:               "FilteredFetch",
+	ShareFetchKey:                  "ShareFetch",
+	ShareAcknowledgeKey:            "ShareAcknowledge",
+	DescribeTrafficKey:             "DescribeTraffic",
+	AlterPartitionReadOnlyKey:      "AlterPartitionReadOnly",
+	AlterBrokerMaintenanceKey:      "AlterBrokerMaintenance",
+	AlterFaultInjectionKey:         "AlterFaultInjection",
+	AlterOffsetsTopicPartitionsKey: "AlterOffsetsTopicPartitions",
+	DescribeClockKey:               "DescribeClock",
+	DescribeLogStatsKey:            "DescribeLogStats",
+	ReadIndexKey:                   "ReadIndex",
+	TransactionalProduceKey:        "TransactionalProduce",
+}
+
+// APIKeyName returns the name of the API with the key, e.g. DeleteTopics, or
+// the key as a string if it isn't one this package knows.
+func APIKeyName(key int16) string {
+	if name, ok := apiKeyNames[key]; ok {
+		return name
+	}
+	return strconv.Itoa(int(key))
+}
+
+// APIKeyByName returns the key of the API with the name, ignoring case.
+func APIKeyByName(name string) (int16, bool) {
+	for key, n := range apiKeyNames {
+		if strings.EqualFold(n, name) {
+			return key, true
+		}
+	}
+	return 0, false
+}
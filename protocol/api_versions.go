@@ -1,12 +1,19 @@
 package protocol
 
+// APIVersions are the versions of each API the broker supports. Flexible
+// versions, e.g. Produce v9+, Fetch v12+, and Metadata v9+, need compact and
+// tagged field encoding which isn't implemented, so they aren't supported.
 var APIVersions = []APIVersion{
-	{APIKey: ProduceKey, MinVersion: 0, MaxVersion: 5},
+	{APIKey: ProduceKey, MinVersion: 0, MaxVersion: 8},
 	{APIKey: FetchKey, MinVersion: 0, MaxVersion: 3},
 	{APIKey: OffsetsKey, MinVersion: 0, MaxVersion: 2},
 	{APIKey: MetadataKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: LeaderAndISRKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: StopReplicaKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: UpdateMetadataKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: ControlledShutdownKey, MinVersion: 1, MaxVersion: 1},
+	{APIKey: OffsetCommitKey, MinVersion: 0, MaxVersion: 2},
+	{APIKey: OffsetFetchKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: FindCoordinatorKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: JoinGroupKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: HeartbeatKey, MinVersion: 0, MaxVersion: 1},
@@ -14,7 +21,42 @@ var APIVersions = []APIVersion{
 	{APIKey: SyncGroupKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: DescribeGroupsKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: ListGroupsKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: SaslHandshakeKey, MinVersion: 1, MaxVersion: 1},
 	{APIKey: APIVersionsKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: CreateTopicsKey, MinVersion: 0, MaxVersion: 1},
 	{APIKey: DeleteTopicsKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: DescribeConfigsKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: AlterConfigsKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: SaslAuthenticateKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: CreateDelegationTokenKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: RenewDelegationTokenKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: ExpireDelegationTokenKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: DescribeDelegationTokenKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: NackKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: FilteredFetchKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: ShareFetchKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: ShareAcknowledgeKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: InitProducerIDKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: EndTxnKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: TxnOffsetCommitKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: WriteTxnMarkersKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: DescribeTrafficKey, MinVersion: 0, MaxVersion: 1},
+	{APIKey: AlterPartitionReadOnlyKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: AlterBrokerMaintenanceKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: AlterFaultInjectionKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: AlterOffsetsTopicPartitionsKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: DescribeClockKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: DescribeLogStatsKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: ReadIndexKey, MinVersion: 0, MaxVersion: 0},
+	{APIKey: TransactionalProduceKey, MinVersion: 0, MaxVersion: 0},
+}
+
+// SupportsVersion returns whether the broker supports the version of the API.
+func SupportsVersion(key, version int16) bool {
+	for _, v := range APIVersions {
+		if v.APIKey == key {
+			return version >= v.MinVersion && version <= v.MaxVersion
+		}
+	}
+	return false
 }
@@ -33,8 +33,16 @@ func (c *APIVersionsResponse) Encode(e PacketEncoder) error {
 	return nil
 }
 
-func (c *APIVersionsResponse) Decode(d PacketDecoder, version int16) error {
+func (c *APIVersionsResponse) Decode(d PacketDecoder, version int16) (err error) {
 	c.APIVersion = version
+	if c.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	if c.ErrorCode == ErrUnsupportedVersion.Code() {
+		// the broker didn't support the version and responded with version 0
+		// to say which it does
+		c.APIVersion, version = 0, 0
+	}
 	l, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIVersionsResponse(t *testing.T) {
+	req := require.New(t)
+	exp := &APIVersionsResponse{
+		APIVersion:   1,
+		APIVersions:  APIVersions,
+		ThrottleTime: time.Millisecond,
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act APIVersionsResponse
+	err = Decode(b, &act, exp.Version())
+	req.NoError(err)
+	req.Equal(exp, &act)
+}
+
+func TestAPIVersionsResponse_UnsupportedVersion(t *testing.T) {
+	req := require.New(t)
+	exp := &APIVersionsResponse{
+		ErrorCode:   ErrUnsupportedVersion.Code(),
+		APIVersions: APIVersions,
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	// the client asked for a later version but the broker fell back to 0
+	var act APIVersionsResponse
+	err = Decode(b, &act, 5)
+	req.NoError(err)
+	req.Equal(exp, &act)
+}
+
+func TestSupportsVersion(t *testing.T) {
+	req := require.New(t)
+	req.True(SupportsVersion(APIVersionsKey, 0))
+	req.True(SupportsVersion(APIVersionsKey, 1))
+	req.False(SupportsVersion(APIVersionsKey, 2))
+	req.False(SupportsVersion(MetadataKey, -1))
+	req.False(SupportsVersion(-1, 0))
+}
+
+func TestAPIKeyByName(t *testing.T) {
+	req := require.New(t)
+	for _, v := range APIVersions {
+		key, ok := APIKeyByName(APIKeyName(v.APIKey))
+		req.True(ok, "api key %d has no name", v.APIKey)
+		req.Equal(v.APIKey, key)
+	}
+	key, ok := APIKeyByName("deletetopics")
+	req.True(ok)
+	req.Equal(int16(DeleteTopicsKey), key)
+	_, ok = APIKeyByName("DropTopics")
+	req.False(ok)
+	req.Equal("9999", APIKeyName(9999))
+}
@@ -0,0 +1,44 @@
+package protocol
+
+// ControlAttribute is set in a message's attributes when it's a control
+// record, i.e. a marker committing or aborting a transaction.
+const ControlAttribute int8 = 0x20
+
+// TransactionalAttribute is set in a message's attributes when it's produced
+// in a transaction. The message format has no producer IDs, so read_committed
+// consumers hold a partition's transactional messages until the partition's
+// next marker, which says whether they were committed or aborted.
+const TransactionalAttribute int8 = 0x10
+
+// ChunkAttribute is set in a message's attributes when its value's a chunk of
+// a bigger value split over a run of messages. The message format has no
+// record headers, so the chunk's header starts its value.
+const ChunkAttribute int8 = 0x40
+
+type ControlRecordType int16
+
+const (
+	ControlRecordAbort  ControlRecordType = 0
+	ControlRecordCommit ControlRecordType = 1
+)
+
+// ControlRecord is the key of a control record.
+type ControlRecord struct {
+	Version int16
+	Type    ControlRecordType
+}
+
+func (r *ControlRecord) Encode(e PacketEncoder) error {
+	e.PutInt16(r.Version)
+	e.PutInt16(int16(r.Type))
+	return nil
+}
+
+func (r *ControlRecord) Decode(d PacketDecoder) (err error) {
+	if r.Version, err = d.Int16(); err != nil {
+		return err
+	}
+	t, err := d.Int16()
+	r.Type = ControlRecordType(t)
+	return err
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlledShutdownResponse(t *testing.T) {
+	req := require.New(t)
+	exp := &ControlledShutdownResponse{
+		APIVersion: 1,
+		ErrorCode:  0,
+		PartitionsRemaining: []*ControlledShutdownPartition{{
+			Topic:     "test_topic",
+			Partition: 2,
+		}},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act ControlledShutdownResponse
+	err = Decode(b, &act, exp.Version())
+	req.NoError(err)
+	req.Equal(exp, &act)
+}
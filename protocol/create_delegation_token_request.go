@@ -0,0 +1,86 @@
+package protocol
+
+import "time"
+
+// https://kafka.apache.org/protocol#The_Messages_CreateDelegationToken
+
+// DelegationTokenPrincipal is a principal, e.g. a token's owner or one allowed
+// to renew it, split into its type and name, e.g. User and alice.
+type DelegationTokenPrincipal struct {
+	PrincipalType string
+	Name          string
+}
+
+// CreateDelegationTokenRequest creates a delegation token for the principal
+// the connection's authenticated as, for short-lived clients to authenticate
+// as it with instead of its own credentials.
+type CreateDelegationTokenRequest struct {
+	APIVersion int16
+
+	// Renewers are the principals, besides the owner, that can renew the token.
+	Renewers []DelegationTokenPrincipal
+	// MaxLifetime is how long the token can be renewed for, or -1 for the
+	// broker's max.
+	MaxLifetime time.Duration
+}
+
+func (r *CreateDelegationTokenRequest) Encode(e PacketEncoder) (err error) {
+	if err = encodeDelegationTokenPrincipals(e, r.Renewers); err != nil {
+		return err
+	}
+	e.PutInt64(int64(r.MaxLifetime / time.Millisecond))
+	return nil
+}
+
+func (r *CreateDelegationTokenRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.Renewers, err = decodeDelegationTokenPrincipals(d); err != nil {
+		return err
+	}
+	lifetime, err := d.Int64()
+	if err != nil {
+		return err
+	}
+	r.MaxLifetime = time.Duration(lifetime) * time.Millisecond
+	return nil
+}
+
+func (r *CreateDelegationTokenRequest) Key() int16 {
+	return CreateDelegationTokenKey
+}
+
+func (r *CreateDelegationTokenRequest) Version() int16 {
+	return r.APIVersion
+}
+
+func encodeDelegationTokenPrincipals(e PacketEncoder, principals []DelegationTokenPrincipal) (err error) {
+	if err = e.PutArrayLength(len(principals)); err != nil {
+		return err
+	}
+	for _, p := range principals {
+		if err = e.PutString(p.PrincipalType); err != nil {
+			return err
+		}
+		if err = e.PutString(p.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeDelegationTokenPrincipals(d PacketDecoder) ([]DelegationTokenPrincipal, error) {
+	n, err := d.ArrayLength()
+	if err != nil {
+		return nil, err
+	}
+	principals := make([]DelegationTokenPrincipal, n)
+	for i := range principals {
+		if principals[i].PrincipalType, err = d.String(); err != nil {
+			return nil, err
+		}
+		if principals[i].Name, err = d.String(); err != nil {
+			return nil, err
+		}
+	}
+	return principals, nil
+}
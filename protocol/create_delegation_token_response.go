@@ -0,0 +1,74 @@
+package protocol
+
+import "time"
+
+type CreateDelegationTokenResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	Owner     DelegationTokenPrincipal
+	// The timestamps are in ms since the epoch.
+	IssueTimestamp  int64
+	ExpiryTimestamp int64
+	MaxTimestamp    int64
+	TokenID         string
+	// HMAC is the token's secret, the client authenticates with the token ID
+	// as its username and the HMAC as its password.
+	HMAC         []byte
+	ThrottleTime time.Duration
+}
+
+func (r *CreateDelegationTokenResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	if err = e.PutString(r.Owner.PrincipalType); err != nil {
+		return err
+	}
+	if err = e.PutString(r.Owner.Name); err != nil {
+		return err
+	}
+	e.PutInt64(r.IssueTimestamp)
+	e.PutInt64(r.ExpiryTimestamp)
+	e.PutInt64(r.MaxTimestamp)
+	if err = e.PutString(r.TokenID); err != nil {
+		return err
+	}
+	if err = e.PutBytes(r.HMAC); err != nil {
+		return err
+	}
+	e.PutInt32(int32(r.ThrottleTime / time.Millisecond))
+	return nil
+}
+
+func (r *CreateDelegationTokenResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	if r.Owner.PrincipalType, err = d.String(); err != nil {
+		return err
+	}
+	if r.Owner.Name, err = d.String(); err != nil {
+		return err
+	}
+	if r.IssueTimestamp, err = d.Int64(); err != nil {
+		return err
+	}
+	if r.ExpiryTimestamp, err = d.Int64(); err != nil {
+		return err
+	}
+	if r.MaxTimestamp, err = d.Int64(); err != nil {
+		return err
+	}
+	if r.TokenID, err = d.String(); err != nil {
+		return err
+	}
+	if r.HMAC, err = d.Bytes(); err != nil {
+		return err
+	}
+	throttle, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	r.ThrottleTime = time.Duration(throttle) * time.Millisecond
+	return nil
+}
@@ -0,0 +1,59 @@
+package protocol
+
+// LeaderIDAndEpoch is the current leader of a partition. It's sent with errors
+// like NotLeaderForPartition so clients can re-route without refreshing
+// metadata. LeaderID and LeaderEpoch are -1 when the leader is unknown.
+type LeaderIDAndEpoch struct {
+	LeaderID    int32
+	LeaderEpoch int32
+}
+
+func (l *LeaderIDAndEpoch) Encode(e PacketEncoder) error {
+	e.PutInt32(l.LeaderID)
+	e.PutInt32(l.LeaderEpoch)
+	return nil
+}
+
+func (l *LeaderIDAndEpoch) Decode(d PacketDecoder, version int16) (err error) {
+	if l.LeaderID, err = d.Int32(); err != nil {
+		return err
+	}
+	l.LeaderEpoch, err = d.Int32()
+	return err
+}
+
+func encodeNodeEndpoints(e PacketEncoder, endpoints []*Broker) (err error) {
+	if err = e.PutArrayLength(len(endpoints)); err != nil {
+		return err
+	}
+	for _, b := range endpoints {
+		e.PutInt32(b.NodeID)
+		if err = e.PutString(b.Host); err != nil {
+			return err
+		}
+		e.PutInt32(b.Port)
+	}
+	return nil
+}
+
+func decodeNodeEndpoints(d PacketDecoder) (endpoints []*Broker, err error) {
+	n, err := d.ArrayLength()
+	if err != nil {
+		return nil, err
+	}
+	endpoints = make([]*Broker, n)
+	for i := range endpoints {
+		b := new(Broker)
+		if b.NodeID, err = d.Int32(); err != nil {
+			return nil, err
+		}
+		if b.Host, err = d.String(); err != nil {
+			return nil, err
+		}
+		if b.Port, err = d.Int32(); err != nil {
+			return nil, err
+		}
+		endpoints[i] = b
+	}
+	return endpoints, nil
+}
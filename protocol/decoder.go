@@ -73,12 +73,20 @@ func (d *ByteDecoder) Bool() (bool, error) {
 }
 
 func (d *ByteDecoder) Int8() (int8, error) {
+	if d.remaining() < 1 {
+		d.off = len(d.b)
+		return -1, ErrInsufficientData
+	}
 	tmp := int8(d.b[d.off])
 	d.off++
 	return tmp, nil
 }
 
 func (d *ByteDecoder) Int16() (int16, error) {
+	if d.remaining() < 2 {
+		d.off = len(d.b)
+		return -1, ErrInsufficientData
+	}
 	tmp := int16(Encoding.Uint16(d.b[d.off:]))
 	d.off += 2
 	return tmp, nil
@@ -205,9 +213,14 @@ func (d *ByteDecoder) Int32Array() ([]int32, error) {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
 	}
-	n := int(Encoding.Uint32(d.b[d.off:]))
+	// signed so a negative length isn't read as a huge one
+	n := int(int32(Encoding.Uint32(d.b[d.off:])))
 	d.off += 4
 
+	if n < 0 {
+		return nil, ErrInvalidArrayLength
+	}
+
 	if d.remaining() < 4*n {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
@@ -217,10 +230,6 @@ func (d *ByteDecoder) Int32Array() ([]int32, error) {
 		return nil, nil
 	}
 
-	if n < 0 {
-		return nil, ErrInvalidArrayLength
-	}
-
 	ret := make([]int32, n)
 	for i := range ret {
 		ret[i] = int32(Encoding.Uint32(d.b[d.off:]))
@@ -234,9 +243,14 @@ func (d *ByteDecoder) Int64Array() ([]int64, error) {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
 	}
-	n := int(Encoding.Uint32(d.b[d.off:]))
+	// signed so a negative length isn't read as a huge one
+	n := int(int32(Encoding.Uint32(d.b[d.off:])))
 	d.off += 4
 
+	if n < 0 {
+		return nil, ErrInvalidArrayLength
+	}
+
 	if d.remaining() < 8*n {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
@@ -246,10 +260,6 @@ func (d *ByteDecoder) Int64Array() ([]int64, error) {
 		return nil, nil
 	}
 
-	if n < 0 {
-		return nil, ErrInvalidArrayLength
-	}
-
 	ret := make([]int64, n)
 	for i := range ret {
 		ret[i] = int64(Encoding.Uint64(d.b[d.off:]))
@@ -263,7 +273,7 @@ func (d *ByteDecoder) StringArray() ([]string, error) {
 		d.off = len(d.b)
 		return nil, ErrInsufficientData
 	}
-	n := int(Encoding.Uint32(d.b[d.off:]))
+	n := int(int32(Encoding.Uint32(d.b[d.off:])))
 	d.off += 4
 
 	if n == 0 {
@@ -274,6 +284,13 @@ func (d *ByteDecoder) StringArray() ([]string, error) {
 		return nil, ErrInvalidArrayLength
 	}
 
+	// each string's at least its length, so a length the rest of the packet
+	// can't hold isn't allocated
+	if d.remaining() < 2*n {
+		d.off = len(d.b)
+		return nil, ErrInsufficientData
+	}
+
 	ret := make([]string, n)
 	for i := range ret {
 		if str, err := d.String(); err != nil {
@@ -298,6 +315,9 @@ func (d *ByteDecoder) Push(pd PushDecoder) error {
 }
 
 func (d *ByteDecoder) Pop() error {
+	if len(d.stack) == 0 {
+		return errors.New("kafka: pop without push")
+	}
 	pd := d.stack[len(d.stack)-1]
 	d.stack = d.stack[:len(d.stack)-1]
 	return pd.Check(d.off, d.b)
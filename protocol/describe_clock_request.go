@@ -0,0 +1,24 @@
+package protocol
+
+// DescribeClockRequest is a Jocko extension asking a broker for its wall
+// clock's time, to check clock skew between brokers.
+type DescribeClockRequest struct {
+	APIVersion int16
+}
+
+func (r *DescribeClockRequest) Encode(e PacketEncoder) error {
+	return nil
+}
+
+func (r *DescribeClockRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	return nil
+}
+
+func (r *DescribeClockRequest) Key() int16 {
+	return DescribeClockKey
+}
+
+func (r *DescribeClockRequest) Version() int16 {
+	return r.APIVersion
+}
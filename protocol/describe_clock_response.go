@@ -0,0 +1,37 @@
+package protocol
+
+type DescribeClockResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	BrokerID  int32
+	// Time is the broker's wall clock time in ms when it handled the request.
+	Time int64
+}
+
+func (r *DescribeClockResponse) Encode(e PacketEncoder) error {
+	e.PutInt16(r.ErrorCode)
+	e.PutInt32(r.BrokerID)
+	e.PutInt64(r.Time)
+	return nil
+}
+
+func (r *DescribeClockResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	if r.BrokerID, err = d.Int32(); err != nil {
+		return err
+	}
+	r.Time, err = d.Int64()
+	return err
+}
+
+func (r *DescribeClockResponse) Key() int16 {
+	return DescribeClockKey
+}
+
+func (r *DescribeClockResponse) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,52 @@
+package protocol
+
+// https://kafka.apache.org/protocol#The_Messages_DescribeDelegationToken
+
+// DescribeDelegationTokenRequest describes the delegation tokens owned by the
+// owners that the connection's principal owns or can renew.
+type DescribeDelegationTokenRequest struct {
+	APIVersion int16
+
+	// Owners are whose tokens to describe, or nil for everyone's.
+	Owners []DelegationTokenPrincipal
+}
+
+func (r *DescribeDelegationTokenRequest) Encode(e PacketEncoder) (err error) {
+	if r.Owners == nil {
+		e.PutInt32(-1)
+		return nil
+	}
+	return encodeDelegationTokenPrincipals(e, r.Owners)
+}
+
+func (r *DescribeDelegationTokenRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	n, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	if n == -1 {
+		return nil
+	}
+	if n < 0 || int(n) > d.remaining() {
+		return ErrInvalidArrayLength
+	}
+	r.Owners = make([]DelegationTokenPrincipal, n)
+	for i := range r.Owners {
+		if r.Owners[i].PrincipalType, err = d.String(); err != nil {
+			return err
+		}
+		if r.Owners[i].Name, err = d.String(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *DescribeDelegationTokenRequest) Key() int16 {
+	return DescribeDelegationTokenKey
+}
+
+func (r *DescribeDelegationTokenRequest) Version() int16 {
+	return r.APIVersion
+}
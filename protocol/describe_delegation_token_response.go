@@ -0,0 +1,97 @@
+package protocol
+
+import "time"
+
+type DescribeDelegationTokenResponse struct {
+	APIVersion int16
+
+	ErrorCode    int16
+	Tokens       []DelegationToken
+	ThrottleTime time.Duration
+}
+
+// DelegationToken describes a delegation token.
+type DelegationToken struct {
+	Owner DelegationTokenPrincipal
+	// The timestamps are in ms since the epoch.
+	IssueTimestamp  int64
+	ExpiryTimestamp int64
+	MaxTimestamp    int64
+	TokenID         string
+	HMAC            []byte
+	Renewers        []DelegationTokenPrincipal
+}
+
+func (r *DescribeDelegationTokenResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	if err = e.PutArrayLength(len(r.Tokens)); err != nil {
+		return err
+	}
+	for _, t := range r.Tokens {
+		if err = e.PutString(t.Owner.PrincipalType); err != nil {
+			return err
+		}
+		if err = e.PutString(t.Owner.Name); err != nil {
+			return err
+		}
+		e.PutInt64(t.IssueTimestamp)
+		e.PutInt64(t.ExpiryTimestamp)
+		e.PutInt64(t.MaxTimestamp)
+		if err = e.PutString(t.TokenID); err != nil {
+			return err
+		}
+		if err = e.PutBytes(t.HMAC); err != nil {
+			return err
+		}
+		if err = encodeDelegationTokenPrincipals(e, t.Renewers); err != nil {
+			return err
+		}
+	}
+	e.PutInt32(int32(r.ThrottleTime / time.Millisecond))
+	return nil
+}
+
+func (r *DescribeDelegationTokenResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Tokens = make([]DelegationToken, n)
+	for i := range r.Tokens {
+		t := &r.Tokens[i]
+		if t.Owner.PrincipalType, err = d.String(); err != nil {
+			return err
+		}
+		if t.Owner.Name, err = d.String(); err != nil {
+			return err
+		}
+		if t.IssueTimestamp, err = d.Int64(); err != nil {
+			return err
+		}
+		if t.ExpiryTimestamp, err = d.Int64(); err != nil {
+			return err
+		}
+		if t.MaxTimestamp, err = d.Int64(); err != nil {
+			return err
+		}
+		if t.TokenID, err = d.String(); err != nil {
+			return err
+		}
+		if t.HMAC, err = d.Bytes(); err != nil {
+			return err
+		}
+		if t.Renewers, err = decodeDelegationTokenPrincipals(d); err != nil {
+			return err
+		}
+	}
+	throttle, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	r.ThrottleTime = time.Duration(throttle) * time.Millisecond
+	return nil
+}
@@ -0,0 +1,29 @@
+package protocol
+
+// DescribeLogStatsRequest is a Jocko extension asking a broker for the size,
+// offsets, and last write of the logs of the partitions it has replicas of.
+type DescribeLogStatsRequest struct {
+	APIVersion int16
+
+	// Topics are the topics to describe the partitions of, all of them if
+	// empty.
+	Topics []string
+}
+
+func (r *DescribeLogStatsRequest) Encode(e PacketEncoder) error {
+	return e.PutStringArray(r.Topics)
+}
+
+func (r *DescribeLogStatsRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	r.Topics, err = d.StringArray()
+	return err
+}
+
+func (r *DescribeLogStatsRequest) Key() int16 {
+	return DescribeLogStatsKey
+}
+
+func (r *DescribeLogStatsRequest) Version() int16 {
+	return r.APIVersion
+}
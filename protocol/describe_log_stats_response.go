@@ -0,0 +1,87 @@
+package protocol
+
+type DescribeLogStatsResponse struct {
+	APIVersion int16
+
+	ErrorCode  int16
+	BrokerID   int32
+	Partitions []*PartitionLogStats
+}
+
+// PartitionLogStats describe a partition's log on a broker.
+type PartitionLogStats struct {
+	Topic     string
+	Partition int32
+	// Size is the bytes of the log's segments on disk.
+	Size           int64
+	LogStartOffset int64
+	LogEndOffset   int64
+	// LastWrite is the greatest timestamp of the log's messages in ms, or -1
+	// if it's empty or its messages don't have timestamps.
+	LastWrite int64
+}
+
+func (r *DescribeLogStatsResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	e.PutInt32(r.BrokerID)
+	if err = e.PutArrayLength(len(r.Partitions)); err != nil {
+		return err
+	}
+	for _, p := range r.Partitions {
+		if err = e.PutString(p.Topic); err != nil {
+			return err
+		}
+		e.PutInt32(p.Partition)
+		e.PutInt64(p.Size)
+		e.PutInt64(p.LogStartOffset)
+		e.PutInt64(p.LogEndOffset)
+		e.PutInt64(p.LastWrite)
+	}
+	return nil
+}
+
+func (r *DescribeLogStatsResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	if r.BrokerID, err = d.Int32(); err != nil {
+		return err
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Partitions = make([]*PartitionLogStats, n)
+	for i := range r.Partitions {
+		p := new(PartitionLogStats)
+		if p.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if p.Partition, err = d.Int32(); err != nil {
+			return err
+		}
+		if p.Size, err = d.Int64(); err != nil {
+			return err
+		}
+		if p.LogStartOffset, err = d.Int64(); err != nil {
+			return err
+		}
+		if p.LogEndOffset, err = d.Int64(); err != nil {
+			return err
+		}
+		if p.LastWrite, err = d.Int64(); err != nil {
+			return err
+		}
+		r.Partitions[i] = p
+	}
+	return nil
+}
+
+func (r *DescribeLogStatsResponse) Key() int16 {
+	return DescribeLogStatsKey
+}
+
+func (r *DescribeLogStatsResponse) Version() int16 {
+	return r.APIVersion
+}
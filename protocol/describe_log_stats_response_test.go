@@ -0,0 +1,23 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeLogStatsResponse(t *testing.T) {
+	req := require.New(t)
+	exp := &DescribeLogStatsResponse{
+		BrokerID: 2,
+		Partitions: []*PartitionLogStats{
+			{Topic: "test_topic", Partition: 0, Size: 1024, LogStartOffset: 5, LogEndOffset: 20, LastWrite: 1500000000000},
+			{Topic: "test_topic", Partition: 1, LogEndOffset: 0, LastWrite: -1},
+		},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act DescribeLogStatsResponse
+	req.NoError(Decode(b, &act, exp.Version()))
+	req.Equal(exp, &act)
+}
@@ -0,0 +1,24 @@
+package protocol
+
+// DescribeTrafficRequest is a Jocko extension asking a broker for the bytes
+// produced to and fetched from it, by topic and by client ID.
+type DescribeTrafficRequest struct {
+	APIVersion int16
+}
+
+func (r *DescribeTrafficRequest) Encode(e PacketEncoder) error {
+	return nil
+}
+
+func (r *DescribeTrafficRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	return nil
+}
+
+func (r *DescribeTrafficRequest) Key() int16 {
+	return DescribeTrafficKey
+}
+
+func (r *DescribeTrafficRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import "time"
+
+type DescribeTrafficResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	// Window is how far back the window byte counts go.
+	Window  time.Duration
+	Topics  []*TrafficStats
+	Clients []*TrafficStats
+	// Partitions is in version 1 and later.
+	Partitions []*PartitionTrafficStats
+}
+
+// TrafficStats are the bytes produced and fetched for a topic or client ID,
+// since the broker started and within the response's window.
+type TrafficStats struct {
+	Name           string
+	BytesIn        int64
+	BytesOut       int64
+	WindowBytesIn  int64
+	WindowBytesOut int64
+}
+
+// PartitionTrafficStats are the bytes produced to and fetched from a partition,
+// since the broker started and within the response's window.
+type PartitionTrafficStats struct {
+	Topic          string
+	Partition      int32
+	BytesIn        int64
+	BytesOut       int64
+	WindowBytesIn  int64
+	WindowBytesOut int64
+}
+
+func (r *DescribeTrafficResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	e.PutInt32(int32(r.Window / time.Millisecond))
+	for _, stats := range [][]*TrafficStats{r.Topics, r.Clients} {
+		if err = e.PutArrayLength(len(stats)); err != nil {
+			return err
+		}
+		for _, s := range stats {
+			if err = e.PutString(s.Name); err != nil {
+				return err
+			}
+			e.PutInt64(s.BytesIn)
+			e.PutInt64(s.BytesOut)
+			e.PutInt64(s.WindowBytesIn)
+			e.PutInt64(s.WindowBytesOut)
+		}
+	}
+	if r.APIVersion < 1 {
+		return nil
+	}
+	if err = e.PutArrayLength(len(r.Partitions)); err != nil {
+		return err
+	}
+	for _, p := range r.Partitions {
+		if err = e.PutString(p.Topic); err != nil {
+			return err
+		}
+		e.PutInt32(p.Partition)
+		e.PutInt64(p.BytesIn)
+		e.PutInt64(p.BytesOut)
+		e.PutInt64(p.WindowBytesIn)
+		e.PutInt64(p.WindowBytesOut)
+	}
+	return nil
+}
+
+func (r *DescribeTrafficResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	window, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	r.Window = time.Duration(window) * time.Millisecond
+	if r.Topics, err = decodeTrafficStats(d); err != nil {
+		return err
+	}
+	if r.Clients, err = decodeTrafficStats(d); err != nil {
+		return err
+	}
+	if version < 1 {
+		return nil
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Partitions = make([]*PartitionTrafficStats, n)
+	for i := range r.Partitions {
+		p := &PartitionTrafficStats{}
+		if p.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if p.Partition, err = d.Int32(); err != nil {
+			return err
+		}
+		if p.BytesIn, err = d.Int64(); err != nil {
+			return err
+		}
+		if p.BytesOut, err = d.Int64(); err != nil {
+			return err
+		}
+		if p.WindowBytesIn, err = d.Int64(); err != nil {
+			return err
+		}
+		if p.WindowBytesOut, err = d.Int64(); err != nil {
+			return err
+		}
+		r.Partitions[i] = p
+	}
+	return nil
+}
+
+func decodeTrafficStats(d PacketDecoder) ([]*TrafficStats, error) {
+	n, err := d.ArrayLength()
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]*TrafficStats, n)
+	for i := range stats {
+		s := &TrafficStats{}
+		if s.Name, err = d.String(); err != nil {
+			return nil, err
+		}
+		if s.BytesIn, err = d.Int64(); err != nil {
+			return nil, err
+		}
+		if s.BytesOut, err = d.Int64(); err != nil {
+			return nil, err
+		}
+		if s.WindowBytesIn, err = d.Int64(); err != nil {
+			return nil, err
+		}
+		if s.WindowBytesOut, err = d.Int64(); err != nil {
+			return nil, err
+		}
+		stats[i] = s
+	}
+	return stats, nil
+}
+
+func (r *DescribeTrafficResponse) Key() int16 {
+	return DescribeTrafficKey
+}
+
+func (r *DescribeTrafficResponse) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import "time"
+
+type EndTxnResponse struct {
+	APIVersion int16
+
+	ThrottleTime time.Duration
+	ErrorCode    int16
+}
+
+func (r *EndTxnResponse) Encode(e PacketEncoder) error {
+	e.PutInt32(int32(r.ThrottleTime / time.Millisecond))
+	e.PutInt16(r.ErrorCode)
+	return nil
+}
+
+func (r *EndTxnResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+
+	throttle, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	r.ThrottleTime = time.Duration(throttle) * time.Millisecond
+	r.ErrorCode, err = d.Int16()
+	return err
+}
+
+func (r *EndTxnResponse) Key() int16 {
+	return EndTxnKey
+}
+
+func (r *EndTxnResponse) Version() int16 {
+	return r.APIVersion
+}
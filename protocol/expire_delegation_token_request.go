@@ -0,0 +1,46 @@
+package protocol
+
+import "time"
+
+// https://kafka.apache.org/protocol#The_Messages_ExpireDelegationToken
+
+// ExpireDelegationTokenRequest brings forward the expiry of the token with the
+// HMAC, or expires it now. It's sent by the token's owner or one of its
+// renewers.
+type ExpireDelegationTokenRequest struct {
+	APIVersion int16
+
+	HMAC []byte
+	// ExpiryTimePeriod is how long from now the token expires, or negative to
+	// expire it immediately.
+	ExpiryTimePeriod time.Duration
+}
+
+func (r *ExpireDelegationTokenRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutBytes(r.HMAC); err != nil {
+		return err
+	}
+	e.PutInt64(int64(r.ExpiryTimePeriod / time.Millisecond))
+	return nil
+}
+
+func (r *ExpireDelegationTokenRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.HMAC, err = d.Bytes(); err != nil {
+		return err
+	}
+	period, err := d.Int64()
+	if err != nil {
+		return err
+	}
+	r.ExpiryTimePeriod = time.Duration(period) * time.Millisecond
+	return nil
+}
+
+func (r *ExpireDelegationTokenRequest) Key() int16 {
+	return ExpireDelegationTokenKey
+}
+
+func (r *ExpireDelegationTokenRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,35 @@
+package protocol
+
+import "time"
+
+type ExpireDelegationTokenResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	// ExpiryTimestamp is when the token expires, in ms since the epoch.
+	ExpiryTimestamp int64
+	ThrottleTime    time.Duration
+}
+
+func (r *ExpireDelegationTokenResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	e.PutInt64(r.ExpiryTimestamp)
+	e.PutInt32(int32(r.ThrottleTime / time.Millisecond))
+	return nil
+}
+
+func (r *ExpireDelegationTokenResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	if r.ExpiryTimestamp, err = d.Int64(); err != nil {
+		return err
+	}
+	throttle, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	r.ThrottleTime = time.Duration(throttle) * time.Millisecond
+	return nil
+}
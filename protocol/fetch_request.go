@@ -16,7 +16,9 @@ type FetchPartition struct {
 }
 
 type FetchTopic struct {
-	Topic      string
+	Topic string
+	// TopicID replaces Topic in v13+.
+	TopicID    UUID
 	Partitions []*FetchPartition
 }
 
@@ -49,7 +51,9 @@ func (r *FetchRequest) Encode(e PacketEncoder) (err error) {
 		return err
 	}
 	for _, t := range r.Topics {
-		if err = e.PutString(t.Topic); err != nil {
+		if r.APIVersion >= 13 {
+			encodeUUID(e, t.TopicID)
+		} else if err = e.PutString(t.Topic); err != nil {
 			return err
 		}
 		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
@@ -99,7 +103,11 @@ func (r *FetchRequest) Decode(d PacketDecoder, version int16) (err error) {
 	topics := make([]*FetchTopic, topicCount)
 	for i := range topics {
 		t := &FetchTopic{}
-		t.Topic, err = d.String()
+		if r.APIVersion >= 13 {
+			t.TopicID, err = decodeUUID(d)
+		} else {
+			t.Topic, err = d.String()
+		}
 		if err != nil {
 			return err
 		}
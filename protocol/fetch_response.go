@@ -30,6 +30,9 @@ type FetchPartitionResponse struct {
 	LastStableOffset    int64
 	AbortedTransactions []*AbortedTransaction
 	RecordSet           []byte
+	// CurrentLeader is set when the request was sent to a broker that isn't the
+	// partition's leader.
+	CurrentLeader LeaderIDAndEpoch
 }
 
 func (r *FetchPartitionResponse) Decode(d PacketDecoder, version int16) (err error) {
@@ -67,6 +70,12 @@ func (r *FetchPartitionResponse) Decode(d PacketDecoder, version int16) (err err
 		return err
 	}
 
+	if version >= 12 {
+		if err = r.CurrentLeader.Decode(d, version); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -90,11 +99,19 @@ func (r *FetchPartitionResponse) Encode(e PacketEncoder, version int16) (err err
 		return err
 	}
 
+	if version >= 12 {
+		if err = r.CurrentLeader.Encode(e); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 type FetchTopicResponse struct {
-	Topic              string
+	Topic string
+	// TopicID replaces Topic in v13+.
+	TopicID            UUID
 	PartitionResponses FetchPartitionResponses
 }
 
@@ -105,6 +122,8 @@ type FetchResponse struct {
 
 	ThrottleTime time.Duration
 	Responses    FetchTopicResponses
+	// NodeEndpoints are the endpoints of the leaders in the partitions' CurrentLeader.
+	NodeEndpoints []*Broker
 }
 
 type FetchTopicResponses []*FetchTopicResponse
@@ -118,7 +137,9 @@ func (r *FetchResponse) Encode(e PacketEncoder) (err error) {
 		return err
 	}
 	for _, response := range r.Responses {
-		if err = e.PutString(response.Topic); err != nil {
+		if r.APIVersion >= 13 {
+			encodeUUID(e, response.TopicID)
+		} else if err = e.PutString(response.Topic); err != nil {
 			return err
 		}
 		if err = e.PutArrayLength(len(response.PartitionResponses)); err != nil {
@@ -130,6 +151,11 @@ func (r *FetchResponse) Encode(e PacketEncoder) (err error) {
 			}
 		}
 	}
+	if r.APIVersion >= 12 {
+		if err = encodeNodeEndpoints(e, r.NodeEndpoints); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -152,7 +178,11 @@ func (r *FetchResponse) Decode(d PacketDecoder, version int16) (err error) {
 
 	for i := range r.Responses {
 		resp := &FetchTopicResponse{}
-		resp.Topic, err = d.String()
+		if r.APIVersion >= 13 {
+			resp.TopicID, err = decodeUUID(d)
+		} else {
+			resp.Topic, err = d.String()
+		}
 		if err != nil {
 			return err
 		}
@@ -171,6 +201,11 @@ func (r *FetchResponse) Decode(d PacketDecoder, version int16) (err error) {
 		resp.PartitionResponses = ps
 		r.Responses[i] = resp
 	}
+	if r.APIVersion >= 12 {
+		if r.NodeEndpoints, err = decodeNodeEndpoints(d); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -29,3 +29,26 @@ func TestFetchResponse(t *testing.T) {
 	req.NoError(err)
 	req.Equal(exp, &act)
 }
+
+func TestFetchResponseCurrentLeader(t *testing.T) {
+	req := require.New(t)
+	exp := &FetchResponse{
+		APIVersion: 12,
+		Responses: []*FetchTopicResponse{{
+			Topic: "test_topic",
+			PartitionResponses: []*FetchPartitionResponse{{
+				Partition:           1,
+				ErrorCode:           ErrNotLeaderForPartition.Code(),
+				AbortedTransactions: []*AbortedTransaction{},
+				CurrentLeader:       LeaderIDAndEpoch{LeaderID: 2, LeaderEpoch: 3},
+			}},
+		}},
+		NodeEndpoints: []*Broker{{NodeID: 2, Host: "localhost", Port: 9092}},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act FetchResponse
+	err = Decode(b, &act, exp.Version())
+	req.NoError(err)
+	req.Equal(exp, &act)
+}
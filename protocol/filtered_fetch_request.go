@@ -0,0 +1,74 @@
+package protocol
+
+// FilteredFetchRequest is a Jocko extension wrapping a fetch request with a
+// record filter. The broker drops the message sets that have no record
+// matching the filter, decompressing compressed message sets to check them.
+type FilteredFetchRequest struct {
+	APIVersion int16
+
+	Filter *RecordFilter
+	Fetch  *FetchRequest
+}
+
+// RecordFilter is a predicate on records. Messages before record batches
+// don't have headers so records are matched by key.
+type RecordFilter struct {
+	// KeyPrefix matches records whose key starts with it.
+	KeyPrefix []byte
+}
+
+// Match returns whether the key matches the filter. A nil filter matches
+// everything.
+func (f *RecordFilter) Match(key []byte) bool {
+	if f == nil {
+		return true
+	}
+	if len(key) < len(f.KeyPrefix) {
+		return false
+	}
+	for i, c := range f.KeyPrefix {
+		if key[i] != c {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *FilteredFetchRequest) Encode(e PacketEncoder) (err error) {
+	var prefix []byte
+	if r.Filter != nil {
+		prefix = r.Filter.KeyPrefix
+	}
+	if err = e.PutBytes(prefix); err != nil {
+		return err
+	}
+	e.PutInt16(r.Fetch.APIVersion)
+	return r.Fetch.Encode(e)
+}
+
+func (r *FilteredFetchRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	prefix, err := d.Bytes()
+	if err != nil {
+		return err
+	}
+	r.Filter = &RecordFilter{KeyPrefix: prefix}
+	fetchVersion, err := d.Int16()
+	if err != nil {
+		return err
+	}
+	// the fetch can only be decoded if its version's one the broker knows
+	if !SupportsVersion(FetchKey, fetchVersion) {
+		return ErrUnsupportedVersion
+	}
+	r.Fetch = &FetchRequest{}
+	return r.Fetch.Decode(d, fetchVersion)
+}
+
+func (r *FilteredFetchRequest) Key() int16 {
+	return FilteredFetchKey
+}
+
+func (r *FilteredFetchRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilteredFetchRequest(t *testing.T) {
+	req := require.New(t)
+	exp := &FilteredFetchRequest{
+		Filter: &RecordFilter{KeyPrefix: []byte("user-")},
+		Fetch: &FetchRequest{
+			APIVersion:  3,
+			ReplicaID:   -1,
+			MaxWaitTime: time.Second,
+			MinBytes:    1,
+			MaxBytes:    1024,
+			Topics: []*FetchTopic{{
+				Topic:      "test",
+				Partitions: []*FetchPartition{{Partition: 0, FetchOffset: 5, MaxBytes: 1024}},
+			}},
+		},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act FilteredFetchRequest
+	req.NoError(Decode(b, &act, exp.Version()))
+	req.Equal(exp.Filter, act.Filter)
+	req.Equal(int16(3), act.Fetch.APIVersion)
+	req.Equal(exp.Fetch.Topics, act.Fetch.Topics)
+
+	// a fetch version the broker doesn't know can't be decoded
+	exp.Fetch.APIVersion = 100
+	b, err = Encode(exp)
+	req.NoError(err)
+	req.Equal(ErrUnsupportedVersion, Decode(b, &act, exp.Version()))
+}
@@ -0,0 +1,80 @@
+package protocol
+
+type FilteredFetchResponse struct {
+	APIVersion int16
+
+	Fetch *FetchResponse
+	// Partitions has where to fetch from next for each partition in the fetch
+	// response since the records at the end of its record set may have been
+	// dropped. It's in the same order as the fetch response's partitions.
+	Partitions []*FilteredFetchPartition
+}
+
+type FilteredFetchPartition struct {
+	Topic      string
+	Partition  int32
+	NextOffset int64
+	// Skipped is the number of message sets dropped by the filter.
+	Skipped int32
+}
+
+func (r *FilteredFetchResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.Fetch.APIVersion)
+	if err = r.Fetch.Encode(e); err != nil {
+		return err
+	}
+	if err = e.PutArrayLength(len(r.Partitions)); err != nil {
+		return err
+	}
+	for _, p := range r.Partitions {
+		if err = e.PutString(p.Topic); err != nil {
+			return err
+		}
+		e.PutInt32(p.Partition)
+		e.PutInt64(p.NextOffset)
+		e.PutInt32(p.Skipped)
+	}
+	return nil
+}
+
+func (r *FilteredFetchResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	fetchVersion, err := d.Int16()
+	if err != nil {
+		return err
+	}
+	r.Fetch = &FetchResponse{}
+	if err = r.Fetch.Decode(d, fetchVersion); err != nil {
+		return err
+	}
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Partitions = make([]*FilteredFetchPartition, n)
+	for i := range r.Partitions {
+		p := &FilteredFetchPartition{}
+		if p.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if p.Partition, err = d.Int32(); err != nil {
+			return err
+		}
+		if p.NextOffset, err = d.Int64(); err != nil {
+			return err
+		}
+		if p.Skipped, err = d.Int32(); err != nil {
+			return err
+		}
+		r.Partitions[i] = p
+	}
+	return nil
+}
+
+func (r *FilteredFetchResponse) Key() int16 {
+	return FilteredFetchKey
+}
+
+func (r *FilteredFetchResponse) Version() int16 {
+	return r.APIVersion
+}
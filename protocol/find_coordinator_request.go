@@ -6,7 +6,7 @@ type CoordinatorType int8
 
 const (
 	CoordinatorGroup       CoordinatorType = 0
-	CoordinatorTransaction CoordinatorType = 0
+	CoordinatorTransaction CoordinatorType = 1
 )
 
 type FindCoordinatorRequest struct {
@@ -0,0 +1,28 @@
+//go:build gofuzz
+// +build gofuzz
+
+package protocol
+
+// Fuzz is the go-fuzz and libFuzzer target for the request decoders. It
+// decodes the data as a request, header then body, of any of the APIs the
+// broker handles, the way the server does, and has the fuzzer keep the inputs
+// that decode. `make fuzz` runs it with go-fuzz, and for libFuzzer it's built
+// with:
+//
+//	go-fuzz-build -libfuzzer -o protocol.a ./protocol
+//	clang -fsanitize=fuzzer protocol.a -o protocol-fuzz
+func Fuzz(data []byte) int {
+	d := NewDecoder(data)
+	header := new(RequestHeader)
+	if err := header.Decode(d); err != nil {
+		return 0
+	}
+	if !SupportsVersion(header.APIKey, header.APIVersion) {
+		// the server doesn't decode these
+		return -1
+	}
+	if err := NewRequest(header.APIKey).Decode(d, header.APIVersion); err != nil {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRequest(t *testing.T) {
+	for _, v := range APIVersions {
+		require.NotNil(t, NewRequest(v.APIKey), "api key %d", v.APIKey)
+	}
+	require.Nil(t, NewRequest(-1))
+}
+
+// TestDecodeMalformedRequests decodes truncated and mutated requests, and
+// random bodies for every API version, to catch decoders that panic or
+// over-allocate on malformed frames between runs of the fuzzer.
+func TestDecodeMalformedRequests(t *testing.T) {
+	var seeds [][]byte
+	for _, body := range []Body{
+		&ProduceRequest{APIVersion: 3, Acks: 1, Timeout: time.Second, TopicData: []*TopicData{{
+			Topic: "test",
+			Data:  []*Data{{Partition: 0, RecordSet: []byte("record set")}},
+		}}},
+		&FetchRequest{APIVersion: 3, MaxBytes: 100, Topics: []*FetchTopic{{
+			Topic:      "test",
+			Partitions: []*FetchPartition{{Partition: 0, FetchOffset: 10, MaxBytes: 100}},
+		}}},
+		&MetadataRequest{APIVersion: 1, Topics: []string{"test", "other"}},
+		&OffsetsRequest{APIVersion: 1, ReplicaID: -1, Topics: []*OffsetsTopic{{
+			Topic:      "test",
+			Partitions: []*OffsetsPartition{{Partition: 0, Timestamp: -1}},
+		}}},
+		&JoinGroupRequest{APIVersion: 1, GroupID: "group", SessionTimeout: 100, ProtocolType: "consumer", GroupProtocols: []*GroupProtocol{{
+			ProtocolName:     "range",
+			ProtocolMetadata: []byte("metadata"),
+		}}},
+	} {
+		b, err := Encode(&Request{CorrelationID: 1, ClientID: "test", Body: body})
+		require.NoError(t, err)
+		seeds = append(seeds, b)
+	}
+
+	rand := rand.New(rand.NewSource(1))
+	for _, seed := range seeds {
+		for i := range seed {
+			decodeMalformed(t, seed[:i])
+		}
+		for i := 0; i < 1000; i++ {
+			b := append([]byte(nil), seed...)
+			for j := rand.Intn(4); j >= 0; j-- {
+				b[rand.Intn(len(b))] = byte(rand.Intn(256))
+			}
+			decodeMalformed(t, b)
+		}
+	}
+
+	for _, v := range APIVersions {
+		for version := v.MinVersion; version <= v.MaxVersion; version++ {
+			header, err := Encode(&requestHeaderEncoder{&RequestHeader{APIKey: v.APIKey, APIVersion: version, ClientID: "test"}})
+			require.NoError(t, err)
+			for i := 0; i < 100; i++ {
+				body := make([]byte, rand.Intn(64))
+				rand.Read(body)
+				decodeMalformed(t, append(append([]byte(nil), header...), body...))
+			}
+		}
+	}
+}
+
+type requestHeaderEncoder struct {
+	*RequestHeader
+}
+
+func (h *requestHeaderEncoder) Encode(e PacketEncoder) error {
+	h.RequestHeader.Encode(e)
+	return nil
+}
+
+// decodeMalformed decodes the request like the server, failing the test if it
+// panics.
+func decodeMalformed(t *testing.T, b []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("decoding %s panicked: %v", hex.EncodeToString(b), r)
+		}
+	}()
+	d := NewDecoder(b)
+	header := new(RequestHeader)
+	if err := header.Decode(d); err != nil {
+		return
+	}
+	if !SupportsVersion(header.APIKey, header.APIVersion) {
+		return
+	}
+	NewRequest(header.APIKey).Decode(d, header.APIVersion)
+}
@@ -0,0 +1,47 @@
+package protocol
+
+// GroupLag is the value of a record in the group lag topic. It's a snapshot of
+// how far behind the end of a partition a consumer group's committed offset
+// is.
+type GroupLag struct {
+	Group           string
+	Topic           string
+	Partition       int32
+	CommittedOffset int64
+	HighWatermark   int64
+	Lag             int64
+}
+
+func (l *GroupLag) Encode(e PacketEncoder) (err error) {
+	if err = e.PutString(l.Group); err != nil {
+		return err
+	}
+	if err = e.PutString(l.Topic); err != nil {
+		return err
+	}
+	e.PutInt32(l.Partition)
+	e.PutInt64(l.CommittedOffset)
+	e.PutInt64(l.HighWatermark)
+	e.PutInt64(l.Lag)
+	return nil
+}
+
+func (l *GroupLag) Decode(d PacketDecoder) (err error) {
+	if l.Group, err = d.String(); err != nil {
+		return err
+	}
+	if l.Topic, err = d.String(); err != nil {
+		return err
+	}
+	if l.Partition, err = d.Int32(); err != nil {
+		return err
+	}
+	if l.CommittedOffset, err = d.Int64(); err != nil {
+		return err
+	}
+	if l.HighWatermark, err = d.Int64(); err != nil {
+		return err
+	}
+	l.Lag, err = d.Int64()
+	return err
+}
@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitProducerIDRequest(t *testing.T) {
+	req := require.New(t)
+	id := "txn"
+	for _, exp := range []*InitProducerIDRequest{
+		{TransactionalID: &id, TransactionTimeout: time.Minute},
+		{TransactionTimeout: time.Minute},
+	} {
+		b, err := Encode(exp)
+		req.NoError(err)
+		var act InitProducerIDRequest
+		err = Decode(b, &act, exp.Version())
+		req.NoError(err)
+		req.Equal(exp, &act)
+	}
+}
@@ -3,14 +3,35 @@ package protocol
 type MetadataRequest struct {
 	APIVersion int16
 
-	Topics                 []string
+	Topics []string
+	// TopicIDs address topics by ID rather than name. Only sent in v10+.
+	TopicIDs               []UUID
 	AllowAutoTopicCreation bool
 }
 
 func (r *MetadataRequest) Encode(e PacketEncoder) (err error) {
-	err = e.PutStringArray(r.Topics)
-	if err != nil {
-		return err
+	if r.APIVersion >= 10 {
+		if err = e.PutArrayLength(len(r.Topics) + len(r.TopicIDs)); err != nil {
+			return err
+		}
+		for _, t := range r.Topics {
+			encodeUUID(e, UUID{})
+			name := t
+			if err = e.PutNullableString(&name); err != nil {
+				return err
+			}
+		}
+		for _, id := range r.TopicIDs {
+			encodeUUID(e, id)
+			if err = e.PutNullableString(nil); err != nil {
+				return err
+			}
+		}
+	} else {
+		err = e.PutStringArray(r.Topics)
+		if err != nil {
+			return err
+		}
 	}
 	if r.APIVersion >= 4 {
 		e.PutBool(r.AllowAutoTopicCreation)
@@ -20,9 +41,31 @@ func (r *MetadataRequest) Encode(e PacketEncoder) (err error) {
 
 func (r *MetadataRequest) Decode(d PacketDecoder, version int16) (err error) {
 	r.APIVersion = version
-	r.Topics, err = d.StringArray()
-	if err != nil {
-		return err
+	if version >= 10 {
+		topicCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < topicCount; i++ {
+			id, err := decodeUUID(d)
+			if err != nil {
+				return err
+			}
+			name, err := d.NullableString()
+			if err != nil {
+				return err
+			}
+			if name != nil {
+				r.Topics = append(r.Topics, *name)
+			} else {
+				r.TopicIDs = append(r.TopicIDs, id)
+			}
+		}
+	} else {
+		r.Topics, err = d.StringArray()
+		if err != nil {
+			return err
+		}
 	}
 	if version >= 4 {
 		r.AllowAutoTopicCreation, err = d.Bool()
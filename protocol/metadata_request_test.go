@@ -0,0 +1,23 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataRequestTopicIDs(t *testing.T) {
+	req := require.New(t)
+	exp := &MetadataRequest{
+		APIVersion:             10,
+		Topics:                 []string{"test_topic"},
+		TopicIDs:               []UUID{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}},
+		AllowAutoTopicCreation: true,
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act MetadataRequest
+	err = Decode(b, &act, exp.Version())
+	req.NoError(err)
+	req.Equal(exp, &act)
+}
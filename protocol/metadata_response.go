@@ -1,5 +1,10 @@
 package protocol
 
+import (
+	"net"
+	"strconv"
+)
+
 type Broker struct {
 	NodeID int32
 	Host   string
@@ -7,6 +12,11 @@ type Broker struct {
 	// unsupported: Rack *string
 }
 
+// Addr returns the broker's host:port address.
+func (b *Broker) Addr() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(int(b.Port)))
+}
+
 type PartitionMetadata struct {
 	PartitionErrorCode int16
 	PartitionID        int32
@@ -16,8 +26,10 @@ type PartitionMetadata struct {
 }
 
 type TopicMetadata struct {
-	TopicErrorCode    int16
-	Topic             string
+	TopicErrorCode int16
+	Topic          string
+	// TopicID is the topic's immutable ID. Only sent in v10+.
+	TopicID           UUID
 	PartitionMetadata []*PartitionMetadata
 }
 
@@ -51,6 +63,9 @@ func (r *MetadataResponse) Encode(e PacketEncoder) (err error) {
 		if err = e.PutString(t.Topic); err != nil {
 			return err
 		}
+		if r.APIVersion >= 10 {
+			encodeUUID(e, t.TopicID)
+		}
 		if err = e.PutArrayLength(len(t.PartitionMetadata)); err != nil {
 			return err
 		}
@@ -117,6 +132,12 @@ func (r *MetadataResponse) Decode(d PacketDecoder, version int16) (err error) {
 		if err != nil {
 			return err
 		}
+		if version >= 10 {
+			m.TopicID, err = decodeUUID(d)
+			if err != nil {
+				return err
+			}
+		}
 		partitionCount, err := d.ArrayLength()
 		if err != nil {
 			return err
@@ -149,6 +170,33 @@ func (r *MetadataResponse) Decode(d PacketDecoder, version int16) (err error) {
 	return nil
 }
 
+// Leader returns the broker leading the partition.
+func (r *MetadataResponse) Leader(topic string, partition int32) (*Broker, error) {
+	for _, t := range r.TopicMetadata {
+		if t.Topic != topic {
+			continue
+		}
+		if t.TopicErrorCode != ErrNone.Code() {
+			return nil, Errs[t.TopicErrorCode]
+		}
+		for _, p := range t.PartitionMetadata {
+			if p.PartitionID != partition {
+				continue
+			}
+			if p.PartitionErrorCode != ErrNone.Code() {
+				return nil, Errs[p.PartitionErrorCode]
+			}
+			for _, b := range r.Brokers {
+				if b.NodeID == p.Leader {
+					return b, nil
+				}
+			}
+			return nil, ErrLeaderNotAvailable
+		}
+	}
+	return nil, ErrUnknownTopicOrPartition
+}
+
 func (r *MetadataResponse) Version() int16 {
 	return r.APIVersion
 }
@@ -0,0 +1,43 @@
+package protocol
+
+// MirrorCheckpoint is the value of a record in a mirror topic's checkpoint
+// topic. It maps an offset of the source partition to the offset it was
+// mirrored at, so consumers' offsets can be translated when they fail over to
+// the mirror.
+type MirrorCheckpoint struct {
+	SourceTopic  string
+	Topic        string
+	Partition    int32
+	SourceOffset int64
+	Offset       int64
+}
+
+func (c *MirrorCheckpoint) Encode(e PacketEncoder) (err error) {
+	if err = e.PutString(c.SourceTopic); err != nil {
+		return err
+	}
+	if err = e.PutString(c.Topic); err != nil {
+		return err
+	}
+	e.PutInt32(c.Partition)
+	e.PutInt64(c.SourceOffset)
+	e.PutInt64(c.Offset)
+	return nil
+}
+
+func (c *MirrorCheckpoint) Decode(d PacketDecoder) (err error) {
+	if c.SourceTopic, err = d.String(); err != nil {
+		return err
+	}
+	if c.Topic, err = d.String(); err != nil {
+		return err
+	}
+	if c.Partition, err = d.Int32(); err != nil {
+		return err
+	}
+	if c.SourceOffset, err = d.Int64(); err != nil {
+		return err
+	}
+	c.Offset, err = d.Int64()
+	return err
+}
@@ -0,0 +1,97 @@
+package protocol
+
+// NackRequest is a Jocko extension for consumers to negatively acknowledge
+// records they failed to process. The broker leading each partition routes the
+// records at the offsets to the topic's retry or dead-letter topic according to
+// its nack.policy.
+type NackRequest struct {
+	APIVersion int16
+
+	GroupID string
+	Topics  []*NackTopic
+}
+
+type NackTopic struct {
+	Topic      string
+	Partitions []*NackPartition
+}
+
+type NackPartition struct {
+	Partition int32
+	Offsets   []int64
+	// Reason is why processing failed, it's kept with the record's attempts.
+	Reason *string
+}
+
+func (r *NackRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutString(r.GroupID); err != nil {
+		return err
+	}
+	if err = e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			if err = e.PutInt64Array(p.Offsets); err != nil {
+				return err
+			}
+			if err = e.PutNullableString(p.Reason); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *NackRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.GroupID, err = d.String(); err != nil {
+		return err
+	}
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*NackTopic, topicCount)
+	for i := range r.Topics {
+		t := &NackTopic{}
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*NackPartition, partitionCount)
+		for j := range t.Partitions {
+			p := &NackPartition{}
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.Offsets, err = d.Int64Array(); err != nil {
+				return err
+			}
+			if p.Reason, err = d.NullableString(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		r.Topics[i] = t
+	}
+	return nil
+}
+
+func (r *NackRequest) Key() int16 {
+	return NackKey
+}
+
+func (r *NackRequest) Version() int16 {
+	return r.APIVersion
+}
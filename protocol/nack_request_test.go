@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNackRequest(t *testing.T) {
+	req := require.New(t)
+	reason := "timed out"
+	exp := &NackRequest{
+		GroupID: "test_group",
+		Topics: []*NackTopic{{
+			Topic: "test_topic",
+			Partitions: []*NackPartition{
+				{Partition: 0, Offsets: []int64{1, 3}, Reason: &reason},
+				{Partition: 1, Offsets: []int64{2}},
+			},
+		}},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act NackRequest
+	req.NoError(Decode(b, &act, exp.Version()))
+	req.Equal(exp, &act)
+}
+
+func TestRetryRecord(t *testing.T) {
+	req := require.New(t)
+	exp := &RetryRecord{
+		Topic:     "test_topic",
+		Partition: 1,
+		Offset:    5,
+		Attempts:  2,
+		Timestamp: time.Unix(1500000000, 0),
+		Key:       []byte("key"),
+		Value:     []byte("value"),
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act RetryRecord
+	req.NoError(act.Decode(NewDecoder(b)))
+	req.Equal(exp, &act)
+}
+
+func TestNackResponse(t *testing.T) {
+	req := require.New(t)
+	for _, version := range []int16{0, 1} {
+		exp := &NackResponse{
+			APIVersion: version,
+			Responses: []*NackTopicResponse{{
+				Topic: "test_topic",
+				Partitions: []*NackPartitionResponse{
+					{Partition: 0},
+					{Partition: 1, ErrorCode: ErrNotLeaderForPartition.Code()},
+				},
+			}},
+		}
+		if version >= 1 {
+			exp.Responses[0].Partitions[1].FailedOffsets = []int64{2, 4}
+		}
+		b, err := Encode(exp)
+		req.NoError(err)
+		var act NackResponse
+		req.NoError(Decode(b, &act, version))
+		req.Equal(exp, &act)
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+type NackResponse struct {
+	APIVersion int16
+
+	Responses []*NackTopicResponse
+}
+
+type NackTopicResponse struct {
+	Topic      string
+	Partitions []*NackPartitionResponse
+}
+
+type NackPartitionResponse struct {
+	Partition int32
+	ErrorCode int16
+	// FailedOffsets are the nacked offsets that weren't routed if there was
+	// an error, so they're the only ones to nack again. Version 1 and up.
+	FailedOffsets []int64
+}
+
+func (r *NackResponse) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Responses)); err != nil {
+		return err
+	}
+	for _, t := range r.Responses {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt16(p.ErrorCode)
+			if r.APIVersion >= 1 {
+				if err = e.PutInt64Array(p.FailedOffsets); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *NackResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Responses = make([]*NackTopicResponse, topicCount)
+	for i := range r.Responses {
+		t := &NackTopicResponse{}
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*NackPartitionResponse, partitionCount)
+		for j := range t.Partitions {
+			p := &NackPartitionResponse{}
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+			if version >= 1 {
+				if p.FailedOffsets, err = d.Int64Array(); err != nil {
+					return err
+				}
+			}
+			t.Partitions[j] = p
+		}
+		r.Responses[i] = t
+	}
+	return nil
+}
+
+func (r *NackResponse) Key() int16 {
+	return NackKey
+}
+
+func (r *NackResponse) Version() int16 {
+	return r.APIVersion
+}
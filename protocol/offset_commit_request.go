@@ -26,16 +26,31 @@ func (r *OffsetCommitRequest) Encode(e PacketEncoder) (err error) {
 	if err = e.PutString(r.GroupID); err != nil {
 		return err
 	}
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.GenerationID)
+		if err = e.PutString(r.MemberID); err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 2 {
+		e.PutInt64(r.RetentionTime)
+	}
 	if err := e.PutArrayLength(len(r.Topics)); err != nil {
 		return err
 	}
 	for _, t := range r.Topics {
+		if err := e.PutString(t.Topic); err != nil {
+			return err
+		}
 		if err := e.PutArrayLength(len(t.Partitions)); err != nil {
 			return err
 		}
 		for _, p := range t.Partitions {
 			e.PutInt32(p.Partition)
 			e.PutInt64(p.Offset)
+			if r.APIVersion == 1 {
+				e.PutInt64(p.Timestamp)
+			}
 			if err := e.PutNullableString(p.Metadata); err != nil {
 				return err
 			}
@@ -68,20 +83,25 @@ func (r *OffsetCommitRequest) Decode(d PacketDecoder, version int16) (err error)
 		return err
 	}
 	r.Topics = make([]OffsetCommitTopicRequest, topicCount)
-	for _, t := range r.Topics {
+	for i := range r.Topics {
+		t := &r.Topics[i]
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
 		partitionCount, err := d.ArrayLength()
 		if err != nil {
 			return err
 		}
 		t.Partitions = make([]OffsetCommitPartitionRequest, partitionCount)
-		for _, p := range t.Partitions {
+		for j := range t.Partitions {
+			p := &t.Partitions[j]
 			if p.Partition, err = d.Int32(); err != nil {
 				return err
 			}
 			if p.Offset, err = d.Int64(); err != nil {
 				return err
 			}
-			if version >= 1 {
+			if version == 1 {
 				if p.Timestamp, err = d.Int64(); err != nil {
 					return err
 				}
@@ -100,5 +120,4 @@ func (r *OffsetCommitRequest) Version() int16 {
 
 func (r *OffsetCommitRequest) Key() int16 {
 	return OffsetCommitKey
-
 }
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetCommitRequest(t *testing.T) {
+	metadata := "metadata"
+	for _, exp := range []*OffsetCommitRequest{
+		{
+			APIVersion: 0,
+			GroupID:    "test-group",
+			Topics: []OffsetCommitTopicRequest{{
+				Topic:      "test-topic",
+				Partitions: []OffsetCommitPartitionRequest{{Partition: 1, Offset: 10, Metadata: &metadata}},
+			}},
+		},
+		{
+			APIVersion:   1,
+			GroupID:      "test-group",
+			GenerationID: 2,
+			MemberID:     "member",
+			Topics: []OffsetCommitTopicRequest{{
+				Topic:      "test-topic",
+				Partitions: []OffsetCommitPartitionRequest{{Partition: 1, Offset: 10, Timestamp: 100}},
+			}},
+		},
+		{
+			APIVersion:    2,
+			GroupID:       "test-group",
+			GenerationID:  2,
+			MemberID:      "member",
+			RetentionTime: 1000,
+			Topics: []OffsetCommitTopicRequest{{
+				Topic:      "test-topic",
+				Partitions: []OffsetCommitPartitionRequest{{Partition: 1, Offset: 10}, {Partition: 2, Offset: 20}},
+			}},
+		},
+	} {
+		req := require.New(t)
+		b, err := Encode(exp)
+		req.NoError(err)
+		var act OffsetCommitRequest
+		err = Decode(b, &act, exp.Version())
+		req.NoError(err)
+		req.Equal(exp, &act)
+	}
+}
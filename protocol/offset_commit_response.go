@@ -57,7 +57,8 @@ func (r *OffsetCommitResponse) Decode(d PacketDecoder, version int16) (err error
 		return err
 	}
 	r.Responses = make([]OffsetCommitTopicResponse, topicCount)
-	for _, t := range r.Responses {
+	for i := range r.Responses {
+		t := &r.Responses[i]
 		if t.Topic, err = d.String(); err != nil {
 			return err
 		}
@@ -66,7 +67,8 @@ func (r *OffsetCommitResponse) Decode(d PacketDecoder, version int16) (err error
 			return err
 		}
 		t.PartitionResponses = make([]OffsetCommitPartitionResponse, partitionCount)
-		for _, p := range t.PartitionResponses {
+		for j := range t.PartitionResponses {
+			p := &t.PartitionResponses[j]
 			p.Partition, err = d.Int32()
 			if err != nil {
 				return err
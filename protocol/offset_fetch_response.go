@@ -7,7 +7,7 @@ type OffsetFetchTopicResponse struct {
 
 type OffsetFetchPartition struct {
 	Partition int32
-	Offset    int16
+	Offset    int64
 	Metadata  *string
 	ErrorCode int16
 }
@@ -31,7 +31,7 @@ func (r *OffsetFetchResponse) Encode(e PacketEncoder) (err error) {
 		}
 		for _, p := range resp.Partitions {
 			e.PutInt32(p.Partition)
-			e.PutInt16(p.Offset)
+			e.PutInt64(p.Offset)
 			if err := e.PutNullableString(p.Metadata); err != nil {
 				return err
 			}
@@ -49,7 +49,8 @@ func (r *OffsetFetchResponse) Decode(d PacketDecoder, version int16) (err error)
 		return err
 	}
 	r.Responses = make([]OffsetFetchTopicResponse, responses)
-	for _, resp := range r.Responses {
+	for i := range r.Responses {
+		resp := &r.Responses[i]
 		if resp.Topic, err = d.String(); err != nil {
 			return err
 		}
@@ -58,11 +59,12 @@ func (r *OffsetFetchResponse) Decode(d PacketDecoder, version int16) (err error)
 			return err
 		}
 		resp.Partitions = make([]OffsetFetchPartition, partitions)
-		for _, p := range resp.Partitions {
+		for j := range resp.Partitions {
+			p := &resp.Partitions[j]
 			if p.Partition, err = d.Int32(); err != nil {
 				return err
 			}
-			if p.Offset, err = d.Int16(); err != nil {
+			if p.Offset, err = d.Int64(); err != nil {
 				return err
 			}
 			if p.Metadata, err = d.NullableString(); err != nil {
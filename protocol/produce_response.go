@@ -3,11 +3,25 @@ package protocol
 import "time"
 
 type ProducePartitionResponse struct {
-	Partition      int32
-	ErrorCode      int16
-	BaseOffset     int64
+	Partition  int32
+	ErrorCode  int16
+	BaseOffset int64
+	// LogAppendTime is when the records were appended if the topic's
+	// timestamps are the log append time, otherwise it's zero and sent as -1.
 	LogAppendTime  time.Time
 	LogStartOffset int64
+	// RecordErrors are the batches that caused the partition's error.
+	RecordErrors []*RecordError
+	ErrorMessage *string
+	// CurrentLeader is set when the request was sent to a broker that isn't the
+	// partition's leader.
+	CurrentLeader LeaderIDAndEpoch
+}
+
+// RecordError is a batch in a produce request that was rejected.
+type RecordError struct {
+	BatchIndex             int32
+	BatchIndexErrorMessage *string
 }
 
 type ProduceTopicResponse struct {
@@ -20,6 +34,8 @@ type ProduceResponse struct {
 
 	Responses    []*ProduceTopicResponse
 	ThrottleTime time.Duration
+	// NodeEndpoints are the endpoints of the leaders in the partitions' CurrentLeader.
+	NodeEndpoints []*Broker
 }
 
 func (r *ProduceResponse) Encode(e PacketEncoder) (err error) {
@@ -36,18 +52,46 @@ func (r *ProduceResponse) Encode(e PacketEncoder) (err error) {
 		for _, p := range resp.PartitionResponses {
 			e.PutInt32(p.Partition)
 			e.PutInt16(p.ErrorCode)
+			e.PutInt64(p.BaseOffset)
 			if r.APIVersion >= 2 {
-				e.PutInt64(p.BaseOffset)
-				e.PutInt64(int64(p.LogAppendTime.UnixNano() / int64(time.Millisecond)))
+				millis := int64(-1)
+				if !p.LogAppendTime.IsZero() {
+					millis = p.LogAppendTime.UnixNano() / int64(time.Millisecond)
+				}
+				e.PutInt64(millis)
 			}
 			if r.APIVersion >= 5 {
 				e.PutInt64(p.LogStartOffset)
 			}
+			if r.APIVersion >= 8 {
+				if err = e.PutArrayLength(len(p.RecordErrors)); err != nil {
+					return err
+				}
+				for _, re := range p.RecordErrors {
+					e.PutInt32(re.BatchIndex)
+					if err = e.PutNullableString(re.BatchIndexErrorMessage); err != nil {
+						return err
+					}
+				}
+				if err = e.PutNullableString(p.ErrorMessage); err != nil {
+					return err
+				}
+			}
+			if r.APIVersion >= 10 {
+				if err = p.CurrentLeader.Encode(e); err != nil {
+					return err
+				}
+			}
 		}
 	}
 	if r.APIVersion >= 1 {
 		e.PutInt32(int32(r.ThrottleTime / time.Millisecond))
 	}
+	if r.APIVersion >= 10 {
+		if err = encodeNodeEndpoints(e, r.NodeEndpoints); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -95,7 +139,9 @@ func (r *ProduceResponse) Decode(d PacketDecoder, version int16) (err error) {
 				if err != nil {
 					return err
 				}
-				p.LogAppendTime = time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond))
+				if millis != -1 {
+					p.LogAppendTime = time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond))
+				}
 			}
 			if r.APIVersion >= 5 {
 				p.LogStartOffset, err = d.Int64()
@@ -103,6 +149,30 @@ func (r *ProduceResponse) Decode(d PacketDecoder, version int16) (err error) {
 					return err
 				}
 			}
+			if r.APIVersion >= 8 {
+				n, err := d.ArrayLength()
+				if err != nil {
+					return err
+				}
+				for k := 0; k < n; k++ {
+					re := new(RecordError)
+					if re.BatchIndex, err = d.Int32(); err != nil {
+						return err
+					}
+					if re.BatchIndexErrorMessage, err = d.NullableString(); err != nil {
+						return err
+					}
+					p.RecordErrors = append(p.RecordErrors, re)
+				}
+				if p.ErrorMessage, err = d.NullableString(); err != nil {
+					return err
+				}
+			}
+			if r.APIVersion >= 10 {
+				if err = p.CurrentLeader.Decode(d, version); err != nil {
+					return err
+				}
+			}
 		}
 		resp.PartitionResponses = ps
 	}
@@ -113,6 +183,10 @@ func (r *ProduceResponse) Decode(d PacketDecoder, version int16) (err error) {
 		}
 		r.ThrottleTime = time.Duration(throttle) * time.Millisecond
 	}
+	if r.APIVersion >= 10 {
+		if r.NodeEndpoints, err = decodeNodeEndpoints(d); err != nil {
+			return err
+		}
+	}
 	return nil
-
 }
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProduceResponse(t *testing.T) {
+	req := require.New(t)
+	appendTime := time.Unix(1500000000, 123*int64(time.Millisecond))
+	exp := &ProduceResponse{
+		APIVersion: 5,
+		Responses: []*ProduceTopicResponse{{
+			Topic: "test",
+			PartitionResponses: []*ProducePartitionResponse{
+				{Partition: 0, BaseOffset: 10, LogAppendTime: appendTime, LogStartOffset: 2},
+				// create time topics and failed appends have no append time
+				{Partition: 1, BaseOffset: 20, LogStartOffset: 0},
+				{Partition: 2, ErrorCode: ErrNotLeaderForPartition.Code(), BaseOffset: -1, LogStartOffset: -1},
+			},
+		}},
+		ThrottleTime: time.Millisecond,
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act ProduceResponse
+	req.NoError(Decode(b, &act, exp.APIVersion))
+	req.Equal(exp, &act)
+}
+
+func TestProduceResponseCurrentLeader(t *testing.T) {
+	req := require.New(t)
+	exp := &ProduceResponse{
+		APIVersion: 10,
+		Responses: []*ProduceTopicResponse{{
+			Topic: "test",
+			PartitionResponses: []*ProducePartitionResponse{{
+				Partition:      0,
+				ErrorCode:      ErrNotLeaderForPartition.Code(),
+				BaseOffset:     -1,
+				LogStartOffset: -1,
+				CurrentLeader:  LeaderIDAndEpoch{LeaderID: 2, LeaderEpoch: 3},
+			}},
+		}},
+		NodeEndpoints: []*Broker{{NodeID: 2, Host: "localhost", Port: 9092}},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act ProduceResponse
+	req.NoError(Decode(b, &act, exp.APIVersion))
+	req.Equal(exp, &act)
+}
@@ -0,0 +1,31 @@
+package protocol
+
+// ReadIndexRequest is a Jocko extension asking the controller for the index
+// of the metadata log a broker has to apply before its metadata reflects every
+// change made before the request, so it can serve linearizable reads.
+type ReadIndexRequest struct {
+	APIVersion int16
+
+	// Unverified has the controller answer without confirming with a quorum
+	// of the brokers that it's still the controller.
+	Unverified bool
+}
+
+func (r *ReadIndexRequest) Encode(e PacketEncoder) error {
+	e.PutBool(r.Unverified)
+	return nil
+}
+
+func (r *ReadIndexRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	r.Unverified, err = d.Bool()
+	return err
+}
+
+func (r *ReadIndexRequest) Key() int16 {
+	return ReadIndexKey
+}
+
+func (r *ReadIndexRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,33 @@
+package protocol
+
+type ReadIndexResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	// Index is the index of the metadata log the controller had applied when
+	// it handled the request.
+	Index int64
+}
+
+func (r *ReadIndexResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	e.PutInt64(r.Index)
+	return nil
+}
+
+func (r *ReadIndexResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	r.Index, err = d.Int64()
+	return err
+}
+
+func (r *ReadIndexResponse) Key() int16 {
+	return ReadIndexKey
+}
+
+func (r *ReadIndexResponse) Version() int16 {
+	return r.APIVersion
+}
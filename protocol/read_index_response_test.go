@@ -0,0 +1,17 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadIndexResponse(t *testing.T) {
+	req := require.New(t)
+	exp := &ReadIndexResponse{Index: 1024}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act ReadIndexResponse
+	req.NoError(Decode(b, &act, exp.Version()))
+	req.Equal(exp, &act)
+}
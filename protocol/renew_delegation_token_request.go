@@ -0,0 +1,45 @@
+package protocol
+
+import "time"
+
+// https://kafka.apache.org/protocol#The_Messages_RenewDelegationToken
+
+// RenewDelegationTokenRequest pushes back the expiry of the token with the
+// HMAC. It's sent by the token's owner or one of its renewers.
+type RenewDelegationTokenRequest struct {
+	APIVersion int16
+
+	HMAC []byte
+	// RenewPeriod is how long from now the token expires, up to its max
+	// timestamp, or -1 for the broker's default.
+	RenewPeriod time.Duration
+}
+
+func (r *RenewDelegationTokenRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutBytes(r.HMAC); err != nil {
+		return err
+	}
+	e.PutInt64(int64(r.RenewPeriod / time.Millisecond))
+	return nil
+}
+
+func (r *RenewDelegationTokenRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.HMAC, err = d.Bytes(); err != nil {
+		return err
+	}
+	period, err := d.Int64()
+	if err != nil {
+		return err
+	}
+	r.RenewPeriod = time.Duration(period) * time.Millisecond
+	return nil
+}
+
+func (r *RenewDelegationTokenRequest) Key() int16 {
+	return RenewDelegationTokenKey
+}
+
+func (r *RenewDelegationTokenRequest) Version() int16 {
+	return r.APIVersion
+}
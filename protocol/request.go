@@ -26,3 +26,101 @@ func (r *Request) Encode(pe PacketEncoder) (err error) {
 	pe.Pop()
 	return nil
 }
+
+// NewRequest returns a request of the API's type to decode the body of a
+// request with the key into, or nil if the key isn't an API's.
+func NewRequest(key int16) VersionedDecoder {
+	switch key {
+	case ProduceKey:
+		return &ProduceRequest{}
+	case FetchKey:
+		return &FetchRequest{}
+	case OffsetsKey:
+		return &OffsetsRequest{}
+	case MetadataKey:
+		return &MetadataRequest{}
+	case LeaderAndISRKey:
+		return &LeaderAndISRRequest{}
+	case StopReplicaKey:
+		return &StopReplicaRequest{}
+	case UpdateMetadataKey:
+		return &UpdateMetadataRequest{}
+	case ControlledShutdownKey:
+		return &ControlledShutdownRequest{}
+	case OffsetCommitKey:
+		return &OffsetCommitRequest{}
+	case OffsetFetchKey:
+		return &OffsetFetchRequest{}
+	case FindCoordinatorKey:
+		return &FindCoordinatorRequest{}
+	case JoinGroupKey:
+		return &JoinGroupRequest{}
+	case HeartbeatKey:
+		return &HeartbeatRequest{}
+	case LeaveGroupKey:
+		return &LeaveGroupRequest{}
+	case SyncGroupKey:
+		return &SyncGroupRequest{}
+	case DescribeGroupsKey:
+		return &DescribeGroupsRequest{}
+	case ListGroupsKey:
+		return &ListGroupsRequest{}
+	case SaslHandshakeKey:
+		return &SaslHandshakeRequest{}
+	case APIVersionsKey:
+		return &APIVersionsRequest{}
+	case CreateTopicsKey:
+		return &CreateTopicRequests{}
+	case DeleteTopicsKey:
+		return &DeleteTopicsRequest{}
+	case AlterConfigsKey:
+		return &AlterConfigsRequest{}
+	case DescribeConfigsKey:
+		return &DescribeConfigsRequest{}
+	case SaslAuthenticateKey:
+		return &SaslAuthenticateRequest{}
+	case CreateDelegationTokenKey:
+		return &CreateDelegationTokenRequest{}
+	case RenewDelegationTokenKey:
+		return &RenewDelegationTokenRequest{}
+	case ExpireDelegationTokenKey:
+		return &ExpireDelegationTokenRequest{}
+	case DescribeDelegationTokenKey:
+		return &DescribeDelegationTokenRequest{}
+	case NackKey:
+		return &NackRequest{}
+	case FilteredFetchKey:
+		return &FilteredFetchRequest{}
+	case ShareFetchKey:
+		return &ShareFetchRequest{}
+	case ShareAcknowledgeKey:
+		return &ShareAcknowledgeRequest{}
+	case InitProducerIDKey:
+		return &InitProducerIDRequest{}
+	case EndTxnKey:
+		return &EndTxnRequest{}
+	case TxnOffsetCommitKey:
+		return &TxnOffsetCommitRequest{}
+	case WriteTxnMarkersKey:
+		return &WriteTxnMarkersRequest{}
+	case DescribeTrafficKey:
+		return &DescribeTrafficRequest{}
+	case AlterPartitionReadOnlyKey:
+		return &AlterPartitionReadOnlyRequest{}
+	case AlterBrokerMaintenanceKey:
+		return &AlterBrokerMaintenanceRequest{}
+	case AlterFaultInjectionKey:
+		return &AlterFaultInjectionRequest{}
+	case AlterOffsetsTopicPartitionsKey:
+		return &AlterOffsetsTopicPartitionsRequest{}
+	case DescribeClockKey:
+		return &DescribeClockRequest{}
+	case DescribeLogStatsKey:
+		return &DescribeLogStatsRequest{}
+	case ReadIndexKey:
+		return &ReadIndexRequest{}
+	case TransactionalProduceKey:
+		return &TransactionalProduceRequest{}
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package protocol
+
+// The builders here construct valid responses for mock brokers, conformance
+// tests, and tools without each of them knowing how every response is laid
+// out.
+
+// NewResponseBody returns an empty response to the API with the key at the
+// version, e.g. to decode a response into, or nil if the API isn't one this
+// package knows.
+func NewResponseBody(key, version int16) ResponseBody {
+	switch key {
+	case ProduceKey:
+		return &ProduceResponse{APIVersion: version}
+	case FetchKey:
+		return &FetchResponse{APIVersion: version}
+	case OffsetsKey:
+		return &OffsetsResponse{APIVersion: version}
+	case MetadataKey:
+		return &MetadataResponse{APIVersion: version}
+	case LeaderAndISRKey:
+		return &LeaderAndISRResponse{APIVersion: version}
+	case StopReplicaKey:
+		return &StopReplicaResponse{}
+	case UpdateMetadataKey:
+		return &UpdateMetadataResponse{}
+	case ControlledShutdownKey:
+		return &ControlledShutdownResponse{APIVersion: version}
+	case OffsetCommitKey:
+		return &OffsetCommitResponse{APIVersion: version}
+	case OffsetFetchKey:
+		return &OffsetFetchResponse{APIVersion: version}
+	case FindCoordinatorKey:
+		return &FindCoordinatorResponse{APIVersion: version}
+	case JoinGroupKey:
+		return &JoinGroupResponse{APIVersion: version}
+	case HeartbeatKey:
+		return &HeartbeatResponse{APIVersion: version}
+	case LeaveGroupKey:
+		return &LeaveGroupResponse{APIVersion: version}
+	case SyncGroupKey:
+		return &SyncGroupResponse{APIVersion: version}
+	case DescribeGroupsKey:
+		return &DescribeGroupsResponse{APIVersion: version}
+	case ListGroupsKey:
+		return &ListGroupsResponse{APIVersion: version}
+	case SaslHandshakeKey:
+		return &SaslHandshakeResponse{APIVersion: version}
+	case APIVersionsKey:
+		return &APIVersionsResponse{APIVersion: version}
+	case CreateTopicsKey:
+		return &CreateTopicsResponse{APIVersion: version}
+	case DeleteTopicsKey:
+		return &DeleteTopicsResponse{APIVersion: version}
+	case InitProducerIDKey:
+		return &InitProducerIDResponse{APIVersion: version}
+	case EndTxnKey:
+		return &EndTxnResponse{APIVersion: version}
+	case TxnOffsetCommitKey:
+		return &TxnOffsetCommitResponse{APIVersion: version}
+	case WriteTxnMarkersKey:
+		return &WriteTxnMarkersResponse{APIVersion: version}
+	case DescribeConfigsKey:
+		return &DescribeConfigsResponse{APIVersion: version}
+	case AlterConfigsKey:
+		return &AlterConfigsResponse{APIVersion: version}
+	case SaslAuthenticateKey:
+		return &SaslAuthenticateResponse{APIVersion: version}
+	case CreateDelegationTokenKey:
+		return &CreateDelegationTokenResponse{APIVersion: version}
+	case RenewDelegationTokenKey:
+		return &RenewDelegationTokenResponse{APIVersion: version}
+	case ExpireDelegationTokenKey:
+		return &ExpireDelegationTokenResponse{APIVersion: version}
+	case DescribeDelegationTokenKey:
+		return &DescribeDelegationTokenResponse{APIVersion: version}
+	case NackKey:
+		return &NackResponse{APIVersion: version}
+	case FilteredFetchKey:
+		return &FilteredFetchResponse{APIVersion: version}
+	case ShareFetchKey:
+		return &ShareFetchResponse{APIVersion: version}
+	case ShareAcknowledgeKey:
+		return &ShareAcknowledgeResponse{APIVersion: version}
+	case DescribeTrafficKey:
+		return &DescribeTrafficResponse{APIVersion: version}
+	case AlterPartitionReadOnlyKey:
+		return &AlterPartitionReadOnlyResponse{APIVersion: version}
+	case AlterBrokerMaintenanceKey:
+		return &AlterBrokerMaintenanceResponse{APIVersion: version}
+	case AlterFaultInjectionKey:
+		return &AlterFaultInjectionResponse{APIVersion: version}
+	case AlterOffsetsTopicPartitionsKey:
+		return &AlterOffsetsTopicPartitionsResponse{APIVersion: version}
+	case DescribeClockKey:
+		return &DescribeClockResponse{APIVersion: version}
+	case DescribeLogStatsKey:
+		return &DescribeLogStatsResponse{APIVersion: version}
+	case ReadIndexKey:
+		return &ReadIndexResponse{APIVersion: version}
+	case TransactionalProduceKey:
+		return &TransactionalProduceResponse{APIVersion: version}
+	}
+	return nil
+}
+
+// ErrorResponse returns the response to the request, at its version, with each
+// of the topics, partitions, groups, or resources in it failed with err, or
+// with the response's error code set to err for requests without any. It
+// returns nil for requests this package doesn't know.
+func ErrorResponse(req Body, err Error) ResponseBody {
+	code := err.Code()
+	var msg *string
+	if err != ErrNone {
+		s := err.Error()
+		msg = &s
+	}
+	version := req.Version()
+	switch req := req.(type) {
+	case *ProduceRequest:
+		res := &ProduceResponse{APIVersion: version}
+		for _, td := range req.TopicData {
+			tres := &ProduceTopicResponse{Topic: td.Topic}
+			for _, d := range td.Data {
+				tres.PartitionResponses = append(tres.PartitionResponses, &ProducePartitionResponse{
+					Partition:      d.Partition,
+					ErrorCode:      code,
+					BaseOffset:     -1,
+					LogStartOffset: -1,
+					ErrorMessage:   msg,
+				})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *TransactionalProduceRequest:
+		res := &TransactionalProduceResponse{APIVersion: version, Produce: &ProduceResponse{}}
+		if req.Produce != nil {
+			res.Produce = ErrorResponse(req.Produce, err).(*ProduceResponse)
+		}
+		return res
+	case *FetchRequest:
+		return fetchErrorResponse(req, code)
+	case *FilteredFetchRequest:
+		res := &FilteredFetchResponse{APIVersion: version, Fetch: &FetchResponse{}}
+		if req.Fetch != nil {
+			res.Fetch = fetchErrorResponse(req.Fetch, code)
+			for _, t := range req.Fetch.Topics {
+				for _, p := range t.Partitions {
+					res.Partitions = append(res.Partitions, &FilteredFetchPartition{
+						Topic:      t.Topic,
+						Partition:  p.Partition,
+						NextOffset: p.FetchOffset,
+					})
+				}
+			}
+		}
+		return res
+	case *OffsetsRequest:
+		res := &OffsetsResponse{APIVersion: version}
+		for _, t := range req.Topics {
+			tres := &OffsetResponse{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.PartitionResponses = append(tres.PartitionResponses, &PartitionResponse{
+					Partition: p.Partition,
+					ErrorCode: code,
+					Offset:    -1,
+				})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *MetadataRequest:
+		res := &MetadataResponse{APIVersion: version, ControllerID: -1}
+		for _, t := range req.Topics {
+			res.TopicMetadata = append(res.TopicMetadata, &TopicMetadata{Topic: t, TopicErrorCode: code})
+		}
+		for _, id := range req.TopicIDs {
+			res.TopicMetadata = append(res.TopicMetadata, &TopicMetadata{TopicID: id, TopicErrorCode: code})
+		}
+		return res
+	case *LeaderAndISRRequest:
+		res := &LeaderAndISRResponse{APIVersion: version, ErrorCode: code}
+		for _, p := range req.PartitionStates {
+			res.Partitions = append(res.Partitions, &LeaderAndISRPartition{Topic: p.Topic, Partition: p.Partition, ErrorCode: code})
+		}
+		return res
+	case *StopReplicaRequest:
+		res := &StopReplicaResponse{ErrorCode: code}
+		for _, p := range req.Partitions {
+			res.Partitions = append(res.Partitions, &StopReplicaResponsePartition{Topic: p.Topic, Partition: p.Partition, ErrorCode: code})
+		}
+		return res
+	case *UpdateMetadataRequest:
+		return &UpdateMetadataResponse{ErrorCode: code}
+	case *ControlledShutdownRequest:
+		return &ControlledShutdownResponse{APIVersion: version, ErrorCode: code}
+	case *OffsetCommitRequest:
+		res := &OffsetCommitResponse{APIVersion: version}
+		for _, t := range req.Topics {
+			tres := OffsetCommitTopicResponse{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.PartitionResponses = append(tres.PartitionResponses, OffsetCommitPartitionResponse{Partition: p.Partition, ErrorCode: code})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *OffsetFetchRequest:
+		res := &OffsetFetchResponse{APIVersion: version}
+		for _, t := range req.Topics {
+			tres := OffsetFetchTopicResponse{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.Partitions = append(tres.Partitions, OffsetFetchPartition{Partition: p, Offset: -1, ErrorCode: code})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *FindCoordinatorRequest:
+		return &FindCoordinatorResponse{APIVersion: version, ErrorCode: code, ErrorMessage: msg, Coordinator: Coordinator{NodeID: -1}}
+	case *JoinGroupRequest:
+		return &JoinGroupResponse{APIVersion: version, ErrorCode: code, GenerationID: -1, MemberID: req.MemberID}
+	case *HeartbeatRequest:
+		return &HeartbeatResponse{APIVersion: version, ErrorCode: code}
+	case *LeaveGroupRequest:
+		return &LeaveGroupResponse{APIVersion: version, ErrorCode: code}
+	case *SyncGroupRequest:
+		return &SyncGroupResponse{APIVersion: version, ErrorCode: code}
+	case *DescribeGroupsRequest:
+		res := &DescribeGroupsResponse{APIVersion: version}
+		for _, id := range req.GroupIDs {
+			res.Groups = append(res.Groups, Group{GroupID: id, ErrorCode: code})
+		}
+		return res
+	case *ListGroupsRequest:
+		return &ListGroupsResponse{APIVersion: version, ErrorCode: code}
+	case *SaslHandshakeRequest:
+		return &SaslHandshakeResponse{APIVersion: version, ErrorCode: code}
+	case *APIVersionsRequest:
+		return &APIVersionsResponse{APIVersion: version, ErrorCode: code, APIVersions: APIVersions}
+	case *CreateTopicRequests:
+		res := &CreateTopicsResponse{APIVersion: version}
+		for _, t := range req.Requests {
+			res.TopicErrorCodes = append(res.TopicErrorCodes, &TopicErrorCode{Topic: t.Topic, ErrorCode: code, ErrorMessage: msg})
+		}
+		return res
+	case *DeleteTopicsRequest:
+		res := &DeleteTopicsResponse{APIVersion: version}
+		for _, t := range req.Topics {
+			res.TopicErrorCodes = append(res.TopicErrorCodes, &TopicErrorCode{Topic: t, ErrorCode: code, ErrorMessage: msg})
+		}
+		return res
+	case *InitProducerIDRequest:
+		return &InitProducerIDResponse{APIVersion: version, ErrorCode: code, ProducerID: -1, ProducerEpoch: -1}
+	case *EndTxnRequest:
+		return &EndTxnResponse{APIVersion: version, ErrorCode: code}
+	case *TxnOffsetCommitRequest:
+		res := &TxnOffsetCommitResponse{APIVersion: version}
+		for _, t := range req.Topics {
+			tres := OffsetCommitTopicResponse{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.PartitionResponses = append(tres.PartitionResponses, OffsetCommitPartitionResponse{Partition: p.Partition, ErrorCode: code})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *WriteTxnMarkersRequest:
+		return writeTxnMarkersErrorResponse(req, code)
+	case *DescribeConfigsRequest:
+		res := &DescribeConfigsResponse{APIVersion: version}
+		for _, r := range req.Resources {
+			res.Resources = append(res.Resources, DescribeConfigsResourceResponse{Type: r.Type, Name: r.Name, ErrorCode: code, ErrorMessage: msg})
+		}
+		return res
+	case *AlterConfigsRequest:
+		res := &AlterConfigsResponse{APIVersion: version}
+		for _, r := range req.Resources {
+			res.Resources = append(res.Resources, AlterConfigResourceResponse{Type: r.Type, Name: r.Name, ErrorCode: code, ErrorMessage: msg})
+		}
+		return res
+	case *SaslAuthenticateRequest:
+		return &SaslAuthenticateResponse{APIVersion: version, ErrorCode: code, ErrorMessage: msg}
+	case *CreateDelegationTokenRequest:
+		return &CreateDelegationTokenResponse{APIVersion: version, ErrorCode: code}
+	case *RenewDelegationTokenRequest:
+		return &RenewDelegationTokenResponse{APIVersion: version, ErrorCode: code}
+	case *ExpireDelegationTokenRequest:
+		return &ExpireDelegationTokenResponse{APIVersion: version, ErrorCode: code}
+	case *DescribeDelegationTokenRequest:
+		return &DescribeDelegationTokenResponse{APIVersion: version, ErrorCode: code}
+	case *NackRequest:
+		res := &NackResponse{APIVersion: version}
+		for _, t := range req.Topics {
+			tres := &NackTopicResponse{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.Partitions = append(tres.Partitions, &NackPartitionResponse{Partition: p.Partition, ErrorCode: code})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *ShareFetchRequest:
+		res := &ShareFetchResponse{APIVersion: version, ErrorCode: code}
+		for _, t := range req.Topics {
+			tres := &ShareFetchTopicResponse{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.Partitions = append(tres.Partitions, &ShareFetchPartitionResponse{Partition: p, ErrorCode: code})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *ShareAcknowledgeRequest:
+		res := &ShareAcknowledgeResponse{APIVersion: version}
+		for _, t := range req.Topics {
+			tres := &ShareAcknowledgeTopicResponse{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.Partitions = append(tres.Partitions, &ShareAcknowledgePartitionResponse{Partition: p.Partition, ErrorCode: code})
+			}
+			res.Responses = append(res.Responses, tres)
+		}
+		return res
+	case *DescribeTrafficRequest:
+		return &DescribeTrafficResponse{APIVersion: version, ErrorCode: code}
+	case *AlterPartitionReadOnlyRequest:
+		res := &AlterPartitionReadOnlyResponse{APIVersion: version}
+		for _, p := range req.Partitions {
+			res.Partitions = append(res.Partitions, &AlterPartitionReadOnlyResult{Topic: p.Topic, Partition: p.Partition, ErrorCode: code})
+		}
+		return res
+	case *AlterBrokerMaintenanceRequest:
+		return &AlterBrokerMaintenanceResponse{APIVersion: version, ErrorCode: code}
+	case *AlterFaultInjectionRequest:
+		res := &AlterFaultInjectionResponse{APIVersion: version}
+		for _, f := range req.Faults {
+			res.Faults = append(res.Faults, &AlterFaultInjectionResult{Point: f.Point, ErrorCode: code})
+		}
+		return res
+	case *AlterOffsetsTopicPartitionsRequest:
+		return &AlterOffsetsTopicPartitionsResponse{APIVersion: version, ErrorCode: code}
+	case *DescribeClockRequest:
+		return &DescribeClockResponse{APIVersion: version, ErrorCode: code}
+	case *DescribeLogStatsRequest:
+		return &DescribeLogStatsResponse{APIVersion: version, ErrorCode: code}
+	case *ReadIndexRequest:
+		return &ReadIndexResponse{APIVersion: version, ErrorCode: code}
+	}
+	return nil
+}
+
+func fetchErrorResponse(req *FetchRequest, code int16) *FetchResponse {
+	res := &FetchResponse{APIVersion: req.Version()}
+	for _, t := range req.Topics {
+		tres := &FetchTopicResponse{Topic: t.Topic, TopicID: t.TopicID}
+		for _, p := range t.Partitions {
+			tres.PartitionResponses = append(tres.PartitionResponses, &FetchPartitionResponse{
+				Partition:        p.Partition,
+				ErrorCode:        code,
+				HighWatermark:    -1,
+				LastStableOffset: -1,
+			})
+		}
+		res.Responses = append(res.Responses, tres)
+	}
+	return res
+}
+
+func writeTxnMarkersErrorResponse(req *WriteTxnMarkersRequest, code int16) *WriteTxnMarkersResponse {
+	res := &WriteTxnMarkersResponse{APIVersion: req.Version()}
+	for _, m := range req.Markers {
+		mres := &WritableTxnMarkerResult{ProducerID: m.ProducerID}
+		for _, t := range m.Topics {
+			tres := &WritableTxnMarkerTopicResult{Topic: t.Topic}
+			for _, p := range t.Partitions {
+				tres.Partitions = append(tres.Partitions, &WritableTxnMarkerPartitionResult{Partition: p, ErrorCode: code})
+			}
+			mres.Topics = append(mres.Topics, tres)
+		}
+		res.Markers = append(res.Markers, mres)
+	}
+	return res
+}
+
+// EncodeResponse encodes the response as it's written on the wire, with its
+// size and the correlation ID of the request it answers.
+func EncodeResponse(correlationID int32, body ResponseBody) ([]byte, error) {
+	return Encode(&Response{CorrelationID: correlationID, Body: body})
+}
+
+// DecodeResponse decodes a response to the API with the key at the version as
+// it's read off the wire, with its size, and returns the correlation ID of the
+// request it answers.
+func DecodeResponse(b []byte, key, version int16) (int32, ResponseBody, error) {
+	body := NewResponseBody(key, version)
+	if body == nil {
+		return 0, nil, ErrUnsupportedVersion
+	}
+	d := NewDecoder(b)
+	size, err := d.Int32()
+	if err != nil {
+		return 0, nil, err
+	}
+	if int(size) != len(b)-4 {
+		return 0, nil, ErrInsufficientData
+	}
+	correlationID, err := d.Int32()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := body.Decode(d, version); err != nil {
+		return 0, nil, err
+	}
+	return correlationID, body, nil
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewResponseBody(t *testing.T) {
+	for _, v := range APIVersions {
+		require.NotNil(t, NewResponseBody(v.APIKey, v.MaxVersion), "api key %d", v.APIKey)
+	}
+	require.Nil(t, NewResponseBody(-1, 0))
+}
+
+func TestErrorResponse(t *testing.T) {
+	req := require.New(t)
+	exp := ErrorResponse(&ProduceRequest{
+		APIVersion: 2,
+		TopicData: []*TopicData{{
+			Topic: "test",
+			Data:  []*Data{{Partition: 0}, {Partition: 1}},
+		}},
+	}, ErrNotLeaderForPartition).(*ProduceResponse)
+	req.Equal(2, len(exp.Responses[0].PartitionResponses))
+	req.Equal(ErrNotLeaderForPartition.Code(), exp.Responses[0].PartitionResponses[1].ErrorCode)
+
+	b, err := EncodeResponse(7, exp)
+	req.NoError(err)
+	correlationID, body, err := DecodeResponse(b, ProduceKey, 2)
+	req.NoError(err)
+	req.Equal(int32(7), correlationID)
+	act := body.(*ProduceResponse)
+	req.Equal(exp.Responses[0].Topic, act.Responses[0].Topic)
+	req.Equal(exp.Responses[0].PartitionResponses[1].ErrorCode, act.Responses[0].PartitionResponses[1].ErrorCode)
+	req.Equal(int64(-1), act.Responses[0].PartitionResponses[1].BaseOffset)
+
+	_, _, err = DecodeResponse(b[:len(b)-1], ProduceKey, 2)
+	req.Equal(ErrInsufficientData, err)
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import "time"
+
+// RetryRecord is the value of a record routed to a retry or dead-letter topic.
+// It wraps the failed record with where it came from and how many times
+// processing it has failed.
+type RetryRecord struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Attempts  int32
+	Reason    *string
+	Timestamp time.Time
+	Key       []byte
+	Value     []byte
+}
+
+func (r *RetryRecord) Encode(e PacketEncoder) (err error) {
+	if err = e.PutString(r.Topic); err != nil {
+		return err
+	}
+	e.PutInt32(r.Partition)
+	e.PutInt64(r.Offset)
+	e.PutInt32(r.Attempts)
+	if err = e.PutNullableString(r.Reason); err != nil {
+		return err
+	}
+	e.PutInt64(r.Timestamp.UnixNano() / int64(time.Millisecond))
+	if err = e.PutBytes(r.Key); err != nil {
+		return err
+	}
+	return e.PutBytes(r.Value)
+}
+
+func (r *RetryRecord) Decode(d PacketDecoder) (err error) {
+	if r.Topic, err = d.String(); err != nil {
+		return err
+	}
+	if r.Partition, err = d.Int32(); err != nil {
+		return err
+	}
+	if r.Offset, err = d.Int64(); err != nil {
+		return err
+	}
+	if r.Attempts, err = d.Int32(); err != nil {
+		return err
+	}
+	if r.Reason, err = d.NullableString(); err != nil {
+		return err
+	}
+	t, err := d.Int64()
+	if err != nil {
+		return err
+	}
+	r.Timestamp = time.Unix(t/1000, (t%1000)*int64(time.Millisecond))
+	if r.Key, err = d.Bytes(); err != nil {
+		return err
+	}
+	r.Value, err = d.Bytes()
+	return err
+}
@@ -0,0 +1,29 @@
+package protocol
+
+// https://kafka.apache.org/protocol#The_Messages_SaslAuthenticate
+
+// SaslAuthenticateRequest carries a step of the SASL exchange for the mechanism
+// chosen with the connection's SaslHandshakeRequest.
+type SaslAuthenticateRequest struct {
+	APIVersion int16
+
+	AuthBytes []byte
+}
+
+func (r *SaslAuthenticateRequest) Encode(e PacketEncoder) (err error) {
+	return e.PutBytes(r.AuthBytes)
+}
+
+func (r *SaslAuthenticateRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	r.AuthBytes, err = d.Bytes()
+	return err
+}
+
+func (r *SaslAuthenticateRequest) Key() int16 {
+	return SaslAuthenticateKey
+}
+
+func (r *SaslAuthenticateRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import "time"
+
+type SaslAuthenticateResponse struct {
+	APIVersion int16
+
+	ErrorCode    int16
+	ErrorMessage *string
+	AuthBytes    []byte
+	// SessionLifetime is how long the client's authenticated for, e.g. until
+	// the delegation token it authenticated with expires, or zero if it
+	// doesn't expire.
+	SessionLifetime time.Duration
+}
+
+func (r *SaslAuthenticateResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	if err = e.PutNullableString(r.ErrorMessage); err != nil {
+		return err
+	}
+	if err = e.PutBytes(r.AuthBytes); err != nil {
+		return err
+	}
+	if r.APIVersion >= 1 {
+		e.PutInt64(int64(r.SessionLifetime / time.Millisecond))
+	}
+	return nil
+}
+
+func (r *SaslAuthenticateResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	if r.ErrorMessage, err = d.NullableString(); err != nil {
+		return err
+	}
+	if r.AuthBytes, err = d.Bytes(); err != nil {
+		return err
+	}
+	if version >= 1 {
+		lifetime, err := d.Int64()
+		if err != nil {
+			return err
+		}
+		r.SessionLifetime = time.Duration(lifetime) * time.Millisecond
+	}
+	return nil
+}
@@ -1,15 +1,21 @@
 package protocol
 
+// https://kafka.apache.org/protocol#The_Messages_SaslHandshake
+
 type SaslHandshakeRequest struct {
 	APIVersion int16
+
+	Mechanism string
 }
 
 func (r *SaslHandshakeRequest) Encode(e PacketEncoder) (err error) {
-	return nil
+	return e.PutString(r.Mechanism)
 }
 
 func (r *SaslHandshakeRequest) Decode(d PacketDecoder, version int16) (err error) {
-	return nil
+	r.APIVersion = version
+	r.Mechanism, err = d.String()
+	return err
 }
 
 func (r *SaslHandshakeRequest) Key() int16 {
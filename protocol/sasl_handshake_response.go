@@ -1,11 +1,22 @@
 package protocol
 
-type SaslHandshakeResponse struct{}
+type SaslHandshakeResponse struct {
+	APIVersion int16
+
+	ErrorCode         int16
+	EnabledMechanisms []string
+}
 
 func (r *SaslHandshakeResponse) Encode(e PacketEncoder) (err error) {
-	return nil
+	e.PutInt16(r.ErrorCode)
+	return e.PutStringArray(r.EnabledMechanisms)
 }
 
 func (r *SaslHandshakeResponse) Decode(d PacketDecoder, version int16) (err error) {
-	return nil
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	r.EnabledMechanisms, err = d.StringArray()
+	return err
 }
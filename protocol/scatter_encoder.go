@@ -0,0 +1,199 @@
+package protocol
+
+import (
+	"math"
+	"net"
+)
+
+// scatterMinBytes is the size from which byte slices are referenced rather
+// than copied by the scatter encoder.
+const scatterMinBytes = 4096
+
+// EncodeBuffers encodes e like Encode but returns the encoding as buffers that
+// reference e's large byte slices, e.g. a fetch response's record sets,
+// instead of copying them into one buffer. Writing the buffers to a
+// connection uses writev where it's supported.
+func EncodeBuffers(e Encoder) (net.Buffers, error) {
+	enc := new(ScatterEncoder)
+	if err := e.Encode(enc); err != nil {
+		return nil, err
+	}
+	return enc.Buffers(), nil
+}
+
+type scatterPush struct {
+	pe PushEncoder
+	// at is the offset of the pushed field in the encoder's own buffer and off
+	// its offset counting the referenced slices
+	at  int
+	off int
+}
+
+type scatterRef struct {
+	// at is the offset in the encoder's own buffer the slice goes at
+	at int
+	b  []byte
+}
+
+// ScatterEncoder encodes into its own buffer except for large byte slices,
+// which it keeps references to. Size fields are filled in with the referenced
+// slices' sizes, but a slice inside any other pushed field, e.g. a CRC, is
+// copied since the field needs the bytes.
+type ScatterEncoder struct {
+	b    []byte
+	refs []scatterRef
+	// skipped is the number of bytes referenced rather than copied
+	skipped int
+	stack   []scatterPush
+}
+
+// Buffers returns the encoded bytes in order.
+func (e *ScatterEncoder) Buffers() net.Buffers {
+	bufs := make(net.Buffers, 0, 2*len(e.refs)+1)
+	var prev int
+	for _, ref := range e.refs {
+		if ref.at > prev {
+			bufs = append(bufs, e.b[prev:ref.at])
+		}
+		bufs = append(bufs, ref.b)
+		prev = ref.at
+	}
+	if len(e.b) > prev {
+		bufs = append(bufs, e.b[prev:])
+	}
+	return bufs
+}
+
+func (e *ScatterEncoder) PutBool(in bool) {
+	if in {
+		e.b = append(e.b, 1)
+	} else {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *ScatterEncoder) PutInt8(in int8) {
+	e.b = append(e.b, byte(in))
+}
+
+func (e *ScatterEncoder) PutInt16(in int16) {
+	e.b = append(e.b, 0, 0)
+	Encoding.PutUint16(e.b[len(e.b)-2:], uint16(in))
+}
+
+func (e *ScatterEncoder) PutInt32(in int32) {
+	e.b = append(e.b, 0, 0, 0, 0)
+	Encoding.PutUint32(e.b[len(e.b)-4:], uint32(in))
+}
+
+func (e *ScatterEncoder) PutInt64(in int64) {
+	e.b = append(e.b, 0, 0, 0, 0, 0, 0, 0, 0)
+	Encoding.PutUint64(e.b[len(e.b)-8:], uint64(in))
+}
+
+func (e *ScatterEncoder) PutArrayLength(in int) error {
+	if in > math.MaxInt32 {
+		return ErrInvalidArrayLength
+	}
+	e.PutInt32(int32(in))
+	return nil
+}
+
+func (e *ScatterEncoder) PutRawBytes(in []byte) error {
+	if len(in) > math.MaxInt32 {
+		return ErrInvalidByteSliceLength
+	}
+	if len(in) >= scatterMinBytes && e.onlySizes() {
+		e.refs = append(e.refs, scatterRef{at: len(e.b), b: in})
+		e.skipped += len(in)
+		return nil
+	}
+	e.b = append(e.b, in...)
+	return nil
+}
+
+func (e *ScatterEncoder) PutBytes(in []byte) error {
+	if in == nil {
+		e.PutInt32(-1)
+		return nil
+	}
+	e.PutInt32(int32(len(in)))
+	return e.PutRawBytes(in)
+}
+
+func (e *ScatterEncoder) PutString(in string) error {
+	if len(in) > math.MaxInt16 {
+		return ErrInvalidStringLength
+	}
+	e.PutInt16(int16(len(in)))
+	e.b = append(e.b, in...)
+	return nil
+}
+
+func (e *ScatterEncoder) PutNullableString(in *string) error {
+	if in == nil {
+		e.PutInt16(-1)
+		return nil
+	}
+	return e.PutString(*in)
+}
+
+func (e *ScatterEncoder) PutStringArray(in []string) error {
+	if err := e.PutArrayLength(len(in)); err != nil {
+		return err
+	}
+	for _, val := range in {
+		if err := e.PutString(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ScatterEncoder) PutInt32Array(in []int32) error {
+	if err := e.PutArrayLength(len(in)); err != nil {
+		return err
+	}
+	for _, val := range in {
+		e.PutInt32(val)
+	}
+	return nil
+}
+
+func (e *ScatterEncoder) PutInt64Array(in []int64) error {
+	if err := e.PutArrayLength(len(in)); err != nil {
+		return err
+	}
+	for _, val := range in {
+		e.PutInt64(val)
+	}
+	return nil
+}
+
+func (e *ScatterEncoder) Push(pe PushEncoder) {
+	pe.SaveOffset(len(e.b))
+	e.stack = append(e.stack, scatterPush{pe: pe, at: len(e.b), off: len(e.b) + e.skipped})
+	e.b = append(e.b, make([]byte, pe.ReserveSize())...)
+}
+
+func (e *ScatterEncoder) Pop() {
+	p := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	if _, ok := p.pe.(*SizeField); ok {
+		// count the referenced slices in the size
+		Encoding.PutUint32(e.b[p.at:], uint32(len(e.b)+e.skipped-p.off-4))
+		return
+	}
+	p.pe.Fill(len(e.b), e.b)
+}
+
+// onlySizes returns whether every field pushed is a size field, so slices can
+// be referenced.
+func (e *ScatterEncoder) onlySizes() bool {
+	for _, p := range e.stack {
+		if _, ok := p.pe.(*SizeField); !ok {
+			return false
+		}
+	}
+	return true
+}
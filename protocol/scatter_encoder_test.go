@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeBuffers(t *testing.T) {
+	req := require.New(t)
+	recordSet := bytes.Repeat([]byte{1}, 2*scatterMinBytes)
+	res := Response{CorrelationID: 1, Body: &FetchResponse{
+		APIVersion: 1,
+		Responses: FetchTopicResponses{{
+			Topic: "topic",
+			PartitionResponses: FetchPartitionResponses{
+				{Partition: 0, RecordSet: recordSet},
+				{Partition: 1, RecordSet: []byte("small")},
+				{Partition: 2, RecordSet: recordSet},
+			},
+		}},
+	}}
+
+	exp, err := Encode(res)
+	req.NoError(err)
+	bufs, err := EncodeBuffers(res)
+	req.NoError(err)
+
+	// the large record sets are referenced rather than copied
+	var refs int
+	for _, b := range bufs {
+		if len(b) > 0 && &b[0] == &recordSet[0] {
+			refs++
+		}
+	}
+	req.Equal(2, refs)
+
+	var act bytes.Buffer
+	_, err = bufs.WriteTo(&act)
+	req.NoError(err)
+	req.Equal(exp, act.Bytes())
+}
@@ -0,0 +1,126 @@
+package protocol
+
+// Acknowledgement types for records acquired by share group members.
+const (
+	// AcknowledgeAccept marks the record as processed.
+	AcknowledgeAccept int8 = 1
+	// AcknowledgeRelease makes the record available to be delivered again.
+	AcknowledgeRelease int8 = 2
+	// AcknowledgeReject marks the record as unprocessable so it isn't
+	// delivered again.
+	AcknowledgeReject int8 = 3
+)
+
+// ShareAcknowledgeRequest is a Jocko extension for share group members to
+// acknowledge the records they acquired with share fetches.
+type ShareAcknowledgeRequest struct {
+	APIVersion int16
+
+	GroupID  string
+	MemberID string
+	Topics   []*ShareAcknowledgeTopic
+}
+
+type ShareAcknowledgeTopic struct {
+	Topic      string
+	Partitions []*ShareAcknowledgePartition
+}
+
+type ShareAcknowledgePartition struct {
+	Partition        int32
+	Acknowledgements []*ShareAcknowledgement
+}
+
+type ShareAcknowledgement struct {
+	Offset int64
+	Type   int8
+}
+
+func (r *ShareAcknowledgeRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutString(r.GroupID); err != nil {
+		return err
+	}
+	if err = e.PutString(r.MemberID); err != nil {
+		return err
+	}
+	if err = e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			if err = e.PutArrayLength(len(p.Acknowledgements)); err != nil {
+				return err
+			}
+			for _, a := range p.Acknowledgements {
+				e.PutInt64(a.Offset)
+				e.PutInt8(a.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *ShareAcknowledgeRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.GroupID, err = d.String(); err != nil {
+		return err
+	}
+	if r.MemberID, err = d.String(); err != nil {
+		return err
+	}
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*ShareAcknowledgeTopic, topicCount)
+	for i := range r.Topics {
+		t := &ShareAcknowledgeTopic{}
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*ShareAcknowledgePartition, partitionCount)
+		for j := range t.Partitions {
+			p := &ShareAcknowledgePartition{}
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			ackCount, err := d.ArrayLength()
+			if err != nil {
+				return err
+			}
+			p.Acknowledgements = make([]*ShareAcknowledgement, ackCount)
+			for k := range p.Acknowledgements {
+				a := &ShareAcknowledgement{}
+				if a.Offset, err = d.Int64(); err != nil {
+					return err
+				}
+				if a.Type, err = d.Int8(); err != nil {
+					return err
+				}
+				p.Acknowledgements[k] = a
+			}
+			t.Partitions[j] = p
+		}
+		r.Topics[i] = t
+	}
+	return nil
+}
+
+func (r *ShareAcknowledgeRequest) Key() int16 {
+	return ShareAcknowledgeKey
+}
+
+func (r *ShareAcknowledgeRequest) Version() int16 {
+	return r.APIVersion
+}
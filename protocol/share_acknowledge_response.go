@@ -0,0 +1,76 @@
+package protocol
+
+type ShareAcknowledgeResponse struct {
+	APIVersion int16
+
+	Responses []*ShareAcknowledgeTopicResponse
+}
+
+type ShareAcknowledgeTopicResponse struct {
+	Topic      string
+	Partitions []*ShareAcknowledgePartitionResponse
+}
+
+type ShareAcknowledgePartitionResponse struct {
+	Partition int32
+	ErrorCode int16
+}
+
+func (r *ShareAcknowledgeResponse) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Responses)); err != nil {
+		return err
+	}
+	for _, t := range r.Responses {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt16(p.ErrorCode)
+		}
+	}
+	return nil
+}
+
+func (r *ShareAcknowledgeResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Responses = make([]*ShareAcknowledgeTopicResponse, topicCount)
+	for i := range r.Responses {
+		t := &ShareAcknowledgeTopicResponse{}
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*ShareAcknowledgePartitionResponse, partitionCount)
+		for j := range t.Partitions {
+			p := &ShareAcknowledgePartitionResponse{}
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		r.Responses[i] = t
+	}
+	return nil
+}
+
+func (r *ShareAcknowledgeResponse) Key() int16 {
+	return ShareAcknowledgeKey
+}
+
+func (r *ShareAcknowledgeResponse) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,79 @@
+package protocol
+
+// ShareFetchRequest is a Jocko extension for consuming as a member of a share
+// group. Members of a share group consume the same partitions and each record
+// is acquired by one member at a time, until the member acknowledges it or
+// its lock times out and the record's delivered again.
+type ShareFetchRequest struct {
+	APIVersion int16
+
+	GroupID  string
+	MemberID string
+	// MaxRecords is the max number of records to acquire from each partition.
+	MaxRecords int32
+	Topics     []*ShareFetchTopic
+}
+
+type ShareFetchTopic struct {
+	Topic      string
+	Partitions []int32
+}
+
+func (r *ShareFetchRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutString(r.GroupID); err != nil {
+		return err
+	}
+	if err = e.PutString(r.MemberID); err != nil {
+		return err
+	}
+	e.PutInt32(r.MaxRecords)
+	if err = e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutInt32Array(t.Partitions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ShareFetchRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.GroupID, err = d.String(); err != nil {
+		return err
+	}
+	if r.MemberID, err = d.String(); err != nil {
+		return err
+	}
+	if r.MaxRecords, err = d.Int32(); err != nil {
+		return err
+	}
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*ShareFetchTopic, topicCount)
+	for i := range r.Topics {
+		t := &ShareFetchTopic{}
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if t.Partitions, err = d.Int32Array(); err != nil {
+			return err
+		}
+		r.Topics[i] = t
+	}
+	return nil
+}
+
+func (r *ShareFetchRequest) Key() int16 {
+	return ShareFetchKey
+}
+
+func (r *ShareFetchRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,119 @@
+package protocol
+
+type ShareFetchResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+	Responses []*ShareFetchTopicResponse
+}
+
+type ShareFetchTopicResponse struct {
+	Topic      string
+	Partitions []*ShareFetchPartitionResponse
+}
+
+type ShareFetchPartitionResponse struct {
+	Partition int32
+	ErrorCode int16
+	// RecordSet has the message sets acquired by the member.
+	RecordSet       []byte
+	AcquiredRecords []*AcquiredRecord
+}
+
+// AcquiredRecord is a record acquired by a share group member and how many
+// times it's been delivered, including this delivery.
+type AcquiredRecord struct {
+	Offset        int64
+	DeliveryCount int16
+}
+
+func (r *ShareFetchResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
+	if err = e.PutArrayLength(len(r.Responses)); err != nil {
+		return err
+	}
+	for _, t := range r.Responses {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt16(p.ErrorCode)
+			if err = e.PutBytes(p.RecordSet); err != nil {
+				return err
+			}
+			if err = e.PutArrayLength(len(p.AcquiredRecords)); err != nil {
+				return err
+			}
+			for _, a := range p.AcquiredRecords {
+				e.PutInt64(a.Offset)
+				e.PutInt16(a.DeliveryCount)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *ShareFetchResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Responses = make([]*ShareFetchTopicResponse, topicCount)
+	for i := range r.Responses {
+		t := &ShareFetchTopicResponse{}
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*ShareFetchPartitionResponse, partitionCount)
+		for j := range t.Partitions {
+			p := &ShareFetchPartitionResponse{}
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+			if p.RecordSet, err = d.Bytes(); err != nil {
+				return err
+			}
+			acquiredCount, err := d.ArrayLength()
+			if err != nil {
+				return err
+			}
+			p.AcquiredRecords = make([]*AcquiredRecord, acquiredCount)
+			for k := range p.AcquiredRecords {
+				a := &AcquiredRecord{}
+				if a.Offset, err = d.Int64(); err != nil {
+					return err
+				}
+				if a.DeliveryCount, err = d.Int16(); err != nil {
+					return err
+				}
+				p.AcquiredRecords[k] = a
+			}
+			t.Partitions[j] = p
+		}
+		r.Responses[i] = t
+	}
+	return nil
+}
+
+func (r *ShareFetchResponse) Key() int16 {
+	return ShareFetchKey
+}
+
+func (r *ShareFetchResponse) Version() int16 {
+	return r.APIVersion
+}
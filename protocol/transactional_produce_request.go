@@ -0,0 +1,50 @@
+package protocol
+
+// TransactionalProduceRequest is a Jocko extension wrapping a transactional
+// producer's produce request with the producer's session. Messages before
+// record batches don't have producer IDs, so it's how the broker tells the
+// producer's current instance from fenced ones. Transactional messages are
+// only accepted in these requests.
+type TransactionalProduceRequest struct {
+	APIVersion int16
+
+	ProducerID    int64
+	ProducerEpoch int16
+	// Produce is the produce request, with the producer's TransactionalID.
+	Produce *ProduceRequest
+}
+
+func (r *TransactionalProduceRequest) Encode(e PacketEncoder) (err error) {
+	e.PutInt64(r.ProducerID)
+	e.PutInt16(r.ProducerEpoch)
+	e.PutInt16(r.Produce.APIVersion)
+	return r.Produce.Encode(e)
+}
+
+func (r *TransactionalProduceRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	if r.ProducerID, err = d.Int64(); err != nil {
+		return err
+	}
+	if r.ProducerEpoch, err = d.Int16(); err != nil {
+		return err
+	}
+	produceVersion, err := d.Int16()
+	if err != nil {
+		return err
+	}
+	// the produce can only be decoded if its version's one the broker knows
+	if !SupportsVersion(ProduceKey, produceVersion) {
+		return ErrUnsupportedVersion
+	}
+	r.Produce = &ProduceRequest{}
+	return r.Produce.Decode(d, produceVersion)
+}
+
+func (r *TransactionalProduceRequest) Key() int16 {
+	return TransactionalProduceKey
+}
+
+func (r *TransactionalProduceRequest) Version() int16 {
+	return r.APIVersion
+}
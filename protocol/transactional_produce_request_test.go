@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionalProduceRequest(t *testing.T) {
+	req := require.New(t)
+	transactionalID := "txn"
+	exp := &TransactionalProduceRequest{
+		ProducerID:    7,
+		ProducerEpoch: 2,
+		Produce: &ProduceRequest{
+			APIVersion:      3,
+			TransactionalID: &transactionalID,
+			Acks:            -1,
+			Timeout:         time.Second,
+			TopicData:       []*TopicData{{Topic: "test", Data: []*Data{{Partition: 0, RecordSet: []byte{1, 2, 3}}}}},
+		},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act TransactionalProduceRequest
+	req.NoError(Decode(b, &act, exp.Version()))
+	req.Equal(exp, &act)
+
+	// the wrapped produce is laid out as Kafka's, the session's only in the
+	// wrapper
+	produce, err := Encode(exp.Produce)
+	req.NoError(err)
+	req.Equal(produce, b[len(b)-len(produce):])
+
+	// a produce version the broker doesn't know can't be decoded
+	exp.Produce.APIVersion = 100
+	b, err = Encode(exp)
+	req.NoError(err)
+	req.Equal(ErrUnsupportedVersion, Decode(b, &act, exp.Version()))
+}
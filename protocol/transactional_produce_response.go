@@ -0,0 +1,30 @@
+package protocol
+
+type TransactionalProduceResponse struct {
+	APIVersion int16
+
+	Produce *ProduceResponse
+}
+
+func (r *TransactionalProduceResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.Produce.APIVersion)
+	return r.Produce.Encode(e)
+}
+
+func (r *TransactionalProduceResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	produceVersion, err := d.Int16()
+	if err != nil {
+		return err
+	}
+	r.Produce = &ProduceResponse{}
+	return r.Produce.Decode(d, produceVersion)
+}
+
+func (r *TransactionalProduceResponse) Key() int16 {
+	return TransactionalProduceKey
+}
+
+func (r *TransactionalProduceResponse) Version() int16 {
+	return r.APIVersion
+}
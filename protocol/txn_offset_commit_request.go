@@ -0,0 +1,109 @@
+package protocol
+
+// TxnOffsetCommitRequest commits the group's offsets with the producer's
+// ongoing transaction, so they're committed if it is and dropped if it's
+// aborted.
+type TxnOffsetCommitRequest struct {
+	APIVersion int16
+
+	TransactionalID string
+	GroupID         string
+	ProducerID      int64
+	ProducerEpoch   int16
+	Topics          []TxnOffsetCommitTopicRequest
+}
+
+type TxnOffsetCommitTopicRequest struct {
+	Topic      string
+	Partitions []TxnOffsetCommitPartitionRequest
+}
+
+type TxnOffsetCommitPartitionRequest struct {
+	Partition int32
+	Offset    int64
+	Metadata  *string
+}
+
+func (r *TxnOffsetCommitRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutString(r.TransactionalID); err != nil {
+		return err
+	}
+	if err = e.PutString(r.GroupID); err != nil {
+		return err
+	}
+	e.PutInt64(r.ProducerID)
+	e.PutInt16(r.ProducerEpoch)
+	if err = e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt64(p.Offset)
+			if err = e.PutNullableString(p.Metadata); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *TxnOffsetCommitRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+
+	if r.TransactionalID, err = d.String(); err != nil {
+		return err
+	}
+	if r.GroupID, err = d.String(); err != nil {
+		return err
+	}
+	if r.ProducerID, err = d.Int64(); err != nil {
+		return err
+	}
+	if r.ProducerEpoch, err = d.Int16(); err != nil {
+		return err
+	}
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]TxnOffsetCommitTopicRequest, topicCount)
+	for i := range r.Topics {
+		t := &r.Topics[i]
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]TxnOffsetCommitPartitionRequest, partitionCount)
+		for j := range t.Partitions {
+			p := &t.Partitions[j]
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.Offset, err = d.Int64(); err != nil {
+				return err
+			}
+			if p.Metadata, err = d.NullableString(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *TxnOffsetCommitRequest) Key() int16 {
+	return TxnOffsetCommitKey
+}
+
+func (r *TxnOffsetCommitRequest) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxnOffsetCommitRequest(t *testing.T) {
+	req := require.New(t)
+	metadata := "metadata"
+	exp := &TxnOffsetCommitRequest{
+		TransactionalID: "txn",
+		GroupID:         "group",
+		ProducerID:      10,
+		ProducerEpoch:   2,
+		Topics: []TxnOffsetCommitTopicRequest{{
+			Topic: "test",
+			Partitions: []TxnOffsetCommitPartitionRequest{
+				{Partition: 0, Offset: 100, Metadata: &metadata},
+				{Partition: 1, Offset: 5},
+			},
+		}},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act TxnOffsetCommitRequest
+	req.NoError(Decode(b, &act, exp.Version()))
+	req.Equal(exp, &act)
+
+	end := &EndTxnRequest{TransactionalID: "txn", ProducerID: 10, ProducerEpoch: 2, Committed: true}
+	b, err = Encode(end)
+	req.NoError(err)
+	var actEnd EndTxnRequest
+	req.NoError(Decode(b, &actEnd, end.Version()))
+	req.Equal(end, &actEnd)
+}
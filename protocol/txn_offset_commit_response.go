@@ -0,0 +1,74 @@
+package protocol
+
+import "time"
+
+type TxnOffsetCommitResponse struct {
+	APIVersion int16
+
+	ThrottleTime time.Duration
+	Responses    []OffsetCommitTopicResponse
+}
+
+func (r *TxnOffsetCommitResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt32(int32(r.ThrottleTime / time.Millisecond))
+	if err = e.PutArrayLength(len(r.Responses)); err != nil {
+		return err
+	}
+	for _, t := range r.Responses {
+		if err = e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err = e.PutArrayLength(len(t.PartitionResponses)); err != nil {
+			return err
+		}
+		for _, p := range t.PartitionResponses {
+			e.PutInt32(p.Partition)
+			e.PutInt16(p.ErrorCode)
+		}
+	}
+	return nil
+}
+
+func (r *TxnOffsetCommitResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+
+	throttle, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	r.ThrottleTime = time.Duration(throttle) * time.Millisecond
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Responses = make([]OffsetCommitTopicResponse, topicCount)
+	for i := range r.Responses {
+		t := &r.Responses[i]
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.PartitionResponses = make([]OffsetCommitPartitionResponse, partitionCount)
+		for j := range t.PartitionResponses {
+			p := &t.PartitionResponses[j]
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *TxnOffsetCommitResponse) Key() int16 {
+	return TxnOffsetCommitKey
+}
+
+func (r *TxnOffsetCommitResponse) Version() int16 {
+	return r.APIVersion
+}
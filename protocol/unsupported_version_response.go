@@ -0,0 +1,27 @@
+package protocol
+
+// UnsupportedVersionResponse is the response to a request for an API or a
+// version of one that the broker doesn't support, other than ApiVersions. It's
+// only the error code since the broker can't encode the response in a version
+// it doesn't know. Clients that pick versions with ApiVersions first never get
+// it.
+type UnsupportedVersionResponse struct {
+	APIVersion int16
+
+	ErrorCode int16
+}
+
+func (r *UnsupportedVersionResponse) Encode(e PacketEncoder) error {
+	e.PutInt16(r.ErrorCode)
+	return nil
+}
+
+func (r *UnsupportedVersionResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	r.ErrorCode, err = d.Int16()
+	return err
+}
+
+func (r *UnsupportedVersionResponse) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateMetadataRequest(t *testing.T) {
+	req := require.New(t)
+	exp := &UpdateMetadataRequest{
+		ControllerID:    1,
+		ControllerEpoch: 2,
+		PartitionStates: []*UpdateMetadataPartitionState{{
+			Topic:           "test_topic",
+			Partition:       3,
+			ControllerEpoch: 2,
+			Leader:          1,
+			LeaderEpoch:     4,
+			ISR:             []int32{1, 2},
+			ZKVersion:       5,
+			Replicas:        []int32{1, 2, 3},
+		}},
+		LiveBrokers: []*UpdateMetadataBroker{{
+			ID:   1,
+			Host: "localhost",
+			Port: 9092,
+		}},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	var act UpdateMetadataRequest
+	err = Decode(b, &act, exp.Version())
+	req.NoError(err)
+	req.Equal(exp, &act)
+}
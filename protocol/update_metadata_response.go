@@ -1,12 +1,15 @@
 package protocol
 
 type UpdateMetadataResponse struct {
+	ErrorCode int16
 }
 
 func (r *UpdateMetadataResponse) Encode(e PacketEncoder) (err error) {
+	e.PutInt16(r.ErrorCode)
 	return nil
 }
 
 func (r *UpdateMetadataResponse) Decode(d PacketDecoder, version int16) (err error) {
-	return nil
+	r.ErrorCode, err = d.Int16()
+	return err
 }
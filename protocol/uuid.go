@@ -0,0 +1,30 @@
+package protocol
+
+import "encoding/binary"
+
+// UUID is a 128-bit identifier, e.g. a topic ID. The zero UUID means unset.
+type UUID [16]byte
+
+// IsZero returns true if the UUID is unset.
+func (u UUID) IsZero() bool {
+	return u == UUID{}
+}
+
+func encodeUUID(e PacketEncoder, u UUID) {
+	e.PutInt64(int64(binary.BigEndian.Uint64(u[:8])))
+	e.PutInt64(int64(binary.BigEndian.Uint64(u[8:])))
+}
+
+func decodeUUID(d PacketDecoder) (u UUID, err error) {
+	hi, err := d.Int64()
+	if err != nil {
+		return u, err
+	}
+	lo, err := d.Int64()
+	if err != nil {
+		return u, err
+	}
+	binary.BigEndian.PutUint64(u[:8], uint64(hi))
+	binary.BigEndian.PutUint64(u[8:], uint64(lo))
+	return u, nil
+}
@@ -0,0 +1,96 @@
+package protocol
+
+// WriteTxnMarkersRequest asks a partition's leader to write the markers ending
+// transactions. Only brokers send it: clients can't produce markers.
+type WriteTxnMarkersRequest struct {
+	APIVersion int16
+
+	Markers []*WritableTxnMarker
+}
+
+type WritableTxnMarker struct {
+	ProducerID    int64
+	ProducerEpoch int16
+	// Committed is true to commit the transaction, false to abort it.
+	Committed        bool
+	Topics           []*WritableTxnMarkerTopic
+	CoordinatorEpoch int32
+}
+
+type WritableTxnMarkerTopic struct {
+	Topic      string
+	Partitions []int32
+}
+
+func (r *WriteTxnMarkersRequest) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Markers)); err != nil {
+		return err
+	}
+	for _, m := range r.Markers {
+		e.PutInt64(m.ProducerID)
+		e.PutInt16(m.ProducerEpoch)
+		e.PutBool(m.Committed)
+		if err = e.PutArrayLength(len(m.Topics)); err != nil {
+			return err
+		}
+		for _, t := range m.Topics {
+			if err = e.PutString(t.Topic); err != nil {
+				return err
+			}
+			if err = e.PutInt32Array(t.Partitions); err != nil {
+				return err
+			}
+		}
+		e.PutInt32(m.CoordinatorEpoch)
+	}
+	return nil
+}
+
+func (r *WriteTxnMarkersRequest) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Markers = make([]*WritableTxnMarker, n)
+	for i := range r.Markers {
+		m := &WritableTxnMarker{}
+		if m.ProducerID, err = d.Int64(); err != nil {
+			return err
+		}
+		if m.ProducerEpoch, err = d.Int16(); err != nil {
+			return err
+		}
+		if m.Committed, err = d.Bool(); err != nil {
+			return err
+		}
+		topics, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		m.Topics = make([]*WritableTxnMarkerTopic, topics)
+		for j := range m.Topics {
+			t := &WritableTxnMarkerTopic{}
+			if t.Topic, err = d.String(); err != nil {
+				return err
+			}
+			if t.Partitions, err = d.Int32Array(); err != nil {
+				return err
+			}
+			m.Topics[j] = t
+		}
+		if m.CoordinatorEpoch, err = d.Int32(); err != nil {
+			return err
+		}
+		r.Markers[i] = m
+	}
+	return nil
+}
+
+func (r *WriteTxnMarkersRequest) Key() int16 {
+	return WriteTxnMarkersKey
+}
+
+func (r *WriteTxnMarkersRequest) Version() int16 {
+	return r.APIVersion
+}
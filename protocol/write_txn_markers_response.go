@@ -0,0 +1,99 @@
+package protocol
+
+type WriteTxnMarkersResponse struct {
+	APIVersion int16
+
+	Markers []*WritableTxnMarkerResult
+}
+
+type WritableTxnMarkerResult struct {
+	ProducerID int64
+	Topics     []*WritableTxnMarkerTopicResult
+}
+
+type WritableTxnMarkerTopicResult struct {
+	Topic      string
+	Partitions []*WritableTxnMarkerPartitionResult
+}
+
+type WritableTxnMarkerPartitionResult struct {
+	Partition int32
+	ErrorCode int16
+}
+
+func (r *WriteTxnMarkersResponse) Encode(e PacketEncoder) (err error) {
+	if err = e.PutArrayLength(len(r.Markers)); err != nil {
+		return err
+	}
+	for _, m := range r.Markers {
+		e.PutInt64(m.ProducerID)
+		if err = e.PutArrayLength(len(m.Topics)); err != nil {
+			return err
+		}
+		for _, t := range m.Topics {
+			if err = e.PutString(t.Topic); err != nil {
+				return err
+			}
+			if err = e.PutArrayLength(len(t.Partitions)); err != nil {
+				return err
+			}
+			for _, p := range t.Partitions {
+				e.PutInt32(p.Partition)
+				e.PutInt16(p.ErrorCode)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *WriteTxnMarkersResponse) Decode(d PacketDecoder, version int16) (err error) {
+	r.APIVersion = version
+	n, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Markers = make([]*WritableTxnMarkerResult, n)
+	for i := range r.Markers {
+		m := &WritableTxnMarkerResult{}
+		if m.ProducerID, err = d.Int64(); err != nil {
+			return err
+		}
+		topics, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		m.Topics = make([]*WritableTxnMarkerTopicResult, topics)
+		for j := range m.Topics {
+			t := &WritableTxnMarkerTopicResult{}
+			if t.Topic, err = d.String(); err != nil {
+				return err
+			}
+			partitions, err := d.ArrayLength()
+			if err != nil {
+				return err
+			}
+			t.Partitions = make([]*WritableTxnMarkerPartitionResult, partitions)
+			for k := range t.Partitions {
+				p := &WritableTxnMarkerPartitionResult{}
+				if p.Partition, err = d.Int32(); err != nil {
+					return err
+				}
+				if p.ErrorCode, err = d.Int16(); err != nil {
+					return err
+				}
+				t.Partitions[k] = p
+			}
+			m.Topics[j] = t
+		}
+		r.Markers[i] = m
+	}
+	return nil
+}
+
+func (r *WriteTxnMarkersResponse) Key() int16 {
+	return WriteTxnMarkersKey
+}
+
+func (r *WriteTxnMarkersResponse) Version() int16 {
+	return r.APIVersion
+}
@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// offsetStore commits subscriptions' offsets to files, one per subscription
+// partition, so deliveries resume where they left off after a restart.
+type offsetStore struct {
+	dir string
+}
+
+func newOffsetStore(dir string) (*offsetStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("webhook: offsets dir is required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &offsetStore{dir: dir}, nil
+}
+
+// get returns the next offset to deliver, or 0 if none has been committed.
+func (s *offsetStore) get(sub string, partition int32) (int64, error) {
+	b, err := ioutil.ReadFile(s.path(sub, partition))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// commit writes the offset to a temp file and renames it over the old one, so
+// a crash leaves either the old or the new offset and never a partial one.
+func (s *offsetStore) commit(sub string, partition int32, offset int64) error {
+	path := s.path(sub, partition)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *offsetStore) path(sub string, partition int32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%d.offset", sub, partition))
+}
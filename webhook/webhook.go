@@ -0,0 +1,522 @@
+// Package webhook pushes records from topics to HTTP webhooks, for consumers
+// that can't hold a connection open like serverless functions. It's run with
+// the jocko webhook command.
+//
+// Delivery is at-least-once: each subscription commits its offset in a
+// partition only after the webhook accepted the records before it. A record the
+// webhook keeps failing is retried with backoff and then produced to the
+// subscription's dead-letter topic, if it has one, so the rest of the partition
+// isn't held up. Dead letters with keys are partitioned by their key like the
+// client's hash partitioner, so they're in the same partition as the key's
+// other dead letters, and the others go to the partition with the source
+// partition's number, modulo the dead-letter topic's partitions.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/client"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/jocko"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultMaxRetries   = 5
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 30 * time.Second
+	fetchMaxWait        = 500 * time.Millisecond
+	fetchMaxBytes       = 1 << 20
+	requestTimeout      = 10 * time.Second
+	// maxMessageSetBytes is the biggest message set a fetch is grown to when
+	// one doesn't fit in fetchMaxBytes.
+	maxMessageSetBytes = 64 << 20
+)
+
+// Client is the subset of a broker connection used to push records.
+type Client interface {
+	Metadata(*protocol.MetadataRequest) (*protocol.MetadataResponse, error)
+	Fetch(*protocol.FetchRequest) (*protocol.FetchResponse, error)
+	Produce(*protocol.ProduceRequest) (*protocol.ProduceResponse, error)
+	Close() error
+}
+
+// Subscription pushes a topic's records to a webhook.
+type Subscription struct {
+	// Name identifies the subscription's committed offsets.
+	Name string
+	// Topic to push records from.
+	Topic string
+	// Partitions to push records from. Defaults to all of the topic's partitions.
+	Partitions []int32
+	// URL of the webhook records are POSTed to, one at a time.
+	URL string
+	// MaxRetries is how many times a failed delivery is retried before the
+	// record goes to the dead-letter topic. Defaults to 5.
+	MaxRetries int
+	// RetryBackoff is how long to wait before the first retry; it doubles with
+	// each retry after that. Defaults to 100ms.
+	RetryBackoff time.Duration
+	// DeadLetterTopic is where records are produced when they run out of
+	// retries. If it's empty, failed records are retried until they succeed.
+	DeadLetterTopic string
+}
+
+// ParseSubscription parses a subscription from its fields as whitespace
+// separated key=value pairs, e.g.
+// "name=orders topic=orders url=http://localhost/orders dead-letter-topic=orders.dlq".
+// The keys are name, topic, url, partitions (separated by commas),
+// max-retries, retry-backoff, and dead-letter-topic. Fields are separated by
+// whitespace since URLs can't have it unescaped, unlike commas or semicolons.
+func ParseSubscription(s string) (Subscription, error) {
+	var sub Subscription
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return sub, fmt.Errorf("webhook: invalid subscription field %q, must be key=value", field)
+		}
+		k, v := kv[0], kv[1]
+		var err error
+		switch k {
+		case "name":
+			sub.Name = v
+		case "topic":
+			sub.Topic = v
+		case "url":
+			sub.URL = v
+		case "partitions":
+			for _, p := range strings.Split(v, ",") {
+				var id int64
+				if id, err = strconv.ParseInt(p, 10, 32); err != nil {
+					break
+				}
+				sub.Partitions = append(sub.Partitions, int32(id))
+			}
+		case "max-retries":
+			sub.MaxRetries, err = strconv.Atoi(v)
+		case "retry-backoff":
+			sub.RetryBackoff, err = time.ParseDuration(v)
+		case "dead-letter-topic":
+			sub.DeadLetterTopic = v
+		default:
+			return sub, fmt.Errorf("webhook: unknown subscription field %q", k)
+		}
+		if err != nil {
+			return sub, fmt.Errorf("webhook: invalid subscription %s: %s", k, err)
+		}
+	}
+	return sub, nil
+}
+
+// Config for the pusher.
+type Config struct {
+	// BrokerAddr is the address of a broker used to look up partition leaders.
+	BrokerAddr string
+	// Subscriptions to push.
+	Subscriptions []Subscription
+	// OffsetsDir is the directory the subscriptions' offsets are committed in.
+	OffsetsDir string
+	// PollInterval is how long to wait before fetching again when a partition
+	// has no new records. Defaults to 1s.
+	PollInterval time.Duration
+	// HTTPClient sends the webhook requests. Defaults to a client with a 10s timeout.
+	HTTPClient *http.Client
+	// Dial opens a connection to the broker at the address. Defaults to jocko.Dial.
+	Dial func(addr string) (Client, error)
+}
+
+// Record is the JSON body POSTed to a webhook. Key and Value are base64 encoded.
+type Record struct {
+	Subscription string `json:"subscription"`
+	Topic        string `json:"topic"`
+	Partition    int32  `json:"partition"`
+	Offset       int64  `json:"offset"`
+	Timestamp    *int64 `json:"timestamp,omitempty"`
+	Key          []byte `json:"key"`
+	Value        []byte `json:"value"`
+}
+
+// DeadLetter is the value of a record produced to a dead-letter topic. The
+// dead-letter record's key is the original record's key.
+type DeadLetter struct {
+	Record
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// Pusher pushes records for its subscriptions.
+type Pusher struct {
+	config      Config
+	offsets     *offsetStore
+	partitioner *client.HashPartitioner
+	shutdownCh  chan struct{}
+	wg          sync.WaitGroup
+}
+
+// New returns a pusher for the config.
+func New(config Config) (*Pusher, error) {
+	if config.PollInterval == 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: requestTimeout}
+	}
+	if config.Dial == nil {
+		config.Dial = func(addr string) (Client, error) {
+			return jocko.Dial("tcp", addr)
+		}
+	}
+	for i := range config.Subscriptions {
+		sub := &config.Subscriptions[i]
+		if sub.Name == "" || sub.Topic == "" || sub.URL == "" {
+			return nil, fmt.Errorf("webhook: subscription needs a name, topic, and url")
+		}
+		if sub.MaxRetries == 0 {
+			sub.MaxRetries = defaultMaxRetries
+		}
+		if sub.RetryBackoff == 0 {
+			sub.RetryBackoff = defaultRetryBackoff
+		}
+	}
+	offsets, err := newOffsetStore(config.OffsetsDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Pusher{
+		config:      config,
+		offsets:     offsets,
+		partitioner: client.NewHashPartitioner(),
+		shutdownCh:  make(chan struct{}),
+	}, nil
+}
+
+// Start pushing records for each subscription's partitions in the background.
+func (p *Pusher) Start() error {
+	for _, sub := range p.config.Subscriptions {
+		partitions := sub.Partitions
+		if len(partitions) == 0 {
+			var err error
+			if partitions, err = p.partitions(sub.Topic); err != nil {
+				return err
+			}
+		}
+		for _, partition := range partitions {
+			p.wg.Add(1)
+			go p.push(sub, partition)
+		}
+	}
+	return nil
+}
+
+// Shutdown stops pushing records and waits for in-flight deliveries to finish.
+func (p *Pusher) Shutdown() error {
+	close(p.shutdownCh)
+	p.wg.Wait()
+	return nil
+}
+
+// push delivers the partition's records to the subscription's webhook from its
+// committed offset onwards.
+func (p *Pusher) push(sub Subscription, partition int32) {
+	defer p.wg.Done()
+
+	offset, err := p.offsets.get(sub.Name, partition)
+	if err != nil {
+		log.Error.Printf("webhook: %s: reading offset for partition %d error: %s", sub.Name, partition, err)
+		return
+	}
+
+	var conn Client
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	maxBytes := int32(fetchMaxBytes)
+	for {
+		if conn == nil {
+			if conn, err = p.dialLeader(sub.Topic, partition); err != nil {
+				log.Error.Printf("webhook: %s: connecting to leader of partition %d error: %s", sub.Name, partition, err)
+				if !p.wait(p.config.PollInterval) {
+					return
+				}
+				continue
+			}
+		}
+		sets, cutOff, err := fetch(conn, sub.Topic, partition, offset, maxBytes)
+		if err != nil {
+			log.Error.Printf("webhook: %s: fetching partition %d error: %s", sub.Name, partition, err)
+			conn.Close()
+			conn = nil
+			if !p.wait(p.config.PollInterval) {
+				return
+			}
+			continue
+		}
+		if len(sets) == 0 && cutOff > 0 {
+			// the next message set's bigger than the fetch, so the fetch is
+			// grown to fit it rather than fetching the same part of it again
+			if cutOff > maxMessageSetBytes {
+				log.Error.Printf("webhook: %s: message set at offset %d of partition %d is %d bytes, more than the most fetched, %d bytes: stopped pushing the partition", sub.Name, offset, partition, cutOff, maxMessageSetBytes)
+				return
+			}
+			maxBytes = cutOff
+			continue
+		}
+		maxBytes = fetchMaxBytes
+		if len(sets) == 0 {
+			if !p.wait(p.config.PollInterval) {
+				return
+			}
+			continue
+		}
+		for _, ms := range sets {
+			if ms.Offset() < offset {
+				continue
+			}
+			for _, m := range ms.Messages() {
+				r := Record{
+					Subscription: sub.Name,
+					Topic:        sub.Topic,
+					Partition:    partition,
+					Offset:       ms.Offset(),
+					Key:          m.Key(),
+					Value:        m.Value(),
+				}
+				if m.MagicByte() > 0 {
+					ts := m.Timestamp()
+					r.Timestamp = &ts
+				}
+				if !p.deliver(sub, r) {
+					return
+				}
+			}
+			offset = ms.Offset() + 1
+			if err := p.offsets.commit(sub.Name, partition, offset); err != nil {
+				log.Error.Printf("webhook: %s: committing offset for partition %d error: %s", sub.Name, partition, err)
+			}
+		}
+	}
+}
+
+// deliver POSTs the record to the webhook, retrying and then dead-lettering it
+// if it fails. It returns false if the pusher shut down before the record was
+// handled.
+func (p *Pusher) deliver(sub Subscription, r Record) bool {
+	body, err := json.Marshal(r)
+	if err != nil {
+		// can't happen, records are always encodable
+		panic(err)
+	}
+	backoff := sub.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err = p.post(sub.URL, body, attempt)
+		if err == nil {
+			return true
+		}
+		log.Debug.Printf("webhook: %s: delivering offset %d of partition %d, attempt %d error: %s", sub.Name, r.Offset, r.Partition, attempt, err)
+		if attempt > sub.MaxRetries && sub.DeadLetterTopic != "" {
+			return p.deadLetter(sub, DeadLetter{Record: r, Attempts: attempt, Error: err.Error()})
+		}
+		if !p.wait(backoff) {
+			return false
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func (p *Pusher) post(url string, body []byte, attempt int) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Jocko-Delivery-Attempt", strconv.Itoa(attempt))
+	res, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// deadLetter produces the failed record to the dead-letter topic, retrying
+// until it's produced or the pusher shuts down.
+func (p *Pusher) deadLetter(sub Subscription, dl DeadLetter) bool {
+	value, err := json.Marshal(dl)
+	if err != nil {
+		panic(err)
+	}
+	b, err := protocol.Encode(&protocol.Message{
+		MagicByte: 1,
+		Timestamp: time.Now(),
+		Key:       dl.Key,
+		Value:     value,
+	})
+	if err != nil {
+		panic(err)
+	}
+	recordSet := commitlog.NewMessageSet(0, b)
+	for {
+		err := p.produce(sub.DeadLetterTopic, dl.Key, dl.Partition, recordSet)
+		if err == nil {
+			return true
+		}
+		log.Error.Printf("webhook: %s: producing to dead-letter topic %s error: %s", sub.Name, sub.DeadLetterTopic, err)
+		if !p.wait(sub.RetryBackoff) {
+			return false
+		}
+	}
+}
+
+// produce produces the record set to the dead-letter topic's partition for
+// the key, or for the source partition if the key's nil.
+func (p *Pusher) produce(topic string, key []byte, source int32, recordSet []byte) error {
+	partitions, err := p.partitions(topic)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	n := int32(len(partitions))
+	partition := source % n
+	if key != nil {
+		// keyed records are only hashed, so the partitioner's safe to share
+		partition = p.partitioner.Partition(topic, key, n)
+	}
+	conn, err := p.dialLeader(topic, partition)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := conn.Produce(&protocol.ProduceRequest{
+		Acks:    -1,
+		Timeout: requestTimeout,
+		TopicData: []*protocol.TopicData{{
+			Topic: topic,
+			Data:  []*protocol.Data{{Partition: partition, RecordSet: recordSet}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	for _, tr := range res.Responses {
+		for _, pr := range tr.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return protocol.Errs[pr.ErrorCode]
+			}
+		}
+	}
+	return nil
+}
+
+// fetch fetches up to maxBytes of the partition's message sets from the
+// offset. If none of them fit, it returns the size of the first, which was cut
+// off.
+func fetch(conn Client, topic string, partition int32, offset int64, maxBytes int32) ([]commitlog.MessageSet, int32, error) {
+	res, err := conn.Fetch(&protocol.FetchRequest{
+		MaxWaitTime: fetchMaxWait,
+		MinBytes:    1,
+		MaxBytes:    maxBytes,
+		Topics: []*protocol.FetchTopic{{
+			Topic: topic,
+			Partitions: []*protocol.FetchPartition{{
+				Partition:   partition,
+				FetchOffset: offset,
+				MaxBytes:    maxBytes,
+			}},
+		}},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	var sets []commitlog.MessageSet
+	var cutOff int32
+	for _, tr := range res.Responses {
+		for _, pr := range tr.PartitionResponses {
+			if pr.ErrorCode != protocol.ErrNone.Code() {
+				return nil, 0, protocol.Errs[pr.ErrorCode]
+			}
+			partitionSets := commitlog.MessageSets(pr.RecordSet)
+			if len(partitionSets) == 0 && len(pr.RecordSet) >= 12 {
+				size := commitlog.MessageSet(pr.RecordSet).Size()
+				if size < 12 {
+					return nil, 0, fmt.Errorf("message set at offset %d has a corrupt size", offset)
+				}
+				if size > maxBytes {
+					cutOff = size
+				}
+			}
+			sets = append(sets, partitionSets...)
+		}
+	}
+	return sets, cutOff, nil
+}
+
+func (p *Pusher) metadata(topic string) (*protocol.MetadataResponse, error) {
+	conn, err := p.config.Dial(p.config.BrokerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Metadata(&protocol.MetadataRequest{Topics: []string{topic}})
+}
+
+func (p *Pusher) partitions(topic string) ([]int32, error) {
+	res, err := p.metadata(topic)
+	if err != nil {
+		return nil, err
+	}
+	var partitions []int32
+	for _, t := range res.TopicMetadata {
+		if t.Topic != topic {
+			continue
+		}
+		if t.TopicErrorCode != protocol.ErrNone.Code() {
+			return nil, protocol.Errs[t.TopicErrorCode]
+		}
+		for _, pm := range t.PartitionMetadata {
+			partitions = append(partitions, pm.PartitionID)
+		}
+	}
+	return partitions, nil
+}
+
+func (p *Pusher) dialLeader(topic string, partition int32) (Client, error) {
+	res, err := p.metadata(topic)
+	if err != nil {
+		return nil, err
+	}
+	leader, err := res.Leader(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return p.config.Dial(leader.Addr())
+}
+
+// wait sleeps for d and returns false if the pusher shut down in the meantime.
+func (p *Pusher) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-p.shutdownCh:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,297 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/testutil/retry"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/client"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// fakeBroker leads every partition and keeps the logs in memory. Topics have
+// one partition unless they're in partitions.
+type fakeBroker struct {
+	mu         sync.Mutex
+	logs       map[topicPartition][][]byte
+	partitions map[string]int32
+}
+
+func (b *fakeBroker) Metadata(req *protocol.MetadataRequest) (*protocol.MetadataResponse, error) {
+	res := &protocol.MetadataResponse{
+		Brokers: []*protocol.Broker{{NodeID: 1, Host: "localhost", Port: 9092}},
+	}
+	for _, t := range req.Topics {
+		n, ok := b.partitions[t]
+		if !ok {
+			n = 1
+		}
+		tm := &protocol.TopicMetadata{Topic: t}
+		for i := int32(0); i < n; i++ {
+			tm.PartitionMetadata = append(tm.PartitionMetadata, &protocol.PartitionMetadata{PartitionID: i, Leader: 1})
+		}
+		res.TopicMetadata = append(res.TopicMetadata, tm)
+	}
+	return res, nil
+}
+
+func (b *fakeBroker) Produce(req *protocol.ProduceRequest) (*protocol.ProduceResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	td := req.TopicData[0]
+	tp := topicPartition{td.Topic, td.Data[0].Partition}
+	ms := commitlog.MessageSet(td.Data[0].RecordSet)
+	ms.PutOffset(int64(len(b.logs[tp])))
+	b.logs[tp] = append(b.logs[tp], ms)
+	return &protocol.ProduceResponse{Responses: []*protocol.ProduceTopicResponse{{
+		Topic:              td.Topic,
+		PartitionResponses: []*protocol.ProducePartitionResponse{{}},
+	}}}, nil
+}
+
+func (b *fakeBroker) Fetch(req *protocol.FetchRequest) (*protocol.FetchResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := req.Topics[0]
+	tp := topicPartition{t.Topic, t.Partitions[0].Partition}
+	var recordSet []byte
+	if offset := t.Partitions[0].FetchOffset; offset < int64(len(b.logs[tp])) {
+		for _, ms := range b.logs[tp][offset:] {
+			recordSet = append(recordSet, ms...)
+		}
+	}
+	if max := int(t.Partitions[0].MaxBytes); len(recordSet) > max {
+		recordSet = recordSet[:max]
+	}
+	return &protocol.FetchResponse{Responses: []*protocol.FetchTopicResponse{{
+		Topic:              t.Topic,
+		PartitionResponses: []*protocol.FetchPartitionResponse{{RecordSet: recordSet}},
+	}}}, nil
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+func (b *fakeBroker) append(t *testing.T, topic string, value string) {
+	b.appendKey(t, topic, 0, nil, value)
+}
+
+func (b *fakeBroker) appendKey(t *testing.T, topic string, partition int32, key []byte, value string) {
+	m, err := protocol.Encode(&protocol.Message{MagicByte: 1, Timestamp: time.Now(), Key: key, Value: []byte(value)})
+	require.NoError(t, err)
+	_, err = b.Produce(&protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+		Topic: topic,
+		Data:  []*protocol.Data{{Partition: partition, RecordSet: commitlog.NewMessageSet(0, m)}},
+	}}})
+	require.NoError(t, err)
+}
+
+func TestPusher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooktest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	broker := &fakeBroker{logs: make(map[topicPartition][][]byte)}
+	broker.append(t, "test-topic", "one")
+	broker.append(t, "test-topic", "bad")
+	broker.append(t, "test-topic", "two")
+
+	var mu sync.Mutex
+	var delivered []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec Record
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&rec))
+		if string(rec.Value) == "bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		delivered = append(delivered, string(rec.Value))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{
+		OffsetsDir:   dir,
+		PollInterval: 10 * time.Millisecond,
+		Subscriptions: []Subscription{{
+			Name:            "sub",
+			Topic:           "test-topic",
+			URL:             srv.URL,
+			MaxRetries:      2,
+			RetryBackoff:    time.Millisecond,
+			DeadLetterTopic: "test-topic.dlq",
+		}},
+		Dial: func(addr string) (Client, error) { return broker, nil },
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+
+	retry.Run(t, func(r *retry.R) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(delivered) != 2 {
+			r.Fatalf("delivered: %v", delivered)
+		}
+	})
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, []string{"one", "two"}, delivered)
+
+	// the failed record was dead-lettered with its attempts
+	broker.mu.Lock()
+	dlq := broker.logs[topicPartition{"test-topic.dlq", 0}]
+	broker.mu.Unlock()
+	require.Equal(t, 1, len(dlq))
+	var dl DeadLetter
+	require.NoError(t, json.Unmarshal(commitlog.MessageSet(dlq[0]).Messages()[0].Value(), &dl))
+	require.Equal(t, "bad", string(dl.Value))
+	require.Equal(t, int64(1), dl.Offset)
+	require.Equal(t, 3, dl.Attempts)
+
+	// the offset was committed past the delivered records
+	offset, err := p.offsets.get("sub", 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), offset)
+}
+
+func TestPusherLargeMessageSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooktest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	broker := &fakeBroker{logs: make(map[topicPartition][][]byte)}
+	// bigger than a fetch, which is grown to fit it
+	large := strings.Repeat("x", fetchMaxBytes+1)
+	broker.append(t, "test-topic", large)
+	broker.append(t, "test-topic", "small")
+
+	var mu sync.Mutex
+	var delivered []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec Record
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&rec))
+		mu.Lock()
+		delivered = append(delivered, len(rec.Value))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{
+		OffsetsDir:    dir,
+		PollInterval:  10 * time.Millisecond,
+		Subscriptions: []Subscription{{Name: "sub", Topic: "test-topic", URL: srv.URL}},
+		Dial:          func(addr string) (Client, error) { return broker, nil },
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	retry.Run(t, func(r *retry.R) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(delivered) != 2 {
+			r.Fatalf("delivered: %v", delivered)
+		}
+	})
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, []int{len(large), len("small")}, delivered)
+}
+
+func TestPusherDeadLetterPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooktest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	broker := &fakeBroker{
+		logs:       make(map[topicPartition][][]byte),
+		partitions: map[string]int32{"test-topic": 3, "test-topic.dlq": 2},
+	}
+	key := []byte("key")
+	broker.appendKey(t, "test-topic", 0, key, "keyed")
+	broker.appendKey(t, "test-topic", 1, nil, "one")
+	broker.appendKey(t, "test-topic", 2, nil, "two")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{
+		OffsetsDir:   dir,
+		PollInterval: 10 * time.Millisecond,
+		Subscriptions: []Subscription{{
+			Name:            "sub",
+			Topic:           "test-topic",
+			URL:             srv.URL,
+			MaxRetries:      1,
+			RetryBackoff:    time.Millisecond,
+			DeadLetterTopic: "test-topic.dlq",
+		}},
+		Dial: func(addr string) (Client, error) { return broker, nil },
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+
+	dlq := func(partition int32) []string {
+		var values []string
+		for _, ms := range broker.logs[topicPartition{"test-topic.dlq", partition}] {
+			var dl DeadLetter
+			require.NoError(t, json.Unmarshal(commitlog.MessageSet(ms).Messages()[0].Value(), &dl))
+			values = append(values, string(dl.Value))
+		}
+		sort.Strings(values)
+		return values
+	}
+	retry.Run(t, func(r *retry.R) {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		if n := len(dlq(0)) + len(dlq(1)); n != 3 {
+			r.Fatalf("dead-lettered: %d", n)
+		}
+	})
+	require.NoError(t, p.Shutdown())
+
+	// unkeyed records go to their source partition's number modulo the
+	// topic's partitions, and keyed ones to their key's hash partition
+	want := map[int32][]string{0: {"two"}, 1: {"one"}}
+	keyed := client.NewHashPartitioner().Partition("test-topic.dlq", key, 2)
+	want[keyed] = append(want[keyed], "keyed")
+	sort.Strings(want[keyed])
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	require.Equal(t, want[0], dlq(0))
+	require.Equal(t, want[1], dlq(1))
+}
+
+func TestParseSubscription(t *testing.T) {
+	sub, err := ParseSubscription("name=sub topic=test-topic url=http://localhost/hook;v=1?a=b,c&d=e partitions=0,2 max-retries=3\tretry-backoff=50ms dead-letter-topic=test-topic.dlq")
+	require.NoError(t, err)
+	require.Equal(t, Subscription{
+		Name:            "sub",
+		Topic:           "test-topic",
+		URL:             "http://localhost/hook;v=1?a=b,c&d=e",
+		Partitions:      []int32{0, 2},
+		MaxRetries:      3,
+		RetryBackoff:    50 * time.Millisecond,
+		DeadLetterTopic: "test-topic.dlq",
+	}, sub)
+
+	for _, s := range []string{"name", "nope=1", "max-retries=x", "partitions=0,x", "retry-backoff=1"} {
+		_, err := ParseSubscription(s)
+		require.Error(t, err, s)
+	}
+}